@@ -3,25 +3,67 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"runtime/debug"
+	"strings"
 	"sync"
-	"syscall"
 	"time"
 )
 
 type ExitHandler = func(context.Context) error
 
+// ExitPhase orders exit handlers. The handlers of a phase run concurrently, once those of
+// the previous phase have completed.
+type ExitPhase int
+
+const (
+	ExitPhaseServers ExitPhase = iota // stop accepting requests
+	ExitPhaseWorkers                  // finish background work (default)
+	ExitPhaseStorage                  // close the database and files
+	numExitPhases
+)
+
+// exitPhaseGrace is how long the handlers of a phase get when an earlier phase has used
+// up the shutdown timeout, so that e.g. the database is still closed
+const exitPhaseGrace = 500 * time.Millisecond
+
+// exitForceCode is the exit code when the program is killed by a third exit signal,
+// like that of a process killed by SIGINT
+const exitForceCode = 130
+
+type exitHandler struct {
+	phase   ExitPhase
+	name    string        // reported when the handler doesn't complete in time
+	site    string        // where the handler was registered, e.g. "server.go:123"
+	timeout time.Duration // of the handler itself; 0 if it has just the shutdown timeout
+	fn      ExitHandler
+}
+
+func (h exitHandler) String() string {
+	if h.site == "" {
+		return h.name
+	}
+	return h.name + " (" + h.site + ")"
+}
+
 var (
 	ExitCh chan struct{} // closes when all exit handlers have completed
 
 	sigch          chan os.Signal
-	exitExitCode   = 0
-	exitHandlersMu sync.Mutex // protects exitHandlers
-	exitHandlers   []ExitHandler
-	exitTimeouts   = map[os.Signal]time.Duration{}
-	exitSignals    = []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM}
+	shutdownCtx    context.Context    // of the exit handlers; cancelled to hurry them up
+	shutdownCancel context.CancelFunc // cancels shutdownCtx
+	shutdownMu     sync.Mutex         // protects shutdownBegan
+	shutdownBegan  bool               // set by beginShutdown
+	exitFinalCode  = 0                // exit code of the program; valid when ExitCh is closed
+	exitHandlersMu sync.Mutex         // protects exitHandlers
+	exitHandlers   []exitHandler
+	exitTimeouts   = map[os.Signal]time.Duration{} // by signal; nil for Shutdown
+	signalHandlers = map[os.Signal][]func(){}      // of HandleSignal
 )
 
 const defaultExitTimeout = 5 * time.Second
@@ -29,107 +71,327 @@ const defaultExitTimeout = 5 * time.Second
 func init() {
 	ExitCh = make(chan struct{})
 	sigch = make(chan os.Signal, 1)
+	shutdownCtx, shutdownCancel = context.WithCancel(context.Background())
 
 	for _, sig := range exitSignals {
 		exitTimeouts[sig] = defaultExitTimeout
 	}
 
 	signal.Notify(sigch, exitSignals...)
-	go func() {
-		sig := <-sigch
-
-		// reset signal handler so that a second signal has the default effect
-		signal.Reset(exitSignals...)
-
-		// log that we are shutting down
-		dlog("shutting down...")
-
-		// create context for shutdown
-		timeout, ok := exitTimeouts[sig]
-		if !ok {
-			timeout = defaultExitTimeout
-		}
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
-		defer cancel() // just in case
-
-		// Note: copy and don't lock to avoid deadlock in case a handler calls RegisterExitHandler
-		handlers := exitHandlers[:]
-		fnch := make(chan struct{}) // "done" signals
-		exitCode := exitExitCode
-
-		// invoke all shutdown handlers in goroutines
-		for _, fn := range handlers {
-			go func(fn ExitHandler) {
-				defer func() {
-					if r := recover(); r != nil {
-						errlog("panic in RegisterExitHandler function: %v\n", r)
-						if DEBUG {
-							debug.PrintStack()
-						}
-						// cancel the shutdown context
-						cancel()
-					}
-				}()
+	go handleExitSignals(sigch)
+}
+
+// exitFunc exits the program once shutdown has completed. Tests replace it, or call
+// runShutdown directly, to observe shutdown without exiting.
+var exitFunc = os.Exit
+
+// handleExitSignals starts shutdown when an exit signal is received from ch, unless it has
+// already begun, e.g. with Shutdown. Signals received while shutting down force exit:
+// the first one hurries shutdown along by cancelling the contexts of the exit handlers
+// and the next one exits right away.
+func handleExitSignals(ch <-chan os.Signal) {
+	forced := false
+	for sig := range ch {
+		if beginShutdown() {
+			go finishShutdown(sig, 0)
+			continue
+		}
+		if forced {
+			exitFunc(exitForceCode)
+			return
+		}
+		forced = true
+		warnlog("forcing exit (1 more Ctrl-C for immediate kill)")
+		shutdownCancel()
+	}
+}
+
+// beginShutdown returns true the first time it's called; the caller then shuts down with
+// finishShutdown. It makes shutdown be started just once, by whichever of Shutdown and
+// an exit signal comes first.
+func beginShutdown() bool {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	if shutdownBegan {
+		return false
+	}
+	shutdownBegan = true
+	return true
+}
+
+// finishShutdown runs the exit handlers, closes ExitCh and exits the program. sig is the
+// signal which started shutdown, or nil for Shutdown(exitCode).
+func finishShutdown(sig os.Signal, exitCode int) {
+	exitCode = runShutdown(shutdownCtx, sig, exitCode)
+	// note: WaitExit, called by goroutines which wait for shutdown, exits with the
+	// same code
+	exitFinalCode = exitCode
+	close(ExitCh)
+	exitFunc(exitCode)
+}
+
+// exitCauseKey is the context key of the exitCause of the contexts of exit handlers
+type exitCauseKey struct{}
+
+// exitCause is what started shutdown
+type exitCause struct {
+	sig  os.Signal // nil for Shutdown
+	code int       // passed to Shutdown
+}
+
+// SignalFromContext returns the signal which started shutdown, given the context of an
+// exit handler. ok is false if shutdown was started by a call to Shutdown.
+func SignalFromContext(ctx context.Context) (sig os.Signal, ok bool) {
+	c, _ := ctx.Value(exitCauseKey{}).(exitCause)
+	return c.sig, c.sig != nil
+}
+
+// ExitCodeFromContext returns the exit code passed to Shutdown, given the context of an
+// exit handler, or 0 if shutdown was started by a signal
+func ExitCodeFromContext(ctx context.Context) int {
+	c, _ := ctx.Value(exitCauseKey{}).(exitCause)
+	return c.code
+}
+
+// detachedContext has the values of its parent context, like the exitCause, but is never
+// done
+type detachedContext struct{ context.Context }
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// runShutdown runs the exit handlers, with the timeout for sig (nil for Shutdown), and
+// returns the exit code of the program: exitCode, or 1 if that is 0 and a handler failed
+// or didn't complete in time. Cancelling ctx makes the handlers
+// hurry up. The handlers can tell what started shutdown with SignalFromContext and
+// ExitCodeFromContext.
+func runShutdown(ctx context.Context, sig os.Signal, exitCode int) int {
+	// Note: copy and don't hold the lock while running handlers, to avoid deadlock in
+	// case a handler calls RegisterExitHandler
+	exitHandlersMu.Lock()
+	handlers := exitHandlers[:len(exitHandlers):len(exitHandlers)]
+	exitHandlersMu.Unlock()
+
+	// log that we are shutting down
+	dlog("shutting down...")
+
+	timeout := GetExitTimeout(sig)
+	ctx = context.WithValue(ctx, exitCauseKey{}, exitCause{sig: sig, code: exitCode})
+	if !runExitHandlers(ctx, handlers, timeout) && exitCode == 0 {
+		exitCode = 1
+	}
+	return exitCode
+}
+
+// runExitHandlers runs handlers phase by phase within timeout, or until ctx is done.
+// It returns false if a handler failed or didn't complete in time. The errors of handlers
+// which failed are logged together at the end.
+//
+// A phase which starts after the timeout has passed or after ctx is done still runs, with
+// a context which expires after exitPhaseGrace.
+func runExitHandlers(ctx context.Context, handlers []exitHandler, timeout time.Duration) bool {
+	ok := true
+	var errs []string
+	deadline := time.Now().Add(timeout)
+	for phase := ExitPhase(0); phase < numExitPhases; phase++ {
+		var hs []exitHandler
+		for _, h := range handlers {
+			if h.phase == phase {
+				hs = append(hs, h)
+			}
+		}
+		if len(hs) == 0 {
+			continue
+		}
+		// note: the remaining time is passed to the handlers as the context's deadline
+		parent, d := ctx, deadline
+		if ctx.Err() != nil || !time.Now().Before(d) {
+			parent, d = detachedContext{ctx}, time.Now().Add(exitPhaseGrace)
+		}
+		phaseCtx, cancel := context.WithDeadline(parent, d)
+		pending, phaseErrs := runExitPhase(phaseCtx, hs)
+		if len(phaseErrs) > 0 {
+			errs = append(errs, phaseErrs...)
+			ok = false
+		}
+		if len(pending) > 0 {
+			if phaseCtx.Err() == context.DeadlineExceeded {
+				warnlog("shutdown timeout (%s); not finished: %s", timeout, strings.Join(pending, ", "))
+			} else {
+				dlog("shutdown: not finished: %s", strings.Join(pending, ", "))
+			}
+			ok = false
+		}
+		cancel()
+	}
+	if len(errs) > 0 {
+		errlog("%d exit %s failed:\n  %s", len(errs), plural(len(errs), "handler", "handlers"),
+			strings.Join(errs, "\n  "))
+	}
+	return ok
+}
+
+// runExitPhase runs the handlers hs concurrently and waits for them to complete, to use up
+// their own timeout, or for ctx to be done. A handler which fails or panics doesn't affect
+// the others. Returns the names and registration sites of the handlers which didn't
+// complete, including those which timed out, and the errors of those which failed.
+func runExitPhase(ctx context.Context, hs []exitHandler) (pending, errs []string) {
+	// "done" signals. A handler which times out and then completes sends two.
+	type exitResult struct {
+		i        int // index of the handler
+		timedout bool
+		err      error
+	}
+	fnch := make(chan exitResult, 2*len(hs))
 
-				// invoke handler and log error
-				if err := fn(ctx); err != nil {
-					if err != context.DeadlineExceeded && err != context.Canceled {
-						errlog("RegisterExitHandler function: %v", err)
+	// invoke all shutdown handlers in goroutines
+	for i, h := range hs {
+		go func(i int, h exitHandler) {
+			hctx := ctx
+			if h.timeout > 0 {
+				var hcancel context.CancelFunc
+				hctx, hcancel = context.WithTimeout(ctx, h.timeout)
+				defer hcancel()
+				go func() {
+					<-hctx.Done()
+					// note: if ctx is done, runExitPhase reports the handler as pending
+					if hctx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+						warnlog("exit handler %s timed out (%s)", h, h.timeout)
+						fnch <- exitResult{i: i, timedout: true} // stop waiting for it
 					}
-					// cancel the shutdown context
-					cancel()
-				} else {
-					// signal to outer function that this handler has completed
-					fnch <- struct{}{}
+				}()
+			}
+			start := time.Now()
+			defer func() {
+				// log completion of a handler which was given up on
+				if d, ok := hctx.Deadline(); ok && time.Now().After(d) {
+					dlog("exit handler %s finished %s after its deadline (ran for %s)",
+						h, time.Since(d).Round(time.Millisecond), time.Since(start).Round(time.Millisecond))
 				}
-			}(fn)
-		}
-
-		// wait for all shutdown handler goroutines to finish
-	wait_loop:
-		for range handlers {
-			select {
-			case <-fnch: // ok
-			case <-ctx.Done():
-				// Context canceled
-				if ctx.Err() == context.DeadlineExceeded {
-					warnlog("shutdown timeout (%s)", timeout)
+			}()
+			defer func() {
+				if r := recover(); r != nil {
+					if DEBUG {
+						debug.PrintStack()
+					}
+					fnch <- exitResult{i: i, err: fmt.Errorf("panic: %v", r)}
 				}
-				if exitCode == 0 {
-					exitCode = 1
+			}()
+
+			// invoke handler and signal to outer function that it has completed
+			fnch <- exitResult{i: i, err: h.fn(hctx)}
+		}(i, h)
+	}
+
+	// wait for all shutdown handler goroutines to finish
+	done := make([]bool, len(hs))
+	for ndone := 0; ndone < len(hs); {
+		select {
+		case r := <-fnch:
+			if done[r.i] {
+				break
+			}
+			done[r.i] = true
+			ndone++
+			if r.timedout {
+				pending = append(pending, hs[r.i].String())
+			} else if r.err == context.DeadlineExceeded || r.err == context.Canceled {
+				// ran out of time; not an error of its own
+				pending = append(pending, hs[r.i].String())
+			} else if r.err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", hs[r.i], r.err))
+			}
+		case <-ctx.Done():
+			for i, h := range hs {
+				if !done[i] {
+					pending = append(pending, h.String())
 				}
-				break wait_loop
 			}
+			return pending, errs
 		}
+	}
+	return pending, errs
+}
 
-		// finished
-		os.Exit(exitCode)
+// HandleSignal makes fn be called each time sig is received. If sig is an exit signal,
+// like SIGHUP, it no longer shuts down the program. Several functions can handle the same
+// signal: they are called in the order they were added, one at a time, on a goroutine
+// which is dedicated to sig, so a signal received while they run is handled afterwards.
+func HandleSignal(sig os.Signal, fn func()) {
+	exitHandlersMu.Lock()
+	for i, s := range exitSignals {
+		if s == sig {
+			exitSignals = append(exitSignals[:i:i], exitSignals[i+1:]...)
+			break
+		}
+	}
+	first := len(signalHandlers[sig]) == 0
+	signalHandlers[sig] = append(signalHandlers[sig], fn)
+	exitHandlersMu.Unlock()
+	if !first {
+		return
+	}
+	signal.Reset(sig) // stop delivering sig to sigch
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig)
+	go func() {
+		for range ch {
+			exitHandlersMu.Lock()
+			fns := signalHandlers[sig]
+			exitHandlersMu.Unlock()
+			for _, fn := range fns {
+				fn()
+			}
+		}
 	}()
 }
 
-// Shutdown is like os.Exit but invokes shutdown handlers before exiting
+// Shutdown is like os.Exit but invokes shutdown handlers before exiting. They run on the
+// calling goroutine.
+// It's safe to call more than once and from any goroutine. If shutdown has already begun,
+// by an earlier call or an exit signal, it just waits for the program to exit, with the
+// exit code of the first one; exitCode is then ignored. Note that an exit handler which
+// calls Shutdown blocks until the shutdown timeout is up.
 func Shutdown(exitCode int) {
-	exitExitCode = exitCode
-	close(sigch)
-	<-ExitCh // never returns
+	if beginShutdown() {
+		finishShutdown(nil, exitCode)
+	}
+	WaitExit()
+}
+
+// WaitExit blocks until shutdown, started by Shutdown or a signal, has completed and
+// then exits the program. It never returns, unless exitFunc doesn't exit.
+func WaitExit() {
+	<-ExitCh
+	exitFunc(exitFinalCode)
 }
 
+// SetExitTimeout sets how long the exit handlers may run when shutdown is started by one
+// of onlySignals, or by any exit signal or Shutdown if none are given. The timeout of a
+// signal which doesn't shut down the program on this platform, like SIGHUP on Windows, is
+// still set, but a warning is logged since it has no effect.
 func SetExitTimeout(timeout time.Duration, onlySignals ...os.Signal) {
+	exitHandlersMu.Lock()
+	defer exitHandlersMu.Unlock()
 	if onlySignals == nil {
-		onlySignals = exitSignals
+		onlySignals = append(exitSignals[:len(exitSignals):len(exitSignals)], nil)
 	}
 	for _, sig := range onlySignals {
-		if _, ok := exitTimeouts[sig]; ok {
-			exitTimeouts[sig] = timeout
+		if _, ok := exitTimeouts[sig]; !ok && sig != nil {
+			warnlog("exit timeout for %v has no effect: not an exit signal", sig)
 		}
+		exitTimeouts[sig] = timeout
 	}
 }
 
+// GetExitTimeout returns how long the exit handlers may run when shutdown is started by
+// signal, or by Shutdown if signal is nil
 func GetExitTimeout(signal os.Signal) time.Duration {
-	if signal != nil {
-		if timeout, ok := exitTimeouts[signal]; ok {
-			return timeout
-		}
+	exitHandlersMu.Lock()
+	defer exitHandlersMu.Unlock()
+	if timeout, ok := exitTimeouts[signal]; ok {
+		return timeout
 	}
 	return defaultExitTimeout
 }
@@ -141,11 +403,36 @@ func GetExitTimeout(signal os.Signal) time.Duration {
 //   func()error
 //   func()
 //
-// A panics inside a handler will cause the context to be cancelled and the
-// panic reported. I.e. a panic inside an exit handler is isolated to that handler
-// but "speeds up" shutdown.
+// An error returned by a handler, or a panic inside it, is reported once all handlers
+// have run and makes the program exit with status 1 (unless Shutdown was called with
+// another non-zero status.) It's isolated to that handler: the others keep running,
+// until they complete or the shutdown timeout is up.
 //
-func RegisterExitHandler(handlerFunc interface{}) {
+// The handler runs in ExitPhaseWorkers (see RegisterExitHandlerWithPhase.)
+//
+// opts may be:
+//   string         the name used in messages about the handler, like that it didn't
+//                  finish in time, along with where it was registered. Defaults to the
+//                  name of the function.
+//   time.Duration  how long the handler may run. Its context expires then, and shutdown
+//                  stops waiting for it, rather than the handler using up the whole
+//                  shutdown timeout.
+//
+func RegisterExitHandler(handlerFunc interface{}, opts ...interface{}) {
+	registerExitHandler(ExitPhaseWorkers, handlerFunc, opts)
+}
+
+// RegisterExitHandlerWithPhase is like RegisterExitHandler but runs the handler in phase,
+// after the handlers of earlier phases have completed. E.g. servers are shut down in
+// ExitPhaseServers so that no requests are handled while the database is being closed in
+// ExitPhaseStorage.
+func RegisterExitHandlerWithPhase(phase ExitPhase, handlerFunc interface{}, opts ...interface{}) {
+	registerExitHandler(phase, handlerFunc, opts)
+}
+
+// registerExitHandler must be called directly by RegisterExitHandler and
+// RegisterExitHandlerWithPhase, for their caller to be recorded as the registration site
+func registerExitHandler(phase ExitPhase, handlerFunc interface{}, opts []interface{}) {
 	var fn ExitHandler
 	if f, ok := handlerFunc.(ExitHandler); ok {
 		fn = f
@@ -169,7 +456,28 @@ func RegisterExitHandler(handlerFunc interface{}) {
 	} else {
 		panic("invalid handler signature (see RegisterExitHandler documentation)")
 	}
+	h := exitHandler{phase: phase, fn: fn}
+	for _, opt := range opts {
+		switch v := opt.(type) {
+		case string:
+			h.name = v
+		case time.Duration:
+			h.timeout = v
+		default:
+			panic(fmt.Sprintf("invalid exit handler option %T", opt))
+		}
+	}
+	if _, file, line, ok := runtime.Caller(2); ok {
+		h.site = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+	if h.name == "" {
+		// e.g. "smolmsg.(*MessageSyncer).Shutdown-fm", without the rest of the package path
+		h.name = runtime.FuncForPC(reflect.ValueOf(handlerFunc).Pointer()).Name()
+		if i := strings.LastIndexByte(h.name, '/'); i != -1 {
+			h.name = h.name[i+1:]
+		}
+	}
 	exitHandlersMu.Lock()
 	defer exitHandlersMu.Unlock()
-	exitHandlers = append(exitHandlers, fn)
+	exitHandlers = append(exitHandlers, h)
 }
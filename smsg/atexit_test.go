@@ -0,0 +1,410 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testExitHandlers removes the exit handlers for a test, and restores them when it ends
+func testExitHandlers(t *testing.T) {
+	exitHandlersMu.Lock()
+	handlers := exitHandlers
+	exitHandlers = nil
+	exitHandlersMu.Unlock()
+	t.Cleanup(func() {
+		exitHandlersMu.Lock()
+		exitHandlers = handlers
+		exitHandlersMu.Unlock()
+	})
+}
+
+// testShutdown resets the state of shutdown for a test, without exit handlers, and makes
+// exitFunc send exit codes to the returned channel rather than exit. Signals sent to the
+// returned signals channel are handled like exit signals.
+func testShutdown(t *testing.T) (codes <-chan int, signals chan<- os.Signal) {
+	testExitHandlers(t)
+	exit := exitFunc
+	exitch := make(chan int, 8)
+	exitFunc = func(code int) { exitch <- code }
+	sigs := make(chan os.Signal, 1)
+	ExitCh = make(chan struct{})
+	shutdownMu.Lock()
+	shutdownBegan = false
+	shutdownMu.Unlock()
+	exitFinalCode = 0
+	shutdownCtx, shutdownCancel = context.WithCancel(context.Background())
+	go handleExitSignals(sigs)
+	t.Cleanup(func() {
+		close(sigs)
+		exitFunc = exit
+	})
+	return exitch, sigs
+}
+
+// expectExit waits for exitFunc to be called with code
+func expectExit(t *testing.T, codes <-chan int, code int) {
+	t.Helper()
+	select {
+	case c := <-codes:
+		if c != code {
+			t.Errorf("exit code %d; expected %d", c, code)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no exit; expected exit code %d", code)
+	}
+}
+
+// expectNoExit checks that exitFunc hasn't been called
+func expectNoExit(t *testing.T, codes <-chan int) {
+	t.Helper()
+	select {
+	case c := <-codes:
+		t.Errorf("exit with code %d; expected none", c)
+	default:
+	}
+}
+
+func TestShutdownRunsHandlersBeforeExit(t *testing.T) {
+	codes, _ := testShutdown(t)
+	ran := false
+	RegisterExitHandler(func() { ran = true })
+	Shutdown(3)
+	if !ran {
+		t.Error("exit handler did not run")
+	}
+	expectExit(t, codes, 3) // by finishShutdown
+	expectExit(t, codes, 3) // by WaitExit
+	select {
+	case <-ExitCh:
+	default:
+		t.Error("ExitCh is not closed")
+	}
+}
+
+// A command which keeps running, like serve, is shut down by an exit signal: main waits
+// with WaitExit, which exits once the exit handlers have run.
+func TestSignalShutsDownRunningCommand(t *testing.T) {
+	codes, signals := testShutdown(t)
+	stopped := make(chan struct{})
+	RegisterExitHandlerWithPhase(ExitPhaseServers, func(ctx context.Context) error {
+		if sig, ok := SignalFromContext(ctx); !ok || sig != os.Interrupt {
+			t.Errorf("SignalFromContext = %v, %v; expected %v", sig, ok, os.Interrupt)
+		}
+		close(stopped)
+		return nil
+	}, "server")
+	waited := make(chan struct{})
+	go func() {
+		WaitExit()
+		close(waited)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-waited:
+		t.Fatal("WaitExit returned before shutdown")
+	default:
+	}
+	expectNoExit(t, codes)
+
+	signals <- os.Interrupt
+	<-stopped
+	expectExit(t, codes, 0)
+	expectExit(t, codes, 0)
+	<-waited
+}
+
+func TestExitPhaseOrder(t *testing.T) {
+	testExitHandlers(t)
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) func() {
+		return func() {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+		}
+	}
+	// registered in reverse order
+	RegisterExitHandlerWithPhase(ExitPhaseStorage, record("storage"))
+	RegisterExitHandler(record("workers"))
+	RegisterExitHandlerWithPhase(ExitPhaseServers, record("servers"))
+
+	// the handlers of a phase run concurrently: each of these waits for the other
+	a, b := make(chan struct{}), make(chan struct{})
+	RegisterExitHandlerWithPhase(ExitPhaseServers, func(ctx context.Context) error {
+		close(a)
+		select {
+		case <-b:
+			return nil
+		case <-ctx.Done():
+			return errors.New("server a ran alone")
+		}
+	})
+	RegisterExitHandlerWithPhase(ExitPhaseServers, func(ctx context.Context) error {
+		close(b)
+		select {
+		case <-a:
+			return nil
+		case <-ctx.Done():
+			return errors.New("server b ran alone")
+		}
+	})
+
+	if !runExitHandlers(context.Background(), exitHandlers, time.Second) {
+		t.Error("exit handlers failed")
+	}
+	if s := strings.Join(order, " "); s != "servers workers storage" {
+		t.Errorf("exit handlers ran in the order %s", s)
+	}
+}
+
+func TestRegisterExitHandlerPhase(t *testing.T) {
+	testExitHandlers(t)
+	RegisterExitHandler(func() {})
+	RegisterExitHandlerWithPhase(ExitPhaseStorage, func() {})
+	if exitHandlers[0].phase != ExitPhaseWorkers || exitHandlers[1].phase != ExitPhaseStorage {
+		t.Errorf("phases %v and %v", exitHandlers[0].phase, exitHandlers[1].phase)
+	}
+}
+
+func TestRunShutdown(t *testing.T) {
+	testShutdown(t)
+	code := -1
+	RegisterExitHandler(func(ctx context.Context) {
+		code = ExitCodeFromContext(ctx)
+	})
+	if c := runShutdown(context.Background(), nil, 2); c != 2 || code != 2 {
+		t.Errorf("runShutdown = %d, ExitCodeFromContext = %d; expected 2", c, code)
+	}
+	if c := runShutdown(context.Background(), os.Interrupt, 0); c != 0 || code != 0 {
+		t.Errorf("runShutdown = %d, ExitCodeFromContext = %d; expected 0", c, code)
+	}
+	RegisterExitHandler(func() error { return errors.New("failed") })
+	if c := runShutdown(context.Background(), nil, 0); c != 1 {
+		t.Errorf("runShutdown with a failing handler = %d; expected 1", c)
+	}
+}
+
+// A signal received during Shutdown hurries the exit handlers along, and the program
+// exits with the code passed to Shutdown
+func TestShutdownThenSignal(t *testing.T) {
+	codes, signals := testShutdown(t)
+	started := make(chan struct{})
+	var nruns int32
+	RegisterExitHandler(func(ctx context.Context) {
+		atomic.AddInt32(&nruns, 1)
+		close(started)
+		<-ctx.Done()
+	})
+	shutdown := make(chan struct{})
+	go func() {
+		Shutdown(2)
+		close(shutdown)
+	}()
+	<-started
+	signals <- os.Interrupt
+	expectExit(t, codes, 2) // by finishShutdown
+	expectExit(t, codes, 2) // by WaitExit
+	<-shutdown
+	if nruns != 1 {
+		t.Errorf("exit handler ran %d times", nruns)
+	}
+}
+
+// Shutdown during shutdown started by a signal waits for it to complete, without running
+// the exit handlers again, and exits with its code
+func TestSignalThenShutdown(t *testing.T) {
+	codes, signals := testShutdown(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	var nruns int32
+	RegisterExitHandler(func() {
+		atomic.AddInt32(&nruns, 1)
+		close(started)
+		<-release
+	})
+	signals <- os.Interrupt
+	<-started
+	shutdown := make(chan struct{})
+	go func() {
+		Shutdown(5)
+		close(shutdown)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned before the exit handlers completed")
+	default:
+	}
+	expectNoExit(t, codes)
+
+	close(release)
+	expectExit(t, codes, 0) // by finishShutdown
+	expectExit(t, codes, 0) // by the WaitExit of Shutdown
+	<-shutdown
+	if nruns != 1 {
+		t.Errorf("exit handler ran %d times", nruns)
+	}
+}
+
+// A phase whose handlers don't complete in time doesn't keep later phases from running,
+// like that of closing the database
+func TestExitPhaseTimeoutRunsLaterPhases(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	var storageErr error
+	storageRan := false
+	hs := []exitHandler{
+		{phase: ExitPhaseServers, name: "hanging", fn: func(context.Context) error {
+			<-hang // ignores its context
+			return nil
+		}},
+		{phase: ExitPhaseStorage, name: "storage", fn: func(ctx context.Context) error {
+			storageRan = true
+			if _, ok := ctx.Deadline(); !ok {
+				storageErr = errors.New("no deadline")
+			} else {
+				storageErr = ctx.Err()
+			}
+			return nil
+		}},
+	}
+	start := time.Now()
+	if runExitHandlers(context.Background(), hs, 100*time.Millisecond) {
+		t.Error("runExitHandlers = true; expected false since a handler didn't complete")
+	}
+	if d := time.Since(start); d > 100*time.Millisecond+exitPhaseGrace+time.Second {
+		t.Errorf("runExitHandlers took %s", d)
+	}
+	if !storageRan || storageErr != nil {
+		t.Errorf("storage phase: ran %v, context error %v", storageRan, storageErr)
+	}
+}
+
+// A handler which fails doesn't cancel those of the same phase, nor later phases
+func TestFailingExitHandlerDoesNotCancelOthers(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) {
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+	}
+	hs := []exitHandler{
+		{phase: ExitPhaseWorkers, name: "failing", fn: func(context.Context) error {
+			record("failing")
+			return errors.New("failed")
+		}},
+		{phase: ExitPhaseWorkers, name: "slow", fn: func(ctx context.Context) error {
+			time.Sleep(100 * time.Millisecond)
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			record("slow")
+			return nil
+		}},
+		{phase: ExitPhaseStorage, name: "storage", fn: func(ctx context.Context) error {
+			record("storage")
+			return ctx.Err()
+		}},
+	}
+	if runExitHandlers(context.Background(), hs, 5*time.Second) {
+		t.Error("runExitHandlers = true; expected false since a handler failed")
+	}
+	if s := strings.Join(order, " "); s != "failing slow storage" {
+		t.Errorf("exit handlers completed in the order %s", s)
+	}
+}
+
+// testSignal is a signal which isn't an exit signal on any platform
+type testSignal string
+
+func (s testSignal) String() string { return string(s) }
+func (testSignal) Signal()          {}
+
+// Console events on Windows, which the Go runtime delivers as SIGTERM, are tested by
+// hand: run smsg daemon in a console window and close the window. The log should show
+// the exit handlers running.
+func TestExitTimeouts(t *testing.T) {
+	exitHandlersMu.Lock()
+	timeouts := map[os.Signal]time.Duration{}
+	for sig, d := range exitTimeouts {
+		timeouts[sig] = d
+	}
+	exitHandlersMu.Unlock()
+	defer func() {
+		exitHandlersMu.Lock()
+		exitTimeouts = timeouts
+		exitHandlersMu.Unlock()
+	}()
+
+	if d := GetExitTimeout(nil); d != defaultExitTimeout {
+		t.Errorf("GetExitTimeout(nil) = %s; expected %s", d, defaultExitTimeout)
+	}
+	SetExitTimeout(2 * time.Second)
+	for _, sig := range append(exitSignals[:len(exitSignals):len(exitSignals)], nil) {
+		if d := GetExitTimeout(sig); d != 2*time.Second {
+			t.Errorf("GetExitTimeout(%v) = %s; expected 2s", sig, d)
+		}
+	}
+	SetExitTimeout(time.Second, exitSignals[0])
+	if d := GetExitTimeout(exitSignals[0]); d != time.Second {
+		t.Errorf("GetExitTimeout(%v) = %s; expected 1s", exitSignals[0], d)
+	}
+	if d := GetExitTimeout(nil); d != 2*time.Second {
+		t.Errorf("GetExitTimeout(nil) = %s; expected 2s", d)
+	}
+
+	// not ignored, though it has no effect
+	sig := testSignal("test")
+	if d := GetExitTimeout(sig); d != defaultExitTimeout {
+		t.Errorf("GetExitTimeout(%v) = %s; expected %s", sig, d, defaultExitTimeout)
+	}
+	SetExitTimeout(3*time.Second, sig)
+	if d := GetExitTimeout(sig); d != 3*time.Second {
+		t.Errorf("GetExitTimeout(%v) = %s; expected 3s", sig, d)
+	}
+}
+
+// Shutdown stops waiting for handlers when the shutdown timeout is up, and a handler
+// which fails, times out or hangs doesn't keep the others from completing
+func TestShutdownTimeout(t *testing.T) {
+	codes, _ := testShutdown(t)
+	defer SetExitTimeout(GetExitTimeout(nil), nil)
+	SetExitTimeout(300*time.Millisecond, nil)
+	hang := make(chan struct{})
+	defer close(hang)
+
+	var slowDone, storageDone int32
+	RegisterExitHandler(func() error { return errors.New("failed") }, "failing")
+	RegisterExitHandler(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, "timing out", 50*time.Millisecond)
+	RegisterExitHandler(func() { <-hang }, "hanging")
+	RegisterExitHandler(func(ctx context.Context) error {
+		time.Sleep(100 * time.Millisecond)
+		atomic.StoreInt32(&slowDone, 1)
+		return ctx.Err()
+	}, "slow")
+	RegisterExitHandlerWithPhase(ExitPhaseStorage, func() {
+		atomic.StoreInt32(&storageDone, 1)
+	}, "storage")
+
+	start := time.Now()
+	Shutdown(0)
+	if d := time.Since(start); d < 300*time.Millisecond || d > 300*time.Millisecond+exitPhaseGrace+time.Second {
+		t.Errorf("Shutdown took %s; expected the shutdown timeout of 300ms", d)
+	}
+	expectExit(t, codes, 1)
+	expectExit(t, codes, 1)
+	if atomic.LoadInt32(&slowDone) == 0 || atomic.LoadInt32(&storageDone) == 0 {
+		t.Errorf("exit handlers didn't complete: slow %v, storage %v", slowDone, storageDone)
+	}
+}
@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "hash"
+  "strconv"
+)
+
+// The id of a message is computed from its canonical form: its section headers, each
+// ending with a newline (U+000A) without a carriage return before it, and the trailing
+// data of its body and files as is. Messages written by smsg (see Message.WriteTo) are in
+// canonical form, so that a message saved with CRLF line endings has the same id as when
+// saved with LF ones.
+//
+// Message ids used to be computed from the message as encoded. They are the same for
+// messages in canonical form, which are most; for others, the old id is kept as a legacy
+// id of the message (see Message.legacyId and the legacy_ids table).
+
+// canonicalHasher is a writer which hashes the canonical form of the encoded message
+// written to it
+type canonicalHasher struct {
+  h    hash.Hash
+  line []byte // header being written, until its newline
+  data uint64 // number of bytes of trailing data left to be written
+}
+
+func newCanonicalHasher() *canonicalHasher {
+  return &canonicalHasher{h: sha256.New()}
+}
+
+func (c *canonicalHasher) Write(p []byte) (int, error) {
+  n := len(p)
+  for len(p) > 0 {
+    if c.data > 0 {
+      chunk := p
+      if uint64(len(chunk)) > c.data {
+        chunk = chunk[:c.data]
+      }
+      c.h.Write(chunk)
+      c.data -= uint64(len(chunk))
+      p = p[len(chunk):]
+      continue
+    }
+    i := bytes.IndexByte(p, '\n')
+    if i == -1 {
+      c.line = append(c.line, p...)
+      break
+    }
+    c.line = append(c.line, p[:i]...)
+    p = p[i+1:]
+    c.line = bytes.TrimSuffix(c.line, []byte{'\r'})
+    c.h.Write(c.line)
+    c.h.Write([]byte{'\n'})
+    c.data = dataSize(c.line)
+    c.line = c.line[:0]
+  }
+  return n, nil
+}
+
+// Sum appends the hash of what has been written to b. A last header without a newline is
+// hashed as is.
+func (c *canonicalHasher) Sum(b []byte) []byte {
+  c.h.Write(c.line)
+  c.line = c.line[:0]
+  return c.h.Sum(b)
+}
+
+// dataSize returns the size of the trailing data of a section with header line, or 0 if
+// it has none. Like parseReader, the size is the first word of the value of "body",
+// "body-enc", "file" and "file-enc" sections; an invalid one is an error there.
+func dataSize(line []byte) uint64 {
+  p := bytes.IndexByte(line, ' ')
+  if p == -1 {
+    return 0
+  }
+  switch string(line[:p]) {
+  case "body", "body-enc", "file", "file-enc":
+  default:
+    return 0
+  }
+  value := bytes.TrimSpace(line[p:])
+  if p := bytes.IndexByte(value, ' '); p != -1 {
+    value = value[:p]
+  }
+  size, _ := strconv.ParseUint(string(value), 10, 64)
+  return size
+}
@@ -0,0 +1,128 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+  "time"
+)
+
+// testCRLF returns text with the newlines of its section headers replaced with CRLF,
+// leaving the data of its body and files as is
+func testCRLF(text string) string {
+  var b strings.Builder
+  for len(text) > 0 {
+    i := strings.IndexByte(text, '\n')
+    if i == -1 {
+      b.WriteString(text)
+      break
+    }
+    line := text[:i]
+    b.WriteString(line + "\r\n")
+    text = text[i+1:]
+    if n := int(dataSize([]byte(line))); n > 0 {
+      b.WriteString(text[:n])
+      text = text[n:]
+    }
+  }
+  return b.String()
+}
+
+func TestCanonicalIdOfCRLF(t *testing.T) {
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  lf := testMessageText("Hello", "alice@example.com", tm, "Line 1\nLine 2\n") +
+    "file 6 a.txt\nHello\n"
+  crlf := testCRLF(lf)
+  if crlf == lf || !strings.Contains(crlf, "subject Hello\r\n") {
+    t.Fatalf("testCRLF(%q) = %q", lf, crlf)
+  }
+  m1 := testParse(t, strings.NewReader(lf), len(lf))
+  m2 := testParse(t, strings.NewReader(crlf), len(crlf))
+  if m1.id != m2.id {
+    t.Errorf("CRLF version of a message has id %s; expected %s", m2.IdString(), m1.IdString())
+  }
+  if !bytes.Equal(m2.body, m1.body) {
+    t.Errorf("CRLF version of a message has body %q; expected %q", m2.body, m1.body)
+  }
+
+  // the legacy id is that of the message as encoded, which is its id in canonical form
+  if m1.legacyId() != m1.id {
+    t.Errorf("legacy id %x of a message in canonical form; expected its id", m1.legacyId())
+  }
+  if m2.legacyId() == m2.id || m2.legacyId() == ([24]byte{}) {
+    t.Errorf("legacy id %x of the CRLF version of a message", m2.legacyId())
+  }
+}
+
+// TestCanonicalHashOfData checks that the data of bodies and files is hashed as is:
+// carriage returns in it make a difference, and lines in it aren't taken for headers
+func TestCanonicalHashOfData(t *testing.T) {
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  ids := map[[24]byte]string{}
+  for _, body := range []string{
+    "Line 1\nLine 2\n",
+    "Line 1\r\nLine 2\r\n",
+    "Line 1\nLine 2\r\n",
+  } {
+    text := testMessageText("Hello", "alice@example.com", tm, body)
+    m := testParse(t, strings.NewReader(text), len(text))
+    if other, ok := ids[m.id]; ok {
+      t.Errorf("bodies %q and %q give the same id", other, body)
+    }
+    ids[m.id] = body
+    if string(m.body) != body {
+      t.Errorf("body %q; expected %q", m.body, body)
+    }
+  }
+
+  // data which looks like headers ending in CRLF is hashed as is, also when it's written
+  // a byte at a time
+  text := "body 12\nfile 1 x\r\n\r\nsubject Hi\n"
+  h1 := newCanonicalHasher()
+  h1.Write([]byte(text))
+  h2 := newCanonicalHasher()
+  for i := 0; i < len(text); i++ {
+    h2.Write([]byte(text[i : i+1]))
+  }
+  expected := newCanonicalHasher()
+  expected.h.Write([]byte(text))
+  if s1, s2, e := h1.Sum(nil), h2.Sum(nil), expected.h.Sum(nil); !bytes.Equal(s1, e) ||
+    !bytes.Equal(s2, e) {
+    t.Errorf("hash of data %x, and written a byte at a time %x; expected %x", s1, s2, e)
+  }
+}
+
+// TestLegacyIdResolves indexes a message which isn't in canonical form, which must be
+// found by its legacy id as well as by its id
+func TestLegacyIdResolves(t *testing.T) {
+  testMsgDir(t)
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  text := testCRLF(testMessageText("Hello", "alice@example.com", tm, "Hello\r\n"))
+  writeTestFile(t, INBOXDIR, "20220601-100000.msg", text)
+  scanTestFolder(t, "inbox")
+  msg := testParse(t, strings.NewReader(text), len(text))
+  legacy := msg.legacyId()
+  if legacy == msg.id {
+    t.Fatal("message is in canonical form")
+  }
+
+  for _, id := range [][24]byte{msg.id, legacy} {
+    idstr := (&Message{id: id}).IdString()
+    loaded, err := loadMessage(idstr)
+    if err != nil {
+      t.Fatalf("loadMessage(%s): %v", idstr, err)
+    }
+    if loaded.id != msg.id || loaded.subject != "Hello" {
+      t.Errorf("loadMessage(%s) loaded %s %q; expected %s", idstr, loaded.IdString(),
+        loaded.subject, msg.IdString())
+    }
+    if ok, err := db.HasMessage(id); !ok || err != nil {
+      t.Errorf("HasMessage(%s) = %v, %v", idstr, ok, err)
+    }
+    decoded, err := decodeId(idstr)
+    if err != nil || decoded != id {
+      t.Errorf("decodeId(%s) = %x, %v; expected %x", idstr, decoded, err, id)
+    }
+  }
+}
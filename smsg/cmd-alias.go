@@ -0,0 +1,92 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "sort"
+  "strings"
+  "text/tabwriter"
+)
+
+func cmd_alias(fl *flag.FlagSet) func() {
+  return func() {
+    switch fl.Arg(0) {
+    case "", "list", "ls":
+      printAliases()
+    case "add":
+      if fl.NArg() < 3 {
+        fl.Usage()
+        os.Exit(1)
+      }
+      name := strings.ToLower(fl.Arg(1))
+      if strings.ContainsAny(name, "@, \t") {
+        fatalf("invalid alias %q (must not contain '@', ',' or spaces)", fl.Arg(1))
+      }
+      if config.Aliases == nil {
+        config.Aliases = map[string]AddressList{}
+      }
+      addrs := config.Aliases[name]
+      for _, arg := range fl.Args()[2:] {
+        address, err := normalizeAndValidateAddress(arg)
+        if err != nil {
+          fatalf("%q: %v", arg, err)
+        }
+        if indexOfString(addrs, address) == -1 {
+          addrs = append(addrs, address)
+        }
+      }
+      config.Aliases[name] = addrs
+      must(config.Save(CONFIGFILE))
+      fmt.Printf("%s = %s\n", name, strings.Join(addrs, ", "))
+    case "rm":
+      if fl.NArg() < 2 {
+        fl.Usage()
+        os.Exit(1)
+      }
+      name := strings.ToLower(fl.Arg(1))
+      addrs, ok := config.Aliases[name]
+      if !ok {
+        fatalf("no alias %q", fl.Arg(1))
+      }
+      if fl.NArg() == 2 {
+        delete(config.Aliases, name)
+      } else {
+        for _, arg := range fl.Args()[2:] {
+          address, _ := normalizeAndValidateAddress(arg)
+          i := indexOfString(addrs, address)
+          if i == -1 {
+            fatalf("alias %q does not include %q", name, arg)
+          }
+          addrs = append(addrs[:i], addrs[i+1:]...)
+        }
+        if len(addrs) == 0 {
+          delete(config.Aliases, name)
+        } else {
+          config.Aliases[name] = addrs
+        }
+      }
+      must(config.Save(CONFIGFILE))
+    default:
+      fatalf("unknown alias command %q\nSee %s alias -h for help", fl.Arg(0), progname)
+    }
+  }
+}
+
+func printAliases() {
+  if len(config.Aliases) == 0 {
+    fmt.Printf("No aliases. Add one with: %s alias add <alias> <address>\n", progname)
+    return
+  }
+  names := make([]string, 0, len(config.Aliases))
+  for name := range config.Aliases {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+  for _, name := range names {
+    fmt.Fprintf(w, "%s\t%s\n", name, strings.Join(config.Aliases[name], ", "))
+  }
+  w.Flush()
+}
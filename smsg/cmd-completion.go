@@ -0,0 +1,249 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+)
+
+// flagValueCompletions maps names of flags to what their values are, for shell completion.
+// See Command.Complete for possible values. Flags not listed here have no completions.
+var flagValueCompletions = map[string]string{
+  "to":     "address",
+  "cc":     "address",
+  "from":   "address",
+  "folder": "inbox outbox sent archive trash all",
+  "sort":   "rank date",
+  "C":      "dir",
+}
+
+func cmd_completion(fl *flag.FlagSet) func() {
+  return func() {
+    if fl.NArg() != 1 {
+      fl.Usage()
+      os.Exit(1)
+    }
+    prog := filepath.Base(progname)
+    switch fl.Arg(0) {
+    case "bash":
+      writeBashCompletion(os.Stdout, prog)
+    case "zsh":
+      // zsh can use bash completion functions
+      fmt.Printf("#compdef %s\nautoload -U +X bashcompinit && bashcompinit\n", prog)
+      writeBashCompletion(os.Stdout, prog)
+    case "fish":
+      writeFishCompletion(os.Stdout, prog)
+    default:
+      fatalf("unsupported shell %q (expected bash, zsh or fish)", fl.Arg(0))
+    }
+  }
+}
+
+// cmd_complete is plumbing used by completion scripts. It prints candidates, one per line.
+func cmd_complete(fl *flag.FlagSet) func() {
+  return func() {
+    switch fl.Arg(0) {
+    case "ids":
+      // note: doesn't wait for the inbox scan, to be quick
+      filter := MessageFilter{folder: "all", limit: 50}
+      must(db.ListMessages(&filter, func(msg *Message) error {
+        fmt.Println(msg.IdString())
+        return nil
+      }))
+    case "addresses":
+      for name := range config.Aliases {
+        fmt.Println(name)
+      }
+      must(db.ListContacts("", func(c *Contact) error {
+        fmt.Println(c.address)
+        return nil
+      }))
+    }
+  }
+}
+
+// completionFlag is a flag of a command, as needed for shell completion
+type completionFlag struct {
+  name     string
+  hasValue bool
+  values   string // see flagValueCompletions
+}
+
+func completionFlags(fl *flag.FlagSet) []completionFlag {
+  var flags []completionFlag
+  fl.VisitAll(func(f *flag.Flag) {
+    bf, ok := f.Value.(interface{ IsBoolFlag() bool })
+    flags = append(flags, completionFlag{
+      name:     f.Name,
+      hasValue: !(ok && bf.IsBoolFlag()),
+      values:   flagValueCompletions[f.Name],
+    })
+  })
+  return flags
+}
+
+// completionCommands returns the names of all visible commands, sorted
+func completionCommands() []string {
+  var names []string
+  for _, c := range commands {
+    if !c.Hidden {
+      names = append(names, c.Name)
+    }
+  }
+  sort.Strings(names)
+  return names
+}
+
+func writeBashCompletion(w io.Writer, prog string) {
+  fn := "_" + strings.ReplaceAll(prog, "-", "_")
+  fmt.Fprintf(w, "# %s shell completion. Generated by \"%s completion\"\n", prog, prog)
+
+  // _fn_words kind cur -- prints completions of kind (see Command.Complete)
+  fmt.Fprintf(w, "%s_words() {\n", fn)
+  fmt.Fprintf(w, "  case \"$1\" in\n")
+  fmt.Fprintf(w, "    id) compgen -W \"$(\"${%s_prog[@]}\" __complete ids 2>/dev/null)\" -- \"$2\" ;;\n", fn)
+  fmt.Fprintf(w, "    address) compgen -W \"$(\"${%s_prog[@]}\" __complete addresses 2>/dev/null)\" -- \"$2\" ;;\n", fn)
+  fmt.Fprintf(w, "    file) compgen -f -- \"$2\" ;;\n")
+  fmt.Fprintf(w, "    dir) compgen -d -- \"$2\" ;;\n")
+  fmt.Fprintf(w, "    command) compgen -W %q -- \"$2\" ;;\n", strings.Join(completionCommands(), " "))
+  fmt.Fprintf(w, "    '') ;;\n")
+  fmt.Fprintf(w, "    *) compgen -W \"$1\" -- \"$2\" ;;\n")
+  fmt.Fprintf(w, "  esac\n}\n\n")
+
+  fmt.Fprintf(w, "%s() {\n", fn)
+  fmt.Fprintf(w, "  local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+  fmt.Fprintf(w, "  local i cmd='' cmdi=0 flags valflags args kind=''\n")
+  fmt.Fprintf(w, "  %s_prog=(\"${COMP_WORDS[0]}\")\n", fn)
+  fmt.Fprintf(w, "  for ((i = 1; i < COMP_CWORD; i++)); do\n")
+  fmt.Fprintf(w, "    case \"${COMP_WORDS[i]}\" in\n")
+  fmt.Fprintf(w, "      -C) ((i++)); %s_prog+=(-C \"${COMP_WORDS[i]}\") ;;\n", fn)
+  fmt.Fprintf(w, "      -*) ;;\n")
+  fmt.Fprintf(w, "      *) cmd=\"${COMP_WORDS[i]}\"; cmdi=$i; break ;;\n")
+  fmt.Fprintf(w, "    esac\n")
+  fmt.Fprintf(w, "  done\n")
+
+  // per-command flags and arguments
+  fmt.Fprintf(w, "  case \"$cmd\" in\n")
+  writeBashCommandCase(w, "''", completionFlags(flag.CommandLine), "command")
+  for _, c := range commands {
+    if c.Hidden {
+      continue
+    }
+    pattern := strings.Join(append([]string{c.Name}, c.Aliases...), "|")
+    writeBashCommandCase(w, pattern, completionFlags(commandFlags(c)), c.Complete)
+  }
+  fmt.Fprintf(w, "  esac\n")
+
+  // completing the value of a flag?
+  fmt.Fprintf(w, "  local pflag=\"${prev#-}\"; pflag=\"${pflag#-}\"\n")
+  fmt.Fprintf(w, "  if [[ $prev == -* && \" $valflags \" == *\" $pflag \"* ]]; then\n")
+  fmt.Fprintf(w, "    case \"$pflag\" in\n")
+  for _, name := range sortedKeys(flagValueCompletions) {
+    fmt.Fprintf(w, "      %s) kind=%q ;;\n", name, flagValueCompletions[name])
+  }
+  fmt.Fprintf(w, "    esac\n")
+  fmt.Fprintf(w, "    COMPREPLY=($(%s_words \"$kind\" \"$cur\"))\n", fn)
+  fmt.Fprintf(w, "    return\n")
+  fmt.Fprintf(w, "  fi\n")
+
+  // flag names
+  fmt.Fprintf(w, "  if [[ $cur == -* ]]; then\n")
+  fmt.Fprintf(w, "    COMPREPLY=($(compgen -W \"$flags\" -- \"$cur\"))\n")
+  fmt.Fprintf(w, "    return\n")
+  fmt.Fprintf(w, "  fi\n")
+
+  // positional arguments. Lists of words (subcommands) only apply to the first argument.
+  fmt.Fprintf(w, "  local nargs=0\n")
+  fmt.Fprintf(w, "  if [[ -n $cmd ]]; then\n")
+  fmt.Fprintf(w, "    for ((i = cmdi + 1; i < COMP_CWORD; i++)); do\n")
+  fmt.Fprintf(w, "      case \"${COMP_WORDS[i]}\" in\n")
+  fmt.Fprintf(w, "        -*) [[ \" $valflags \" == *\" ${COMP_WORDS[i]#-} \"* ]] && ((i++)) ;;\n")
+  fmt.Fprintf(w, "        *) ((nargs++)) ;;\n")
+  fmt.Fprintf(w, "      esac\n")
+  fmt.Fprintf(w, "    done\n")
+  fmt.Fprintf(w, "  fi\n")
+  fmt.Fprintf(w, "  case \"$args\" in\n")
+  fmt.Fprintf(w, "    id|address|file|dir) ;;\n")
+  fmt.Fprintf(w, "    *) [[ $nargs -gt 0 ]] && return ;;\n")
+  fmt.Fprintf(w, "  esac\n")
+  fmt.Fprintf(w, "  COMPREPLY=($(%s_words \"$args\" \"$cur\"))\n", fn)
+  fmt.Fprintf(w, "}\n\n")
+  fmt.Fprintf(w, "complete -o default -F %s %s\n", fn, prog)
+}
+
+func writeBashCommandCase(w io.Writer, pattern string, flags []completionFlag, args string) {
+  var names, valnames []string
+  for _, f := range flags {
+    names = append(names, "-"+f.name)
+    if f.hasValue {
+      valnames = append(valnames, f.name)
+    }
+  }
+  fmt.Fprintf(w, "    %s)\n", pattern)
+  fmt.Fprintf(w, "      flags=%q\n", strings.Join(names, " "))
+  fmt.Fprintf(w, "      valflags=%q\n", strings.Join(valnames, " "))
+  fmt.Fprintf(w, "      args=%q ;;\n", args)
+}
+
+func writeFishCompletion(w io.Writer, prog string) {
+  fmt.Fprintf(w, "# %s shell completion. Generated by \"%s completion\"\n", prog, prog)
+  fmt.Fprintf(w, "complete -c %s -f\n", prog)
+
+  fishArgs := func(kind string) string {
+    switch kind {
+    case "":
+      return ""
+    case "id":
+      return fmt.Sprintf(" -a '(%s __complete ids 2>/dev/null)'", prog)
+    case "address":
+      return fmt.Sprintf(" -a '(%s __complete addresses 2>/dev/null)'", prog)
+    case "file":
+      return " -F"
+    case "dir":
+      return " -a '(__fish_complete_directories)'"
+    case "command":
+      return fmt.Sprintf(" -a %q", strings.Join(completionCommands(), " "))
+    }
+    return fmt.Sprintf(" -a %q", kind)
+  }
+
+  writeFlags := func(cond string, flags []completionFlag) {
+    for _, f := range flags {
+      fmt.Fprintf(w, "complete -c %s%s -o %s", prog, cond, f.name)
+      if f.hasValue {
+        fmt.Fprintf(w, " -r%s", fishArgs(f.values))
+      }
+      fmt.Fprintf(w, "\n")
+    }
+  }
+
+  writeFlags(" -n __fish_use_subcommand", completionFlags(flag.CommandLine))
+  for _, name := range completionCommands() {
+    fmt.Fprintf(w, "complete -c %s -n __fish_use_subcommand -a %s\n", prog, name)
+  }
+  for _, c := range commands {
+    if c.Hidden {
+      continue
+    }
+    names := strings.Join(append([]string{c.Name}, c.Aliases...), " ")
+    cond := fmt.Sprintf(" -n '__fish_seen_subcommand_from %s'", names)
+    writeFlags(cond, completionFlags(commandFlags(c)))
+    if c.Complete != "" {
+      fmt.Fprintf(w, "complete -c %s%s%s\n", prog, cond, fishArgs(c.Complete))
+    }
+  }
+}
+
+func sortedKeys(m map[string]string) []string {
+  keys := make([]string, 0, len(m))
+  for k := range m {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  return keys
+}
@@ -0,0 +1,186 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bytes"
+  "flag"
+  "fmt"
+  "os"
+  "os/exec"
+  "strings"
+  "time"
+)
+
+// composeBodySentinel is the value of the "body" section in a message being composed.
+// It is replaced with the actual byte size of the body when the message is sent,
+// so that the user doesn't have to keep the size up to date while editing.
+const composeBodySentinel = "*"
+
+// composeErrorField is used for reporting problems back to the user in the
+// message being edited. Since it's an "x-" field it's ignored by the parser.
+const composeErrorField = "x-error"
+
+func cmd_compose(fl *flag.FlagSet) func() {
+  opt_from := fl.String("from", "", "Sender identity (address or alias).\n"+
+    "Defaults to the default identity")
+  opt_to := fl.String("to", "", "Recipients (addresses or aliases, separated by comma)")
+  opt_subject := fl.String("subject", "", "Subject")
+  opt_expires := fl.String("expires", "",
+    "Make the message expire `duration` after it's sent, e.g. 24h. Expired messages\n"+
+      "are deleted")
+  opt_priority := fl.String("priority", "", "Priority: low, normal, high or urgent")
+  opt_encrypt := fl.Bool("encrypt", false,
+    "Encrypt the body and files to the public keys of the recipients (see \"smsg key\")")
+  opt_draft := fl.Bool("draft", false,
+    "Save the message as a draft instead of sending it (see \"smsg drafts\")")
+  opt_resume := fl.String("resume", "", "Continue composing the draft with `id`")
+  return func() {
+    if *opt_resume != "" {
+      resumeDraft(*opt_resume, *opt_draft)
+      return
+    }
+
+    var from string
+    if sender, err := resolveSender(*opt_from); err == nil {
+      from = sender.FieldValue()
+    } else if *opt_from != "" {
+      fatalf(err)
+    }
+
+    recipients := []Author{{}}
+    if *opt_to != "" {
+      var err error
+      recipients, err = parseRecipients(*opt_to)
+      must(err)
+    }
+
+    var skel bytes.Buffer
+    fmt.Fprintf(&skel, "subject %s\n", *opt_subject)
+    fmt.Fprintf(&skel, "from    %s\n", from)
+    for _, a := range recipients {
+      fmt.Fprintf(&skel, "to      %s\n", a.FieldValue())
+    }
+    fmt.Fprintf(&skel, "time    %s\n", time.Now().Format("2006-01-02 15:04:05 -0700"))
+    if *opt_expires != "" {
+      if d, err := parseDuration(*opt_expires); err != nil || d <= 0 {
+        fatalf("invalid -expires %q (expected a duration, e.g. 24h)", *opt_expires)
+      }
+      fmt.Fprintf(&skel, "expires %s\n", *opt_expires)
+    }
+    if *opt_priority != "" {
+      p, err := parsePriority(*opt_priority)
+      must(err)
+      fmt.Fprintf(&skel, "priority %s\n", p)
+    }
+    fmt.Fprintf(&skel, "body    %s\n", composeBodySentinel)
+
+    msg, data, ok := composeInEditor(skel.Bytes(), *opt_draft)
+    if !ok {
+      fmt.Fprintln(os.Stderr, "aborted (empty message)")
+      return
+    }
+    if *opt_draft {
+      saveDraft(msg, data)
+      return
+    }
+    if *opt_encrypt {
+      var err error
+      msg, data, err = encryptOutgoingMessage(msg, data, false, "compose")
+      must(err)
+    }
+    sendMessage(msg, data)
+  }
+}
+
+// composeInEditor opens $EDITOR on a temporary file initialized with content.
+// When the editor exits the message is parsed and validated, or with draft, only parsed
+// (see parseDraft.) If that fails, the editor is opened again with the error added to the
+// top of the message.
+// Returns ok=false if the user emptied the file.
+func composeInEditor(content []byte, draft bool) (msg *Message, data []byte, ok bool) {
+  f, err := os.CreateTemp(TMPDIR, "compose-*.msg")
+  must(err)
+  tmpfile := f.Name()
+  f.Close()
+  RegisterExitHandler(func() { os.Remove(tmpfile) }, "compose")
+  defer os.Remove(tmpfile)
+
+  for {
+    must(os.WriteFile(tmpfile, content, 0600))
+    must(runEditor(tmpfile))
+    content, err = os.ReadFile(tmpfile)
+    must(err)
+    content = stripComposeErrors(content)
+    if len(bytes.TrimSpace(content)) == 0 {
+      return nil, nil, false
+    }
+    data = fillComposeBodySize(content)
+    if draft {
+      msg, data, err = parseDraft(data, "message")
+    } else {
+      msg, data, err = parseOutgoingMessage(data, "message")
+    }
+    if err == nil {
+      return msg, data, true
+    }
+    errmsg := strings.ReplaceAll(err.Error(), "\n", " ")
+    content = append([]byte(composeErrorField+" "+errmsg+"\n"), content...)
+  }
+}
+
+func runEditor(file string) error {
+  editor := os.Getenv("VISUAL")
+  if editor == "" {
+    editor = os.Getenv("EDITOR")
+  }
+  if editor == "" {
+    editor = "vi"
+  }
+  // EDITOR may contain arguments, e.g. "code --wait"
+  args := strings.Fields(editor)
+  cmd := exec.Command(args[0], append(args[1:], file)...)
+  cmd.Stdin = os.Stdin
+  cmd.Stdout = os.Stdout
+  cmd.Stderr = os.Stderr
+  if err := cmd.Run(); err != nil {
+    return errorf("%s: %v", editor, err)
+  }
+  return nil
+}
+
+// stripComposeErrors removes any leading error lines added by composeInEditor
+func stripComposeErrors(content []byte) []byte {
+  prefix := []byte(composeErrorField + " ")
+  for bytes.HasPrefix(content, prefix) {
+    p := bytes.IndexByte(content, '\n')
+    if p == -1 {
+      return content[:0]
+    }
+    content = content[p+1:]
+  }
+  return content
+}
+
+// fillComposeBodySize replaces a "body *" line with the size of the remaining content
+func fillComposeBodySize(content []byte) []byte {
+  start := 0
+  for start < len(content) {
+    end := bytes.IndexByte(content[start:], '\n')
+    if end == -1 {
+      break
+    }
+    end += start
+    line := content[start:end]
+    if bytes.HasPrefix(line, []byte("body ")) &&
+      string(bytes.TrimSpace(line[len("body "):])) == composeBodySentinel {
+      body := content[end+1:]
+      var buf bytes.Buffer
+      buf.Write(content[:start])
+      fmt.Fprintf(&buf, "body %d\n", len(body))
+      buf.Write(body)
+      return buf.Bytes()
+    }
+    start = end + 1
+  }
+  return content
+}
@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bufio"
+  "flag"
+  "fmt"
+  "os"
+  "strconv"
+  "strings"
+  "text/tabwriter"
+  "time"
+)
+
+func cmd_contacts(fl *flag.FlagSet) func() {
+  opt_search := fl.String("search", "", "Only contacts with address or name containing `text`")
+  opt_json := fl.Bool("json", false, "Print contacts as JSON")
+  opt_tsv := fl.Bool("tsv", false, "Print contacts as tab-separated values: address, name,\n"+
+    "number of messages, last seen and whether pinned (see \"list -h\")")
+  return func() {
+    cmd := fl.Arg(0)
+    args := fl.Args()
+    if len(args) > 0 {
+      args = args[1:]
+    }
+
+    switch cmd {
+    case "", "list", "ls":
+      fl.Parse(args) // options may follow "list"
+      msgsync.WaitReady()
+      if *opt_json {
+        printContactsJSON(*opt_search)
+      } else if *opt_tsv {
+        printContactsTSV(*opt_search)
+      } else {
+        printContacts(*opt_search)
+      }
+    case "set":
+      if len(args) < 2 {
+        fl.Usage()
+        os.Exit(1)
+      }
+      address, err := normalizeAndValidateAddress(args[0])
+      if err != nil {
+        fatalf("%q: %v", args[0], err)
+      }
+      name := strings.Join(args[1:], " ")
+      must(db.SetContactName(address, name))
+      fmt.Printf("%s\n", Author{address: address, name: name})
+    case "rm":
+      if len(args) != 1 {
+        fl.Usage()
+        os.Exit(1)
+      }
+      address, err := normalizeAndValidateAddress(args[0])
+      if err != nil {
+        fatalf("%q: %v", args[0], err)
+      }
+      must(db.RemoveContact(address))
+    default:
+      fatalf("unknown contacts command %q\nSee %s contacts -h for help", cmd, progname)
+    }
+  }
+}
+
+func printContacts(search string) {
+  now := time.Now()
+  w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+  fmt.Fprintf(w, "%sAddress\tName\tMessages\tLast seen%s\n", colheader, colreset)
+  count := 0
+  must(db.ListContacts(search, func(c *Contact) error {
+    name := c.name
+    if c.pinned {
+      name += " *"
+    }
+    lastseen := "-"
+    if !c.lastseen.IsZero() {
+      lastseen = formatTime(now, localTime(c.lastseen))
+    }
+    fmt.Fprintf(w, "%s%s\t%s\t%d\t%s%s\n",
+      colreset, c.address, limitStrLen(name, 30), c.msgcount, lastseen, colreset)
+    count++
+    return nil
+  }))
+  if count == 0 {
+    fmt.Fprintf(w, "%s(no contacts)%s\n", coldim, colreset)
+  }
+  w.Flush()
+}
+
+type contactJSON struct {
+  Address  string     `json:"address"`
+  Name     string     `json:"name"`
+  Messages int        `json:"messages"`
+  LastSeen *time.Time `json:"last_seen,omitempty"`
+  Pinned   bool       `json:"pinned"`
+}
+
+// printContactsTSV prints contacts as tab-separated values (see tsv.go), with the time
+// they were last seen empty if unknown
+func printContactsTSV(search string) {
+  w := bufio.NewWriter(os.Stdout)
+  var buf []byte
+  must(db.ListContacts(search, func(c *Contact) error {
+    buf = appendTSVField(buf[:0], c.address)
+    buf = append(buf, '\t')
+    buf = appendTSVField(buf, c.name)
+    buf = append(buf, '\t')
+    buf = strconv.AppendInt(buf, int64(c.msgcount), 10)
+    buf = append(buf, '\t')
+    if !c.lastseen.IsZero() {
+      buf = appendTSVTime(buf, c.lastseen)
+    }
+    buf = append(buf, '\t')
+    buf = strconv.AppendBool(buf, c.pinned)
+    buf = append(buf, '\n')
+    _, err := w.Write(buf)
+    return err
+  }))
+  must(w.Flush())
+}
+
+func printContactsJSON(search string) {
+  contacts := []contactJSON{}
+  must(db.ListContacts(search, func(c *Contact) error {
+    cj := contactJSON{
+      Address:  c.address,
+      Name:     c.name,
+      Messages: c.msgcount,
+      Pinned:   c.pinned,
+    }
+    if !c.lastseen.IsZero() {
+      t := c.lastseen
+      cj.LastSeen = &t
+    }
+    contacts = append(contacts, cj)
+    return nil
+  }))
+  printJSON(contacts)
+}
@@ -0,0 +1,25 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "context"
+  "flag"
+  "fmt"
+)
+
+func cmd_count(fl *flag.FlagSet) func() {
+  opt_wait := fl.Bool("wait", false, "Wait for the inbox scan, to include new messages")
+  var filter MessageFilter
+  addMessageFilterFlags(fl, &filter, "inbox")
+  return func() {
+    if *opt_wait && ctl == nil {
+      msgsync.Start()
+      if msgsync.waitFolderReady(context.Background(), filter.folder) != nil {
+        return // interrupted
+      }
+    }
+    n, err := countMessages(&filter)
+    must(err)
+    fmt.Println(n)
+  }
+}
@@ -0,0 +1,27 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestCountPrintsJustANumber(t *testing.T) {
+  testMsgDir(t)
+  if out := runTestCommand(t, "count"); out != "0\n" {
+    t.Errorf("count of an empty inbox = %q; expected %q", out, "0\n")
+  }
+  writeTestMessages(t, 3)
+  for _, args := range [][]string{nil, {"-unread"}, {"-folder", "inbox"}} {
+    out := runTestCommand(t, "count", args...)
+    if out != "3\n" {
+      t.Errorf("count %s = %q; expected %q", strings.Join(args, " "), out, "3\n")
+    }
+    if strings.IndexByte(out, 0x1B) != -1 {
+      t.Errorf("count %s printed ANSI escapes: %q", strings.Join(args, " "), out)
+    }
+  }
+  if out := runTestCommand(t, "count", "-folder", "sent"); out != "0\n" {
+    t.Errorf("count -folder sent = %q; expected %q", out, "0\n")
+  }
+}
@@ -0,0 +1,23 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+)
+
+func cmd_daemon(fl *flag.FlagSet) func() {
+  return func() {
+    if err := startControlServer(); err != nil {
+      fatalf("daemon: %v", err)
+    }
+    startBackground()
+    startWebhooks()
+    msgsync.Watch()
+    handleRescanSignal()
+    fmt.Fprintf(os.Stderr, "serving %s on %s (^C to stop)\n",
+      MSGDIR, relPath(WORKDIR, controlSocketPath()))
+    keepRunning = true
+  }
+}
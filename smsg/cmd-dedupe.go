@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "strings"
+)
+
+func cmd_dedupe(fl *flag.FlagSet) func() {
+  opt_trash := fl.Bool("trash", false,
+    "Move all but the earliest copy of each message to the trash")
+  return func() {
+    groups, err := db.CopyGroups()
+    must(err)
+    ncopies, nlinked, ntrashed := 0, 0, 0
+    for _, g := range groups {
+      msg := &Message{}
+      must(db.LoadMessageById(g.ids[0], msg))
+      ids := make([]string, len(g.ids)-1)
+      for i, id := range g.ids[1:] {
+        m := Message{id: id}
+        ids[i] = m.IdString()
+      }
+      fmt.Printf("%s  %s %q from %s: %d copies (%s)\n", msg.IdString(), g.folder,
+        sanitizeText(msg.subject), msg.from.address, len(g.ids), strings.Join(ids, ", "))
+      ncopies += len(g.ids) - 1
+      if !g.linked {
+        must(db.LinkCopies(g.ids))
+        nlinked += len(g.ids) - 1
+      }
+      if *opt_trash {
+        for _, id := range g.ids[1:] {
+          copymsg := &Message{}
+          must(db.LoadMessageById(id, copymsg))
+          if err := trashMessage(copymsg); err != nil {
+            fatalf("%s: %v", copymsg.IdString(), err)
+          }
+          ntrashed++
+        }
+      }
+    }
+
+    fmt.Printf("%d %s with copies, %d extra %s", len(groups),
+      plural(len(groups), "message", "messages"), ncopies, plural(ncopies, "copy", "copies"))
+    if nlinked > 0 {
+      fmt.Printf(", of which %d %s not recorded as such until now", nlinked,
+        plural(nlinked, "was", "were"))
+    }
+    fmt.Println()
+    if ntrashed > 0 {
+      fmt.Printf("moved %d %s to the trash\n", ntrashed, plural(ntrashed, "copy", "copies"))
+    }
+    n, err := db.CountUnhashedMessages()
+    must(err)
+    if n > 0 {
+      fmt.Printf("%s%d %s indexed before copies were detected were not checked "+
+        "(run %s reindex to check them)%s\n",
+        coldim, n, plural(n, "message", "messages"), progname, colreset)
+    }
+  }
+}
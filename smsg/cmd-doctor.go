@@ -0,0 +1,396 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "io/fs"
+  "os"
+  "path/filepath"
+  "time"
+)
+
+// doctorStaleAge is the age at which temporary files are considered left behind
+const doctorStaleAge = 24 * time.Hour
+
+type doctorStatus int
+
+const (
+  doctorPass doctorStatus = iota
+  doctorWarn
+  doctorFail
+)
+
+// doctor runs health checks and reports the results
+type doctor struct {
+  fix        bool
+  exactSizes bool // show sizes in bytes (-bytes)
+  worst      doctorStatus
+}
+
+func cmd_doctor(fl *flag.FlagSet) func() {
+  opt_fix := fl.Bool("fix", false,
+    "Fix problems which can be fixed safely: create missing directories,\n"+
+      "remove stale temporary files, migrate the database and enable write-ahead logging")
+  opt_bytes := fl.Bool("bytes", false, "Show sizes in bytes rather than like \"3.4 MiB\"")
+  return func() {
+    d := &doctor{fix: *opt_fix, exactSizes: *opt_bytes}
+    d.run()
+    Shutdown(int(d.worst))
+  }
+}
+
+// report prints the result of a check. remedy is printed for warnings and failures.
+func (d *doctor) report(status doctorStatus, msg, remedy string) {
+  if status > d.worst {
+    d.worst = status
+  }
+  switch status {
+  case doctorPass:
+    fmt.Printf("%spass%s  %s\n", colrow, colreset, msg)
+  case doctorWarn:
+    fmt.Printf("%swarn%s  %s\n", colwarn, colreset, msg)
+  case doctorFail:
+    fmt.Printf("%sfail%s  %s\n", colfailed, colreset, msg)
+  }
+  if status != doctorPass && remedy != "" {
+    fmt.Printf("      %s%s%s\n", coldim, remedy, colreset)
+  }
+}
+
+// fixed reports that a problem was fixed, or a failure if the fix failed.
+// msg describes what was done, e.g. "created outbox/".
+func (d *doctor) fixed(err error, msg string) {
+  if err != nil {
+    d.report(doctorFail, fmt.Sprintf("failed to fix: %s: %v", msg, err), "")
+  } else {
+    fmt.Printf("%sfix%s   %s\n", colrow, colreset, msg)
+  }
+}
+
+func (d *doctor) run() {
+  if !d.checkMsgDir() {
+    return
+  }
+  d.checkDirs()
+  d.checkTmpFiles()
+  d.checkConfig()
+  d.checkDB()
+  d.checkDaemon()
+}
+
+func (d *doctor) checkMsgDir() bool {
+  if err := isdir(MSGDIR); err != nil {
+    if !os.IsNotExist(err) {
+      d.report(doctorFail, err.Error(), "")
+      return false
+    }
+    if !d.fix {
+      d.report(doctorFail, fmt.Sprintf("%s does not exist", MSGDIR),
+        "Run with -fix to create it, or set -C or SMSG_MSGDIR")
+      return false
+    }
+    if err := os.MkdirAll(MSGDIR, 0700); err != nil {
+      d.fixed(err, "created "+MSGDIR)
+      return false
+    }
+    d.fixed(nil, "created "+MSGDIR)
+  }
+  f, err := os.CreateTemp(MSGDIR, ".doctor-*")
+  if err != nil {
+    d.report(doctorFail, fmt.Sprintf("%s is not writable: %v", MSGDIR, err),
+      "Check the permissions of the directory")
+    return false
+  }
+  f.Close()
+  os.Remove(f.Name())
+  d.report(doctorPass, fmt.Sprintf("%s is writable", MSGDIR), "")
+  return true
+}
+
+func (d *doctor) checkDirs() {
+  for _, dir := range msgDirs() {
+    name := relPath(MSGDIR, dir) + "/"
+    err := isdir(dir)
+    if err == nil {
+      d.report(doctorPass, fmt.Sprintf("%s exists", name), "")
+    } else if !os.IsNotExist(err) {
+      d.report(doctorFail, err.Error(), "")
+    } else if d.fix {
+      d.fixed(os.MkdirAll(dir, 0700), "created "+name)
+    } else {
+      d.report(doctorWarn, fmt.Sprintf("%s does not exist", name),
+        "Run with -fix to create it")
+    }
+  }
+}
+
+// checkTmpFiles looks for temporary files left behind by processes which were killed
+func (d *doctor) checkTmpFiles() {
+  var stale []string
+  entries, _ := os.ReadDir(TMPDIR)
+  for _, ent := range entries {
+    stale = appendIfStale(stale, filepath.Join(TMPDIR, ent.Name()))
+  }
+  stale = appendIfStale(stale, CONFIGFILE+".tmp")
+  if len(stale) == 0 {
+    d.report(doctorPass, "no stale temporary files", "")
+    return
+  }
+  var size int64
+  for _, file := range stale {
+    size += diskUsage(file)
+  }
+  msg := fmt.Sprintf("%d stale temporary %s of %s (e.g. %s)",
+    len(stale), plural(len(stale), "file", "files"), sizeString(size, d.exactSizes),
+    relPath(MSGDIR, stale[0]))
+  if !d.fix {
+    d.report(doctorWarn, msg, "Run with -fix to remove them")
+    return
+  }
+  var err error
+  for _, file := range stale {
+    if err1 := os.RemoveAll(file); err1 != nil && err == nil {
+      err = err1
+    }
+  }
+  d.fixed(err, "removed "+msg)
+}
+
+// diskUsage returns the size of file, or of the files in it if it's a directory
+func diskUsage(file string) (size int64) {
+  filepath.WalkDir(file, func(path string, ent fs.DirEntry, err error) error {
+    if err == nil && !ent.IsDir() {
+      if info, err := ent.Info(); err == nil {
+        size += info.Size()
+      }
+    }
+    return nil
+  })
+  return size
+}
+
+func appendIfStale(files []string, file string) []string {
+  if st, err := os.Stat(file); err == nil && time.Since(st.ModTime()) > doctorStaleAge {
+    files = append(files, file)
+  }
+  return files
+}
+
+func (d *doctor) checkConfig() {
+  if err := config.Load(CONFIGFILE); err != nil {
+    d.report(doctorFail, fmt.Sprintf("invalid config: %v", err), "Correct or remove "+CONFIGFILE)
+    return
+  }
+  d.report(doctorPass, "config is valid", "")
+
+  if len(config.Identities) == 0 {
+    d.report(doctorWarn, "no sender identity configured",
+      fmt.Sprintf("Add one with: %s id add <address> [<name>]", progname))
+    return
+  }
+  for _, id := range config.Identities {
+    address, err := normalizeAndValidateAddress(id.Address)
+    if err != nil {
+      d.report(doctorFail, fmt.Sprintf("identity %q: %v", id.Address, err),
+        fmt.Sprintf("Remove it with: %s id rm %s", progname, id.Address))
+    } else if address != id.Address {
+      d.report(doctorWarn, fmt.Sprintf("identity %q is not normalized (%q)", id.Address, address),
+        fmt.Sprintf("Remove it with \"%s id rm\" and add it again", progname))
+    } else {
+      d.report(doctorPass, fmt.Sprintf("identity %s is valid", id.Address), "")
+    }
+    if id.SigningKey != "" {
+      if _, err := os.Stat(id.SigningKey); err != nil {
+        d.report(doctorWarn, fmt.Sprintf("signing key of %s: %v", id.Address, err), "")
+      }
+    }
+  }
+  if config.DefaultIdentity != "" && config.FindIdentity(config.DefaultIdentity) == nil {
+    d.report(doctorWarn, fmt.Sprintf("default identity %q does not exist", config.DefaultIdentity),
+      fmt.Sprintf("Set it with: %s id use <address>", progname))
+  }
+}
+
+func (d *doctor) checkDB() {
+  if _, err := os.Stat(DBFILE); err != nil {
+    if !os.IsNotExist(err) {
+      d.report(doctorFail, err.Error(), "")
+      return
+    }
+    if !d.fix {
+      d.report(doctorWarn, "database does not exist",
+        "It is created when smsg is run, or run with -fix")
+      return
+    }
+  }
+  if err := db.Connect(); err != nil {
+    d.report(doctorFail, fmt.Sprintf("failed to open database: %v", err), "")
+    return
+  }
+  defer db.Close()
+
+  var result string
+  if err := db.QueryRow(`PRAGMA quick_check`).Scan(&result); err != nil || result != "ok" {
+    if err != nil {
+      result = err.Error()
+    }
+    d.report(doctorFail, fmt.Sprintf("database integrity check failed: %s", result),
+      fmt.Sprintf("Move %s aside; it is rebuilt from the message files", DBFILE))
+    return
+  }
+  d.report(doctorPass, "database integrity check passed", "")
+
+  version, err := db.SchemaVersion()
+  if err != nil {
+    d.report(doctorFail, fmt.Sprintf("failed to read schema version: %v", err), "")
+    return
+  }
+  if version > len(dbMigrations) {
+    d.report(doctorFail,
+      fmt.Sprintf("database schema version %d is newer than this program (%d)",
+        version, len(dbMigrations)),
+      "Upgrade smsg")
+  } else if version < len(dbMigrations) || (version == 0 && !d.tableExists("messages")) {
+    msg := fmt.Sprintf("database schema version %d is outdated (current is %d)",
+      version, len(dbMigrations))
+    if d.fix {
+      d.fixed(db.init(), fmt.Sprintf("migrated database from schema version %d to %d",
+        version, len(dbMigrations)))
+    } else {
+      d.report(doctorWarn, msg, "Run with -fix or run any smsg command to migrate")
+    }
+  } else {
+    d.report(doctorPass, fmt.Sprintf("database schema version %d is current", version), "")
+    d.checkSize()
+    d.checkDuplicates()
+    d.checkFiles()
+  }
+
+  var mode string
+  if err := db.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil {
+    d.report(doctorFail, fmt.Sprintf("failed to read journal mode: %v", err), "")
+  } else if mode != "wal" {
+    // note: journal mode is persistent, so setting it once is enough
+    msg := fmt.Sprintf("database journal mode is %q, not \"wal\"", mode)
+    if d.fix {
+      _, err := db.Exec(`PRAGMA journal_mode = WAL`)
+      d.fixed(err, "enabled write-ahead logging")
+    } else {
+      d.report(doctorWarn, msg,
+        "Concurrent smsg processes may block each other. Run with -fix or run any smsg "+
+          "command to enable WAL")
+    }
+  } else {
+    d.report(doctorPass, "database uses write-ahead logging", "")
+  }
+}
+
+// checkSize reports the size of the database, including its write-ahead log, and the
+// number of messages in it
+func (d *doctor) checkSize() {
+  var size int64
+  for _, file := range []string{DBFILE, DBFILE + "-wal"} {
+    if st, err := os.Stat(file); err == nil {
+      size += st.Size()
+    }
+  }
+  var count int
+  if err := db.QueryRow(`SELECT count(*) FROM messages`).Scan(&count); err != nil {
+    d.report(doctorFail, fmt.Sprintf("failed to count messages: %v", err), "")
+    return
+  }
+  d.report(doctorPass, fmt.Sprintf("database has %s %s in %s", humanCount(count),
+    plural(count, "message", "messages"), sizeString(size, d.exactSizes)), "")
+}
+
+// checkDuplicates reports message files which are copies of other message files, as
+// found by the last scan
+func (d *doctor) checkDuplicates() {
+  dups, err := db.Duplicates("")
+  if err != nil {
+    d.report(doctorFail, fmt.Sprintf("failed to read duplicate files: %v", err), "")
+    return
+  }
+  if len(dups) == 0 {
+    d.report(doctorPass, "no duplicate message files", "")
+    return
+  }
+  const maxListed = 10
+  for i, dup := range dups {
+    if i == maxListed {
+      d.report(doctorWarn, fmt.Sprintf("and %d more", len(dups)-maxListed), "")
+      break
+    }
+    d.report(doctorWarn, fmt.Sprintf("%s is a duplicate of %s", dup.path, dup.canonical), "")
+  }
+  d.report(doctorWarn,
+    fmt.Sprintf("%d duplicate message %s", len(dups), plural(len(dups), "file", "files")),
+    fmt.Sprintf("Run %s scan -remove-duplicates to remove identical copies", progname))
+}
+
+// checkFiles reports indexed message files which have changed or been removed since
+// they were last indexed, as far as can be told without parsing them (see
+// isLikelyUnchanged)
+func (d *doctor) checkFiles() {
+  var changed, removed int
+  for _, folder := range scanFolders {
+    files, err := db.IndexedFiles(folder)
+    if err != nil {
+      d.report(doctorFail, fmt.Sprintf("failed to read indexed files: %v", err), "")
+      return
+    }
+    for rel, f := range files {
+      info, err := os.Stat(filepath.Join(MSGDIR, rel))
+      if err != nil {
+        removed++
+      } else if !isLikelyUnchanged(filepath.Join(MSGDIR, rel), info, f) {
+        changed++
+      }
+    }
+  }
+  if changed == 0 && removed == 0 {
+    d.report(doctorPass, "indexed message files are unchanged", "")
+    return
+  }
+  d.report(doctorWarn, fmt.Sprintf("%d indexed message %s changed and %d removed since "+
+    "last indexed", changed, plural(changed, "file", "files"), removed),
+    fmt.Sprintf("Run %s scan to update the database", progname))
+}
+
+func (d *doctor) tableExists(name string) bool {
+  var n int
+  db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?`,
+    name).Scan(&n)
+  return n > 0
+}
+
+// checkDaemon reports the last scan of the inbox by a running daemon or server, if any
+func (d *doctor) checkDaemon() {
+  c := dialControl()
+  if c == nil {
+    return
+  }
+  defer c.Close()
+  var status controlStatus
+  if err := c.call("status", nil, &status); err != nil {
+    d.report(doctorWarn, fmt.Sprintf("failed to get status of daemon: %v", err), "")
+    return
+  }
+  st := status.LastScan
+  if st == nil {
+    d.report(doctorPass, "daemon has not yet scanned the inbox", "")
+    return
+  }
+  ago := time.Since(st.Time).Round(time.Second)
+  if st.Error != "" {
+    d.report(doctorWarn, fmt.Sprintf("last inbox scan by daemon (%s ago) failed: %s", ago, st.Error),
+      "See the log of the daemon")
+  } else if st.Failed > 0 {
+    d.report(doctorWarn, fmt.Sprintf("last inbox scan by daemon (%s ago): %d %s failed to index",
+      ago, st.Failed, plural(st.Failed, "file", "files")),
+      "See the log of the daemon")
+  } else {
+    d.report(doctorPass, fmt.Sprintf("last inbox scan by daemon was %s ago", ago), "")
+  }
+}
@@ -0,0 +1,164 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bytes"
+  "flag"
+  "fmt"
+  "os"
+  "path/filepath"
+  "time"
+)
+
+// Drafts are messages being composed, saved with "compose -draft" in DRAFTSDIR and
+// indexed in the "drafts" folder. They are not validated, e.g. a draft may have no
+// recipients yet, and are not listed or searched along with other messages unless asked
+// for with -folder drafts. A draft is never delivered, not even if its file is put in the
+// outbox (see Deliverer.deliverFile); "compose -resume" sends it once it's finished.
+
+func cmd_drafts(fl *flag.FlagSet) func() {
+  filter := MessageFilter{folder: "drafts"}
+  addMessageLimitFlag(fl, &filter)
+  return func() {
+    if printMessageList(&filter, nil) == 0 {
+      fmt.Fprintf(os.Stderr, "%s(no drafts)%s\n", coldim, colreset)
+    }
+  }
+}
+
+// parseDraft parses a message being composed to be saved as a draft. Unlike
+// parseOutgoingMessage it doesn't validate the message, and sections without a value,
+// like a "to" which hasn't been filled in, and "time" are removed from data, so that the
+// time is that of when the draft is sent. Like parseOutgoingMessage, the returned data
+// may differ from the input.
+func parseDraft(data []byte, srcname string) (*Message, []byte, error) {
+  data = stripDraftFields(data)
+  msg := &Message{time: time.Now().UTC().Truncate(time.Second)}
+  if err := msg.ParseReader(bytes.NewReader(data), len(data), srcname); err != nil {
+    return nil, nil, err
+  }
+  return msg, data, nil
+}
+
+// stripDraftFields removes the "time" section and sections without a value from the
+// fields of message data, up to its body
+func stripDraftFields(data []byte) []byte {
+  var buf bytes.Buffer
+  for start := 0; start < len(data); {
+    end := bytes.IndexByte(data[start:], '\n')
+    if end == -1 {
+      end = len(data)
+    } else {
+      end += start + 1
+    }
+    line := data[start:end]
+    if bytes.HasPrefix(line, []byte("body ")) {
+      buf.Write(data[start:])
+      break
+    }
+    // note: without "time", a draft gets the time it's sent at (see withTime)
+    if f := bytes.Fields(line); len(f) == 0 || (len(f) > 1 && string(f[0]) != "time") {
+      buf.Write(line)
+    }
+    start = end
+  }
+  return buf.Bytes()
+}
+
+// saveDraft writes a new draft file with data in DRAFTSDIR and adds msg to the database
+func saveDraft(msg *Message, data []byte) {
+  dir, err := messageDir(DRAFTSDIR, msg.time)
+  must(err)
+  file, err := writeMessageFile(dir, msg.time, data)
+  must(err)
+  msg.folder = "drafts"
+  msg.file = relPath(MSGDIR, file)
+  _, err = db.PutMessage(msg)
+  must(err)
+  fmt.Printf("saved draft %s\n", msg.IdString())
+}
+
+// loadDraft loads the draft with id idstr, returning it with the data of its file
+func loadDraft(idstr string) (*Message, []byte, error) {
+  id, err := decodeId(idstr)
+  if err != nil {
+    return nil, nil, errorf("%q: %v", idstr, err)
+  }
+  msg := &Message{}
+  if err := db.LoadMessageById(id, msg); err != nil {
+    return nil, nil, err
+  }
+  if msg.folder != "drafts" {
+    return nil, nil, errorf("message %s is not a draft (it's in %s)", idstr, msg.folder)
+  }
+  if msg.file == "" {
+    return nil, nil, errorf("draft %s has no file", idstr)
+  }
+  data, err := os.ReadFile(filepath.Join(MSGDIR, msg.file))
+  return msg, data, err
+}
+
+// deleteDraft removes a draft and its file, e.g. once it has been sent
+func deleteDraft(msg *Message) error {
+  err := os.Remove(filepath.Join(MSGDIR, msg.file))
+  if err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  return db.DeleteMessages([][24]byte{msg.id})
+}
+
+// resumeDraft opens $EDITOR on the draft with id idstr and sends it, or with draft, saves
+// it as a new draft. Either way the old draft is removed, unless the editor is emptied.
+func resumeDraft(idstr string, draft bool) {
+  old, data, err := loadDraft(idstr)
+  must(err)
+  msg, data, ok := composeInEditor(draftComposeContent(old, data), draft)
+  if !ok {
+    fmt.Fprintf(os.Stderr, "aborted (empty message); draft %s is kept\n", idstr)
+    return
+  }
+  if draft {
+    if msg.id == old.id {
+      fmt.Printf("draft %s is unchanged\n", idstr)
+      return
+    }
+    saveDraft(msg, data)
+  } else {
+    sendMessage(msg, data)
+  }
+  if err := deleteDraft(old); err != nil {
+    errlog("failed to remove draft %s: %v", idstr, err)
+  }
+}
+
+// draftComposeContent returns the data of a draft file for editing, like that of a new
+// message (see cmd_compose): with empty sections for subject, from and to if the draft
+// has none, and with its body's size replaced by composeBodySentinel
+func draftComposeContent(msg *Message, data []byte) []byte {
+  var buf bytes.Buffer
+  if msg.subject == "" {
+    buf.WriteString("subject \n")
+  }
+  if msg.from.address == "" {
+    buf.WriteString("from    \n")
+  }
+  if msg.to.address == "" {
+    buf.WriteString("to      \n")
+  }
+  for start := 0; start < len(data); {
+    end := bytes.IndexByte(data[start:], '\n')
+    if end == -1 {
+      break
+    }
+    end += start + 1
+    if bytes.HasPrefix(data[start:end], []byte("body ")) {
+      buf.Write(data[:start])
+      fmt.Fprintf(&buf, "body    %s\n", composeBodySentinel)
+      buf.Write(data[end:])
+      return buf.Bytes()
+    }
+    start = end
+  }
+  buf.Write(data)
+  return buf.Bytes()
+}
@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "time"
+)
+
+// expiryGrace is how long after they expire messages are purged. They are no longer
+// listed once they have expired, but are kept a while in case the clock of their sender,
+// or of this computer, is off.
+const expiryGrace = time.Hour
+
+// autoPurgeExpiredBudget is how much time is spent purging expired messages at startup.
+// Whatever is left is purged the next time, or by "purge-expired".
+const autoPurgeExpiredBudget = 100 * time.Millisecond
+
+func cmd_purge_expired(fl *flag.FlagSet) func() {
+  opt_dryrun := fl.Bool("dry-run", false, "List messages which would be purged")
+  opt_bytes := fl.Bool("bytes", false, "Show sizes in bytes rather than like \"3.4 MiB\"")
+  return func() {
+    var onPurge func(em *ExpiredMessage, size int64)
+    if *opt_dryrun {
+      onPurge = func(em *ExpiredMessage, size int64) {
+        m := Message{id: em.id}
+        fmt.Printf("%s  %s(%s, expired %s)%s\n", m.IdString(), coldim,
+          sizeString(size, *opt_bytes), formatTime(time.Now(), localTime(em.expires)), colreset)
+      }
+    }
+    count, nbytes, err := purgeExpired(time.Now().Add(-expiryGrace), time.Time{},
+      *opt_dryrun, onPurge)
+    verb := "purged"
+    if *opt_dryrun {
+      verb = "would purge"
+    }
+    fmt.Printf("%s %d expired %s (%s)\n", verb, count, plural(count, "message", "messages"),
+      sizeString(nbytes, *opt_bytes))
+    must(err)
+  }
+}
+
+// purgeExpired permanently deletes messages, in any folder, which expired before the
+// given time, along with their files. Messages without an "expires" section are never
+// deleted. Otherwise like purgeTrash.
+func purgeExpired(
+  before, deadline time.Time, dryrun bool, fn func(em *ExpiredMessage, size int64),
+) (count int, nbytes int64, err error) {
+  var expired []ExpiredMessage
+  err = db.ListExpired(before, func(em *ExpiredMessage) error {
+    expired = append(expired, *em)
+    return nil
+  })
+  if err != nil {
+    return
+  }
+
+  var batch [][24]byte
+  for i := range expired {
+    if !deadline.IsZero() && time.Now().After(deadline) {
+      break
+    }
+    em := &expired[i]
+    var size int64
+    if size, err = removeMessageFile(em.file, dryrun); err != nil {
+      break
+    }
+    if fn != nil {
+      fn(em, size)
+    }
+    count++
+    nbytes += size
+    if !dryrun {
+      batch = append(batch, em.id)
+      if len(batch) == trashPurgeBatchSize {
+        if err = db.DeleteMessages(batch); err != nil {
+          return
+        }
+        batch = batch[:0]
+      }
+    }
+  }
+  if err2 := db.DeleteMessages(batch); err == nil {
+    err = err2
+  }
+  return
+}
+
+// autoPurgeExpired purges expired messages, spending at most autoPurgeExpiredBudget on it
+func autoPurgeExpired() {
+  deadline := time.Now().Add(autoPurgeExpiredBudget)
+  count, _, err := purgeExpired(time.Now().Add(-expiryGrace), deadline, false, nil)
+  if err != nil {
+    if err != errDBClosed {
+      errlog("failed to purge expired messages: %v", err)
+    }
+  } else if count > 0 {
+    synclog.Debugf("purged %d expired %s", count, plural(count, "message", "messages"))
+  }
+}
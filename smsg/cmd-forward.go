@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bytes"
+  "flag"
+  "fmt"
+  "os"
+  "strings"
+  "time"
+)
+
+func cmd_forward(fl *flag.FlagSet) func() {
+  opt_to := fl.String("to", "", "Recipients (addresses or aliases, separated by comma)")
+  opt_from := fl.String("from", "",
+    "Sender identity (address or alias).\nDefaults to the default identity")
+  opt_nofiles := fl.Bool("no-files", false, "Don't include the original message's files")
+  return func() {
+    if fl.NArg() != 1 || *opt_to == "" {
+      fl.Usage()
+      os.Exit(1)
+    }
+
+    recipients, err := parseRecipients(*opt_to)
+    must(err)
+    sender, err := resolveSender(*opt_from)
+    must(err)
+
+    msgsync.WaitReady()
+    orig, err := loadMessage(fl.Arg(0))
+    must(err)
+    if orig.enc != nil {
+      fatalf("%s is encrypted; forwarding encrypted messages is not supported",
+        orig.IdString())
+    }
+
+    fwd := &Message{
+      subject: forwardSubject(orig.subject),
+      from:    sender,
+      to:      recipients[0],
+      cc:      recipients[1:],
+      time:    time.Now().Truncate(time.Second),
+      tags:    orig.tags,
+    }
+
+    var body bytes.Buffer
+    writeForwardHeader(&body, orig)
+    body.Write(orig.body)
+    fwd.body = body.Bytes()
+
+    if !*opt_nofiles {
+      if orig.file == "" {
+        warnlog("the file of message %s is missing; attachments were not included",
+          orig.IdString())
+      } else {
+        fwd.files = orig.files
+      }
+    }
+
+    var buf bytes.Buffer
+    _, err = fwd.WriteTo(&buf)
+    must(err)
+    msg, data, err := parseOutgoingMessage(buf.Bytes(), "forward")
+    must(err)
+    sendMessage(msg, data)
+  }
+}
+
+// forwardSubject returns subject prefixed with "Fwd: ", unless it already is
+func forwardSubject(subject string) string {
+  if len(subject) >= 4 && strings.EqualFold(subject[:4], "fwd:") {
+    return subject
+  }
+  return "Fwd: " + subject
+}
+
+func writeForwardHeader(buf *bytes.Buffer, msg *Message) {
+  buf.WriteString("---------- Forwarded message ----------\n")
+  fmt.Fprintf(buf, "From: %s\n", msg.from)
+  for _, a := range msg.Recipients() {
+    fmt.Fprintf(buf, "To: %s\n", a)
+  }
+  fmt.Fprintf(buf, "Date: %s\n", msg.time.Format("2006-01-02 15:04:05 -0700"))
+  fmt.Fprintf(buf, "Subject: %s\n\n", msg.subject)
+}
@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "strings"
+  "text/tabwriter"
+)
+
+func cmd_id(fl *flag.FlagSet) func() {
+  return func() {
+    switch fl.Arg(0) {
+    case "", "list", "ls":
+      printIdentities()
+    case "add":
+      cmd_id_add(fl.Args()[1:]...)
+    case "use":
+      if fl.NArg() != 2 {
+        fl.Usage()
+        os.Exit(1)
+      }
+      id := config.FindIdentity(fl.Arg(1))
+      if id == nil {
+        fatalf("no identity %q", fl.Arg(1))
+      }
+      config.DefaultIdentity = id.Address
+      must(config.Save(CONFIGFILE))
+    case "rm":
+      if fl.NArg() != 2 {
+        fl.Usage()
+        os.Exit(1)
+      }
+      id := config.FindIdentity(fl.Arg(1))
+      if id == nil {
+        fatalf("no identity %q", fl.Arg(1))
+      }
+      for i, id2 := range config.Identities {
+        if id2 == id {
+          config.Identities = append(config.Identities[:i], config.Identities[i+1:]...)
+          break
+        }
+      }
+      if config.DefaultIdentity == id.Address {
+        config.DefaultIdentity = ""
+      }
+      must(config.Save(CONFIGFILE))
+    default:
+      fatalf("unknown id command %q\nSee %s id -h for help", fl.Arg(0), progname)
+    }
+  }
+}
+
+func cmd_id_add(args ...string) {
+  fl := flag.NewFlagSet("id add", flag.ExitOnError)
+  opt_alias := fl.String("alias", "", "Short name for the identity, for use with -from")
+  opt_key := fl.String("key", "", "Signing key file")
+  fl.Parse(args)
+  if fl.NArg() < 1 {
+    fl.Usage()
+    os.Exit(1)
+  }
+
+  // validate the address once here rather than every time the identity is used
+  address, err := normalizeAndValidateAddress(fl.Arg(0))
+  if err != nil {
+    fatalf("%q: %v", fl.Arg(0), err)
+  }
+  if config.FindIdentity(address) != nil {
+    fatalf("identity %s already exists", address)
+  }
+  if *opt_alias != "" && config.FindIdentity(*opt_alias) != nil {
+    fatalf("alias %q is already in use", *opt_alias)
+  }
+  id := &Identity{
+    Address: address,
+    Name:    strings.Join(fl.Args()[1:], " "),
+    Alias:   *opt_alias,
+  }
+  if *opt_key != "" {
+    id.SigningKey = argPath(*opt_key)
+  }
+  config.Identities = append(config.Identities, id)
+  must(config.Save(CONFIGFILE))
+  fmt.Printf("added identity %s\n", id.Author())
+}
+
+func printIdentities() {
+  if len(config.Identities) == 0 {
+    fmt.Printf("No identities. Add one with: %s id add <address> [<name>]\n", progname)
+    return
+  }
+  defaultId := config.GetDefaultIdentity()
+  w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+  for _, id := range config.Identities {
+    marker := " "
+    if id == defaultId {
+      marker = "*"
+    }
+    fmt.Fprintf(w, "%s %s\t%s\t%s\n", marker, id.Address, id.Name, id.Alias)
+  }
+  w.Flush()
+}
@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "path/filepath"
+  "sort"
+  "text/tabwriter"
+)
+
+func cmd_key(fl *flag.FlagSet) func() {
+  return func() {
+    switch fl.Arg(0) {
+    case "", "list", "ls":
+      printKeys()
+    case "gen":
+      cmd_key_gen(fl.Args()[1:]...)
+    case "add":
+      if fl.NArg() != 3 {
+        fl.Usage()
+        os.Exit(1)
+      }
+      address, err := normalizeAndValidateAddress(fl.Arg(1))
+      if err != nil {
+        fatalf("%q: %v", fl.Arg(1), err)
+      }
+      pub, err := parsePublicKey(fl.Arg(2))
+      must(err)
+      if config.Keys == nil {
+        config.Keys = map[string]string{}
+      }
+      config.Keys[address] = formatPublicKey(pub)
+      must(config.Save(CONFIGFILE))
+      fmt.Printf("added key of %s\n", address)
+    case "rm":
+      if fl.NArg() != 2 {
+        fl.Usage()
+        os.Exit(1)
+      }
+      address, err := normalizeAndValidateAddress(fl.Arg(1))
+      if err != nil {
+        fatalf("%q: %v", fl.Arg(1), err)
+      }
+      if _, ok := config.Keys[address]; !ok {
+        fatalf("no key of %s", address)
+      }
+      delete(config.Keys, address)
+      must(config.Save(CONFIGFILE))
+    default:
+      fatalf("unknown key command %q\nSee %s key -h for help", fl.Arg(0), progname)
+    }
+  }
+}
+
+func cmd_key_gen(args ...string) {
+  fl := flag.NewFlagSet("key gen", flag.ExitOnError)
+  opt_file := fl.String("file", "",
+    "Key `file` of the identity, if it has none yet. Defaults to MSGDIR/.keys/<address>.key")
+  fl.Parse(args)
+  if fl.NArg() > 1 {
+    fl.Usage()
+    os.Exit(1)
+  }
+  id := config.GetDefaultIdentity()
+  if fl.NArg() == 1 {
+    id = config.FindIdentity(fl.Arg(0))
+  }
+  if id == nil {
+    fatalf("no identity %q", fl.Arg(0))
+  }
+  if _, err := identityEncryptionKey(id); err == nil {
+    fatalf("%s already has an encryption key (see %s key)", id.Address, progname)
+  } else if err != errNoEncryptionKey {
+    fatalf(err)
+  }
+  if id.SigningKey == "" {
+    id.SigningKey = filepath.Join(keyFileDir(), id.Address+".key")
+    if *opt_file != "" {
+      id.SigningKey = argPath(*opt_file)
+    }
+    must(config.Save(CONFIGFILE))
+  } else if *opt_file != "" && argPath(*opt_file) != id.SigningKey {
+    fatalf("%s already has the key file %s", id.Address, id.SigningKey)
+  }
+  pub, err := generateEncryptionKey(id.SigningKey)
+  must(err)
+  fmt.Printf("added encryption key of %s to %s\n", id.Address, id.SigningKey)
+  fmt.Printf("public key, for senders to add with \"%s key add %s <key>\":\n%s\n",
+    progname, id.Address, formatPublicKey(pub))
+}
+
+func printKeys() {
+  w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+  for _, id := range config.Identities {
+    priv, err := identityEncryptionKey(id)
+    if err == errNoEncryptionKey {
+      continue
+    } else if err != nil {
+      warnlog("%v", err)
+      continue
+    }
+    fmt.Fprintf(w, "%s\t%s\t(identity)\n", id.Address, formatPublicKey(publicKeyOf(priv)))
+  }
+  addresses := make([]string, 0, len(config.Keys))
+  for address := range config.Keys {
+    addresses = append(addresses, address)
+  }
+  sort.Strings(addresses)
+  for _, address := range addresses {
+    fmt.Fprintf(w, "%s\t%s\n", address, config.Keys[address])
+  }
+  w.Flush()
+}
@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "text/tabwriter"
+)
+
+func cmd_label(fl *flag.FlagSet) func() {
+  return func() {
+    if fl.NArg() == 0 {
+      fl.Usage()
+      os.Exit(1)
+    }
+    id, err := decodeId(fl.Arg(0))
+    if err != nil {
+      fatalf("%q: %v", fl.Arg(0), err)
+    }
+    msg := &Message{}
+    if err := db.LoadMessageById(id, msg); err != nil {
+      fatalf(err)
+    }
+    id = msg.id // note: the message may have been found by its legacy id
+
+    for _, arg := range fl.Args()[1:] {
+      if len(arg) < 2 || (arg[0] != '+' && arg[0] != '-') {
+        fatalf("invalid argument %q (expected +<label> or -<label>)", arg)
+      }
+      label := normalizeLabel(arg[1:])
+      if label == "" {
+        fatalf("invalid label %q (max %d characters, without commas)", arg[1:], maxLabelLen)
+      }
+      if arg[0] == '+' {
+        must(db.AddLabel(id, label))
+      } else if removed, err := db.RemoveLabel(id, label); err != nil {
+        fatalf(err)
+      } else if !removed {
+        warnlog("message %s has no label %q", fl.Arg(0), label)
+      }
+    }
+    if fl.NArg() > 1 {
+      return
+    }
+
+    labels, err := db.Labels(id)
+    must(err)
+    w := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+    for _, l := range labels {
+      fmt.Fprintf(w, "%s\t%s\n", l.label, l.source)
+    }
+    w.Flush()
+  }
+}
@@ -2,120 +2,680 @@
 package main
 
 import (
+  "bufio"
+  "context"
+  "errors"
   "flag"
   "fmt"
-  "log"
-  "math"
+  "io"
+  "io/fs"
   "os"
+  "path/filepath"
+  "strconv"
   "strings"
   "text/tabwriter"
   "time"
+  "unicode/utf8"
 )
 
-func cmd_list(args ...string) {
-  const usagefmt = `
-Usage: %s list [options]
-List messages in inbox
-Options:
-  `
-  fl := flag.NewFlagSet("list", flag.ExitOnError)
-  fl.Usage = func() {
-    fmt.Fprintf(os.Stderr, strings.TrimSpace(usagefmt)+"\n", progname)
-    fl.PrintDefaults()
-  }
+// terminal colors, set by setColors from the theme (see Theme), or empty without colors.
+// Note: lines of tables have the same number of these in their first cell, and they have
+// the same length, which keeps tabwriter columns aligned. Hence the leading zeros.
+var (
+  colmarker    = "\x1B[01m" // the marker of unread messages
+  colrow       = "\x1B[01m" // rows of unread messages
+  colseparator = "\x1B[02m"
+  colheader    = "\x1B[02m"
+  colsnippet   = "\x1B[02m"
+  coldim       = "\x1B[02m"
+  colfailed    = "\x1B[31m"
+  colwarn      = "\x1B[33m"
+  colurgent    = "\x1B[91m" // bright red; messages with priority urgent
+  colhigh      = "\x1B[93m" // bright yellow; messages with priority high
+  colselected  = "\x1B[07m" // reverse video
+  colreset     = "\x1B[00m"
+)
+
+// outgoingFolders are the folders of messages sent by the user, which are listed with
+// their recipients rather than their sender
+var outgoingFolders = []string{"outbox", "sent", "drafts"}
+
+// scanPatience is how long commands like list wait for the initial scan before showing
+// what's already in the index, unless -wait is given (see waitForScan). Tests shorten it.
+var scanPatience = 3 * time.Second
+
+func cmd_list(fl *flag.FlagSet) func() {
   opt_nowait := fl.Bool("nowait", false, "Don't wait for inbox scan")
-  fl.Parse(args)
-
-  if !*opt_nowait {
-    msgsync.WaitReady()
-  }
-  printMessageList(0, 20)
-}
-
-func printMessageList(offset, limit int) int {
-  db.mu.RLock()
-  defer db.mu.RUnlock()
-  rows, err := db.Query(`
-    SELECT id, subject, fromaddr, authors.name as fromname
-    FROM messages
-    LEFT JOIN authors ON authors.address = messages.fromaddr
-    ORDER BY id DESC
-    LIMIT ? OFFSET ?;
-  `, limit, offset)
-  if err != nil {
-    log.Fatal(err)
-  }
-  defer rows.Close()
-
-  coldim := "\x1B[2m"
-  colrow := "\x1B[1m"
-  colreset := "\x1B[0m"
-  now := time.Now()
-  padding := 2
-  w := tabwriter.NewWriter(os.Stdout, 0, 0, padding, ' ', 0)
-  var prevday, prevmonth, prevyear int
-  numwidth := int(math.Log10(float64(offset + limit)))
-  i := offset + limit
-  fmt.Fprintf(w, "%s  # From\tSubject\tTime%s\n", coldim, colreset)
-
-  for rows.Next() {
-    var msg Message
-    must(db.InitMessageRows4(&msg, rows))
-
-    from := limitStrLen(msg.from.ShortString(), 20)
-    subject := limitStrLen(msg.subject, 35)
-    t := msg.time.Local()
-
-    year := t.Year()
-    month := (year << 14) | int(t.Month())
-    day := (month << 12) | t.Day()
-
-    if prevyear != 0 {
-      if year != prevyear {
-        fmt.Fprintf(w, "  %s%d\t\t%s\n", coldim, year, colreset)
-      } else if month != prevmonth {
-        fmt.Fprintf(w, "  %s%s\t\t%s\n", coldim, t.Month(), colreset)
-      } else if day != prevday {
-        fmt.Fprintf(w, "  %s%s\t\t%s\n", coldim, t.Weekday(), colreset)
+  opt_wait := fl.Bool("wait", false,
+    "Wait for inbox scan however long it takes (default: up to "+scanPatience.String()+")")
+  opt_json := fl.Bool("json", false, "Print messages as JSON. Implies -nowait unless -wait")
+  opt_ids := fl.Bool("ids", false, "Print just the ids of messages, one per line.\n"+
+    "Implies -nowait unless -wait")
+  opt_tsv := fl.Bool("tsv", false, "Print messages as tab-separated values, without a header,\n"+
+    "e.g. for cut and awk (see -h). Implies -nowait unless -wait")
+  opt_sort := fl.String("sort", "id",
+    "Order of messages: \"id\" (newest first), or \"priority\" or \"size\" (highest first,\n"+
+      "then newest)")
+  opt_long := fl.Bool("l", false, "Long format, with the id prefix, size and labels of messages")
+  opt_columns := fl.String("columns", "",
+    "Comma-separated `columns` to list, of "+listColumnNames()+".\n"+
+      "Defaults to from,subject,time, or id,from,subject,time with -tsv")
+  var filter MessageFilter
+  fl.BoolVar(&filter.oldest, "reverse", false,
+    "List oldest messages first, e.g. to catch up, numbered counting up from 1")
+  fl.BoolVar(&filter.oldest, "r", false, "Same as -reverse")
+  opt_threads := fl.Bool("threads", false,
+    "List threads of replies, one per row, with the subject of their latest message,\n"+
+      "who is in them and how many messages they have")
+  opt_thread := fl.String("thread", "",
+    "List the messages of the thread which the message with `id` is in, each reply\n"+
+      "indented below the message it's a reply to")
+  addMessageFilterFlags(fl, &filter, "inbox")
+  addMessageLimitFlag(fl, &filter)
+  addTimeZoneFlag(fl)
+  fl.Func("min-size", "Only messages of at least `size`, e.g. 1M", func(s string) (err error) {
+    filter.minSize, err = parseByteSize(s)
+    return
+  })
+  return func() {
+    if *opt_sort != "id" && *opt_sort != "priority" && *opt_sort != "size" {
+      fatalf("invalid -sort %q (expected id, priority or size)", *opt_sort)
+    }
+    filter.sortBy = *opt_sort
+    columns := selectListColumns(*opt_columns, *opt_long, *opt_tsv)
+    if *opt_tsv && (*opt_ids || *opt_json) {
+      fatalf("-tsv can't be combined with -ids or -json")
+    }
+    if *opt_threads || *opt_thread != "" {
+      if *opt_threads && *opt_thread != "" {
+        fatalf("-threads and -thread can't be combined")
+      }
+      if *opt_tsv {
+        fatalf("-tsv can't be combined with threads")
       }
+      if NODB {
+        fatalf("threads need the database, which -no-db leaves closed")
+      }
+      if !filter.sortedById() {
+        fatalf("-sort %s can't be combined with threads, which are in order of replies",
+          filter.sortBy)
+      }
+    }
+    if NODB {
+      if *opt_ids || *opt_json || *opt_tsv {
+        fatalf("-ids, -json and -tsv need message ids, which -no-db leaves unknown")
+      }
+      if !filter.sortedById() {
+        fatalf("-sort %s needs the database, which -no-db leaves closed", filter.sortBy)
+      }
+      if filter.minSize > 0 {
+        fatalf("-min-size needs the database, which -no-db leaves closed")
+      }
+      if filter.oldest {
+        fatalf("-reverse needs the database, which -no-db leaves closed")
+      }
+      printMessageListFromFiles(&filter, columns)
+      return
+    }
+    // note: with a daemon running, messages are listed by it (see control.go)
+    nowait := *opt_nowait || ((*opt_ids || *opt_json || *opt_tsv) && !*opt_wait)
+    updating := false
+    if !nowait && ctl == nil {
+      err := waitForScan(filter.folder, *opt_wait)
+      if err == errInterrupted {
+        return // e.g. by ^C
+      }
+      updating = err != nil
+    }
+    if *opt_threads {
+      printThreadList(&filter, *opt_ids, *opt_json)
+    } else if *opt_thread != "" {
+      if *opt_ids || *opt_json {
+        fatalf("-ids and -json can't be combined with -thread")
+      }
+      printThread(&filter, *opt_thread, columns)
+    } else if *opt_ids {
+      printMessageIds(&filter)
+    } else if *opt_json {
+      printMessageListJSON(&filter)
+    } else if *opt_tsv {
+      printMessageListTSV(&filter, columns)
+    } else {
+      if printMessageList(&filter, columns) == 0 {
+        printEmptyListNote(&filter)
+      }
+    }
+    if updating {
+      printIndexUpdating()
+    }
+  }
+}
+
+// waitForScan waits for the initial scan of the folders needed to list messages in
+// folder. Unless wait is true, it gives up after scanPatience, returning
+// context.DeadlineExceeded. Returns errInterrupted if the program is exiting.
+func waitForScan(folder string, wait bool) error {
+  ctx := context.Background()
+  if !wait {
+    var cancel context.CancelFunc
+    ctx, cancel = context.WithTimeout(ctx, scanPatience)
+    defer cancel()
+  }
+  return msgsync.waitFolderReady(ctx, folder)
+}
+
+// printIndexUpdating notes that messages were listed before the initial scan finished,
+// so some may be missing
+func printIndexUpdating() {
+  fmt.Fprintf(os.Stderr, "%s(index still updating…)%s\n", coldim, colreset)
+}
+
+// addMessageFilterFlags adds flags to fl which set the fields of filter
+func addMessageFilterFlags(fl *flag.FlagSet, filter *MessageFilter, folder string) {
+  fl.StringVar(&filter.folder, "folder", folder,
+    "Only messages in folder (inbox, outbox, sent, archive, trash, drafts or all)")
+  fl.Func("from", "Only messages from `address`", func(s string) (err error) {
+    filter.from, err = normalizeAndValidateAddress(s)
+    return
+  })
+  fl.Func("since", "Only messages since `time` (YYYY-MM-DD or duration, e.g. 7d)",
+    func(s string) (err error) {
+      filter.since, err = parseTimeArg(s)
+      return
+    })
+  fl.Func("until", "Only messages before `time` (YYYY-MM-DD or duration, e.g. 7d)",
+    func(s string) (err error) {
+      filter.until, err = parseTimeArg(s)
+      return
+    })
+  fl.Func("label", "Only messages with `label`", func(s string) error {
+    if filter.label = normalizeLabel(s); filter.label == "" {
+      return errorf("invalid label %q", s)
+    }
+    return nil
+  })
+  fl.BoolVar(&filter.unread, "unread", false, "Only unread messages")
+  fl.BoolVar(&filter.expired, "expired", false,
+    "Include messages which have expired but have not yet been purged")
+  fl.BoolVar(&filter.copies, "copies", false,
+    "Include every copy of messages which have copies, not just the earliest")
+}
+
+// addMessageLimitFlag adds the -n flag to fl, which sets filter.limit
+func addMessageLimitFlag(fl *flag.FlagSet, filter *MessageFilter) {
+  fl.IntVar(&filter.limit, "n", 20, "Max number of messages to show (0 for all)")
+}
+
+// printMessageList prints the messages matching filter, with columns or the default
+// ones if nil, and returns the number of messages printed
+func printMessageList(filter *MessageFilter, columns []*listColumn) int {
+  // messages which could not be delivered are marked in the outbox, and messages which
+  // receipts have been received for are marked in the sent folder
+  var failed map[[24]byte]bool
+  var statuses map[[24]byte]receiptStatus
+  var err error
+  switch filter.folder {
+  case "outbox":
+    failed, err = db.FailedDeliveries()
+  case "sent":
+    statuses, err = db.DeliveryStatuses()
+  }
+  must(err)
+  // messages which have copies are noted with the number of copies (see Config.Duplicates)
+  copies, err := db.CopyCounts()
+  must(err)
+  var labels map[[24]byte][]string
+  if hasListColumn(columns, "labels") {
+    labels, err = db.MessageLabels()
+    must(err)
+  }
+
+  printRow := func(p *messageListPrinter, msg *Message) {
+    if failed[msg.id] {
+      p.PrintRow(msg, colfailed, "✗")
+    } else if status := statuses[msg.id]; status == receiptDelivered {
+      p.PrintRow(msg, colrow, "✓")
+    } else if status == receiptRead {
+      p.PrintRow(msg, colrow, "✓✓")
+    } else {
+      p.PrintRow(msg, colrow, "●") // TODO unread or not
+    }
+  }
+
+  if filter.limit <= 0 {
+    n, err := countMessages(filter)
+    must(err)
+    p := newMessageListPrinter(os.Stdout, n)
+    p.columns = columns
+    p.recipients = indexOfString(outgoingFolders, filter.folder) != -1
+    p.copies = copies
+    p.labels = labels
+    p.datesep = filter.sortedById() // dates are not in order when sorted otherwise
+    if filter.oldest {
+      p.countUp(filter.offset + 1)
+    }
+    must(listMessages(filter, func(msg *Message) error {
+      printRow(p, msg)
+      return nil
+    }))
+    p.Flush()
+    return p.count
+  }
+
+  // list one more message than is shown, to tell whether there are more. Rows are
+  // numbered counting down to 1 for the last one, so the number of rows is needed first.
+  page := *filter
+  page.limit++
+  var msgs []Message
+  must(listMessages(&page, func(msg *Message) error {
+    msgs = append(msgs, *msg)
+    return nil
+  }))
+  more := len(msgs) > filter.limit
+  if more {
+    msgs = msgs[:filter.limit]
+  }
+  p := newMessageListPrinter(os.Stdout, filter.offset+len(msgs))
+  p.columns = columns
+  p.recipients = indexOfString(outgoingFolders, filter.folder) != -1
+  p.copies = copies
+  p.labels = labels
+  p.datesep = filter.sortedById()
+  if filter.oldest {
+    p.countUp(filter.offset + 1)
+  }
+  for i := range msgs {
+    printRow(p, &msgs[i])
+  }
+  p.Flush()
+
+  if more {
+    // note: only counted when there are more, since it reads the whole index of the folder
+    n, err := countMessages(filter)
+    must(err)
+    if n -= filter.offset + len(msgs); n > 0 {
+      fmt.Fprintf(os.Stderr, "%s…and %d more (use -n 0 to show all)%s\n",
+        coldim, n, colreset)
+    }
+  }
+  return p.count
+}
+
+func printMessageIds(filter *MessageFilter) {
+  w := bufio.NewWriter(os.Stdout)
+  var buf []byte
+  must(listMessages(filter, func(msg *Message) error {
+    buf = append(msg.AppendId(buf[:0]), '\n')
+    _, err := w.Write(buf)
+    return err
+  }))
+  must(w.Flush())
+}
+
+func printMessageListJSON(filter *MessageFilter) {
+  messages := []messageJSON{}
+  must(listMessages(filter, func(msg *Message) error {
+    messages = append(messages, makeMessageJSON(msg))
+    return nil
+  }))
+  printJSON(messages)
+}
+
+// printMessageListTSV prints the messages matching filter as tab-separated values (see
+// tsv.go), with columns
+func printMessageListTSV(filter *MessageFilter, columns []*listColumn) {
+  var labels map[[24]byte][]string
+  if hasListColumn(columns, "labels") {
+    var err error
+    labels, err = db.MessageLabels()
+    must(err)
+  }
+  w := bufio.NewWriter(os.Stdout)
+  var buf []byte
+  must(listMessages(filter, func(msg *Message) error {
+    buf = append(appendTSVRow(buf[:0], msg, columns, labels[msg.id]), '\n')
+    _, err := w.Write(buf)
+    return err
+  }))
+  must(w.Flush())
+}
+
+// messageListPrinter writes a table of messages
+type messageListPrinter struct {
+  w        *tabwriter.Writer
+  now      time.Time
+  numwidth int
+  i        int  // number of the next row
+  up       bool // rows are numbered counting up rather than down (see countUp)
+  count    int  // number of rows printed
+  datesep  bool // print a separator line where the date changes
+  columns  []*listColumn // defaultListColumns if nil
+  widths   []int         // of columns, once the header is printed (see fitListColumns)
+  // recipients is true when all messages are outgoing, so that the From column is a To
+  // column with their recipients. Otherwise outgoing messages are marked in it with "→"
+  // before their recipients.
+  recipients bool
+  header   bool // the header has been printed
+
+  copies map[[24]byte]int // number of copies of messages, noted after their subject
+  depth  map[[24]byte]int // depth of replies in a thread, by which their subject is indented
+  labels map[[24]byte][]string // labels of messages, if listed (see MessageLabels)
+
+  prevday, prevmonth, prevyear int
+
+  buf []byte // row being formatted; reused for all rows
+}
+
+// listPadding is the space between the columns of message lists
+const listPadding = 2
+
+// newMessageListPrinter returns a printer which numbers rows counting down from first
+func newMessageListPrinter(w io.Writer, first int) *messageListPrinter {
+  p := &messageListPrinter{
+    w:        tabwriter.NewWriter(w, 0, 0, listPadding, ' ', 0),
+    now:      localTime(time.Now()), // for date separators, in the same zone as rows
+    numwidth: countDigits(first),
+    i:        first,
+    datesep:  true,
+  }
+  return p
+}
+
+// countUp makes the printer number rows counting up from first, for messages listed
+// oldest first. The width of numbers is still that of the number it was created with.
+func (p *messageListPrinter) countUp(first int) {
+  p.i = first
+  p.up = true
+}
+
+// printHeader prints the header of the table before the first row, once the columns are
+// known, and fits them to the terminal
+func (p *messageListPrinter) printHeader() {
+  if p.header {
+    return
+  }
+  p.header = true
+  if p.columns == nil {
+    p.columns = defaultListColumns
+  }
+  // rows start with a marker, the number of the row and a space (see PrintRow)
+  p.widths = fitListColumns(p.columns, 2+p.numwidth+1, stdoutWidth())
+  // "#" is aligned with the last digit of numbers, so that the column headers are aligned
+  // with the values below them
+  b := append(p.buf[:0], colreset+colheader+"  "...)
+  for n := 1; n < p.numwidth; n++ {
+    b = append(b, ' ')
+  }
+  b = append(b, "# "...)
+  for i, c := range p.columns {
+    if i > 0 {
+      b = append(b, '\t')
+    }
+    if c.name == "from" && p.recipients {
+      b = append(b, "To"...)
+    } else {
+      b = append(b, c.header...)
     }
+  }
+  b = append(b, colreset+"\n"...)
+  p.w.Write(b)
+  p.buf = b
+}
 
-    when := formatTime(now, t)
-    marker := "●" // TODO unread or not
-    fmt.Fprintf(w, "%s%s %*d %s\t%s\t%s%s\n",
-      colrow, marker, numwidth, i, from, subject, when, colreset)
+// printSeparator writes a dimmed line with label, e.g. a date, between rows. It has as
+// many cells as rows do, so that it doesn't break the alignment of their columns.
+func (p *messageListPrinter) printSeparator(label string) {
+  cells := strings.Repeat("\t", len(p.columns)-1)
+  fmt.Fprintf(p.w, "  %s%s%s%s%s\n", colreset, colseparator, label, cells, colreset)
+}
 
-    prevyear = year
-    prevmonth = month
-    prevday = day
+// PrintRow writes a row for msg. color must have the same length as colrow.
+// marker is one or two characters wide.
+func (p *messageListPrinter) PrintRow(msg *Message, color, marker string) {
+  p.printHeader()
+  if color == colrow {
+    color = priorityColor(msg.priority, color)
+  }
+  t := localTime(msg.time)
 
-    i--
+  year, month, day := dateKeys(t)
+
+  if p.datesep {
+    // note: the first row is compared to today, so that the rows before the first
+    // separator are today's, whichever order rows are in
+    prevyear, prevmonth, prevday := p.prevyear, p.prevmonth, p.prevday
+    if prevyear == 0 {
+      prevyear, prevmonth, prevday = dateKeys(p.now)
+    }
+    if year != prevyear {
+      p.printSeparator(strconv.Itoa(year))
+    } else if month != prevmonth {
+      p.printSeparator(t.Month().String())
+    } else if day != prevday {
+      p.printSeparator(t.Weekday().String())
+    }
   }
 
-  // if end > -1 {
-  //   fmt.Fprintf(w, "  %s(%d more)\t\t%s\n", coldim, end+1, colreset)
-  // }
+  // note: the row is formatted by appending to a buffer which is reused for all rows,
+  // rather than with fmt, since there may be many thousands of them
+  // the marker of unread messages has a color of its own (see Theme.MarkerUnread)
+  markerColor := color
+  if marker == "●" && color == colrow {
+    markerColor = colmarker
+  }
+  b := append(p.buf[:0], markerColor...)
+  b = append(b, marker...)
+  b = append(b, color...)
+  for n := utf8.RuneCountInString(marker); n < 2; n++ {
+    b = append(b, ' ')
+  }
+  var num [20]byte
+  digits := strconv.AppendInt(num[:0], int64(p.i), 10)
+  for n := len(digits); n < p.numwidth; n++ {
+    b = append(b, ' ')
+  }
+  b = append(b, digits...)
+  b = append(b, ' ')
+  for i, c := range p.columns {
+    if i > 0 {
+      b = append(b, '\t')
+    }
+    b = c.render(p, b, msg, p.widths[i])
+  }
+  b = append(b, colreset...)
+  b = append(b, '\n')
+  p.w.Write(b)
+  p.buf = b
+
+  p.prevyear = year
+  p.prevmonth = month
+  p.prevday = day
+  if p.up {
+    p.i++
+  } else {
+    p.i--
+  }
+  p.count++
+}
+
+// dateKeys returns numbers which are the same for times in the same year, month and day,
+// for separating rows by date
+func dateKeys(t time.Time) (year, month, day int) {
+  year = t.Year()
+  month = (year << 14) | int(t.Month())
+  day = (month << 12) | t.Day()
+  return
+}
+
+// isOutgoing returns true if msg was sent by the user: it's in one of outgoingFolders or,
+// e.g. in the archive, it's from one of the user's identities
+func isOutgoing(msg *Message) bool {
+  return indexOfString(outgoingFolders, msg.folder) != -1 ||
+    config.FindIdentity(msg.from.address) != nil
+}
 
-  w.Flush()
-  return (offset + limit) - i
+// recipientsString returns the short name of the first recipient of msg (see
+// Author.ShortString), followed by the number of others, like "alice +2", in about width
+// columns
+func recipientsString(msg *Message, width int) string {
+  var others string
+  if n := msg.RecipientCount(); n > 1 {
+    others = " +" + strconv.Itoa(n-1)
+  }
+  return limitStrLen(msg.to.ShortString(), imax(width-len(others), 1)) + others
 }
 
-func limitStrLen(s string, maxlen int) string {
-  if len(s) > maxlen {
-    return s[:maxlen-1] + "…"
+// PrintNote writes a dimmed line of text in the subject column, or the first one if
+// there's none, below the last row
+func (p *messageListPrinter) PrintNote(text string) {
+  p.printHeader()
+  i := 0
+  for j, c := range p.columns {
+    if c.name == "subject" {
+      i = j
+      break
+    }
   }
-  return s
+  cells := make([]string, len(p.columns))
+  cells[i] = text
+  cells[0] = colreset + colsnippet + cells[0]
+  fmt.Fprintf(p.w, "%s%s\n", strings.Join(cells, "\t"), colreset)
+}
+
+// Flush writes what has been printed. Without rows or notes, nothing is, not even the
+// header (see printEmptyListNote).
+func (p *messageListPrinter) Flush() {
+  p.w.Flush()
 }
 
-func formatTime(now time.Time, t time.Time) string {
-  if now.Year() != t.Year() {
-    return t.Format("2006, Jan 2, 15:04")
+// errStopWalk stops walkDirRev from the callback, without an error
+var errStopWalk = errors.New("stop walking")
+
+// printMessageListFromFiles lists messages from the headers of their files rather than
+// from the database, for -no-db. Messages are listed newest first by file name, which
+// starts with the time the message was received or sent; the messages of each hosted
+// user (see Config.Recipients) are listed after those of the previous one.
+func printMessageListFromFiles(filter *MessageFilter, columns []*listColumn) {
+  if filter.unread {
+    fatalf("-unread needs the database, which -no-db leaves closed")
+  }
+  if filter.folder == "" || filter.folder == "all" ||
+    indexOfString(reindexFolders, filter.folder) == -1 {
+    fatalf("-no-db can only list one of the folders %s", strings.Join(reindexFolders, ", "))
+  }
+  dir := filepath.Join(MSGDIR, filter.folder)
+  ignore := loadIgnoreRules()
+  var msgs []*Message
+  err := walkDirRev(dir, func(path string, d fs.DirEntry, err error) error {
+    if err != nil {
+      return err
+    }
+    if path == dir {
+      return nil
+    }
+    // skip dot files and ignored files, like the scanner does
+    if d.Name()[0] == '.' || ignore.ignored(relPath(MSGDIR, path), d.IsDir()) {
+      if d.IsDir() {
+        return filepath.SkipDir
+      }
+      return nil
+    }
+    if d.IsDir() || !strings.HasSuffix(path, ".msg") {
+      return nil
+    }
+    msg := &Message{}
+    if err := msg.ParseHeaders(path); err != nil {
+      warnlog("%v", err)
+      return nil
+    }
+    if info, err := d.Info(); err == nil {
+      msg.size = info.Size() // the message is all of its file
+    }
+    // note: -label matches only sender labels; local ones are in the database
+    if msg.receipt != receiptNone ||
+      (filter.from != "" && msg.from.address != filter.from) ||
+      (filter.label != "" && indexOfString(msg.tags, filter.label) == -1) ||
+      (!filter.since.IsZero() && msg.time.Before(filter.since)) ||
+      (!filter.until.IsZero() && !msg.time.Before(filter.until)) {
+      return nil
+    }
+    msgs = append(msgs, msg)
+    if filter.limit > 0 && len(msgs) == filter.limit {
+      return errStopWalk
+    }
+    return nil
+  })
+  if err != nil && err != errStopWalk {
+    fatalf(err)
   }
-  if now.Month() != t.Month() {
-    return t.Format("Jan 2, 15:04")
+  p := newMessageListPrinter(os.Stdout, len(msgs))
+  p.columns = columns
+  p.recipients = indexOfString(outgoingFolders, filter.folder) != -1
+  for _, msg := range msgs {
+    p.PrintRow(msg, colrow, "●")
   }
-  if now.Day() != t.Day() {
-    return t.Format("Jan 2, 15:04")
+  p.Flush()
+  if len(msgs) == 0 {
+    printEmptyListNote(filter)
   }
-  return t.Format("15:04:05")
 }
+
+// printEmptyListNote prints a note in place of a list of the messages matching filter
+// when there are none, like "(inbox is empty)"
+func printEmptyListNote(filter *MessageFilter) {
+  var note string
+  switch {
+  case filter.offset > 0:
+    note = "no more messages"
+  case filter.narrowed():
+    note = "no matching messages"
+  case filter.folder == "" || filter.folder == "all":
+    note = "no messages"
+  default:
+    note = filter.folder + " is empty"
+  }
+  fmt.Fprintf(os.Stderr, "%s(%s)%s\n", coldim, note, colreset)
+}
+
+// displayLocation is the time zone which times are shown in (see setDisplayLocation)
+var displayLocation = time.Local
+
+// setDisplayLocation sets displayLocation to the zone named name, or else by
+// SMSG_DISPLAY_TZ or display_tz in the config, if any: "local", "UTC" or a zone of the
+// IANA time zone database, like "Europe/Berlin"
+func setDisplayLocation(name string) error {
+  for _, s := range []string{name, os.Getenv("SMSG_DISPLAY_TZ"), config.DisplayTZ} {
+    if s == "" {
+      continue
+    }
+    switch strings.ToLower(s) {
+    case "local":
+      displayLocation = time.Local
+    case "utc":
+      displayLocation = time.UTC
+    default:
+      loc, err := time.LoadLocation(s)
+      if err != nil || strings.ToLower(s) == "local" {
+        return errorf("invalid time zone %q (expected local, UTC or a zone like "+
+          "Europe/Berlin, America/New_York or Asia/Tokyo)", s)
+      }
+      displayLocation = loc
+    }
+    return nil
+  }
+  return nil
+}
+
+// addTimeZoneFlag adds the -tz flag to fl, which sets displayLocation. It's parsed after
+// SMSG_DISPLAY_TZ and display_tz have been applied, so it overrides them.
+func addTimeZoneFlag(fl *flag.FlagSet) {
+  fl.Func("tz", "Show times in time `zone`: local, UTC or a zone like Europe/Berlin.\n"+
+    "Overrides environment variable SMSG_DISPLAY_TZ and display_tz in the config.\n"+
+    "JSON output keeps the offsets of times", setDisplayLocation)
+}
+
+// localTime returns t in the time zone which times are shown in (see displayLocation)
+func localTime(t time.Time) time.Time {
+  return t.In(displayLocation)
+}
+
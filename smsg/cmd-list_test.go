@@ -0,0 +1,447 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "io"
+  "math/rand"
+  "os"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestListIds(t *testing.T) {
+  testMsgDir(t)
+  if out := runTestCommand(t, "list", "-ids"); out != "" {
+    t.Errorf("list -ids of an empty inbox = %q; expected nothing", out)
+  }
+  writeTestMessages(t, 3)
+  out := runTestCommand(t, "list", "-ids")
+  if strings.IndexByte(out, 0x1B) != -1 {
+    t.Errorf("list -ids printed ANSI escapes: %q", out)
+  }
+  ids := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+  if len(ids) != 3 || !strings.HasSuffix(out, "\n") {
+    t.Fatalf("list -ids = %q; expected 3 lines", out)
+  }
+  for _, id := range ids {
+    var msg Message
+    if bid, err := decodeId(id); err != nil {
+      t.Errorf("id %q: %v", id, err)
+    } else if err := db.LoadMessageById(bid, &msg); err != nil {
+      t.Errorf("id %q: %v", id, err)
+    }
+  }
+  if out := runTestCommand(t, "list", "-ids", "-n", "1"); strings.Count(out, "\n") != 1 {
+    t.Errorf("list -ids -n 1 = %q; expected one line", out)
+  }
+}
+
+func TestListDoesNotWaitForStalledScan(t *testing.T) {
+  testMsgDir(t)
+  writeTestMessages(t, 3)
+  testStalledScan(t)
+  defer func(d time.Duration) { scanPatience = d }(scanPatience)
+
+  scanPatience = 100 * time.Millisecond
+  start := time.Now()
+  out := runTestCommand(t, "list")
+  if d := time.Since(start); d < scanPatience || d > 10*time.Second {
+    t.Errorf("list took %s; expected about %s", d, scanPatience)
+  }
+  if !strings.Contains(out, "Message 3") {
+    t.Errorf("list = %q; expected the indexed messages", out)
+  }
+
+  // plumbing doesn't wait by default
+  scanPatience = time.Minute
+  start = time.Now()
+  out = runTestCommand(t, "list", "-ids")
+  if d := time.Since(start); d > 10*time.Second {
+    t.Errorf("list -ids took %s", d)
+  }
+  if n := strings.Count(out, "\n"); n != 3 {
+    t.Errorf("list -ids = %q; expected 3 ids", out)
+  }
+}
+
+func TestListWithoutDatabase(t *testing.T) {
+  testMsgDir(t)
+  writeTestMessages(t, 3)
+  writeTestFile(t, INBOXDIR, ".20220601-150000.msg", "not a message")
+  db.Close()
+  NODB = true
+  defer func() { NODB = false }()
+
+  out := runTestCommand(t, "list")
+  i1, i2, i3 := strings.Index(out, "Message 1"), strings.Index(out, "Message 2"),
+    strings.Index(out, "Message 3")
+  if i1 == -1 || i2 == -1 || i3 == -1 || !(i3 < i2 && i2 < i1) {
+    t.Errorf("list = %q; expected messages 3, 2 and 1", out)
+  }
+  out = runTestCommand(t, "list", "-n", "2")
+  if !strings.Contains(out, "Message 3") || !strings.Contains(out, "Message 2") ||
+    strings.Contains(out, "Message 1") {
+    t.Errorf("list -n 2 = %q; expected messages 3 and 2", out)
+  }
+}
+
+// testListLines returns the rows of the output of list as "<number> <subject>", and its
+// date separators as their label, without the header and colors
+func testListLines(out string) []string {
+  var lines []string
+  for _, line := range strings.Split(out, "\n")[1:] {
+    for strings.Contains(line, "\x1b[") {
+      i := strings.Index(line, "\x1b[")
+      line = line[:i] + line[i+5:]
+    }
+    fields := strings.Fields(strings.TrimPrefix(line, "●"))
+    switch len(fields) {
+    case 0:
+    case 1:
+      lines = append(lines, fields[0])
+    default:
+      lines = append(lines, fields[0]+" "+fields[2]+" "+fields[3])
+    }
+  }
+  return lines
+}
+
+// TestListReverse lists messages oldest first, which must be numbered counting up, with
+// date separators where the date changes in either order
+func TestListReverse(t *testing.T) {
+  testMsgDir(t)
+  defer func(loc *time.Location) { displayLocation = loc }(displayLocation)
+  setDisplayLocation("UTC")
+  writeTestMessages(t, 15) // sent from Wednesday 11:00 to Thursday 01:00
+  // rows returns the rows of messages from to to, numbered by the number of the message
+  rows := func(from, to int) string {
+    step := 1
+    if from > to {
+      step = -1
+    }
+    var lines []string
+    for i := from; i != to+step; i += step {
+      lines = append(lines, fmt.Sprintf("%d Message %d", i, i))
+    }
+    return strings.Join(lines, "\n")
+  }
+  for _, test := range []struct {
+    args     []string
+    expected []string
+  }{
+    {[]string{"-n", "0"}, []string{"2022", rows(15, 14), "Wednesday", rows(13, 1)}},
+    {[]string{"-r", "-n", "0"}, []string{"2022", rows(1, 13), "Thursday", rows(14, 15)}},
+    {[]string{"-reverse", "-n", "3"}, []string{"2022", rows(1, 3)}},
+  } {
+    out := runTestCommand(t, "list", test.args...)
+    got, expected := strings.Join(testListLines(out), "\n"), strings.Join(test.expected, "\n")
+    if got != expected {
+      t.Errorf("list %s:\n%s\nexpected\n%s", strings.Join(test.args, " "), got, expected)
+    }
+  }
+}
+
+// TestListRecipients lists sent messages, which must be listed with their recipients in
+// a To column, by contact name if known, and marked with "→" among other messages
+func TestListRecipients(t *testing.T) {
+  testMsgDir(t)
+  config.Identities = []*Identity{{Address: "me@example.com"}}
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  writeTestFile(t, INBOXDIR, "20220601-100000.msg",
+    testMessageText("Hello", "bob@example.com Bob", tm, "Hi"))
+  for i, to := range []string{"carol@example.com", "bob@example.com\nto carol@example.com"} {
+    tm = tm.Add(time.Hour)
+    writeTestFile(t, SENTDIR, tm.Format("20060102-150405")+".msg", fmt.Sprintf(
+      "subject Sent %d\nfrom me@example.com\nto %s\ntime %s\nbody 2\nHi", i+1, to,
+      tm.Format("2006-01-02 15:04:05 -0700")))
+  }
+  scanTestFolder(t, "inbox")
+  scanTestFolder(t, "sent")
+
+  // row returns the row of the message with subject in out
+  row := func(out, subject string) string {
+    for _, line := range strings.Split(out, "\n") {
+      if strings.Contains(line, subject+" ") {
+        return line
+      }
+    }
+    t.Fatalf("no %s in %q", subject, out)
+    return ""
+  }
+  out := runTestCommand(t, "list", "-folder", "sent")
+  if !strings.Contains(strings.Split(out, "\n")[0], "# To") {
+    t.Errorf("header %q; expected a To column", strings.Split(out, "\n")[0])
+  }
+  expected := map[string]string{"Sent 1": "carol@example.com", "Sent 2": "Bob +1"}
+  for subject, to := range expected {
+    if r := row(out, subject); !strings.Contains(r, to+" ") || strings.Contains(r, "→") {
+      t.Errorf("list -folder sent: %q; expected %q", r, to)
+    }
+  }
+  out = runTestCommand(t, "list", "-folder", "all")
+  if r := row(out, "Sent 2"); !strings.Contains(r, "→ Bob +1 ") {
+    t.Errorf("list -folder all: %q; expected → Bob +1", r)
+  }
+  if r := row(out, "Hello"); !strings.Contains(r, "Bob ") || strings.Contains(r, "→") {
+    t.Errorf("list -folder all: %q; expected Bob", r)
+  }
+
+  // without the database, recipients are listed by the addresses in their files
+  db.Close()
+  NODB = true
+  defer func() { NODB = false }()
+  out = runTestCommand(t, "list", "-folder", "sent")
+  if r := row(out, "Sent 2"); !strings.Contains(r, "bob@example.com +1 ") {
+    t.Errorf("list -no-db -folder sent: %q; expected bob@example.com +1", r)
+  }
+}
+
+// TestDisplayLocation sets the zone which times are shown in with -tz, SMSG_DISPLAY_TZ
+// and display_tz, which take precedence in this order, and lists messages in it
+func TestDisplayLocation(t *testing.T) {
+  testMsgDir(t)
+  defer func(loc *time.Location) { displayLocation = loc }(displayLocation)
+  if _, err := time.LoadLocation("Asia/Tokyo"); err != nil {
+    t.Skip("no time zone database:", err)
+  }
+  for _, test := range []struct {
+    tz, env, config string
+    expected        string // the zone, or "" for an invalid one
+  }{
+    {"", "", "", "Local"},
+    {"", "", "Asia/Tokyo", "Asia/Tokyo"},
+    {"", "America/New_York", "Asia/Tokyo", "America/New_York"},
+    {"utc", "America/New_York", "Asia/Tokyo", "UTC"},
+    {"LOCAL", "America/New_York", "", "Local"},
+    {"Mars/Olympus", "", "", ""},
+    {"", "Mars/Olympus", "Asia/Tokyo", ""},
+  } {
+    displayLocation = time.Local
+    t.Setenv("SMSG_DISPLAY_TZ", test.env)
+    config.DisplayTZ = test.config
+    err := setDisplayLocation(test.tz)
+    if test.expected == "" {
+      if err == nil {
+        t.Errorf("%+v: zone %s; expected an error", test, displayLocation)
+      }
+    } else if err != nil || displayLocation.String() != test.expected {
+      t.Errorf("%+v: zone %s, %v; expected %s", test, displayLocation, err, test.expected)
+    }
+  }
+
+  // the messages are sent on the same day in UTC, but not in Tokyo
+  for i, tm := range []time.Time{
+    time.Date(2022, 6, 1, 14, 0, 0, 0, time.UTC),
+    time.Date(2022, 6, 1, 16, 0, 0, 0, time.UTC),
+  } {
+    writeTestFile(t, INBOXDIR, tm.Format("20060102-150405")+".msg",
+      testMessageText(fmt.Sprintf("Message %d", i+1), "alice@example.com", tm, "Hello"))
+  }
+  scanTestFolder(t, "inbox")
+  config.DisplayTZ = ""
+  for zone, expected := range map[string][]string{
+    "UTC":        {"2022", "2 Message 2", "1 Message 1"},
+    "Asia/Tokyo": {"2022", "2 Message 2", "Wednesday", "1 Message 1"},
+  } {
+    if err := setDisplayLocation(zone); err != nil {
+      t.Fatal(err)
+    }
+    out := runTestCommand(t, "list")
+    lines := testListLines(out)
+    if strings.Join(lines, ", ") != strings.Join(expected, ", ") {
+      t.Errorf("%s: list %q; expected %q", zone, lines, expected)
+    }
+    if zone == "Asia/Tokyo" && !strings.Contains(out, "2022, Jun 2, 01:00") {
+      t.Errorf("%s: list = %q; expected the time in Tokyo, 2022, Jun 2, 01:00", zone, out)
+    }
+  }
+}
+
+// testDiscardStdout makes what's written to stdout be discarded until the test ends
+func testDiscardStdout(t testing.TB) {
+  f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  stdout := os.Stdout
+  os.Stdout = f
+  t.Cleanup(func() {
+    os.Stdout = stdout
+    f.Close()
+  })
+}
+
+func BenchmarkListJSON(b *testing.B) {
+  testMsgDir(b)
+  writeTestMessages(b, 1000)
+  testDiscardStdout(b)
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    printMessageListJSON(&MessageFilter{folder: "inbox"})
+  }
+}
+
+// fmtListRow writes a row of q like PrintRow, as it did with fmt before rows were
+// formatted by appending to a buffer, to compare with
+func fmtListRow(q *messageListPrinter, msg *Message, color, marker string) {
+  q.printHeader()
+  if color == colrow {
+    color = priorityColor(msg.priority, color)
+  }
+  markerColor := color
+  if marker == "●" && color == colrow {
+    markerColor = colmarker
+  }
+  var values []string
+  for i, c := range q.columns {
+    values = append(values, string(c.render(q, nil, msg, q.widths[i])))
+  }
+  pad := fmt.Sprintf("%-2s", marker)[len(marker):]
+  fmt.Fprintf(q.w, "%s%s%s%s%*d %s%s\n", markerColor, marker, color, pad, q.numwidth, q.i,
+    strings.Join(values, "\t"), colreset)
+  q.i--
+}
+
+// testListRows returns n messages with a variety of names, subjects, times and priorities
+func testListRows(n int) []*Message {
+  r := rand.New(rand.NewSource(1))
+  names := []string{
+    "", "Alice", "Bob Bobson", "日本語の名前", strings.Repeat("Long Name ", 10),
+  }
+  subjects := []string{
+    "", "Hello", "Re: Hello", "👩‍👩‍👧 family", strings.Repeat("long ", 40),
+  }
+  start := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  var msgs []*Message
+  for i := 0; i < n; i++ {
+    from := Author{fmt.Sprintf("user%d@example.com", i), names[r.Intn(len(names))]}
+    msg := &Message{
+      subject:  subjects[r.Intn(len(subjects))],
+      from:     from,
+      time:     start.Add(time.Duration(r.Int63n(int64(2 * 365 * 24 * time.Hour)))),
+      priority: messagePriority(r.Intn(4) - 1),
+      folder:   "inbox",
+      size:     r.Int63n(10 << 20),
+    }
+    r.Read(msg.id[:])
+    msgs = append(msgs, msg)
+  }
+  return msgs
+}
+
+func TestPrintRowMatchesFmt(t *testing.T) {
+  defer setColors("")
+  for _, color := range []string{"never", "always"} {
+    if err := setColors(color); err != nil {
+      t.Fatal(err)
+    }
+    for _, columns := range [][]*listColumn{defaultListColumns, longListColumns} {
+      msgs := testListRows(2000)
+      var got, want bytes.Buffer
+      p := newMessageListPrinter(&got, len(msgs))
+      q := newMessageListPrinter(&want, len(msgs))
+      p.columns, q.columns = columns, columns
+      p.datesep, q.datesep = false, false
+      markers := []string{"", "●", "✓", "✓✓", "✗"}
+      for i, msg := range msgs {
+        marker := markers[i%len(markers)]
+        p.PrintRow(msg, colrow, marker)
+        fmtListRow(q, msg, colrow, marker)
+      }
+      p.Flush()
+      q.Flush()
+      if got.String() != want.String() {
+        gotLines := strings.Split(got.String(), "\n")
+        wantLines := strings.Split(want.String(), "\n")
+        for i := range gotLines {
+          if i < len(wantLines) && gotLines[i] != wantLines[i] {
+            t.Fatalf("color %s, line %d:\n%q\nexpected\n%q",
+              color, i, gotLines[i], wantLines[i])
+          }
+        }
+        t.Fatalf("color %s: %d lines; expected %d", color, len(gotLines), len(wantLines))
+      }
+    }
+  }
+}
+
+// TestListAlignment checks that the "#" header is aligned with the numbers of rows, and
+// the numbers with each other, as they go from one digit to two
+func TestListAlignment(t *testing.T) {
+  defer setColors("")
+  defer func(loc *time.Location) { displayLocation = loc }(displayLocation)
+  setColors("never")
+  setDisplayLocation("UTC")
+  tests := map[int][]string{
+    9: {
+      "  # From               Subject    Time",
+      "  2022                            ",
+      "● 9 alice@example.com  Message 9  2022, Jun 1, 19:00",
+      "● 8 alice@example.com  Message 8  2022, Jun 1, 18:00",
+      "● 7 alice@example.com  Message 7  2022, Jun 1, 17:00",
+      "● 6 alice@example.com  Message 6  2022, Jun 1, 16:00",
+      "● 5 alice@example.com  Message 5  2022, Jun 1, 15:00",
+      "● 4 alice@example.com  Message 4  2022, Jun 1, 14:00",
+      "● 3 alice@example.com  Message 3  2022, Jun 1, 13:00",
+      "● 2 alice@example.com  Message 2  2022, Jun 1, 12:00",
+      "● 1 alice@example.com  Message 1  2022, Jun 1, 11:00",
+    },
+    10: {
+      "   # From               Subject     Time",
+      "  2022                              ",
+      "● 10 alice@example.com  Message 10  2022, Jun 1, 20:00",
+      "●  9 alice@example.com  Message 9   2022, Jun 1, 19:00",
+      "●  8 alice@example.com  Message 8   2022, Jun 1, 18:00",
+      "●  7 alice@example.com  Message 7   2022, Jun 1, 17:00",
+      "●  6 alice@example.com  Message 6   2022, Jun 1, 16:00",
+      "●  5 alice@example.com  Message 5   2022, Jun 1, 15:00",
+      "●  4 alice@example.com  Message 4   2022, Jun 1, 14:00",
+      "●  3 alice@example.com  Message 3   2022, Jun 1, 13:00",
+      "●  2 alice@example.com  Message 2   2022, Jun 1, 12:00",
+      "●  1 alice@example.com  Message 1   2022, Jun 1, 11:00",
+    },
+    11: {
+      "   # From               Subject     Time",
+      "  2022                              ",
+      "● 11 alice@example.com  Message 11  2022, Jun 1, 21:00",
+      "● 10 alice@example.com  Message 10  2022, Jun 1, 20:00",
+      "●  9 alice@example.com  Message 9   2022, Jun 1, 19:00",
+      "●  8 alice@example.com  Message 8   2022, Jun 1, 18:00",
+      "●  7 alice@example.com  Message 7   2022, Jun 1, 17:00",
+      "●  6 alice@example.com  Message 6   2022, Jun 1, 16:00",
+      "●  5 alice@example.com  Message 5   2022, Jun 1, 15:00",
+      "●  4 alice@example.com  Message 4   2022, Jun 1, 14:00",
+      "●  3 alice@example.com  Message 3   2022, Jun 1, 13:00",
+      "●  2 alice@example.com  Message 2   2022, Jun 1, 12:00",
+      "●  1 alice@example.com  Message 1   2022, Jun 1, 11:00",
+    },
+  }
+  for n, lines := range tests {
+    testMsgDir(t)
+    writeTestMessages(t, n)
+    expected := strings.Join(lines, "\n") + "\n"
+    if out := runTestCommand(t, "list"); out != expected {
+      t.Errorf("list of %d messages:\n%s\nexpected:\n%s", n, out, expected)
+    }
+  }
+}
+
+func BenchmarkPrintRow(b *testing.B) {
+  defer setColors("")
+  setColors("always")
+  msgs := testListRows(1000)
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    p := newMessageListPrinter(io.Discard, len(msgs))
+    p.datesep = false
+    for _, msg := range msgs {
+      p.PrintRow(msg, colrow, "●")
+    }
+    p.Flush()
+  }
+}
@@ -0,0 +1,106 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+// migrateBatchSize is the number of renamed files recorded in the database at once
+const migrateBatchSize = 500
+
+func cmd_migrate_layout(fl *flag.FlagSet) func() {
+  opt_dryrun := fl.Bool("dry-run", false, "Print the files which would be moved")
+  return func() {
+    if c := dialControl(); c != nil {
+      c.Close()
+      fatalf("stop smsg daemon and smsg serve first")
+    }
+    moved := 0
+    for _, folder := range []string{"inbox", "sent"} {
+      moved += migrateFolderLayout(folder, *opt_dryrun)
+    }
+    if *opt_dryrun {
+      return
+    }
+    fmt.Printf("moved %d %s\n", moved, plural(moved, "file", "files"))
+    if !config.DateDirs {
+      // store new messages the same way
+      config.DateDirs = true
+      must(config.Save(CONFIGFILE))
+      fmt.Printf("set date_dirs in %s\n", relPath(WORKDIR, CONFIGFILE))
+    }
+  }
+}
+
+// migrateFolderLayout moves the message files directly in folder, or in the inbox
+// directory of a user, into directories by year and month (see messageDir) and returns
+// how many were moved
+func migrateFolderLayout(folder string, dryrun bool) int {
+  files, err := db.MessageFiles(folder)
+  must(err)
+  ids := make(map[string][24]byte, len(files))
+  for id, file := range files {
+    ids[file] = id
+  }
+
+  dir := filepath.Join(MSGDIR, folder)
+  dirs := []string{dir}
+  entries, err := os.ReadDir(dir)
+  must(err)
+  if folder == "inbox" {
+    for _, ent := range entries {
+      if ent.IsDir() && inboxOwner(filepath.Join(dir, ent.Name(), "x")) != "" {
+        dirs = append(dirs, filepath.Join(dir, ent.Name()))
+      }
+    }
+  }
+
+  var batch []FileRename
+  flush := func() {
+    must(db.RenameFiles(batch))
+    batch = batch[:0]
+  }
+  moved := 0
+  for _, dir := range dirs {
+    entries, err := os.ReadDir(dir)
+    must(err)
+    for _, ent := range entries {
+      name := ent.Name()
+      if ent.IsDir() || name[0] == '.' || !strings.HasSuffix(name, ".msg") {
+        continue
+      }
+      file := filepath.Join(dir, name)
+      var msg Message
+      if err := msg.SetTimeFromFilename(name); err != nil {
+        warnlog("not moving %s: %v", relPath(MSGDIR, file), err)
+        continue
+      }
+      t := msg.time.UTC()
+      dstdir := filepath.Join(dir, t.Format("2006"), t.Format("01"))
+      if dryrun {
+        fmt.Printf("%s -> %s\n", relPath(MSGDIR, file), relPath(MSGDIR, dstdir))
+        continue
+      }
+      must(os.MkdirAll(dstdir, 0700))
+      dstfile, err := moveIntoDir(file, dstdir)
+      if err != nil {
+        errlog("failed to move %s: %v", relPath(MSGDIR, file), err)
+        continue
+      }
+      // note: if smsg is stopped before the database is updated, the next scan finds
+      // the messages at their new paths
+      rel := relPath(MSGDIR, file)
+      batch = append(batch, FileRename{old: rel, new: relPath(MSGDIR, dstfile), id: ids[rel]})
+      if len(batch) == migrateBatchSize {
+        flush()
+      }
+      moved++
+    }
+  }
+  flush()
+  return moved
+}
@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "text/tabwriter"
+  "time"
+)
+
+func cmd_outbox(fl *flag.FlagSet) func() {
+  return func() {
+    switch fl.Arg(0) {
+    case "":
+      printOutbox()
+    case "retry":
+      if fl.NArg() != 2 {
+        fl.Usage()
+        os.Exit(1)
+      }
+      file, msg, err := findOutboxMessage(fl.Arg(1))
+      must(err)
+      must(db.ResetDeliverySchedule(msg.Id()))
+      must(delivery.deliverFile(file, true, nil))
+      fmt.Printf("sent %s to %s\n", msg.IdString(), formatRecipients(msg))
+    default:
+      fatalf("unknown outbox command %q", fl.Arg(0))
+    }
+  }
+}
+
+// outboxMessages calls fn for every message in OUTBOXDIR
+func outboxMessages(fn func(file string, msg *Message)) error {
+  entries, err := os.ReadDir(OUTBOXDIR)
+  if err != nil {
+    return err
+  }
+  for _, ent := range entries {
+    name := ent.Name()
+    if ent.IsDir() || name[0] == '.' || !strings.HasSuffix(name, ".msg") {
+      continue
+    }
+    file := filepath.Join(OUTBOXDIR, name)
+    msg := &Message{}
+    if err := msg.ParseFile(file); err != nil {
+      errlog("failed to read message file %q: %v", file, err)
+      continue
+    }
+    fn(file, msg)
+  }
+  return nil
+}
+
+// findOutboxMessage finds a message in the outbox by id or unique id prefix
+func findOutboxMessage(id string) (file string, msg *Message, err error) {
+  nfound := 0
+  err = outboxMessages(func(file1 string, msg1 *Message) {
+    if strings.HasPrefix(msg1.IdString(), id) {
+      file, msg = file1, msg1
+      nfound++
+    }
+  })
+  if err == nil && nfound > 1 {
+    err = errorf("%w %q", ErrAmbiguousId, id)
+  } else if err == nil && nfound == 0 {
+    err = errorf("message %q %w in outbox", id, ErrNotFound)
+  }
+  return
+}
+
+func printOutbox() {
+  now := time.Now()
+  w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+  fmt.Fprintf(w, "%sId\tTo\tSubject\tSize\tQueued\tAttempts\tStatus\tLast error%s\n",
+    colheader, colreset)
+
+  count := 0
+  must(outboxMessages(func(file string, msg *Message) {
+    var ds DeliveryState
+    must(db.LoadDeliveryState(msg.Id(), &ds))
+    color, status := colreset, "pending"
+    if ds.failed {
+      color, status = colfailed, "failed"
+    } else if now.Before(ds.nextattempt) {
+      status = "retry in " + ds.nextattempt.Sub(now).Round(time.Second).String()
+    }
+    size := "?"
+    if st, err := os.Stat(file); err == nil {
+      size = humanBytes(st.Size())
+    }
+    fmt.Fprintf(w, "%s%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s%s\n", color,
+      msg.IdString(),
+      limitStrLen(msg.to.ShortString(), 20),
+      limitStrLen(msg.subject, 35),
+      size,
+      formatTime(now, localTime(msg.time)),
+      ds.attempts,
+      status,
+      ds.lasterror,
+      colreset)
+    count++
+  }))
+  if count == 0 {
+    fmt.Fprintf(w, "%s(outbox is empty)%s\n", coldim, colreset)
+  }
+  w.Flush()
+}
@@ -0,0 +1,209 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bufio"
+  "context"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "flag"
+  "fmt"
+  "net/url"
+  "os"
+  "strings"
+  "text/tabwriter"
+  "time"
+)
+
+func cmd_peer(fl *flag.FlagSet) func() {
+  return func() {
+    switch fl.Arg(0) {
+    case "", "list", "ls":
+      printPeers()
+    case "add":
+      cmd_peer_add(fl.Args()[1:]...)
+    case "test":
+      if fl.NArg() != 2 {
+        fl.Usage()
+        os.Exit(1)
+      }
+      peer := findPeerArg(fl.Arg(1))
+      if err := testPeer(peer); err != nil {
+        fatalf("peer %s: %v", peer.Name, err)
+      }
+    case "use":
+      if fl.NArg() != 2 {
+        fl.Usage()
+        os.Exit(1)
+      }
+      config.DefaultPeer = findPeerArg(fl.Arg(1)).Name
+      must(config.Save(CONFIGFILE))
+    case "rm":
+      if fl.NArg() != 2 {
+        fl.Usage()
+        os.Exit(1)
+      }
+      peer := findPeerArg(fl.Arg(1))
+      for i, p := range config.Peers {
+        if p == peer {
+          config.Peers = append(config.Peers[:i], config.Peers[i+1:]...)
+          break
+        }
+      }
+      if config.DefaultPeer == peer.Name {
+        config.DefaultPeer = ""
+      }
+      must(config.Save(CONFIGFILE))
+      must(db.DeletePullCursor(peer.Name))
+    default:
+      fatalf("unknown peer command %q\nSee %s peer -h for help", fl.Arg(0), progname)
+    }
+  }
+}
+
+func cmd_peer_add(args ...string) {
+  fl := flag.NewFlagSet("peer add", flag.ExitOnError)
+  opt_url := fl.String("url", "",
+    "Address of the server, like https://host:7110 or tls://host:7112")
+  opt_token := fl.String("token", "", "API `token` of the server; \"-\" reads it from stdin")
+  opt_domains := fl.String("domains", "",
+    "Comma-separated `domains` of recipient addresses to deliver to the server")
+  opt_fingerprint := fl.String("cert-fingerprint", "",
+    "Trust the server's certificate if it has this SHA-256 `fingerprint`")
+  opt_default := fl.Bool("default", false,
+    "Deliver messages for domains of no other peer to the server")
+  fl.Parse(args)
+  if fl.NArg() != 1 || *opt_url == "" {
+    fl.Usage()
+    os.Exit(1)
+  }
+  name := fl.Arg(0)
+  if name == "" || strings.ContainsAny(name, " \t,") {
+    fatalf("invalid peer name %q (must not contain ',' or spaces)", name)
+  }
+  if config.FindPeer(name) != nil {
+    fatalf("peer %q already exists", name)
+  }
+  u, err := url.Parse(*opt_url)
+  if err != nil || u.Host == "" {
+    fatalf("invalid -url %q", *opt_url)
+  }
+  switch u.Scheme {
+  case "http", "https", "tcp", "tls":
+  default:
+    fatalf("invalid -url %q: must be http, https, tcp or tls", *opt_url)
+  }
+
+  peer := &Peer{Name: name, URL: *opt_url, Token: *opt_token}
+  if peer.Token == "-" {
+    line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+    if err != nil && line == "" {
+      fatalf("failed to read token from stdin: %v", err)
+    }
+    peer.Token = strings.TrimSpace(line)
+  }
+  if *opt_domains != "" {
+    for _, d := range strings.Split(*opt_domains, ",") {
+      d, err := normalizeDomain(strings.TrimPrefix(strings.TrimSpace(d), "@"))
+      if err != nil {
+        fatalf("%v", err)
+      }
+      if other := config.peerForDomain("@" + d); other != nil {
+        fatalf("domain %s is already delivered to peer %s", d, other.Name)
+      }
+      peer.Domains = append(peer.Domains, d)
+    }
+  }
+  if *opt_fingerprint != "" {
+    fp := strings.ToLower(strings.ReplaceAll(*opt_fingerprint, ":", ""))
+    if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+      fatalf("invalid -cert-fingerprint %q (expected a SHA-256 hash as hex)",
+        *opt_fingerprint)
+    }
+    peer.CertFingerprint = fp
+  }
+  config.Peers = append(config.Peers, peer)
+  if *opt_default {
+    config.DefaultPeer = name
+  }
+  must(config.Save(CONFIGFILE))
+}
+
+// findPeerArg returns the peer with name, or exits with an error if there's none
+func findPeerArg(name string) *Peer {
+  peer := config.FindPeer(name)
+  if peer == nil {
+    fatalf("no peer %q (see %s peer list)", name, progname)
+  }
+  return peer
+}
+
+// tokenFingerprint returns a short hash of token which identifies it without revealing it
+func tokenFingerprint(token string) string {
+  if token == "" {
+    return "-"
+  }
+  sum := sha256.Sum256([]byte(token))
+  return "sha256:" + hex.EncodeToString(sum[:4])
+}
+
+func printPeers() {
+  if len(config.Peers) == 0 {
+    fmt.Printf("No peers. Add one with: %s peer add -url <url> <name>\n", progname)
+    return
+  }
+  w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+  fmt.Fprintf(w, "%sName\tURL\tDomains\tToken%s\n", colheader, colreset)
+  for _, peer := range config.Peers {
+    domains := strings.Join(peer.Domains, ", ")
+    if peer.Name == config.DefaultPeer {
+      if domains != "" {
+        domains += ", "
+      }
+      domains += "(default)"
+    }
+    if domains == "" {
+      domains = "-"
+    }
+    fmt.Fprintf(w, "%s%s\t%s\t%s\t%s%s\n", colreset,
+      peer.Name, peer.URL, domains, tokenFingerprint(peer.Token), colreset)
+  }
+  w.Flush()
+}
+
+// testPeer connects to a peer, which checks its token, and prints how long it took and
+// the server's version
+func testPeer(peer *Peer) error {
+  start := time.Now()
+  var server string
+  if peerHasAPI(peer) {
+    res, err := peerAPIRequest(context.Background(), peer, "GET", "/v1/health", nil, -1,
+      peerReplyTimeout)
+    if err != nil {
+      return err
+    }
+    defer res.Body.Close()
+    var health struct {
+      Version string `json:"version"`
+      Build   string `json:"build"`
+    }
+    if err := json.NewDecoder(res.Body).Decode(&health); err != nil {
+      return errorf("unexpected response: %v", err)
+    }
+    server = fmt.Sprintf("smsg %s (build %s)", health.Version, health.Build)
+  } else {
+    c, err := dialPeerURL(peer)
+    if err != nil {
+      return err
+    }
+    defer c.Close()
+    if _, err := c.Ping(); err != nil {
+      return err
+    }
+    server = fmt.Sprintf("%s, peer protocol version %d", c.server, c.version)
+  }
+  fmt.Printf("%s: ok in %s; %s\n", peer.Name, time.Since(start).Round(time.Millisecond),
+    server)
+  return nil
+}
@@ -0,0 +1,233 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bufio"
+  "context"
+  "encoding/json"
+  "flag"
+  "fmt"
+  "net/url"
+  "os"
+  "strings"
+  "time"
+)
+
+// pullPageSize is the number of messages listed per request when pulling
+const pullPageSize = 100
+
+// pullRetryInterval is how long pull -follow waits before reconnecting to a peer
+const pullRetryInterval = 10 * time.Second
+
+func cmd_pull(fl *flag.FlagSet) func() {
+  opt_follow := fl.Bool("follow", false,
+    "Keep running and pull new messages as they arrive on the peers")
+  return func() {
+    peers := pullPeers(fl.Args())
+    if !*opt_follow {
+      failed := 0
+      for _, peer := range peers {
+        n, err := pullMessages(context.Background(), peer)
+        if err != nil {
+          errlog("pull from %s: %v", peer.Name, err)
+          failed++
+        }
+        pulllog.Debugf("%d new %s from %s", n, plural(n, "message", "messages"), peer.Name)
+      }
+      if failed > 0 {
+        os.Exit(1)
+      }
+      return
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    RegisterExitHandler(func() { cancel() }, "pull")
+    for _, peer := range peers {
+      go followPeer(ctx, peer)
+    }
+    fmt.Fprintf(os.Stderr, "pulling new messages (^C to stop)\n")
+    keepRunning = true
+  }
+}
+
+// pullPeers returns the peers with the names, or all peers with an HTTP API if names is
+// empty. It's a fatal error if there are none.
+func pullPeers(names []string) []*Peer {
+  var peers []*Peer
+  for _, name := range names {
+    peer := findPeerArg(name)
+    if !peerHasAPI(peer) {
+      fatalf("can't pull from peer %s: its url is not http or https", name)
+    }
+    peers = append(peers, peer)
+  }
+  if len(names) == 0 {
+    for _, peer := range config.Peers {
+      if peerHasAPI(peer) {
+        peers = append(peers, peer)
+      }
+    }
+    if len(peers) == 0 {
+      fatalf("no peers to pull from (see %s peer)", progname)
+    }
+  }
+  return peers
+}
+
+// peerHasAPI returns true if the peer is reached with its HTTP API
+func peerHasAPI(peer *Peer) bool {
+  u, err := url.Parse(peer.URL)
+  return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// pullMessages pulls the messages in the inbox of peer which are newer than the last one
+// pulled from it, oldest first, and returns the number of new messages.
+// The cursor is advanced after each message, so an interrupted pull resumes where it left
+// off. Note that messages are ordered by their time, so a message which arrives at the
+// peer later than newer ones, e.g. after having been delayed, is not pulled.
+func pullMessages(ctx context.Context, peer *Peer) (n int, err error) {
+  for {
+    cursor, err := db.PullCursor(peer.Name)
+    if err != nil {
+      return n, err
+    }
+    q := url.Values{
+      "folder": {"inbox"},
+      "order":  {"oldest"},
+      "limit":  {fmt.Sprint(pullPageSize)},
+    }
+    if cursor != nil {
+      var id [24]byte
+      copy(id[:], cursor)
+      q.Set("after", (&Message{id: id}).IdString())
+    }
+    res, err := peerAPIRequest(ctx, peer, "GET", "/v1/messages?"+q.Encode(), nil, -1,
+      peerReplyTimeout)
+    if err != nil {
+      return n, err
+    }
+    var list struct {
+      Messages []messageJSON `json:"messages"`
+    }
+    err = json.NewDecoder(res.Body).Decode(&list)
+    res.Body.Close()
+    if err != nil {
+      return n, err
+    }
+    for _, m := range list.Messages {
+      isnew, err := pullMessage(ctx, peer, m.Id, m.Time)
+      if err != nil {
+        return n, err
+      }
+      if isnew {
+        n++
+      }
+    }
+    if len(list.Messages) < pullPageSize {
+      return n, nil
+    }
+  }
+}
+
+// pullMessage downloads the message with id from peer into the inbox, unless it's already
+// here, and records it as the last message pulled from peer.
+// t is the time of the message according to the peer.
+func pullMessage(ctx context.Context, peer *Peer, idstr string, t time.Time) (bool, error) {
+  id, err := decodeId(idstr)
+  if err != nil {
+    return false, errorf("peer sent %v", err)
+  }
+  isnew := false
+  if exists, err := db.HasMessage(id); err != nil {
+    return false, err
+  } else if !exists {
+    res, err := peerAPIRequest(ctx, peer, "GET", "/v1/messages/"+idstr+"/raw", nil, -1,
+      peerReplyTimeout)
+    if err != nil {
+      return false, err
+    }
+    defer res.Body.Close()
+    size := int(res.ContentLength)
+    if size < 0 || size > receiveLimits.total {
+      size = receiveLimits.total
+    }
+    // note: the id is recomputed from the file and must match, or the file is not the
+    // message which the peer listed
+    var msg *Message
+    msg, isnew, err = receiveMessage(res.Body, size, t, idstr, true)
+    if err != nil {
+      return false, errorf("message %s: %v", idstr, err)
+    }
+    if isnew {
+      printWatchRow(msg)
+    }
+  }
+  return isnew, db.SetPullCursor(peer.Name, id)
+}
+
+// followPeer pulls new messages from peer as they arrive, using its stream of events
+// (GET /v1/events), until ctx is canceled. Lost connections are retried.
+func followPeer(ctx context.Context, peer *Peer) {
+  for {
+    // catch up first, since the stream only replays a limited number of messages
+    _, err := pullMessages(ctx, peer)
+    if err == nil {
+      err = followPeerEvents(ctx, peer)
+    }
+    if ctx.Err() != nil {
+      return
+    }
+    errlog("pull from %s: %v (retrying in %s)", peer.Name, err, pullRetryInterval)
+    select {
+    case <-ctx.Done():
+      return
+    case <-time.After(pullRetryInterval):
+    }
+  }
+}
+
+// followPeerEvents reads the event stream of peer and pulls each new message.
+// It returns when the stream ends.
+func followPeerEvents(ctx context.Context, peer *Peer) error {
+  path := "/v1/events"
+  if cursor, err := db.PullCursor(peer.Name); err != nil {
+    return err
+  } else if cursor != nil {
+    var id [24]byte
+    copy(id[:], cursor)
+    path += "?since=" + (&Message{id: id}).IdString()
+  }
+  res, err := peerAPIRequest(ctx, peer, "GET", path, nil, -1, 0)
+  if err != nil {
+    return err
+  }
+  defer res.Body.Close()
+  pulllog.Debugf("following %s", peer.Name)
+
+  // parse server-sent events; only the data of "message" events is used
+  var event, data string
+  scanner := bufio.NewScanner(res.Body)
+  for scanner.Scan() {
+    line := scanner.Text()
+    switch {
+    case line == "":
+      if event == "message" && data != "" {
+        var m messageJSON
+        if err := json.Unmarshal([]byte(data), &m); err != nil {
+          return errorf("malformed event: %v", err)
+        }
+        if _, err := pullMessage(ctx, peer, m.Id, m.Time); err != nil {
+          return err
+        }
+      }
+      event, data = "", ""
+    case strings.HasPrefix(line, "event:"):
+      event = strings.TrimSpace(line[len("event:"):])
+    case strings.HasPrefix(line, "data:"):
+      data += strings.TrimSpace(line[len("data:"):])
+    }
+  }
+  if err := scanner.Err(); err != nil {
+    return err
+  }
+  return errorf("the event stream ended")
+}
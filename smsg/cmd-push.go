@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+)
+
+func cmd_push(fl *flag.FlagSet) func() {
+  opt_topeer := fl.String("to-peer", "",
+    "Deliver to the peer `name` regardless of the recipients' addresses")
+  return func() {
+    var peer *Peer
+    if *opt_topeer != "" {
+      peer = findPeerArg(*opt_topeer)
+    }
+
+    type outboxEntry struct {
+      file string
+      msg  *Message
+    }
+    var entries []outboxEntry
+    if fl.NArg() > 0 {
+      for _, id := range fl.Args() {
+        file, msg, err := findOutboxMessage(id)
+        must(err)
+        entries = append(entries, outboxEntry{file, msg})
+      }
+    } else {
+      must(outboxMessages(func(file string, msg *Message) {
+        entries = append(entries, outboxEntry{file, msg})
+      }))
+    }
+    if len(entries) == 0 {
+      fmt.Fprintf(os.Stderr, "outbox is empty\n")
+      return
+    }
+
+    // note: each message is delivered on its own, and its delivery state is recorded by
+    // deliverFile, so a failure doesn't affect the other messages
+    failed := 0
+    for _, e := range entries {
+      to := formatRecipients(e.msg)
+      if peer != nil {
+        to = "peer " + peer.Name
+      }
+      if err := delivery.deliverFile(e.file, true, peer); err != nil {
+        errlog("%s to %s: %v", e.msg.IdString(), to, err)
+        failed++
+      } else {
+        fmt.Printf("sent %s to %s\n", e.msg.IdString(), to)
+      }
+    }
+    if failed > 0 {
+      fatalf("%d of %d %s could not be delivered (see %s outbox)",
+        failed, len(entries), plural(len(entries), "message", "messages"), progname)
+    }
+  }
+}
@@ -1,6 +1,142 @@
 // SPDX-License-Identifier: Apache-2.0
 package main
 
-func cmd_read(args ...string) {
-  fatalf("read: not yet implemented")
+import (
+  "flag"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+func cmd_read(fl *flag.FlagSet) func() {
+  var filter MessageFilter
+  opt_thread := fl.Bool("thread", false,
+    "Read the messages of the thread which the message is in, each reply after the\n"+
+      "message it replies to")
+  fl.BoolVar(&filter.oldest, "reverse", false,
+    "With -unread, read the oldest messages first, e.g. to catch up")
+  fl.BoolVar(&filter.oldest, "r", false, "Same as -reverse")
+  addMessageFilterFlags(fl, &filter, "inbox")
+  fl.IntVar(&filter.limit, "n", 0, "Max number of messages to read (0 for all)")
+  addTimeZoneFlag(fl)
+  return func() {
+    if fl.NArg() > 1 || (fl.NArg() == 0 && (!filter.unread || *opt_thread)) {
+      fl.Usage()
+      os.Exit(1)
+    }
+    if err := waitForScan(filter.folder, true); err == errInterrupted {
+      return // e.g. by ^C
+    }
+
+    // note: messages are listed without all of their data, like their bodies, which
+    // are loaded as they are read
+    var ids []string
+    switch {
+    case *opt_thread:
+      msgs, replies := listThread(&filter, fl.Arg(0))
+      order, _ := threadOrder(msgs, replies)
+      for _, i := range order {
+        ids = append(ids, msgs[i].IdString())
+      }
+    case fl.NArg() == 1:
+      ids = append(ids, fl.Arg(0))
+    default:
+      must(listMessages(&filter, func(msg *Message) error {
+        ids = append(ids, msg.IdString())
+        return nil
+      }))
+      if len(ids) == 0 {
+        printEmptyListNote(&filter)
+      }
+    }
+
+    now := time.Now()
+    for i, id := range ids {
+      msg, err := loadMessage(id)
+      must(err)
+      if i > 0 {
+        fmt.Println()
+      }
+      // messages which can't be decrypted are left unread, for when the key is at hand
+      if err := msg.Decrypt(); err != nil {
+        warnlog("%s: %v", id, err)
+        printMessage(os.Stdout, msg, now)
+        continue
+      }
+      printMessage(os.Stdout, msg, now)
+      must(markRead(msg.id))
+    }
+  }
+}
+
+// messageHeaderLines returns the lines of the header of msg shown when it's read, by
+// read and ui, with its time relative to now when that's recent
+func messageHeaderLines(msg *Message, now time.Time) []string {
+  lines := []string{
+    "From:    " + sanitizeText(msg.from.String()),
+    "To:      " + sanitizeText(formatRecipients(msg)),
+    "Date:    " + formatMessageDate(now, localTime(msg.time)),
+    "Subject: " + sanitizeText(msg.subject),
+  }
+  if msg.size > 0 {
+    lines = append(lines, "Size:    "+humanBytes(msg.size))
+  }
+  if msg.enc != nil && msg.enc.decrypted {
+    lines = append(lines, "Encrypted: yes, decrypted with your key")
+  } else if msg.enc != nil {
+    lines = append(lines, "Encrypted: yes, and could not be decrypted")
+  }
+  return lines
+}
+
+// attachmentLines returns the lines of the block which lists the files of msg when it's
+// read, with their names and sizes, or nil if it has no files
+func attachmentLines(msg *Message) []string {
+  if len(msg.files) == 0 {
+    return nil
+  }
+  names := make([]string, len(msg.files))
+  namewidth := 0
+  for i := range msg.files {
+    f := &msg.files[i]
+    switch {
+    case f.encName != nil && f.name == "":
+      names[i] = encPlaceholder
+    case f.name == "":
+      names[i] = fmt.Sprintf("(file %d)", i+1)
+    default:
+      names[i] = sanitizeText(filepath.Base(f.name))
+    }
+    namewidth = imax(namewidth, textWidth(names[i]))
+  }
+  lines := []string{fmt.Sprintf("%d %s:", len(names),
+    plural(len(names), "attachment", "attachments"))}
+  for i, name := range names {
+    pad := strings.Repeat(" ", namewidth-textWidth(name))
+    lines = append(lines, "  "+name+pad+"  "+humanBytes(int64(msg.files[i].Size())))
+  }
+  return lines
+}
+
+// printMessage prints the header, body and attachments of msg to w. The body of an
+// encrypted message is only printed once it's been decrypted.
+func printMessage(w io.Writer, msg *Message, now time.Time) {
+  for _, line := range messageHeaderLines(msg, now) {
+    fmt.Fprintf(w, "%s%s%s\n", colheader, line, colreset)
+  }
+  if len(msg.body) > 0 {
+    fmt.Fprintln(w)
+    for _, line := range wrapText(string(msg.body), 0) {
+      fmt.Fprintln(w, line)
+    }
+  }
+  if files := attachmentLines(msg); files != nil {
+    fmt.Fprintf(w, "\n%s%s%s\n", colheader, files[0], colreset)
+    for _, line := range files[1:] {
+      fmt.Fprintln(w, line)
+    }
+  }
 }
@@ -0,0 +1,280 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "io"
+  "strings"
+  "testing"
+  "time"
+)
+
+// testReadSetup sets up MSGDIR for the output of read to be the same wherever tests run
+func testReadSetup(t *testing.T) {
+  testMsgDir(t)
+  loc := displayLocation
+  t.Cleanup(func() {
+    setColors("")
+    displayLocation = loc
+  })
+  setColors("never")
+  setDisplayLocation("UTC")
+}
+
+// testListIds returns the ids of the messages listed by list with args
+func testListIds(t *testing.T, args ...string) []string {
+  t.Helper()
+  out := runTestCommand(t, "list", append([]string{"-ids"}, args...)...)
+  return strings.Fields(out)
+}
+
+// testReadSubjects returns the subjects of the messages printed by read with args
+func testReadSubjects(t *testing.T, args ...string) []string {
+  t.Helper()
+  var subjects []string
+  for _, line := range strings.Split(runTestCommand(t, "read", args...), "\n") {
+    if strings.HasPrefix(line, "Subject: ") {
+      subjects = append(subjects, strings.TrimPrefix(line, "Subject: "))
+    }
+  }
+  return subjects
+}
+
+func TestReadMessage(t *testing.T) {
+  testReadSetup(t)
+  writeTestMessages(t, 2)
+  ids := testListIds(t)
+  out := runTestCommand(t, "read", ids[1])
+  expected := "From:    alice@example.com\n" +
+    "To:      me@example.com\n" +
+    "Date:    Wed, Jun 1, 2022 at 11:00\n" +
+    "Subject: Message 1\n" +
+    "Size:    102 B\n" +
+    "\n" +
+    "Hello\n"
+  if out != expected {
+    t.Errorf("read = %q; expected %q", out, expected)
+  }
+  if out := runTestCommand(t, "count", "-unread"); out != "1\n" {
+    t.Errorf("%s unread messages after read; expected 1", strings.TrimSpace(out))
+  }
+}
+
+// TestReadRecentDate reads a message from a few minutes ago, whose date in the header is
+// followed by the time relative to now, like in list
+func TestReadRecentDate(t *testing.T) {
+  testReadSetup(t)
+  tm := time.Now().Add(-5 * time.Minute).Truncate(time.Second)
+  writeTestFile(t, INBOXDIR, tm.UTC().Format("20060102-150405")+".msg",
+    testMessageText("Recent", "alice@example.com", tm, "Hello"))
+  scanTestFolder(t, "inbox")
+  out := runTestCommand(t, "read", testListIds(t)[0])
+  expected := "Date:    " + localTime(tm).Format("Mon, Jan 2, 2006 at 15:04") + " (5m)\n"
+  if !strings.Contains(out, expected) {
+    t.Errorf("read = %q; expected it to contain %q", out, expected)
+  }
+}
+
+func TestReadAttachments(t *testing.T) {
+  testReadSetup(t)
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  text := testMessageText("Files", "alice@example.com", tm, "See attached\n") +
+    "file 11 notes/hello.txt\nHello again\n" +
+    "file 1536 report.pdf\n" + strings.Repeat("x", 1536) + "\n" +
+    "file 3\nabc"
+  writeTestFile(t, INBOXDIR, "20220601-100000.msg", text)
+  scanTestFolder(t, "inbox")
+  out := runTestCommand(t, "read", testListIds(t)[0])
+  expected := "Subject: Files\n" +
+    "Size:    1.7 KiB\n" +
+    "\n" +
+    "See attached\n" +
+    "\n" +
+    "3 attachments:\n" +
+    "  hello.txt   11 B\n" +
+    "  report.pdf  1.5 KiB\n" +
+    "  (file 3)    3 B\n"
+  if !strings.HasSuffix(out, expected) {
+    t.Errorf("read = %q; expected it to end with %q", out, expected)
+  }
+}
+
+func TestReadUnread(t *testing.T) {
+  testReadSetup(t)
+  writeTestMessages(t, 3)
+  ids := testListIds(t)
+  testMarkRead(t, ids[1], true) // Message 2
+
+  subjects := testReadSubjects(t, "-unread")
+  if s := strings.Join(subjects, ", "); s != "Message 3, Message 1" {
+    t.Errorf("read -unread read %s; expected Message 3, Message 1", s)
+  }
+  if ids := testListIds(t, "-unread"); len(ids) != 0 {
+    t.Errorf("%d unread messages after read -unread", len(ids))
+  }
+  if s := testReadSubjects(t, "-unread"); len(s) != 0 {
+    t.Errorf("read -unread of read messages read %v", s)
+  }
+
+  for _, id := range ids {
+    testMarkRead(t, id, false)
+  }
+  for _, args := range [][]string{{"-unread", "-r"}, {"-unread", "-reverse"}} {
+    subjects = testReadSubjects(t, args...)
+    if s := strings.Join(subjects, ", "); s != "Message 1, Message 2, Message 3" {
+      t.Errorf("read %s read %s; expected oldest first", strings.Join(args, " "), s)
+    }
+    for _, id := range ids {
+      testMarkRead(t, id, false)
+    }
+  }
+  subjects = testReadSubjects(t, "-unread", "-r", "-n", "2")
+  if s := strings.Join(subjects, ", "); s != "Message 1, Message 2" {
+    t.Errorf("read -unread -r -n 2 read %s", s)
+  }
+}
+
+func TestReadThread(t *testing.T) {
+  testReadSetup(t)
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  writeTestFile(t, INBOXDIR, "20220601-100000.msg",
+    testMessageText("Question", "alice@example.com", tm, "Hello?"))
+  scanTestFolder(t, "inbox")
+  question := testListIds(t)[0]
+
+  // another message, then a reply to the question
+  tm = tm.Add(time.Hour)
+  writeTestFile(t, INBOXDIR, "20220601-110000.msg",
+    testMessageText("Other", "carol@example.com", tm, "Hi"))
+  tm = tm.Add(time.Hour)
+  reply := testMessageText("Re: Question", "bob@example.com", tm, "Yes")
+  reply = strings.Replace(reply, "body ", "in-reply-to "+question+"\nbody ", 1)
+  writeTestFile(t, INBOXDIR, "20220601-120000.msg", reply)
+  scanTestFolder(t, "inbox")
+
+  subjects := testReadSubjects(t, "-thread", question)
+  if s := strings.Join(subjects, ", "); s != "Question, Re: Question" {
+    t.Errorf("read -thread read %s; expected Question, Re: Question", s)
+  }
+  if ids := testListIds(t, "-unread"); len(ids) != 1 {
+    t.Errorf("%d unread messages after read -thread; expected 1", len(ids))
+  }
+}
+
+// testEncryptedMessage writes a message to the inbox which is encrypted, with its
+// subject, to a new key of the identity me@example.com, and returns its id
+func testEncryptedMessage(t *testing.T) string {
+  t.Helper()
+  pub := testEncryptionKey(t)
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  text := testMessageText("Secret", "alice@example.com", tm, "Hello, secretly")
+  msg := testParse(t, strings.NewReader(text), len(text))
+  keys := map[string][32]byte{"me@example.com": pub}
+  data, err := encryptMessage(msg, []byte(text), keys, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  writeTestFile(t, INBOXDIR, "20220601-100000.msg", string(data))
+  scanTestFolder(t, "inbox")
+  return testListIds(t)[0]
+}
+
+func TestReadEncrypted(t *testing.T) {
+  testReadSetup(t)
+  id := testEncryptedMessage(t)
+  out := runTestCommand(t, "read", id)
+  expected := "From:    alice@example.com\n" +
+    "To:      me@example.com\n" +
+    "Date:    Wed, Jun 1, 2022 at 10:00\n" +
+    "Subject: Secret\n" +
+    "Size:    316 B\n" +
+    "Encrypted: yes, decrypted with your key\n" +
+    "\n" +
+    "Hello, secretly\n"
+  if out != expected {
+    t.Errorf("read = %q; expected %q", out, expected)
+  }
+  if ids := testListIds(t, "-unread"); len(ids) != 0 {
+    t.Errorf("encrypted message is unread after read")
+  }
+}
+
+// TestReadEncryptedWithoutKey reads an encrypted message without the key it's encrypted
+// to, which must print its header but neither its body nor the ciphertext, and leave it
+// unread
+func TestReadEncryptedWithoutKey(t *testing.T) {
+  testReadSetup(t)
+  id := testEncryptedMessage(t)
+  config.Identities[0].SigningKey = ""
+  out := runTestCommand(t, "read", id)
+  expected := "From:    alice@example.com\n" +
+    "To:      me@example.com\n" +
+    "Date:    Wed, Jun 1, 2022 at 10:00\n" +
+    "Subject: " + encPlaceholder + "\n" +
+    "Size:    316 B\n" +
+    "Encrypted: yes, and could not be decrypted\n"
+  if out != expected {
+    t.Errorf("read = %q; expected %q", out, expected)
+  }
+  if ids := testListIds(t, "-unread"); len(ids) != 1 {
+    t.Errorf("message which couldn't be decrypted is read after read")
+  }
+}
+
+// testMarkRead sets the read state of the message with id
+func testMarkRead(t *testing.T, id string, isread bool) {
+  t.Helper()
+  bid, err := decodeId(id)
+  if err == nil {
+    err = db.MarkRead(bid[:], isread)
+  }
+  if err != nil {
+    t.Fatal(err)
+  }
+}
+
+// TestTimeZoneFlag shows the time of a message in another zone with -tz of list, read and
+// stats, which overrides SMSG_DISPLAY_TZ
+func TestTimeZoneFlag(t *testing.T) {
+  testReadSetup(t)
+  if _, err := time.LoadLocation("Asia/Tokyo"); err != nil {
+    t.Skip("no time zone database:", err)
+  }
+  tm := time.Date(2022, 6, 1, 23, 30, 0, 0, time.UTC)
+  writeTestFile(t, INBOXDIR, "20220601-233000.msg",
+    testMessageText("Late", "alice@example.com", tm, "Hello"))
+  scanTestFolder(t, "inbox")
+  id := testListIds(t)[0]
+  t.Setenv("SMSG_DISPLAY_TZ", "America/New_York")
+  if err := setDisplayLocation(""); err != nil {
+    t.Fatal(err)
+  }
+
+  tests := []struct {
+    args     []string
+    expected string
+  }{
+    {[]string{"read", id}, "Date:    Wed, Jun 1, 2022 at 19:30\n"},
+    {[]string{"read", "-tz", "Asia/Tokyo", id}, "Date:    Thu, Jun 2, 2022 at 08:30\n"},
+    {[]string{"read", "-tz", "UTC", id}, "Date:    Wed, Jun 1, 2022 at 23:30\n"},
+    {[]string{"list", "-tz", "Asia/Tokyo"}, "2022, Jun 2, 08:30"},
+    {[]string{"stats", "-tz", "Asia/Tokyo"}, "2022, Jun 2, 08:30"},
+  }
+  for _, test := range tests {
+    out := runTestCommand(t, test.args[0], test.args[1:]...)
+    if !strings.Contains(out, test.expected) {
+      t.Errorf("%s = %q; expected it to contain %q", strings.Join(test.args, " "), out,
+        test.expected)
+    }
+    setDisplayLocation("")
+  }
+
+  // an invalid zone is a usage error
+  fl := flag.NewFlagSet("read", flag.ContinueOnError)
+  fl.SetOutput(io.Discard)
+  findCommand("read").Setup(fl)
+  if err := fl.Parse([]string{"-tz", "Mars/Olympus", id}); err == nil ||
+    !strings.Contains(err.Error(), "Europe/Berlin") {
+    t.Errorf("-tz with an invalid zone: %v", err)
+  }
+}
@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "context"
+  "flag"
+  "fmt"
+  "os"
+  "time"
+)
+
+// reindexFolders are the folders indexed by reindex: those scanned as usual, and the
+// folders which messages are put in by smsg itself
+var reindexFolders = append(scanFolders[:len(scanFolders):len(scanFolders)],
+  "archive", "trash", "drafts")
+
+func cmd_reindex(fl *flag.FlagSet) func() {
+  return func() {
+    must(createMsgDirs())
+    must(os.Chdir(MSGDIR))
+    must(config.Load(CONFIGFILE))
+    if c := dialControl(); c != nil {
+      c.Close()
+      fatalf("stop smsg daemon and smsg serve first")
+    }
+
+    // move the database aside, with its write-ahead log, which may hold recent changes
+    backup := fmt.Sprintf("%s.%s.bak", DBFILE, time.Now().Format("20060102-150405"))
+    hasBackup := true
+    for _, suffix := range []string{"", "-wal", "-shm"} {
+      err := os.Rename(DBFILE+suffix, backup+suffix)
+      if err != nil && os.IsNotExist(err) {
+        if suffix == "" {
+          hasBackup = false
+        }
+      } else {
+        must(err)
+      }
+    }
+    must(db.Open())
+    RegisterExitHandlerWithPhase(ExitPhaseStorage, db.Close, "database")
+
+    ctx, cancel := context.WithCancel(context.Background())
+    RegisterExitHandler(func() error { cancel(); return nil }, "scan")
+    failed := 0
+    for _, folder := range reindexFolders {
+      start := time.Now()
+      scanner := MessageFileScanner{
+        ctx:    ctx,
+        folder: folder,
+        full:   true,
+        follow: config.FollowSymlinks,
+      }
+      if err := scanner.scan(); err != nil {
+        errlog("failed to scan %s: %v", folder, err)
+        Shutdown(1)
+      }
+      fmt.Printf("%s: indexed %d of %d %s in %s\n", folder, scanner.nindexed,
+        len(scanner.seen), plural(len(scanner.seen), "file", "files"),
+        time.Since(start).Round(time.Millisecond))
+      failed += int(scanner.nfailed)
+    }
+    if failed > 0 {
+      warnlog("%d %s failed to index (see log)", failed, plural(failed, "file", "files"))
+    }
+
+    if !hasBackup {
+      return
+    }
+    counts, errs := db.RestoreFrom(backup)
+    for i, q := range restoreQueries {
+      if errs[i] != nil {
+        warnlog("failed to restore %s from old database: %v", q.what, errs[i])
+      } else {
+        fmt.Printf("restored %s: %d\n", q.what, counts[i])
+      }
+    }
+    // messages in the trash without a trash time would never be purged
+    _, err := db.Exec(`UPDATE messages SET trashed = ? WHERE folder = 'trash' AND trashed IS NULL`,
+      time.Now().Unix())
+    must(err)
+    fmt.Printf("the old database is at %s; delete it when you no longer need it\n",
+      relPath(WORKDIR, backup))
+  }
+}
@@ -0,0 +1,150 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bytes"
+  "flag"
+  "fmt"
+  "io"
+  "os"
+  "strings"
+  "time"
+)
+
+// replyOptions are the options of replyTo
+type replyOptions struct {
+  all  bool   // reply to all recipients of the original message
+  cc   string // additional recipients (addresses or aliases, separated by comma)
+  body string // reply text; "-" reads it from stdin and "" opens $EDITOR
+  from string // sender identity; "" for the identity the original was sent to
+}
+
+func cmd_reply(fl *flag.FlagSet) func() {
+  var opt replyOptions
+  fl.BoolVar(&opt.all, "all", false, "Reply to all recipients of the original message")
+  fl.StringVar(&opt.cc, "cc", "",
+    "Additional recipients (addresses or aliases, separated by comma)")
+  fl.StringVar(&opt.body, "body", "", "Reply text. \"-\" reads it from stdin")
+  fl.StringVar(&opt.from, "from", "",
+    "Sender identity (address or alias).\n"+
+      "Defaults to the identity the original message was sent to")
+  return func() {
+    if fl.NArg() != 1 {
+      fl.Usage()
+      os.Exit(1)
+    }
+
+    msgsync.WaitReady()
+    orig, err := loadMessage(fl.Arg(0))
+    must(err)
+    replyTo(orig, opt)
+  }
+}
+
+// replyTo composes a reply to orig and sends it. Returns false if the user aborted.
+func replyTo(orig *Message, opt replyOptions) bool {
+  must(orig.Decrypt())
+  reply := &Message{
+    subject:   replySubject(orig.subject),
+    time:      time.Now().Truncate(time.Second),
+    inReplyTo: orig.id,
+  }
+
+  // sender
+  var err error
+  if opt.from != "" {
+    reply.from, err = resolveSender(opt.from)
+    must(err)
+  } else if id := config.IdentityForAddress(orig.to.address); id != nil {
+    reply.from = id.Author()
+  } else {
+    fatalf("no sender identity configured (see %s id add)", progname)
+  }
+
+  // recipients
+  recipients := []Author{orig.from}
+  if orig.replyTo.address != "" {
+    recipients[0] = orig.replyTo
+  }
+  if opt.all {
+    recipients = append(recipients, orig.Recipients()...)
+  }
+  if opt.cc != "" {
+    cc, err := parseRecipients(opt.cc)
+    must(err)
+    recipients = append(recipients, cc...)
+  }
+  seen := map[string]bool{}
+  for _, a := range recipients {
+    // skip duplicates and, except for the primary recipient, my own identities
+    if seen[a.address] || (len(seen) > 0 && config.FindIdentity(a.address) != nil) {
+      continue
+    }
+    seen[a.address] = true
+    if reply.to.address == "" {
+      reply.to = a
+    } else {
+      reply.cc = append(reply.cc, a)
+    }
+  }
+
+  var msg *Message
+  var data []byte
+  if opt.body != "" {
+    if opt.body == "-" {
+      reply.body, err = io.ReadAll(os.Stdin)
+      must(err)
+    } else {
+      reply.body = []byte(opt.body)
+    }
+    var buf bytes.Buffer
+    _, err = reply.WriteTo(&buf)
+    must(err)
+    msg, data, err = parseOutgoingMessage(buf.Bytes(), "reply")
+    must(err)
+  } else {
+    var buf bytes.Buffer
+    _, err = reply.WriteHeaderTo(&buf)
+    must(err)
+    fmt.Fprintf(&buf, "body %s\n\n", composeBodySentinel)
+    writeQuoted(&buf, orig)
+    var ok bool
+    msg, data, ok = composeInEditor(buf.Bytes(), false)
+    if !ok {
+      fmt.Fprintln(os.Stderr, "aborted (empty message)")
+      return false
+    }
+  }
+
+  // note: a reply to an encrypted message is encrypted too, since it may quote it
+  if orig.enc != nil {
+    msg, data, err = encryptOutgoingMessage(msg, data, orig.enc.subject != nil, "reply")
+    must(err)
+  }
+
+  sendMessage(msg, data)
+  must(markRead(orig.id))
+  return true
+}
+
+// replySubject returns subject prefixed with "Re: ", unless it already is
+func replySubject(subject string) string {
+  if len(subject) >= 3 && strings.EqualFold(subject[:3], "re:") {
+    return subject
+  }
+  return "Re: " + subject
+}
+
+// writeQuoted writes the body of msg with each line prefixed by "> "
+func writeQuoted(w io.Writer, msg *Message) {
+  fmt.Fprintf(w, "On %s, %s wrote:\n",
+    msg.time.Local().Format("Jan 2, 2006 at 15:04"), msg.from.ShortString())
+  body := strings.TrimRight(string(msg.body), "\n")
+  for _, line := range strings.Split(body, "\n") {
+    if line == "" || line[0] == '>' {
+      fmt.Fprintf(w, ">%s\n", line)
+    } else {
+      fmt.Fprintf(w, "> %s\n", line)
+    }
+  }
+}
@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "context"
+  "flag"
+  "fmt"
+  "time"
+)
+
+func cmd_scan(fl *flag.FlagSet) func() {
+  opt_full := fl.Bool("full", false, "Parse all files, even those which have not changed")
+  opt_follow := fl.Bool("follow-symlinks", false,
+    "Follow symbolic links, like the follow_symlinks config")
+  opt_rmdups := fl.Bool("remove-duplicates", false,
+    "Remove files which are identical copies of another message file")
+  return func() {
+    failed := 0
+    for _, folder := range scanFolders {
+      start := time.Now()
+      scanner := MessageFileScanner{
+        ctx:    context.Background(),
+        folder: folder,
+        full:   *opt_full,
+        follow: *opt_follow || config.FollowSymlinks,
+        rmdups: *opt_rmdups,
+      }
+      if err := scanner.scan(); err != nil {
+        errlog("failed to scan %s: %v", folder, err)
+        Shutdown(1)
+      }
+      fmt.Printf("%s: scanned %d %s in %s: %d indexed, %d unchanged, %d failed\n",
+        folder, len(scanner.seen), plural(len(scanner.seen), "file", "files"),
+        time.Since(start).Round(time.Millisecond),
+        scanner.nindexed, scanner.nskipped, scanner.nfailed)
+      if scanner.nremoved > 0 || scanner.nmoved > 0 {
+        fmt.Printf("%s: %d %s removed, %d moved\n", folder,
+          scanner.nremoved, plural(scanner.nremoved, "message", "messages"), scanner.nmoved)
+      }
+      if scanner.ndupsRemoved > 0 {
+        fmt.Printf("%s: removed %d duplicate %s\n", folder,
+          scanner.ndupsRemoved, plural(scanner.ndupsRemoved, "file", "files"))
+      }
+      if n := scanner.ndups - scanner.ndupsRemoved; n > 0 {
+        fmt.Printf("%s: %d duplicate %s (see smsg doctor)\n", folder, n, plural(n, "file", "files"))
+      }
+      failed += int(scanner.nfailed)
+    }
+    if failed > 0 {
+      warnlog("%d %s failed to index (see log)", failed, plural(failed, "file", "files"))
+    }
+  }
+}
@@ -0,0 +1,177 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bufio"
+  "encoding/json"
+  "flag"
+  "fmt"
+  "os"
+  "strings"
+  "time"
+)
+
+func cmd_search(fl *flag.FlagSet) func() {
+  opt_sort := fl.String("sort", "rank", "Order of results: \"rank\" (relevance) or \"date\"")
+  opt_json := fl.Bool("json", false, "Print results as JSON. Implies -nowait unless -wait")
+  opt_tsv := fl.Bool("tsv", false, "Print results as tab-separated values, without a header,\n"+
+    "followed by their snippet (see \"list -h\"). Implies -nowait unless -wait")
+  opt_columns := fl.String("columns", "",
+    "Comma-separated `columns` to list, like those of \"list -columns\"")
+  opt_nowait := fl.Bool("nowait", false, "Don't wait for the scan of message files")
+  opt_wait := fl.Bool("wait", false, "Wait for the scan of message files however long it\n"+
+    "takes (default: up to "+scanPatience.String()+")")
+  var filter MessageFilter
+  addMessageFilterFlags(fl, &filter, "all")
+  addMessageLimitFlag(fl, &filter)
+  return func() {
+    if fl.NArg() == 0 {
+      fl.Usage()
+      os.Exit(1)
+    }
+    if *opt_sort != "rank" && *opt_sort != "date" {
+      fatalf("invalid -sort %q (expected rank or date)", *opt_sort)
+    }
+    query := strings.Join(fl.Args(), " ")
+    bydate := *opt_sort == "date"
+    columns := selectListColumns(*opt_columns, false, *opt_tsv)
+    if *opt_tsv && *opt_json {
+      fatalf("-tsv can't be combined with -json")
+    }
+
+    updating := false
+    if !*opt_nowait && (!(*opt_json || *opt_tsv) || *opt_wait) {
+      err := waitForScan("all", *opt_wait)
+      if err == errInterrupted {
+        return
+      }
+      updating = err != nil
+    }
+    if !db.hasFTS {
+      fmt.Fprintf(os.Stderr,
+        "note: full-text search is unavailable; matching words literally instead\n")
+    }
+
+    if *opt_json || *opt_tsv {
+      if *opt_json {
+        printSearchResultsJSON(query, &filter, bydate)
+      } else {
+        printSearchResultsTSV(query, &filter, bydate, columns)
+      }
+      if updating {
+        printIndexUpdating()
+      }
+      return
+    }
+
+    type result struct {
+      msg     Message
+      snippet string
+    }
+    var results []result
+    err := db.SearchMessages(query, &filter, bydate, func(msg *Message, snippet string) error {
+      results = append(results, result{*msg, snippet})
+      return nil
+    })
+    if err != nil {
+      fatalf("%v", err)
+    }
+    if len(results) == 0 {
+      fmt.Fprintf(os.Stderr, "no messages matching %q\n", query)
+      if updating {
+        printIndexUpdating()
+      }
+      return
+    }
+
+    p := newMessageListPrinter(os.Stdout, filter.offset+len(results))
+    p.columns = columns
+    if hasListColumn(columns, "labels") {
+      p.labels, err = db.MessageLabels()
+      must(err)
+    }
+    p.datesep = bydate // dates are not in order when sorted by rank
+    for i := range results {
+      p.PrintRow(&results[i].msg, colrow, "●")
+      snippet := strings.Join(strings.Fields(results[i].snippet), " ")
+      if snippet != "" && snippet != results[i].msg.subject {
+        p.PrintNote(limitStrLen(snippet, 60))
+      }
+    }
+    p.Flush()
+    if updating {
+      printIndexUpdating()
+    }
+  }
+}
+
+// messageJSON is the JSON encoding of a message in lists of messages
+type messageJSON struct {
+  Id       string          `json:"id"`
+  From     string          `json:"from"`
+  FromName string          `json:"from_name,omitempty"`
+  To       string          `json:"to,omitempty"` // the first recipient
+  ToName   string          `json:"to_name,omitempty"`
+  CcCount  int             `json:"cc_count,omitempty"` // number of other recipients
+  Folder   string          `json:"folder,omitempty"`
+  Subject  string          `json:"subject"`
+  Time     time.Time       `json:"time"`
+  Priority messagePriority `json:"priority"`
+  Size     int64           `json:"size,omitempty"` // in bytes, if known (see Message.Size)
+  Files    int             `json:"file_count,omitempty"` // number of files
+  Snippet  string          `json:"snippet,omitempty"`
+}
+
+func makeMessageJSON(msg *Message) messageJSON {
+  return messageJSON{
+    Id:       msg.IdString(),
+    From:     msg.from.address,
+    FromName: msg.from.name,
+    To:       msg.to.address,
+    ToName:   msg.to.name,
+    CcCount:  imax(len(msg.cc), msg.ncc),
+    Folder:   msg.folder,
+    Subject:  msg.subject,
+    Time:     msg.time,
+    Priority: msg.priority,
+    Size:     msg.size,
+    Files:    msg.FileCount(),
+  }
+}
+
+// printSearchResultsTSV prints search results as tab-separated values (see tsv.go), with
+// columns and their snippet
+func printSearchResultsTSV(query string, filter *MessageFilter, bydate bool, columns []*listColumn) {
+  var labels map[[24]byte][]string
+  if hasListColumn(columns, "labels") {
+    var err error
+    labels, err = db.MessageLabels()
+    must(err)
+  }
+  w := bufio.NewWriter(os.Stdout)
+  var buf []byte
+  must(db.SearchMessages(query, filter, bydate, func(msg *Message, snippet string) error {
+    buf = append(appendTSVRow(buf[:0], msg, columns, labels[msg.id]), '\t')
+    buf = append(appendTSVField(buf, snippet), '\n')
+    _, err := w.Write(buf)
+    return err
+  }))
+  must(w.Flush())
+}
+
+func printJSON(v interface{}) {
+  enc := json.NewEncoder(os.Stdout)
+  enc.SetIndent("", "  ")
+  must(enc.Encode(v))
+}
+
+func printSearchResultsJSON(query string, filter *MessageFilter, bydate bool) {
+  results := []messageJSON{}
+  must(db.SearchMessages(query, filter, bydate, func(msg *Message, snippet string) error {
+    m := makeMessageJSON(msg)
+    m.Snippet = snippet
+    results = append(results, m)
+    return nil
+  }))
+  printJSON(results)
+}
@@ -1,6 +1,371 @@
 // SPDX-License-Identifier: Apache-2.0
 package main
 
-func cmd_send(args ...string) {
-  fatalf("send: not yet implemented")
+import (
+  "bytes"
+  "flag"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+)
+
+func cmd_send(fl *flag.FlagSet) func() {
+  opt_dryrun := fl.Bool("dry-run", false,
+    "Parse and validate the message and print a summary without sending it")
+  opt_from := fl.String("from", "",
+    "Sender identity (address or alias) for messages without a \"from\" section.\n"+
+      "Defaults to the default identity")
+  opt_to := fl.String("to", "",
+    "Recipients (addresses or aliases, separated by comma) for messages without\n"+
+      "a \"to\" section")
+  opt_expires := fl.String("expires", "",
+    "Make the message expire `duration` after it's sent, e.g. 24h, for messages\n"+
+      "without an \"expires\" section. Expired messages are deleted")
+  opt_priority := fl.String("priority", "",
+    "Priority (low, normal, high or urgent) for messages without a \"priority\" section")
+  opt_encrypt := fl.Bool("encrypt", false,
+    "Encrypt the body and files to the public keys of the recipients (see \"smsg key\")")
+  opt_encryptsubject := fl.Bool("encrypt-subject", false,
+    "Like -encrypt, and also encrypt the subject, which is then listed as "+
+      strconv.Quote(encPlaceholder))
+  return func() {
+    if fl.NArg() != 1 {
+      fl.Usage()
+      os.Exit(1)
+    }
+
+    srcname := fl.Arg(0)
+    var data []byte
+    var err error
+    if srcname == "-" {
+      srcname = "<stdin>"
+      data, err = io.ReadAll(os.Stdin)
+    } else {
+      data, err = os.ReadFile(argPath(srcname))
+    }
+    must(err)
+
+    data, err = withSender(data, *opt_from)
+    must(err)
+    if *opt_to != "" {
+      data, err = withRecipients(data, *opt_to)
+      must(err)
+    }
+    if *opt_expires != "" {
+      data, err = withExpiry(data, *opt_expires)
+      must(err)
+    }
+    if *opt_priority != "" {
+      data, err = withPriority(data, *opt_priority)
+      must(err)
+    }
+
+    msg, data, err := parseOutgoingMessage(data, srcname)
+    must(err)
+    if *opt_encrypt || *opt_encryptsubject {
+      msg, data, err = encryptOutgoingMessage(msg, data, *opt_encryptsubject, srcname)
+      must(err)
+    }
+
+    if *opt_dryrun {
+      printMessageSummary(os.Stdout, msg)
+      return
+    }
+
+    sendMessage(msg, data)
+  }
+}
+
+// sendMessage queues a message for delivery and makes a first delivery attempt
+func sendMessage(msg *Message, data []byte) {
+  file, err := queueMessage(msg, data)
+  must(err)
+  dlog("wrote %s", relPath(MSGDIR, file))
+  if err := delivery.deliverFile(file, false, nil); err != nil {
+    fmt.Printf("queued %s to %s (not yet delivered: %v)\n",
+      msg.IdString(), formatRecipients(msg), err)
+  } else {
+    fmt.Printf("sent %s to %s\n", msg.IdString(), formatRecipients(msg))
+  }
+}
+
+// parseOutgoingMessage parses and validates a message about to be sent.
+// Messages without a "time" section get one with the current time (see withTime), so the
+// returned data may differ from the input.
+func parseOutgoingMessage(data []byte, srcname string) (*Message, []byte, error) {
+  now := time.Now().UTC().Truncate(time.Second)
+  data = withTime(data, now)
+  msg := &Message{time: now}
+  if err := msg.ParseReader(bytes.NewReader(data), len(data), srcname); err != nil {
+    return nil, nil, err
+  }
+  if err := msg.Validate(); err != nil {
+    return nil, nil, errorf("%s: %v", srcname, err)
+  }
+  return msg, data, nil
+}
+
+// encryptOutgoingMessage encrypts msg, parsed from data, to the public keys of its
+// recipients and sender, if the sender has one (see encryptMessage), and returns the
+// encrypted message, parsed
+func encryptOutgoingMessage(msg *Message, data []byte, encryptSubject bool, srcname string) (
+  *Message, []byte, error,
+) {
+  if msg.enc != nil {
+    return nil, nil, errorf("%s: message is already encrypted", srcname)
+  }
+  keys := map[string][32]byte{}
+  for _, a := range msg.Recipients() {
+    pub, err := recipientPublicKey(a.address)
+    if err != nil {
+      return nil, nil, err
+    }
+    keys[a.address] = pub
+  }
+  // note: with the sender's key, the copy of the message in the sent folder is readable
+  if pub, err := recipientPublicKey(msg.from.address); err == nil {
+    keys[msg.from.address] = pub
+  }
+  data, err := encryptMessage(msg, data, keys, encryptSubject)
+  if err != nil {
+    return nil, nil, err
+  }
+  return parseOutgoingMessage(data, srcname)
+}
+
+// withTime adds a "time" section with t to encoded message data which doesn't have one.
+// Without it, the server receiving the message would use the time it was received, which
+// gives the message a different id there than here.
+func withTime(data []byte, t time.Time) []byte {
+  var msg Message
+  // note: parsing fails without a time; other errors are reported by the caller
+  msg.ParseReader(bytes.NewReader(data), len(data), "")
+  if !msg.time.IsZero() {
+    return data
+  }
+  // note: appended rather than prepended to keep line numbers in parse errors
+  return append(data, "\ntime "+t.Format("2006-01-02 15:04:05 -0700")+"\n"...)
+}
+
+// resolveSender returns the sender for a -from flag value, which is the address or alias of
+// an identity, or any "address [name]". An empty value means the default identity.
+func resolveSender(from string) (Author, error) {
+  if from == "" {
+    id := config.GetDefaultIdentity()
+    if id == nil {
+      return Author{}, errorf("no sender identity configured (see %s id add)", progname)
+    }
+    return id.Author(), nil
+  }
+  if id := config.FindIdentity(from); id != nil {
+    return id.Author(), nil
+  }
+  var a Author
+  err := a.Parse([]byte(from))
+  return a, err
+}
+
+// withSender adds a "from" section to encoded message data which doesn't have one.
+// from is resolved with resolveSender.
+func withSender(data []byte, from string) ([]byte, error) {
+  var msg Message
+  msg.time = time.Now()
+  if err := msg.ParseReader(bytes.NewReader(data), len(data), ""); err != nil {
+    return data, nil // let the caller report the parse error
+  }
+  if msg.from.address != "" {
+    if from != "" {
+      return nil, errorf("message already has a sender (%s)", msg.from.address)
+    }
+    return data, nil
+  }
+  sender, err := resolveSender(from)
+  if err != nil {
+    return nil, err
+  }
+  return append([]byte("from "+sender.FieldValue()+"\n"), data...), nil
+}
+
+// withRecipients adds "to" sections to encoded message data which doesn't have any.
+// to is parsed with parseRecipients.
+func withRecipients(data []byte, to string) ([]byte, error) {
+  var msg Message
+  msg.time = time.Now()
+  if err := msg.ParseReader(bytes.NewReader(data), len(data), ""); err != nil {
+    return data, nil // let the caller report the parse error
+  }
+  if msg.to.address != "" {
+    return nil, errorf("message already has recipients (%s)", formatRecipients(&msg))
+  }
+  recipients, err := parseRecipients(to)
+  if err != nil {
+    return nil, err
+  }
+  var buf bytes.Buffer
+  for _, a := range recipients {
+    buf.WriteString("to " + a.FieldValue() + "\n")
+  }
+  return append(buf.Bytes(), data...), nil
+}
+
+// withExpiry adds an "expires" section with value expires, e.g. "24h", to encoded message
+// data which doesn't have one
+func withExpiry(data []byte, expires string) ([]byte, error) {
+  if d, err := parseDuration(expires); err != nil || d <= 0 {
+    return nil, errorf("invalid -expires %q (expected a duration, e.g. 24h)", expires)
+  }
+  var msg Message
+  msg.time = time.Now()
+  if err := msg.ParseReader(bytes.NewReader(data), len(data), ""); err != nil {
+    return data, nil // let the caller report the parse error
+  }
+  if !msg.expires.IsZero() {
+    return nil, errorf("message already has an expiry time (%s)",
+      msg.expires.Format("2006-01-02 15:04:05 -0700"))
+  }
+  return append([]byte("expires "+expires+"\n"), data...), nil
+}
+
+// withPriority adds a "priority" section with value priority to encoded message data
+// which doesn't have one
+func withPriority(data []byte, priority string) ([]byte, error) {
+  p, err := parsePriority(priority)
+  if err != nil {
+    return nil, err
+  }
+  var msg Message
+  msg.time = time.Now()
+  if err := msg.ParseReader(bytes.NewReader(data), len(data), ""); err != nil {
+    return data, nil // let the caller report the parse error
+  }
+  if msg.priority != priorityNormal {
+    return nil, errorf("message already has a priority (%s)", msg.priority)
+  }
+  return append([]byte("priority "+p.String()+"\n"), data...), nil
+}
+
+// queueMessage writes the encoded message data to OUTBOXDIR, adds the message to the
+// database and returns the new file's path
+func queueMessage(msg *Message, data []byte) (string, error) {
+  file, err := writeOutboxFile(msg, data)
+  if err != nil {
+    return "", err
+  }
+  msg.folder = "outbox"
+  msg.file = relPath(MSGDIR, file)
+  _, err = db.PutMessage(msg)
+  return file, err
+}
+
+// writeOutboxFile writes the encoded message data to a new file in OUTBOXDIR and returns
+// its path (see writeMessageFile)
+func writeOutboxFile(msg *Message, data []byte) (string, error) {
+  return writeMessageFile(OUTBOXDIR, msg.time, data)
+}
+
+// writeMessageFile writes the encoded data of a message with time t to a new file in dir
+// and returns its path. The filename encodes t so that the id computed when the file is
+// later parsed matches the message's id.
+func writeMessageFile(dir string, t time.Time, data []byte) (string, error) {
+  name := t.UTC().Format("20060102-150405")
+  file := filepath.Join(dir, name+".msg")
+  for n := 2; ; n++ {
+    err := writeFileNoClobber(file, data)
+    if err == nil {
+      break
+    }
+    if !os.IsExist(err) {
+      return "", err
+    }
+    file = filepath.Join(dir, fmt.Sprintf("%s.%d.msg", name, n))
+  }
+  return file, nil
+}
+
+func printMessageSummary(w io.Writer, msg *Message) {
+  fmt.Fprintf(w, "id       %s\n", msg.IdString())
+  fmt.Fprintf(w, "time     %s\n", msg.time.Format("2006-01-02 15:04:05 -0700"))
+  fmt.Fprintf(w, "from     %s\n", msg.from)
+  for _, a := range msg.Recipients() {
+    fmt.Fprintf(w, "to       %s\n", a)
+  }
+  if msg.replyTo.address != "" {
+    fmt.Fprintf(w, "reply-to %s\n", msg.replyTo)
+  }
+  if msg.inReplyTo != ([24]byte{}) {
+    r := Message{id: msg.inReplyTo}
+    fmt.Fprintf(w, "reply to %s\n", r.IdString())
+  }
+  fmt.Fprintf(w, "subject  %s\n", msg.subject)
+  if msg.enc != nil {
+    addresses := make([]string, len(msg.enc.recipients))
+    for i, r := range msg.enc.recipients {
+      addresses[i] = r.address
+    }
+    fmt.Fprintf(w, "encrypted to %s\n", strings.Join(addresses, ", "))
+    size := len(msg.enc.body)
+    fmt.Fprintf(w, "body     %d %s (encrypted)\n", size, plural(size, "byte", "bytes"))
+  } else {
+    fmt.Fprintf(w, "body     %d %s\n", len(msg.body), plural(len(msg.body), "byte", "bytes"))
+  }
+  for _, f := range msg.files {
+    name := f.name
+    if f.encName != nil && name == "" {
+      name = encPlaceholder
+    }
+    fmt.Fprintf(w, "file     %d %s  %s\n", f.dataLen, plural(f.dataLen, "byte", "bytes"), name)
+  }
+}
+
+// formatRecipients returns a comma-separated list of the addresses a message is sent to
+func formatRecipients(msg *Message) string {
+  var sb strings.Builder
+  for i, a := range msg.Recipients() {
+    if i > 0 {
+      sb.WriteString(", ")
+    }
+    sb.WriteString(a.address)
+  }
+  return sb.String()
+}
+
+// parseRecipients parses a comma-separated list of addresses and aliases.
+// Aliases are expanded to the addresses they stand for.
+func parseRecipients(s string) ([]Author, error) {
+  var recipients []Author
+  seen := map[string]bool{}
+  add := func(addr string) error {
+    address, err := normalizeAndValidateAddress(addr)
+    if err != nil {
+      return err
+    }
+    if !seen[address] {
+      seen[address] = true
+      recipients = append(recipients, Author{address: address})
+    }
+    return nil
+  }
+  for _, tok := range strings.Split(s, ",") {
+    tok = strings.TrimSpace(tok)
+    if tok == "" {
+      continue
+    }
+    if addrs := config.ExpandAlias(tok); addrs != nil {
+      for _, addr := range addrs {
+        if err := add(addr); err != nil {
+          return nil, errorf("alias %q: %q: %w", tok, addr, err)
+        }
+      }
+    } else if err := add(tok); err != nil {
+      return nil, errorf("%q is neither an alias nor a valid address (%w)", tok, err)
+    }
+  }
+  if len(recipients) == 0 {
+    return nil, errorf("no recipients")
+  }
+  return recipients, nil
 }
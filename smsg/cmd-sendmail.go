@@ -0,0 +1,196 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "flag"
+  "fmt"
+  "io"
+  "net/mail"
+  "os"
+  "strings"
+)
+
+// Exit statuses of sendmail, from sysexits.h
+const (
+  exUsage    = 64 // invalid arguments
+  exDataErr  = 65 // the email is malformed
+  exNoUser   = 67 // a recipient is invalid
+  exIOErr    = 74 // failed to read the email
+  exTempFail = 75 // failed to queue the email; the caller may try again later
+  exConfig   = 78 // no sender identity
+)
+
+// sendmailOptions are the options of sendmail which change what it does.
+// Other options, like -oem and -B8BITMIME, are accepted and ignored.
+type sendmailOptions struct {
+  headers  bool   // -t: send to the recipients of the To, Cc and Bcc headers
+  dots     bool   // a line with a single "." ends the email; cleared by -i and -oi
+  from     string // -f or -r: the sender, for an email without a From header
+  fullname string // -F: the name of the sender, for an email without a From header
+}
+
+func cmd_sendmail(fl *flag.FlagSet) func() {
+  return func() {
+    opts, args := parseSendmailArgs(fl.Args())
+
+    data, err := readSendmailInput(os.Stdin, opts.dots)
+    if err != nil {
+      sendmailExit(exIOErr, "failed to read email: %v", err)
+    }
+    em, err := mail.ReadMessage(bytes.NewReader(data))
+    if err != nil {
+      sendmailExit(exDataErr, "invalid email: %v", err)
+    }
+
+    // recipients
+    to := args
+    if opts.headers {
+      for _, key := range []string{"To", "Cc", "Bcc"} {
+        addrs, err := em.Header.AddressList(key)
+        if err == mail.ErrHeaderNotPresent {
+          continue
+        }
+        if err != nil {
+          // e.g. "To: root" from cron, which may be an alias
+          for _, s := range strings.Split(em.Header.Get(key), ",") {
+            to = append(to, strings.TrimSpace(s))
+          }
+          continue
+        }
+        for _, addr := range addrs {
+          to = append(to, addr.Address)
+        }
+      }
+    }
+    if len(to) == 0 {
+      sendmailExit(exUsage, "no recipients")
+    }
+    recipients, err := parseRecipients(strings.Join(to, ","))
+    if err != nil {
+      sendmailExit(exNoUser, "%v", err)
+    }
+    // note: messages have no hidden recipients, so Bcc recipients are listed like others
+    var rcpts []string
+    for _, a := range recipients {
+      rcpts = append(rcpts, a.address)
+    }
+
+    // the sender is only needed for an email without a From header
+    var sender Author
+    if _, err := mail.ParseAddress(em.Header.Get("From")); err != nil || opts.from != "" {
+      if sender, err = resolveSender(opts.from); err != nil {
+        if opts.from != "" {
+          sendmailExit(exUsage, "-f %s: %v", opts.from, err)
+        }
+        sendmailExit(exConfig, "%v", err)
+      }
+      if opts.fullname != "" {
+        sender.name = opts.fullname
+      }
+    }
+
+    encoded, err := convertEmail(data, sender, rcpts)
+    if err != nil {
+      sendmailExit(exDataErr, "invalid email: %v", err)
+    }
+    msg, encoded, err := parseOutgoingMessage(encoded, "<stdin>")
+    if err != nil {
+      sendmailExit(exDataErr, "%v", err)
+    }
+    file, err := queueMessage(msg, encoded)
+    if err != nil {
+      sendmailExit(exTempFail, "failed to queue message: %v", err)
+    }
+    dlog("wrote %s", relPath(MSGDIR, file))
+
+    // like sendmail, succeed once the message is queued; failed deliveries are retried
+    // in the background (see daemon)
+    if err := delivery.deliverFile(file, false, nil); err != nil {
+      sendmaillog.Debugf("%s not yet delivered: %v", msg.IdString(), err)
+    }
+  }
+}
+
+// parseSendmailArgs parses the arguments of sendmail and returns its options and the
+// recipients. It exits with exUsage for unsupported options, like -bs.
+func parseSendmailArgs(args []string) (opts sendmailOptions, recipients []string) {
+  opts.dots = true
+  for i := 0; i < len(args); i++ {
+    arg := args[i]
+    if arg == "--" {
+      return opts, append(recipients, args[i+1:]...)
+    }
+    if len(arg) < 2 || arg[0] != '-' {
+      recipients = append(recipients, arg)
+      continue
+    }
+    // value of an option which has one, like "-f addr" or "-faddr"
+    value := func() string {
+      if len(arg) > 2 {
+        return arg[2:]
+      }
+      if i+1 == len(args) {
+        sendmailExit(exUsage, "option %s requires a value", arg)
+      }
+      i++
+      return args[i]
+    }
+    switch arg[1] {
+    case 't':
+      opts.headers = true
+    case 'i':
+      opts.dots = false
+    case 'f', 'r':
+      opts.from = value()
+    case 'F':
+      opts.fullname = value()
+    case 'o':
+      if arg == "-oi" {
+        opts.dots = false
+      }
+    case 'b':
+      if arg != "-bm" { // -bm is the default mode: read an email from stdin and send it
+        sendmailExit(exUsage, "unsupported option %s", arg)
+      }
+    case 'B', 'N', 'R', 'V', 'X':
+      value()
+    case 'O', 'U', 'v', 'm', 'e':
+      // ignored
+    default:
+      sendmailExit(exUsage, "unknown option %s\nSee %s help sendmail", arg, progname)
+    }
+  }
+  return opts, recipients
+}
+
+// readSendmailInput reads an email from r. If dots is true, a line with a single "."
+// ends the email.
+func readSendmailInput(r io.Reader, dots bool) ([]byte, error) {
+  if !dots {
+    return io.ReadAll(r)
+  }
+  var buf bytes.Buffer
+  br := bufio.NewReader(r)
+  for {
+    line, err := br.ReadBytes('\n')
+    if s := string(line); s == ".\n" || s == ".\r\n" || (s == "." && err == io.EOF) {
+      break
+    }
+    buf.Write(line)
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return nil, err
+    }
+  }
+  return buf.Bytes(), nil
+}
+
+// sendmailExit prints an error and exits with status, one of the ex constants
+func sendmailExit(status int, format string, arg ...interface{}) {
+  fmt.Fprintf(os.Stderr, "%s: %s\n", progname, fmt.Sprintf(format, arg...))
+  os.Exit(status)
+}
@@ -1,6 +1,354 @@
 // SPDX-License-Identifier: Apache-2.0
 package main
 
-func cmd_serve(args ...string) {
-  fatalf("serve: not yet implemented")
+import (
+  "context"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/tls"
+  "encoding/base64"
+  "flag"
+  "fmt"
+  "net"
+  "net/http"
+  "os"
+  "strconv"
+  "syscall"
+  "text/tabwriter"
+  "time"
+)
+
+// defaultServeAddr is the address the server listens on by default
+const defaultServeAddr = "127.0.0.1:7110"
+
+func cmd_serve(fl *flag.FlagSet) func() {
+  opt_addr := fl.String("addr", defaultServeAddr, "Listen on `address` (host:port)")
+  opt_noauth := fl.Bool("no-auth", false,
+    "Don't require API tokens. Only allowed when listening on a loopback address.")
+  opt_name := fl.String("name", "", "Name of the token made by \"token create\", e.g. \"laptop\"")
+  opt_owner := fl.String("owner", "",
+    "Limit the token made by \"token create\" to the messages of hosted user `address`")
+  opt_tlscert := fl.String("tls-cert", "", "Serve HTTPS with the certificate in `file` (PEM)")
+  opt_tlskey := fl.String("tls-key", "", "Private key `file` (PEM) of the certificate of -tls-cert")
+  opt_metricsaddr := fl.String("metrics-addr", "",
+    "Serve metrics at http://`address`/metrics, e.g. \"127.0.0.1:7111\"")
+  opt_selfsigned := fl.Bool("tls-self-signed", false,
+    "Serve HTTPS with a self-signed certificate, created on first use")
+  opt_noui := fl.Bool("no-ui", false, "Don't serve the web UI; only the API")
+  opt_peeraddr := fl.String("peer-addr", "",
+    "Also accept messages with the peer protocol on `address`, e.g. \":7112\"")
+  opt_smtpaddr := fl.String("smtp", "",
+    "Also receive email for local addresses with SMTP on `address`, e.g. \":2525\"")
+  return func() {
+    if fl.Arg(0) == "token" {
+      serveToken(fl, opt_name, opt_owner)
+      return
+    }
+    if fl.NArg() > 1 {
+      fl.Usage()
+      os.Exit(1)
+    }
+    if fl.NArg() == 1 {
+      setMsgDir(argPath(fl.Arg(0)))
+    }
+    openMsgDir()
+
+    // listen before returning so that errors, like the address being in use, are
+    // reported right away
+    ln, err := net.Listen("tcp", *opt_addr)
+    if err != nil {
+      fatalf("serve: %v", err)
+    }
+    if *opt_noauth && !ln.Addr().(*net.TCPAddr).IP.IsLoopback() {
+      ln.Close()
+      fatalf("serve: -no-auth is only allowed with a loopback address, like %s",
+        defaultServeAddr)
+    }
+    if !*opt_noauth {
+      ntokens := 0
+      must(db.ListTokens(func(*APIToken) error { ntokens++; return nil }))
+      if ntokens == 0 {
+        warnlog("no API tokens; all requests will be denied (see %s serve token create)",
+          progname)
+      }
+    }
+
+    // the web UI is served at / and the API at /v1/
+    handler := http.NewServeMux()
+    handler.Handle("/v1/", newAPIHandler(!*opt_noauth))
+    if !*opt_noui {
+      handler.Handle("/", webUIHandler())
+    }
+
+    srv := &http.Server{
+      Handler:           handler,
+      ReadHeaderTimeout: 10 * time.Second,
+      ConnState: func(_ net.Conn, state http.ConnState) {
+        switch state {
+        case http.StateNew:
+          metricHTTPConnections.Add(1)
+        case http.StateHijacked, http.StateClosed:
+          metricHTTPConnections.Add(-1)
+        }
+      },
+    }
+    scheme := "http"
+    certs := serveCertLoader(*opt_tlscert, *opt_tlskey, *opt_selfsigned, *opt_addr)
+    if certs != nil {
+      scheme = "https"
+      srv.TLSConfig = &tls.Config{
+        MinVersion:     tls.VersionTLS12,
+        GetCertificate: certs.GetCertificate,
+      }
+      ln = tls.NewListener(ln, srv.TLSConfig)
+      if *opt_selfsigned {
+        fmt.Fprintf(os.Stderr, "certificate fingerprint (SHA-256): %s\n", certs.Fingerprint())
+      }
+    }
+
+    // the peer protocol is served on its own port, with the same TLS certificate
+    if *opt_peeraddr != "" {
+      pln, err := net.Listen("tcp", *opt_peeraddr)
+      if err != nil {
+        fatalf("serve: %v", err)
+      }
+      if *opt_noauth && !pln.Addr().(*net.TCPAddr).IP.IsLoopback() {
+        fatalf("serve: -no-auth is only allowed with a loopback -peer-addr")
+      }
+      proto := "tcp"
+      if srv.TLSConfig != nil {
+        pln = tls.NewListener(pln, srv.TLSConfig)
+        proto = "tcp+tls"
+      }
+      psrv := newPeerServer(pln, !*opt_noauth)
+      RegisterExitHandlerWithPhase(ExitPhaseServers, psrv.Shutdown, "peer server")
+      go func() {
+        if err := psrv.Serve(); err != nil {
+          errlog("serve peer protocol: %v", err)
+        }
+      }()
+      fmt.Fprintf(os.Stderr, "accepting messages from peers on %s (%s)\n", pln.Addr(), proto)
+    }
+
+    // email is received on its own port, without TLS
+    if *opt_smtpaddr != "" {
+      sln, err := net.Listen("tcp", *opt_smtpaddr)
+      if err != nil {
+        fatalf("serve: %v", err)
+      }
+      ssrv := newSMTPServer(sln)
+      RegisterExitHandlerWithPhase(ExitPhaseServers, ssrv.Shutdown, "SMTP server")
+      go func() {
+        if err := ssrv.Serve(); err != nil {
+          errlog("serve SMTP: %v", err)
+        }
+      }()
+      fmt.Fprintf(os.Stderr, "receiving email on %s (smtp)\n", sln.Addr())
+    }
+
+    // metrics are served separately from the API so that they can be kept private
+    if *opt_metricsaddr != "" {
+      mln, err := net.Listen("tcp", *opt_metricsaddr)
+      if err != nil {
+        fatalf("serve: %v", err)
+      }
+      msrv := &http.Server{Handler: metricsHandler(), ReadHeaderTimeout: 10 * time.Second}
+      RegisterExitHandlerWithPhase(ExitPhaseServers, func(ctx context.Context) error {
+        return msrv.Shutdown(ctx)
+      }, "metrics server")
+      go func() {
+        if err := msrv.Serve(mln); err != nil && err != http.ErrServerClosed {
+          errlog("serve metrics: %v", err)
+        }
+      }()
+      fmt.Fprintf(os.Stderr, "serving metrics on http://%s/metrics\n", mln.Addr())
+    }
+
+    startBackground()
+    startWebhooks()
+    msgsync.Watch()
+    handleServeHUP(certs)
+    handleRescanSignal()
+    if err := startControlServer(); err != nil {
+      warnlog("not serving the control socket: %v", err)
+    }
+    RegisterExitHandlerWithPhase(ExitPhaseServers, func(ctx context.Context) error {
+      return srv.Shutdown(ctx)
+    }, "HTTP server")
+    go func() {
+      if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+        errlog("serve: %v", err)
+        Shutdown(1)
+      }
+    }()
+    fmt.Fprintf(os.Stderr, "serving %s on %s://%s\n", MSGDIR, scheme, ln.Addr())
+    keepRunning = true
+  }
+}
+
+// handleServeHUP makes SIGHUP reload the TLS certificate, if any, e.g. after it has been
+// renewed, and scan MSGDIR if Config.RescanOnHUP is set. Otherwise SIGHUP shuts down the
+// server, like SIGTERM.
+func handleServeHUP(certs *certLoader) {
+  if certs == nil && !config.RescanOnHUP {
+    return
+  }
+  HandleSignal(syscall.SIGHUP, func() {
+    if certs != nil {
+      // new connections use the new certificate while open connections are unaffected
+      if err := certs.Reload(); err != nil {
+        errlog("failed to reload TLS certificate: %v", err)
+      } else {
+        logger.Infof("reloaded TLS certificate %s", certs.certfile)
+      }
+    }
+    if config.RescanOnHUP {
+      logger.Infof("SIGHUP: rescanning %s", MSGDIR)
+      msgsync.Rescan()
+    }
+  })
+}
+
+// serveCertLoader returns the TLS certificate to serve with according to the flags of
+// serve and the config, or nil if serving without TLS
+func serveCertLoader(certfile, keyfile string, selfsigned bool, addr string) *certLoader {
+  switch {
+  case selfsigned:
+    if certfile != "" || keyfile != "" {
+      fatalf("serve: -tls-self-signed can't be used with -tls-cert or -tls-key")
+    }
+    host, _, _ := net.SplitHostPort(addr)
+    var err error
+    if certfile, keyfile, err = selfSignedCert(host); err != nil {
+      fatalf("serve: failed to create self-signed certificate: %v", err)
+    }
+  case certfile != "" && keyfile != "":
+    certfile, keyfile = argPath(certfile), argPath(keyfile)
+  case certfile == "" && keyfile == "":
+    certfile, keyfile = config.TLSCert, config.TLSKey
+  }
+  if certfile == "" && keyfile == "" {
+    return nil
+  }
+  if certfile == "" || keyfile == "" {
+    fatalf("serve: both a TLS certificate and its key are needed")
+  }
+  certs, err := newCertLoader(certfile, keyfile)
+  if err != nil {
+    fatalf("serve: %v", err)
+  }
+  return certs
+}
+
+// serveToken implements "serve token <command>"
+func serveToken(fl *flag.FlagSet, opt_name, opt_owner *string) {
+  args := fl.Args()[1:]
+  cmd := ""
+  if len(args) > 0 {
+    cmd, args = args[0], args[1:]
+  }
+  fl.Parse(args) // options may follow the command
+  args = fl.Args()
+  openMsgDir()
+
+  switch cmd {
+  case "", "list", "ls":
+    printTokens()
+  case "create":
+    if len(args) > 0 {
+      fl.Usage()
+      os.Exit(1)
+    }
+    owner := *opt_owner
+    if owner != "" {
+      var err error
+      if owner, err = normalizeAndValidateAddress(owner); err != nil {
+        fatalf("-owner %q: %v", *opt_owner, err)
+      }
+      if !config.IsHostedRecipient(owner) {
+        fatalf("-owner %s is not a hosted user (see \"recipients\" in %s)", owner,
+          relPath(WORKDIR, CONFIGFILE))
+      }
+    }
+    token := generateToken()
+    hash := sha256.Sum256([]byte(token))
+    id, err := db.CreateToken(*opt_name, owner, hash[:])
+    must(err)
+    fmt.Fprintf(os.Stderr, "Created token %d. It is not shown again; store it safely.\n", id)
+    fmt.Println(token)
+  case "revoke", "rm":
+    if len(args) != 1 {
+      fl.Usage()
+      os.Exit(1)
+    }
+    id, err := findToken(args[0])
+    if err != nil {
+      fatalf("%v", err)
+    }
+    must(db.RevokeToken(id))
+  default:
+    fatalf("unknown serve token command %q\nSee %s serve -h for help", cmd, progname)
+  }
+}
+
+// generateToken returns a new random API token
+func generateToken() string {
+  var b [32]byte
+  if _, err := rand.Read(b[:]); err != nil {
+    panic(err)
+  }
+  return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// findToken returns the id of the token with the id or name s.
+// It's an error if several tokens have the name.
+func findToken(s string) (int64, error) {
+  var ids []int64
+  id, idErr := strconv.ParseInt(s, 10, 64)
+  err := db.ListTokens(func(t *APIToken) error {
+    if (idErr == nil && t.id == id) || t.name == s {
+      ids = append(ids, t.id)
+    }
+    return nil
+  })
+  if err != nil {
+    return 0, err
+  }
+  switch len(ids) {
+  case 0:
+    return 0, errorf("no token %q", s)
+  case 1:
+    return ids[0], nil
+  }
+  return 0, errorf("several tokens match %q; use the token's id", s)
+}
+
+func printTokens() {
+  now := time.Now()
+  w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+  fmt.Fprintf(w, "%sID\tName\tOwner\tCreated\tLast used%s\n", colheader, colreset)
+  count := 0
+  must(db.ListTokens(func(t *APIToken) error {
+    name := t.name
+    if name == "" {
+      name = "-"
+    }
+    owner := t.owner
+    if owner == "" {
+      owner = "(all)"
+    }
+    lastused := "never"
+    if !t.lastused.IsZero() {
+      lastused = formatTime(now, localTime(t.lastused))
+    }
+    fmt.Fprintf(w, "%s%d\t%s\t%s\t%s\t%s%s\n", colreset,
+      t.id, limitStrLen(name, 30), owner, formatTime(now, localTime(t.created)), lastused,
+      colreset)
+    count++
+    return nil
+  }))
+  if count == 0 {
+    fmt.Fprintf(w, "%s(no tokens)%s\n", coldim, colreset)
+  }
+  w.Flush()
 }
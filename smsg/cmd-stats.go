@@ -0,0 +1,41 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "text/tabwriter"
+)
+
+// statsLargestCount is the number of largest messages listed by "stats"
+const statsLargestCount = 10
+
+func cmd_stats(fl *flag.FlagSet) func() {
+  opt_bytes := fl.Bool("bytes", false, "Show sizes in bytes rather than like \"3.4 MiB\"")
+  addTimeZoneFlag(fl)
+  return func() {
+    sizes, err := db.FolderSizes()
+    must(err)
+    var total FolderSize
+    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "Folder\tMessages\tSize")
+    for _, fs := range sizes {
+      fmt.Fprintf(w, "%s\t%d\t%s\n", fs.folder, fs.count, sizeString(fs.bytes, *opt_bytes))
+      total.count += fs.count
+      total.bytes += fs.bytes
+      total.unsized += fs.unsized
+    }
+    fmt.Fprintf(w, "total\t%d\t%s\n", total.count, sizeString(total.bytes, *opt_bytes))
+    w.Flush()
+    if total.unsized > 0 {
+      fmt.Printf("%s%d %s of unknown size, not included (run %s reindex to count them)%s\n",
+        coldim, total.unsized, plural(total.unsized, "message", "messages"), progname,
+        colreset)
+    }
+
+    fmt.Printf("\nLargest messages:\n")
+    filter := MessageFilter{folder: "all", sortBy: "size", limit: statsLargestCount}
+    printMessageList(&filter, mustParseListColumns("from,subject,time,size"))
+  }
+}
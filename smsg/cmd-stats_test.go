@@ -0,0 +1,41 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestStats(t *testing.T) {
+  testReadSetup(t)
+  writeTestMessages(t, 12) // 102 bytes each, and 103 for messages 10 to 12
+  tm := time.Date(2022, 6, 2, 10, 0, 0, 0, time.UTC)
+  writeTestFile(t, ARCHIVEDIR, "20220602-100000.msg",
+    testMessageText("Large", "bob@example.com", tm, strings.Repeat("x", 4000)))
+  scanTestFolder(t, "archive")
+
+  out := runTestCommand(t, "stats", "-bytes")
+  expected := "Folder   Messages  Size\n" +
+    "archive  1         4094 bytes\n" +
+    "inbox    12        1227 bytes\n" +
+    "total    13        5321 bytes\n"
+  if !strings.HasPrefix(out, expected) {
+    t.Errorf("stats -bytes = %q; expected it to start with %q", out, expected)
+  }
+  out = runTestCommand(t, "stats")
+  if !strings.Contains(out, "total    13        5.2 KiB\n") {
+    t.Errorf("stats = %q; expected a total of 5.2 KiB", out)
+  }
+
+  // the largest messages, largest first, at most statsLargestCount of them
+  _, largest, _ := strings.Cut(out, "\nLargest messages:\n")
+  var subjects []string
+  for _, line := range strings.Split(strings.TrimSpace(largest), "\n")[1:] {
+    subjects = append(subjects, strings.Fields(line)[3:5]...)
+  }
+  if len(subjects) != 2*statsLargestCount || subjects[0] != "Large" ||
+    subjects[2]+subjects[3] != "Message12" {
+    t.Errorf("largest messages %q", largest)
+  }
+}
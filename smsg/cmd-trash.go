@@ -0,0 +1,208 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "path/filepath"
+  "time"
+)
+
+// defaultTrashRetention is how long messages are kept in the trash, unless configured
+// otherwise (Config.TrashRetention)
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// autoPurgeTrashBudget is how much time is spent purging the trash at startup.
+// Whatever is left is purged the next time, or by "trash purge".
+const autoPurgeTrashBudget = 100 * time.Millisecond
+
+// trashPurgeBatchSize is the number of messages deleted from the database per transaction
+const trashPurgeBatchSize = 100
+
+func trashRetention() time.Duration {
+  if config.TrashRetention > 0 {
+    return time.Duration(config.TrashRetention)
+  }
+  return defaultTrashRetention
+}
+
+func cmd_rm(fl *flag.FlagSet) func() {
+  return func() {
+    if fl.NArg() == 0 {
+      fl.Usage()
+      os.Exit(1)
+    }
+    for _, idstr := range fl.Args() {
+      id, err := decodeId(idstr)
+      if err != nil {
+        fatalf("%q: %v", idstr, err)
+      }
+      msg := &Message{}
+      must(db.LoadMessageById(id, msg))
+      if err := trashMessage(msg); err != nil {
+        fatalf("%s: %v", idstr, err)
+      }
+    }
+  }
+}
+
+// trashMessage moves a message and its file to the trash
+func trashMessage(msg *Message) error {
+  if msg.folder == "trash" {
+    return errorf("message is already in the trash")
+  }
+  file := msg.file
+  if file != "" {
+    dstfile, err := moveIntoDir(filepath.Join(MSGDIR, file), TRASHDIR)
+    if err != nil && !os.IsNotExist(err) {
+      return err
+    }
+    file = relPath(MSGDIR, dstfile)
+    if err != nil {
+      file = "" // file is gone
+    }
+  }
+  return db.TrashMessage(msg.id[:], msg.folder, file, time.Now())
+}
+
+func cmd_trash(fl *flag.FlagSet) func() {
+  filter := MessageFilter{folder: "trash"}
+  addMessageLimitFlag(fl, &filter)
+  opt_older := fl.String("older", "",
+    "Purge messages which have been in the trash longer than `duration`, e.g. 7d.\n"+
+      "Defaults to trash_retention of the config, or 30d")
+  opt_dryrun := fl.Bool("dry-run", false, "List messages which would be purged")
+  opt_bytes := fl.Bool("bytes", false, "Show sizes in bytes rather than like \"3.4 MiB\"")
+  return func() {
+    cmd := fl.Arg(0)
+    args := fl.Args()
+    if len(args) > 0 {
+      args = args[1:]
+    }
+
+    // wait for the automatic purge at startup
+    msgsync.WaitReady()
+
+    switch cmd {
+    case "", "list", "ls":
+      fl.Parse(args) // options may follow "list"
+      if printMessageList(&filter, nil) == 0 {
+        printEmptyListNote(&filter)
+      }
+    case "purge":
+      fl.Parse(args)
+      retention := trashRetention()
+      if *opt_older != "" {
+        var err error
+        if retention, err = parseDuration(*opt_older); err != nil {
+          fatalf("-older: %v", err)
+        }
+      }
+      cmd_trash_purge(time.Now().Add(-retention), *opt_dryrun, *opt_bytes)
+    default:
+      fatalf("unknown trash command %q\nSee %s trash -h for help", cmd, progname)
+    }
+  }
+}
+
+func cmd_trash_purge(before time.Time, dryrun, exactSizes bool) {
+  var onPurge func(tm *TrashedMessage, size int64)
+  if dryrun {
+    onPurge = func(tm *TrashedMessage, size int64) {
+      m := Message{id: tm.id}
+      fmt.Printf("%s  %s(%s, trashed %s)%s\n", m.IdString(), coldim,
+        sizeString(size, exactSizes), formatTime(time.Now(), localTime(tm.trashed)), colreset)
+    }
+  }
+  count, nbytes, err := purgeTrash(before, time.Time{}, dryrun, onPurge)
+  verb := "purged"
+  if dryrun {
+    verb = "would purge"
+  }
+  fmt.Printf("%s %d %s (%s)\n", verb, count, plural(count, "message", "messages"),
+    sizeString(nbytes, exactSizes))
+  must(err)
+}
+
+// purgeTrash permanently deletes messages which were moved to the trash before the
+// given time, along with their files. Returns the number of messages and the size of
+// their files. If deadline is not zero, purging stops when it has passed.
+// If dryrun is true, nothing is deleted. fn, if not nil, is called for each message.
+func purgeTrash(
+  before, deadline time.Time, dryrun bool, fn func(tm *TrashedMessage, size int64),
+) (count int, nbytes int64, err error) {
+  var trashed []TrashedMessage
+  err = db.ListTrash(before, func(tm *TrashedMessage) error {
+    trashed = append(trashed, *tm)
+    return nil
+  })
+  if err != nil {
+    return
+  }
+
+  var batch [][24]byte
+  for i := range trashed {
+    if !deadline.IsZero() && time.Now().After(deadline) {
+      break
+    }
+    tm := &trashed[i]
+    var size int64
+    if size, err = removeMessageFile(tm.file, dryrun); err != nil {
+      break
+    }
+    if fn != nil {
+      fn(tm, size)
+    }
+    count++
+    nbytes += size
+    if !dryrun {
+      batch = append(batch, tm.id)
+      if len(batch) == trashPurgeBatchSize {
+        if err = db.DeleteMessages(batch); err != nil {
+          return
+        }
+        batch = batch[:0]
+      }
+    }
+  }
+  if err2 := db.DeleteMessages(batch); err == nil {
+    err = err2
+  }
+  return
+}
+
+// removeMessageFile removes the file of a message being purged, unless dryrun, and
+// returns its size. file is relative to MSGDIR, or "" if the message has no file.
+//
+// note: files are removed before their rows, so that a file is never left without a row
+// when interrupted. A row without a file is removed by the next purge.
+func removeMessageFile(file string, dryrun bool) (size int64, err error) {
+  if file == "" {
+    return 0, nil
+  }
+  file = filepath.Join(MSGDIR, file)
+  if st, err := os.Lstat(file); err == nil {
+    size = st.Size()
+  }
+  if !dryrun {
+    if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+      return size, err
+    }
+  }
+  return size, nil
+}
+
+// autoPurgeTrash purges expired messages from the trash, spending at most
+// autoPurgeTrashBudget on it
+func autoPurgeTrash() {
+  deadline := time.Now().Add(autoPurgeTrashBudget)
+  count, _, err := purgeTrash(time.Now().Add(-trashRetention()), deadline, false, nil)
+  if err != nil {
+    if err != errDBClosed {
+      errlog("failed to purge trash: %v", err)
+    }
+  } else if count > 0 {
+    trashlog.Debugf("purged %d %s", count, plural(count, "message", "messages"))
+  }
+}
@@ -0,0 +1,484 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "os/signal"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+// uiMaxMessages is the max number of messages loaded into the message list of the ui
+const uiMaxMessages = 1000
+
+// uiHelp is shown in the status line of the ui
+const uiHelp = "j/k move  enter read  space/b scroll  m read/unread  a archive  d delete" +
+  "  r reply  / search  q quit"
+
+func cmd_ui(fl *flag.FlagSet) func() {
+  var filter MessageFilter
+  addMessageFilterFlags(fl, &filter, "inbox")
+  return func() {
+    msgsync.WaitReady()
+    t, err := openTerminal()
+    if err != nil {
+      fatalf("failed to open terminal: %v", err)
+    }
+    // note: restores the terminal also when shut down by a signal
+    RegisterExitHandler(t.close, "terminal")
+
+    ui := &messageUI{t: t, filter: filter, logch: make(chan string, 8)}
+
+    // show log messages in the status line rather than on top of the ui
+    logger.SetOutput(uiLogWriter(ui.logch))
+    defer logger.SetOutput(os.Stderr)
+
+    newmsgch := make(chan struct{}, 1)
+    msgsync.OnNewMessage(func(*Message) {
+      select {
+      case newmsgch <- struct{}{}:
+      default: // a reload is already pending
+      }
+    })
+    msgsync.Watch()
+
+    ui.run(newmsgch)
+    t.close()
+  }
+}
+
+// messageUI is the state of the interactive ui
+type messageUI struct {
+  t      *terminal
+  filter MessageFilter
+  query  string // search query, or "" when listing all messages
+  msgs   []Message
+  unread map[[24]byte]bool
+  sel    int // index in msgs of the selected message
+  top    int // index in msgs of the first message shown
+
+  reading   *Message // message in the reading pane, or nil if closed
+  readlines []string
+  readtop   int // index in readlines of the first line shown
+
+  prompt    bool   // true while a search query is being typed
+  input     string // search query being typed
+  status    string // shown in the status line until the next key press
+  logch     chan string
+  listlines int // number of lines of the message list
+}
+
+type uiLogWriter chan string
+
+func (w uiLogWriter) Write(p []byte) (int, error) {
+  select {
+  case w <- strings.TrimSpace(string(p)):
+  default:
+  }
+  return len(p), nil
+}
+
+func (ui *messageUI) run(newmsgch <-chan struct{}) {
+  winch := make(chan os.Signal, 1)
+  if len(termResizeSignals) > 0 { // note: Notify without signals relays all of them
+    signal.Notify(winch, termResizeSignals...)
+    defer signal.Stop(winch)
+  }
+
+  ui.load()
+  for {
+    ui.draw()
+    select {
+    case key, ok := <-ui.t.keys:
+      if !ok {
+        return
+      }
+      ui.status = ""
+      if !ui.handleKey(key) {
+        return
+      }
+    case <-winch:
+      ui.t.updateSize()
+      if ui.reading != nil {
+        ui.readlines = ui.formatMessage(ui.reading)
+      }
+    case <-newmsgch:
+      ui.load()
+      ui.status = "new messages"
+    case s := <-ui.logch:
+      ui.status = s
+    }
+  }
+}
+
+// load loads the message list, keeping the selected message selected
+func (ui *messageUI) load() {
+  var selid [24]byte
+  if ui.sel < len(ui.msgs) {
+    selid = ui.msgs[ui.sel].id
+  }
+
+  f := ui.filter
+  f.limit = uiMaxMessages
+  var msgs []Message
+  var err error
+  if ui.query != "" {
+    err = db.SearchMessages(ui.query, &f, true, func(msg *Message, _ string) error {
+      msgs = append(msgs, *msg)
+      return nil
+    })
+  } else {
+    err = db.ListMessages(&f, func(msg *Message) error {
+      msgs = append(msgs, *msg)
+      return nil
+    })
+  }
+  if err != nil {
+    ui.status = err.Error()
+    return
+  }
+  unread := map[[24]byte]bool{}
+  f.unread = true
+  err = db.ListMessages(&f, func(msg *Message) error {
+    unread[msg.id] = true
+    return nil
+  })
+  if err != nil {
+    ui.status = err.Error()
+  }
+
+  ui.msgs = msgs
+  ui.unread = unread
+  ui.sel = 0
+  for i := range msgs {
+    if msgs[i].id == selid {
+      ui.sel = i
+      break
+    }
+  }
+}
+
+// handleKey handles a key press. Returns false to quit.
+func (ui *messageUI) handleKey(key string) bool {
+  if ui.prompt {
+    ui.handlePromptKey(key)
+    return true
+  }
+  switch key {
+  case "q", "ctrl-c":
+    return false
+  case "j", "down":
+    ui.selectMessage(ui.sel + 1)
+  case "k", "up":
+    ui.selectMessage(ui.sel - 1)
+  case "pgdn", "ctrl-f":
+    ui.selectMessage(ui.sel + ui.listlines)
+  case "pgup", "ctrl-b":
+    ui.selectMessage(ui.sel - ui.listlines)
+  case "g", "home":
+    ui.selectMessage(0)
+  case "G", "end":
+    ui.selectMessage(len(ui.msgs) - 1)
+  case "enter":
+    ui.openMessage()
+  case " ":
+    ui.scrollMessage(ui.readPaneLines() - 1)
+  case "b":
+    ui.scrollMessage(-(ui.readPaneLines() - 1))
+  case "esc":
+    if ui.reading != nil {
+      ui.reading = nil
+    } else if ui.query != "" {
+      ui.query = ""
+      ui.load()
+    }
+  case "m":
+    ui.toggleRead()
+  case "a":
+    ui.moveSelected("archive")
+  case "d":
+    ui.moveSelected("trash")
+  case "r":
+    ui.reply()
+  case "/":
+    ui.prompt = true
+    ui.input = ui.query
+  }
+  return true
+}
+
+func (ui *messageUI) handlePromptKey(key string) {
+  switch key {
+  case "esc", "ctrl-c":
+    ui.prompt = false
+  case "enter":
+    ui.prompt = false
+    ui.query = strings.TrimSpace(ui.input)
+    ui.reading = nil
+    ui.load()
+  case "backspace":
+    if r := []rune(ui.input); len(r) > 0 {
+      ui.input = string(r[:len(r)-1])
+    }
+  case "ctrl-u":
+    ui.input = ""
+  default:
+    if len([]rune(key)) == 1 {
+      ui.input += key
+    }
+  }
+}
+
+func (ui *messageUI) selected() *Message {
+  if ui.sel < len(ui.msgs) {
+    return &ui.msgs[ui.sel]
+  }
+  return nil
+}
+
+func (ui *messageUI) selectMessage(i int) {
+  ui.sel = imax(0, imin(i, len(ui.msgs)-1))
+  if ui.reading != nil {
+    ui.openMessage() // the reading pane follows the selection
+  }
+}
+
+// openMessage shows the selected message in the reading pane and marks it as read
+func (ui *messageUI) openMessage() {
+  sel := ui.selected()
+  if sel == nil {
+    return
+  }
+  msg, err := loadMessage(sel.IdString())
+  if err != nil {
+    ui.status = err.Error()
+    return
+  }
+  if err := msg.Decrypt(); err != nil {
+    ui.status = err.Error()
+  }
+  ui.reading = msg
+  ui.readlines = ui.formatMessage(msg)
+  ui.readtop = 0
+  if ui.unread[msg.id] {
+    if err := markRead(msg.id); err != nil {
+      ui.status = err.Error()
+    } else {
+      delete(ui.unread, msg.id)
+    }
+  }
+}
+
+func (ui *messageUI) formatMessage(msg *Message) []string {
+  width := ui.t.width
+  lines := messageHeaderLines(msg, time.Now())
+  for i, line := range lines {
+    lines[i] = colheader + fitWidth(line, width) + colreset
+  }
+  lines = append(lines, "")
+  lines = append(lines, wrapText(string(msg.body), width)...)
+  if files := attachmentLines(msg); files != nil {
+    lines = append(lines, "", colheader+fitWidth(files[0], width)+colreset)
+    for _, line := range files[1:] {
+      lines = append(lines, fitWidth(line, width))
+    }
+  }
+  return lines
+}
+
+func (ui *messageUI) scrollMessage(delta int) {
+  if ui.reading == nil {
+    ui.openMessage()
+    return
+  }
+  ui.readtop = imax(0, imin(ui.readtop+delta, len(ui.readlines)-ui.readPaneLines()))
+}
+
+func (ui *messageUI) toggleRead() {
+  msg := ui.selected()
+  if msg == nil {
+    return
+  }
+  isread := ui.unread[msg.id]
+  var err error
+  if isread {
+    err = markRead(msg.id)
+  } else {
+    err = db.MarkRead(msg.Id(), false)
+  }
+  if err != nil {
+    ui.status = err.Error()
+  } else if isread {
+    delete(ui.unread, msg.id)
+  } else {
+    ui.unread[msg.id] = true
+  }
+}
+
+// moveSelected moves the selected message to the archive or trash folder
+func (ui *messageUI) moveSelected(folder string) {
+  sel := ui.selected()
+  if sel == nil {
+    return
+  }
+  msg := &Message{}
+  err := db.LoadMessageById(sel.id, msg)
+  if err == nil {
+    if folder == "trash" {
+      err = trashMessage(msg)
+      ui.status = "moved to trash"
+    } else {
+      err = archiveMessage(msg)
+      ui.status = "archived"
+    }
+  }
+  if err != nil {
+    ui.status = err.Error()
+    return
+  }
+  ui.msgs = append(ui.msgs[:ui.sel], ui.msgs[ui.sel+1:]...)
+  ui.reading = nil
+  ui.selectMessage(ui.sel)
+}
+
+// reply suspends the ui while composing a reply to the selected message in $EDITOR
+func (ui *messageUI) reply() {
+  sel := ui.selected()
+  if sel == nil {
+    return
+  }
+  orig, err := loadMessage(sel.IdString())
+  if err == nil {
+    err = orig.Decrypt()
+  }
+  if err != nil {
+    ui.status = err.Error()
+    return
+  }
+  // note: replyTo exits the program on errors, so check for the most likely one here
+  if config.IdentityForAddress(orig.to.address) == nil {
+    ui.status = fmt.Sprintf("no sender identity configured (see %s id add)", progname)
+    return
+  }
+  ui.t.suspend()
+  logger.SetOutput(os.Stderr)
+  sent := replyTo(orig, replyOptions{})
+  logger.SetOutput(uiLogWriter(ui.logch))
+  if err := ui.t.resume(); err != nil {
+    ui.status = err.Error()
+  } else if sent {
+    delete(ui.unread, orig.id)
+    ui.status = "reply sent"
+  } else {
+    ui.status = "reply aborted"
+  }
+}
+
+// readPaneLines returns the number of lines of the reading pane
+func (ui *messageUI) readPaneLines() int {
+  return ui.t.height - 3 - ui.listlines
+}
+
+func (ui *messageUI) draw() {
+  width, height := ui.t.width, ui.t.height
+  lines := make([]string, 0, height)
+
+  // title
+  title := fmt.Sprintf(" %s · %d %s", ui.filter.folder, len(ui.msgs),
+    plural(len(ui.msgs), "message", "messages"))
+  if ui.query != "" {
+    title += fmt.Sprintf(" matching %q", ui.query)
+  }
+  lines = append(lines, colselected+fitWidth(sanitizeText(title), width)+colreset)
+
+  // message list, taking up all space or, if a message is open, 40% of it
+  ui.listlines = height - 2
+  if ui.reading != nil {
+    ui.listlines = imax(3, (height-3)*2/5)
+  }
+  if ui.sel < ui.top {
+    ui.top = ui.sel
+  } else if ui.sel >= ui.top+ui.listlines {
+    ui.top = ui.sel - ui.listlines + 1
+  }
+  now := time.Now()
+  for i := ui.top; i < ui.top+ui.listlines; i++ {
+    if i >= len(ui.msgs) {
+      lines = append(lines, "")
+      continue
+    }
+    lines = append(lines, ui.formatRow(&ui.msgs[i], now, i == ui.sel, width))
+  }
+
+  // reading pane
+  if ui.reading != nil {
+    lines = append(lines, colseparator+strings.Repeat("─", width)+colreset)
+    n := ui.readPaneLines()
+    for i := ui.readtop; i < ui.readtop+n; i++ {
+      if i < len(ui.readlines) {
+        lines = append(lines, ui.readlines[i])
+      } else {
+        lines = append(lines, "")
+      }
+    }
+  }
+
+  // status line
+  switch {
+  case ui.prompt:
+    lines = append(lines, fitWidth("/"+sanitizeText(ui.input)+"█", width))
+  case ui.status != "":
+    lines = append(lines, fitWidth(sanitizeText(ui.status), width))
+  default:
+    lines = append(lines, coldim+fitWidth(uiHelp, width)+colreset)
+  }
+
+  ui.t.draw(lines)
+}
+
+func (ui *messageUI) formatRow(msg *Message, now time.Time, selected bool, width int) string {
+  marker := "  "
+  color := colreset
+  if ui.unread[msg.id] {
+    marker = "● "
+    color = colrow
+  }
+  timestr := formatMessageTime(now, localTime(msg.time))
+  fromwidth := imin(20, width/4)
+  timewidth := len("2006, Jan 02, 15:04") // longest formatTime result
+  subjwidth := width - 2 - fromwidth - 4 - timewidth // 2 for the marker
+  row := marker +
+    fitWidth(sanitizeText(msg.from.ShortString()), fromwidth) + "  " +
+    fitWidth(sanitizeText(msg.subject), subjwidth) + "  " +
+    timestr
+  row = fitWidth(row, width)
+  markerColor := color
+  if ui.unread[msg.id] {
+    markerColor = colmarker // see Theme.MarkerUnread
+  }
+  if selected {
+    color += colselected
+    markerColor += colselected
+  }
+  n := imin(len(marker), len(row))
+  return markerColor + row[:n] + color + row[n:] + colreset
+}
+
+// archiveMessage moves a message and its file to the archive folder
+func archiveMessage(msg *Message) error {
+  if msg.folder == "archive" {
+    return errorf("message is already archived")
+  }
+  file := msg.file
+  if file != "" {
+    dstfile, err := moveIntoDir(filepath.Join(MSGDIR, file), ARCHIVEDIR)
+    if err != nil {
+      return err
+    }
+    file = relPath(MSGDIR, dstfile)
+  }
+  return db.MoveMessage(msg.id[:], msg.folder, "archive", file)
+}
@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "os/exec"
+  "runtime"
+  "strconv"
+  "time"
+)
+
+func cmd_watch(fl *flag.FlagSet) func() {
+  opt_exec := fl.String("exec", "",
+    "Run shell `command` for every new message, with the message in environment\n"+
+      "variables SMSG_ID, SMSG_FROM, SMSG_SUBJECT and SMSG_PRIORITY")
+  opt_notify := fl.Bool("notify", false,
+    "Show a desktop notification for every new message, with notify-send on Linux\n"+
+      "and osascript on macOS, or ring the terminal bell if neither is available")
+  return func() {
+    // note: handlers are called one at a time, so -exec commands never overlap and
+    // their output is not interleaved with ours
+    msgsync.OnNewMessage(func(msg *Message) {
+      printWatchRow(msg)
+      if *opt_notify {
+        desktopNotify(msg)
+      }
+      if *opt_exec != "" {
+        runWatchExec(*opt_exec, msg)
+      }
+    })
+    startWebhooks()
+    msgsync.Watch()
+    fmt.Fprintf(os.Stderr, "watching %s for new messages (^C to stop)\n", INBOXDIR)
+    keepRunning = true
+  }
+}
+
+func printWatchRow(msg *Message) {
+  color := priorityColor(msg.priority, colrow)
+  markerColor := color
+  if color == colrow {
+    markerColor = colmarker // see Theme.MarkerUnread
+  }
+  fmt.Printf("%s●%s %-20s  %-35s  %s  %s%s%s\n",
+    markerColor, color,
+    limitStrLen(msg.from.ShortString(), 20),
+    limitStrLen(msg.subject, 35),
+    formatMessageTime(time.Now(), localTime(msg.time)),
+    coldim, msg.IdString(), colreset)
+}
+
+func runWatchExec(command string, msg *Message) {
+  cmd := exec.Command("/bin/sh", "-c", command)
+  cmd.Stdin = nil
+  cmd.Stdout = os.Stdout
+  cmd.Stderr = os.Stderr
+  cmd.Env = append(os.Environ(),
+    "SMSG_ID="+msg.IdString(),
+    "SMSG_FROM="+msg.from.String(),
+    "SMSG_SUBJECT="+msg.subject,
+    "SMSG_PRIORITY="+msg.priority.String())
+  if err := cmd.Run(); err != nil {
+    errlog("-exec %q: %v", command, err)
+  }
+}
+
+// notifyUrgency returns the urgency of notify-send for a message with priority p
+func notifyUrgency(p messagePriority) string {
+  switch {
+  case p >= priorityUrgent:
+    return "critical"
+  case p <= priorityLow:
+    return "low"
+  }
+  return "normal"
+}
+
+// desktopNotify shows a notification of msg with the notification system of the
+// desktop, or rings the terminal bell if there's none
+func desktopNotify(msg *Message) {
+  title := msg.from.ShortString()
+  var cmd *exec.Cmd
+  switch runtime.GOOS {
+  case "darwin":
+    // note: AppleScript strings have the same escapes as Go's, for quotes and backslashes
+    cmd = exec.Command("osascript", "-e", fmt.Sprintf("display notification %s with title %s",
+      strconv.Quote(msg.subject), strconv.Quote(title)))
+  default:
+    if path, err := exec.LookPath("notify-send"); err == nil {
+      cmd = exec.Command(path, "--app-name=smsg", "--urgency="+notifyUrgency(msg.priority),
+        "--", title, msg.subject)
+    }
+  }
+  if cmd != nil {
+    out, err := cmd.CombinedOutput()
+    if err == nil {
+      return
+    }
+    watchlog.Debugf("%s: %v %s", cmd.Path, err, out)
+  }
+  fmt.Fprint(os.Stderr, "\a")
+}
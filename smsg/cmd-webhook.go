@@ -0,0 +1,122 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "net/url"
+  "os"
+  "strings"
+  "text/tabwriter"
+  "time"
+)
+
+func cmd_webhook(fl *flag.FlagSet) func() {
+  return func() {
+    switch fl.Arg(0) {
+    case "", "list", "ls":
+      printWebhooks()
+    case "add":
+      cmd_webhook_add(fl.Args()[1:]...)
+    case "test":
+      if fl.NArg() != 2 {
+        fl.Usage()
+        os.Exit(1)
+      }
+      hook := findWebhookArg(fl.Arg(1))
+      // note: the message is parsed, rather than the event made up, to give it a real id
+      msg, _, err := parseOutgoingMessage([]byte("from test@localhost\nto test@localhost\n"+
+        "subject Test event from smsg\nbody 4\ntest\n"), "test")
+      must(err)
+      ev := makeWebhookEvent(msg)
+      ev.Test = true
+      start := time.Now()
+      if err := postWebhook(hook, &ev); err != nil {
+        fatalf("webhook %s: %v", hook.Name, err)
+      }
+      fmt.Printf("%s: ok in %s\n", hook.Name, time.Since(start).Round(time.Millisecond))
+    case "rm":
+      if fl.NArg() != 2 {
+        fl.Usage()
+        os.Exit(1)
+      }
+      hook := findWebhookArg(fl.Arg(1))
+      for i, h := range config.Webhooks {
+        if h == hook {
+          config.Webhooks = append(config.Webhooks[:i], config.Webhooks[i+1:]...)
+          break
+        }
+      }
+      must(config.Save(CONFIGFILE))
+    default:
+      fatalf("unknown webhook command %q\nSee %s webhook -h for help", fl.Arg(0), progname)
+    }
+  }
+}
+
+func cmd_webhook_add(args ...string) {
+  fl := flag.NewFlagSet("webhook add", flag.ExitOnError)
+  opt_url := fl.String("url", "", "`URL` to POST new messages to")
+  opt_secret := fl.String("secret", "",
+    "Sign requests with HMAC-SHA256 using `key` (X-Smsg-Signature header)")
+  opt_from := fl.String("from", "",
+    "Only messages from these comma-separated `addresses` (\"*@domain\" for any address\n"+
+      "at domain)")
+  fl.Parse(args)
+  if fl.NArg() != 1 || *opt_url == "" {
+    fl.Usage()
+    os.Exit(1)
+  }
+  name := fl.Arg(0)
+  if name == "" || strings.ContainsAny(name, " \t,") {
+    fatalf("invalid webhook name %q (must not contain ',' or spaces)", name)
+  }
+  if config.FindWebhook(name) != nil {
+    fatalf("webhook %q already exists", name)
+  }
+  if u, err := url.Parse(*opt_url); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+    fatalf("invalid -url %q: must be an http or https URL", *opt_url)
+  }
+  hook := &Webhook{Name: name, URL: *opt_url, Secret: *opt_secret}
+  if *opt_from != "" {
+    for _, s := range strings.Split(*opt_from, ",") {
+      s = strings.TrimSpace(s)
+      if !strings.HasPrefix(s, "*@") {
+        var err error
+        if s, err = normalizeAndValidateAddress(s); err != nil {
+          fatalf("invalid -from address %q", s)
+        }
+      }
+      hook.From = append(hook.From, s)
+    }
+  }
+  config.Webhooks = append(config.Webhooks, hook)
+  must(config.Save(CONFIGFILE))
+}
+
+// findWebhookArg returns the webhook with name, or exits with an error if there's none
+func findWebhookArg(name string) *Webhook {
+  hook := config.FindWebhook(name)
+  if hook == nil {
+    fatalf("no webhook %q (see %s webhook list)", name, progname)
+  }
+  return hook
+}
+
+func printWebhooks() {
+  if len(config.Webhooks) == 0 {
+    fmt.Printf("No webhooks. Add one with: %s webhook add -url <url> <name>\n", progname)
+    return
+  }
+  w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+  fmt.Fprintf(w, "%sName\tURL\tFrom\tSecret%s\n", colheader, colreset)
+  for _, hook := range config.Webhooks {
+    from := strings.Join(hook.From, ", ")
+    if from == "" {
+      from = "*"
+    }
+    fmt.Fprintf(w, "%s%s\t%s\t%s\t%s%s\n", colreset,
+      hook.Name, hook.URL, from, tokenFingerprint(hook.Secret), colreset)
+  }
+  w.Flush()
+}
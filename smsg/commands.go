@@ -0,0 +1,668 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "flag"
+  "fmt"
+  "io"
+  "os"
+  "strings"
+  "text/tabwriter"
+)
+
+// Command is a command of the smsg program
+type Command struct {
+  Name    string
+  Aliases []string
+  Args    string // synopsis of positional arguments, e.g. "<id>"
+  Summary string // one-line description
+  Help    string // additional description printed by "help <command>"
+
+  // Setup defines the command's flags on fl and returns a function which runs the
+  // command after fl has been parsed
+  Setup func(fl *flag.FlagSet) (run func())
+
+  // Complete describes the positional arguments of the command for shell completion:
+  // "id" (message ids), "address" (contact addresses), "file", "dir", "command" (names of
+  // commands) or a space-separated list of words, like subcommands.
+  Complete string
+
+  // NoSync means the command does not need background indexing and delivery
+  NoSync bool
+
+  // Proxy means the command uses the control socket of a running daemon or server when
+  // there is one (see ctl), in which case background indexing and delivery is not started
+  Proxy bool
+
+  // NoSetup means MSGDIR is not set up for the command: directories are not created
+  // and the config and database are not loaded. Implies NoSync.
+  NoSetup bool
+
+  // NoDB means the command works without the database, with -no-db, e.g. when it's
+  // damaged. Other commands fail with -no-db.
+  NoDB bool
+
+  // RawArgs means the arguments are not parsed as flags; the command parses fl.Args()
+  // itself, e.g. to accept the options of another program
+  RawArgs bool
+
+  Hidden bool // not listed in usage or completions
+}
+
+// commands lists all commands. It's populated in init to avoid an initialization cycle,
+// since some commands refer to the list.
+var commands []*Command
+
+func init() {
+  commands = []*Command{
+    {
+      Name:    "list",
+      Aliases: []string{"ls", "l"},
+      Summary: "List messages in your inbox (default)",
+      Proxy:   true,
+      NoDB:    true,
+      Help: `
+Waits up to 3 seconds for new message files to be indexed, then lists what's in the
+index and notes that it's still updating; -wait waits for as long as it takes.
+With "smsg -no-db list", e.g. when the database is damaged or locked, messages are
+listed from the headers of their files instead, newest first, without ids and without
+-unread, -ids or -json.
+In the sent folder, outbox and drafts, messages are listed with their recipients.
+In the outbox, messages which could not be delivered are marked with ✗.
+In the sent folder, messages are marked with ✓ when their recipient's server has
+reported that they were delivered, and ✓✓ when read (see "receipts" in the config.)
+With -threads, replies are listed together with the messages they reply to, one thread
+per row; -thread <id> lists the messages of one. Use -folder all to include your own
+replies, which are in the sent folder.
+-columns selects the columns to list, e.g. -columns id,from,subject,folder; -l lists
+the id prefix, size and labels of messages too. The subject is truncated to fit the
+width of the terminal.
+-tsv prints one line per message with the values of the columns separated by tabs,
+without a header, colors or truncation, e.g. for cut and awk; the columns default to
+id,from,subject,time. Backslashes, tabs, newlines and carriage returns in values are
+escaped as \\, \t, \n and \r. Times are in UTC, like 2006-01-02T15:04:05Z, sizes in
+bytes, and labels separated by commas.`,
+      Setup:   cmd_list,
+    },
+    {
+      Name:    "count",
+      Summary: "Print the number of messages",
+      Help: `
+Prints just the number, e.g. for use in a shell prompt. Doesn't wait for the inbox
+to be scanned unless -wait is given, so recently arrived messages may not be counted.`,
+      Setup:  cmd_count,
+      NoSync: true,
+      Proxy:  true,
+    },
+    {
+      Name:    "read",
+      Aliases: []string{"r"},
+      Args:    "<id> | -unread",
+      Summary: "Read a message",
+      Help: `
+Prints the header and body of a message and marks it as read. With -unread, the unread
+messages of the inbox (or of -folder) are read one after the other, newest first, or
+oldest first with -r. With -thread, the messages of the thread which the message is in
+are read in order of replies; use -folder all to include your own replies.`,
+      Setup:    cmd_read,
+      Complete: "id",
+    },
+    {
+      Name:    "search",
+      Args:    "<query>",
+      Summary: "Search the subject and body of messages",
+      Help: `
+Words are matched by prefix with a trailing "*" (e.g. repo*) and phrases are matched
+when quoted (e.g. '"quarterly report"'). See https://sqlite.org/fts5.html for the
+full query syntax.`,
+      Setup: cmd_search,
+    },
+    {
+      Name:     "send",
+      Args:     "<file>",
+      Summary:  "Send a message",
+      Help:     `Reads the message from stdin if <file> is "-"`,
+      Setup:    cmd_send,
+      Complete: "file",
+    },
+    {
+      Name:    "sendmail",
+      Args:    "[<recipient> ...]",
+      Summary: "Send an email read from stdin, like sendmail",
+      Help: `
+For programs which send email with sendmail, like cron. smsg also acts like this
+when invoked as "sendmail", e.g. through a symlink.
+The email is converted to a message (its text part becomes the body and attachments
+become files) and queued in the outbox. Recipients are addresses or aliases.
+Options:
+  -t             Also send to the recipients in the To, Cc and Bcc headers. Bcc
+                 recipients are not hidden from other recipients.
+  -i, -oi        Don't treat a line with a single "." as the end of the email
+  -f <address>   Sender for an email without a From header (default: the default
+                 identity)
+  -F <name>      Name of the sender for an email without a From header
+Other options of sendmail, like -oem, are ignored. Exits with status 64 for invalid
+arguments, 65 for an invalid email, 67 for an invalid recipient, 75 if the message
+could not be queued, in which case it can be sent again later, and 78 when there's
+no sender identity.`,
+      Setup:   cmd_sendmail,
+      NoSync:  true,
+      RawArgs: true,
+    },
+    {
+      Name:    "scan",
+      Summary: "Index the message files in the inbox, outbox and sent folders",
+      Help: `
+The folders are scanned every time smsg runs, so this is rarely needed. Files which
+have not changed since they were indexed, judging by their size and modification time,
+are skipped unless -full is given. Messages whose file has moved within its folder are
+updated, and messages whose file has been removed from the inbox are removed from the
+index. Prints the number of files indexed and skipped, and of messages removed and
+moved, for each folder.
+
+When several files have the same message, the one with the smallest path is the
+message's file and the others are duplicates, which smsg doctor lists.
+-remove-duplicates removes duplicates which are identical to the message's file.`,
+      Setup:  cmd_scan,
+      NoSync: true,
+    },
+    {
+      Name:    "reindex",
+      Summary: "Rebuild the database from the message files",
+      Help: `
+Moves the database aside, to smsg.db.<time>.bak, creates a new one and indexes the
+message files in all folders. Then copies what can't be found in the files from the
+old database: which messages have been read, when messages were trashed, receipts,
+delivery states, labels, pinned contact names, API tokens and pull cursors. What can be read
+from a damaged database is copied. The old database is kept.
+smsg daemon and smsg serve must not be running.`,
+      Setup:   cmd_reindex,
+      NoSetup: true,
+    },
+    {
+      Name:    "migrate-layout",
+      Args:    "[-dry-run]",
+      Summary: "Move inbox and sent message files into directories by year and month",
+      Help: `
+Moves message files like inbox/20240712-093114.msg to inbox/2024/07/20240712-093114.msg
+and sets date_dirs in the config, so that new messages are stored the same way. Files
+in other directories are left where they are; they are read wherever they are, so this
+is optional. smsg daemon and smsg serve must not be running.`,
+      Setup:  cmd_migrate_layout,
+      NoSync: true,
+    },
+    {
+      Name:    "compose",
+      Summary: "Compose a message in $EDITOR and send it",
+      Help: `
+With -draft the message is saved as a draft instead, which may be unfinished, e.g. have
+no recipients yet. -resume <id> continues composing a draft and sends it, or with -draft
+saves it again.`,
+      Setup: cmd_compose,
+    },
+    {
+      Name:    "drafts",
+      Summary: "List drafts (see compose -draft)",
+      Setup:   cmd_drafts,
+      NoSync:  true,
+    },
+    {
+      Name:     "reply",
+      Args:     "<id>",
+      Summary:  "Reply to a message",
+      Help:     `Opens $EDITOR with the original message quoted, unless -body is given.`,
+      Setup:    cmd_reply,
+      Complete: "id",
+    },
+    {
+      Name:     "forward",
+      Aliases:  []string{"fwd"},
+      Args:     "-to <address> <id>",
+      Summary:  "Forward a message, including its files",
+      Setup:    cmd_forward,
+      Complete: "id",
+    },
+    {
+      Name:    "outbox",
+      Args:    "[retry <id>]",
+      Summary: "List messages waiting to be delivered",
+      Help: `
+"retry <id>" makes an immediate delivery attempt, even for failed messages.`,
+      Setup:    cmd_outbox,
+      Complete: "retry",
+    },
+    {
+      Name:    "push",
+      Args:    "[-to-peer <name>] [<id> ...]",
+      Summary: "Deliver messages in the outbox now",
+      Help: `
+Makes a delivery attempt for each message in the outbox, or for the messages <id>.
+Messages to addresses in the domains of a peer (see "peers" in the config) are
+sent to that server (see serve), with its HTTP API or the peer protocol, and are
+moved to the sent folder once the server has accepted them.`,
+      Setup:  cmd_push,
+      NoSync: true,
+    },
+    {
+      Name:    "pull",
+      Args:    "[-follow] [<peer> ...]",
+      Summary: "Fetch new messages from peers",
+      Help: `
+Downloads the messages in the inbox of each peer (see peer) which
+are newer than the last one pulled from it, into the inbox. Defaults to all peers
+with an http or https url. With -follow, keeps running and pulls new messages as
+they arrive.`,
+      Setup:  cmd_pull,
+      NoSync: true,
+    },
+    {
+      Name:    "peer",
+      Args:    "[<command>]",
+      Summary: "Manage the servers messages are delivered to",
+      Help: `
+Messages to addresses in the domains of a peer are delivered to it, and messages to
+addresses in no peer's domains to the default peer.
+Commands:
+  list           List peers (default). Tokens are shown as fingerprints.
+  add [-url <url>] [-token <token>|-] [-domains <domain,...>]
+      [-cert-fingerprint <sha256>] [-default] <name>
+                 Add a peer. See peer add -h
+  test <name>    Connect to a peer and show its version and the time it took
+  use <name>     Make a peer the default peer
+  rm <name>      Remove a peer`,
+      Setup:    cmd_peer,
+      Complete: "list add test use rm",
+      NoSync:   true,
+    },
+    {
+      Name:     "rm",
+      Aliases:  []string{"delete"},
+      Args:     "<id> ...",
+      Summary:  "Move messages to the trash",
+      Setup:    cmd_rm,
+      Complete: "id",
+      NoSync:   true,
+    },
+    {
+      Name:    "label",
+      Args:    "<id> [+<label> | -<label> ...]",
+      Summary: "List, add and remove labels of a message",
+      Help: `
+Labels are added from the "tags" section of a message when it's first indexed, and can
+be added (+<label>) and removed (-<label>) locally. Removed sender labels stay removed
+when the message is indexed again. Messages with a label are listed with -label.`,
+      Setup:    cmd_label,
+      Complete: "id",
+      NoSync:   true,
+    },
+    {
+      Name:    "dedupe",
+      Summary: "Find copies of messages",
+      Help: `
+Copies of a message are messages in the same folder with the same content, sender and
+recipient, but sent at different times, e.g. sent again. They are found when added, and
+what is done with them depends on "duplicates" in the config: "link" (default) lists
+them as one message, noted with the number of copies, "skip" doesn't add them, and
+"mark" lists each. Messages with the same content to other recipients are not copies.
+
+dedupe lists the messages which have copies, including those indexed before copies were
+detected, which it records as copies. With -trash, all but the earliest copy of each are
+moved to the trash. Messages indexed before content hashes were are checked once their
+files change, or after "smsg reindex".`,
+      Setup: cmd_dedupe,
+    },
+    {
+      Name:    "stats",
+      Summary: "Show how much space messages take",
+      Help: `
+Prints the number and total size of the messages in each folder, and lists the largest
+messages (outside the trash and drafts.) Messages indexed before sizes were recorded are
+counted once their files change, or after "smsg reindex".`,
+      Setup: cmd_stats,
+    },
+    {
+      Name:    "trash",
+      Args:    "[<command>]",
+      Summary: "List and purge messages in the trash",
+      Help: `
+Messages in the trash are purged automatically after trash_retention (see the config;
+default 30 days.) A little purging is done every time smsg runs; "purge" does the rest.
+Commands:
+  list    List messages in the trash (default)
+  purge   Permanently delete messages older than -older, with their files`,
+      Setup:    cmd_trash,
+      Complete: "list purge",
+    },
+    {
+      Name:    "purge-expired",
+      Summary: "Delete messages which have expired",
+      Help: `
+Messages with an "expires" section are no longer listed once they have expired, unless
+-expired is given, and are deleted with their files an hour later, allowing for clocks
+being off. A little purging is done every time smsg runs; purge-expired does the rest.`,
+      Setup: cmd_purge_expired,
+    },
+    {
+      Name:    "id",
+      Args:    "[<command>]",
+      Summary: "Manage sender identities",
+      Help: `
+Commands:
+  list                    List identities (default)
+  add <address> [<name>]  Add an identity. Options:
+    -alias <alias>          Short name for use with -from
+    -key <file>             Key file (see "key")
+  use <address|alias>     Set the default identity
+  rm <address|alias>      Remove an identity`,
+      Setup:    cmd_id,
+      Complete: "list add use rm",
+    },
+    {
+      Name:    "key",
+      Args:    "[<command>]",
+      Summary: "Manage encryption keys",
+      Help: `
+Messages sent with -encrypt can only be read by the recipients, with the private keys
+of their identities. The public key of each recipient must have been added with "add".
+Commands:
+  list                        List public keys of identities and recipients (default)
+  gen [<address|alias>]       Create an encryption key for an identity, in its key file
+                              (see "id add -key"), and print its public key. Options:
+    -file <file>                Key file, if the identity has none yet.
+                                Defaults to MSGDIR/.keys/<address>.key
+  add <address> <public key>  Add or replace the public key of a recipient
+  rm <address>                Remove the public key of a recipient`,
+      Setup:    cmd_key,
+      Complete: "list gen add rm",
+      NoSync:   true,
+    },
+    {
+      Name:    "contacts",
+      Args:    "[<command>]",
+      Summary: "List and name the authors of messages",
+      Help: `
+Commands:
+  list                  List contacts (default)
+  set <address> <name>  Set the display name of a contact.
+                        The name is kept even if messages use another name.
+  rm <address>          Remove a contact, including a name set with "set".
+                        Authors of messages reappear when messages are indexed.`,
+      Setup:    cmd_contacts,
+      Complete: "list set rm",
+    },
+    {
+      Name:    "alias",
+      Args:    "[<command>]",
+      Summary: "Manage recipient aliases",
+      Help: `
+Aliases can be used in place of addresses with send -to, compose -to, forward -to
+and reply -cc. An alias with several addresses is a group.
+Commands:
+  list                          List aliases (default)
+  add <alias> <address> ...     Add addresses to an alias, creating it if needed
+  rm <alias> [<address> ...]    Remove addresses from an alias, or the entire alias`,
+      Setup:    cmd_alias,
+      Complete: "list add rm",
+    },
+    {
+      Name:    "watch",
+      Summary: "Print new messages as they arrive, until interrupted",
+      Setup:   cmd_watch,
+    },
+    {
+      Name:    "daemon",
+      Summary: "Index and deliver messages in the background, until interrupted",
+      Help: `
+Keeps the index up to date as messages arrive and delivers messages in the outbox.
+Other programs can use it through a unix socket, MSGDIR/smsg.sock (see control.go
+for the protocol), and list and count use it when it's running instead of
+scanning the inbox themselves. serve provides the socket too.
+SIGUSR1 (kill -USR1) makes daemon and serve scan the messages root directory for
+changes right away, e.g. after copying files into the inbox.`,
+      Setup:  cmd_daemon,
+      NoSync: true,
+    },
+    {
+      Name:    "webhook",
+      Args:    "[<command>]",
+      Summary: "Manage URLs which are notified of new messages",
+      Help: `
+While daemon, serve or watch runs, a JSON summary of each new message (id, from,
+subject, time and nfiles) is POSTed to the webhooks which match it. With a secret, the
+body is signed with HMAC-SHA256 in the header "X-Smsg-Signature: sha256=<hex>".
+Commands:
+  list           List webhooks (default). Secrets are shown as fingerprints.
+  add -url <url> [-secret <key>] [-from <address,...>] <name>
+                 Add a webhook. See webhook add -h
+  test <name>    POST a test event to a webhook and show the time it took
+  rm <name>      Remove a webhook`,
+      Setup:    cmd_webhook,
+      Complete: "list add test rm",
+      NoSync:   true,
+    },
+    {
+      Name:    "ui",
+      Summary: "Browse messages in a full-screen terminal interface",
+      Help: `
+Keys:
+  j, k, up, down   Select the next or previous message
+  enter            Read the selected message
+  space, b         Scroll the message being read
+  m                Mark as read or unread
+  a                Archive
+  d                Move to the trash
+  r                Reply, in $EDITOR
+  /                Search. esc clears the search.
+  q                Quit
+New messages appear as they arrive.`,
+      Setup: cmd_ui,
+    },
+    {
+      Name:    "serve",
+      Args:    "[<dir> | token <command>]",
+      Summary: "Serve the messages in <dir> over HTTP",
+      Help: `
+<dir> defaults to the messages root directory (see -C.) Runs until interrupted.
+Requests must have an API token in an "Authorization: Bearer <token>" header.
+With -tls-cert and -tls-key (or tls_cert and tls_key in the config), or with
+-tls-self-signed, the server uses HTTPS. The certificate is reloaded on SIGHUP.
+With rescan_on_hup in the config, SIGHUP also makes the server scan the messages
+root directory for changes. Without HTTPS or rescan_on_hup, SIGHUP stops the server.
+A self-signed certificate is created on first use and its fingerprint is printed
+so that clients can pin it.
+With -peer-addr, messages are also accepted with the peer protocol, a simple
+binary protocol over TCP (or TLS, like HTTP) used by push. Clients introduce
+themselves with an API token, like for the API.
+With -smtp, email is received too: a minimal SMTP server accepts email for local
+addresses (or recipients in the config) and rejects all other email, so it can't be
+used as a relay. Emails are converted to messages; attachments become files.
+A web UI for reading messages is served at /, unless -no-ui is given. It asks for
+an API token, which it stores in the browser.
+Token commands:
+  token list                         List tokens and when they were last used
+  token create [-name <name>]        Create a token and print it. Only its hash is
+               [-owner <address>]    stored, so it can't be shown again. A token with
+                                     an owner only gives access to the owner's messages.
+  token revoke <id|name>             Revoke a token
+API:
+  GET  /v1/messages                  List messages. Parameters: folder, from, since,
+                                     until, unread, offset, limit, q, a search query
+                                     (see search), after=<id> for messages newer
+                                     than <id> and order=oldest for oldest first.
+  POST /v1/messages                  Receive a message into the inbox. The request body
+                                     is a message file. Responds with the message's id;
+                                     201 if it's new, 200 if it was already received.
+  GET  /v1/messages/{id}             A message, including its body
+  GET  /v1/messages/{id}/raw         The message file
+  GET  /v1/messages/{id}/files/{n}   The n:th file of a message, from 0
+  GET  /v1/events                    Server-sent events: a "message" event with the
+                                     id, sender, subject and time of each new message.
+                                     Parameter since=<id> (or the Last-Event-ID
+                                     header) first sends the messages newer than <id>.
+  GET  /v1/health                    The server's version and last inbox scan`,
+      Setup:    cmd_serve,
+      Complete: "dir",
+      NoSetup:  true,
+    },
+    {
+      Name:    "completion",
+      Args:    "bash|zsh|fish",
+      Summary: "Print a shell completion script",
+      Help: `
+For example:
+  bash: smsg completion bash > /etc/bash_completion.d/smsg
+  zsh:  smsg completion zsh > "${fpath[1]}/_smsg"
+  fish: smsg completion fish > ~/.config/fish/completions/smsg.fish`,
+      Setup:    cmd_completion,
+      Complete: "bash zsh fish",
+      NoSync:   true,
+    },
+    {
+      Name:    "doctor",
+      Summary: "Check the message directory, database and configuration for problems",
+      Help: `
+Exits with status 0 if all checks pass, 1 if there are warnings and 2 on failures.`,
+      Setup:   cmd_doctor,
+      NoSetup: true,
+    },
+    {
+      Name:    "version",
+      Summary: "Print version and exit",
+      Setup:   func(*flag.FlagSet) func() { return cmd_version },
+      NoSync:  true,
+    },
+    {
+      Name:     "help",
+      Args:     "[<command>]",
+      Summary:  "Show help for a command",
+      Setup:    cmd_help,
+      Complete: "command",
+      NoSync:   true,
+    },
+    {Name: "__complete", Setup: cmd_complete, NoSync: true, Hidden: true},
+  }
+}
+
+// findCommand returns the command with name or alias, or nil if not found
+func findCommand(name string) *Command {
+  for _, c := range commands {
+    if c.Name == name {
+      return c
+    }
+    for _, alias := range c.Aliases {
+      if alias == name {
+        return c
+      }
+    }
+  }
+  return nil
+}
+
+// commandFlags returns the flags of a command
+func commandFlags(c *Command) *flag.FlagSet {
+  fl := flag.NewFlagSet(c.Name, flag.ContinueOnError)
+  fl.Usage = func() { c.PrintUsage(fl) }
+  c.Setup(fl)
+  return fl
+}
+
+// PrintUsage writes help for the command, including the flags defined in fl
+func (c *Command) PrintUsage(fl *flag.FlagSet) {
+  w := fl.Output()
+  nflags := 0
+  fl.VisitAll(func(*flag.Flag) { nflags++ })
+  fmt.Fprintf(w, "Usage: %s %s", progname, c.Name)
+  if nflags > 0 {
+    fmt.Fprintf(w, " [options]")
+  }
+  if c.Args != "" {
+    fmt.Fprintf(w, " %s", c.Args)
+  }
+  fmt.Fprintf(w, "\n%s\n", c.Summary)
+  if len(c.Aliases) > 0 {
+    fmt.Fprintf(w, "Aliases: %s\n", strings.Join(c.Aliases, ", "))
+  }
+  if c.Help != "" {
+    fmt.Fprintf(w, "%s\n", strings.TrimSpace(c.Help))
+  }
+  if nflags > 0 {
+    fmt.Fprintf(w, "Options:\n")
+    fl.PrintDefaults()
+  }
+}
+
+// writeCommandList writes the names and summaries of all commands, for the main usage
+func writeCommandList(w io.Writer) {
+  tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+  for _, c := range commands {
+    if c.Hidden {
+      continue
+    }
+    synopsis := c.Name
+    if c.Args != "" {
+      synopsis += " " + c.Args
+    }
+    fmt.Fprintf(tw, "  %s\t%s\n", synopsis, c.Summary)
+  }
+  tw.Flush()
+}
+
+func cmd_help(fl *flag.FlagSet) func() {
+  return func() {
+    if fl.NArg() == 0 {
+      usageAndExit()
+    }
+    c := findCommand(fl.Arg(0))
+    if c == nil {
+      unknownCommand(fl.Arg(0))
+    }
+    fl := commandFlags(c)
+    fl.SetOutput(os.Stdout)
+    c.PrintUsage(fl)
+  }
+}
+
+// unknownCommand reports that name is not a command, suggesting similar ones, and exits
+func unknownCommand(name string) {
+  msg := fmt.Sprintf("Unknown command %q", name)
+  if suggestions := similarCommands(name); len(suggestions) > 0 {
+    msg += fmt.Sprintf("; did you mean %s?", quoteJoin(suggestions, " or "))
+  }
+  fatalf("%s\nSee %s -h for help", msg, progname)
+}
+
+// similarCommands returns the names of commands which are close to name, e.g. misspelled
+func similarCommands(name string) []string {
+  var names []string
+  for _, c := range commands {
+    if c.Hidden {
+      continue
+    }
+    for _, s := range append([]string{c.Name}, c.Aliases...) {
+      maxdist := 1
+      if len(name) > 4 {
+        maxdist = 2
+      }
+      if editDistance(name, s) <= maxdist || (len(name) > 2 && strings.HasPrefix(s, name)) {
+        names = append(names, c.Name)
+        break
+      }
+    }
+  }
+  return names
+}
+
+func quoteJoin(v []string, lastsep string) string {
+  var sb strings.Builder
+  for i, s := range v {
+    if i > 0 {
+      if i == len(v)-1 {
+        sb.WriteString(lastsep)
+      } else {
+        sb.WriteString(", ")
+      }
+    }
+    fmt.Fprintf(&sb, "'%s'", s)
+  }
+  return sb.String()
+}
@@ -0,0 +1,356 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "encoding/json"
+  "os"
+  "strings"
+  "time"
+)
+
+// Config is the user configuration, stored as JSON in CONFIGFILE
+type Config struct {
+  // Local lists addresses which are delivered to directly, into INBOXDIR.
+  // An entry "*@domain" matches any address at domain.
+  Local []string `json:"local,omitempty"`
+
+  // MaxDeliveryAge is how long delivery of a message is attempted before giving up.
+  // Defaults to defaultMaxDeliveryAge.
+  MaxDeliveryAge Duration `json:"max_delivery_age,omitempty"`
+
+  // TrashRetention is how long messages are kept in the trash before they are purged.
+  // Defaults to defaultTrashRetention.
+  TrashRetention Duration `json:"trash_retention,omitempty"`
+
+  // RateLimit is the number of requests per minute serve accepts from each client
+  // address, and RateBurst the number of requests a client can make at once.
+  // Default to defaultRateLimit and defaultRateBurst. A negative RateLimit disables
+  // rate limiting.
+  RateLimit int `json:"rate_limit,omitempty"`
+  RateBurst int `json:"rate_burst,omitempty"`
+
+  // Recipients are the users hosted by serve, when it serves several users. Each has an
+  // inbox directory, INBOXDIR/<address>, and API tokens which give access only to their
+  // messages. An entry "*@domain" matches any address at domain.
+  // Messages for other addresses are rejected.
+  Recipients []string `json:"recipients,omitempty"`
+
+  // TLSCert and TLSKey are the certificate and key files which serve uses for HTTPS.
+  // The -tls-cert and -tls-key flags of serve override them.
+  TLSCert string `json:"tls_cert,omitempty"`
+  TLSKey  string `json:"tls_key,omitempty"`
+
+  // Peers are the servers (see serve) which messages are delivered to, by the domain of
+  // the recipient's address. Messages for other domains are delivered to the peer named
+  // DefaultPeer, if any. Managed with "smsg peer".
+  Peers       []*Peer `json:"peers,omitempty"`
+  DefaultPeer string  `json:"default_peer,omitempty"`
+
+  // Receipts is the status of received messages which is reported to their senders with
+  // receipts: "delivered" when a message is received, and "read" also when it's read.
+  // No receipts are sent by default.
+  Receipts receiptStatus `json:"receipts,omitempty"`
+
+  // Duplicates is what is done with a message which is added to a folder which has a
+  // copy of it, e.g. one sent again: "link" (default) records it as a copy, and list shows
+  // the copies as one message, "skip" doesn't add it, and "mark" records it as a copy but
+  // list shows each (see duplicatesMode)
+  Duplicates duplicatesMode `json:"duplicates,omitempty"`
+
+  // InboxPoll makes serve, daemon and watch check INBOXDIR for new files periodically
+  // instead of being notified of them by the operating system, which doesn't work for
+  // some network file systems
+  InboxPoll bool `json:"inbox_poll,omitempty"`
+
+  // RejectUnauthenticatedUrgent makes serve reject messages with priority urgent which are
+  // received without an API token, e.g. with -no-auth or by email, so that they can't be
+  // used to escalate notifications (see notifyUrgency)
+  RejectUnauthenticatedUrgent bool `json:"reject_unauthenticated_urgent,omitempty"`
+
+  // ScanWorkers is the number of message files which are parsed at once when scanning
+  // INBOXDIR. Defaults to twice the number of CPUs (see scanWorkers.)
+  ScanWorkers int `json:"scan_workers,omitempty"`
+
+  // ParseMemory is the size, in MiB, of the bodies of messages which may be read at once,
+  // e.g. by the workers of a scan. Defaults to 64 MiB (see parseBudget.)
+  ParseMemory int `json:"parse_memory,omitempty"`
+
+  // AbsTime makes list, watch and ui show the times of messages as dates rather than
+  // relative to the current time (see formatMessageTime), like the -abs-time option
+  AbsTime bool `json:"abs_time,omitempty"`
+
+  // DisplayTZ is the time zone which times are shown in, like "UTC" or "Europe/Berlin",
+  // unless overridden by SMSG_DISPLAY_TZ or the -tz flag of list, read and stats (see
+  // setDisplayLocation)
+  DisplayTZ string `json:"display_tz,omitempty"`
+
+  // Theme is the styles of text printed to terminals: "preset", one of default, light and
+  // mono, and styles of it to replace, like "marker_unread": "bold+red" (see loadTheme).
+  // SMSG_THEME takes precedence.
+  Theme map[string]string `json:"theme,omitempty"`
+
+  // DateDirs makes received and sent messages be stored in directories by year and month
+  // of the message, like INBOXDIR/2024/07/20240712-093114.msg (see messageDir)
+  DateDirs bool `json:"date_dirs,omitempty"`
+
+  // FollowSymlinks makes scans index the files which symbolic links in MSGDIR point to
+  // and look in the directories they point to, as long as those are in MSGDIR
+  FollowSymlinks bool `json:"follow_symlinks,omitempty"`
+
+  // RescanOnHUP makes serve scan MSGDIR for changes when it receives SIGHUP, instead of
+  // exiting (see MessageSyncer.Rescan)
+  RescanOnHUP bool `json:"rescan_on_hup,omitempty"`
+
+  // RescanInterval is how often serve, daemon and watch scan INBOXDIR for changes which
+  // were missed while watching it. Defaults to defaultRescanInterval; 0 disables it.
+  RescanInterval *Duration `json:"rescan_interval,omitempty"`
+
+  // Webhooks are URLs which are notified of new messages by serve, daemon and watch.
+  // Managed with "smsg webhook".
+  Webhooks []*Webhook `json:"webhooks,omitempty"`
+
+  // Identities are the addresses messages can be sent from.
+  // DefaultIdentity is the address of the one used when none is specified.
+  Identities      []*Identity `json:"identities,omitempty"`
+  DefaultIdentity string      `json:"default_identity,omitempty"`
+
+  // Aliases are short names for recipient addresses, e.g. "bob" or "team".
+  // An alias with more than one address is a group.
+  Aliases map[string]AddressList `json:"aliases,omitempty"`
+
+  // Keys are the public encryption keys of recipients, by address, for send -encrypt.
+  // Managed with "smsg key".
+  Keys map[string]string `json:"keys,omitempty"`
+}
+
+// Identity is a sender identity.
+// Address is normalized when the identity is added (see cmd_id.)
+type Identity struct {
+  Address    string `json:"address"`
+  Name       string `json:"name,omitempty"`
+  Alias      string `json:"alias,omitempty"`       // short name, e.g. "work"
+  SigningKey string `json:"signing_key,omitempty"` // path to key file (see keys.go)
+}
+
+func (id *Identity) Author() Author {
+  return Author{address: id.Address, name: id.Name}
+}
+
+// Peer is a server which messages are delivered to (see peerTransport)
+type Peer struct {
+  Name string `json:"name"`
+
+  // URL is the address of the server: "https://host:port" or "http://host:port" for its
+  // HTTP API, or "tls://host:port" or "tcp://host:port" for the peer protocol
+  URL string `json:"url"`
+
+  // Token is the server's API token (see "serve token")
+  Token string `json:"token,omitempty"`
+
+  // Domains are the domains of the recipient addresses which are delivered to the server
+  Domains []string `json:"domains,omitempty"`
+
+  // CertFingerprint is the SHA-256 fingerprint of the server's certificate, which is
+  // then trusted even if it's self-signed (see serve -tls-self-signed)
+  CertFingerprint string `json:"cert_fingerprint,omitempty"`
+}
+
+// Webhook is a URL which new messages are POSTed to as JSON (see webhookEvent)
+type Webhook struct {
+  Name string `json:"name"`
+  URL  string `json:"url"`
+
+  // Secret is the key used to sign requests with HMAC-SHA256, if any
+  Secret string `json:"secret,omitempty"`
+
+  // From limits the webhook to messages from these addresses.
+  // An entry "*@domain" matches any address at domain.
+  From []string `json:"from,omitempty"`
+}
+
+// AddressList is a list of addresses which is encoded as a string in JSON when it has
+// just one address
+type AddressList []string
+
+func (l AddressList) MarshalJSON() ([]byte, error) {
+  if len(l) == 1 {
+    return json.Marshal(l[0])
+  }
+  return json.Marshal([]string(l))
+}
+
+func (l *AddressList) UnmarshalJSON(data []byte) error {
+  var s string
+  if err := json.Unmarshal(data, &s); err == nil {
+    *l = AddressList{s}
+    return nil
+  }
+  return json.Unmarshal(data, (*[]string)(l))
+}
+
+// Duration is a time.Duration which is encoded as a string in JSON, e.g. "36h" or "7d"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+  return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+  var s string
+  if err := json.Unmarshal(data, &s); err != nil {
+    return err
+  }
+  v, err := parseDuration(s)
+  *d = Duration(v)
+  return err
+}
+
+// Load reads configuration from filename. A missing file is not an error.
+func (c *Config) Load(filename string) error {
+  data, err := os.ReadFile(filename)
+  if err != nil {
+    if os.IsNotExist(err) {
+      return nil
+    }
+    return err
+  }
+  if err := json.Unmarshal(data, c); err != nil {
+    return errorf("%s: %v", filename, err)
+  }
+  return nil
+}
+
+// Save writes the configuration to filename
+func (c *Config) Save(filename string) error {
+  data, err := json.MarshalIndent(c, "", "  ")
+  if err != nil {
+    return err
+  }
+  tmpfile := filename + ".tmp"
+  if err := os.WriteFile(tmpfile, append(data, '\n'), 0600); err != nil {
+    return err
+  }
+  return os.Rename(tmpfile, filename)
+}
+
+// FindIdentity returns the identity with the address or alias s, or nil if not found
+func (c *Config) FindIdentity(s string) *Identity {
+  for _, id := range c.Identities {
+    if strings.EqualFold(id.Address, s) || (id.Alias != "" && id.Alias == s) {
+      return id
+    }
+  }
+  return nil
+}
+
+// GetDefaultIdentity returns the default identity, or nil if there are no identities
+func (c *Config) GetDefaultIdentity() *Identity {
+  if id := c.FindIdentity(c.DefaultIdentity); id != nil {
+    return id
+  }
+  if len(c.Identities) > 0 {
+    return c.Identities[0]
+  }
+  return nil
+}
+
+// IdentityForAddress returns the identity with address, falling back to the default identity
+func (c *Config) IdentityForAddress(address string) *Identity {
+  for _, id := range c.Identities {
+    if strings.EqualFold(id.Address, address) {
+      return id
+    }
+  }
+  return c.GetDefaultIdentity()
+}
+
+// IsLocalAddress returns true if address (which is assumed to be normalized)
+// is delivered locally. This includes the addresses of identities.
+func (c *Config) IsLocalAddress(address string) bool {
+  for _, id := range c.Identities {
+    if strings.EqualFold(id.Address, address) {
+      return true
+    }
+  }
+  return matchAddress(c.Local, address)
+}
+
+// IsHostedRecipient returns true if address (which is assumed to be normalized) is one of
+// the users hosted by the server (Recipients)
+func (c *Config) IsHostedRecipient(address string) bool {
+  return matchAddress(c.Recipients, address)
+}
+
+// matchAddress returns true if address matches one of patterns, which are addresses or
+// "*@domain" for any address at domain
+func matchAddress(patterns []string, address string) bool {
+  for _, pat := range patterns {
+    if strings.HasPrefix(pat, "*@") {
+      p := strings.LastIndexByte(address, '@')
+      if p != -1 && equalDomains(address[p+1:], pat[2:]) {
+        return true
+      }
+    } else if strings.EqualFold(pat, address) || sameAddress(pat, address) {
+      return true
+    }
+  }
+  return false
+}
+
+// sameAddress reports whether addresses a and b are the same once normalized, e.g. in
+// the config, where they may have internationalized domains
+func sameAddress(a, b string) bool {
+  a, err1 := normalizeAndValidateAddress(a)
+  b, err2 := normalizeAndValidateAddress(b)
+  return err1 == nil && err2 == nil && a == b
+}
+
+// FindPeer returns the peer with name, or nil if there's none
+func (c *Config) FindPeer(name string) *Peer {
+  for _, p := range c.Peers {
+    if p.Name == name {
+      return p
+    }
+  }
+  return nil
+}
+
+// FindWebhook returns the webhook with name, or nil if there's none
+func (c *Config) FindWebhook(name string) *Webhook {
+  for _, hook := range c.Webhooks {
+    if hook.Name == name {
+      return hook
+    }
+  }
+  return nil
+}
+
+// PeerForAddress returns the peer which delivers to address, by the address's domain,
+// falling back to the default peer, or nil if there's none
+func (c *Config) PeerForAddress(address string) *Peer {
+  if peer := c.peerForDomain(address); peer != nil {
+    return peer
+  }
+  return c.FindPeer(c.DefaultPeer)
+}
+
+func (c *Config) peerForDomain(address string) *Peer {
+  p := strings.LastIndexByte(address, '@')
+  if p == -1 {
+    return nil
+  }
+  domain := address[p+1:]
+  for _, peer := range c.Peers {
+    for _, d := range peer.Domains {
+      if equalDomains(d, domain) {
+        return peer
+      }
+    }
+  }
+  return nil
+}
+
+// ExpandAlias returns the addresses of alias name, or nil if there's no such alias
+func (c *Config) ExpandAlias(name string) []string {
+  return c.Aliases[strings.ToLower(name)]
+}
@@ -0,0 +1,565 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bufio"
+  "context"
+  "encoding/json"
+  "io"
+  "net"
+  "os"
+  "path/filepath"
+  "sync"
+  "time"
+)
+
+// The control socket lets other programs on the same host, like editor plugins, use a
+// running daemon or server (see daemon and serve) without paying for starting up and
+// scanning the inbox. It's a unix socket, MSGDIR/smsg.sock, which only the owner can use.
+//
+// Requests and responses are JSON objects, one per line:
+//
+//   > {"id": 1, "method": "count-unread"}
+//   < {"id": 1, "result": {"count": 3}}
+//
+// A failed request has an "error" instead of a "result". Methods and their params:
+//
+//   list          folder, from, since, until, unread, offset, limit (0 for all)
+//                 -> {messages, total, offset, limit}, like GET /v1/messages
+//   read          id -> the message, like GET /v1/messages/{id}
+//   count         like list -> {count}
+//   count-unread  folder (default "inbox") -> {count}
+//   mark-read     id, unread (to mark as unread) -> {}
+//   send          message (the message file), from, to (for messages without those
+//                 sections, like send -from and -to) -> {id}
+//   status        -> {last_scan}, the result of the last scan of the inbox (see
+//                 scanStatus), or {} before the first one
+//   subscribe     -> {}, followed by {"event": "message", "message": {...}} for every
+//                 new message in the inbox until the connection is closed
+//
+// The list and count commands use the socket when it's available.
+
+const controlSocketName = "smsg.sock"
+
+type controlRequest struct {
+  Id     int64           `json:"id"`
+  Method string          `json:"method"`
+  Params json.RawMessage `json:"params,omitempty"`
+}
+
+type controlResponse struct {
+  Id     int64       `json:"id"`
+  Result interface{} `json:"result,omitempty"`
+  Error  string      `json:"error,omitempty"`
+}
+
+type controlEvent struct {
+  Event   string      `json:"event"`
+  Message messageJSON `json:"message"`
+}
+
+// controlStatus is the result of the status method
+type controlStatus struct {
+  LastScan *scanStatus `json:"last_scan,omitempty"`
+}
+
+// controlListParams are the params of the list and count methods
+type controlListParams struct {
+  Folder  string    `json:"folder,omitempty"`
+  From    string    `json:"from,omitempty"`
+  Label   string    `json:"label,omitempty"`
+  Since   time.Time `json:"since,omitempty"`
+  Until   time.Time `json:"until,omitempty"`
+  Unread  bool      `json:"unread,omitempty"`
+  Expired bool      `json:"expired,omitempty"`
+  Copies  bool      `json:"copies,omitempty"`
+  Thread  string    `json:"thread,omitempty"`
+  MinSize int64     `json:"min_size,omitempty"`
+  Sort    string    `json:"sort,omitempty"`
+  Oldest  bool      `json:"oldest,omitempty"`
+  Offset  int       `json:"offset,omitempty"`
+  Limit   int       `json:"limit,omitempty"`
+}
+
+func makeControlListParams(f *MessageFilter) controlListParams {
+  return controlListParams{
+    Folder:  f.folder,
+    From:    f.from,
+    Label:   f.label,
+    Since:   f.since,
+    Until:   f.until,
+    Unread:  f.unread,
+    Expired: f.expired,
+    Copies:  f.copies,
+    Thread:  threadParam(f.thread),
+    MinSize: f.minSize,
+    Sort:    f.sortBy,
+    Oldest:  f.oldest,
+    Offset:  f.offset,
+    Limit:   f.limit,
+  }
+}
+
+func (p *controlListParams) filter() (f MessageFilter, err error) {
+  f = MessageFilter{
+    folder:  p.Folder,
+    since:   p.Since,
+    until:   p.Until,
+    unread:  p.Unread,
+    expired: p.Expired,
+    copies:  p.Copies,
+    minSize: p.MinSize,
+    sortBy:  p.Sort,
+    oldest:  p.Oldest,
+    offset:  p.Offset,
+    limit:   p.Limit,
+  }
+  if f.folder == "" {
+    f.folder = "inbox"
+  }
+  if p.From != "" {
+    if f.from, err = normalizeAndValidateAddress(p.From); err != nil {
+      return f, errorf("from: %v", err)
+    }
+  }
+  if p.Label != "" {
+    if f.label = normalizeLabel(p.Label); f.label == "" {
+      return f, errorf("label: invalid label %q", p.Label)
+    }
+  }
+  if p.Thread != "" {
+    id, err := decodeId(p.Thread)
+    if err != nil {
+      return f, errorf("thread: %v", err)
+    }
+    f.thread = id[:]
+  }
+  if f.offset < 0 {
+    return f, errorf("offset: must not be negative")
+  }
+  if f.sortBy != "" && f.sortBy != "id" && f.sortBy != "priority" && f.sortBy != "size" {
+    return f, errorf("sort: invalid value %q", f.sortBy)
+  }
+  return f, nil
+}
+
+// threadParam returns the thread param of a list request for MessageFilter.thread
+func threadParam(thread []byte) string {
+  if thread == nil {
+    return ""
+  }
+  m := Message{}
+  copy(m.id[:], thread)
+  return m.IdString()
+}
+
+func controlSocketPath() string {
+  return filepath.Join(MSGDIR, controlSocketName)
+}
+
+// controlServer serves the control socket
+type controlServer struct {
+  ln     net.Listener
+  events *eventBroker
+
+  mu     sync.Mutex
+  conns  map[net.Conn]struct{}
+  closed bool
+  wg     sync.WaitGroup
+}
+
+// startControlServer listens on the control socket and serves it until shutdown.
+// A socket left behind by a process which crashed is removed first, but it's an error if
+// another process is serving the socket.
+func startControlServer() error {
+  path := controlSocketPath()
+  if info, err := os.Lstat(path); err == nil {
+    if info.Mode()&os.ModeSocket == 0 {
+      return errorf("%s is not a socket", path)
+    }
+    if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+      conn.Close()
+      return errorf("another smsg process is serving %s", path)
+    }
+    controllog.Debugf("removing stale socket %s", path)
+    if err := os.Remove(path); err != nil {
+      return err
+    }
+  }
+  ln, err := net.Listen("unix", path)
+  if err != nil {
+    return err
+  }
+  if err := os.Chmod(path, 0600); err != nil {
+    ln.Close()
+    return err
+  }
+  s := &controlServer{
+    ln:     ln,
+    events: newEventBroker(),
+    conns:  map[net.Conn]struct{}{},
+  }
+  msgsync.OnNewMessage(s.events.publish)
+  RegisterExitHandlerWithPhase(ExitPhaseServers, s.Shutdown, "control socket")
+  go func() {
+    if err := s.Serve(); err != nil {
+      errlog("control socket: %v", err)
+    }
+  }()
+  controllog.Debugf("listening on %s", path)
+  return nil
+}
+
+func (s *controlServer) Serve() error {
+  for {
+    conn, err := s.ln.Accept()
+    if err != nil {
+      s.mu.Lock()
+      closed := s.closed
+      s.mu.Unlock()
+      if closed {
+        return nil
+      }
+      if ne, ok := err.(net.Error); ok && ne.Temporary() {
+        time.Sleep(100 * time.Millisecond)
+        continue
+      }
+      return err
+    }
+    s.mu.Lock()
+    if s.closed {
+      s.mu.Unlock()
+      conn.Close()
+      return nil
+    }
+    s.conns[conn] = struct{}{}
+    s.wg.Add(1)
+    s.mu.Unlock()
+    go func() {
+      defer s.wg.Done()
+      s.serveConn(conn)
+      s.mu.Lock()
+      delete(s.conns, conn)
+      s.mu.Unlock()
+    }()
+  }
+}
+
+// Shutdown stops accepting connections, closes open ones and removes the socket
+func (s *controlServer) Shutdown(ctx context.Context) error {
+  s.mu.Lock()
+  s.closed = true
+  s.ln.Close() // note: this removes the socket file
+  for conn := range s.conns {
+    conn.Close()
+  }
+  s.mu.Unlock()
+  s.events.Close()
+  done := make(chan struct{})
+  go func() {
+    s.wg.Wait()
+    close(done)
+  }()
+  select {
+  case <-done:
+    return nil
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+}
+
+func (s *controlServer) serveConn(conn net.Conn) {
+  defer conn.Close()
+  dec := json.NewDecoder(conn)
+  enc := json.NewEncoder(conn)
+  for {
+    var req controlRequest
+    if err := dec.Decode(&req); err != nil {
+      if err != io.EOF {
+        enc.Encode(controlResponse{Error: "invalid request: " + err.Error()})
+      }
+      return
+    }
+    if req.Method == "subscribe" {
+      s.subscribe(conn, enc, req.Id)
+      return
+    }
+    res := controlResponse{Id: req.Id}
+    if result, err := s.call(req.Method, req.Params); err != nil {
+      res.Error = err.Error()
+    } else {
+      res.Result = result
+    }
+    if err := enc.Encode(res); err != nil {
+      return
+    }
+  }
+}
+
+// subscribe streams new messages to a client until it closes the connection
+func (s *controlServer) subscribe(conn net.Conn, enc *json.Encoder, id int64) {
+  c := s.events.subscribe()
+  if c == nil {
+    enc.Encode(controlResponse{Id: id, Error: "shutting down"})
+    return
+  }
+  defer s.events.unsubscribe(c)
+  if err := enc.Encode(controlResponse{Id: id, Result: struct{}{}}); err != nil {
+    return
+  }
+  // the client is not expected to send anything more; reading tells when it's gone
+  closed := make(chan struct{})
+  go func() {
+    io.Copy(io.Discard, conn)
+    close(closed)
+  }()
+  for {
+    select {
+    case <-closed:
+      return
+    case <-c.done:
+      return
+    case m := <-c.ch:
+      if err := enc.Encode(controlEvent{Event: "message", Message: m}); err != nil {
+        return
+      }
+    }
+  }
+}
+
+func (s *controlServer) call(method string, params json.RawMessage) (interface{}, error) {
+  decode := func(v interface{}) error {
+    if len(params) == 0 {
+      return nil
+    }
+    if err := json.Unmarshal(params, v); err != nil {
+      return errorf("invalid params: %v", err)
+    }
+    return nil
+  }
+
+  switch method {
+  case "list":
+    var p controlListParams
+    if err := decode(&p); err != nil {
+      return nil, err
+    }
+    f, err := p.filter()
+    if err != nil {
+      return nil, err
+    }
+    return controlListMessages(&f)
+
+  case "count", "count-unread":
+    var p controlListParams
+    if err := decode(&p); err != nil {
+      return nil, err
+    }
+    if method == "count-unread" {
+      p.Unread = true
+    }
+    f, err := p.filter()
+    if err != nil {
+      return nil, err
+    }
+    n, err := db.CountMessages(&f)
+    return map[string]int{"count": n}, err
+
+  case "status":
+    return controlStatus{LastScan: msgsync.LastScan()}, nil
+
+  case "read", "mark-read":
+    var p struct {
+      Id     string `json:"id"`
+      Unread bool   `json:"unread"`
+    }
+    if err := decode(&p); err != nil {
+      return nil, err
+    }
+    id, err := decodeId(p.Id)
+    if err != nil {
+      return nil, err
+    }
+    if method == "mark-read" {
+      if p.Unread {
+        err = db.MarkRead(id[:], false)
+      } else {
+        err = markRead(id)
+      }
+      return struct{}{}, err
+    }
+    msg, err := loadMessage(p.Id)
+    if err != nil {
+      return nil, err
+    }
+    m := makeMessageDetailJSON(msg)
+    unread, err := db.UnreadMessages([][24]byte{msg.id})
+    m.Unread = unread[msg.id]
+    return m, err
+
+  case "send":
+    var p struct {
+      Message string `json:"message"`
+      From    string `json:"from"`
+      To      string `json:"to"`
+    }
+    if err := decode(&p); err != nil {
+      return nil, err
+    }
+    data, err := withSender([]byte(p.Message), p.From)
+    if err == nil && p.To != "" {
+      data, err = withRecipients(data, p.To)
+    }
+    if err != nil {
+      return nil, err
+    }
+    msg, data, err := parseOutgoingMessage(data, "message")
+    if err != nil {
+      return nil, err
+    }
+    if _, err := queueMessage(msg, data); err != nil {
+      return nil, err
+    }
+    delivery.Wakeup()
+    return map[string]string{"id": msg.IdString()}, nil
+  }
+  return nil, errorf("unknown method %q", method)
+}
+
+// controlListMessages returns a page of the messages matching f, with their read state
+func controlListMessages(f *MessageFilter) (*messageListJSON, error) {
+  res := &messageListJSON{Messages: []apiMessageJSON{}, Offset: f.offset, Limit: f.limit}
+  var ids [][24]byte
+  var err error
+  if res.Total, err = db.CountMessages(f); err != nil {
+    return nil, err
+  }
+  err = db.ListMessages(f, func(msg *Message) error {
+    res.Messages = append(res.Messages, apiMessageJSON{messageJSON: makeMessageJSON(msg)})
+    ids = append(ids, msg.id)
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  unread, err := db.UnreadMessages(ids)
+  if err != nil {
+    return nil, err
+  }
+  for i := range res.Messages {
+    res.Messages[i].Unread = unread[ids[i]]
+  }
+  return res, nil
+}
+
+// controlClient is a connection to the control socket of a running daemon or server
+type controlClient struct {
+  conn   net.Conn
+  r      *bufio.Reader
+  nextid int64
+}
+
+// ctl is connected by main for commands which use the control socket when available
+// (Command.Proxy), or nil
+var ctl *controlClient
+
+// dialControl connects to the control socket, or returns nil if no daemon is running
+func dialControl() *controlClient {
+  conn, err := net.DialTimeout("unix", controlSocketPath(), time.Second)
+  if err != nil {
+    if !os.IsNotExist(err) {
+      controllog.Debugf("%v", err)
+    }
+    return nil
+  }
+  controllog.Debugf("using %s", controlSocketPath())
+  return &controlClient{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *controlClient) Close() error {
+  return c.conn.Close()
+}
+
+// call makes a request and decodes its result into result
+func (c *controlClient) call(method string, params, result interface{}) error {
+  c.nextid++
+  req := struct {
+    Id     int64       `json:"id"`
+    Method string      `json:"method"`
+    Params interface{} `json:"params,omitempty"`
+  }{c.nextid, method, params}
+  data, err := json.Marshal(req)
+  if err != nil {
+    return err
+  }
+  if _, err := c.conn.Write(append(data, '\n')); err != nil {
+    return err
+  }
+  line, err := c.r.ReadBytes('\n')
+  if err != nil {
+    return errorf("control socket: %v", err)
+  }
+  var res struct {
+    Id     int64           `json:"id"`
+    Result json.RawMessage `json:"result"`
+    Error  string          `json:"error"`
+  }
+  if err := json.Unmarshal(line, &res); err != nil {
+    return errorf("control socket: %v", err)
+  }
+  if res.Error != "" {
+    return errorf("%s", res.Error)
+  }
+  if result == nil {
+    return nil
+  }
+  return json.Unmarshal(res.Result, result)
+}
+
+// listMessages calls fn for each message matching f, like db.ListMessages, using the
+// control socket when connected
+func listMessages(f *MessageFilter, fn func(msg *Message) error) error {
+  if ctl == nil {
+    return db.ListMessages(f, fn)
+  }
+  var res messageListJSON
+  if err := ctl.call("list", makeControlListParams(f), &res); err != nil {
+    return err
+  }
+  for i := range res.Messages {
+    m := &res.Messages[i]
+    id, err := decodeId(m.Id)
+    if err != nil {
+      return err
+    }
+    msg := &Message{
+      id:       id,
+      time:     m.Time,
+      subject:  m.Subject,
+      from:     Author{address: m.From, name: m.FromName},
+      to:       Author{address: m.To, name: m.ToName},
+      ncc:      m.CcCount,
+      folder:   m.Folder,
+      priority: m.Priority,
+      size:     m.Size,
+      nfiles:   m.Files,
+    }
+    if err := fn(msg); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// countMessages returns the number of messages matching f, like db.CountMessages, using
+// the control socket when connected
+func countMessages(f *MessageFilter) (int, error) {
+  if ctl == nil {
+    return db.CountMessages(f)
+  }
+  var res struct {
+    Count int `json:"count"`
+  }
+  err := ctl.call("count", makeControlListParams(f), &res)
+  return res.Count, err
+}
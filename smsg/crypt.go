@@ -0,0 +1,284 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bytes"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/binary"
+  "fmt"
+  "io"
+  "sort"
+  "strings"
+
+  "golang.org/x/crypto/chacha20poly1305"
+  "golang.org/x/crypto/curve25519"
+  "golang.org/x/crypto/hkdf"
+)
+
+// Messages are encrypted much like age (age-encryption.org) does it: the body and files
+// are encrypted with ChaCha20-Poly1305 using a random message key, which is encrypted to
+// each recipient with a key derived from an ephemeral X25519 key and the recipient's
+// public key. An encrypted message has these sections:
+//
+//   enc <address> <stanza>      for each recipient: the ephemeral public key and the
+//                               encrypted message key, base64-encoded
+//   subject-enc <ciphertext>    the subject, base64-encoded, with -encrypt-subject
+//   body-enc <bytesize>         the encrypted body
+//   file-enc <bytesize> <name>  an encrypted file, with its encrypted name
+//
+// Every encrypted value uses its own nonce, a counter (see encNonce), so that values
+// can't be swapped.
+
+const (
+  encStanzaLen = curve25519.PointSize + chacha20poly1305.KeySize +
+    chacha20poly1305.Overhead
+
+  encSubjectNonce  = 0
+  encBodyNonce     = 1
+  encFileNonceBase = 2 // name of file i is encFileNonceBase+2i, its data that plus one
+
+  // encPlaceholder is the subject of messages sent with -encrypt-subject, and shown for
+  // the names of encrypted files
+  encPlaceholder = "(encrypted)"
+)
+
+var encStanzaInfo = []byte("smsg enc key")
+
+// encRecipient is an "enc" section of a message
+type encRecipient struct {
+  address string
+  stanza  []byte // ephemeral public key + message key encrypted to address
+}
+
+// messageEncryption holds the encrypted parts of a message which are not files
+type messageEncryption struct {
+  recipients []encRecipient
+  subject    []byte // encrypted subject ("subject-enc"), or nil
+  body       []byte // encrypted body ("body-enc")
+  decrypted  bool   // the message has been decrypted (see Message.Decrypt)
+}
+
+// decryptError is returned by Message.Decrypt when the key of the reader doesn't fit,
+// as opposed to when the message has been corrupted
+type decryptError struct{ msg string }
+
+func (e *decryptError) Error() string { return e.msg }
+
+// encryption returns m.enc, creating it if needed
+func (m *Message) encryption() *messageEncryption {
+  if m.enc == nil {
+    m.enc = &messageEncryption{}
+  }
+  return m.enc
+}
+
+func encNonce(n int) []byte {
+  nonce := make([]byte, chacha20poly1305.NonceSize)
+  binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(n))
+  return nonce
+}
+
+func encBase64(b []byte) string {
+  return base64.RawStdEncoding.EncodeToString(b)
+}
+
+func decBase64(s string) ([]byte, error) {
+  return base64.RawStdEncoding.DecodeString(s)
+}
+
+// stanzaKey derives the key which encrypts the message key from an X25519 shared secret
+func stanzaKey(shared, ephemeral, recipient []byte) ([]byte, error) {
+  salt := append(append([]byte{}, ephemeral...), recipient...)
+  key := make([]byte, chacha20poly1305.KeySize)
+  _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, encStanzaInfo), key)
+  return key, err
+}
+
+// wrapMessageKey encrypts msgkey to the recipient with public key pub
+func wrapMessageKey(msgkey []byte, pub [32]byte) ([]byte, error) {
+  var eph [32]byte
+  if _, err := rand.Read(eph[:]); err != nil {
+    return nil, err
+  }
+  ephpub, err := curve25519.X25519(eph[:], curve25519.Basepoint)
+  if err != nil {
+    return nil, err
+  }
+  shared, err := curve25519.X25519(eph[:], pub[:])
+  if err != nil {
+    return nil, err
+  }
+  key, err := stanzaKey(shared, ephpub, pub[:])
+  if err != nil {
+    return nil, err
+  }
+  aead, err := chacha20poly1305.New(key)
+  if err != nil {
+    return nil, err
+  }
+  return aead.Seal(ephpub, encNonce(0), msgkey, nil), nil
+}
+
+// unwrapMessageKey decrypts the message key of stanza with the private key priv
+func unwrapMessageKey(stanza []byte, priv [32]byte) ([]byte, error) {
+  ephpub := stanza[:curve25519.PointSize]
+  shared, err := curve25519.X25519(priv[:], ephpub)
+  if err != nil {
+    return nil, err
+  }
+  pub, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+  if err != nil {
+    return nil, err
+  }
+  key, err := stanzaKey(shared, ephpub, pub)
+  if err != nil {
+    return nil, err
+  }
+  aead, err := chacha20poly1305.New(key)
+  if err != nil {
+    return nil, err
+  }
+  return aead.Open(nil, encNonce(0), stanza[curve25519.PointSize:], nil)
+}
+
+// parseEncRecipient parses the value of an "enc" section: <address> <stanza>
+func parseEncRecipient(value string) (r encRecipient, err error) {
+  var address, stanza string
+  if _, err := fmt.Sscanf(value, "%s %s", &address, &stanza); err != nil {
+    return r, errorf("invalid enc section (expected address and key)")
+  }
+  if r.address, err = normalizeAndValidateAddress(address); err != nil {
+    return r, err
+  }
+  if r.stanza, err = decBase64(stanza); err != nil || len(r.stanza) != encStanzaLen {
+    return r, errorf("invalid enc section for %s (corrupted key)", r.address)
+  }
+  return r, nil
+}
+
+// encryptMessage returns the encoded data of msg, parsed from data, with its body and
+// files encrypted to the public keys of recipients, by address. With encryptSubject, the
+// subject is encrypted too, leaving encPlaceholder in its place.
+func encryptMessage(
+  msg *Message, data []byte, recipients map[string][32]byte, encryptSubject bool,
+) ([]byte, error) {
+  msgkey := make([]byte, chacha20poly1305.KeySize)
+  if _, err := rand.Read(msgkey); err != nil {
+    return nil, err
+  }
+  aead, err := chacha20poly1305.New(msgkey)
+  if err != nil {
+    return nil, err
+  }
+
+  enc := *msg
+  enc.body, enc.files = nil, nil
+  enc.enc = &messageEncryption{}
+  addresses := make([]string, 0, len(recipients))
+  for a := range recipients {
+    addresses = append(addresses, a)
+  }
+  sort.Strings(addresses)
+  for _, a := range addresses {
+    stanza, err := wrapMessageKey(msgkey, recipients[a])
+    if err != nil {
+      return nil, err
+    }
+    enc.enc.recipients = append(enc.enc.recipients, encRecipient{address: a, stanza: stanza})
+  }
+  if encryptSubject {
+    enc.enc.subject = aead.Seal(nil, encNonce(encSubjectNonce), []byte(msg.subject), nil)
+    enc.subject = encPlaceholder
+  }
+
+  var buf bytes.Buffer
+  if _, err := enc.WriteHeaderTo(&buf); err != nil {
+    return nil, err
+  }
+  body := aead.Seal(nil, encNonce(encBodyNonce), msg.body, nil)
+  fmt.Fprintf(&buf, "body-enc %d\n", len(body))
+  buf.Write(body)
+  for i, f := range msg.files {
+    n := encFileNonceBase + 2*i
+    name := aead.Seal(nil, encNonce(n), []byte(f.name), nil)
+    fdata := aead.Seal(nil, encNonce(n+1), data[f.dataStart:f.dataStart+f.dataLen], nil)
+    fmt.Fprintf(&buf, "\nfile-enc %d %s\n", len(fdata), encBase64(name))
+    buf.Write(fdata)
+  }
+  return buf.Bytes(), nil
+}
+
+// Decrypt decrypts the subject, body and file names of an encrypted message with the
+// encryption key of an identity which it's encrypted to. Files are decrypted when opened.
+// A *decryptError is returned when there's no such key or it doesn't fit.
+func (m *Message) Decrypt() error {
+  if m.enc == nil || m.enc.decrypted {
+    return nil
+  }
+  var msgkey []byte
+  var addresses []string
+  var wrongkey *Identity
+  for _, r := range m.enc.recipients {
+    addresses = append(addresses, r.address)
+    id := config.FindIdentity(r.address)
+    if id == nil {
+      continue
+    }
+    priv, err := identityEncryptionKey(id)
+    if err != nil {
+      if err == errNoEncryptionKey {
+        continue
+      }
+      return err
+    }
+    if msgkey, err = unwrapMessageKey(r.stanza, priv); err == nil {
+      break
+    }
+    wrongkey = id
+  }
+  if msgkey == nil {
+    if wrongkey != nil {
+      return &decryptError{fmt.Sprintf(
+        "wrong key: the message is encrypted to a key of %s other than the one in %s",
+        wrongkey.Address, wrongkey.SigningKey)}
+    }
+    return &decryptError{fmt.Sprintf(
+      "no key to decrypt the message with; it's encrypted to %s",
+      strings.Join(addresses, ", "))}
+  }
+
+  aead, err := chacha20poly1305.New(msgkey)
+  if err != nil {
+    return err
+  }
+  if m.enc.subject != nil {
+    subject, err := aead.Open(nil, encNonce(encSubjectNonce), m.enc.subject, nil)
+    if err != nil {
+      return errorf("encrypted subject is corrupted (%v)", err)
+    }
+    m.subject = string(subject)
+  }
+  if m.body, err = aead.Open(nil, encNonce(encBodyNonce), m.enc.body, nil); err != nil {
+    return errorf("encrypted body is corrupted (%v)", err)
+  }
+  if m.body == nil {
+    m.body = []byte{}
+  }
+  for i := range m.files {
+    f := &m.files[i]
+    if f.encName == nil {
+      continue // not encrypted
+    }
+    n := encFileNonceBase + 2*i
+    name, err := aead.Open(nil, encNonce(n), f.encName, nil)
+    if err != nil {
+      return errorf("encrypted name of file %d is corrupted (%v)", i+1, err)
+    }
+    f.name = string(name)
+    f.aead, f.nonce = aead, encNonce(n+1)
+  }
+  m.enc.decrypted = true
+  return nil
+}
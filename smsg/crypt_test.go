@@ -0,0 +1,128 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "errors"
+  "io"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+// testEncryptionKey makes a new encryption key of the identity me@example.com, the
+// recipient of test messages, and returns its public key
+func testEncryptionKey(t *testing.T) [32]byte {
+  t.Helper()
+  keyfile := filepath.Join(t.TempDir(), "me.key")
+  pub, err := generateEncryptionKey(keyfile)
+  if err != nil {
+    t.Fatal(err)
+  }
+  config.Identities = []*Identity{{Address: "me@example.com", SigningKey: keyfile}}
+  return pub
+}
+
+// testEncryptedFile writes a message with a file to the inbox, encrypted to pub with its
+// subject, and returns the path of its file
+func testEncryptedFile(t *testing.T, pub [32]byte) string {
+  t.Helper()
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  text := testMessageText("Secret", "alice@example.com", tm, "Hello, secretly\n") +
+    "file 7 plan.txt\nat dawn"
+  msg := testParse(t, strings.NewReader(text), len(text))
+  keys := map[string][32]byte{"me@example.com": pub}
+  data, err := encryptMessage(msg, []byte(text), keys, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, s := range []string{"Secret", "secretly", "plan.txt", "at dawn"} {
+    if strings.Contains(string(data), s) {
+      t.Errorf("encrypted message contains %q", s)
+    }
+  }
+  return writeTestFile(t, INBOXDIR, "20220601-100000.msg", string(data))
+}
+
+func TestEncryptMessage(t *testing.T) {
+  testMsgDir(t)
+  file := testEncryptedFile(t, testEncryptionKey(t))
+  m := &Message{}
+  if err := m.ParseFile(file); err != nil {
+    t.Fatal(err)
+  }
+  if m.subject != encPlaceholder || len(m.files) != 1 || m.files[0].encName == nil {
+    t.Errorf("subject %q, files %+v; expected %q and an encrypted file", m.subject, m.files,
+      encPlaceholder)
+  }
+  if err := m.Decrypt(); err != nil {
+    t.Fatal(err)
+  }
+  if m.subject != "Secret" || string(m.body) != "Hello, secretly\n" {
+    t.Errorf("decrypted subject %q, body %q", m.subject, m.body)
+  }
+  if len(m.files) != 1 || m.files[0].name != "plan.txt" {
+    t.Fatalf("decrypted files %+v; expected plan.txt", m.files)
+  }
+  r, err := m.files[0].Open()
+  if err != nil {
+    t.Fatal(err)
+  }
+  data, err := io.ReadAll(r)
+  r.Close()
+  if err != nil || string(data) != "at dawn" {
+    t.Errorf("file data %q, %v; expected %q", data, err, "at dawn")
+  }
+
+  // the database has the message, but not what's encrypted
+  scanTestFolder(t, "inbox")
+  db.Close()
+  for _, name := range []string{DBFILE, DBFILE + "-wal"} {
+    data, err := os.ReadFile(name)
+    if err != nil && !os.IsNotExist(err) {
+      t.Fatal(err)
+    }
+    if strings.Contains(string(data), "secretly") {
+      t.Errorf("%s contains the decrypted body", filepath.Base(name))
+    }
+  }
+}
+
+// TestDecryptErrors decrypts a message without the key it's encrypted to, and with its
+// body corrupted, which must fail with errors telling these cases apart
+func TestDecryptErrors(t *testing.T) {
+  testMsgDir(t)
+  file := testEncryptedFile(t, testEncryptionKey(t))
+  parse := func() *Message {
+    m := &Message{}
+    if err := m.ParseFile(file); err != nil {
+      t.Fatal(err)
+    }
+    return m
+  }
+
+  keyfile := config.Identities[0].SigningKey
+  config.Identities[0].SigningKey = filepath.Join(t.TempDir(), "other.key")
+  if _, err := generateEncryptionKey(config.Identities[0].SigningKey); err != nil {
+    t.Fatal(err)
+  }
+  var derr *decryptError
+  err := parse().Decrypt()
+  if !errors.As(err, &derr) || !strings.HasPrefix(err.Error(), "wrong key") {
+    t.Errorf("with another key: %v; expected a wrong key error", err)
+  }
+  config.Identities[0].SigningKey = ""
+  err = parse().Decrypt()
+  if !errors.As(err, &derr) || !strings.HasPrefix(err.Error(), "no key") {
+    t.Errorf("without a key: %v; expected a missing key error", err)
+  }
+
+  config.Identities[0].SigningKey = keyfile
+  m := parse()
+  m.enc.body[len(m.enc.body)/2] ^= 1
+  err = m.Decrypt()
+  if err == nil || errors.As(err, &derr) || !strings.Contains(err.Error(), "corrupted") {
+    t.Errorf("with a corrupted body: %v; expected a corruption error", err)
+  }
+}
@@ -2,8 +2,16 @@
 package main
 
 import (
+  "bytes"
+  "context"
+  "crypto/subtle"
   "database/sql"
+  "errors"
+  "fmt"
+  "path/filepath"
+  "strings"
   "sync"
+  "time"
 
   _ "modernc.org/sqlite"
 )
@@ -12,18 +20,40 @@ import (
 //   Scan(dest ...any) error
 // }
 
+// errDBClosed is returned by some methods of DB when it has been closed
+var errDBClosed = errors.New("database is closed")
+
 type DB struct {
   *sql.DB
-  mu sync.RWMutex
+  mu     sync.RWMutex
+  hasFTS bool // messages_fts full-text index is available
 }
 
 func (db *DB) Open() error {
+  if err := db.Connect(); err != nil {
+    return err
+  }
+  // let a new database give the pages freed by removing messages back to the file
+  // system (see moveBodies.) This has no effect on an existing database.
+  if _, err := db.Exec(`PRAGMA auto_vacuum = INCREMENTAL`); err != nil {
+    dblog.Debugf("failed to enable incremental vacuum: %v", err)
+  }
+  // write-ahead logging lets other processes, like "smsg list", read the database while
+  // a scan writes to it. The journal mode is persistent, so this only changes it once.
+  if _, err := db.Exec(`PRAGMA journal_mode = WAL`); err != nil {
+    dblog.Debugf("failed to enable write-ahead logging: %v", err)
+  }
+  return db.init()
+}
+
+// Connect opens the database without creating or migrating the schema
+func (db *DB) Connect() error {
   conn, err := sql.Open("sqlite", DBFILE)
   if err != nil {
     return err
   }
   db.DB = conn
-  return db.init()
+  return nil
 }
 
 func (db *DB) init() error {
@@ -43,6 +73,337 @@ func (db *DB) init() error {
     name     text not null
   ) WITHOUT ROWID;
   `)
+  if err != nil {
+    return err
+  }
+  if err := db.migrate(); err != nil {
+    return err
+  }
+  return db.initFTS()
+}
+
+// initFTS creates the full-text search index if the sqlite library supports it.
+// The index is not part of the schema migrations since it is optional.
+func (db *DB) initFTS() error {
+  var n int
+  err := db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'messages_fts'`).Scan(&n)
+  if err != nil {
+    return err
+  }
+  if n == 0 {
+    _, err := db.Exec(`
+      CREATE VIRTUAL TABLE messages_fts USING fts5(id UNINDEXED, subject, body)
+    `)
+    if err != nil {
+      dblog.Debugf("full-text search unavailable: %v", err)
+      return nil
+    }
+    dblog.Debugf("building full-text search index")
+    _, err = db.Exec(`
+      INSERT INTO messages_fts (id, subject, body)
+      SELECT messages.id, subject, CAST(bodies.body AS TEXT)
+      FROM messages LEFT JOIN bodies ON bodies.id = messages.id
+    `)
+    if err != nil {
+      return err
+    }
+  }
+  db.hasFTS = true
+  return nil
+}
+
+// dbMigrations are applied in order to bring the schema up to date.
+// The index+1 of the last applied migration is stored as the database's user_version.
+// Never change or remove an existing entry; only append new ones.
+var dbMigrations = []string{
+  // 1: folders, source file paths and delivery state
+  `
+  ALTER TABLE messages ADD COLUMN folder text not null default 'inbox';
+  ALTER TABLE messages ADD COLUMN filepath text;
+  CREATE INDEX messages_folder ON messages (folder, id);
+  CREATE TABLE delivery (
+    id          blob not null primary key,
+    attempts    int not null default 0,
+    lastattempt int,
+    lasterror   text
+  ) WITHOUT ROWID;
+  `,
+  // 2: delivery retry scheduling
+  `
+  ALTER TABLE delivery ADD COLUMN nextattempt int;
+  ALTER TABLE delivery ADD COLUMN failed int not null default 0;
+  `,
+  // 3: contacts; message count, last message and pinned names of authors
+  `
+  ALTER TABLE authors ADD COLUMN msgcount int not null default 0;
+  ALTER TABLE authors ADD COLUMN lastid blob;
+  ALTER TABLE authors ADD COLUMN pinned int not null default 0;
+  UPDATE authors SET
+    msgcount = (SELECT count(*) FROM messages WHERE fromaddr = authors.address),
+    lastid = (SELECT max(id) FROM messages WHERE fromaddr = authors.address);
+  `,
+  // 4: trash; the time a message was moved to the trash
+  `
+  ALTER TABLE messages ADD COLUMN trashed int;
+  CREATE INDEX messages_trashed ON messages (trashed) WHERE trashed IS NOT NULL;
+  `,
+  // 5: API tokens of the server; only the SHA-256 of each token is stored
+  `
+  CREATE TABLE tokens (
+    id       integer primary key,
+    name     text not null default '',
+    hash     blob not null unique,
+    created  int not null,
+    lastused int
+  );
+  `,
+  // 6: owners of messages received by a server hosting several addresses, and the
+  // owner whose messages a token gives access to. A message can have several owners.
+  `
+  CREATE TABLE owners (
+    id    blob not null,
+    owner text not null,
+    PRIMARY KEY (id, owner)
+  ) WITHOUT ROWID;
+  CREATE INDEX owners_owner ON owners (owner, id);
+  ALTER TABLE tokens ADD COLUMN owner text not null default '';
+  `,
+  // 7: the id of the last message pulled from each peer (see pull)
+  `
+  CREATE TABLE pull_cursors (
+    peer   text not null primary key,
+    lastid blob not null
+  ) WITHOUT ROWID;
+  `,
+  // 8: the status of sent messages reported by receipts (see receiptStatus)
+  `
+  ALTER TABLE messages ADD COLUMN delivery_status int not null default 0;
+  `,
+  // 9: size and modification time (in nanoseconds) of indexed inbox files, so that
+  // unchanged files are not parsed again when scanning (see MessageFileScanner)
+  `
+  CREATE TABLE files (
+    path  text not null primary key,
+    size  int not null,
+    mtime int not null,
+    id    blob not null
+  ) WITHOUT ROWID;
+  `,
+  // 10: files which have the same message as another file, the canonical one, which is
+  // the message's file (see MessageFileScanner.found)
+  `
+  CREATE TABLE duplicates (
+    path      text not null primary key,
+    id        blob not null,
+    canonical text not null
+  ) WITHOUT ROWID;
+  CREATE INDEX duplicates_canonical ON duplicates (canonical);
+  `,
+  // 11: message bodies, in a table of their own so that the rows of messages, which are
+  // read by list, stay small. The bodies are moved by moveBodies; messages.body is left
+  // NULL.
+  `
+  CREATE TABLE IF NOT EXISTS bodies (
+    id   blob not null primary key,
+    body blob
+  );
+  `,
+  // 12: SHA-256 of the contents of indexed files, and when they were indexed (in
+  // nanoseconds), for when their size and modification time can't tell whether they
+  // have changed (see isLikelyUnchanged)
+  `
+  ALTER TABLE files ADD COLUMN hash blob;
+  ALTER TABLE files ADD COLUMN indexed int not null default 0;
+  `,
+  // 13: when messages expire (in seconds), from their "expires" section, or NULL (see
+  // purgeExpired)
+  `
+  ALTER TABLE messages ADD COLUMN expires int;
+  CREATE INDEX messages_expires ON messages (expires) WHERE expires IS NOT NULL;
+  `,
+  // 14: the priority of messages, from their "priority" section (see messagePriority)
+  `
+  ALTER TABLE messages ADD COLUMN priority int not null default 0;
+  CREATE INDEX messages_priority ON messages (priority, id);
+  `,
+  // 15: labels of messages, from their "tags" section (source 'sender') or added locally
+  // (source 'local'). Sender labels removed locally are kept with removed = 1, so that
+  // they are not added again when the message is indexed again.
+  `
+  CREATE TABLE labels (
+    id      blob not null,
+    label   text not null,
+    source  text not null,
+    removed int not null default 0,
+    PRIMARY KEY (id, label)
+  ) WITHOUT ROWID;
+  CREATE INDEX labels_label ON labels (label, id);
+  `,
+  // 16: the size of messages in bytes (see Message.Size), or NULL for messages indexed
+  // before this, until their files are indexed again
+  `
+  ALTER TABLE messages ADD COLUMN size int;
+  CREATE INDEX messages_size ON messages (size, id) WHERE size IS NOT NULL;
+  `,
+  // 17: the SHA-256 of the content of messages, all but their time (see
+  // Message.contentHash), or NULL for messages indexed before this, until their files are
+  // indexed again; and the id of the earliest of the copies of a message, for its other
+  // copies (see Config.Duplicates)
+  `
+  ALTER TABLE messages ADD COLUMN content_hash blob;
+  ALTER TABLE messages ADD COLUMN copy_of blob;
+  CREATE INDEX messages_content_hash ON messages (content_hash) WHERE content_hash IS NOT NULL;
+  CREATE INDEX messages_copy_of ON messages (copy_of) WHERE copy_of IS NOT NULL;
+  `,
+  // 18: the SHA-256 of messages as encoded, e.g. in their files, now that ids are
+  // computed from their canonical form (see canonical.go), or NULL for messages indexed
+  // before this; and the ids which messages not in canonical form had before, by which
+  // they can still be found (see Message.legacyId)
+  `
+  ALTER TABLE messages ADD COLUMN raw_hash blob;
+  CREATE TABLE legacy_ids (
+    id        blob not null primary key,
+    canonical blob not null
+  ) WITHOUT ROWID;
+  CREATE INDEX legacy_ids_canonical ON legacy_ids (canonical);
+  `,
+  // 19: the id of the message which a message is a reply to, from its "reply to"
+  // section, and the thread of replies which it's in (see selectThread), or NULL for
+  // messages which are not replies and those indexed before this, until their files are
+  // indexed again
+  `
+  ALTER TABLE messages ADD COLUMN in_reply_to blob;
+  ALTER TABLE messages ADD COLUMN thread blob;
+  CREATE INDEX messages_thread ON messages (thread, id) WHERE thread IS NOT NULL;
+  `,
+  // 20: the number of recipients of messages other than the first (toaddr), or NULL for
+  // messages indexed before this, until their files are indexed again
+  `
+  ALTER TABLE messages ADD COLUMN ncc int;
+  `,
+  // 21: the number of files of messages, or NULL for messages indexed before this, until
+  // their files are indexed again
+  `
+  ALTER TABLE messages ADD COLUMN nfiles int;
+  `,
+}
+
+// dbMigrationFuncs are run after the statements of the migration with the same index,
+// before it's recorded as applied, e.g. to move data in chunks, each in a transaction
+// of its own. They must resume where they left off when interrupted.
+var dbMigrationFuncs = map[int]func(db *DB) error{
+  10: (*DB).moveBodies,
+}
+
+// moveBodiesChunkSize is about how many bytes of message bodies moveBodies moves per
+// transaction
+const moveBodiesChunkSize = 8 << 20
+
+// SchemaVersion returns the schema version of the database
+func (db *DB) SchemaVersion() (version int, err error) {
+  err = db.QueryRow(`PRAGMA user_version`).Scan(&version)
+  return
+}
+
+func (db *DB) migrate() error {
+  version, err := db.SchemaVersion()
+  if err != nil {
+    return err
+  }
+  if version > len(dbMigrations) {
+    return errorf("database %q has schema version %d; this version of smsg supports %d",
+      DBFILE, version, len(dbMigrations))
+  }
+  for ; version < len(dbMigrations); version++ {
+    dblog.Debugf("migrating schema to version %d", version+1)
+    tx, err := db.Begin()
+    if err != nil {
+      return err
+    }
+    if _, err := tx.Exec(dbMigrations[version]); err != nil {
+      _ = tx.Rollback()
+      return errorf("schema migration %d: %v", version+1, err)
+    }
+    if fn := dbMigrationFuncs[version]; fn != nil {
+      if err := tx.Commit(); err != nil {
+        return err
+      }
+      if err := fn(db); err != nil {
+        return errorf("schema migration %d: %v", version+1, err)
+      }
+      if tx, err = db.Begin(); err != nil {
+        return err
+      }
+    }
+    // note: PRAGMA does not support parameters
+    if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+      _ = tx.Rollback()
+      return err
+    }
+    if err := tx.Commit(); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// moveBodies moves the bodies of messages to the bodies table (migration 11). It moves a
+// few at a time, so that the pages freed in messages are reused for bodies rather than
+// the database growing to hold all bodies twice.
+func (db *DB) moveBodies() error {
+  after := []byte{} // id of the last message moved
+  for {
+    rows, err := db.Query(`
+      SELECT id, length(body) FROM messages WHERE id > ? AND body IS NOT NULL
+      ORDER BY id LIMIT 256
+    `, after)
+    if err != nil {
+      return err
+    }
+    var ids [][]byte
+    size := 0
+    for size < moveBodiesChunkSize && rows.Next() {
+      var id []byte
+      var n int
+      if err := rows.Scan(&id, &n); err != nil {
+        rows.Close()
+        return err
+      }
+      ids = append(ids, id)
+      size += n
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+      return err
+    }
+    if len(ids) == 0 {
+      break
+    }
+    tx, err := db.Begin()
+    if err != nil {
+      return err
+    }
+    for _, id := range ids {
+      _, err := tx.Exec(`
+        INSERT OR REPLACE INTO bodies (id, body) SELECT id, body FROM messages WHERE id = ?
+      `, id)
+      if err == nil {
+        _, err = tx.Exec(`UPDATE messages SET body = NULL WHERE id = ?`, id)
+      }
+      if err != nil {
+        _ = tx.Rollback()
+        return err
+      }
+    }
+    if err := tx.Commit(); err != nil {
+      return err
+    }
+    dblog.Debugf("moved %d message bodies (%s)", len(ids), humanBytes(int64(size)))
+    after = ids[len(ids)-1]
+  }
+  // return the free pages to the file system, when the database was created with
+  // incremental vacuum (see Open)
+  _, err := db.Exec(`PRAGMA incremental_vacuum`)
   return err
 }
 
@@ -84,16 +445,22 @@ func (db *DB) InitMessageRow4(msg *Message, row *sql.Row) error {
   return nil
 }
 
-// id, subject, fromaddr, fromname
-func (db *DB) InitMessageRows4(msg *Message, rows *sql.Rows) error {
+// id, subject, fromaddr, fromname, toaddr, toname, ncc, folder, priority, size, nfiles
+func (db *DB) InitMessageRows11(msg *Message, rows *sql.Rows) error {
   // Note: "id := m.id[:0]; scan(&id)" doesn't work for some reason;
   // we get back a heap-allocated slice. I.e. the database driver does not
   // populate the m.id array. To avoid lots of little allocations we use
   // sql.RawBytes which gives back a borrowed reference to db-owned data.
   var id sql.RawBytes
-  if err := rows.Scan(&id, &msg.subject, &msg.from.address, &msg.from.name); err != nil {
+  var size, ncc, nfiles sql.NullInt64
+  err := rows.Scan(&id, &msg.subject, &msg.from.address, &msg.from.name,
+    &msg.to.address, &msg.to.name, &ncc, &msg.folder, &msg.priority, &size, &nfiles)
+  if err != nil {
     return err
   }
+  msg.size = size.Int64
+  msg.ncc = int(ncc.Int64) // NULL for messages indexed before it was stored
+  msg.nfiles = int(nfiles.Int64)
   if len(id) > 24 {
     return errorf("invalid id %q", id)
   }
@@ -102,36 +469,2185 @@ func (db *DB) InitMessageRows4(msg *Message, rows *sql.Rows) error {
   return nil
 }
 
-func (db *DB) PutMessage(msg *Message) error {
+// LoadMessageById loads a message's fields from the database. A message whose id has
+// changed since it was not in canonical form is found by its old id (see
+// Message.legacyId), and loaded with its current id.
+func (db *DB) LoadMessageById(id [24]byte, msg *Message) error {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  var canonical, body, rawHash []byte
+  var file sql.NullString
+  err := db.QueryRow(`
+    SELECT messages.id, subject, fromaddr, ifnull(authors.name, ''), toaddr, bodies.body,
+      folder, filepath, priority, ifnull(size, 0), raw_hash
+    FROM messages
+    LEFT JOIN authors ON authors.address = messages.fromaddr
+    LEFT JOIN bodies ON bodies.id = messages.id
+    WHERE messages.id = ifnull((SELECT canonical FROM legacy_ids WHERE id = ?1), ?1)
+  `, id[:]).Scan(
+    &canonical, &msg.subject, &msg.from.address, &msg.from.name, &msg.to.address, &body,
+    &msg.folder, &file, &msg.priority, &msg.size, &rawHash)
+  if err != nil {
+    if err == sql.ErrNoRows {
+      var m Message
+      m.id = id
+      return errorf("message %s %w", m.IdString(), ErrNotFound)
+    }
+    return err
+  }
+  copy(msg.id[:], canonical)
+  msg.SetTimeFromId()
+  msg.body = body
+  msg.file = file.String
+  copy(msg.rawHash[:], rawHash)
+  return nil
+}
+
+// HasMessage returns true if the database has a message with id, in any folder, or
+// which had id before it was in canonical form (see LoadMessageById)
+func (db *DB) HasMessage(id [24]byte) (bool, error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  var n int
+  err := db.QueryRow(`
+    SELECT 1 FROM messages
+    WHERE id = ifnull((SELECT canonical FROM legacy_ids WHERE id = ?1), ?1)
+  `, id[:]).Scan(&n)
+  if err == sql.ErrNoRows {
+    return false, nil
+  }
+  return err == nil, err
+}
+
+// MessageFolder returns the folder of the message with id, or "" if there's no such
+// message in the database
+func (db *DB) MessageFolder(id [24]byte) (string, error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  var folder string
+  err := db.QueryRow(`SELECT folder FROM messages WHERE id = ?`, id[:]).Scan(&folder)
+  if err == sql.ErrNoRows {
+    return "", nil
+  }
+  return folder, err
+}
+
+// loadMessage loads a message by its id string.
+// The message is parsed from its file when available, otherwise it's loaded from the
+// database, which doesn't have all of the message's data (e.g. files) and msg.file is "".
+func loadMessage(idstr string) (*Message, error) {
+  id, err := decodeId(idstr)
+  if err != nil {
+    return nil, errorf("%v: message %w", err, ErrNotFound)
+  }
+  msg := &Message{}
+  if err := db.LoadMessageById(id, msg); err != nil {
+    return nil, err
+  }
+  if msg.file == "" {
+    return msg, nil
+  }
+  msg2 := &Message{folder: msg.folder, file: msg.file}
+  if err := msg2.ParseFile(filepath.Join(MSGDIR, msg.file)); err != nil {
+    metricParseFailures.Inc()
+    warnlog("%v (using data from the database)", err)
+    msg.file = ""
+    return msg, nil
+  }
+  if msg.rawHash != ([32]byte{}) && msg2.rawHash != msg.rawHash && msg2.id == msg.id {
+    // note: the id is that of the canonical form of the message, which changes
+    // like this don't change, e.g. to line endings
+    warnlog("%s has been modified since it was indexed, but not its message", msg.file)
+  }
+  return msg2, nil
+}
+
+// MarkRead sets the read state of a message
+func (db *DB) MarkRead(id []byte, isread bool) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  _, err := db.Exec(`UPDATE messages SET isread = ? WHERE id = ?`, isread, id)
+  return err
+}
+
+// sizeColumn returns the value of messages.size for msg
+func sizeColumn(msg *Message) interface{} {
+  if msg.size == 0 {
+    return nil
+  }
+  return msg.size
+}
+
+// expiresColumn returns the value of messages.expires for msg
+func expiresColumn(msg *Message) interface{} {
+  if msg.expires.IsZero() {
+    return nil
+  }
+  return msg.expires.Unix()
+}
+
+// Copies of a message are messages in the same folder with the same content hash, sender
+// and first recipient; other recipients are part of the content. They are found when
+// added and recorded as copies of the earliest one (messages.copy_of), unless
+// Config.Duplicates says to skip them. These queries are used by PutMessage and
+// putIndexedMessages.
+const (
+  // selectCopyOf selects what a message is a copy of, if any: the earliest copy
+  selectCopyOf = `SELECT ifnull(copy_of, id) FROM messages
+    WHERE content_hash = ? AND fromaddr = ? AND toaddr = ? AND folder = ? AND id != ?
+    ORDER BY id LIMIT 1`
+  // relinkCopies records ?1, a message which is earlier than the copy ?2, as the earliest
+  // copy of the others
+  relinkCopies = `UPDATE messages SET copy_of = ?1 WHERE id = ?2 OR copy_of = ?2`
+  // backfillMessage sets the columns which messages indexed before they were added lack
+  backfillMessage = `UPDATE messages SET size = ifnull(size, ?),
+    content_hash = ifnull(content_hash, ?), raw_hash = ifnull(raw_hash, ?),
+    in_reply_to = ifnull(in_reply_to, ?), thread = ifnull(thread, ?), ncc = ifnull(ncc, ?),
+    nfiles = ifnull(nfiles, ?)
+    WHERE id = ?`
+  // insertLegacyId records the id a message had before it was in canonical form
+  insertLegacyId = `INSERT OR IGNORE INTO legacy_ids (id, canonical) VALUES (?, ?)`
+)
+
+func copyOfArgs(msg *Message, folder string) []interface{} {
+  return []interface{}{
+    msg.contentHash[:], msg.from.address, msg.to.address, folder, msg.id[:]}
+}
+
+// copyOf decides how msg is added given the result of selectCopyOf: returns the value of
+// its messages.copy_of, whether the copies are to be relinked to it since it's the
+// earliest (see relinkCopies), or whether it's not to be added at all.
+func copyOf(msg *Message, row *sql.Row) (copyof []byte, relink []byte, skip bool, err error) {
+  if msg.contentHash == ([32]byte{}) {
+    return nil, nil, false, nil
+  }
+  if err = row.Scan(&copyof); err != nil {
+    if err == sql.ErrNoRows {
+      err = nil
+    }
+    return nil, nil, false, err
+  }
+  if config.Duplicates == duplicatesSkip {
+    return nil, nil, true, nil
+  }
+  if bytes.Compare(msg.id[:], copyof) < 0 {
+    return nil, copyof, false, nil
+  }
+  return copyof, nil, false, nil
+}
+
+// contentHashColumn returns the value of messages.content_hash for msg
+func contentHashColumn(msg *Message) interface{} {
+  if msg.contentHash == ([32]byte{}) {
+    return nil
+  }
+  return msg.contentHash[:]
+}
+
+// rawHashColumn returns the value of messages.raw_hash for msg
+func rawHashColumn(msg *Message) interface{} {
+  if msg.rawHash == ([32]byte{}) {
+    return nil
+  }
+  return msg.rawHash[:]
+}
+
+// A thread is a message which is not a reply and the replies to it, and to those, and so
+// on. Its id is that of its first message, or of the message which its first replies are
+// replies to when that's not in the database, e.g. since it was deleted. Messages which
+// are not replies are in a thread of their own, so messages.thread is NULL for them.
+// These queries are used by PutMessage and putIndexedMessages.
+const (
+  // selectThread selects the thread of the message which a message is a reply to
+  selectThread = `SELECT ifnull(thread, id) FROM messages WHERE id = ?`
+  // rethread moves the replies in the thread ?2, a message added after them, to the
+  // thread ?1 which that message is in
+  rethread = `UPDATE messages SET thread = ?1 WHERE thread = ?2`
+)
+
+// threadOf returns the value of messages.thread for msg given the result of selectThread
+func threadOf(msg *Message, row *sql.Row) ([]byte, error) {
+  if msg.inReplyTo == ([24]byte{}) {
+    return nil, nil
+  }
+  var thread []byte
+  if err := row.Scan(&thread); err != nil {
+    if err != sql.ErrNoRows {
+      return nil, err
+    }
+    thread = msg.inReplyTo[:] // not in the database, at least not yet
+  }
+  return thread, nil
+}
+
+// inReplyToColumn returns the value of messages.in_reply_to for msg
+func inReplyToColumn(msg *Message) interface{} {
+  if msg.inReplyTo == ([24]byte{}) {
+    return nil
+  }
+  return msg.inReplyTo[:]
+}
+
+// hasLegacyId returns true if msg had another id before ids were computed from the
+// canonical form of messages
+func hasLegacyId(msg *Message) bool {
+  return msg.rawHash != ([32]byte{}) && msg.legacyId() != msg.id
+}
+
+// PutMessage adds msg to the database, unless it's already there or it's a copy of
+// another message which is to be skipped (see Config.Duplicates).
+// Returns true if it was added.
+func (db *DB) PutMessage(msg *Message) (added bool, err error) {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  defer metricDBWriteSeconds.ObserveSince(time.Now())
+
+  tx, err := db.Begin()
+  if err != nil {
+    return false, err
+  }
+
+  folder := msg.folder
+  if folder == "" {
+    folder = "inbox"
+  }
+
+  copyof, relink, skip, err := copyOf(
+    msg, tx.QueryRow(selectCopyOf, copyOfArgs(msg, folder)...))
+  if err != nil {
+    _ = tx.Rollback()
+    return false, err
+  }
+  thread, err := threadOf(msg, tx.QueryRow(selectThread, msg.inReplyTo[:]))
+  if err != nil {
+    _ = tx.Rollback()
+    return false, err
+  }
+  var inserted int64
+  if !skip {
+    res, err := tx.Exec(`
+      INSERT OR IGNORE into messages
+      (id, subject, fromaddr, toaddr, folder, filepath, expires, priority, size,
+        content_hash, copy_of, raw_hash, in_reply_to, thread, ncc, nfiles)
+      VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, msg.id[:], msg.subject, msg.from.address, msg.to.address, folder, msg.file,
+      expiresColumn(msg), msg.priority, sizeColumn(msg), contentHashColumn(msg), copyof,
+      rawHashColumn(msg), inReplyToColumn(msg), thread, len(msg.cc), len(msg.files))
+    if err != nil {
+      _ = tx.Rollback()
+      return false, err
+    }
+    inserted, _ = res.RowsAffected()
+  }
+
+  // only store the body of and index messages which were not already in the database
+  if inserted == 0 {
+    // note: messages indexed before sizes, content hashes and threads were get them when
+    // indexed again
+    _, err = tx.Exec(backfillMessage, sizeColumn(msg), contentHashColumn(msg),
+      rawHashColumn(msg), inReplyToColumn(msg), thread, len(msg.cc), len(msg.files),
+      msg.id[:])
+    if err != nil {
+      _ = tx.Rollback()
+      return false, err
+    }
+  }
+  if thread != nil && !skip {
+    if _, err = tx.Exec(rethread, thread, msg.id[:]); err != nil {
+      _ = tx.Rollback()
+      return false, err
+    }
+  }
+  if inserted > 0 && hasLegacyId(msg) {
+    legacy := msg.legacyId()
+    if _, err = tx.Exec(insertLegacyId, legacy[:], msg.id[:]); err != nil {
+      _ = tx.Rollback()
+      return false, err
+    }
+  }
+  if inserted > 0 && relink != nil {
+    if _, err = tx.Exec(relinkCopies, msg.id[:], relink); err != nil {
+      _ = tx.Rollback()
+      return false, err
+    }
+  }
+  if inserted > 0 {
+    _, err = tx.Exec(`INSERT OR REPLACE INTO bodies (id, body) VALUES(?, ?)`,
+      msg.id[:], msg.body)
+    if err != nil {
+      _ = tx.Rollback()
+      return false, err
+    }
+  }
+  if inserted > 0 && db.hasFTS {
+    _, err = tx.Exec(`
+      INSERT INTO messages_fts (id, subject, body) VALUES(?, ?, ?)
+    `, msg.id[:], msg.subject, string(msg.body))
+    if err != nil {
+      _ = tx.Rollback()
+      return false, err
+    }
+  }
+  if inserted > 0 {
+    for _, tag := range msg.tags {
+      _, err = tx.Exec(`
+        INSERT OR IGNORE INTO labels (id, label, source) VALUES(?, ?, ?)
+      `, msg.id[:], tag, labelSourceSender)
+      if err != nil {
+        _ = tx.Rollback()
+        return false, err
+      }
+    }
+  }
+
+  // note: the name of an author is updated with every message, unless pinned
+  _, err = tx.Exec(`
+    INSERT INTO authors (address, name, msgcount, lastid) VALUES(?1, ?2,
+      (SELECT count(*) FROM messages WHERE fromaddr = ?1),
+      (SELECT max(id) FROM messages WHERE fromaddr = ?1))
+    ON CONFLICT (address) DO UPDATE SET
+      name = CASE WHEN pinned OR excluded.name = '' THEN name ELSE excluded.name END,
+      msgcount = msgcount + ?3,
+      lastid = CASE WHEN ?3 = 0 OR lastid > ?4 THEN lastid ELSE ?4 END
+  `, msg.from.address, msg.from.name, inserted, msg.id[:])
+  if err != nil {
+    _ = tx.Rollback()
+    return false, err
+  }
+
+  if err := tx.Commit(); err != nil {
+    return false, err
+  }
+  if inserted > 0 {
+    metricMessagesIndexed.Inc()
+  }
+  return inserted > 0, nil
+}
+
+// IndexedMessage is a message read from its file by a scan, to be added to the database
+// with PutIndexedMessages
+type IndexedMessage struct {
+  msg   *Message
+  owner string   // user whose inbox the file is in, if any (see inboxOwner)
+  size  int64    // of the file
+  mtime time.Time
+  hash  [32]byte // of the contents of the file (see fileFingerprint)
+
+  // set by PutIndexedMessages
+  added bool     // the message was not already in the database
+  prev  [24]byte // id of the message which the file had before, if any (see PutFile)
+}
+
+// PutIndexedMessages adds messages and the state of their files to the database, in one
+// transaction, which is much faster than calling PutMessage, AddMessageOwner and PutFile
+// for each of them. If it fails, none of the messages have been added.
+func (db *DB) PutIndexedMessages(msgs []*IndexedMessage) error {
   db.mu.Lock()
   defer db.mu.Unlock()
+  if db.DB == nil {
+    return errDBClosed
+  }
+  defer metricDBWriteSeconds.ObserveSince(time.Now())
 
   tx, err := db.Begin()
   if err != nil {
     return err
   }
+  if err := putIndexedMessages(tx, msgs, db.hasFTS); err != nil {
+    _ = tx.Rollback()
+    return err
+  }
+  if err := tx.Commit(); err != nil {
+    return err
+  }
+  for _, m := range msgs {
+    if m.added {
+      metricMessagesIndexed.Inc()
+    }
+  }
+  return nil
+}
 
-  _, err = db.Exec(`
-    INSERT OR IGNORE into messages
-    (id, subject, fromaddr, toaddr, body) VALUES(?, ?, ?, ?, ?)
-  `, msg.id[:], msg.subject, msg.from.address, msg.to.address, msg.body)
+func putIndexedMessages(tx *sql.Tx, msgs []*IndexedMessage, hasFTS bool) error {
+  // note: the statements are the same as those of PutMessage, AddMessageOwner and PutFile
+  var stmts [14]*sql.Stmt
+  for i, query := range []string{
+    `INSERT OR IGNORE into messages
+      (id, subject, fromaddr, toaddr, folder, filepath, expires, priority, size,
+        content_hash, copy_of, raw_hash, in_reply_to, thread, ncc, nfiles)
+      VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+    `INSERT INTO messages_fts (id, subject, body) VALUES(?, ?, ?)`,
+    `INSERT INTO authors (address, name, msgcount, lastid) VALUES(?1, ?2,
+      (SELECT count(*) FROM messages WHERE fromaddr = ?1),
+      (SELECT max(id) FROM messages WHERE fromaddr = ?1))
+    ON CONFLICT (address) DO UPDATE SET
+      name = CASE WHEN pinned OR excluded.name = '' THEN name ELSE excluded.name END,
+      msgcount = msgcount + ?3,
+      lastid = CASE WHEN ?3 = 0 OR lastid > ?4 THEN lastid ELSE ?4 END`,
+    `INSERT OR IGNORE INTO owners (id, owner) VALUES (?, ?)`,
+    `SELECT id FROM files WHERE path = ?`,
+    `INSERT OR REPLACE INTO files (path, size, mtime, id, hash, indexed)
+      VALUES (?, ?, ?, ?, ?, ?)`,
+    `INSERT OR REPLACE INTO bodies (id, body) VALUES(?, ?)`,
+    `INSERT OR IGNORE INTO labels (id, label, source) VALUES(?, ?, ?)`,
+    backfillMessage,
+    selectCopyOf,
+    relinkCopies,
+    insertLegacyId,
+    selectThread,
+    rethread,
+  } {
+    if i == 1 && !hasFTS {
+      continue
+    }
+    stmt, err := tx.Prepare(query)
+    if err != nil {
+      return err
+    }
+    defer stmt.Close()
+    stmts[i] = stmt
+  }
+  insertMsg, insertFTS, putAuthor, insertOwner, selectFile, putFile, putBody, insertLabel :=
+    stmts[0], stmts[1], stmts[2], stmts[3], stmts[4], stmts[5], stmts[6], stmts[7]
+  backfill, selectCopy, relink, insertLegacy := stmts[8], stmts[9], stmts[10], stmts[11]
+  selectThr, rethr := stmts[12], stmts[13]
+
+  for _, m := range msgs {
+    msg := m.msg
+    folder := msg.folder
+    if folder == "" {
+      folder = "inbox"
+    }
+    copyof, relinkTo, skip, err := copyOf(
+      msg, selectCopy.QueryRow(copyOfArgs(msg, folder)...))
+    if err != nil {
+      return err
+    }
+    thread, err := threadOf(msg, selectThr.QueryRow(msg.inReplyTo[:]))
+    if err != nil {
+      return err
+    }
+    var inserted int64
+    if !skip {
+      res, err := insertMsg.Exec(
+        msg.id[:], msg.subject, msg.from.address, msg.to.address, folder, msg.file,
+        expiresColumn(msg), msg.priority, sizeColumn(msg), contentHashColumn(msg), copyof,
+        rawHashColumn(msg), inReplyToColumn(msg), thread, len(msg.cc), len(msg.files))
+      if err != nil {
+        return err
+      }
+      inserted, _ = res.RowsAffected()
+    }
+    m.added = inserted > 0
+    if !m.added {
+      _, err := backfill.Exec(sizeColumn(msg), contentHashColumn(msg), rawHashColumn(msg),
+        inReplyToColumn(msg), thread, len(msg.cc), len(msg.files), msg.id[:])
+      if err != nil {
+        return err
+      }
+    }
+    if thread != nil && !skip {
+      if _, err := rethr.Exec(thread, msg.id[:]); err != nil {
+        return err
+      }
+    }
+    if m.added && hasLegacyId(msg) {
+      legacy := msg.legacyId()
+      if _, err := insertLegacy.Exec(legacy[:], msg.id[:]); err != nil {
+        return err
+      }
+    }
+    if m.added && relinkTo != nil {
+      if _, err := relink.Exec(msg.id[:], relinkTo); err != nil {
+        return err
+      }
+    }
+    if m.added {
+      if _, err := putBody.Exec(msg.id[:], msg.body); err != nil {
+        return err
+      }
+      for _, tag := range msg.tags {
+        if _, err := insertLabel.Exec(msg.id[:], tag, labelSourceSender); err != nil {
+          return err
+        }
+      }
+    }
+    if m.added && insertFTS != nil {
+      if _, err := insertFTS.Exec(msg.id[:], msg.subject, string(msg.body)); err != nil {
+        return err
+      }
+    }
+    _, err = putAuthor.Exec(msg.from.address, msg.from.name, inserted, msg.id[:])
+    if err != nil {
+      return err
+    }
+    if m.owner != "" {
+      if _, err := insertOwner.Exec(msg.id[:], m.owner); err != nil {
+        return err
+      }
+    }
+    var previd []byte
+    err = selectFile.QueryRow(msg.file).Scan(&previd)
+    if err != nil && err != sql.ErrNoRows {
+      return err
+    }
+    m.prev = [24]byte{}
+    copy(m.prev[:], previd)
+    _, err = putFile.Exec(
+      msg.file, m.size, m.mtime.UnixNano(), msg.id[:], m.hash[:], time.Now().UnixNano())
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// MoveMessage updates the folder and file of a message currently in fromFolder
+func (db *DB) MoveMessage(id []byte, fromFolder, toFolder, file string) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  _, err := db.Exec(`
+    UPDATE messages SET folder = ?, filepath = ? WHERE id = ? AND folder = ?
+  `, toFolder, file, id, fromFolder)
+  return err
+}
+
+// TrashMessage moves a message currently in fromFolder to the trash folder.
+// file is the new path of its file.
+func (db *DB) TrashMessage(id []byte, fromFolder, file string, t time.Time) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  res, err := db.Exec(`
+    UPDATE messages SET folder = 'trash', filepath = ?, trashed = ? WHERE id = ? AND folder = ?
+  `, file, t.Unix(), id, fromFolder)
   if err != nil {
     return err
   }
+  if n, _ := res.RowsAffected(); n == 0 {
+    return errorf("message is not in %s", fromFolder)
+  }
+  return nil
+}
 
-  if msg.from.name != "" {
-    _, err = db.Exec(`
-      INSERT OR REPLACE into authors (address, name) VALUES(?, ?)
-    `, msg.from.address, msg.from.name)
-  } else {
-    _, err = db.Exec(`
-      INSERT OR IGNORE into authors (address, name) VALUES(?, '')
-    `, msg.from.address)
+// TrashedMessage is a message in the trash folder
+type TrashedMessage struct {
+  id      [24]byte
+  file    string // relative to MSGDIR; empty if the message has no file
+  trashed time.Time
+}
+
+// ListTrash calls fn for each message which was moved to the trash before t, oldest first.
+// tm is reused between calls. fn must not call other DB methods.
+func (db *DB) ListTrash(before time.Time, fn func(tm *TrashedMessage) error) error {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  if db.DB == nil {
+    return errDBClosed // e.g. when purging in the background during shutdown
   }
+  rows, err := db.Query(`
+    SELECT id, ifnull(filepath, ''), trashed FROM messages
+    WHERE folder = 'trash' AND trashed <= ?
+    ORDER BY trashed
+  `, before.Unix())
+  if err != nil {
+    return err
+  }
+  defer rows.Close()
+  var tm TrashedMessage
+  for rows.Next() {
+    var id sql.RawBytes
+    var trashed int64
+    if err := rows.Scan(&id, &tm.file, &trashed); err != nil {
+      return err
+    }
+    copy(tm.id[:], id)
+    tm.trashed = time.Unix(trashed, 0)
+    if err := fn(&tm); err != nil {
+      return err
+    }
+  }
+  return rows.Err()
+}
+
+// ExpiredMessage is a message which has expired (see Message.expires)
+type ExpiredMessage struct {
+  id      [24]byte
+  file    string // relative to MSGDIR; empty if the message has no file
+  expires time.Time
+}
+
+// ListExpired calls fn for each message which expired before t, in any folder, oldest
+// first. Messages without an expiry time are never listed. em is reused between calls.
+// fn must not call other DB methods.
+func (db *DB) ListExpired(before time.Time, fn func(em *ExpiredMessage) error) error {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  if db.DB == nil {
+    return errDBClosed // e.g. when purging in the background during shutdown
+  }
+  rows, err := db.Query(`
+    SELECT id, ifnull(filepath, ''), expires FROM messages
+    WHERE expires IS NOT NULL AND expires <= ?
+    ORDER BY expires
+  `, before.Unix())
   if err != nil {
-    _ = tx.Rollback()
     return err
   }
+  defer rows.Close()
+  var em ExpiredMessage
+  for rows.Next() {
+    var id sql.RawBytes
+    var expires int64
+    if err := rows.Scan(&id, &em.file, &expires); err != nil {
+      return err
+    }
+    copy(em.id[:], id)
+    em.expires = time.Unix(expires, 0)
+    if err := fn(&em); err != nil {
+      return err
+    }
+  }
+  return rows.Err()
+}
 
+// DeleteMessages permanently removes messages from the database, in one transaction,
+// including their full-text index entries and delivery state.
+// Message files are not removed.
+func (db *DB) DeleteMessages(ids [][24]byte) error {
+  if len(ids) == 0 {
+    return nil
+  }
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  if db.DB == nil {
+    return errDBClosed
+  }
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  for _, id := range ids {
+    var from string
+    err := tx.QueryRow(`SELECT fromaddr FROM messages WHERE id = ?`, id[:]).Scan(&from)
+    if err == sql.ErrNoRows {
+      continue
+    }
+    if err == nil {
+      _, err = tx.Exec(`DELETE FROM messages WHERE id = ?`, id[:])
+    }
+    if err == nil {
+      _, err = tx.Exec(`DELETE FROM bodies WHERE id = ?`, id[:])
+    }
+    if err == nil {
+      _, err = tx.Exec(`DELETE FROM delivery WHERE id = ?`, id[:])
+    }
+    if err == nil {
+      _, err = tx.Exec(`DELETE FROM owners WHERE id = ?`, id[:])
+    }
+    if err == nil {
+      _, err = tx.Exec(`DELETE FROM labels WHERE id = ?`, id[:])
+    }
+    if err == nil {
+      _, err = tx.Exec(`DELETE FROM legacy_ids WHERE canonical = ?`, id[:])
+    }
+    if err == nil {
+      _, err = tx.Exec(`
+        UPDATE authors SET
+          msgcount = max(msgcount - 1, 0),
+          lastid = (SELECT max(id) FROM messages WHERE fromaddr = ?1)
+        WHERE address = ?1
+      `, from)
+    }
+    if err != nil {
+      _ = tx.Rollback()
+      return err
+    }
+  }
+  if db.hasFTS {
+    // note: id is not indexed in messages_fts, so delete all in one statement (one scan)
+    args := make([]interface{}, len(ids))
+    for i := range ids {
+      args[i] = ids[i][:]
+    }
+    _, err := tx.Exec(`DELETE FROM messages_fts WHERE id IN (?`+
+      strings.Repeat(", ?", len(ids)-1)+`)`, args...)
+    if err != nil {
+      _ = tx.Rollback()
+      return err
+    }
+  }
   return tx.Commit()
 }
+
+// DeleteMessagesWithFile removes the messages in folder whose file is file (relative to
+// MSGDIR) from the database, like DeleteMessages, and returns how many were removed
+func (db *DB) DeleteMessagesWithFile(folder, file string) (int, error) {
+  db.mu.RLock()
+  if db.DB == nil {
+    db.mu.RUnlock()
+    return 0, errDBClosed
+  }
+  rows, err := db.Query(`SELECT id FROM messages WHERE folder = ? AND filepath = ?`,
+    folder, file)
+  if err != nil {
+    db.mu.RUnlock()
+    return 0, err
+  }
+  var ids [][24]byte
+  for rows.Next() {
+    var id sql.RawBytes
+    if err := rows.Scan(&id); err != nil {
+      break
+    }
+    var id24 [24]byte
+    copy(id24[:], id)
+    ids = append(ids, id24)
+  }
+  rows.Close()
+  err = rows.Err()
+  db.mu.RUnlock()
+  if err != nil {
+    return 0, err
+  }
+  if err := db.DeleteFiles([]string{file}); err != nil {
+    return 0, err
+  }
+  return len(ids), db.DeleteMessages(ids)
+}
+
+// MessageFiles returns the file paths of the messages in folder, by message id.
+// Messages without a file are not included.
+func (db *DB) MessageFiles(folder string) (map[[24]byte]string, error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  if db.DB == nil {
+    return nil, errDBClosed
+  }
+  rows, err := db.Query(`
+    SELECT id, filepath FROM messages WHERE folder = ? AND filepath IS NOT NULL AND filepath != ''
+  `, folder)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  files := map[[24]byte]string{}
+  for rows.Next() {
+    var id sql.RawBytes
+    var file string
+    if err := rows.Scan(&id, &file); err != nil {
+      return nil, err
+    }
+    var key [24]byte
+    copy(key[:], id)
+    files[key] = file
+  }
+  return files, rows.Err()
+}
+
+// ReplaceMessage removes message old from the database if its file is file, which now
+// has message new, after giving new the read state and local labels of old
+func (db *DB) ReplaceMessage(old, new [24]byte, file string) error {
+  db.mu.Lock()
+  if db.DB == nil {
+    db.mu.Unlock()
+    return errDBClosed
+  }
+  res, err := db.Exec(`
+    UPDATE messages SET isread = (SELECT isread FROM messages WHERE id = ?1)
+    WHERE id = ?2 AND EXISTS (SELECT 1 FROM messages WHERE id = ?1 AND filepath = ?3)
+  `, old[:], new[:], file)
+  var n int64
+  if err == nil {
+    if n, _ = res.RowsAffected(); n > 0 {
+      // note: sender labels of new come from its own "tags" section
+      _, err = db.Exec(`
+        INSERT OR REPLACE INTO labels (id, label, source, removed)
+        SELECT ?2, label, source, removed FROM labels
+        WHERE id = ?1 AND (source = ?3 OR removed)
+      `, old[:], new[:], labelSourceLocal)
+    }
+    if err == nil && n > 0 {
+      // note: replies to old move to the thread of new, which it's now the message of
+      _, err = db.Exec(`
+        UPDATE messages SET thread = (SELECT ifnull(thread, id) FROM messages WHERE id = ?2)
+        WHERE thread = ?1
+      `, old[:], new[:])
+    }
+  }
+  db.mu.Unlock()
+  if err != nil {
+    return err
+  }
+  if n == 0 {
+    return nil // old has moved elsewhere, e.g. to the archive
+  }
+  return db.DeleteMessages([][24]byte{old})
+}
+
+// IndexedFile is the state of a message file when it was indexed
+type IndexedFile struct {
+  size    int64
+  mtime   int64 // in nanoseconds
+  id      [24]byte
+  hash    [32]byte // of the contents of the file (see fileFingerprint); zero if unknown
+  indexed int64    // when the file was indexed, in nanoseconds
+  current bool     // the message is in the database, in the folder of the file
+}
+
+// IndexedFiles returns the state of the indexed files in folder, by path relative to
+// MSGDIR
+func (db *DB) IndexedFiles(folder string) (map[string]IndexedFile, error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  if db.DB == nil {
+    return nil, errDBClosed
+  }
+  // note: a join with messages is about ten times slower than this, which only reads
+  // the messages_folder index
+  rows, err := db.Query(`
+    SELECT path, size, mtime, id, hash, indexed,
+           id IN (SELECT id FROM messages WHERE folder = ?1)
+    FROM files WHERE path GLOB ?2
+  `, folder, folder+string(filepath.Separator)+"*")
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  files := map[string]IndexedFile{}
+  for rows.Next() {
+    var path string
+    var f IndexedFile
+    var id, hash sql.RawBytes
+    err := rows.Scan(&path, &f.size, &f.mtime, &id, &hash, &f.indexed, &f.current)
+    if err != nil {
+      return nil, err
+    }
+    copy(f.id[:], id)
+    copy(f.hash[:], hash)
+    files[path] = f
+  }
+  return files, rows.Err()
+}
+
+// IndexedFile returns the state of the indexed file at path, relative to MSGDIR, or false
+// if it's not indexed
+func (db *DB) IndexedFile(path string) (f IndexedFile, ok bool, err error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  if db.DB == nil {
+    return f, false, errDBClosed
+  }
+  folder := path
+  if i := strings.IndexByte(path, filepath.Separator); i != -1 {
+    folder = path[:i]
+  }
+  var id, hash []byte
+  err = db.QueryRow(`
+    SELECT size, mtime, id, hash, indexed,
+           EXISTS (SELECT 1 FROM messages WHERE messages.id = files.id AND folder = ?)
+    FROM files WHERE path = ?
+  `, folder, path).Scan(&f.size, &f.mtime, &id, &hash, &f.indexed, &f.current)
+  if err == sql.ErrNoRows {
+    return f, false, nil
+  } else if err != nil {
+    return f, false, err
+  }
+  copy(f.id[:], id)
+  copy(f.hash[:], hash)
+  return f, true, nil
+}
+
+// TouchFile records that the indexed file at path has been found to be unchanged,
+// though its modification time is now mtime (see isLikelyUnchanged)
+func (db *DB) TouchFile(path string, mtime time.Time) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  if db.DB == nil {
+    return errDBClosed
+  }
+  _, err := db.Exec(`UPDATE files SET mtime = ?, indexed = ? WHERE path = ?`,
+    mtime.UnixNano(), time.Now().UnixNano(), path)
+  return err
+}
+
+// PutFile records the state of an indexed file with message id, and the fingerprint of
+// its contents (see fileFingerprint.)
+// Returns the id of the message the file had before, or zero if it was not indexed.
+func (db *DB) PutFile(path string, size int64, mtime time.Time, id [24]byte, hash [32]byte) (
+  prev [24]byte, err error,
+) {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  if db.DB == nil {
+    return prev, errDBClosed
+  }
+  var previd []byte
+  err = db.QueryRow(`SELECT id FROM files WHERE path = ?`, path).Scan(&previd)
+  if err != nil && err != sql.ErrNoRows {
+    return prev, err
+  }
+  copy(prev[:], previd)
+  _, err = db.Exec(`
+    INSERT OR REPLACE INTO files (path, size, mtime, id, hash, indexed) VALUES (?, ?, ?, ?, ?, ?)
+  `, path, size, mtime.UnixNano(), id[:], hash[:], time.Now().UnixNano())
+  return prev, err
+}
+
+// DeleteFiles removes the recorded state of files, e.g. which no longer exist
+func (db *DB) DeleteFiles(paths []string) error {
+  if len(paths) == 0 {
+    return nil
+  }
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  if db.DB == nil {
+    return errDBClosed
+  }
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  for _, path := range paths {
+    if _, err := tx.Exec(`DELETE FROM files WHERE path = ?`, path); err != nil {
+      _ = tx.Rollback()
+      return err
+    }
+  }
+  return tx.Commit()
+}
+
+// restoreQueries copy state which can't be derived from message files from another
+// database, attached as "old", by reindex (see RestoreFrom)
+var restoreQueries = []struct{ what, query string }{
+  {"state of messages (read, trashed, receipts)", `
+    UPDATE messages SET isread = o.isread, trashed = o.trashed,
+      delivery_status = o.delivery_status
+    FROM old.messages o WHERE o.id = messages.id`},
+  {"delivery states", `
+    INSERT OR IGNORE INTO delivery (id, attempts, lastattempt, lasterror, nextattempt, failed)
+    SELECT id, attempts, lastattempt, lasterror, nextattempt, failed FROM old.delivery
+    WHERE id IN (SELECT id FROM messages WHERE folder = 'outbox')`},
+  {"pinned contact names", `
+    UPDATE authors SET name = o.name, pinned = 1
+    FROM old.authors o WHERE o.address = authors.address AND o.pinned`},
+  {"message owners", `
+    INSERT OR IGNORE INTO owners (id, owner)
+    SELECT id, owner FROM old.owners WHERE id IN (SELECT id FROM messages)`},
+  {"API tokens", `
+    INSERT OR IGNORE INTO tokens (id, name, hash, created, lastused, owner)
+    SELECT id, name, hash, created, lastused, owner FROM old.tokens`},
+  {"labels", `
+    INSERT OR REPLACE INTO labels (id, label, source, removed)
+    SELECT id, label, source, removed FROM old.labels WHERE id IN (SELECT id FROM messages)`},
+  // note: messages not in canonical form which were indexed with their legacy ids (see
+  // Message.legacyId) now have other ids, recorded in legacy_ids as they were indexed
+  {"state of messages with legacy ids", `
+    UPDATE messages SET isread = o.isread, trashed = o.trashed,
+      delivery_status = o.delivery_status
+    FROM old.messages o JOIN legacy_ids l ON l.id = o.id WHERE l.canonical = messages.id`},
+  {"labels of messages with legacy ids", `
+    INSERT OR REPLACE INTO labels (id, label, source, removed)
+    SELECT l.canonical, label, source, removed FROM old.labels
+    JOIN legacy_ids l ON l.id = old.labels.id`},
+  {"pull cursors", `
+    INSERT OR IGNORE INTO pull_cursors (peer, lastid) SELECT peer, lastid FROM old.pull_cursors`},
+}
+
+// RestoreFrom copies state which can't be derived from message files, like which
+// messages have been read, from the database file at path, for reindex. Each kind of
+// state is restored separately, so that what can be read from a damaged database is.
+// Returns the number of rows restored of each kind (see restoreQueries) and the errors
+// of those which failed.
+func (db *DB) RestoreFrom(path string) (counts []int64, errs []error) {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  counts = make([]int64, len(restoreQueries))
+  errs = make([]error, len(restoreQueries))
+  // note: attached databases are per connection
+  ctx := context.Background()
+  conn, err := db.Conn(ctx)
+  if err == nil {
+    defer conn.Close()
+    _, err = conn.ExecContext(ctx, `ATTACH DATABASE ? AS old`, path)
+  }
+  if err != nil {
+    for i := range errs {
+      errs[i] = err
+    }
+    return
+  }
+  defer conn.ExecContext(ctx, `DETACH DATABASE old`)
+  for i, q := range restoreQueries {
+    res, err := conn.ExecContext(ctx, q.query)
+    if err != nil {
+      errs[i] = err
+      continue
+    }
+    counts[i], _ = res.RowsAffected()
+  }
+  return
+}
+
+// FileRename is a message file which has been renamed from old to new, relative to MSGDIR
+type FileRename struct {
+  old, new string
+  id       [24]byte // message whose file it is, if any
+}
+
+// RenameFiles updates the paths of renamed message files in one transaction
+func (db *DB) RenameFiles(renames []FileRename) error {
+  if len(renames) == 0 {
+    return nil
+  }
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  if db.DB == nil {
+    return errDBClosed
+  }
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  for _, r := range renames {
+    // note: messages.filepath isn't indexed, so messages are looked up by id
+    if r.id != ([24]byte{}) {
+      _, err := tx.Exec(`UPDATE messages SET filepath = ? WHERE id = ? AND filepath = ?`,
+        r.new, r.id[:], r.old)
+      if err != nil {
+        _ = tx.Rollback()
+        return err
+      }
+    }
+    for _, q := range []string{
+      `UPDATE OR REPLACE files SET path = ?2 WHERE path = ?1`,
+      `UPDATE OR REPLACE duplicates SET path = ?2 WHERE path = ?1`,
+      `UPDATE duplicates SET canonical = ?2 WHERE canonical = ?1`,
+    } {
+      if _, err := tx.Exec(q, r.old, r.new); err != nil {
+        _ = tx.Rollback()
+        return err
+      }
+    }
+  }
+  return tx.Commit()
+}
+
+// Duplicate is a file whose message is the same as that of another file, canonical.
+// Paths are relative to MSGDIR.
+type Duplicate struct {
+  path      string
+  id        [24]byte
+  canonical string
+}
+
+// SetDuplicates replaces the duplicate files recorded for folder with dups
+func (db *DB) SetDuplicates(folder string, dups []Duplicate) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  if db.DB == nil {
+    return errDBClosed
+  }
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  _, err = tx.Exec(`DELETE FROM duplicates WHERE path GLOB ?`,
+    folder+string(filepath.Separator)+"*")
+  if err != nil {
+    _ = tx.Rollback()
+    return err
+  }
+  for _, d := range dups {
+    _, err := tx.Exec(`INSERT OR REPLACE INTO duplicates (path, id, canonical) VALUES (?, ?, ?)`,
+      d.path, d.id[:], d.canonical)
+    if err != nil {
+      _ = tx.Rollback()
+      return err
+    }
+  }
+  return tx.Commit()
+}
+
+// Duplicates returns the duplicate files recorded by scans, ordered by path.
+// canonical limits them to the duplicates of that file, unless it's empty.
+func (db *DB) Duplicates(canonical string) ([]Duplicate, error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  if db.DB == nil {
+    return nil, errDBClosed
+  }
+  rows, err := db.Query(`
+    SELECT path, id, canonical FROM duplicates WHERE ?1 = '' OR canonical = ?1 ORDER BY path
+  `, canonical)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  var dups []Duplicate
+  for rows.Next() {
+    var d Duplicate
+    var id sql.RawBytes
+    if err := rows.Scan(&d.path, &id, &d.canonical); err != nil {
+      return nil, err
+    }
+    copy(d.id[:], id)
+    dups = append(dups, d)
+  }
+  return dups, rows.Err()
+}
+
+type DeliveryState struct {
+  attempts    int
+  lastattempt time.Time
+  lasterror   string
+  nextattempt time.Time // zero if not yet scheduled
+  failed      bool      // true when delivery has been given up on
+}
+
+func (db *DB) LoadDeliveryState(id []byte, ds *DeliveryState) error {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  var lastattempt, nextattempt sql.NullInt64
+  var lasterror sql.NullString
+  err := db.QueryRow(`
+    SELECT attempts, lastattempt, lasterror, nextattempt, failed FROM delivery WHERE id = ?
+  `, id).Scan(&ds.attempts, &lastattempt, &lasterror, &nextattempt, &ds.failed)
+  if err == sql.ErrNoRows {
+    *ds = DeliveryState{}
+    return nil
+  }
+  ds.lastattempt = unixTimeOrZero(lastattempt)
+  ds.nextattempt = unixTimeOrZero(nextattempt)
+  ds.lasterror = lasterror.String
+  return err
+}
+
+// RecordDeliveryFailure increments the attempt count of a message, records err and
+// schedules the next attempt
+func (db *DB) RecordDeliveryFailure(id []byte, err error, nextattempt time.Time) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  _, err = db.Exec(`
+    INSERT INTO delivery (id, attempts, lastattempt, lasterror, nextattempt) VALUES (?, 1, ?, ?, ?)
+    ON CONFLICT (id) DO UPDATE SET
+      attempts = attempts + 1,
+      lastattempt = excluded.lastattempt,
+      lasterror = excluded.lasterror,
+      nextattempt = excluded.nextattempt
+  `, id, time.Now().Unix(), err.Error(), nextattempt.Unix())
+  return err
+}
+
+// MarkDeliveryFailed records that delivery of a message has been given up on
+func (db *DB) MarkDeliveryFailed(id []byte, reason string) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  _, err := db.Exec(`
+    INSERT INTO delivery (id, lasterror, failed) VALUES (?, ?, 1)
+    ON CONFLICT (id) DO UPDATE SET lasterror = excluded.lasterror, failed = 1
+  `, id, reason)
+  return err
+}
+
+// ResetDeliverySchedule makes a message eligible for delivery right away,
+// even if it was marked as failed
+func (db *DB) ResetDeliverySchedule(id []byte) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  _, err := db.Exec(`
+    UPDATE delivery SET nextattempt = NULL, failed = 0 WHERE id = ?
+  `, id)
+  return err
+}
+
+// FailedDeliveries returns the ids of messages which could not be delivered
+func (db *DB) FailedDeliveries() (map[[24]byte]bool, error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  rows, err := db.Query(`SELECT id FROM delivery WHERE failed = 1`)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  ids := map[[24]byte]bool{}
+  for rows.Next() {
+    var id sql.RawBytes
+    if err := rows.Scan(&id); err != nil {
+      return nil, err
+    }
+    var key [24]byte
+    copy(key[:], id)
+    ids[key] = true
+  }
+  return ids, rows.Err()
+}
+
+// SetDeliveryStatus records the status of a sent message reported by a receipt, unless
+// it already has a later status. Returns false if there's no such message in the outbox
+// or sent folder.
+func (db *DB) SetDeliveryStatus(id []byte, status receiptStatus) (bool, error) {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  res, err := db.Exec(`
+    UPDATE messages SET delivery_status = max(delivery_status, ?)
+    WHERE id = ? AND folder IN ('outbox', 'sent')
+  `, status, id)
+  if err != nil {
+    return false, err
+  }
+  n, err := res.RowsAffected()
+  return n > 0, err
+}
+
+// DeliveryStatuses returns the status of messages which receipts have been received for
+func (db *DB) DeliveryStatuses() (map[[24]byte]receiptStatus, error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  rows, err := db.Query(`SELECT id, delivery_status FROM messages WHERE delivery_status > 0`)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  statuses := map[[24]byte]receiptStatus{}
+  for rows.Next() {
+    var id sql.RawBytes
+    var status receiptStatus
+    if err := rows.Scan(&id, &status); err != nil {
+      return nil, err
+    }
+    var key [24]byte
+    copy(key[:], id)
+    statuses[key] = status
+  }
+  return statuses, rows.Err()
+}
+
+// CountFailedDeliveries returns the number of messages which could not be delivered
+func (db *DB) CountFailedDeliveries() (count int, err error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  err = db.QueryRow(`SELECT count(*) FROM delivery WHERE failed = 1`).Scan(&count)
+  return
+}
+
+// ClearDeliveryState removes the delivery record of a message which has been delivered
+func (db *DB) ClearDeliveryState(id []byte) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  _, err := db.Exec(`DELETE FROM delivery WHERE id = ?`, id)
+  return err
+}
+
+// Contact is an author of messages, as recorded in the authors table
+type Contact struct {
+  Author
+  msgcount int       // number of messages from the author
+  lastseen time.Time // time of the latest message from the author
+  pinned   bool      // name was set by the user and is not updated from messages
+}
+
+// ListContacts calls fn for each author whose address or name contains search
+// (all authors if search is empty), most recently seen first.
+// fn must not call other DB methods.
+func (db *DB) ListContacts(search string, fn func(c *Contact) error) error {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  pattern := "%" + likeEscape(search) + "%"
+  rows, err := db.Query(`
+    SELECT address, name, msgcount, lastid, pinned
+    FROM authors
+    WHERE address LIKE ? ESCAPE '\' OR name LIKE ? ESCAPE '\'
+    ORDER BY lastid DESC, address
+  `, pattern, pattern)
+  if err != nil {
+    return err
+  }
+  defer rows.Close()
+  var c Contact
+  for rows.Next() {
+    var lastid sql.RawBytes
+    if err := rows.Scan(&c.address, &c.name, &c.msgcount, &lastid, &c.pinned); err != nil {
+      return err
+    }
+    c.lastseen = time.Time{}
+    if len(lastid) == 24 {
+      var m Message
+      copy(m.id[:], lastid)
+      c.lastseen = m.IdTime()
+    }
+    if err := fn(&c); err != nil {
+      return err
+    }
+  }
+  return rows.Err()
+}
+
+// SetContactName sets and pins the display name of an author, so that it is not
+// replaced by names in messages
+func (db *DB) SetContactName(address, name string) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  _, err := db.Exec(`
+    INSERT INTO authors (address, name, pinned) VALUES(?, ?, 1)
+    ON CONFLICT (address) DO UPDATE SET name = excluded.name, pinned = 1
+  `, address, name)
+  return err
+}
+
+// RemoveContact removes an author. It is added again when a message from it is indexed.
+func (db *DB) RemoveContact(address string) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  res, err := db.Exec(`DELETE FROM authors WHERE address = ?`, address)
+  if err != nil {
+    return err
+  }
+  if n, _ := res.RowsAffected(); n == 0 {
+    return errorf("no contact %q", address)
+  }
+  return nil
+}
+
+// MessageFilter selects messages for ListMessages and SearchMessages
+type MessageFilter struct {
+  folder     string    // only messages in folder ("" or "all" for any but trash and drafts)
+  from       string    // only messages from this address
+  owner      string    // only messages owned by this address (see AddMessageOwner)
+  label      string    // only messages with this label (see normalizeLabel)
+  since      time.Time // only messages created at or after this time
+  until      time.Time // only messages created before this time
+  unread     bool      // only messages which have not been read
+  expired    bool      // include messages which have expired (see Message.expires)
+  copies     bool      // include all copies of messages, not just the earliest
+  thread     []byte    // only messages in this thread (see selectThread)
+  after      []byte    // only messages with greater ids, i.e. newer ones
+  minSize    int64     // only messages of at least this many bytes (see Message.Size)
+  oldest     bool      // list oldest messages first
+  sortBy     string    // "" or "id", "priority" or "size"; highest first, then by id
+  offset     int
+  limit      int // max number of messages (<=0 for no limit)
+}
+
+// narrowed returns true if f selects only some of the messages of its folder, e.g. those
+// from an address, not counting offset and limit
+func (f *MessageFilter) narrowed() bool {
+  return f.from != "" || f.owner != "" || f.label != "" || !f.since.IsZero() ||
+    !f.until.IsZero() || f.unread || f.thread != nil || f.after != nil || f.minSize > 0
+}
+
+// where returns a SQL condition (never empty) and its arguments for the filter
+func (f *MessageFilter) where() (string, []interface{}) {
+  conds := []string{"1"}
+  var args []interface{}
+  if f.folder != "" && f.folder != "all" {
+    conds = append(conds, "messages.folder = ?")
+    args = append(args, f.folder)
+  } else {
+    conds = append(conds, "messages.folder NOT IN ('trash', 'drafts')")
+  }
+  if f.from != "" {
+    conds = append(conds, "messages.fromaddr = ?")
+    args = append(args, f.from)
+  }
+  if f.owner != "" {
+    conds = append(conds,
+      "EXISTS (SELECT 1 FROM owners WHERE owners.id = messages.id AND owner = ?)")
+    args = append(args, f.owner)
+  }
+  if f.label != "" {
+    conds = append(conds, "EXISTS (SELECT 1 FROM labels "+
+      "WHERE labels.id = messages.id AND label = ? AND removed = 0)")
+    args = append(args, f.label)
+  }
+  if f.unread {
+    conds = append(conds, "ifnull(messages.isread, 0) = 0")
+  }
+  if f.minSize > 0 {
+    conds = append(conds, "messages.size >= ?")
+    args = append(args, f.minSize)
+  }
+  if !f.expired {
+    conds = append(conds, "(messages.expires IS NULL OR messages.expires > ?)")
+    args = append(args, time.Now().Unix())
+  }
+  if f.thread != nil {
+    // note: the thread of its first message is NULL (see selectThread)
+    conds = append(conds,
+      "(messages.thread = ? OR (messages.id = ? AND messages.thread IS NULL))")
+    args = append(args, f.thread, f.thread)
+  }
+  if !f.copies && config.Duplicates == duplicatesLink {
+    // note: the earliest copy in the folder is listed, which is not the one the others
+    // are copies of when that is in another folder, e.g. the trash
+    conds = append(conds, "(messages.copy_of IS NULL OR NOT EXISTS (SELECT 1 FROM messages o "+
+      "WHERE (o.id = messages.copy_of OR o.copy_of = messages.copy_of) "+
+      "AND o.id < messages.id AND o.folder = messages.folder))")
+  }
+  // note: ids start with the big-endian creation timestamp, so a time range is a range
+  // of ids, which uses the primary key index
+  if !f.since.IsZero() {
+    conds = append(conds, "messages.id >= ?")
+    args = append(args, idTimePrefix(f.since))
+  }
+  if !f.until.IsZero() {
+    conds = append(conds, "messages.id < ?")
+    args = append(args, idTimePrefix(f.until))
+  }
+  if f.after != nil {
+    conds = append(conds, "messages.id > ?")
+    args = append(args, f.after)
+  }
+  return strings.Join(conds, " AND "), args
+}
+
+// sortedById returns true if messages are listed in order of id, i.e. of time
+func (f *MessageFilter) sortedById() bool {
+  return f.sortBy == "" || f.sortBy == "id"
+}
+
+func (f *MessageFilter) limitArgs() []interface{} {
+  limit := f.limit
+  if limit <= 0 {
+    limit = -1
+  }
+  return []interface{}{limit, f.offset}
+}
+
+// idTimePrefix returns the leading bytes of ids of messages created at time t
+func idTimePrefix(t time.Time) []byte {
+  var sec uint32
+  if ut := t.Unix(); ut > idEpochBase {
+    sec = uint32(ut - idEpochBase)
+  }
+  return []byte{byte(sec >> 24), byte(sec >> 16), byte(sec >> 8), byte(sec)}
+}
+
+// ListMessages calls fn for each message matching f, newest first unless f.oldest.
+// msg is reused between calls. fn must not call other DB methods.
+func (db *DB) ListMessages(f *MessageFilter, fn func(msg *Message) error) error {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  where, args := f.where()
+  order := "id DESC"
+  if f.oldest {
+    order = "id ASC"
+  }
+  switch f.sortBy {
+  case "priority":
+    order = "priority DESC, " + order
+  case "size":
+    order = "ifnull(size, 0) DESC, " + order
+  }
+  // note: the names of recipients are those of contacts, which are authors
+  rows, err := db.Query(`
+    SELECT id, subject, fromaddr, ifnull(f.name, ''), toaddr, ifnull(t.name, ''), ncc,
+      folder, priority, size, nfiles
+    FROM messages
+    LEFT JOIN authors f ON f.address = messages.fromaddr
+    LEFT JOIN authors t ON t.address = messages.toaddr
+    WHERE `+where+`
+    ORDER BY `+order+`
+    LIMIT ? OFFSET ?
+  `, append(args, f.limitArgs()...)...)
+  if err != nil {
+    return err
+  }
+  defer rows.Close()
+  var msg Message
+  for rows.Next() {
+    if err := db.InitMessageRows11(&msg, rows); err != nil {
+      return err
+    }
+    if err := fn(&msg); err != nil {
+      return err
+    }
+  }
+  return rows.Err()
+}
+
+// CountMessages returns the number of messages matching f, ignoring offset and limit
+func (db *DB) CountMessages(f *MessageFilter) (count int, err error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  where, args := f.where()
+  err = db.QueryRow(`SELECT count(*) FROM messages WHERE `+where, args...).Scan(&count)
+  return
+}
+
+// Thread summarizes the messages of a thread which match a filter (see ListThreads)
+type Thread struct {
+  id           [24]byte // see selectThread
+  latest       [24]byte // id of the latest message
+  subject      string   // of the latest message
+  count        int
+  unread       int
+  participants []Author // senders and recipients, in order of their first message
+}
+
+// ListThreads returns the threads of the messages matching f, the one with the latest
+// message first. The offset and limit of f are those of threads rather than messages.
+func (db *DB) ListThreads(f *MessageFilter) ([]Thread, error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  where, args := f.where()
+  // note: subject is that of the row of max(id), as sqlite does for a bare column of a
+  // query with a single max() aggregate
+  rows, err := db.Query(`
+    SELECT ifnull(thread, id), max(id), subject, count(*), sum(ifnull(isread, 0) = 0)
+    FROM messages
+    WHERE `+where+`
+    GROUP BY ifnull(thread, id)
+    ORDER BY max(id) DESC
+    LIMIT ? OFFSET ?
+  `, append(args, f.limitArgs()...)...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  var threads []Thread
+  index := map[[24]byte]int{} // index in threads, by id
+  for rows.Next() {
+    var t Thread
+    var id, latest []byte
+    if err := rows.Scan(&id, &latest, &t.subject, &t.count, &t.unread); err != nil {
+      return nil, err
+    }
+    copy(t.id[:], id)
+    copy(t.latest[:], latest)
+    index[t.id] = len(threads)
+    threads = append(threads, t)
+  }
+  if err := rows.Err(); err != nil || len(threads) == 0 {
+    return threads, err
+  }
+
+  rows, err = db.Query(`
+    SELECT ifnull(messages.thread, messages.id), fromaddr, ifnull(f.name, ''),
+      toaddr, ifnull(t.name, '')
+    FROM messages
+    LEFT JOIN authors f ON f.address = messages.fromaddr
+    LEFT JOIN authors t ON t.address = messages.toaddr
+    WHERE `+where+`
+    ORDER BY messages.id
+  `, args...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var id sql.RawBytes
+    var from, to Author
+    if err := rows.Scan(&id, &from.address, &from.name, &to.address, &to.name); err != nil {
+      return nil, err
+    }
+    var id24 [24]byte
+    copy(id24[:], id)
+    i, ok := index[id24]
+    if !ok {
+      continue // not on this page
+    }
+    t := &threads[i]
+    for _, a := range []Author{from, to} {
+      if a.address != "" && !hasParticipant(t.participants, a.address) {
+        t.participants = append(t.participants, a)
+      }
+    }
+  }
+  return threads, rows.Err()
+}
+
+func hasParticipant(participants []Author, address string) bool {
+  for _, a := range participants {
+    if a.address == address {
+      return true
+    }
+  }
+  return false
+}
+
+// CountThreads returns the number of threads of the messages matching f, ignoring offset
+// and limit
+func (db *DB) CountThreads(f *MessageFilter) (count int, err error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  where, args := f.where()
+  err = db.QueryRow(`SELECT count(DISTINCT ifnull(thread, id)) FROM messages WHERE `+where,
+    args...).Scan(&count)
+  return
+}
+
+// MessageThread returns the id of the thread of a message, which is the id of the
+// message itself when it's not a reply (see selectThread), or false if there's no such
+// message
+func (db *DB) MessageThread(id [24]byte) (thread [24]byte, ok bool, err error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  var b []byte
+  err = db.QueryRow(`SELECT ifnull(thread, id) FROM messages WHERE id = ?`, id[:]).Scan(&b)
+  if err == sql.ErrNoRows {
+    return thread, false, nil
+  }
+  copy(thread[:], b)
+  return thread, err == nil, err
+}
+
+// ThreadReplies returns the id of the message which each message in a thread is a reply
+// to, by the id of the reply
+func (db *DB) ThreadReplies(thread [24]byte) (map[[24]byte][24]byte, error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  rows, err := db.Query(`
+    SELECT id, in_reply_to FROM messages WHERE thread = ? AND in_reply_to IS NOT NULL
+  `, thread[:])
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  replies := map[[24]byte][24]byte{}
+  for rows.Next() {
+    var id, parent [24]byte
+    var b1, b2 sql.RawBytes
+    if err := rows.Scan(&b1, &b2); err != nil {
+      return nil, err
+    }
+    copy(id[:], b1)
+    copy(parent[:], b2)
+    replies[id] = parent
+  }
+  return replies, rows.Err()
+}
+
+// CopyCounts returns the number of copies in its folder of each message which has copies
+// there, by id (see Config.Duplicates)
+func (db *DB) CopyCounts() (map[[24]byte]int, error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  rows, err := db.Query(`
+    SELECT id, ifnull(copy_of, id), folder FROM messages
+    WHERE copy_of IS NOT NULL
+      OR id IN (SELECT copy_of FROM messages WHERE copy_of IS NOT NULL)
+  `)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  groups := map[string][][24]byte{} // by the id of the earliest copy and folder
+  for rows.Next() {
+    var id, copyof sql.RawBytes
+    var folder string
+    if err := rows.Scan(&id, &copyof, &folder); err != nil {
+      return nil, err
+    }
+    var id24 [24]byte
+    copy(id24[:], id)
+    key := string(copyof) + folder
+    groups[key] = append(groups[key], id24)
+  }
+  counts := map[[24]byte]int{}
+  for _, ids := range groups {
+    if len(ids) > 1 {
+      for _, id := range ids {
+        counts[id] = len(ids)
+      }
+    }
+  }
+  return counts, rows.Err()
+}
+
+// CopyGroup is a group of messages in a folder which are copies of each other: they have
+// the same content hash, sender and first recipient (see selectCopyOf)
+type CopyGroup struct {
+  folder string
+  ids    [][24]byte // earliest first
+  linked bool       // the messages are recorded as copies of each other
+}
+
+// CopyGroups returns the groups of copies of messages in folders other than the trash,
+// whether or not they are recorded as copies, e.g. since they were indexed before
+// copies were detected
+func (db *DB) CopyGroups() ([]CopyGroup, error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  rows, err := db.Query(`
+    SELECT folder, content_hash, fromaddr, toaddr, id, ifnull(copy_of, id) FROM messages m
+    WHERE content_hash IS NOT NULL AND folder != 'trash' AND EXISTS (
+      SELECT 1 FROM messages o WHERE o.content_hash = m.content_hash AND o.id != m.id
+      AND o.fromaddr = m.fromaddr AND o.toaddr = m.toaddr AND o.folder = m.folder)
+    ORDER BY folder, content_hash, fromaddr, toaddr, id
+  `)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  var groups []CopyGroup
+  var prevkey string
+  var prevcopyof []byte
+  for rows.Next() {
+    var folder, from, to string
+    var hash, id, copyof []byte
+    if err := rows.Scan(&folder, &hash, &from, &to, &id, &copyof); err != nil {
+      return nil, err
+    }
+    var id24 [24]byte
+    copy(id24[:], id)
+    key := folder + "\x00" + string(hash) + from + "\x00" + to
+    if key != prevkey || len(groups) == 0 {
+      groups = append(groups, CopyGroup{folder: folder, linked: true})
+      prevkey, prevcopyof = key, copyof
+    }
+    g := &groups[len(groups)-1]
+    g.ids = append(g.ids, id24)
+    g.linked = g.linked && bytes.Equal(copyof, prevcopyof)
+  }
+  return groups, rows.Err()
+}
+
+// CountUnhashedMessages returns the number of messages outside the trash which have no
+// content hash since they were indexed before content hashes were, and so are not found
+// by CopyGroups
+func (db *DB) CountUnhashedMessages() (count int, err error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  err = db.QueryRow(`
+    SELECT count(*) FROM messages WHERE content_hash IS NULL AND folder != 'trash'
+  `).Scan(&count)
+  return
+}
+
+// LinkCopies records the messages of ids, which are copies of each other, as copies of
+// the first one
+func (db *DB) LinkCopies(ids [][24]byte) error {
+  if len(ids) < 2 {
+    return nil
+  }
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  var copyof []byte
+  err = tx.QueryRow(`SELECT ifnull(copy_of, id) FROM messages WHERE id = ?`, ids[0][:]).
+    Scan(&copyof)
+  for _, id := range ids[1:] {
+    if err != nil {
+      break
+    }
+    _, err = tx.Exec(`UPDATE messages SET copy_of = ? WHERE id = ?`, copyof, id[:])
+  }
+  if err != nil {
+    _ = tx.Rollback()
+    return err
+  }
+  return tx.Commit()
+}
+
+// FolderSize is the number and total size of the messages in a folder
+type FolderSize struct {
+  folder  string
+  count   int
+  bytes   int64
+  unsized int // messages of unknown size, not included in bytes
+}
+
+// FolderSizes returns the size of each folder, ordered by name
+func (db *DB) FolderSizes() ([]FolderSize, error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  rows, err := db.Query(`
+    SELECT folder, count(*), ifnull(sum(size), 0), count(*) - count(size)
+    FROM messages GROUP BY folder ORDER BY folder
+  `)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  var sizes []FolderSize
+  for rows.Next() {
+    var fs FolderSize
+    if err := rows.Scan(&fs.folder, &fs.count, &fs.bytes, &fs.unsized); err != nil {
+      return nil, err
+    }
+    sizes = append(sizes, fs)
+  }
+  return sizes, rows.Err()
+}
+
+// UnreadMessages returns the ids of the messages in ids which have not been read
+func (db *DB) UnreadMessages(ids [][24]byte) (map[[24]byte]bool, error) {
+  unread := map[[24]byte]bool{}
+  if len(ids) == 0 {
+    return unread, nil
+  }
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  args := make([]interface{}, len(ids))
+  for i := range ids {
+    args[i] = ids[i][:]
+  }
+  rows, err := db.Query(`
+    SELECT id FROM messages
+    WHERE id IN (?`+strings.Repeat(", ?", len(ids)-1)+`) AND ifnull(isread, 0) = 0
+  `, args...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var b []byte
+    if err := rows.Scan(&b); err != nil {
+      return nil, err
+    }
+    var id [24]byte
+    copy(id[:], b)
+    unread[id] = true
+  }
+  return unread, rows.Err()
+}
+
+// SearchMessages calls fn for each message matching f and the full-text query, best
+// match first or, if bydate is true, newest first. snippet is an excerpt of the matching
+// text. Without a full-text index, messages containing all words of query are returned.
+// msg is reused between calls. fn must not call other DB methods.
+func (db *DB) SearchMessages(
+  query string, f *MessageFilter, bydate bool, fn func(msg *Message, snippet string) error,
+) error {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+
+  where, args := f.where()
+  var sqlstr string
+  if db.hasFTS {
+    order := "rank"
+    if bydate {
+      order = "messages.id DESC"
+    }
+    sqlstr = `
+      SELECT messages.id, messages.subject, messages.fromaddr, ifnull(authors.name, ''),
+             snippet(messages_fts, -1, '', '', '…', 12)
+      FROM messages_fts
+      JOIN messages ON messages.id = messages_fts.id
+      LEFT JOIN authors ON authors.address = messages.fromaddr
+      WHERE messages_fts MATCH ? AND ` + where + `
+      ORDER BY ` + order + `
+      LIMIT ? OFFSET ?`
+    args = append([]interface{}{query}, args...)
+  } else {
+    words := likeSearchWords(query)
+    if len(words) == 0 {
+      return errorf("invalid search query: empty")
+    }
+    var conds []string
+    for _, word := range words {
+      conds = append(conds,
+        "(subject LIKE ? ESCAPE '\\' OR CAST(bodies.body AS TEXT) LIKE ? ESCAPE '\\')")
+      pattern := "%" + likeEscape(word) + "%"
+      args = append(args, pattern, pattern)
+    }
+    sqlstr = `
+      SELECT messages.id, messages.subject, messages.fromaddr, ifnull(authors.name, ''),
+             substr(CAST(bodies.body AS TEXT),
+                    max(1, instr(lower(CAST(bodies.body AS TEXT)), lower(?)) - 30), 80)
+      FROM messages
+      LEFT JOIN authors ON authors.address = messages.fromaddr
+      LEFT JOIN bodies ON bodies.id = messages.id
+      WHERE ` + where + ` AND ` + strings.Join(conds, " AND ") + `
+      ORDER BY messages.id DESC
+      LIMIT ? OFFSET ?`
+    args = append([]interface{}{words[0]}, args...)
+  }
+
+  rows, err := db.Query(sqlstr, append(args, f.limitArgs()...)...)
+  if err != nil {
+    return searchQueryError(err)
+  }
+  defer rows.Close()
+  var msg Message
+  var snippet string
+  var id sql.RawBytes
+  for rows.Next() {
+    err := rows.Scan(&id, &msg.subject, &msg.from.address, &msg.from.name, &snippet)
+    if err != nil {
+      return err
+    }
+    if len(id) > 24 {
+      return errorf("invalid id %q", id)
+    }
+    copy(msg.id[:24], id)
+    msg.SetTimeFromId()
+    if err := fn(&msg, snippet); err != nil {
+      return err
+    }
+  }
+  return searchQueryError(rows.Err())
+}
+
+// searchQueryError rewrites errors from the FTS query parser, which look like
+// "SQL logic error: fts5: syntax error near "x" (1)", to something more readable
+func searchQueryError(err error) error {
+  if err == nil {
+    return nil
+  }
+  msg := err.Error()
+  if !strings.Contains(msg, "fts5:") && !strings.Contains(msg, "unterminated string") {
+    return err
+  }
+  msg = strings.TrimPrefix(msg, "SQL logic error: ")
+  msg = strings.TrimPrefix(msg, "fts5: ")
+  msg = strings.TrimSuffix(msg, " (1)")
+  return errorf("invalid search query: %s", msg)
+}
+
+// likeSearchWords returns the words of a full-text query, without quotes and
+// prefix-query stars
+func likeSearchWords(query string) []string {
+  var words []string
+  for _, word := range strings.Fields(query) {
+    if word = strings.Trim(word, "\"*"); word != "" {
+      words = append(words, word)
+    }
+  }
+  return words
+}
+
+// likeEscape escapes the LIKE wildcards in s, for use with ESCAPE '\'
+func likeEscape(s string) string {
+  return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(s)
+}
+
+type APIToken struct {
+  id       int64
+  name     string
+  owner    string // address whose messages the token gives access to; "" for all
+  created  time.Time
+  lastused time.Time // zero if never used
+}
+
+// CreateToken adds an API token with the given SHA-256 hash and returns its id
+func (db *DB) CreateToken(name, owner string, hash []byte) (int64, error) {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  res, err := db.Exec(`INSERT INTO tokens (name, owner, hash, created) VALUES (?, ?, ?, ?)`,
+    name, owner, hash, time.Now().Unix())
+  if err != nil {
+    return 0, err
+  }
+  return res.LastInsertId()
+}
+
+// ListTokens calls fn for each API token, oldest first. fn must not call other DB methods.
+func (db *DB) ListTokens(fn func(t *APIToken) error) error {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  rows, err := db.Query(`SELECT id, name, owner, created, lastused FROM tokens ORDER BY id`)
+  if err != nil {
+    return err
+  }
+  defer rows.Close()
+  var t APIToken
+  for rows.Next() {
+    var created int64
+    var lastused sql.NullInt64
+    if err := rows.Scan(&t.id, &t.name, &t.owner, &created, &lastused); err != nil {
+      return err
+    }
+    t.created = time.Unix(created, 0)
+    t.lastused = unixTimeOrZero(lastused)
+    if err := fn(&t); err != nil {
+      return err
+    }
+  }
+  return rows.Err()
+}
+
+// RevokeToken removes an API token
+func (db *DB) RevokeToken(id int64) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  res, err := db.Exec(`DELETE FROM tokens WHERE id = ?`, id)
+  if err != nil {
+    return err
+  }
+  if n, _ := res.RowsAffected(); n == 0 {
+    return errorf("no token %d", id)
+  }
+  return nil
+}
+
+// AuthenticateToken returns true if hash is the SHA-256 hash of an API token, in which
+// case the token's last-used time is updated, along with the token's owner.
+// hash is compared with every token in constant time, so that the time taken doesn't
+// reveal anything about the tokens.
+func (db *DB) AuthenticateToken(hash []byte) (ok bool, owner string, err error) {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  rows, err := db.Query(`SELECT id, owner, hash FROM tokens`)
+  if err != nil {
+    return false, "", err
+  }
+  var id int64 = -1
+  for rows.Next() {
+    var tid int64
+    var towner string
+    var thash []byte
+    if err := rows.Scan(&tid, &towner, &thash); err != nil {
+      rows.Close()
+      return false, "", err
+    }
+    if subtle.ConstantTimeCompare(hash, thash) == 1 {
+      id, owner = tid, towner
+    }
+  }
+  rows.Close()
+  if err := rows.Err(); err != nil || id == -1 {
+    return false, "", err
+  }
+  now := time.Now().Unix()
+  _, err = db.Exec(`UPDATE tokens SET lastused = ? WHERE id = ? AND ifnull(lastused, 0) < ?`,
+    now, id, now)
+  return err == nil, owner, err
+}
+
+// AddMessageOwner records that a message belongs to the user with address owner,
+// when the server hosts several users (Config.Recipients)
+func (db *DB) AddMessageOwner(id [24]byte, owner string) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  _, err := db.Exec(`INSERT OR IGNORE INTO owners (id, owner) VALUES (?, ?)`, id[:], owner)
+  return err
+}
+
+// IsMessageOwner returns true if the message with id belongs to owner
+func (db *DB) IsMessageOwner(id [24]byte, owner string) (bool, error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  var n int
+  err := db.QueryRow(`SELECT 1 FROM owners WHERE id = ? AND owner = ?`, id[:], owner).Scan(&n)
+  if err == sql.ErrNoRows {
+    return false, nil
+  }
+  return err == nil, err
+}
+
+// Label is a label of a message
+type Label struct {
+  label  string
+  source string // labelSourceSender or labelSourceLocal
+}
+
+// Labels returns the labels of the message with id, in alphabetical order.
+// Sender labels which have been removed are not included.
+func (db *DB) Labels(id [24]byte) ([]Label, error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  rows, err := db.Query(`
+    SELECT label, source FROM labels WHERE id = ? AND removed = 0 ORDER BY label
+  `, id[:])
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  var labels []Label
+  for rows.Next() {
+    var l Label
+    if err := rows.Scan(&l.label, &l.source); err != nil {
+      return nil, err
+    }
+    labels = append(labels, l)
+  }
+  return labels, rows.Err()
+}
+
+// MessageLabels returns the labels of all messages which have any, by id, in order
+func (db *DB) MessageLabels() (map[[24]byte][]string, error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  rows, err := db.Query(`SELECT id, label FROM labels WHERE removed = 0 ORDER BY id, label`)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  labels := map[[24]byte][]string{}
+  for rows.Next() {
+    var id sql.RawBytes
+    var label string
+    if err := rows.Scan(&id, &label); err != nil {
+      return nil, err
+    }
+    var id24 [24]byte
+    copy(id24[:], id)
+    labels[id24] = append(labels[id24], label)
+  }
+  return labels, rows.Err()
+}
+
+// AddLabel adds a local label to the message with id, or restores a removed sender label
+func (db *DB) AddLabel(id [24]byte, label string) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  _, err := db.Exec(`
+    INSERT INTO labels (id, label, source) VALUES (?, ?, ?)
+    ON CONFLICT (id, label) DO UPDATE SET removed = 0
+  `, id[:], label, labelSourceLocal)
+  return err
+}
+
+// RemoveLabel removes a label from the message with id. A sender label is marked as
+// removed rather than deleted, so that indexing the message again doesn't add it back.
+// Returns false if the message didn't have the label.
+func (db *DB) RemoveLabel(id [24]byte, label string) (bool, error) {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  res, err := db.Exec(`DELETE FROM labels WHERE id = ? AND label = ? AND source = ?`,
+    id[:], label, labelSourceLocal)
+  if err != nil {
+    return false, err
+  }
+  n, _ := res.RowsAffected()
+  if n == 0 {
+    res, err = db.Exec(`
+      UPDATE labels SET removed = 1 WHERE id = ? AND label = ? AND removed = 0
+    `, id[:], label)
+    if err != nil {
+      return false, err
+    }
+    n, _ = res.RowsAffected()
+  }
+  return n > 0, nil
+}
+
+// PullCursor returns the id of the last message pulled from peer, or nil if none has been
+func (db *DB) PullCursor(peer string) ([]byte, error) {
+  db.mu.RLock()
+  defer db.mu.RUnlock()
+  var id []byte
+  err := db.QueryRow(`SELECT lastid FROM pull_cursors WHERE peer = ?`, peer).Scan(&id)
+  if err == sql.ErrNoRows {
+    return nil, nil
+  }
+  return id, err
+}
+
+// SetPullCursor records id as the last message pulled from peer
+func (db *DB) SetPullCursor(peer string, id [24]byte) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  _, err := db.Exec(`INSERT OR REPLACE INTO pull_cursors (peer, lastid) VALUES (?, ?)`,
+    peer, id[:])
+  return err
+}
+
+// DeletePullCursor forgets the last message pulled from peer
+func (db *DB) DeletePullCursor(peer string) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  _, err := db.Exec(`DELETE FROM pull_cursors WHERE peer = ?`, peer)
+  return err
+}
+
+func unixTimeOrZero(v sql.NullInt64) time.Time {
+  if !v.Valid {
+    return time.Time{}
+  }
+  return time.Unix(v.Int64, 0)
+}
@@ -0,0 +1,65 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+)
+
+// duplicatesMode is what is done with a message which is added to a folder which has a
+// copy of it, e.g. one sent again or pulled after being imported: a message with the same
+// content (see Message.contentHash), sender and first recipient, at a different time.
+// Messages with the same content to other recipients are not copies.
+type duplicatesMode int
+
+const (
+  duplicatesLink duplicatesMode = iota // add it as a copy, listed as one with the others
+  duplicatesSkip                       // don't add it
+  duplicatesMark                       // add it as a copy, listed on its own
+)
+
+func (d duplicatesMode) String() string {
+  switch d {
+  case duplicatesLink:
+    return "link"
+  case duplicatesSkip:
+    return "skip"
+  case duplicatesMark:
+    return "mark"
+  }
+  return "?"
+}
+
+func parseDuplicatesMode(s string) (duplicatesMode, error) {
+  switch s {
+  case "link":
+    return duplicatesLink, nil
+  case "skip":
+    return duplicatesSkip, nil
+  case "mark":
+    return duplicatesMark, nil
+  }
+  return duplicatesLink, errorf("invalid duplicates %q (expected link, skip or mark)", s)
+}
+
+func (d duplicatesMode) MarshalJSON() ([]byte, error) {
+  return json.Marshal(d.String())
+}
+
+func (d *duplicatesMode) UnmarshalJSON(data []byte) error {
+  var s string
+  if err := json.Unmarshal(data, &s); err != nil {
+    return err
+  }
+  v, err := parseDuplicatesMode(s)
+  *d = v
+  return err
+}
+
+// copiesNote returns the note shown after the subject of a message with n copies
+func copiesNote(n int) string {
+  if n < 2 {
+    return ""
+  }
+  return fmt.Sprintf(" (%d copies)", n)
+}
@@ -0,0 +1,346 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "io"
+  "math/rand"
+  "net/url"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// deliveryInterval is how often the deliverer looks for messages in the outbox
+const deliveryInterval = time.Minute
+
+// defaultMaxDeliveryAge is how long delivery is attempted before a message is
+// marked as failed, unless configured otherwise (Config.MaxDeliveryAge)
+const defaultMaxDeliveryAge = 7 * 24 * time.Hour
+
+// deliveryBackoff is the delay before the next delivery attempt, indexed by the number of
+// failed attempts minus one. The last entry is used for all later attempts.
+var deliveryBackoff = []time.Duration{
+  time.Minute,
+  5 * time.Minute,
+  30 * time.Minute,
+  2 * time.Hour,
+  8 * time.Hour,
+  24 * time.Hour,
+}
+
+// nextDeliveryAttempt returns the time of the next delivery attempt of a message which
+// has failed delivery attempts times
+func nextDeliveryAttempt(now time.Time, attempts int) time.Time {
+  delay := deliveryBackoff[imax(0, imin(attempts, len(deliveryBackoff))-1)]
+  // ±10% jitter so that messages to the same destination don't retry in lockstep
+  jitter := time.Duration(rand.Int63n(int64(delay/5))) - delay/10
+  return now.Add(delay + jitter)
+}
+
+func maxDeliveryAge() time.Duration {
+  if config.MaxDeliveryAge > 0 {
+    return time.Duration(config.MaxDeliveryAge)
+  }
+  return defaultMaxDeliveryAge
+}
+
+// Transport delivers messages to recipients
+type Transport interface {
+  // Deliver delivers msg which was read from file.
+  // Must be idempotent; the same message may be delivered more than once.
+  Deliver(msg *Message, file string) error
+}
+
+// findTransport returns the transport to use for delivering a message to address
+func findTransport(address string) (Transport, error) {
+  if config.IsLocalAddress(address) {
+    return localTransport{}, nil
+  }
+  if peer := config.PeerForAddress(address); peer != nil {
+    return peerTransport{peer}, nil
+  }
+  domain := address[strings.LastIndexByte(address, '@')+1:]
+  return nil, errorf("no route to %s: no peer for %s and no default peer (see %s peer)",
+    address, domain, progname)
+}
+
+// localTransport delivers messages to addresses on this host by placing them in INBOXDIR
+type localTransport struct{}
+
+func (localTransport) Deliver(msg *Message, file string) error {
+  if msg.receipt != receiptNone {
+    return applyReceipt(msg)
+  }
+  dir, err := messageDir(INBOXDIR, msg.time)
+  if err != nil {
+    return err
+  }
+  dstfile, err := linkIntoDir(file, dir)
+  if err != nil {
+    return err
+  }
+  inmsg := *msg
+  inmsg.folder = "inbox"
+  inmsg.file = relPath(MSGDIR, dstfile)
+  added, err := db.PutMessage(&inmsg)
+  if err != nil {
+    return err
+  }
+  if added {
+    msgsync.messageAdded(&inmsg)
+  }
+  if err := sendReceipt(&inmsg, receiptDelivered); err != nil {
+    errlog("failed to send receipt for message %s: %v", msg, err)
+  }
+  return nil
+}
+
+// peerTransport delivers messages to a server (see serve), with its HTTP API or the peer
+// protocol depending on the scheme of the peer's URL. The message file is streamed as is.
+type peerTransport struct {
+  peer *Peer
+}
+
+func (t peerTransport) Deliver(msg *Message, file string) error {
+  f, err := os.Open(file)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+  st, err := f.Stat()
+  if err != nil {
+    return err
+  }
+  u, err := url.Parse(t.peer.URL)
+  if err != nil {
+    return errorf("peer %s: invalid url: %v", t.peer.Name, err)
+  }
+  var id string
+  switch u.Scheme {
+  case "http", "https":
+    id, err = t.post(f, st.Size())
+  case "tcp", "tls":
+    id, err = t.send(f, st.Size())
+  default:
+    return errorf("peer %s: unsupported url scheme %q", t.peer.Name, u.Scheme)
+  }
+  if err != nil {
+    return errorf("peer %s: %v", t.peer.Name, err)
+  }
+  // The server computes the id from the message file too, so a different id means that
+  // it received a different message, e.g. because the file was corrupted on the way.
+  if id != msg.IdString() {
+    errlog("peer %s received message %s as %s; the message may be corrupt",
+      t.peer.Name, msg.IdString(), id)
+  }
+  return nil
+}
+
+// post sends a message file with POST /v1/messages and returns the message's id
+func (t peerTransport) post(r io.Reader, size int64) (string, error) {
+  timeout := peerReplyTimeout + time.Duration(size/(64*1024))*time.Second
+  res, err := peerAPIRequest(context.Background(), t.peer, "POST", "/v1/messages", r, size,
+    timeout)
+  if err != nil {
+    return "", err
+  }
+  defer res.Body.Close()
+  var body struct {
+    Id string `json:"id"`
+  }
+  if err := json.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(&body); err != nil {
+    return "", errorf("%s (%v)", res.Status, err)
+  }
+  return body.Id, nil
+}
+
+// send sends a message file with the peer protocol and returns the message's id
+func (t peerTransport) send(r io.Reader, size int64) (string, error) {
+  c, err := dialPeerURL(t.peer)
+  if err != nil {
+    return "", err
+  }
+  defer c.Close()
+  return c.Send(r, size)
+}
+
+// Deliverer attempts delivery of messages in OUTBOXDIR.
+// Delivered messages are moved to SENTDIR.
+//
+// Failed attempts are retried with exponential backoff (deliveryBackoff) until the message
+// is older than maxDeliveryAge, at which point it's marked as failed.
+// Attempts are scheduled by wall-clock time stored in the database rather than by timers,
+// which may fire late or not at all across system sleep.
+type Deliverer struct {
+  mu       sync.Mutex // serializes deliveries
+  shutdown uint32
+  stopch   chan struct{}
+  donech   chan struct{}
+  wakeupch chan struct{}
+}
+
+func (d *Deliverer) Start() {
+  deliverlog.Debugf("start")
+  d.stopch = make(chan struct{})
+  d.donech = make(chan struct{})
+  d.wakeupch = make(chan struct{}, 1)
+  RegisterExitHandler(d.Shutdown, "delivery")
+  go d.main()
+}
+
+// Wakeup makes the deliverer look for messages in the outbox right away
+func (d *Deliverer) Wakeup() {
+  select {
+  case d.wakeupch <- struct{}{}:
+  default:
+  }
+}
+
+func (d *Deliverer) Shutdown(ctx context.Context) error {
+  if !atomic.CompareAndSwapUint32(&d.shutdown, 0, 1) {
+    return nil // race lost or already shut down
+  }
+  close(d.stopch)
+  select {
+  case <-d.donech:
+    return nil
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+}
+
+func (d *Deliverer) main() {
+  defer close(d.donech)
+  for {
+    d.deliverAll()
+    select {
+    case <-d.stopch:
+      return
+    case <-d.wakeupch:
+    case <-time.After(deliveryInterval):
+      // Note: may fire late after the system has been sleeping. That's fine since
+      // deliverFile compares the wall clock against the schedule.
+    }
+  }
+}
+
+func (d *Deliverer) deliverAll() {
+  entries, err := os.ReadDir(OUTBOXDIR)
+  if err != nil {
+    deliverlog.Errorf("%v", err)
+    return
+  }
+  for _, ent := range entries {
+    if atomic.LoadUint32(&d.shutdown) != 0 {
+      return
+    }
+    name := ent.Name()
+    if ent.IsDir() || name[0] == '.' || !strings.HasSuffix(name, ".msg") {
+      continue
+    }
+    d.deliverFile(filepath.Join(OUTBOXDIR, name), false, nil)
+  }
+}
+
+// deliverFile attempts delivery of a message in the outbox.
+// Unless force is true, nothing happens if the message is not yet due for another attempt
+// or has been marked as failed. If peer is not nil, the message is delivered to it
+// regardless of its recipients (see push -to-peer.)
+// Returns nil if the message was delivered or was skipped.
+func (d *Deliverer) deliverFile(file string, force bool, peer *Peer) error {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+
+  msg := &Message{}
+  if err := msg.ParseFile(file); err != nil {
+    if os.IsNotExist(err) {
+      return nil // delivered by a concurrent call
+    }
+    deliverlog.Errorf("failed to read message file %q: %v", file, err)
+    return err
+  }
+
+  // note: a draft is never delivered, even if its file ends up in the outbox, e.g. copied
+  // there by hand. It's known by its folder in the database rather than by where its
+  // file is.
+  if folder, err := db.MessageFolder(msg.id); err != nil {
+    deliverlog.Errorf("failed to look up %s: %v", msg, err)
+    return err
+  } else if folder == "drafts" {
+    err := errorf("%s is a draft, which is not delivered", relPath(MSGDIR, file))
+    deliverlog.Warnf("%v", err)
+    return err
+  }
+
+  var ds DeliveryState
+  if err := db.LoadDeliveryState(msg.Id(), &ds); err != nil {
+    deliverlog.Errorf("failed to load delivery state of %s: %v", msg, err)
+    return err
+  }
+  now := time.Now()
+  if !force && (ds.failed || now.Before(ds.nextattempt)) {
+    return nil
+  }
+
+  metricDeliveryAttempts.Inc()
+  err := deliverMessage(msg, file, peer)
+  if err == nil {
+    metricDeliverySuccesses.Inc()
+    deliverlog.Debugf("delivered %s to %s", msg, formatRecipients(msg))
+    return nil
+  }
+  metricDeliveryFailures.Inc()
+  deliverlog.Debugf("%s: %v", msg, err)
+  var dberr error
+  if now.Sub(msg.time) > maxDeliveryAge() {
+    warnlog("giving up delivery of %s to %s: %v", msg.IdString(), formatRecipients(msg), err)
+    dberr = db.MarkDeliveryFailed(msg.Id(), err.Error())
+  } else {
+    dberr = db.RecordDeliveryFailure(msg.Id(), err, nextDeliveryAttempt(now, ds.attempts+1))
+  }
+  if dberr != nil {
+    deliverlog.Errorf("failed to record delivery state of %s: %v", msg, dberr)
+  }
+  return err
+}
+
+// deliverMessage delivers a message in the outbox and moves it to the sent folder.
+// If the process is interrupted half-way, calling deliverMessage again completes the
+// operation without delivering the message twice.
+func deliverMessage(msg *Message, file string, peer *Peer) error {
+  // note: a transport is used once per message, even with several recipients it serves
+  used := map[Transport]bool{}
+  for _, a := range msg.Recipients() {
+    var t Transport = peerTransport{peer}
+    if peer == nil {
+      var err error
+      if t, err = findTransport(a.address); err != nil {
+        return err
+      }
+    }
+    if used[t] {
+      continue
+    }
+    used[t] = true
+    if err := t.Deliver(msg, file); err != nil {
+      return err
+    }
+  }
+  sentdir, err := messageDir(SENTDIR, msg.time)
+  if err != nil {
+    return err
+  }
+  sentfile, err := moveIntoDir(file, sentdir)
+  if err != nil {
+    return err
+  }
+  if err := db.MoveMessage(msg.Id(), "outbox", "sent", relPath(MSGDIR, sentfile)); err != nil {
+    return err
+  }
+  return db.ClearDeliveryState(msg.Id())
+}
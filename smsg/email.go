@@ -0,0 +1,238 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bytes"
+  "encoding/base64"
+  "fmt"
+  "io"
+  "mime"
+  "mime/multipart"
+  "mime/quotedprintable"
+  "net/mail"
+  "net/textproto"
+  "strconv"
+  "strings"
+  "time"
+
+  "golang.org/x/text/encoding/htmlindex"
+)
+
+// Emails are converted to messages, for the SMTP gateway (see smtpServer) and sendmail:
+// From, To, Subject and Date become from, to, subject and time, the text/plain part
+// becomes the body and other parts, like attachments, become files.
+
+// emailMaxDepth is the max nesting of multipart parts
+const emailMaxDepth = 10
+
+// emailFile is a part of an email which becomes a file of the message
+type emailFile struct {
+  name string
+  data []byte
+}
+
+// emailContent is the content of an email, collected from its MIME parts
+type emailContent struct {
+  text  []byte // the first text/plain part, in UTF-8
+  html  []byte // the first text/html part, used when there's no text part
+  files []emailFile
+}
+
+var emailWordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// convertEmail converts an email (RFC 5322) to an encoded message. Its recipients are
+// rcpts, the addresses it's sent to, and it's from sender if it has no From header.
+func convertEmail(data []byte, sender Author, rcpts []string) ([]byte, error) {
+  em, err := mail.ReadMessage(bytes.NewReader(data))
+  if err != nil {
+    return nil, err
+  }
+  hdr := em.Header
+  msg := &Message{}
+
+  // addresses
+  parser := &mail.AddressParser{WordDecoder: emailWordDecoder}
+  if addr, err := parser.Parse(hdr.Get("From")); err == nil {
+    msg.from = emailAuthor(addr)
+  } else if sender.address != "" {
+    msg.from = sender
+  } else {
+    return nil, errorf("missing From")
+  }
+  if msg.from.address == "" {
+    return nil, errorf("invalid From address")
+  }
+  if addr, err := parser.Parse(hdr.Get("Reply-To")); err == nil {
+    msg.replyTo = emailAuthor(addr)
+  }
+  // recipients are named as in the To and Cc headers
+  var named []*mail.Address
+  for _, key := range []string{"To", "Cc"} {
+    if addrs, err := parser.ParseList(hdr.Get(key)); err == nil {
+      named = append(named, addrs...)
+    }
+  }
+  for i, address := range rcpts {
+    a := Author{address: address}
+    for _, addr := range named {
+      if b := emailAuthor(addr); b.address == address {
+        a.name = b.name
+        break
+      }
+    }
+    if i == 0 {
+      msg.to = a
+    } else {
+      msg.cc = append(msg.cc, a)
+    }
+  }
+
+  // subject and time
+  subject := hdr.Get("Subject")
+  if s, err := emailWordDecoder.DecodeHeader(subject); err == nil {
+    subject = s
+  }
+  msg.subject = oneLine(subject)
+  if msg.subject == "" {
+    msg.subject = "(no subject)"
+  }
+  // note: times outside the range of message ids, or in the future, are replaced by now
+  now := time.Now()
+  msg.time = now
+  if t, err := hdr.Date(); err == nil && t.Unix() >= idEpochBase && t.Before(now.Add(time.Hour)) {
+    msg.time = t
+  }
+  msg.time = msg.time.Truncate(time.Second)
+
+  // body and files
+  var content emailContent
+  if err := content.add(textproto.MIMEHeader(hdr), em.Body, 0); err != nil {
+    return nil, err
+  }
+  msg.body = content.text
+  if msg.body == nil {
+    msg.body = []byte{}
+    if content.html != nil {
+      content.files = append(content.files, emailFile{"message.html", content.html})
+    }
+  }
+
+  var buf bytes.Buffer
+  msg.WriteHeaderTo(&buf)
+  fmt.Fprintf(&buf, "body %d\n", len(msg.body))
+  buf.Write(msg.body)
+  for _, f := range content.files {
+    fmt.Fprintf(&buf, "\nfile %d %s\n", len(f.data), f.name)
+    buf.Write(f.data)
+  }
+  return buf.Bytes(), nil
+}
+
+// emailAuthor returns the author for an email address
+func emailAuthor(addr *mail.Address) Author {
+  address, err := normalizeAndValidateAddress(addr.Address)
+  if err != nil || strings.ContainsAny(address, " \t") {
+    return Author{}
+  }
+  return Author{address: address, name: oneLine(addr.Name)}
+}
+
+// add adds the MIME part with header h and body r, and its parts if it's a multipart
+func (c *emailContent) add(h textproto.MIMEHeader, r io.Reader, depth int) error {
+  ctype, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+  if err != nil {
+    ctype, params = "text/plain", nil // the default (RFC 2045 5.2)
+  }
+  if strings.HasPrefix(ctype, "multipart/") {
+    if depth == emailMaxDepth {
+      return errorf("too deeply nested parts")
+    }
+    mr := multipart.NewReader(r, params["boundary"])
+    for {
+      part, err := mr.NextRawPart()
+      if err == io.EOF {
+        return nil
+      }
+      if err != nil {
+        return err
+      }
+      if err := c.add(part.Header, part, depth+1); err != nil {
+        return err
+      }
+    }
+  }
+
+  switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+  case "base64":
+    r = base64.NewDecoder(base64.StdEncoding, r)
+  case "quoted-printable":
+    r = quotedprintable.NewReader(r)
+  }
+  data, err := io.ReadAll(r)
+  if err != nil {
+    return err
+  }
+
+  disposition, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+  name := dparams["filename"]
+  if name == "" {
+    name = params["name"]
+  }
+  if s, err := emailWordDecoder.DecodeHeader(name); err == nil {
+    name = s
+  }
+  name = oneLine(name)
+  if disposition != "attachment" && name == "" {
+    switch ctype {
+    case "text/plain":
+      if c.text == nil {
+        c.text = emailText(data, params["charset"])
+        return nil
+      }
+    case "text/html":
+      if c.html == nil {
+        c.html = emailText(data, params["charset"])
+        return nil
+      }
+    }
+  }
+  if name == "" {
+    name = "part" + strconv.Itoa(len(c.files)+1)
+    if exts, _ := mime.ExtensionsByType(ctype); len(exts) > 0 {
+      name += exts[0]
+    } else if ctype == "message/rfc822" {
+      name += ".eml"
+    }
+  }
+  c.files = append(c.files, emailFile{name, data})
+  return nil
+}
+
+// emailText converts text in charset to UTF-8 with LF line endings
+func emailText(data []byte, charset string) []byte {
+  if charset != "" && !strings.EqualFold(charset, "utf-8") &&
+    !strings.EqualFold(charset, "us-ascii") {
+    if enc, err := htmlindex.Get(charset); err == nil {
+      if b, err := enc.NewDecoder().Bytes(data); err == nil {
+        data = b
+      }
+    } else {
+      emaillog.Debugf("unknown charset %q", charset)
+    }
+  }
+  return bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+}
+
+// charsetReader converts text in charset to UTF-8, for decoding encoded words in headers
+func charsetReader(charset string, r io.Reader) (io.Reader, error) {
+  enc, err := htmlindex.Get(charset)
+  if err != nil {
+    return nil, err
+  }
+  return enc.NewDecoder().Reader(r), nil
+}
+
+// oneLine replaces line breaks in s with spaces
+func oneLine(s string) string {
+  return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "errors"
+  "fmt"
+  "net/http"
+)
+
+// Kinds of errors, which callers tell apart with errors.Is, e.g. to choose an exit code or
+// an HTTP status. Errors of these kinds wrap them, e.g. errorf("message %s %w", id,
+// ErrNotFound), or match them, like tooLargeError.
+var (
+  ErrNotFound       = errors.New("not found")
+  ErrAmbiguousId    = errors.New("ambiguous id") // an id prefix matches several messages
+  ErrInvalidAddress = errors.New("invalid address")
+  ErrTooLarge       = errors.New("too large") // e.g. a message exceeding receiveLimits
+)
+
+// ParseError is an error in a message, like a malformed field or a missing one.
+// Srcname is "" and Line 0 when they are unknown, e.g. for a missing field.
+type ParseError struct {
+  Srcname string // e.g. the message file
+  Line    int
+  Msg     string
+}
+
+func (e *ParseError) Error() string {
+  switch {
+  case e.Srcname != "" && e.Line > 0:
+    return fmt.Sprintf("%s:%d: %s", e.Srcname, e.Line, e.Msg)
+  case e.Srcname != "":
+    return e.Srcname + ": " + e.Msg
+  }
+  return e.Msg
+}
+
+// parseErrorf returns a *ParseError for line of srcname
+func parseErrorf(srcname string, line int, format string, arg ...interface{}) error {
+  return &ParseError{Srcname: srcname, Line: line, Msg: fmt.Sprintf(format, arg...)}
+}
+
+// Exit statuses of the program for errors of these kinds (see exitCodeOf.)
+// Other errors exit with status 1, and invalid command line arguments with status 2.
+const (
+  exitNotFound       = 3
+  exitAmbiguousId    = 4
+  exitInvalidAddress = 5
+  exitTooLarge       = 6
+  exitInvalidMessage = 7 // a ParseError
+)
+
+// exitCodeOf returns the exit status of the program when it fails with err
+func exitCodeOf(err error) int {
+  var perr *ParseError
+  switch {
+  case errors.Is(err, ErrNotFound):
+    return exitNotFound
+  case errors.Is(err, ErrAmbiguousId):
+    return exitAmbiguousId
+  case errors.Is(err, ErrInvalidAddress):
+    return exitInvalidAddress
+  case errors.Is(err, ErrTooLarge):
+    return exitTooLarge
+  case errors.As(err, &perr):
+    return exitInvalidMessage
+  }
+  return 1
+}
+
+// httpStatusOf returns the HTTP status of a response to a request which failed with err
+func httpStatusOf(err error) int {
+  var perr *ParseError
+  switch {
+  case errors.Is(err, ErrNotFound):
+    return http.StatusNotFound
+  case errors.Is(err, ErrTooLarge):
+    return http.StatusRequestEntityTooLarge
+  case errors.Is(err, ErrAmbiguousId), errors.Is(err, ErrInvalidAddress),
+    errors.As(err, &perr):
+    return http.StatusBadRequest
+  }
+  return http.StatusInternalServerError
+}
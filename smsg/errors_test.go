@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "net/http"
+  "strings"
+  "testing"
+  "time"
+)
+
+// TestErrorKinds checks that errors of message lookups, recipients and the parser have
+// the exit status and HTTP status of their kind, also when wrapped
+func TestErrorKinds(t *testing.T) {
+  testMsgDir(t)
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  for _, subject := range []string{"One", "Two"} {
+    tm = tm.Add(time.Minute)
+    writeTestFile(t, OUTBOXDIR, tm.Format("20060102-150405")+".msg",
+      testMessageText(subject, "me@example.com", tm, "Hello"))
+  }
+  parse := func(text string, limits MessageLimits) error {
+    return (&Message{}).ParseReaderLimits(strings.NewReader(text), len(text), "test.msg",
+      limits)
+  }
+  _, _, ambiguous := findOutboxMessage("")
+  _, _, notFound := findOutboxMessage("x!")
+  _, invalidAddress := parseRecipients("bob")
+  invalidMessage := parse("subject Hi\nnot a field\n", MessageLimits{})
+  tooLarge := parse(testMessageText("Hi", "alice@example.com", tm, "Hello"),
+    MessageLimits{total: 10})
+
+  for _, test := range []struct {
+    name       string
+    err        error
+    exitCode   int
+    httpStatus int
+  }{
+    {"not found", notFound, exitNotFound, http.StatusNotFound},
+    {"wrapped not found", errorf("reply: %w", notFound), exitNotFound, http.StatusNotFound},
+    {"ambiguous id", ambiguous, exitAmbiguousId, http.StatusBadRequest},
+    {"invalid address", invalidAddress, exitInvalidAddress, http.StatusBadRequest},
+    {"too large", tooLarge, exitTooLarge, http.StatusRequestEntityTooLarge},
+    {"invalid message", invalidMessage, exitInvalidMessage, http.StatusBadRequest},
+    {"other", errorf("failed"), 1, http.StatusInternalServerError},
+  } {
+    if test.err == nil {
+      t.Errorf("%s: no error", test.name)
+      continue
+    }
+    if code := exitCodeOf(test.err); code != test.exitCode {
+      t.Errorf("%s: exit code %d for %q; expected %d", test.name, code, test.err,
+        test.exitCode)
+    }
+    if status := httpStatusOf(test.err); status != test.httpStatus {
+      t.Errorf("%s: HTTP status %d for %q; expected %d", test.name, status, test.err,
+        test.httpStatus)
+    }
+  }
+  if s := invalidMessage.Error(); s != `test.msg:2: unknown field "not"` {
+    t.Errorf("parse error %q", s)
+  }
+}
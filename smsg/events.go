@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "sync"
+  "time"
+)
+
+// eventKeepaliveInterval is how often a comment is sent on an idle event stream, so that
+// proxies don't close it and clients notice when the connection is lost
+const eventKeepaliveInterval = 15 * time.Second
+
+// eventClientBuffer is the number of events buffered for each client of an event stream.
+// A client which falls this far behind is disconnected; it can reconnect and catch up
+// with Last-Event-ID.
+const eventClientBuffer = 64
+
+// eventBroker fans out new messages to the clients of GET /v1/events
+type eventBroker struct {
+  mu      sync.Mutex
+  clients map[*eventClient]struct{}
+  closed  bool
+}
+
+type eventClient struct {
+  ch   chan messageJSON
+  done chan struct{} // closed when the client is dropped or the broker is closed
+}
+
+func newEventBroker() *eventBroker {
+  return &eventBroker{clients: map[*eventClient]struct{}{}}
+}
+
+// subscribe adds a client, or returns nil if the broker is closed
+func (b *eventBroker) subscribe() *eventClient {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  if b.closed {
+    return nil
+  }
+  c := &eventClient{
+    ch:   make(chan messageJSON, eventClientBuffer),
+    done: make(chan struct{}),
+  }
+  b.clients[c] = struct{}{}
+  return c
+}
+
+func (b *eventBroker) unsubscribe(c *eventClient) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  b.drop(c)
+}
+
+// drop removes c and ends its stream. b.mu must be locked.
+func (b *eventBroker) drop(c *eventClient) {
+  if _, ok := b.clients[c]; ok {
+    delete(b.clients, c)
+    close(c.done)
+  }
+}
+
+// publish sends msg to all clients. It never blocks; a client whose buffer is full is
+// dropped instead.
+func (b *eventBroker) publish(msg *Message) {
+  m := makeMessageJSON(msg)
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  for c := range b.clients {
+    select {
+    case c.ch <- m:
+    default:
+      servelog.Debugf("dropping slow event stream client")
+      b.drop(c)
+    }
+  }
+}
+
+// Close ends all streams and makes new ones fail
+func (b *eventBroker) Close() {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  b.closed = true
+  for c := range b.clients {
+    b.drop(c)
+  }
+}
+
+// GET /v1/events[?since=<id>]
+//
+// A stream of server-sent events, one "message" event per new message in the inbox, with
+// the message's id as the event id. Given the id of a message, with the since parameter or
+// a Last-Event-ID header, messages newer than it are sent first (at most apiMaxLimit.)
+func (b *eventBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  if !apiAllowMethods(w, r, "GET") {
+    return
+  }
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    apiError(w, http.StatusInternalServerError, "streaming not supported")
+    return
+  }
+  owner := requestOwner(r)
+
+  var replay []messageJSON
+  since := r.URL.Query().Get("since")
+  if since == "" {
+    since = r.Header.Get("Last-Event-ID")
+  }
+  if since != "" {
+    id, err := decodeId(since)
+    if err != nil {
+      apiError(w, http.StatusBadRequest, "since: %v", err)
+      return
+    }
+    f := MessageFilter{folder: "inbox", owner: owner, after: id[:], limit: apiMaxLimit}
+    err = db.ListMessages(&f, func(msg *Message) error {
+      replay = append(replay, makeMessageJSON(msg))
+      return nil
+    })
+    if err != nil {
+      apiError(w, http.StatusInternalServerError, "%v", err)
+      return
+    }
+  }
+
+  // subscribe before sending the replayed messages so that none are missed in between
+  c := b.subscribe()
+  if c == nil {
+    apiError(w, http.StatusServiceUnavailable, "server is shutting down")
+    return
+  }
+  defer b.unsubscribe(c)
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.Header().Set("X-Accel-Buffering", "no") // disable buffering in nginx
+  w.WriteHeader(http.StatusOK)
+  fmt.Fprintf(w, "retry: %d\n\n", (2 * inboxPollInterval).Milliseconds())
+
+  sent := map[string]bool{}
+  for i := len(replay) - 1; i >= 0; i-- { // oldest first
+    writeEvent(w, &replay[i])
+    sent[replay[i].Id] = true
+  }
+  flusher.Flush()
+
+  keepalive := time.NewTicker(eventKeepaliveInterval)
+  defer keepalive.Stop()
+  for {
+    select {
+    case <-r.Context().Done(): // client disconnected
+      return
+    case <-c.done:
+      return
+    case <-keepalive.C:
+      fmt.Fprint(w, ": keepalive\n\n")
+    case m := <-c.ch:
+      if sent[m.Id] {
+        continue
+      }
+      if owner != "" {
+        id, _ := decodeId(m.Id)
+        if ok, err := db.IsMessageOwner(id, owner); err != nil || !ok {
+          continue
+        }
+      }
+      writeEvent(w, &m)
+    }
+    flusher.Flush()
+  }
+}
+
+func writeEvent(w http.ResponseWriter, m *messageJSON) {
+  data, _ := json.Marshal(m)
+  fmt.Fprintf(w, "event: message\nid: %s\ndata: %s\n\n", m.Id, data)
+}
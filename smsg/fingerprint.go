@@ -0,0 +1,130 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "container/list"
+  "crypto/sha256"
+  "io"
+  "io/fs"
+  "os"
+  "sync"
+  "time"
+)
+
+// mtimeResolution is the coarsest resolution of file modification times which smsg
+// expects, that of FAT file systems. A file may be modified again within this time
+// without its modification time changing, and a copy of a file on such a file system
+// may have a modification time which differs from the original by up to this.
+const mtimeResolution = 2 * time.Second
+
+// fileFingerprint returns the SHA-256 of the contents of the file at path
+func fileFingerprint(path string) ([32]byte, error) {
+  var sum [32]byte
+  f, err := os.Open(path)
+  if err != nil {
+    return sum, err
+  }
+  defer f.Close()
+  h := sha256.New()
+  if _, err := io.Copy(h, f); err != nil {
+    return sum, err
+  }
+  h.Sum(sum[:0])
+  return sum, nil
+}
+
+// isLikelyUnchanged returns true if the file at path, with info (or nil to stat it), has
+// the same contents as when rec was recorded, without reading it when its size and
+// modification time tell. It's read, and compared with the fingerprint in rec, when
+// they can't tell because of the resolution of modification times (mtimeResolution):
+//   - its modification time differs from that of rec by less than mtimeResolution, e.g.
+//     it was copied to a FAT file system
+//   - it was indexed less than mtimeResolution after it was modified, so it may have
+//     been modified again without its modification time changing
+func isLikelyUnchanged(path string, info fs.FileInfo, rec IndexedFile) bool {
+  if info == nil {
+    var err error
+    if info, err = os.Stat(path); err != nil {
+      return false
+    }
+  }
+  if info.Size() != rec.size {
+    return false
+  }
+  d := time.Duration(info.ModTime().UnixNano() - rec.mtime)
+  if d < 0 {
+    d = -d
+  }
+  if d >= mtimeResolution {
+    return false
+  }
+  if d == 0 && (rec.indexed == 0 || time.Duration(rec.indexed-rec.mtime) >= mtimeResolution) {
+    return true // note: indexed is 0 for files indexed before it was recorded
+  }
+  if rec.hash == ([32]byte{}) {
+    return false // recorded by a version of smsg which didn't fingerprint files
+  }
+  sum, err := fileFingerprint(path)
+  return err == nil && sum == rec.hash
+}
+
+// fileRecordCacheSize is the number of file records kept by a fileRecordCache
+const fileRecordCacheSize = 1024
+
+// fileRecordCache keeps the most recently looked up records of indexed files in memory,
+// so that files which change repeatedly, e.g. while a sync tool writes them, are not
+// looked up in the database every time
+type fileRecordCache struct {
+  mu      sync.Mutex
+  entries map[string]*list.Element
+  lru     list.List // of *fileRecordEntry, most recently used first
+}
+
+type fileRecordEntry struct {
+  path string
+  rec  IndexedFile
+  ok   bool // false if the file is not indexed
+}
+
+func newFileRecordCache() *fileRecordCache {
+  return &fileRecordCache{entries: map[string]*list.Element{}}
+}
+
+// lookup returns the record of the file at rel (relative to MSGDIR), or false if it's
+// not indexed
+func (c *fileRecordCache) lookup(rel string) (IndexedFile, bool, error) {
+  c.mu.Lock()
+  if e := c.entries[rel]; e != nil {
+    c.lru.MoveToFront(e)
+    ent := e.Value.(*fileRecordEntry)
+    c.mu.Unlock()
+    return ent.rec, ent.ok, nil
+  }
+  c.mu.Unlock()
+  rec, ok, err := db.IndexedFile(rel)
+  if err != nil {
+    return rec, false, err
+  }
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if e := c.entries[rel]; e != nil {
+    c.lru.Remove(e)
+  }
+  c.entries[rel] = c.lru.PushFront(&fileRecordEntry{rel, rec, ok})
+  if c.lru.Len() > fileRecordCacheSize {
+    e := c.lru.Back()
+    c.lru.Remove(e)
+    delete(c.entries, e.Value.(*fileRecordEntry).path)
+  }
+  return rec, ok, nil
+}
+
+// forget removes the record of the file at rel, e.g. since it has been indexed again
+func (c *fileRecordCache) forget(rel string) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if e := c.entries[rel]; e != nil {
+    c.lru.Remove(e)
+    delete(c.entries, rel)
+  }
+}
@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+func TestIsLikelyUnchanged(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "a.msg")
+  mtime := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  // write writes text to the file, modified at mtime plus d
+  write := func(text string, d time.Duration) {
+    t.Helper()
+    if err := os.WriteFile(path, []byte(text), 0600); err != nil {
+      t.Fatal(err)
+    }
+    if err := os.Chtimes(path, mtime.Add(d), mtime.Add(d)); err != nil {
+      t.Fatal(err)
+    }
+  }
+  write("hello", 0)
+  hash, err := fileFingerprint(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  rec := IndexedFile{
+    size:    5,
+    mtime:   mtime.UnixNano(),
+    hash:    hash,
+    indexed: mtime.Add(time.Minute).UnixNano(),
+  }
+  // indexed right after it was modified, so it may have changed since within the
+  // resolution of modification times
+  recent := rec
+  recent.indexed = mtime.Add(500 * time.Millisecond).UnixNano()
+  unhashed := rec
+  unhashed.hash = [32]byte{}
+  unindexed := rec
+  unindexed.indexed = 0
+
+  tests := []struct {
+    name      string
+    text      string
+    d         time.Duration // of the modification time
+    rec       IndexedFile
+    unchanged bool
+  }{
+    {"same", "hello", 0, rec, true},
+    {"other size", "hello!", 0, rec, false},
+    {"modified later", "hello", 2 * time.Second, rec, false},
+    {"modified earlier", "hello", -time.Minute, rec, false},
+    // e.g. copied to a FAT file system, which rounds modification times
+    {"copied", "hello", time.Second, rec, true},
+    {"copied, rounded down", "hello", -time.Second, rec, true},
+    {"modified within resolution", "jello", time.Second, rec, false},
+    {"indexed right after modified", "hello", 0, recent, true},
+    {"modified again right after", "jello", 0, recent, false},
+    {"not fingerprinted", "hello", time.Second, unhashed, false},
+    {"indexed before recorded", "jello", 0, unindexed, true},
+  }
+  for _, test := range tests {
+    write(test.text, test.d)
+    if unchanged := isLikelyUnchanged(path, nil, test.rec); unchanged != test.unchanged {
+      t.Errorf("%s: isLikelyUnchanged = %v; expected %v", test.name, unchanged, test.unchanged)
+    }
+    info, err := os.Stat(path)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if unchanged := isLikelyUnchanged(path, info, test.rec); unchanged != test.unchanged {
+      t.Errorf("%s, with info: isLikelyUnchanged = %v; expected %v",
+        test.name, unchanged, test.unchanged)
+    }
+  }
+
+  os.Remove(path)
+  if isLikelyUnchanged(path, nil, rec) {
+    t.Errorf("isLikelyUnchanged of a deleted file = true")
+  }
+}
+
+func TestFileRecordCache(t *testing.T) {
+  testMsgDir(t)
+  writeTestMessages(t, 2)
+  rel := "inbox/20220601-110000.msg"
+  c := newFileRecordCache()
+  rec, ok, err := c.lookup(rel)
+  if err != nil || !ok || rec.size == 0 {
+    t.Fatalf("lookup(%s) = %+v, %v, %v", rel, rec, ok, err)
+  }
+  if _, ok, err := c.lookup("inbox/missing.msg"); ok || err != nil {
+    t.Errorf("lookup of a file which isn't indexed = %v, %v", ok, err)
+  }
+
+  // records are looked up in the database once, until forgotten
+  if err := db.DeleteFiles([]string{rel}); err != nil {
+    t.Fatal(err)
+  }
+  if rec2, ok, _ := c.lookup(rel); !ok || rec2 != rec {
+    t.Errorf("lookup after the record was deleted = %+v, %v; expected the cached record",
+      rec2, ok)
+  }
+  c.forget(rel)
+  if _, ok, _ := c.lookup(rel); ok {
+    t.Errorf("lookup after forget found the deleted record")
+  }
+
+  // the least recently used records are dropped
+  c = newFileRecordCache()
+  for i := 0; i <= fileRecordCacheSize; i++ {
+    if i == 2 {
+      c.lookup("inbox/0.msg") // used again
+    }
+    c.lookup(fmt.Sprintf("inbox/%d.msg", i))
+  }
+  if len(c.entries) != fileRecordCacheSize || c.lru.Len() != fileRecordCacheSize {
+    t.Errorf("%d entries; expected %d", len(c.entries), fileRecordCacheSize)
+  }
+  if c.entries["inbox/0.msg"] == nil || c.entries["inbox/1.msg"] != nil {
+    t.Errorf("dropped the wrong record")
+  }
+}
@@ -3,7 +3,11 @@ module github.com/rsms/smolmsg
 go 1.18
 
 require (
-	golang.org/x/text v0.3.3
+	github.com/fsnotify/fsnotify v1.4.9
+	golang.org/x/crypto v0.0.0-20211108221036-ceb1ce70b4fa
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
+	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211
+	golang.org/x/text v0.3.6
 	modernc.org/sqlite v1.18.0
 )
 
@@ -0,0 +1,158 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "os"
+  "path/filepath"
+  "regexp"
+  "strings"
+)
+
+// msgIgnoreName is a file in MSGDIR which lists files which are not indexed, like stray
+// files of sync tools, with patterns like those of .gitignore:
+//
+//   *.sync-conflict-*    "*" matches anything but "/", "?" any character but "/"
+//   inbox/drafts/        a trailing "/" matches only directories
+//   /inbox/old*.msg      a pattern with a "/" is relative to MSGDIR, else it matches at
+//                        any depth
+//   **/backup/**         "**" matches any number of directories
+//   !keep.msg            "!" includes files excluded by an earlier pattern again
+//
+// The last pattern which matches a file decides. Files in an excluded directory can't
+// be included again. Blank lines and lines starting with "#" are ignored.
+const msgIgnoreName = ".msgignore"
+
+// defaultIgnorePatterns apply before those of msgIgnoreName
+var defaultIgnorePatterns = []string{"*.tmp", "*.partial", ".tmp/"}
+
+// ignoreRules decides which files in MSGDIR are not indexed (see msgIgnoreName)
+type ignoreRules []ignoreRule
+
+type ignoreRule struct {
+  re      *regexp.Regexp // matches a path relative to MSGDIR, with "/" separators
+  negate  bool           // pattern started with "!"
+  dirOnly bool           // pattern ended with "/"
+}
+
+// loadIgnoreRules returns the default rules and those of MSGDIR/.msgignore, if it exists.
+// Invalid patterns are logged and skipped.
+func loadIgnoreRules() ignoreRules {
+  rules := parseIgnoreRules(strings.Join(defaultIgnorePatterns, "\n"), "")
+  data, err := os.ReadFile(filepath.Join(MSGDIR, msgIgnoreName))
+  if err != nil {
+    if !os.IsNotExist(err) {
+      errlog("%v", err)
+    }
+    return rules
+  }
+  return append(rules, parseIgnoreRules(string(data), msgIgnoreName)...)
+}
+
+// parseIgnoreRules parses patterns, one per line. filename is used in messages about
+// invalid patterns.
+func parseIgnoreRules(patterns, filename string) ignoreRules {
+  var rules ignoreRules
+  s := bufio.NewScanner(strings.NewReader(patterns))
+  for lineno := 1; s.Scan(); lineno++ {
+    line := strings.TrimRight(s.Text(), " \t\r")
+    if line == "" || line[0] == '#' {
+      continue
+    }
+    rule, err := parseIgnoreRule(line)
+    if err != nil {
+      errlog("%s:%d: invalid pattern %q: %v", filename, lineno, line, err)
+      continue
+    }
+    rules = append(rules, rule)
+  }
+  return rules
+}
+
+func parseIgnoreRule(pattern string) (rule ignoreRule, err error) {
+  if pattern[0] == '!' {
+    rule.negate = true
+    pattern = pattern[1:]
+  } else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+    pattern = pattern[1:]
+  }
+  if strings.HasSuffix(pattern, "/") {
+    rule.dirOnly = true
+    pattern = strings.TrimRight(pattern, "/")
+  }
+  if pattern == "" {
+    return rule, errorf("empty pattern")
+  }
+  // a pattern without a "/", other than at the end, matches at any depth
+  anchored := strings.Contains(pattern, "/")
+  pattern = strings.TrimPrefix(pattern, "/")
+
+  var re bytes.Buffer
+  re.WriteString("^")
+  if !anchored {
+    re.WriteString("(?:.*/)?")
+  }
+  for i := 0; i < len(pattern); i++ {
+    c := pattern[i]
+    switch {
+    case strings.HasPrefix(pattern[i:], "**/"):
+      re.WriteString("(?:.*/)?")
+      i += 2
+    case strings.HasPrefix(pattern[i:], "/**") && i+3 == len(pattern):
+      re.WriteString("/.*")
+      i += 2
+    case strings.HasPrefix(pattern[i:], "**"):
+      re.WriteString(".*")
+      i++
+    case c == '*':
+      re.WriteString("[^/]*")
+    case c == '?':
+      re.WriteString("[^/]")
+    case c == '[':
+      end := strings.IndexByte(pattern[i+1:], ']')
+      if end == -1 {
+        return rule, errorf("unterminated [")
+      }
+      class := pattern[i+1 : i+1+end]
+      if strings.HasPrefix(class, "!") {
+        class = "^" + class[1:]
+      }
+      re.WriteString("[" + class + "]")
+      i += end + 1
+    case c == '\\' && i+1 < len(pattern):
+      i++
+      re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+    default:
+      re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+    }
+  }
+  re.WriteString("$")
+  rule.re, err = regexp.Compile(re.String())
+  return rule, err
+}
+
+// ignored returns true if the file or directory at path, which is relative to MSGDIR,
+// is excluded. It doesn't look at the directories path is in (see ignoredPath.)
+func (rules ignoreRules) ignored(path string, isDir bool) bool {
+  path = filepath.ToSlash(path)
+  ignored := false
+  for _, rule := range rules {
+    if rule.negate == ignored && (isDir || !rule.dirOnly) && rule.re.MatchString(path) {
+      ignored = !rule.negate
+    }
+  }
+  return ignored
+}
+
+// ignoredPath is like ignored but also returns true if a directory which the file at
+// path is in is excluded
+func (rules ignoreRules) ignoredPath(path string) bool {
+  path = filepath.ToSlash(path)
+  for i := 0; i < len(path); i++ {
+    if path[i] == '/' && rules.ignored(path[:i], true) {
+      return true
+    }
+  }
+  return rules.ignored(path, false)
+}
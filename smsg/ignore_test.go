@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "testing"
+  "time"
+)
+
+func TestIgnoreRules(t *testing.T) {
+  tests := []struct {
+    patterns string
+    path     string
+    isDir    bool
+    ignored  bool
+  }{
+    {"*.tmp", "inbox/a.tmp", false, true},
+    {"*.tmp", "inbox/a.msg", false, false},
+    {"*.tmp", "a.tmp", false, true},
+    {"*.sync-conflict-*", "inbox/foo.sync-conflict-2024.msg", false, true},
+    {"*", "inbox/a.msg", false, true},
+    {"inbox/*", "inbox/sub/a.msg", false, false},
+    {"?.msg", "inbox/a.msg", false, true},
+    {"?.msg", "inbox/ab.msg", false, false},
+    {"?.msg", "inbox/a/.msg", false, false},
+    {"[ab].msg", "inbox/b.msg", false, true},
+    {"[!ab].msg", "inbox/b.msg", false, false},
+    {"[!ab].msg", "inbox/c.msg", false, true},
+    {`\#a.msg`, "inbox/#a.msg", false, true},
+    {`\!a.msg`, "inbox/!a.msg", false, true},
+    {`a\*.msg`, "inbox/a*.msg", false, true},
+    {`a\*.msg`, "inbox/ab.msg", false, false},
+
+    // anchoring
+    {"/inbox/old*.msg", "inbox/old1.msg", false, true},
+    {"/inbox/old*.msg", "archive/inbox/old1.msg", false, false},
+    {"inbox/old*.msg", "archive/inbox/old1.msg", false, false},
+    {"old*.msg", "archive/inbox/old1.msg", false, true},
+
+    // "**"
+    {"**/backup/**", "inbox/backup/a.msg", false, true},
+    {"**/backup/**", "backup/a.msg", false, true},
+    {"**/backup/**", "inbox/backups/a.msg", false, false},
+    {"inbox/**/a.msg", "inbox/a.msg", false, true},
+    {"inbox/**/a.msg", "inbox/x/y/a.msg", false, true},
+    {"inbox/**", "inbox/x/y/a.msg", false, true},
+    {"inbox/**", "inbox", true, false},
+    {"a**.msg", "inbox/ab/c.msg", false, true},
+
+    // directories
+    {"drafts/", "inbox/drafts", true, true},
+    {"drafts/", "inbox/drafts", false, false},
+    {".tmp/", "inbox/.tmp", true, true},
+
+    // negation: the last matching pattern decides
+    {"*.msg\n!keep.msg", "inbox/keep.msg", false, false},
+    {"*.msg\n!keep.msg", "inbox/other.msg", false, true},
+    {"!keep.msg\n*.msg", "inbox/keep.msg", false, true},
+    {"*.msg\n!keep.msg\nkeep.msg", "inbox/keep.msg", false, true},
+    {"*.msg\n!k*.msg\n!keep.msg", "inbox/keep.msg", false, false},
+    {"!a.msg", "inbox/a.msg", false, false},
+
+    // comments, blank lines and invalid patterns
+    {"# *.msg\n\n", "inbox/a.msg", false, false},
+    {"*.msg   \n", "inbox/a.msg", false, true},
+    {"[a.msg\n*.tmp", "inbox/[a.msg", false, false},
+    {"[a.msg\n*.tmp", "inbox/a.tmp", false, true},
+    {"!\n/", "inbox/a.msg", false, false},
+  }
+  for _, test := range tests {
+    rules := parseIgnoreRules(test.patterns, "test")
+    if ignored := rules.ignored(test.path, test.isDir); ignored != test.ignored {
+      t.Errorf("patterns %q: ignored(%q, %v) = %v; expected %v",
+        test.patterns, test.path, test.isDir, ignored, test.ignored)
+    }
+  }
+}
+
+func TestIgnoredPath(t *testing.T) {
+  rules := parseIgnoreRules("backup/\n!keep.msg\n*.tmp", "test")
+  tests := []struct {
+    path    string
+    ignored bool
+  }{
+    {"inbox/a.msg", false},
+    {"inbox/a.tmp", true},
+    {"inbox/backup/a.msg", true},
+    {"backup/a.msg", true},
+    // files in an excluded directory can't be included again
+    {"inbox/backup/keep.msg", true},
+    {"inbox/backup.msg", false},
+  }
+  for _, test := range tests {
+    if ignored := rules.ignoredPath(test.path); ignored != test.ignored {
+      t.Errorf("ignoredPath(%q) = %v; expected %v", test.path, ignored, test.ignored)
+    }
+  }
+}
+
+func TestLoadIgnoreRules(t *testing.T) {
+  testMsgDir(t)
+  rules := loadIgnoreRules()
+  for _, path := range []string{"inbox/a.tmp", "inbox/a.msg.partial"} {
+    if !rules.ignored(path, false) {
+      t.Errorf("%s isn't ignored by default", path)
+    }
+  }
+  if !rules.ignoredPath("inbox/.tmp/a.msg") {
+    t.Errorf("files in .tmp directories aren't ignored by default")
+  }
+
+  // .msgignore applies after the defaults
+  writeTestFile(t, MSGDIR, msgIgnoreName, "*.sync-conflict-*\n!keep.tmp\n")
+  rules = loadIgnoreRules()
+  if !rules.ignored("inbox/a.sync-conflict-2024.msg", false) {
+    t.Errorf("pattern of %s isn't applied", msgIgnoreName)
+  }
+  if rules.ignored("inbox/keep.tmp", false) {
+    t.Errorf("%s can't include files excluded by default", msgIgnoreName)
+  }
+}
+
+func TestScanSkipsIgnoredFiles(t *testing.T) {
+  testMsgDir(t)
+  writeTestFile(t, MSGDIR, msgIgnoreName, "*.sync-conflict-*\nold/\n")
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  text := testMessageText("Hello", "alice@example.com", tm, "Hello")
+  writeTestFile(t, INBOXDIR, "20220601-100000.msg", text)
+  tm = tm.Add(time.Hour)
+  text = testMessageText("Conflict", "alice@example.com", tm, "Hello")
+  writeTestFile(t, INBOXDIR, "20220601-110000.sync-conflict-2024.msg", text)
+  writeTestFile(t, INBOXDIR, "old/20220601-110000.msg", text)
+  expectScanCounts(t, scanTestFolder(t, "inbox"), 1, 0)
+}
@@ -0,0 +1,250 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "io/fs"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+
+  "github.com/fsnotify/fsnotify"
+)
+
+// inboxSettleDelay is how long a file in INBOXDIR must be unchanged before it's indexed,
+// so that files which are still being written, e.g. by a sync tool, are not read
+const inboxSettleDelay = 500 * time.Millisecond
+
+// inboxWatcher indexes message files as they are added to INBOXDIR and removes the
+// messages of files which are removed from it, from the database.
+// Changes are noticed with notifications from the operating system (watchEvents) or by
+// checking the directory periodically (watchPoll.)
+type inboxWatcher struct {
+  ms      *MessageSyncer
+  ignore  ignoreRules             // files not to index; reloaded by rescan
+  known   map[string]bool         // files seen; true if indexed
+  pending map[string]*pendingFile // files which have changed, until they settle
+  files   *fileRecordCache        // records of indexed files
+}
+
+// pendingFile is the state of a file which has changed, or been removed
+type pendingFile struct {
+  size    int64 // -1 if the file doesn't exist
+  mtime   time.Time
+  changed time.Time // when size or mtime last changed
+}
+
+// watchEvents watches INBOXDIR with notifications from the operating system until the
+// syncer is shut down. It returns an error if INBOXDIR can't be watched this way.
+func (w *inboxWatcher) watchEvents() error {
+  fw, err := fsnotify.NewWatcher()
+  if err != nil {
+    return err
+  }
+  defer fw.Close()
+  if err := w.addDirs(fw, INBOXDIR); err != nil {
+    return err
+  }
+  synclog.Debugf("watching %s", relPath(MSGDIR, INBOXDIR))
+  ticker := time.NewTicker(inboxSettleDelay / 2)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-w.ms.ctx.Done():
+      return nil
+    case now := <-ticker.C:
+      w.settle(now)
+    case ev, ok := <-fw.Events:
+      if !ok {
+        return nil
+      }
+      w.event(fw, ev)
+    case err, ok := <-fw.Errors:
+      if !ok {
+        return nil
+      }
+      // e.g. events were lost because too many happened at once
+      synclog.Debugf("%v; rescanning %s", err, relPath(MSGDIR, INBOXDIR))
+      w.rescan()
+    }
+  }
+}
+
+// watchPoll checks INBOXDIR for changes every inboxPollInterval until the syncer is
+// shut down
+func (w *inboxWatcher) watchPoll() {
+  synclog.Debugf("polling %s", relPath(MSGDIR, INBOXDIR))
+  poll := time.NewTicker(inboxPollInterval)
+  defer poll.Stop()
+  ticker := time.NewTicker(inboxSettleDelay / 2)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-w.ms.ctx.Done():
+      return
+    case <-poll.C:
+      w.rescan()
+    case now := <-ticker.C:
+      w.settle(now)
+    }
+  }
+}
+
+// addDirs watches dir and its subdirectories, except dot directories and ignored ones
+func (w *inboxWatcher) addDirs(fw *fsnotify.Watcher, dir string) error {
+  return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+    if err != nil || !d.IsDir() {
+      return err
+    }
+    if path != dir && (d.Name()[0] == '.' || w.ignore.ignored(relPath(MSGDIR, path), true)) {
+      return filepath.SkipDir
+    }
+    return fw.Add(path)
+  })
+}
+
+func (w *inboxWatcher) event(fw *fsnotify.Watcher, ev fsnotify.Event) {
+  // skip dot files and files in dot directories, like those of sync tools, and files
+  // excluded by msgIgnoreName
+  rel := relPath(INBOXDIR, ev.Name)
+  if rel[0] == '.' || strings.Contains(rel, string(filepath.Separator)+".") {
+    return
+  }
+  if w.ignore.ignoredPath(relPath(MSGDIR, ev.Name)) {
+    return
+  }
+  if strings.HasSuffix(ev.Name, ".msg") {
+    if ev.Op != fsnotify.Chmod {
+      w.touch(ev.Name)
+    }
+    return
+  }
+  if ev.Op&fsnotify.Create != 0 {
+    // a new directory, e.g. the inbox of a new user (see Config.Recipients)
+    if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+      if err := w.addDirs(fw, ev.Name); err != nil {
+        synclog.Errorf("failed to watch %s: %v", relPath(MSGDIR, ev.Name), err)
+      }
+      // files may have been added before the directory was watched
+      w.rescan()
+    }
+  } else if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+    // files in a directory which is moved away are not reported individually
+    prefix := ev.Name + string(filepath.Separator)
+    for file := range w.known {
+      if strings.HasPrefix(file, prefix) {
+        w.touch(file)
+      }
+    }
+  }
+}
+
+// rescan looks for files in INBOXDIR which have been added or removed, or which are now
+// excluded by msgIgnoreName
+func (w *inboxWatcher) rescan() {
+  w.ignore = loadIgnoreRules()
+  files := w.ms.inboxFiles(w.ignore)
+  present := make(map[string]bool, len(files))
+  for _, file := range files {
+    present[file] = true
+    if _, ok := w.known[file]; !ok {
+      w.touch(file)
+    }
+  }
+  for file := range w.known {
+    if !present[file] {
+      w.touch(file)
+    }
+  }
+}
+
+// touch records that file has changed. It's indexed, or its message is removed, once
+// it has settled (see settle.)
+func (w *inboxWatcher) touch(file string) {
+  if w.pending[file] == nil {
+    w.pending[file] = &pendingFile{size: -2, changed: time.Now()} // -2 is "not yet seen"
+  }
+}
+
+// settle indexes or forgets files which have not changed for inboxSettleDelay, or for
+// freshFileAge if they were modified less than freshFileAge ago
+func (w *inboxWatcher) settle(now time.Time) {
+  for file, p := range w.pending {
+    size, mtime := int64(-1), time.Time{}
+    if info, err := os.Stat(file); err == nil {
+      size, mtime = info.Size(), info.ModTime()
+    }
+    if size != p.size || !mtime.Equal(p.mtime) {
+      p.size, p.mtime, p.changed = size, mtime, now
+      continue
+    }
+    if now.Sub(p.changed) < inboxSettleDelay {
+      continue
+    }
+    if size != -1 && now.Sub(mtime) < freshFileAge && now.Sub(p.changed) < freshFileAge {
+      // modified very recently, so it may still be being written in chunks which are
+      // further apart than inboxSettleDelay
+      continue
+    }
+    delete(w.pending, file)
+    if size == -1 || w.ignore.ignoredPath(relPath(MSGDIR, file)) {
+      w.forget(file)
+    } else {
+      w.index(file)
+    }
+  }
+}
+
+// index indexes file, unless it's likely unchanged since it was indexed, e.g. when
+// written again with the same contents by a sync tool. Its message is reported to
+// OnNewMessage handlers if it's new (see indexMessageFile.)
+func (w *inboxWatcher) index(file string) {
+  rel := relPath(MSGDIR, file)
+  rec, ok, err := w.files.lookup(rel)
+  if err != nil {
+    synclog.With("file", rel).Debugf("failed to look up file: %v", err)
+  } else if ok && rec.current && isLikelyUnchanged(file, nil, rec) {
+    w.known[file] = true
+    return
+  }
+  w.files.forget(rel)
+  msg := indexMessageFile(file)
+  // note: a file which failed to parse is indexed again if it changes
+  w.known[file] = msg != nil
+}
+
+// forget removes the message of a file which has been removed from the database
+func (w *inboxWatcher) forget(file string) {
+  if _, ok := w.known[file]; !ok {
+    return
+  }
+  delete(w.known, file)
+  // if the file has a duplicate, that becomes the message's file
+  rel := relPath(MSGDIR, file)
+  w.files.forget(rel)
+  log := synclog.With("file", rel)
+  dups, err := db.Duplicates(rel)
+  if err != nil {
+    log.Errorf("failed to look up duplicates: %v", err)
+  }
+  for _, d := range dups {
+    if _, err := os.Stat(filepath.Join(MSGDIR, d.path)); err != nil {
+      continue
+    }
+    if err := db.MoveMessage(d.id[:], "inbox", "inbox", d.path); err != nil {
+      log.Errorf("failed to update file of message: %v", err)
+    } else if err := db.DeleteFiles([]string{rel}); err != nil {
+      log.Errorf("%v", err)
+    }
+    log.Debugf("file was deleted; its duplicate %s is now the message's file", d.path)
+    return
+  }
+  // note: when smsg moves a message out of the inbox, e.g. to archive it, the database
+  // has been updated by the time the file has settled, so the message isn't removed
+  n, err := db.DeleteMessagesWithFile("inbox", rel)
+  if err != nil {
+    log.Errorf("failed to remove message from database: %v", err)
+  } else if n > 0 {
+    log.Debugf("removed message of deleted file")
+  }
+}
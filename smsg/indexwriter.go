@@ -0,0 +1,124 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "sync"
+  "time"
+)
+
+// indexBatchSize is the largest number of messages which a scan adds to the database in
+// one transaction, and indexBatchInterval is the longest time a message found by a scan
+// waits to be added. Writing one message per transaction is limited by how many times
+// per second the disk can sync, which may be only a few dozen times for a spinning disk
+// or an SD card. A batch is also written once the bodies of its messages add up to
+// indexBatchBytes.
+const (
+  indexBatchSize     = 500
+  indexBatchInterval = 100 * time.Millisecond
+  indexBatchBytes    = 16 << 20
+)
+
+// indexPendingBytes bounds the size of the bodies of the messages which have been read
+// by a scan but not yet added to the database. Workers wait when parsing gets that far
+// ahead of writing, so that a folder of large messages doesn't fill up memory.
+const indexPendingBytes = 4 * indexBatchBytes
+
+// indexWriter adds the messages read by the workers of a scan to the database, in
+// batches (see indexBatchSize.) Its goroutine is the only one writing them, so that
+// workers don't wait for the database, nor for each other, unless they get too far
+// ahead (see indexPendingBytes.)
+type indexWriter struct {
+  msgs    chan *IndexedMessage
+  done    chan struct{} // closed when the goroutine has exited
+  written func(m *IndexedMessage, err error)
+
+  mu      sync.Mutex
+  cond    *sync.Cond // signalled when pending decreases
+  pending int        // size of the bodies of messages put but not yet written
+}
+
+// newIndexWriter starts a writer, which calls written, on its goroutine, for every
+// message once it has been added to the database or failed to be
+func newIndexWriter(written func(m *IndexedMessage, err error)) *indexWriter {
+  w := &indexWriter{
+    msgs:    make(chan *IndexedMessage, indexBatchSize),
+    done:    make(chan struct{}),
+    written: written,
+  }
+  w.cond = sync.NewCond(&w.mu)
+  go w.run()
+  return w
+}
+
+// put queues m to be added to the database. It blocks while the messages queued before
+// it are too large (see indexPendingBytes.)
+func (w *indexWriter) put(m *IndexedMessage) {
+  size := len(m.msg.body)
+  w.mu.Lock()
+  for w.pending > 0 && w.pending+size > indexPendingBytes {
+    w.cond.Wait()
+  }
+  w.pending += size
+  w.mu.Unlock()
+  w.msgs <- m
+}
+
+// close writes the queued messages and stops the writer. put must not be called after.
+// Scans call it also when cancelled, so that the messages which have been read are not
+// read again by the next scan.
+func (w *indexWriter) close() {
+  close(w.msgs)
+  <-w.done
+}
+
+func (w *indexWriter) run() {
+  defer close(w.done)
+  var batch []*IndexedMessage
+  var size int                 // of the bodies of batch
+  var timeout <-chan time.Time // when the batch is due
+  for {
+    select {
+    case m, ok := <-w.msgs:
+      if !ok {
+        w.write(batch)
+        return
+      }
+      batch = append(batch, m)
+      size += len(m.msg.body)
+      if len(batch) == 1 {
+        timeout = time.After(indexBatchInterval)
+      }
+      if len(batch) < indexBatchSize && size < indexBatchBytes {
+        continue
+      }
+    case <-timeout:
+    }
+    w.write(batch)
+    w.mu.Lock()
+    w.pending -= size
+    w.cond.Broadcast()
+    w.mu.Unlock()
+    batch = batch[:0]
+    size = 0
+    timeout = nil
+  }
+}
+
+func (w *indexWriter) write(batch []*IndexedMessage) {
+  if len(batch) == 0 {
+    return
+  }
+  err := db.PutIndexedMessages(batch)
+  if err != nil && len(batch) > 1 {
+    // add them one at a time, so that a message which can't be added doesn't keep the
+    // others out
+    synclog.Debugf("failed to add %d messages at once: %v", len(batch), err)
+    for _, m := range batch {
+      w.written(m, db.PutIndexedMessages([]*IndexedMessage{m}))
+    }
+    return
+  }
+  for _, m := range batch {
+    w.written(m, err)
+  }
+}
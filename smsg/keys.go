@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "crypto/rand"
+  "errors"
+  "os"
+  "path/filepath"
+  "strings"
+
+  "golang.org/x/crypto/curve25519"
+)
+
+// The key file of an identity (Identity.SigningKey) holds its private keys, one per
+// line as "<kind> <base64 key>". The kind of encryption keys is "x25519" (see crypt.go.)
+// Lines of other kinds are kept as they are.
+const keyKindX25519 = "x25519"
+
+// publicKeyPrefix starts the text form of public keys, e.g. "x25519:Jk3…"
+const publicKeyPrefix = keyKindX25519 + ":"
+
+var errNoEncryptionKey = errors.New("no encryption key")
+
+// keyFileDir is where key files created by "key gen" are stored, unless -file is given
+func keyFileDir() string {
+  return filepath.Join(MSGDIR, ".keys")
+}
+
+// readKeyFile returns the key of kind in the key file at path, or nil if there's none
+func readKeyFile(path, kind string) ([]byte, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  s := bufio.NewScanner(bytes.NewReader(data))
+  for s.Scan() {
+    fields := strings.Fields(s.Text())
+    if len(fields) == 2 && fields[0] == kind {
+      key, err := decBase64(fields[1])
+      if err != nil {
+        return nil, errorf("%s: invalid %s key", path, kind)
+      }
+      return key, nil
+    }
+  }
+  return nil, s.Err()
+}
+
+// identityEncryptionKey returns the private encryption key of id, or errNoEncryptionKey
+func identityEncryptionKey(id *Identity) (priv [32]byte, err error) {
+  if id.SigningKey == "" {
+    return priv, errNoEncryptionKey
+  }
+  key, err := readKeyFile(id.SigningKey, keyKindX25519)
+  if err != nil {
+    return priv, errorf("key of %s: %v", id.Address, err)
+  }
+  if key == nil {
+    return priv, errNoEncryptionKey
+  }
+  if len(key) != len(priv) {
+    return priv, errorf("key of %s: invalid %s key in %s", id.Address, keyKindX25519,
+      id.SigningKey)
+  }
+  copy(priv[:], key)
+  return priv, nil
+}
+
+// generateEncryptionKey adds a new encryption key to the key file at path, creating it
+// if needed, and returns its public key
+func generateEncryptionKey(path string) (pub [32]byte, err error) {
+  var priv [32]byte
+  if _, err := rand.Read(priv[:]); err != nil {
+    return pub, err
+  }
+  pubkey, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+  if err != nil {
+    return pub, err
+  }
+  copy(pub[:], pubkey)
+  if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+    return pub, err
+  }
+  f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+  if err != nil {
+    return pub, err
+  }
+  _, err = f.WriteString(keyKindX25519 + " " + encBase64(priv[:]) + "\n")
+  if err2 := f.Close(); err == nil {
+    err = err2
+  }
+  return pub, err
+}
+
+func publicKeyOf(priv [32]byte) (pub [32]byte) {
+  key, _ := curve25519.X25519(priv[:], curve25519.Basepoint)
+  copy(pub[:], key)
+  return
+}
+
+func formatPublicKey(pub [32]byte) string {
+  return publicKeyPrefix + encBase64(pub[:])
+}
+
+func parsePublicKey(s string) (pub [32]byte, err error) {
+  if !strings.HasPrefix(s, publicKeyPrefix) {
+    return pub, errorf("invalid public key %q (expected %s<key>)", s, publicKeyPrefix)
+  }
+  key, err := decBase64(s[len(publicKeyPrefix):])
+  if err != nil || len(key) != len(pub) {
+    return pub, errorf("invalid public key %q", s)
+  }
+  copy(pub[:], key)
+  return pub, nil
+}
+
+// recipientPublicKey returns the public key of the recipient with address, which is one
+// added with "key add" or that of an identity
+func recipientPublicKey(address string) (pub [32]byte, err error) {
+  if s, ok := config.Keys[address]; ok {
+    return parsePublicKey(s)
+  }
+  if id := config.FindIdentity(address); id != nil {
+    priv, err := identityEncryptionKey(id)
+    if err == nil {
+      return publicKeyOf(priv), nil
+    } else if err != errNoEncryptionKey {
+      return pub, err
+    }
+  }
+  return pub, errorf("no public key for %s (add it with \"%s key add\")", address, progname)
+}
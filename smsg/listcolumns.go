@@ -0,0 +1,307 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "os"
+  "strconv"
+  "strings"
+
+  "golang.org/x/term"
+)
+
+// listColumn is a column of message lists (see messageListPrinter). A column added to
+// listColumns can be selected with "list -columns".
+type listColumn struct {
+  name   string // e.g. "from", as given to -columns
+  header string
+  // width is what values are truncated to if truncate is true, and otherwise about how
+  // wide they are, e.g. times. The width of truncated columns adapts to the width of the
+  // terminal (see fitListColumns): flex columns take what the others leave.
+  width    int
+  truncate bool
+  flex     bool
+  // render appends the value of the column for msg to b, truncated to width if the
+  // column is truncated
+  render func(p *messageListPrinter, b []byte, msg *Message, width int) []byte
+  // tsv appends the full value of the column for msg to b for tab-separated output (see
+  // tsv.go), given the labels of msg if the labels column is listed
+  tsv func(b []byte, msg *Message, labels []string) []byte
+}
+
+// idPrefixLen is the length of the prefix of ids in the id column, which is enough to
+// tell messages apart
+const idPrefixLen = 12
+
+// minListColumnWidth is the width below which truncated columns don't shrink to fit the
+// terminal
+const minListColumnWidth = 10
+
+var listColumns = []*listColumn{
+  {name: "id", header: "Id", width: idPrefixLen,
+    render: renderIdColumn, tsv: tsvIdColumn},
+  {name: "from", header: "From", width: 20, truncate: true,
+    render: renderFromColumn, tsv: tsvFromColumn},
+  {name: "to", header: "To", width: 20, truncate: true,
+    render: renderToColumn, tsv: tsvToColumn},
+  {name: "subject", header: "Subject", width: 35, truncate: true, flex: true,
+    render: renderSubjectColumn, tsv: tsvSubjectColumn},
+  {name: "time", header: "Time", width: 18,
+    render: renderTimeColumn, tsv: tsvTimeColumn},
+  {name: "size", header: "Size", width: 9,
+    render: renderSizeColumn, tsv: tsvSizeColumn},
+  {name: "folder", header: "Folder", width: 8,
+    render: renderFolderColumn, tsv: tsvFolderColumn},
+  {name: "labels", header: "Labels", width: 25, truncate: true,
+    render: renderLabelsColumn, tsv: tsvLabelsColumn},
+  {name: "nfiles", header: "Files", width: 5,
+    render: renderFilesColumn, tsv: tsvFilesColumn},
+}
+
+// defaultListColumns and longListColumns are the columns of message lists by default and
+// with "list -l". Tab-separated output has the id of messages by default
+// (defaultTSVColumns), to pass them to other commands.
+var (
+  defaultListColumns = mustParseListColumns("from,subject,time")
+  longListColumns    = mustParseListColumns("id,from,subject,time,size,labels")
+  defaultTSVColumns  = mustParseListColumns("id,from,subject,time")
+)
+
+// parseListColumns parses a comma-separated list of names of columns, like
+// "from,subject,time"
+func parseListColumns(s string) ([]*listColumn, error) {
+  var columns []*listColumn
+  for _, name := range strings.Split(s, ",") {
+    name = strings.TrimSpace(name)
+    c := findListColumn(name)
+    if c == nil {
+      return nil, errorf("unknown column %q (expected %s)", name, listColumnNames())
+    }
+    if hasListColumn(columns, name) {
+      return nil, errorf("column %q given twice", name)
+    }
+    columns = append(columns, c)
+  }
+  return columns, nil
+}
+
+// selectListColumns returns the columns named by -columns, or else the default ones of
+// long or tab-separated output, or of message lists
+func selectListColumns(names string, long, tsv bool) []*listColumn {
+  if names == "" {
+    if long {
+      return longListColumns
+    } else if tsv {
+      return defaultTSVColumns
+    }
+    return defaultListColumns
+  }
+  if long {
+    fatalf("-l and -columns can't be combined")
+  }
+  columns, err := parseListColumns(names)
+  if err != nil {
+    fatalf("-columns: %v", err)
+  }
+  return columns
+}
+
+func mustParseListColumns(s string) []*listColumn {
+  columns, err := parseListColumns(s)
+  if err != nil {
+    panic(err)
+  }
+  return columns
+}
+
+func findListColumn(name string) *listColumn {
+  for _, c := range listColumns {
+    if c.name == name {
+      return c
+    }
+  }
+  return nil
+}
+
+func hasListColumn(columns []*listColumn, name string) bool {
+  for _, c := range columns {
+    if c.name == name {
+      return true
+    }
+  }
+  return false
+}
+
+// listColumnNames returns the names of all columns, like "id, from, … or nfiles"
+func listColumnNames() string {
+  names := make([]string, len(listColumns))
+  for i, c := range listColumns {
+    names[i] = c.name
+  }
+  return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+// fitListColumns returns the widths of columns in rows which start with indent columns
+// of marker and number, so that the rows fit in the terminal if possible: flex columns
+// take the width which the others leave, and other truncated columns shrink when that's
+// not enough. With termwidth 0, e.g. when not writing to a terminal, the columns have
+// their default widths.
+func fitListColumns(columns []*listColumn, indent, termwidth int) []int {
+  widths := make([]int, len(columns))
+  for i, c := range columns {
+    widths[i] = c.width
+  }
+  if termwidth <= 0 {
+    return widths
+  }
+  rest := termwidth - indent - listPadding*(len(columns)-1)
+  nflex := 0
+  for i, c := range columns {
+    if c.flex {
+      nflex++
+    } else {
+      rest -= widths[i]
+    }
+  }
+  for i, c := range columns {
+    if c.flex {
+      widths[i] = imax(rest/nflex, minListColumnWidth)
+      rest -= widths[i]
+      nflex--
+    }
+  }
+  for i, c := range columns {
+    if rest >= 0 {
+      break
+    }
+    if c.truncate && !c.flex && widths[i] > minListColumnWidth {
+      w := imax(widths[i]+rest, minListColumnWidth)
+      rest += widths[i] - w
+      widths[i] = w
+    }
+  }
+  return widths
+}
+
+// stdoutWidth returns the width of the terminal which stdout is, or 0 if it's not one
+func stdoutWidth() int {
+  w, _, err := term.GetSize(int(os.Stdout.Fd()))
+  if err != nil {
+    return 0
+  }
+  return w
+}
+
+func renderIdColumn(p *messageListPrinter, b []byte, msg *Message, width int) []byte {
+  if msg.id == ([24]byte{}) {
+    return append(b, '?') // e.g. listed with -no-db
+  }
+  id := msg.IdString()
+  return append(b, id[:imin(len(id), idPrefixLen)]...)
+}
+
+func renderFromColumn(p *messageListPrinter, b []byte, msg *Message, width int) []byte {
+  if p.recipients {
+    return append(b, recipientsString(msg, width)...)
+  }
+  if isOutgoing(msg) {
+    b = append(b, "→ "...)
+    return append(b, recipientsString(msg, width-2)...)
+  }
+  return append(b, limitStrLen(msg.from.ShortString(), width)...)
+}
+
+func renderToColumn(p *messageListPrinter, b []byte, msg *Message, width int) []byte {
+  return append(b, recipientsString(msg, width)...)
+}
+
+func renderSubjectColumn(p *messageListPrinter, b []byte, msg *Message, width int) []byte {
+  for d := p.depth[msg.id]; d > 0; d-- {
+    b = append(b, "  "...)
+  }
+  b = append(b, limitStrLen(msg.subject, width)...)
+  return append(b, copiesNote(p.copies[msg.id])...)
+}
+
+func renderTimeColumn(p *messageListPrinter, b []byte, msg *Message, width int) []byte {
+  return appendMessageTime(b, p.now, localTime(msg.time))
+}
+
+func renderSizeColumn(p *messageListPrinter, b []byte, msg *Message, width int) []byte {
+  if msg.size == 0 {
+    return append(b, '?') // indexed before sizes were (see Message.Size)
+  }
+  return append(b, humanBytes(msg.size)...)
+}
+
+func renderFolderColumn(p *messageListPrinter, b []byte, msg *Message, width int) []byte {
+  return append(b, msg.folder...)
+}
+
+func renderLabelsColumn(p *messageListPrinter, b []byte, msg *Message, width int) []byte {
+  labels := msg.tags // e.g. listed with -no-db, which has just the sender's labels
+  if p.labels != nil {
+    labels = p.labels[msg.id]
+  }
+  return append(b, limitStrLen(strings.Join(labels, ", "), width)...)
+}
+
+func renderFilesColumn(p *messageListPrinter, b []byte, msg *Message, width int) []byte {
+  if n := msg.FileCount(); n > 0 {
+    b = strconv.AppendInt(b, int64(n), 10)
+  }
+  return b
+}
+
+func tsvIdColumn(b []byte, msg *Message, labels []string) []byte {
+  return msg.AppendId(b)
+}
+
+func tsvFromColumn(b []byte, msg *Message, labels []string) []byte {
+  return appendTSVField(b, msg.from.address)
+}
+
+func tsvToColumn(b []byte, msg *Message, labels []string) []byte {
+  return appendTSVField(b, msg.to.address)
+}
+
+func tsvSubjectColumn(b []byte, msg *Message, labels []string) []byte {
+  return appendTSVField(b, msg.subject)
+}
+
+func tsvTimeColumn(b []byte, msg *Message, labels []string) []byte {
+  return appendTSVTime(b, msg.time)
+}
+
+func tsvSizeColumn(b []byte, msg *Message, labels []string) []byte {
+  if msg.size == 0 {
+    return b // unknown (see Message.Size)
+  }
+  return strconv.AppendInt(b, msg.size, 10)
+}
+
+func tsvFolderColumn(b []byte, msg *Message, labels []string) []byte {
+  return appendTSVField(b, msg.folder)
+}
+
+func tsvLabelsColumn(b []byte, msg *Message, labels []string) []byte {
+  if labels == nil {
+    labels = msg.tags
+  }
+  return appendTSVField(b, strings.Join(labels, ","))
+}
+
+func tsvFilesColumn(b []byte, msg *Message, labels []string) []byte {
+  return strconv.AppendInt(b, int64(msg.FileCount()), 10)
+}
+
+// appendTSVRow appends the fields of columns for msg to b, separated by tabs, for a line
+// of tab-separated output
+func appendTSVRow(b []byte, msg *Message, columns []*listColumn, labels []string) []byte {
+  for i, c := range columns {
+    if i > 0 {
+      b = append(b, '\t')
+    }
+    b = c.tsv(b, msg, labels)
+  }
+  return b
+}
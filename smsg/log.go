@@ -0,0 +1,259 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// logger is the logger of the program. errlog, warnlog and dlog log with it.
+var logger = newLogger(os.Stderr)
+
+// Loggers of parts of the program. Their messages are marked with the name, like
+// "[sync]" in text logs.
+var (
+  synclog     = logger.Named("sync")    // MessageSyncer and inbox watching
+  deliverlog  = logger.Named("deliver") // Deliverer
+  servelog    = logger.Named("serve")   // the HTTP API
+  peerlog     = logger.Named("peer")    // the peer protocol
+  smtplog     = logger.Named("smtp")
+  controllog  = logger.Named("control") // the control socket
+  receiptlog  = logger.Named("receipt")
+  webhooklog  = logger.Named("webhook")
+  dblog       = logger.Named("db")
+  emaillog    = logger.Named("email") // conversion of email to messages
+  pulllog     = logger.Named("pull")
+  sendmaillog = logger.Named("sendmail")
+  trashlog    = logger.Named("trash")
+  watchlog    = logger.Named("watch")
+)
+
+// LogLevel is how much is logged: messages of levels above it are not
+type LogLevel int32
+
+const (
+  LogError LogLevel = iota
+  LogWarn
+  LogInfo  // the default
+  LogDebug // -v or -D
+  LogTrace // -vv; e.g. every file scanned
+)
+
+var logLevelNames = []string{"error", "warn", "info", "debug", "trace"}
+
+func (level LogLevel) String() string {
+  if level >= 0 && int(level) < len(logLevelNames) {
+    return logLevelNames[level]
+  }
+  return strconv.Itoa(int(level))
+}
+
+// parseLogLevel parses the name of a level, like "debug"
+func parseLogLevel(s string) (LogLevel, error) {
+  for i, name := range logLevelNames {
+    if strings.EqualFold(s, name) || (strings.EqualFold(s, "warning") && i == int(LogWarn)) {
+      return LogLevel(i), nil
+    }
+  }
+  return 0, errorf("invalid log level %q (expected %s)", s, strings.Join(logLevelNames, ", "))
+}
+
+// textLogPrefixes are written before messages of each level in text logs
+var textLogPrefixes = []string{"[error] ", "[warning] ", "", "[debug] ", "[trace] "}
+
+// Logger writes log messages, which are diagnostics, to stderr, as text or as JSON
+// objects, one per line.
+// A logger made with Named or With writes to the same output as the logger it was made
+// from and has its name and fields too.
+type Logger struct {
+  out    *logOutput
+  name   string     // part of the program, e.g. "sync"
+  fields []logField // attached to every message
+}
+
+type logField struct {
+  key   string
+  value interface{}
+}
+
+// logOutput is where a logger and those made from it write to
+type logOutput struct {
+  level int32 // LogLevel; atomic
+  json  int32 // 1 if messages are written as JSON; atomic
+  mu    sync.Mutex
+  w     io.Writer // protected by mu
+}
+
+// newLogger returns a logger which writes messages of level LogInfo and below to w
+func newLogger(w io.Writer) *Logger {
+  return &Logger{out: &logOutput{level: int32(LogInfo), w: w}}
+}
+
+// Named returns a logger whose messages are from the part of the program called name,
+// like "sync"
+func (l *Logger) Named(name string) *Logger {
+  l2 := *l
+  l2.name = name
+  return &l2
+}
+
+// With returns a logger whose messages have the field key=value, e.g. a file path or a
+// request id
+func (l *Logger) With(key string, value interface{}) *Logger {
+  l2 := *l
+  l2.fields = append(l.fields[:len(l.fields):len(l.fields)], logField{key, value})
+  return &l2
+}
+
+// SetLevel sets the level of messages which are logged
+func (l *Logger) SetLevel(level LogLevel) { atomic.StoreInt32(&l.out.level, int32(level)) }
+
+// Level returns the level of messages which are logged
+func (l *Logger) Level() LogLevel { return LogLevel(atomic.LoadInt32(&l.out.level)) }
+
+// Enabled returns true if messages of level are logged. It's for skipping the work of
+// producing a message which won't be logged.
+func (l *Logger) Enabled(level LogLevel) bool { return level <= l.Level() }
+
+// SetJSON makes messages be written as JSON objects, one per line, like
+// {"ts":"…","level":"warn","name":"sync","msg":"…","fields":{"file":"…"}}
+func (l *Logger) SetJSON(enable bool) {
+  var v int32
+  if enable {
+    v = 1
+  }
+  atomic.StoreInt32(&l.out.json, v)
+}
+
+// SetOutput sets where messages are written to
+func (l *Logger) SetOutput(w io.Writer) {
+  l.out.mu.Lock()
+  defer l.out.mu.Unlock()
+  l.out.w = w
+}
+
+func (l *Logger) Errorf(format string, arg ...interface{}) { l.logf(LogError, format, arg) }
+func (l *Logger) Warnf(format string, arg ...interface{})  { l.logf(LogWarn, format, arg) }
+func (l *Logger) Infof(format string, arg ...interface{})  { l.logf(LogInfo, format, arg) }
+func (l *Logger) Debugf(format string, arg ...interface{}) { l.logf(LogDebug, format, arg) }
+func (l *Logger) Tracef(format string, arg ...interface{}) { l.logf(LogTrace, format, arg) }
+
+func (l *Logger) logf(level LogLevel, format string, arg []interface{}) {
+  if !l.Enabled(level) {
+    return
+  }
+  msg := fmt.Sprintf(format, arg...)
+  var buf bytes.Buffer
+  if atomic.LoadInt32(&l.out.json) != 0 {
+    l.formatJSON(&buf, level, msg)
+  } else {
+    l.formatText(&buf, level, msg)
+  }
+  l.out.mu.Lock()
+  defer l.out.mu.Unlock()
+  l.out.w.Write(buf.Bytes())
+}
+
+// formatText writes a message like "▎[warning] [sync] message key=value"
+func (l *Logger) formatText(buf *bytes.Buffer, level LogLevel, msg string) {
+  buf.WriteString("▎")
+  if int(level) < len(textLogPrefixes) {
+    buf.WriteString(textLogPrefixes[level])
+  }
+  if l.name != "" {
+    buf.WriteString("[" + l.name + "] ")
+  }
+  buf.WriteString(strings.TrimSuffix(msg, "\n"))
+  for _, f := range l.fields {
+    s := fmt.Sprint(logFieldValue(f.value))
+    if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+      s = strconv.Quote(s)
+    }
+    buf.WriteString(" " + f.key + "=" + s)
+  }
+  buf.WriteByte('\n')
+}
+
+func (l *Logger) formatJSON(buf *bytes.Buffer, level LogLevel, msg string) {
+  type record struct {
+    Ts     string                 `json:"ts"`
+    Level  string                 `json:"level"`
+    Name   string                 `json:"name,omitempty"`
+    Msg    string                 `json:"msg"`
+    Fields map[string]interface{} `json:"fields,omitempty"`
+  }
+  r := record{
+    Ts:    time.Now().Format(time.RFC3339Nano),
+    Level: level.String(),
+    Name:  l.name,
+    Msg:   strings.TrimSuffix(msg, "\n"),
+  }
+  if len(l.fields) > 0 {
+    r.Fields = make(map[string]interface{}, len(l.fields))
+    for _, f := range l.fields {
+      r.Fields[f.key] = logFieldValue(f.value)
+    }
+  }
+  enc := json.NewEncoder(buf)
+  enc.SetEscapeHTML(false)
+  if err := enc.Encode(r); err != nil {
+    // e.g. a field value which can't be encoded
+    fmt.Fprintf(buf, "{\"ts\":%q,\"level\":%q,\"msg\":%q}\n", r.Ts, r.Level, r.Msg)
+  }
+}
+
+// logFieldValue returns the value of a field as it's logged: errors and values with a
+// String method as strings, e.g. time.Duration as "1.5s" rather than 1500000000
+func logFieldValue(v interface{}) interface{} {
+  switch v := v.(type) {
+  case error:
+    return v.Error()
+  case fmt.Stringer:
+    return v.String()
+  }
+  return v
+}
+
+// configureLogging sets the level and format of logger from the command line options and
+// the SMSG_LOG environment variable, a level (see parseLogLevel) and/or "json", separated
+// by commas, like "debug,json". Options which are set take precedence over SMSG_LOG.
+func configureLogging(verbose, veryVerbose, jsonOpt bool) error {
+  level, jsonEnv := LogInfo, false
+  if env := os.Getenv("SMSG_LOG"); env != "" {
+    var names []string
+    for _, s := range strings.Split(env, ",") {
+      if s = strings.TrimSpace(s); strings.EqualFold(s, "json") {
+        jsonEnv = true
+      } else if s != "" {
+        names = append(names, s)
+      }
+    }
+    if len(names) > 1 {
+      return errorf("SMSG_LOG: more than one log level: %s", strings.Join(names, ", "))
+    } else if len(names) == 1 {
+      var err error
+      if level, err = parseLogLevel(names[0]); err != nil {
+        return errorf("SMSG_LOG: %v", err)
+      }
+    }
+  }
+  switch {
+  case veryVerbose:
+    level = LogTrace
+  case verbose || DEBUG:
+    if level < LogDebug {
+      level = LogDebug
+    }
+  }
+  logger.SetLevel(level)
+  logger.SetJSON(jsonEnv || jsonOpt)
+  return nil
+}
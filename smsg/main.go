@@ -5,40 +5,54 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
-	"strings"
+	"runtime/debug"
 )
 
 var (
-	VERSION   string = "0.1.0"
-	BUILDTAG  string = "src" // set at compile time
-	DEBUG     bool   = false
-	MSGDIR    string // root file directory for messages (env: SMSG_MSGDIR)
-	INBOXDIR  string
-	OUTBOXDIR string
-	DBFILE    string
+	VERSION    string = "0.1.0"
+	BUILDTAG   string = "src" // set at compile time
+	DEBUG      bool   = false
+	NODB       bool   // the database is not opened (-no-db; see Command.NoDB)
+	ABSTIME    bool   // times of messages are shown as they are, not relative (-abs-time)
+	MSGDIR     string // root file directory for messages (env: SMSG_MSGDIR)
+	INBOXDIR   string
+	OUTBOXDIR  string
+	SENTDIR    string
+	ARCHIVEDIR string
+	TRASHDIR   string // messages removed with "rm", until purged
+	DRAFTSDIR  string // messages being composed, saved with "compose -draft"
+	TMPDIR     string // temporary files, e.g. messages being written
+	SERVEDIR   string // state of the server, e.g. its self-signed certificate
+	DBFILE     string
+	CONFIGFILE string
+	WORKDIR    string // working directory at startup
 )
 
 var (
-	logger   *log.Logger
-	dlog     = func(_ string, _ ...interface{}) {}
 	db       DB
 	msgsync  MessageSyncer
+	delivery Deliverer
+	config   Config
 	progname string
+
+	// keepRunning is set by commands which run until interrupted, like watch and
+	// serve, to keep main from shutting down when the command function returns.
+	// Such commands stop in exit handlers (see RegisterExitHandler.)
+	keepRunning bool
 )
 
-func dlog1(format string, arg ...interface{}) {
-	logger.Printf("[debug] "+format, arg...)
+func dlog(format string, arg ...interface{}) {
+	logger.Debugf(format, arg...)
 }
 
 func errlog(format string, arg ...interface{}) {
-	logger.Printf("[error] "+format, arg...)
+	logger.Errorf(format, arg...)
 }
 
 func warnlog(format string, arg ...interface{}) {
-	logger.Printf("[warning] "+format, arg...)
+	logger.Warnf(format, arg...)
 }
 
 func cmd_version() {
@@ -47,37 +61,77 @@ func cmd_version() {
 }
 
 func main() {
-	const usagefmt = `
-Usage: %s [options] <command>
-Commands:
-  list         List messages in your inbox (default)
-  read <id>    Read a message
-  send <file>  Send a message
-  serve <dir>  Start a smolmsg server, storing state in <dir>
-Options:
-`
 	progname = os.Args[0]
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, strings.TrimSpace(usagefmt)+"\n", progname)
+		w := flag.CommandLine.Output()
+		fmt.Fprintf(w, "Usage: %s [options] <command>\nCommands:\n", progname)
+		writeCommandList(w)
+		fmt.Fprintf(w, "Options:\n")
 		flag.PrintDefaults()
+		fmt.Fprintf(w, "See %s help <command> for help with a command\n", progname)
+		fmt.Fprintf(w, "Exit status:\n"+
+			"  0 success, 1 failure, 2 invalid options, 3 message not found,\n"+
+			"  4 ambiguous message id, 5 invalid address, 6 message too large,\n"+
+			"  7 invalid message\n")
+		fmt.Fprintf(w, "Environment:\n"+
+			"  SMSG_MSGDIR  messages root directory (see -C)\n"+
+			"  SMSG_LOG     what to log: error, warn, info, debug or trace, and/or json,\n"+
+			"               like \"debug,json\". -v, -vv and -log-json take precedence\n"+
+			"  SMSG_DISPLAY_TZ  time zone to show times in (see -tz of list)\n"+
+			"  SMSG_THEME   color theme: default, light or mono, and/or styles, like\n"+
+			"               \"light,marker_unread=bold+red\" (see theme in the config)\n"+
+			"  NO_COLOR     if set, don't use colors (see -color)\n")
 	}
 	flag.StringVar(&MSGDIR, "C", "",
 		"Set messages root directory.\n"+
 			"Overrides environment variable SMSG_MSGDIR.\n"+
 			"Defaults to ~/.smolmsg")
 	opt_version := flag.Bool("version", false, "Print version and exit")
-	flag.BoolVar(&DEBUG, "D", false, "Enable debug mode")
+	flag.BoolVar(&NODB, "no-db", false,
+		"Don't open the database, e.g. when it's damaged or locked by another process.\n"+
+			"Only list works without it, reading the headers of message files")
+	flag.BoolVar(&ABSTIME, "abs-time", false,
+		"Show the times of messages as dates, like \"Jan 2, 15:04\", rather than like \"3h\".\n"+
+			"Same as abs_time in the config")
+	opt_color := flag.String("color", "",
+		"Use colors `when`: always, never or auto (if stdout is a terminal). Overrides\n"+
+			"environment variable NO_COLOR. Defaults to always, unless NO_COLOR is set")
+	flag.BoolVar(&DEBUG, "D", false, "Enable debug mode. Implies -v")
+	opt_verbose := flag.Bool("v", false, "Log debug messages")
+	opt_veryverbose := flag.Bool("vv", false, "Log debug messages and details, e.g. each file scanned")
+	opt_logjson := flag.Bool("log-json", false,
+		"Log JSON objects, one per line, with the keys ts, level, name, msg and fields")
+	// when invoked as "sendmail", e.g. through a symlink, smsg acts like sendmail
+	if filepath.Base(os.Args[0]) == "sendmail" {
+		os.Args = append([]string{os.Args[0], "sendmail"}, os.Args[1:]...)
+	}
 	flag.Parse()
 
-	logger = log.New(os.Stdout, "▎", 0)
-	if DEBUG {
-		dlog = dlog1
+	// note: log messages go to stderr, so that they don't mix with the output of commands
+	if err := configureLogging(*opt_verbose, *opt_veryverbose, *opt_logjson); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
 
 	if *opt_version {
 		cmd_version()
 	}
 
+	// find command
+	var cmdname = "list"
+	var cmdargs []string
+	if flag.NArg() > 0 {
+		cmdname = flag.Arg(0)
+		cmdargs = flag.Args()[1:]
+	}
+	cmd := findCommand(cmdname)
+	if cmd == nil {
+		unknownCommand(cmdname)
+	}
+	if NODB && !cmd.NoDB {
+		fatalf("%s needs the database, which -no-db leaves closed", cmd.Name)
+	}
+
 	// set MSGDIR
 	if MSGDIR == "" {
 		MSGDIR = os.Getenv("SMSG_MSGDIR")
@@ -88,62 +142,123 @@ Options:
 		}
 	}
 	var err error
-	MSGDIR, err = filepath.Abs(MSGDIR)
+	WORKDIR, err = os.Getwd()
+	must(err)
+	setMsgDir(MSGDIR)
+	if !cmd.NoSetup {
+		openMsgDir()
+	}
+	// note: list, read and stats override this with their -tz flag
+	if err := setDisplayLocation(""); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", progname, err)
+		os.Exit(2)
+	}
+	if err := setColors(*opt_color); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", progname, err)
+		os.Exit(2)
+	}
+	if cmd.Proxy && !cmd.NoSetup && !NODB {
+		if ctl = dialControl(); ctl != nil {
+			RegisterExitHandler(ctl.Close, "control client")
+		}
+	}
+	if !cmd.NoSync && !cmd.NoSetup && !NODB && ctl == nil {
+		startBackground()
+	}
+
+	// call command function
+	fl := flag.NewFlagSet(cmd.Name, flag.ExitOnError)
+	fl.Usage = func() { cmd.PrintUsage(fl) }
+	run := cmd.Setup(fl)
+	if cmd.RawArgs {
+		cmdargs = append([]string{"--"}, cmdargs...)
+	}
+	fl.Parse(cmdargs)
+	run()
+
+	if !keepRunning {
+		Shutdown(0)
+	}
+
+	// run until interrupted by a signal or until Shutdown is called
+	WaitExit()
+}
+
+// setMsgDir sets MSGDIR and the paths in it
+func setMsgDir(dir string) {
+	var err error
+	MSGDIR, err = filepath.Abs(dir)
 	must(err)
 	dlog("MSGDIR=%q", MSGDIR)
 	os.Setenv("SMSG_MSGDIR", MSGDIR)
 	INBOXDIR = filepath.Join(MSGDIR, "inbox")
 	OUTBOXDIR = filepath.Join(MSGDIR, "outbox")
+	SENTDIR = filepath.Join(MSGDIR, "sent")
+	ARCHIVEDIR = filepath.Join(MSGDIR, "archive")
+	TRASHDIR = filepath.Join(MSGDIR, "trash")
+	DRAFTSDIR = filepath.Join(MSGDIR, "drafts")
+	TMPDIR = filepath.Join(MSGDIR, ".tmp")
+	SERVEDIR = filepath.Join(MSGDIR, ".serve")
 	DBFILE = filepath.Join(MSGDIR, "smsg.db")
-	must(os.MkdirAll(INBOXDIR, 0700))
-	must(os.MkdirAll(OUTBOXDIR, 0700))
+	CONFIGFILE = filepath.Join(MSGDIR, "config.json")
+}
+
+// openMsgDir creates the directories of MSGDIR if needed, loads the config and opens
+// the database, unless NODB
+func openMsgDir() {
+	must(createMsgDirs())
 	must(os.Chdir(MSGDIR))
+	must(config.Load(CONFIGFILE))
+	if NODB {
+		return
+	}
 
 	// open database
-	must(db.Open())
-	RegisterExitHandler(db.Close)
+	if err := db.Open(); err != nil {
+		// e.g. the database is damaged, or locked by another process
+		fatalf("%v\n(%s -no-db list lists messages from their files)", err, progname)
+	}
+	RegisterExitHandlerWithPhase(ExitPhaseStorage, db.Close, "database")
+}
 
+// startBackground starts indexing of incoming messages and delivery of outgoing ones
+func startBackground() {
 	// start sync process
 	msgsync.Start()
 
-	// call command function
-	var cmd = "list"
-	var cmdargs []string
-	if flag.NArg() > 0 {
-		cmd = flag.Arg(0)
-		cmdargs = flag.Args()[1:]
-	}
-	switch cmd {
-	case "list", "ls", "l":
-		cmd_list(cmdargs...)
-	case "read", "r":
-		cmd_read(cmdargs...)
-	case "send":
-		cmd_send(cmdargs...)
-	case "serve":
-		cmd_serve(cmdargs...)
-	case "version":
-		cmd_version()
-	case "help":
-		flag.Usage()
-		os.Exit(0)
-	default:
-		fatalf("Unknown command %q\nSee %s -h for help", cmd, os.Args[0])
+	// start delivery of outgoing messages
+	delivery.Start()
+	if n, err := db.CountFailedDeliveries(); err == nil && n > 0 {
+		warnlog("%d %s could not be delivered (see %s outbox)",
+			n, plural(n, "message", "messages"), progname)
 	}
+}
+
+// msgDirs returns the directories in MSGDIR
+func msgDirs() []string {
+	return []string{INBOXDIR, OUTBOXDIR, SENTDIR, ARCHIVEDIR, TRASHDIR, DRAFTSDIR, TMPDIR}
+}
 
-	// TODO: only if no serve is going on
-	Shutdown(0)
+func createMsgDirs() error {
+	for _, dir := range msgDirs() {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// channel closes when all exit handlers have completed
-	<-ExitCh
+func usageAndExit() {
+	flag.Usage()
+	os.Exit(0)
 }
 
+// must exits with fatalf if err is not nil. In debug mode the stack is printed first.
 func must(err error) {
 	if err != nil {
 		if DEBUG {
-			panic(err)
-		} else {
-			fatalf(err)
+			debug.PrintStack()
 		}
+		fatalf(err)
 	}
 }
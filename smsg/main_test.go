@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "context"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+// testMsgDir makes a temporary MSGDIR with an empty config and an open database for a
+// test, like openMsgDir. The database is closed when the test ends.
+func testMsgDir(t testing.TB) {
+  t.Helper()
+  setMsgDir(t.TempDir())
+  if err := createMsgDirs(); err != nil {
+    t.Fatal(err)
+  }
+  config = Config{}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { db.Close() })
+}
+
+// testMessageText returns a message from from to "me@example.com", sent at tm
+func testMessageText(subject, from string, tm time.Time, body string) string {
+  return fmt.Sprintf("subject %s\nfrom %s\nto me@example.com\ntime %s\nbody %d\n%s",
+    subject, from, tm.Format("2006-01-02 15:04:05 -0700"), len(body), body)
+}
+
+// writeTestFile writes a file at dir/name, with a modification time a minute ago so
+// that scans don't take it for a file which is still being written (see freshFileAge),
+// and returns its path
+func writeTestFile(t testing.TB, dir, name, text string) string {
+  t.Helper()
+  path := filepath.Join(dir, name)
+  if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+    t.Fatal(err)
+  }
+  if err := os.WriteFile(path, []byte(text), 0600); err != nil {
+    t.Fatal(err)
+  }
+  mtime := time.Now().Add(-time.Minute)
+  if err := os.Chtimes(path, mtime, mtime); err != nil {
+    t.Fatal(err)
+  }
+  return path
+}
+
+// writeTestMessages writes n messages to the inbox, the i:th one sent i hours after
+// 2022-06-01 10:00 UTC, with the subject "Message <i>", and indexes them
+func writeTestMessages(t testing.TB, n int) {
+  t.Helper()
+  start := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  for i := 1; i <= n; i++ {
+    tm := start.Add(time.Duration(i) * time.Hour)
+    writeTestFile(t, INBOXDIR, tm.Format("20060102-150405")+".msg",
+      testMessageText(fmt.Sprintf("Message %d", i), "alice@example.com", tm, "Hello"))
+  }
+  if s := scanTestFolder(t, "inbox"); s.nfailed > 0 {
+    t.Fatalf("%d messages failed to index", s.nfailed)
+  }
+}
+
+// scanTestFolder indexes the files of folder, like smsg scan
+func scanTestFolder(t testing.TB, folder string) *MessageFileScanner {
+  t.Helper()
+  s := &MessageFileScanner{ctx: context.Background(), folder: folder}
+  if err := s.scan(); err != nil {
+    t.Fatalf("scan %s: %v", folder, err)
+  }
+  return s
+}
+
+// captureStdout returns what fn writes to stdout
+func captureStdout(t testing.TB, fn func()) string {
+  t.Helper()
+  r, w, err := os.Pipe()
+  if err != nil {
+    t.Fatal(err)
+  }
+  stdout := os.Stdout
+  os.Stdout = w
+  done := make(chan []byte)
+  go func() {
+    b, _ := io.ReadAll(r)
+    done <- b
+  }()
+  defer func() {
+    os.Stdout = stdout
+  }()
+  fn()
+  w.Close()
+  return string(<-done)
+}
+
+// runTestCommand runs the command name with args, like main, and returns what it
+// writes to stdout
+func runTestCommand(t testing.TB, name string, args ...string) string {
+  t.Helper()
+  cmd := findCommand(name)
+  if cmd == nil {
+    t.Fatalf("no command %q", name)
+  }
+  fl := flag.NewFlagSet(name, flag.ContinueOnError)
+  run := cmd.Setup(fl)
+  if err := fl.Parse(args); err != nil {
+    t.Fatal(err)
+  }
+  return captureStdout(t, run)
+}
+
+func TestMustClosesDatabase(t *testing.T) {
+  codes, _ := testShutdown(t)
+  testMsgDir(t)
+  RegisterExitHandlerWithPhase(ExitPhaseStorage, db.Close, "database")
+  must(errors.New("failed"))
+  expectExit(t, codes, 1)
+  if db.DB != nil {
+    t.Error("database is still open")
+  }
+}
+
+// fatalf in an exit handler exits right away, rather than waiting for shutdown to finish
+func TestFatalInExitHandler(t *testing.T) {
+  codes, _ := testShutdown(t)
+  RegisterExitHandler(func() { fatalf("failed in exit handler") })
+  fatalf("failed")
+  expectExit(t, codes, 1) // by the handler's fatalf
+  expectExit(t, codes, 1) // once shutdown has finished
+}
@@ -4,13 +4,21 @@ package main
 import (
   "bufio"
   "bytes"
+  "crypto/cipher"
+  "crypto/sha256"
+  "fmt"
   "io"
+  "math/bits"
   "os"
   "path/filepath"
   "strconv"
   "strings"
   "time"
+  "unicode"
+  "unicode/utf8"
 
+  "golang.org/x/crypto/chacha20poly1305"
+  "golang.org/x/net/idna"
   "golang.org/x/text/unicode/norm"
 )
 
@@ -21,12 +29,36 @@ const (
   FIELD_TIME
   FIELD_BODY
   FIELD_FILE
+  FIELD_REPLY_TO
+  FIELD_IN_REPLY_TO
+  FIELD_X_RECEIPT
+  FIELD_EXPIRES
+  FIELD_PRIORITY
+  FIELD_TAGS
+  FIELD_ENC
+  FIELD_SUBJECT_ENC
+  FIELD_BODY_ENC
+  FIELD_FILE_ENC
 )
 
 var fieldtab map[string]int // maps field name to FIELD_ constant
 
 const MAX_BODY_SIZE = 8 * 1024 * 1024 // 8 MiB
 
+// MessageLimits limits the size of a message being parsed, e.g. one received from another
+// host. Zero means no limit. Bodies are always limited to MAX_BODY_SIZE.
+type MessageLimits struct {
+  body  int // max size of the body
+  file  int // max size of each file
+  total int // max size of the whole message, in bytes read
+}
+
+// tooLargeError is returned by ParseReaderLimits when a message exceeds a size limit
+type tooLargeError string
+
+func (e tooLargeError) Error() string        { return string(e) }
+func (e tooLargeError) Is(target error) bool { return target == ErrTooLarge }
+
 // idEpochBase offsets the timestamp to provide a wider range.
 // Effective range (0x0–0xFFFFFFFF): 2020-09-13 12:26:40 – 2156-10-20 18:54:55 (UTC)
 const idEpochBase int64 = 1600000000
@@ -38,6 +70,8 @@ type Author struct {
   name    string
 }
 
+// String returns the author as `"name" address`, or just the address if there's no name,
+// which Parse reads too
 func (a Author) String() string {
   if a.name == "" {
     return a.address
@@ -52,32 +86,153 @@ func (a Author) ShortString() string {
   return a.name
 }
 
+// FieldValue returns the author encoded as the value of a "from" or "to" section. The
+// name is quoted if it wouldn't read back the same bare (see Parse), e.g. when it starts
+// with a quote or space.
+func (a Author) FieldValue() string {
+  if a.name == "" {
+    return a.address
+  }
+  if nameNeedsQuotes(a.name) {
+    return a.address + " " + strconv.Quote(a.name)
+  }
+  return a.address + " " + a.name
+}
+
+// Parse parses the value of a "from" or "to" section: an address optionally followed by
+// a name, which is either the rest of the line or a Go-style quoted string, like
+// `bob@example.com "Bob \"Bobby\" Smith"`. It also reads the form of String, with the
+// quoted name first. A name starting with a quote which isn't a valid quoted string is
+// taken as is, like in messages written before names were quoted.
 func (a *Author) Parse(line []byte) (err error) {
   line = bytes.TrimSpace(line)
   if len(line) == 0 {
     return errorf("missing address")
   }
-  if p := bytes.IndexByte(line, ' '); p != -1 {
-    a.name = string(bytes.TrimSpace(line[p:]))
+  a.name = ""
+  if line[0] == '"' {
+    // `"name" address`
+    if quoted, err := strconv.QuotedPrefix(string(line)); err == nil {
+      a.name, _ = strconv.Unquote(quoted)
+      line = bytes.TrimSpace(line[len(quoted):])
+      a.address, err = normalizeAndValidateAddress(string(line))
+      return err
+    }
+  }
+  if p := bytes.IndexAny(line, " \t"); p != -1 {
+    name := string(bytes.TrimSpace(line[p:]))
+    if unquoted, err := strconv.Unquote(name); err == nil && name[0] == '"' {
+      name = unquoted
+    }
+    a.name = name
     line = line[:p]
   }
   a.address, err = normalizeAndValidateAddress(string(line))
   return err
 }
 
+// nameNeedsQuotes returns true if name must be quoted in a "from" or "to" section, to be
+// read back by Author.Parse as it is
+func nameNeedsQuotes(name string) bool {
+  if name[0] == '"' || strings.TrimSpace(name) != name {
+    return true
+  }
+  for _, r := range name {
+    if !unicode.IsPrint(r) {
+      return true
+    }
+  }
+  return false
+}
+
 type Attachment struct {
   name      string
   dataStart int
   dataLen   int
+  srcfile   string // file containing the data at dataStart (set by ParseFile)
+
+  // for an encrypted file ("file-enc"), its encrypted name, and once decrypted (see
+  // Message.Decrypt), the cipher and nonce of its data
+  encName []byte
+  aead    cipher.AEAD
+  nonce   []byte
+}
+
+// Open returns a reader of the attachment's data, read from its source file.
+// The data of an encrypted file is decrypted, which requires the message to have been.
+func (a *Attachment) Open() (io.ReadCloser, error) {
+  if a.encName == nil {
+    return a.openRaw()
+  }
+  if a.aead == nil {
+    return nil, errorf("file is encrypted")
+  }
+  r, err := a.openRaw()
+  if err != nil {
+    return nil, err
+  }
+  defer r.Close()
+  data, err := io.ReadAll(r)
+  if err != nil {
+    return nil, err
+  }
+  if data, err = a.aead.Open(data[:0], a.nonce, data, nil); err != nil {
+    return nil, errorf("encrypted file %q is corrupted (%v)", a.name, err)
+  }
+  return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Size returns the size of the attachment's data, which for an encrypted file is that of
+// its data once decrypted
+func (a *Attachment) Size() int {
+  if a.encName != nil {
+    return imax(0, a.dataLen-chacha20poly1305.Overhead)
+  }
+  return a.dataLen
+}
+
+// openRaw returns a reader of the attachment's data as it's stored in its source file
+func (a *Attachment) openRaw() (io.ReadCloser, error) {
+  if a.srcfile == "" {
+    return nil, errorf("data of file %q is not available", a.name)
+  }
+  f, err := os.Open(a.srcfile)
+  if err != nil {
+    return nil, err
+  }
+  return &attachmentReader{io.NewSectionReader(f, int64(a.dataStart), int64(a.dataLen)), f}, nil
 }
 
+type attachmentReader struct {
+  *io.SectionReader
+  f *os.File
+}
+
+func (r *attachmentReader) Close() error { return r.f.Close() }
+
 type Message struct {
-  id       [24]byte // time + SHA256
-  time     time.Time
-  subject  string
-  from, to Author
-  body     []byte
-  files    []Attachment
+  id          [24]byte // time + SHA256 of the canonical form of the message (see canonical.go)
+  time        time.Time
+  subject     string
+  from, to    Author
+  cc          []Author      // additional recipients (repeated "to" sections)
+  ncc         int           // number of cc, when loaded from the database, which only has "to"
+  replyTo     Author        // where replies should be sent, if not to "from"
+  inReplyTo   [24]byte      // id of the message this is a reply to, or zero
+  receipt     receiptStatus // for a receipt ("x-receipt"), the status of receiptOf
+  receiptOf   [24]byte      // id of the message a receipt is for
+  expires     time.Time     // when the message is to be deleted ("expires"), or zero
+  priority    messagePriority
+  tags        []string           // normalized labels from the "tags" section (see parseTags)
+  enc         *messageEncryption // encrypted parts of an encrypted message, or nil
+  size        int64              // of the encoded message, in bytes, or 0 if unknown (see Size)
+  contentHash [32]byte           // SHA-256 of all but the time of the message (see parseReader)
+  rawHash     [32]byte           // SHA-256 of the message as encoded, e.g. in its file
+  body        []byte
+  files       []Attachment
+  nfiles      int    // number of files, when loaded from the database, which doesn't have them
+  folder      string // e.g. "inbox"
+  file        string // source file, relative to MSGDIR
 }
 
 func (m *Message) Id() []byte {
@@ -117,17 +272,28 @@ func (m *Message) IdTime() time.Time {
   return time.Unix(int64(m.IdTimestamp())+idEpochBase, 0)
 }
 
+// idEncodedLen is the largest length of an encoded message id (see EncodeId): "0"
+// followed by up to 33 base62 digits, since 62^33 > 2^192
+const idEncodedLen = 34
+
 func (m *Message) IdString() string {
-  var buf [50]byte
+  var buf [idEncodedLen]byte
   return string(m.EncodeId(buf[:]))
 }
 
-// EncodeId writes m.id to dst which must be at least 50 bytes.
+// AppendId appends the encoded id of m (see EncodeId) to dst and returns the extended
+// slice. It doesn't allocate when dst has room for idEncodedLen more bytes.
+func (m *Message) AppendId(dst []byte) []byte {
+  var buf [idEncodedLen]byte
+  return append(dst, m.EncodeId(buf[:])...)
+}
+
+// EncodeId writes m.id to dst which must be at least idEncodedLen bytes.
 // Returns the start offset (this function starts writing at the end of dst.)
 func (m *Message) EncodeId(dst []byte) []byte {
   // see https://github.com/rsms/go-uuid/blob/master/uuid.go#L250 for decoder
   const srcBase = 0x100000000
-  const dstBase = 62
+  const dstBase = 62 * 62 * 62 * 62 * 62 // five digits per division; less than srcBase
 
   parts := [6]uint32{
     uint32(m.id[0])<<24 | uint32(m.id[1])<<16 | uint32(m.id[2])<<8 | uint32(m.id[3]),
@@ -140,14 +306,14 @@ func (m *Message) EncodeId(dst []byte) []byte {
 
   n := len(dst)
   bp := parts[:]
-  bq := [6]uint32{}
 
   for len(bp) != 0 {
-    quotient := bq[:0]
+    // divide the number in bp by dstBase, in place
+    quotient := bp[:0]
     remainder := uint64(0)
 
     for _, c := range bp {
-      value := uint64(c) + uint64(remainder)*srcBase
+      value := uint64(c) + remainder*srcBase
       digit := value / dstBase
       remainder = value % dstBase
 
@@ -155,16 +321,62 @@ func (m *Message) EncodeId(dst []byte) []byte {
         quotient = append(quotient, uint32(digit))
       }
     }
+    bp = quotient
 
     // Writes at the end of the destination buffer because we computed the
-    // lowest bits first.
-    n--
-    dst[n] = base62Characters[remainder]
-    bp = quotient
+    // lowest bits first. The remainder is five digits, except for the most
+    // significant ones, which have no leading zeroes.
+    for i := 0; i < 5; i++ {
+      n--
+      dst[n] = base62Characters[remainder%62]
+      remainder /= 62
+      if len(bp) == 0 && remainder == 0 {
+        break
+      }
+    }
   }
   n--
   dst[n] = '0'
-  return dst[n-1:]
+  return dst[n:]
+}
+
+// decodeId parses a message id encoded by EncodeId
+func decodeId(s string) (id [24]byte, err error) {
+  if len(s) < 2 || s[0] != '0' {
+    return id, errorf("invalid id %q", s)
+  }
+  // multiply-and-add into a 192-bit big-endian number, one base62 digit at a time
+  var parts [6]uint64
+  for i := 1; i < len(s); i++ {
+    c := s[i]
+    var digit uint64
+    switch {
+    case c >= '0' && c <= '9':
+      digit = uint64(c - '0')
+    case c >= 'A' && c <= 'Z':
+      digit = uint64(c-'A') + 10
+    case c >= 'a' && c <= 'z':
+      digit = uint64(c-'a') + 36
+    default:
+      return id, errorf("invalid id %q", s)
+    }
+    carry := digit
+    for j := len(parts) - 1; j >= 0; j-- {
+      v := parts[j]*62 + carry
+      parts[j] = v & 0xffffffff
+      carry = v >> 32
+    }
+    if carry != 0 {
+      return id, errorf("invalid id %q (too large)", s)
+    }
+  }
+  for i, v := range parts {
+    id[i*4] = byte(v >> 24)
+    id[i*4+1] = byte(v >> 16)
+    id[i*4+2] = byte(v >> 8)
+    id[i*4+3] = byte(v)
+  }
+  return id, nil
 }
 
 func (m *Message) UpdateIdFromTime() error {
@@ -189,15 +401,94 @@ func (m *Message) UpdateIdFromTime() error {
 }
 
 func (m *Message) ParseReader(r io.Reader, srcsize int, srcname string) error {
-  bufsize := srcsize + 1 // one byte for final read at EOF
-  if bufsize > 4096 {
-    bufsize = 4096
+  return m.ParseReaderLimits(r, srcsize, srcname, MessageLimits{})
+}
+
+// ParseReaderLimits is like ParseReader but fails with a tooLargeError as soon as the
+// message exceeds one of limits, without reading the rest of it
+func (m *Message) ParseReaderLimits(
+  r io.Reader, srcsize int, srcname string, limits MessageLimits,
+) error {
+  return m.parseReader(r, srcsize, srcname, limits, false)
+}
+
+// minParseBufferSize and maxParseBufferSize bound the size of the buffer which messages
+// are read with (see parseBufferSize.) Every line of fields must fit in the buffer, so
+// maxParseBufferSize is the longest a field can be, with its name, e.g. a subject or a
+// recipient with a long name. It used to be 4096, which long subjects and author names
+// can approach; the buffer is only this large for messages at least as large.
+const (
+  minParseBufferSize = 512
+  maxParseBufferSize = 64 * 1024
+)
+
+// parseBufferSize returns the size of the buffer to read a message of srcsize bytes with,
+// or of unknown size if srcsize is 0 or less: the smallest power of two which holds all
+// of the message and the final read at its end, within minParseBufferSize and
+// maxParseBufferSize.
+func parseBufferSize(srcsize int) int {
+  if srcsize <= 0 || srcsize >= maxParseBufferSize {
+    return maxParseBufferSize
+  }
+  size := 1 << bits.Len(uint(srcsize)) // > srcsize, leaving a byte for the final read
+  if size < minParseBufferSize {
+    size = minParseBufferSize
+  }
+  return size
+}
+
+// parseReader parses a message. If headersOnly is true, it stops at the body or the first
+// file, leaving the message without an id (see ParseHeaders.)
+func (m *Message) parseReader(
+  r io.Reader, srcsize int, srcname string, limits MessageLimits, headersOnly bool,
+) (err error) {
+  if limits.total > 0 {
+    lr := &sizeLimitReader{r: r, n: int64(limits.total) + 1}
+    r = lr
+    defer func() {
+      if err != nil && lr.n <= 0 {
+        err = tooLargeError(fmt.Sprintf("message too large (limit %d)", limits.total))
+      }
+    }()
   }
-  bufsize = int(1) << ilog2(uint64(bufsize)) // round to nearest (floor) pow2
+
+  // bodyMemory is the part of parseMemory taken for the body, which is returned once it
+  // has been read, or failed to be
+  var bodyMemory int
+  defer func() { parseMemory.release(bodyMemory) }()
+
+  // spill is the body when it was spilled to disk rather than read into memory, which is
+  // read back once the rest of the message has been parsed. spillEnc is true if it's an
+  // encrypted body ("body-enc".)
+  var spill *spilledBody
+  var spillEnc bool
+  defer func() { spill.remove() }()
+
+  // expiresAfter is the time of an "expires" section with a duration, which is relative
+  // to the time of the message. It's added to m.time once parsed, since "time" may come
+  // after "expires" (see withTime.)
+  var expiresAfter time.Duration
+  defer func() {
+    if err == nil && expiresAfter != 0 {
+      m.expires = m.time.Add(expiresAfter)
+    }
+  }()
+
+  bufsize := parseBufferSize(srcsize)
 
   var lineno, fileno int
-  cr := MakeSHA256HashingCountingReader(r)
+  // note: all data is read from r through cr, whether it's parsed, like fields, or
+  // skipped, like attachments, so the hashes cover all of it regardless of bufsize: cr's
+  // that of the data as is (rawHash), and idh that of its canonical form (the id).
+  // br buffers data which cr has counted but which hasn't been parsed yet.
+  idh := newCanonicalHasher()
+  cr := MakeSHA256HashingCountingReader(io.TeeReader(r, idh))
   br := bufio.NewReaderSize(&cr, bufsize)
+
+  // ch hashes the content of the message: every section but "time" and empty lines, each
+  // line ending with a newline, and the data of the body and files after their sections.
+  // Unlike the id, it's the same for copies of a message sent at different times.
+  ch := sha256.New()
   for {
     lineno++
     line, tooLargeForBuffer, err := br.ReadLine()
@@ -208,14 +499,14 @@ func (m *Message) ParseReader(r io.Reader, srcsize int, srcname string) error {
       return err
     }
     if tooLargeForBuffer {
-      return errorf("%s:%d: field too long", srcname, lineno)
+      return parseErrorf(srcname, lineno, "field too long")
     }
     //dlog("%4d> %q", lineno, line)
 
     // parse field
     p := bytes.IndexByte(line, ' ')
     if p == 0 {
-      return errorf("%s:%d: invalid leading space", srcname, lineno)
+      return parseErrorf(srcname, lineno, "invalid leading space")
     }
     if p == -1 {
       if len(line) == 0 { // skip empty line
@@ -225,12 +516,16 @@ func (m *Message) ParseReader(r io.Reader, srcsize int, srcname string) error {
     }
     key := line[:p]
     field, ok := fieldtab[string(key)]
+    if field != FIELD_TIME || !ok {
+      ch.Write(line)
+      ch.Write([]byte{'\n'})
+    }
     if !ok {
       if strings.HasPrefix(string(key), "x-") {
         // ignore "x-*" fields
         continue
       }
-      return errorf("%s:%d: unknown field %q", srcname, lineno, key)
+      return parseErrorf(srcname, lineno, "unknown field %q", key)
     }
 
     // parse field value
@@ -241,13 +536,45 @@ func (m *Message) ParseReader(r io.Reader, srcsize int, srcname string) error {
 
     case FIELD_FROM: // "from" <address> [<text>]
       if err := m.from.Parse(line[p:]); err != nil {
-        return errorf("%s:%d: %s (%q)", srcname, lineno, err, line)
+        return parseErrorf(srcname, lineno, "%s (%q)", err, line)
       }
 
     case FIELD_TO: // "to" <address> [<text>]
-      if err := m.to.Parse(line[p:]); err != nil {
-        return errorf("%s:%d: %s (%q)", srcname, lineno, err, line)
+      var a Author
+      if err := a.Parse(line[p:]); err != nil {
+        return parseErrorf(srcname, lineno, "%s (%q)", err, line)
+      }
+      if m.to.address == "" {
+        m.to = a
+      } else {
+        m.cc = append(m.cc, a)
+      }
+
+    case FIELD_REPLY_TO: // "reply-to" <address> [<text>]
+      if err := m.replyTo.Parse(line[p:]); err != nil {
+        return parseErrorf(srcname, lineno, "%s (%q)", err, line)
+      }
+
+    case FIELD_IN_REPLY_TO: // "in-reply-to" <id>
+      id, err := decodeId(string(bytes.TrimSpace(line[p:])))
+      if err != nil {
+        return parseErrorf(srcname, lineno, "%s (%q)", err, line)
       }
+      m.inReplyTo = id
+
+    case FIELD_X_RECEIPT: // "x-receipt" <id> "delivered"|"read"
+      fields := strings.Fields(string(line[p:]))
+      if len(fields) != 2 {
+        return parseErrorf(srcname, lineno, "invalid receipt (%q)", line)
+      }
+      id, err := decodeId(fields[0])
+      if err != nil {
+        return parseErrorf(srcname, lineno, "%s (%q)", err, line)
+      }
+      if m.receipt, err = parseReceiptStatus(fields[1]); err != nil {
+        return parseErrorf(srcname, lineno, "%s (%q)", err, line)
+      }
+      m.receiptOf = id
 
     case FIELD_TIME: // "time" <datetime> [<timezoneoffset>]
       // e.g. "2006-01-02 15:04:05 -07:00"
@@ -258,32 +585,112 @@ func (m *Message) ParseReader(r io.Reader, srcsize int, srcname string) error {
       if err != nil {
         t, err = time.Parse("2006-01-02 15:04:05", s)
         if err != nil {
-          return errorf("invalid time format %q (expected %q) %v", s, format, err)
+          return parseErrorf(srcname, lineno, "invalid time format %q (expected %q) %v",
+            s, format, err)
         }
       }
       m.time = t
 
-    case FIELD_BODY: // "body" <bytesize>
-      size, err := strconv.ParseUint(string(bytes.TrimSpace(line[p:])), 10, 64)
+    case FIELD_EXPIRES: // "expires" <datetime> [<timezoneoffset>] | <duration>
+      // e.g. "2006-01-02 15:04:05 -07:00"
+      // e.g. "24h" or "7d", after the time of the message
+      s := string(bytes.TrimSpace(line[p:]))
+      m.expires, expiresAfter = time.Time{}, 0
+      if t, err := time.Parse("2006-01-02 15:04:05 -0700", s); err == nil {
+        m.expires = t
+      } else if t, err := time.Parse("2006-01-02 15:04:05", s); err == nil {
+        m.expires = t
+      } else if d, err := parseDuration(s); err == nil && d > 0 {
+        expiresAfter = d
+      } else {
+        return parseErrorf(srcname, lineno,
+          "invalid expiry %q (expected a time like that of \"time\" or a duration, e.g. 24h)",
+          s)
+      }
+
+    case FIELD_PRIORITY: // "priority" "low"|"normal"|"high"|"urgent"
+      var err error
+      if m.priority, err = parsePriority(string(bytes.TrimSpace(line[p:]))); err != nil {
+        return parseErrorf(srcname, lineno, "%s", err)
+      }
+
+    case FIELD_TAGS: // "tags" <text> ("," <text>)*
+      m.tags = parseTags(string(line[p:]))
+
+    case FIELD_ENC: // "enc" <address> <base64>
+      r, err := parseEncRecipient(string(line[p:]))
       if err != nil {
-        return errorf("%s:%d: invalid integer size %q", srcname, lineno, line[p:])
+        return parseErrorf(srcname, lineno, "%s", err)
       }
-      if size > MAX_BODY_SIZE {
-        return errorf("%s:%d: body too large (%d)", srcname, lineno, size)
+      m.encryption().recipients = append(m.enc.recipients, r)
+
+    case FIELD_SUBJECT_ENC: // "subject-enc" <base64>
+      subject, err := decBase64(string(bytes.TrimSpace(line[p:])))
+      if err != nil {
+        return parseErrorf(srcname, lineno, "invalid encrypted subject (%v)", err)
+      }
+      m.encryption().subject = subject
+
+    case FIELD_BODY, FIELD_BODY_ENC: // "body" <bytesize>, "body-enc" <bytesize>
+      if headersOnly {
+        return nil
       }
-      m.body = make([]byte, size)
-      n, err := io.ReadFull(br, m.body)
+      size, err := strconv.ParseUint(string(bytes.TrimSpace(line[p:])), 10, 64)
       if err != nil {
+        return parseErrorf(srcname, lineno, "invalid integer size %q", line[p:])
+      }
+      if size > MAX_BODY_SIZE || (limits.body > 0 && size > uint64(limits.body)) {
+        return tooLargeError(fmt.Sprintf("%s:%d: body too large (%d)", srcname, lineno, size))
+      }
+      if srcsize > 0 && size > uint64(srcsize) {
+        return parseErrorf(srcname, lineno,
+          "invalid body size %d (beyond end of message file)", size)
+      }
+      // note: a body replaces any previous one, so its part of the budget is returned
+      parseMemory.release(bodyMemory)
+      spill.remove()
+      bodyMemory, spill, spillEnc = 0, nil, false
+      var ok bool
+      if bodyMemory, ok = parseMemory.tryAcquire(int(size), parseBudgetWait); !ok {
+        // the budget is used up by other parsers, so rather than waiting for it, the
+        // body is spilled to disk
+        m.body = nil
+        if spill, err = spillBody(br, int64(size), ch); err == nil {
+          spillEnc = field == FIELD_BODY_ENC
+          continue
+        }
+      } else if srcsize > 0 {
+        m.body = make([]byte, size)
+        _, err = io.ReadFull(br, m.body)
+      } else {
+        // the size of the message is unknown, so rather than allocating size bytes up
+        // front, which a short message could make up to MAX_BODY_SIZE, grow the body as
+        // it's read
+        var buf bytes.Buffer
+        _, err = io.CopyN(&buf, br, int64(size))
+        m.body = buf.Bytes()
+        if m.body == nil {
+          m.body = []byte{}
+        }
+      }
+      if err == io.EOF || err == io.ErrUnexpectedEOF {
+        m.body = m.body[:0]
+        return parseErrorf(srcname, lineno,
+          "invalid body size %d (beyond end of message file)", size)
+      } else if err != nil {
         m.body = m.body[:0]
         return err
       }
-      if n != len(m.body) {
-        m.body = m.body[:0]
-        return errorf("%s:%d: invalid body size %d (beyond end of message file)",
-          srcname, lineno, size)
+      ch.Write(m.body)
+      if field == FIELD_BODY_ENC {
+        // note: the body is left nil, so that it's not stored in the database
+        m.encryption().body, m.body = m.body, nil
       }
 
-    case FIELD_FILE: // "file" <bytesize> [<text>]
+    case FIELD_FILE, FIELD_FILE_ENC: // "file" <bytesize> [<text>], "file-enc" <bytesize> <base64>
+      if headersOnly {
+        return nil
+      }
       fileno++
       line = bytes.TrimSpace(line[p:])
       var file Attachment
@@ -291,18 +698,31 @@ func (m *Message) ParseReader(r io.Reader, srcsize int, srcname string) error {
         file.name = string(bytes.TrimSpace(line[p:]))
         line = line[:p]
       }
-      size64, err := strconv.ParseUint(string(line), 10, strconv.IntSize)
+      // note: at most the largest int, so that size isn't negative
+      size64, err := strconv.ParseUint(string(line), 10, strconv.IntSize-1)
       if err != nil {
-        return errorf("%s:%d: invalid integer size %q", srcname, lineno, line[p:])
+        return parseErrorf(srcname, lineno, "file %d: invalid integer size %q", fileno, line)
       }
       size := int(size64)
-      file.dataStart = cr.nread - br.Buffered()
-      discarded, err := br.Discard(int(size))
-      if discarded < int(size) {
-        return errorf("%s:%d: file %d %q: invalid size %d (beyond end of message file)",
-          srcname, lineno, fileno, file.name, size)
+      if field == FIELD_FILE_ENC {
+        if file.encName, err = decBase64(file.name); err != nil || file.name == "" {
+          return parseErrorf(srcname, lineno, "file %d: invalid encrypted name", fileno)
+        }
+        file.name = ""
       }
-      if err != nil {
+      if limits.file > 0 && size > limits.file {
+        return tooLargeError(fmt.Sprintf("%s:%d: file %d %q too large (%d)",
+          srcname, lineno, fileno, file.name, size))
+      }
+      file.dataStart = cr.nread - br.Buffered() // bytes parsed so far
+      // note: the data is read past rather than parsed. CopyN returns io.EOF when there's
+      // less than size, wherever the message ends; other errors are those of reading.
+      n, err := io.CopyN(ch, br, int64(size))
+      if err == io.EOF || err == io.ErrUnexpectedEOF {
+        return parseErrorf(srcname, lineno,
+          "file %d %q: invalid size %d (beyond end of message file, after %d bytes)",
+          fileno, file.name, size, n)
+      } else if err != nil {
         return err
       }
       file.dataLen = size
@@ -310,16 +730,52 @@ func (m *Message) ParseReader(r io.Reader, srcsize int, srcname string) error {
 
     }
   }
+  if headersOnly {
+    return nil
+  }
+  if spill != nil {
+    body, err := spill.readAll()
+    if err != nil {
+      return err
+    }
+    if spillEnc {
+      m.encryption().body = body
+    } else {
+      m.body = body
+    }
+  }
 
   //err := binary.Write(cr.hash, binary.BigEndian, m.time.Unix())
   // cr.hash.Sum(m.id[4:4])
   var buf [32]byte
-  cr.hash.Sum(buf[:0])
+  idh.Sum(buf[:0])
   copy(m.id[4:], buf[:20])
+  cr.hash.Sum(m.rawHash[:0])
+  m.size = int64(cr.nread)
+  ch.Sum(m.contentHash[:0])
 
   return m.UpdateIdFromTime()
 }
 
+// sizeLimitReader reads from r until n bytes have been read, after which it fails.
+// Set n to one more than the limit to allow reading up to the limit and then EOF.
+type sizeLimitReader struct {
+  r io.Reader
+  n int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+  if l.n <= 0 {
+    return 0, tooLargeError("message too large")
+  }
+  if int64(len(p)) > l.n {
+    p = p[:l.n]
+  }
+  n, err := l.r.Read(p)
+  l.n -= int64(n)
+  return n, err
+}
+
 func (m *Message) ParseFile(srcfile string) error {
   if err := m.SetTimeFromFilename(srcfile); err != nil {
     return err
@@ -338,21 +794,291 @@ func (m *Message) ParseFile(srcfile string) error {
       size = int(size64)
     }
   }
-  return m.ParseReader(f, size, srcfile)
+  if err := m.ParseReader(f, size, srcfile); err != nil {
+    return err
+  }
+  for i := range m.files {
+    m.files[i].srcfile = srcfile
+  }
+  return nil
+}
+
+// ParseHeaders is like ParseFile but reads only the fields of the message up to its body
+// and files, e.g. to list messages without the database. Since the id of a message is a
+// hash of all of it, the message has no id, nor body or files.
+func (m *Message) ParseHeaders(srcfile string) error {
+  if err := m.SetTimeFromFilename(srcfile); err != nil {
+    return err
+  }
+  f, err := os.Open(srcfile)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+  // note: the size is only used to size the read buffer; as it's unknown, the buffer
+  // holds the longest fields which ParseFile accepts
+  return m.parseReader(f, 0, srcfile, MessageLimits{}, true)
+}
+
+// legacyId returns the id which the message had before ids were computed from the
+// canonical form of messages, which differs from its id if it's not in canonical form.
+// It's the zero id for messages which were not parsed.
+func (m *Message) legacyId() (id [24]byte) {
+  if m.rawHash == ([32]byte{}) {
+    return id
+  }
+  copy(id[:4], m.id[:4])
+  copy(id[4:], m.rawHash[:20])
+  return id
+}
+
+// Size returns the size in bytes of the encoded message: its sections, body and files.
+// It's 0 for messages parsed with ParseHeaders and messages indexed before sizes were.
+func (m *Message) Size() int64 {
+  return m.size
+}
+
+// RecipientCount returns the number of recipients of m, including those which are not
+// loaded from the database (see Message.ncc)
+func (m *Message) RecipientCount() int {
+  n := imax(len(m.cc), m.ncc)
+  if m.to.address != "" {
+    n++
+  }
+  return n
+}
+
+// FileCount returns the number of files of m, including those which are not loaded
+// from the database (see Message.nfiles)
+func (m *Message) FileCount() int {
+  return imax(len(m.files), m.nfiles)
+}
+
+// Recipients returns all recipients of the message
+func (m *Message) Recipients() []Author {
+  if m.to.address == "" {
+    return m.cc
+  }
+  return append([]Author{m.to}, m.cc...)
+}
+
+// WriteHeaderTo writes all sections except body and files
+func (m *Message) WriteHeaderTo(w io.Writer) (int64, error) {
+  var buf bytes.Buffer
+  fmt.Fprintf(&buf, "subject %s\n", m.subject)
+  fmt.Fprintf(&buf, "from    %s\n", m.from.FieldValue())
+  for _, a := range m.Recipients() {
+    fmt.Fprintf(&buf, "to      %s\n", a.FieldValue())
+  }
+  if m.replyTo.address != "" {
+    fmt.Fprintf(&buf, "reply-to %s\n", m.replyTo.FieldValue())
+  }
+  if m.inReplyTo != ([24]byte{}) {
+    var idbuf [idEncodedLen]byte
+    r := Message{id: m.inReplyTo}
+    fmt.Fprintf(&buf, "in-reply-to %s\n", r.EncodeId(idbuf[:]))
+  }
+  if m.receipt != receiptNone {
+    r := Message{id: m.receiptOf}
+    fmt.Fprintf(&buf, "x-receipt %s %s\n", r.IdString(), m.receipt)
+  }
+  if !m.time.IsZero() {
+    fmt.Fprintf(&buf, "time    %s\n", m.time.Format("2006-01-02 15:04:05 -0700"))
+  }
+  if !m.expires.IsZero() {
+    fmt.Fprintf(&buf, "expires %s\n", m.expires.Format("2006-01-02 15:04:05 -0700"))
+  }
+  if m.priority != priorityNormal {
+    fmt.Fprintf(&buf, "priority %s\n", m.priority)
+  }
+  if len(m.tags) > 0 {
+    fmt.Fprintf(&buf, "tags    %s\n", strings.Join(m.tags, ", "))
+  }
+  if m.enc != nil {
+    for _, r := range m.enc.recipients {
+      fmt.Fprintf(&buf, "enc %s %s\n", r.address, encBase64(r.stanza))
+    }
+    if m.enc.subject != nil {
+      fmt.Fprintf(&buf, "subject-enc %s\n", encBase64(m.enc.subject))
+    }
+  }
+  return buf.WriteTo(w)
 }
 
+// WriteTo writes the message in its encoded form, which is its canonical form (see
+// canonical.go), so that the hash of what is written is that of its id.
+// Attachment data is streamed from the attachments' source files.
+// The body and files of an encrypted message are written encrypted.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+  n, err := m.WriteHeaderTo(w)
+  if err != nil {
+    return n, err
+  }
+  field, body := "body", m.body
+  if m.enc != nil {
+    field, body = "body-enc", m.enc.body
+  }
+  n2, err := fmt.Fprintf(w, "%s %d\n", field, len(body))
+  n += int64(n2)
+  if err != nil {
+    return n, err
+  }
+  n2, err = w.Write(body)
+  n += int64(n2)
+  for i := range m.files {
+    if err != nil {
+      break
+    }
+    a := &m.files[i]
+    if a.encName != nil {
+      n2, err = fmt.Fprintf(w, "\nfile-enc %d %s\n", a.dataLen, encBase64(a.encName))
+    } else {
+      n2, err = fmt.Fprintf(w, "\nfile %d %s\n", a.dataLen, a.name)
+    }
+    n += int64(n2)
+    if err != nil {
+      break
+    }
+    var r io.ReadCloser
+    if r, err = a.openRaw(); err != nil {
+      break
+    }
+    var n3 int64
+    n3, err = io.Copy(w, r)
+    n += n3
+    r.Close()
+    if err == nil && n3 != int64(a.dataLen) {
+      err = errorf("file %q: short read", a.name)
+    }
+  }
+  return n, err
+}
+
+// Validate checks that all required sections are present
+func (m *Message) Validate() error {
+  if m.subject == "" {
+    return &ParseError{Msg: "missing subject"}
+  }
+  if m.from.address == "" {
+    return &ParseError{Msg: "missing from"}
+  }
+  if m.to.address == "" {
+    return &ParseError{Msg: "missing to"}
+  }
+  if m.body == nil && (m.enc == nil || m.enc.body == nil) {
+    return &ParseError{Msg: "missing body"}
+  }
+  return nil
+}
+
+// invalidAddressError is returned by normalizeAndValidateAddress with the reason why an
+// address is invalid
+type invalidAddressError string
+
+func (e invalidAddressError) Error() string        { return "invalid address: " + string(e) }
+func (e invalidAddressError) Is(target error) bool { return target == ErrInvalidAddress }
+
+// addressIDNA converts the domains of addresses to ASCII, with the mapping of lookups,
+// which e.g. lowercases and normalizes, so that "bücher.example" and
+// "xn--bcher-kva.example" are the same domain
+var addressIDNA = idna.New(
+  idna.MapForLookup(), idna.BidiRule(), idna.VerifyDNSLength(true))
+
+// maxLocalPartLen and maxAddressLen are the longest local part and address of RFC 5321
+const (
+  maxLocalPartLen = 64
+  maxAddressLen   = 254
+)
+
+// normalizeAndValidateAddress returns the canonical form of an address, with its local
+// part lowercased and NFC-normalized and its domain converted to ASCII (punycode), or an
+// invalidAddressError. Local parts may have any non-ASCII characters but spaces and
+// controls; lookalikes of other characters are allowed, as addresses are normalized, not
+// policed.
 func normalizeAndValidateAddress(address string) (string, error) {
   // make sure "café" and "café" use the same UTF-8 sequences
   address = norm.NFC.String(address)
   address = strings.ToLower(address)
 
-  // TODO proper validation
-  if p := strings.IndexByte(address, '@'); p == -1 {
-    return "", errorf("invalid address")
+  local, domain, ok := strings.Cut(address, "@")
+  if !ok {
+    return "", invalidAddressError("missing @")
+  }
+  if strings.IndexByte(domain, '@') != -1 {
+    return "", invalidAddressError("more than one @")
+  }
+  if err := validateLocalPart(local); err != nil {
+    return "", err
+  }
+  if domain == "" {
+    return "", invalidAddressError("empty domain")
+  }
+  // "x.example." is a valid domain name, but would be another address than "x.example"
+  ascii, err := normalizeDomain(domain)
+  if err != nil {
+    return "", invalidAddressError(fmt.Sprintf("invalid domain %q", domain))
+  }
+  address = local + "@" + ascii
+  if len(address) > maxAddressLen {
+    return "", invalidAddressError(fmt.Sprintf("longer than %d bytes", maxAddressLen))
   }
   return address, nil
 }
 
+// normalizeDomain returns the ASCII form of a domain, like the domains of addresses
+// returned by normalizeAndValidateAddress, or an error if it's invalid
+func normalizeDomain(domain string) (string, error) {
+  ascii, err := addressIDNA.ToASCII(norm.NFC.String(domain))
+  if err != nil || ascii == "" || strings.HasSuffix(ascii, ".") {
+    return "", errorf("invalid domain %q", domain)
+  }
+  return ascii, nil
+}
+
+// equalDomains reports whether domains a and b are the same, e.g. "bücher.example" and
+// "XN--BCHER-KVA.example"
+func equalDomains(a, b string) bool {
+  if strings.EqualFold(a, b) {
+    return true
+  }
+  a, err1 := normalizeDomain(a)
+  b, err2 := normalizeDomain(b)
+  return err1 == nil && err2 == nil && a == b
+}
+
+// validateLocalPart checks the part of an address before "@": dot-separated atoms of
+// letters, digits and the symbols of RFC 5322, or of non-ASCII characters (RFC 6531)
+func validateLocalPart(local string) error {
+  if local == "" {
+    return invalidAddressError("empty local part")
+  }
+  if len(local) > maxLocalPartLen {
+    return invalidAddressError(fmt.Sprintf("local part longer than %d bytes", maxLocalPartLen))
+  }
+  if local[0] == '.' || local[len(local)-1] == '.' || strings.Contains(local, "..") {
+    return invalidAddressError("misplaced . in local part")
+  }
+  for _, r := range local {
+    if r == utf8.RuneError {
+      return invalidAddressError("invalid UTF-8 in local part")
+    }
+    if r < utf8.RuneSelf {
+      if !isAtext(byte(r)) && r != '.' {
+        return invalidAddressError(fmt.Sprintf("invalid character %q in local part", r))
+      }
+    } else if unicode.IsSpace(r) || !unicode.IsGraphic(r) {
+      return invalidAddressError(fmt.Sprintf("invalid character %q in local part", r))
+    }
+  }
+  return nil
+}
+
+// isAtext reports whether c is an ASCII character of atoms in addresses (RFC 5322 3.2.3)
+func isAtext(c byte) bool {
+  return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+    strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) != -1
+}
+
 func init() {
   fieldtab = map[string]int{
     "subject": FIELD_SUBJECT,
@@ -361,5 +1087,16 @@ func init() {
     "time":    FIELD_TIME,
     "body":    FIELD_BODY,
     "file":    FIELD_FILE,
+
+    "reply-to":    FIELD_REPLY_TO,
+    "in-reply-to": FIELD_IN_REPLY_TO,
+    "x-receipt":   FIELD_X_RECEIPT,
+    "expires":     FIELD_EXPIRES,
+    "priority":    FIELD_PRIORITY,
+    "tags":        FIELD_TAGS,
+    "enc":         FIELD_ENC,
+    "subject-enc": FIELD_SUBJECT_ENC,
+    "body-enc":    FIELD_BODY_ENC,
+    "file-enc":    FIELD_FILE_ENC,
   }
 }
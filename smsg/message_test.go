@@ -0,0 +1,643 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "math"
+  "math/rand"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "testing/iotest"
+  "time"
+)
+
+// testParse parses a message from r, of size bytes (0 if unknown)
+func testParse(t testing.TB, r io.Reader, size int) *Message {
+  t.Helper()
+  m := &Message{}
+  if err := m.ParseReader(r, size, "test.msg"); err != nil {
+    t.Fatal(err)
+  }
+  return m
+}
+
+// TestParseReaderFinalRead parses a message with a reader which returns its last data
+// along with io.EOF, which must give the same message as other readers
+func TestParseReaderFinalRead(t *testing.T) {
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  text := testMessageText("Hello", "alice@example.com", tm, "Hello, Bob\n") +
+    "file 11 hello.txt\nHello again"
+  want := testParse(t, strings.NewReader(text), len(text))
+  readers := map[string]func() io.Reader{
+    "DataErrReader": func() io.Reader { return iotest.DataErrReader(strings.NewReader(text)) },
+    "OneByteReader": func() io.Reader { return iotest.OneByteReader(strings.NewReader(text)) },
+    "HalfReader":    func() io.Reader { return iotest.HalfReader(strings.NewReader(text)) },
+  }
+  for name, r := range readers {
+    for _, size := range []int{len(text), 0} {
+      m := testParse(t, r(), size)
+      if m.IdString() != want.IdString() || m.rawHash != want.rawHash || m.size != want.size {
+        t.Errorf("%s, size %d: id %s, size %d; expected %s, %d",
+          name, size, m.IdString(), m.size, want.IdString(), want.size)
+      }
+      if len(m.files) != 1 || m.files[0].dataStart != want.files[0].dataStart {
+        t.Errorf("%s, size %d: files %+v; expected %+v", name, size, m.files, want.files)
+      }
+    }
+  }
+  if want.size != int64(len(text)) {
+    t.Errorf("size %d; expected %d", want.size, len(text))
+  }
+}
+
+// TestParseAttachmentOffsets parses messages with files smaller than, as large as and
+// larger than the buffer they're read with, which must have the same id whatever the
+// buffer size and the offsets of their data in the message
+func TestParseAttachmentOffsets(t *testing.T) {
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  for _, sizes := range [][]int{
+    {0},
+    {10},
+    {minParseBufferSize - 1, minParseBufferSize, minParseBufferSize + 1},
+    {maxParseBufferSize - 1},
+    {maxParseBufferSize},
+    {maxParseBufferSize + 1},
+    {10, maxParseBufferSize, 10, maxParseBufferSize + 1, 0},
+  } {
+    var sb strings.Builder
+    sb.WriteString(testMessageText("Files", "alice@example.com", tm, "Hello\n"))
+    var offsets []int
+    for i, size := range sizes {
+      fmt.Fprintf(&sb, "file %d f%d.bin\n", size, i)
+      offsets = append(offsets, sb.Len())
+      for j := 0; j < size; j++ {
+        sb.WriteByte(byte('a' + (i+j)%26))
+      }
+    }
+    text := sb.String()
+    var id string
+    for _, srcsize := range []int{len(text), 0} {
+      for _, oneByte := range []bool{false, true} {
+        var r io.Reader = strings.NewReader(text)
+        if oneByte {
+          r = iotest.OneByteReader(r)
+        }
+        m := testParse(t, r, srcsize)
+        if id == "" {
+          id = m.IdString()
+        } else if m.IdString() != id {
+          t.Errorf("files %v, size %d: id %s; expected %s", sizes, srcsize, m.IdString(), id)
+        }
+        if len(m.files) != len(sizes) {
+          t.Errorf("files %v: parsed %d files", sizes, len(m.files))
+          continue
+        }
+        for i, f := range m.files {
+          if f.dataStart != offsets[i] || f.dataLen != sizes[i] {
+            t.Errorf("files %v, size %d: file %d at %d, %d bytes; expected %d, %d",
+              sizes, srcsize, i, f.dataStart, f.dataLen, offsets[i], sizes[i])
+          }
+        }
+      }
+    }
+  }
+}
+
+// TestParseTruncatedFile parses messages which end before the data of a file, which must
+// fail with the same error whether the size of the message is known and however the
+// reader reports the end of it
+func TestParseTruncatedFile(t *testing.T) {
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  text := testMessageText("Hello", "alice@example.com", tm, "hi")
+  truncated := func(lineno, fileno int, name string, size, n int) string {
+    return fmt.Sprintf("test.msg:%d: file %d %q: invalid size %d "+
+      "(beyond end of message file, after %d bytes)", lineno, fileno, name, size, n)
+  }
+  tests := []struct {
+    name string
+    text string
+    err  string // "" if the message parses
+  }{
+    {"at header boundary", text + "\nfile 10 a.bin\n", truncated(7, 1, "a.bin", 10, 0)},
+    {"mid-file", text + "\nfile 10 a.bin\n12345", truncated(7, 1, "a.bin", 10, 5)},
+    {"second file", text + "\nfile 3 a.bin\nabc\nfile 10 b.bin\n1",
+      truncated(9, 2, "b.bin", 10, 1)},
+    {"empty file at end", text + "\nfile 0 a.bin\n", ""},
+    {"empty file at end without newline", text + "\nfile 0 a.bin", ""},
+  }
+  readers := map[string]func(io.Reader) io.Reader{
+    "Reader":        func(r io.Reader) io.Reader { return r },
+    "DataErrReader": iotest.DataErrReader,
+    "OneByteReader": iotest.OneByteReader,
+  }
+  for _, test := range tests {
+    for name, r := range readers {
+      for _, size := range []int{len(test.text), 0} {
+        var m Message
+        err := m.ParseReader(r(strings.NewReader(test.text)), size, "test.msg")
+        if test.err == "" {
+          if err != nil || len(m.files) != 1 || m.files[0].dataLen != 0 {
+            t.Errorf("%s, %s, size %d: error %v, files %+v",
+              test.name, name, size, err, m.files)
+          }
+        } else if err == nil || err.Error() != test.err {
+          t.Errorf("%s, %s, size %d: error %v; expected %s",
+            test.name, name, size, err, test.err)
+        }
+      }
+    }
+  }
+
+  // errors of reading other than the end of the message are returned as they are
+  errRead := errors.New("read error")
+  data := text + "\nfile 10 a.bin\n12345"
+  r := io.MultiReader(strings.NewReader(data), iotest.ErrReader(errRead))
+  var m Message
+  if err := m.ParseReader(r, len(data)+5, "test.msg"); err != errRead {
+    t.Errorf("error %v; expected %v", err, errRead)
+  }
+}
+
+func TestParseHeaders(t *testing.T) {
+  testMsgDir(t)
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  text := testMessageText("Hello", "alice@example.com", tm, "Hello, Bob\n") +
+    "file 11 hello.txt\nHello again"
+  path := writeTestFile(t, INBOXDIR, "20220601-100000.msg", text)
+  var m Message
+  if err := m.ParseHeaders(path); err != nil {
+    t.Fatal(err)
+  }
+  if m.subject != "Hello" || m.from.address != "alice@example.com" || !m.time.Equal(tm) {
+    t.Errorf("subject %q, from %q, time %v", m.subject, m.from.address, m.time)
+  }
+  if m.body != nil || len(m.files) != 0 || m.id != ([24]byte{}) {
+    t.Errorf("body %q, %d files, id %x; expected none", m.body, len(m.files), m.id)
+  }
+
+  // stops before a body which is truncated
+  text = strings.Replace(testMessageText("Truncated", "alice@example.com", tm, "Hello"),
+    "body 5", "body 100", 1)
+  path = writeTestFile(t, INBOXDIR, "20220601-110000.msg", text)
+  if err := m.ParseHeaders(path); err != nil {
+    t.Errorf("ParseHeaders of a truncated message: %v", err)
+  }
+}
+
+// encodeIdOneDigit is EncodeId as it was before it computed five digits per division,
+// to compare with
+func encodeIdOneDigit(id [24]byte) string {
+  const srcBase = 0x100000000
+  const dstBase = 62
+  var parts [6]uint32
+  for i := range parts {
+    parts[i] = binary.BigEndian.Uint32(id[i*4:])
+  }
+  var dst [idEncodedLen]byte
+  n := len(dst)
+  bp := parts[:]
+  var bq [6]uint32
+  for len(bp) != 0 {
+    quotient := bq[:0]
+    remainder := uint64(0)
+    for _, c := range bp {
+      value := uint64(c) + remainder*srcBase
+      digit := value / dstBase
+      remainder = value % dstBase
+      if len(quotient) != 0 || digit != 0 {
+        quotient = append(quotient, uint32(digit))
+      }
+    }
+    n--
+    dst[n] = base62Characters[remainder]
+    bp = quotient
+  }
+  n--
+  dst[n] = '0'
+  return string(dst[n:])
+}
+
+func TestEncodeId(t *testing.T) {
+  var ids [][24]byte
+  // the number in the last 8 bytes of an id
+  addId := func(hi, lo uint64) {
+    var id [24]byte
+    binary.BigEndian.PutUint64(id[8:], hi)
+    binary.BigEndian.PutUint64(id[16:], lo)
+    ids = append(ids, id)
+  }
+  for _, n := range []uint64{0, 1, 61, 62, 99999, 100000, 100001, 62*62*62*62*62 - 1,
+    62 * 62 * 62 * 62 * 62, math.MaxUint64 - 1, math.MaxUint64} {
+    addId(0, n)
+  }
+  addId(1, 0) // math.MaxUint64 + 1
+  var id [24]byte
+  for i := range id {
+    id[i] = 0xff
+  }
+  ids = append(ids, id)
+  r := rand.New(rand.NewSource(1))
+  for i := 0; i < 100; i++ {
+    r.Read(id[:])
+    ids = append(ids, id)
+  }
+
+  for _, id := range ids {
+    m := &Message{id: id}
+    want := encodeIdOneDigit(id)
+    if s := m.IdString(); s != want {
+      t.Errorf("IdString of %x = %q; expected %q", id, s, want)
+    }
+    if s := string(m.AppendId([]byte("id "))); s != "id "+want {
+      t.Errorf("AppendId of %x = %q; expected %q", id, s, "id "+want)
+    }
+    if decoded, err := decodeId(want); err != nil || decoded != id {
+      t.Errorf("decodeId(%q) = %x, %v; expected %x", want, decoded, err, id)
+    }
+  }
+}
+
+func BenchmarkEncodeId(b *testing.B) {
+  var id [24]byte
+  rand.New(rand.NewSource(1)).Read(id[:])
+  m := &Message{id: id}
+  b.Run("AppendId", func(b *testing.B) {
+    b.ReportAllocs()
+    buf := make([]byte, 0, idEncodedLen)
+    for i := 0; i < b.N; i++ {
+      buf = m.AppendId(buf[:0])
+    }
+  })
+  b.Run("IdString", func(b *testing.B) {
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+      _ = m.IdString()
+    }
+  })
+  b.Run("OneDigit", func(b *testing.B) {
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+      _ = encodeIdOneDigit(id)
+    }
+  })
+}
+
+func TestParseBufferSize(t *testing.T) {
+  tests := []struct{ srcsize, bufsize int }{
+    {0, maxParseBufferSize}, // unknown, e.g. stdin
+    {-1, maxParseBufferSize},
+    {1, minParseBufferSize},
+    {minParseBufferSize - 1, minParseBufferSize},
+    {minParseBufferSize, 2 * minParseBufferSize},
+    {3000, 4096},
+    {4095, 4096},
+    {4096, 8192},
+    {maxParseBufferSize - 1, maxParseBufferSize},
+    {maxParseBufferSize, maxParseBufferSize},
+    {10 << 20, maxParseBufferSize},
+  }
+  for _, test := range tests {
+    if n := parseBufferSize(test.srcsize); n != test.bufsize {
+      t.Errorf("parseBufferSize(%d) = %d; expected %d", test.srcsize, n, test.bufsize)
+    }
+  }
+}
+
+// TestParseLongFields parses messages with subjects around the sizes of the buffers they
+// are read with, of known and unknown size
+func TestParseLongFields(t *testing.T) {
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  for _, n := range []int{
+    minParseBufferSize - 10, minParseBufferSize, minParseBufferSize + 10,
+    2047, 2048, 2049, 3000, 4095, 4096, 4097, 8192, maxParseBufferSize - 100,
+  } {
+    subject := strings.Repeat("x", n-len("subject "))
+    text := testMessageText(subject, "alice@example.com", tm, "Hello")
+    for _, srcsize := range []int{len(text), 0} {
+      for _, oneByte := range []bool{false, true} {
+        var r io.Reader = strings.NewReader(text)
+        if oneByte {
+          r = iotest.OneByteReader(r)
+        }
+        var m Message
+        if err := m.ParseReader(r, srcsize, "test.msg"); err != nil {
+          t.Errorf("%d bytes long subject line, size %d: %v", n, srcsize, err)
+        } else if m.subject != subject || string(m.body) != "Hello" {
+          t.Errorf("%d bytes long subject line, size %d: subject of %d bytes, body %q",
+            n, srcsize, len(m.subject), m.body)
+        }
+      }
+    }
+  }
+
+  subject := strings.Repeat("x", maxParseBufferSize)
+  text := testMessageText(subject, "alice@example.com", tm, "Hello")
+  for _, srcsize := range []int{len(text), 0} {
+    var m Message
+    err := m.ParseReader(strings.NewReader(text), srcsize, "test.msg")
+    if err == nil || !strings.Contains(err.Error(), "field too long") {
+      t.Errorf("subject longer than the buffer, size %d: %v; expected field too long",
+        srcsize, err)
+    }
+  }
+}
+
+// testParseFixture returns a message with a body of bodySize bytes and nfiles files of
+// fileSize bytes each
+func testParseFixture(bodySize, nfiles, fileSize int) []byte {
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  body := strings.Repeat("All work and no play makes Jack a dull boy.\n", bodySize/45+1)
+  var b bytes.Buffer
+  b.WriteString(testMessageText("Fixture", "alice@example.com", tm, body[:bodySize]))
+  data := bytes.Repeat([]byte{0, 1, 2, 0xfe, 0xff, '\n'}, fileSize/6+1)[:fileSize]
+  for i := 0; i < nfiles; i++ {
+    fmt.Fprintf(&b, "\nfile %d file%d.bin\n", fileSize, i)
+    b.Write(data)
+  }
+  return b.Bytes()
+}
+
+func benchmarkParse(b *testing.B, data []byte) {
+  b.SetBytes(int64(len(data)))
+  b.ReportAllocs()
+  for i := 0; i < b.N; i++ {
+    var m Message
+    if err := m.ParseReader(bytes.NewReader(data), len(data), "bench.msg"); err != nil {
+      b.Fatal(err)
+    }
+  }
+}
+
+func BenchmarkParseSmall(b *testing.B) { benchmarkParse(b, testParseFixture(200, 0, 0)) }
+func BenchmarkParseLargeBody(b *testing.B) {
+  benchmarkParse(b, testParseFixture(4<<20, 0, 0))
+}
+func BenchmarkParseManyAttachments(b *testing.B) {
+  benchmarkParse(b, testParseFixture(200, 200, 4096))
+}
+
+// FuzzParseReader checks that parsing any input doesn't panic, and that a valid message
+// is written with WriteTo as a message which parses, and which is written and parsed
+// once more as the same bytes and the same id.
+// The corpus of inputs which caused problems before is in testdata/fuzz/FuzzParseReader.
+func FuzzParseReader(f *testing.F) {
+  f.Add(testParseFixture(0, 0, 0))
+  f.Add(testParseFixture(100, 0, 0))
+  f.Add(testParseFixture(10, 3, 10))
+  f.Add(testParseFixture(10, 1, 0))
+  f.Fuzz(func(t *testing.T, data []byte) {
+    var m Message
+    err := m.ParseReader(bytes.NewReader(data), len(data), "fuzz.msg")
+    var m0 Message
+    err0 := m0.ParseReader(bytes.NewReader(data), 0, "fuzz.msg") // unknown size
+    if err != nil {
+      return
+    }
+    if err0 != nil || m0.id != m.id {
+      t.Fatalf("parsed with the size of the message, but with an unknown size: %v", err0)
+    }
+    if len(m.body) > len(data) {
+      t.Fatalf("body of %d bytes in a message of %d", len(m.body), len(data))
+    }
+    if m.Validate() != nil {
+      return
+    }
+
+    // the data of files is read from the file of the message
+    path := filepath.Join(t.TempDir(), "fuzz.msg")
+    if err := os.WriteFile(path, data, 0600); err != nil {
+      t.Fatal(err)
+    }
+    for i := range m.files {
+      m.files[i].srcfile = path
+    }
+    var encoded bytes.Buffer
+    if _, err := m.WriteTo(&encoded); err != nil {
+      t.Fatalf("WriteTo: %v", err)
+    }
+    var m2 Message
+    err = m2.ParseReader(bytes.NewReader(encoded.Bytes()), encoded.Len(), "fuzz.msg")
+    if err != nil {
+      t.Fatalf("parsing the message written by WriteTo: %v\n%q", err, encoded.Bytes())
+    }
+
+    // what WriteTo writes is its own encoding
+    if err := os.WriteFile(path, encoded.Bytes(), 0600); err != nil {
+      t.Fatal(err)
+    }
+    for i := range m2.files {
+      m2.files[i].srcfile = path
+    }
+    var encoded2 bytes.Buffer
+    if _, err := m2.WriteTo(&encoded2); err != nil {
+      t.Fatalf("WriteTo of the message written by WriteTo: %v", err)
+    }
+    if !bytes.Equal(encoded2.Bytes(), encoded.Bytes()) {
+      t.Fatalf("WriteTo wrote\n%q\nand then\n%q", encoded.Bytes(), encoded2.Bytes())
+    }
+    var m3 Message
+    err = m3.ParseReader(bytes.NewReader(encoded2.Bytes()), encoded2.Len(), "fuzz.msg")
+    if err != nil || m3.id != m2.id {
+      t.Fatalf("id %x after writing again; expected %x (%v)", m3.id, m2.id, err)
+    }
+  })
+}
+
+func TestNormalizeAndValidateAddress(t *testing.T) {
+  long := strings.Repeat("a", maxLocalPartLen)
+  label := strings.Repeat("b", 63)
+  tests := []struct {
+    address  string
+    expected string // normalized address, or the reason why it's invalid
+    valid    bool
+  }{
+    {"bob@example.com", "bob@example.com", true},
+    {"Bob@Example.COM", "bob@example.com", true},
+    {"bob.smith@example.com", "bob.smith@example.com", true},
+    {"bob+tag@sub.example.com", "bob+tag@sub.example.com", true},
+    {"!#$%&'*+-/=?^_`{|}~@example.com", "!#$%&'*+-/=?^_`{|}~@example.com", true},
+    {"a@b", "a@b", true},
+    {"a@localhost", "a@localhost", true},
+    {"a@127.0.0.1", "a@127.0.0.1", true},
+    {"a@my-host.example", "a@my-host.example", true},
+    {long + "@example.com", long + "@example.com", true},
+    {"a@" + label + ".example", "a@" + label + ".example", true},
+
+    // internationalized
+    {"bob@bücher.example", "bob@xn--bcher-kva.example", true},
+    {"bob@BÜCHER.example", "bob@xn--bcher-kva.example", true},
+    {"bob@xn--bcher-kva.example", "bob@xn--bcher-kva.example", true},
+    {"bob@XN--BCHER-KVA.example", "bob@xn--bcher-kva.example", true},
+    {"bob@bu\u0308cher.example", "bob@xn--bcher-kva.example", true},
+    {"bob@日本.example", "bob@xn--wgv71a.example", true},
+    {"bob@ｅｘａｍｐｌｅ.com", "bob@example.com", true},
+    {"café@example.com", "café@example.com", true},
+    {"cafe\u0301@example.com", "café@example.com", true},
+    {"CAFÉ@example.com", "café@example.com", true},
+    {"用户@例子.广告", "用户@xn--fsqu00a.xn--4rr70v", true},
+    {"δοκιμή@παράδειγμα.δοκιμή", "δοκιμή@xn--hxajbheg2az3al.xn--jxalpdlp",
+      true},
+
+    // confusables are accepted, and are other addresses: Cyrillic о and а, fullwidth b
+    {"bоb@example.com", "bоb@example.com", true},
+    {"bob@exаmple.com", "bob@xn--exmple-4nf.com", true},
+    {"ｂob@example.com", "ｂob@example.com", true},
+
+    // invalid
+    {"", "missing @", false},
+    {"bob", "missing @", false},
+    {"bob.example.com", "missing @", false},
+    {"a@b@c", "more than one @", false},
+    {"@example.com", "empty local part", false},
+    {"bob@", "empty domain", false},
+    {"bob smith@example.com", `invalid character ' '`, false},
+    {" bob@example.com", `invalid character ' '`, false},
+    {"bob\t@example.com", `invalid character '\t'`, false},
+    {"bob\u00a0x@example.com", `invalid character '\u00a0'`, false},
+    {"bob\u200bx@example.com", `invalid character '\u200b'`, false},
+    {"bob\x00@example.com", `invalid character '\x00'`, false},
+    {"\"bob\"@example.com", `invalid character '"'`, false},
+    {"bob(x)@example.com", `invalid character '('`, false},
+    {"bob,x@example.com", `invalid character ','`, false},
+    {"bob\xff@example.com", "invalid UTF-8", false},
+    {".bob@example.com", "misplaced .", false},
+    {"bob.@example.com", "misplaced .", false},
+    {"bob..smith@example.com", "misplaced .", false},
+    {long + "a@example.com", "local part longer than", false},
+    {"bob@example.com.", "invalid domain", false},
+    {"bob@.example.com", "invalid domain", false},
+    {"bob@example..com", "invalid domain", false},
+    {"bob@exa mple.com", "invalid domain", false},
+    {"bob@" + label + "b.example", "invalid domain", false},
+    {"bob@xn--zz.example", "invalid domain", false},
+    {"bob@" + strings.Repeat(label+".", 4) + "com", "invalid domain", false},
+    {long + "@" + strings.Repeat(label+".", 3) + "com", "longer than 254", false},
+  }
+  for _, test := range tests {
+    address, err := normalizeAndValidateAddress(test.address)
+    if !test.valid {
+      if err == nil {
+        t.Errorf("%q: valid (%q)", test.address, address)
+      } else if !errors.Is(err, ErrInvalidAddress) ||
+        !strings.Contains(err.Error(), test.expected) {
+        t.Errorf("%q: error %q; expected %q", test.address, err, test.expected)
+      }
+      continue
+    }
+    if err != nil || address != test.expected {
+      t.Errorf("%q = %q, %v; expected %q", test.address, address, err, test.expected)
+      continue
+    }
+    // normalized addresses stay the same
+    if again, err := normalizeAndValidateAddress(address); err != nil || again != address {
+      t.Errorf("%q normalized again = %q, %v", address, again, err)
+    }
+  }
+}
+
+func TestEqualDomains(t *testing.T) {
+  tests := []struct {
+    a, b  string
+    equal bool
+  }{
+    {"example.com", "example.com", true},
+    {"example.com", "EXAMPLE.COM", true},
+    {"bücher.example", "xn--bcher-kva.example", true},
+    {"BÜCHER.example", "XN--BCHER-KVA.example", true},
+    {"example.com", "example.org", false},
+    {"example.com", "exаmple.com", false}, // Cyrillic а
+  }
+  for _, test := range tests {
+    if equal := equalDomains(test.a, test.b); equal != test.equal {
+      t.Errorf("equalDomains(%q, %q) = %v; expected %v", test.a, test.b, equal, test.equal)
+    }
+  }
+}
+
+func TestAuthorParse(t *testing.T) {
+  tests := []struct {
+    line    string
+    address string
+    name    string
+  }{
+    {"bob@example.com", "bob@example.com", ""},
+    {"  Bob@Example.com  ", "bob@example.com", ""},
+    {"bob@example.com Bob Smith", "bob@example.com", "Bob Smith"},
+    {"bob@example.com\tBob  Smith  ", "bob@example.com", "Bob  Smith"},
+    {`bob@example.com "Bob Smith"`, "bob@example.com", "Bob Smith"},
+    {`bob@example.com "Bob \"Bobby\" Smith"`, "bob@example.com", `Bob "Bobby" Smith`},
+    {`bob@example.com " Bob "`, "bob@example.com", " Bob "},
+    {`bob@example.com "é\t\n"`, "bob@example.com", "é\t\n"},
+    {`bob@example.com ""`, "bob@example.com", ""},
+    {`bob@example.com Bob "Bobby" Smith`, "bob@example.com", `Bob "Bobby" Smith`},
+    {`bob@example.com "Bob`, "bob@example.com", `"Bob`}, // not a quoted string
+    {`bob@example.com "Bob" Smith`, "bob@example.com", `"Bob" Smith`},
+    {`"Bob Smith" bob@example.com`, "bob@example.com", "Bob Smith"},
+    {`"Bob \"Bobby\" Smith" bob@example.com`, "bob@example.com", `Bob "Bobby" Smith`},
+    {`"a@b.example" bob@example.com`, "bob@example.com", "a@b.example"},
+    {"bob@example.com a@b.example", "bob@example.com", "a@b.example"},
+    {"bob@bücher.example Bob", "bob@xn--bcher-kva.example", "Bob"},
+  }
+  for _, test := range tests {
+    var a Author
+    if err := a.Parse([]byte(test.line)); err != nil {
+      t.Errorf("Parse(%q): %v", test.line, err)
+    } else if a.address != test.address || a.name != test.name {
+      t.Errorf("Parse(%q) = %q, %q; expected %q, %q",
+        test.line, a.address, a.name, test.address, test.name)
+    }
+  }
+  for _, line := range []string{"", "  ", "Bob Smith", `"Bob" Smith`, "bob@@example.com"} {
+    var a Author
+    if err := a.Parse([]byte(line)); err == nil {
+      t.Errorf("Parse(%q) = %q, %q; expected an error", line, a.address, a.name)
+    }
+  }
+}
+
+// TestAuthorRoundTrip checks that Parse reads authors written by FieldValue and String as
+// they are, and that FieldValue quotes only names which wouldn't read back bare
+func TestAuthorRoundTrip(t *testing.T) {
+  for _, test := range []struct {
+    name   string
+    quoted bool
+  }{
+    {"", false},
+    {"Bob", false},
+    {"Bob Smith", false},
+    {`Bob "Bobby" Smith`, false},
+    {`Bob \ Smith`, false},
+    {`Bob \"Smith\"`, false},
+    {"bob@example.com", false},
+    {"Zoë Åström", false},
+    {"日本 太郎", false},
+    {"\U0001F469\u200D\U0001F4BB", true}, // ZWJ sequence
+    {`"Bob"`, true},
+    {`"`, true},
+    {" Bob", true},
+    {"Bob ", true},
+    {"Bob\tSmith", true},
+    {"Bob\nSmith", true},
+    {"\u200B", true},
+  } {
+    a := Author{address: "bob@example.com", name: test.name}
+    for _, s := range []string{a.FieldValue(), a.String()} {
+      var b Author
+      if err := b.Parse([]byte(s)); err != nil {
+        t.Errorf("name %q: Parse(%q): %v", test.name, s, err)
+      } else if b != a {
+        t.Errorf("name %q: Parse(%q) = %q, %q", test.name, s, b.address, b.name)
+      }
+    }
+    bare := strings.TrimSpace("bob@example.com " + test.name)
+    if quoted := a.FieldValue() != bare; quoted != test.quoted {
+      t.Errorf("name %q: FieldValue() = %q", test.name, a.FieldValue())
+    }
+  }
+}
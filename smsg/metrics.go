@@ -0,0 +1,189 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "fmt"
+  "io"
+  "math"
+  "net/http"
+  "strconv"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// Metrics, exposed in the Prometheus text format by serve -metrics-addr
+var (
+  metricMessagesIndexed = newCounter("smsg_messages_indexed_total",
+    "Messages added to the database")
+  metricMessagesReceived = newCounter("smsg_messages_received_total",
+    "Messages received by serve, with the HTTP API or the peer protocol")
+  metricParseFailures = newCounter("smsg_message_parse_failures_total",
+    "Message files or received messages which could not be parsed")
+  metricDeliveryAttempts = newCounter("smsg_delivery_attempts_total",
+    "Delivery attempts of outgoing messages")
+  metricDeliverySuccesses = newCounter("smsg_delivery_successes_total",
+    "Outgoing messages delivered")
+  metricDeliveryFailures = newCounter("smsg_delivery_failures_total",
+    "Failed delivery attempts of outgoing messages")
+  metricDBWriteSeconds = newHistogram("smsg_db_write_seconds",
+    "Time taken to add a message to the database",
+    []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1})
+  metricNewMessagesDropped = newCounter("smsg_new_messages_dropped_total",
+    "New messages not reported to webhooks and subscribers since they fell behind")
+  metricInboxScanSeconds = newGauge("smsg_inbox_scan_seconds",
+    "Duration of the last scan of the inbox directory")
+  metricHTTPConnections = newGauge("smsg_http_connections_open",
+    "Open connections to the HTTP API")
+  metricAPIAccepted = newCounter("smsg_api_requests_accepted_total",
+    "Requests to the HTTP API which were not rejected by rate limiting")
+  metricAPIRateLimited = newCounter("smsg_api_requests_rate_limited_total",
+    "Requests to the HTTP API rejected for exceeding the rate limit")
+  metricAPITooManyUploads = newCounter("smsg_api_requests_too_many_uploads_total",
+    "Requests to the HTTP API rejected for exceeding the concurrent upload limit")
+)
+
+// metric is a value in the metrics registry
+type metric interface {
+  writeMetric(w io.Writer)
+}
+
+var (
+  metricsMu sync.Mutex // protects metrics
+  metrics   []metric   // in order of registration
+)
+
+func registerMetric(m metric) {
+  metricsMu.Lock()
+  defer metricsMu.Unlock()
+  metrics = append(metrics, m)
+}
+
+// writeMetrics writes all metrics in the Prometheus text format
+func writeMetrics(w io.Writer) {
+  metricsMu.Lock()
+  defer metricsMu.Unlock()
+  for _, m := range metrics {
+    m.writeMetric(w)
+  }
+}
+
+// metricsHandler serves the metrics at /metrics
+func metricsHandler() http.Handler {
+  mux := http.NewServeMux()
+  mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    writeMetrics(w)
+  })
+  return mux
+}
+
+func writeMetricHeader(w io.Writer, name, help, typ string) {
+  fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatMetricValue(v float64) string {
+  if math.IsInf(v, 1) {
+    return "+Inf"
+  }
+  return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counter is a metric which only increases
+type counter struct {
+  name, help string
+  v          uint64
+}
+
+func newCounter(name, help string) *counter {
+  c := &counter{name: name, help: help}
+  registerMetric(c)
+  return c
+}
+
+func (c *counter) Inc() { atomic.AddUint64(&c.v, 1) }
+
+func (c *counter) writeMetric(w io.Writer) {
+  writeMetricHeader(w, c.name, c.help, "counter")
+  fmt.Fprintf(w, "%s %d\n", c.name, atomic.LoadUint64(&c.v))
+}
+
+// gauge is a metric which can go up and down
+type gauge struct {
+  name, help string
+  bits       uint64 // float64
+}
+
+func newGauge(name, help string) *gauge {
+  g := &gauge{name: name, help: help}
+  registerMetric(g)
+  return g
+}
+
+func (g *gauge) Set(v float64) { atomic.StoreUint64(&g.bits, math.Float64bits(v)) }
+
+func (g *gauge) Add(delta float64) {
+  for {
+    old := atomic.LoadUint64(&g.bits)
+    v := math.Float64frombits(old) + delta
+    if atomic.CompareAndSwapUint64(&g.bits, old, math.Float64bits(v)) {
+      return
+    }
+  }
+}
+
+func (g *gauge) writeMetric(w io.Writer) {
+  writeMetricHeader(w, g.name, g.help, "gauge")
+  v := math.Float64frombits(atomic.LoadUint64(&g.bits))
+  fmt.Fprintf(w, "%s %s\n", g.name, formatMetricValue(v))
+}
+
+// histogram counts observations, like durations, in buckets
+type histogram struct {
+  name, help string
+  bounds     []float64 // upper bounds of buckets, ascending
+
+  mu     sync.Mutex
+  counts []uint64 // per bucket, not cumulative; the last is for +Inf
+  sum    float64
+}
+
+func newHistogram(name, help string, bounds []float64) *histogram {
+  h := &histogram{name: name, help: help, bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+  registerMetric(h)
+  return h
+}
+
+func (h *histogram) Observe(v float64) {
+  i := 0
+  for i < len(h.bounds) && v > h.bounds[i] {
+    i++
+  }
+  h.mu.Lock()
+  h.counts[i]++
+  h.sum += v
+  h.mu.Unlock()
+}
+
+// ObserveSince observes the time since start, in seconds
+func (h *histogram) ObserveSince(start time.Time) {
+  h.Observe(time.Since(start).Seconds())
+}
+
+func (h *histogram) writeMetric(w io.Writer) {
+  h.mu.Lock()
+  counts := append([]uint64(nil), h.counts...)
+  sum := h.sum
+  h.mu.Unlock()
+  writeMetricHeader(w, h.name, h.help, "histogram")
+  var n uint64
+  for i, count := range counts {
+    n += count
+    bound := math.Inf(1)
+    if i < len(h.bounds) {
+      bound = h.bounds[i]
+    }
+    fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatMetricValue(bound), n)
+  }
+  fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, formatMetricValue(sum), h.name, n)
+}
@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "io"
+  "os"
+  "sync"
+  "time"
+)
+
+// defaultParseMemory is the size of the bodies which may be read at once by parsers,
+// unless configured otherwise (Config.ParseMemory.) A scan parses many files at once
+// (see scanWorkers) and each may have a body of up to MAX_BODY_SIZE.
+const defaultParseMemory = 64 << 20
+
+// parseBudgetWait is how long a parser waits for the budget to read a body into memory,
+// after which it spills the body to disk instead (see spilledBody)
+var parseBudgetWait = time.Second
+
+// parseBudget bounds the memory used for the bodies of messages being parsed. A parser
+// acquires the size of a body before allocating it and releases it when done parsing.
+// Parsers wait while the budget is used up by others, for up to parseBudgetWait.
+type parseBudget struct {
+  mu     sync.Mutex
+  cond   *sync.Cond // signalled when used decreases
+  limit  int        // 0 until first used
+  used   int
+  spills int // number of times tryAcquire gave up, and a body was spilled to disk
+}
+
+var parseMemory parseBudget
+
+// acquire waits until size bytes of the budget are available and takes them. It returns
+// the number of bytes taken, which is less than size when size is larger than the whole
+// budget, so that a body larger than the budget is read alone rather than never.
+func (b *parseBudget) acquire(size int) int {
+  n, _ := b.tryAcquire(size, -1)
+  return n
+}
+
+// tryAcquire is like acquire but waits at most timeout, or as long as it takes if timeout
+// is negative. ok is false if the budget was still used up by then, and nothing is taken.
+func (b *parseBudget) tryAcquire(size int, timeout time.Duration) (n int, ok bool) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  if b.limit == 0 {
+    b.cond = sync.NewCond(&b.mu)
+    b.limit = defaultParseMemory
+    if config.ParseMemory > 0 {
+      b.limit = config.ParseMemory << 20
+    }
+  }
+  if size > b.limit {
+    size = b.limit
+  }
+  expired := false
+  if timeout >= 0 && b.used > 0 && b.used+size > b.limit {
+    timer := time.AfterFunc(timeout, func() {
+      b.mu.Lock()
+      expired = true
+      b.cond.Broadcast()
+      b.mu.Unlock()
+    })
+    defer timer.Stop()
+  }
+  for b.used > 0 && b.used+size > b.limit {
+    if expired {
+      b.spills++
+      return 0, false
+    }
+    b.cond.Wait()
+  }
+  b.used += size
+  return size, true
+}
+
+// release returns n bytes, as returned by acquire, to the budget
+func (b *parseBudget) release(n int) {
+  if n == 0 {
+    return
+  }
+  b.mu.Lock()
+  b.used -= n
+  b.cond.Broadcast()
+  b.mu.Unlock()
+}
+
+// spilledBody is the body of a message being parsed which was read into a temporary file
+// in TMPDIR, since the budget was used up, rather than into memory. It's read back once
+// the rest of the message has been parsed, so that in the meantime the parser neither
+// holds memory for it nor waits for other parsers.
+type spilledBody struct {
+  f    *os.File
+  size int64
+}
+
+// spillBody copies a body of size bytes from r into a new temporary file, and to w
+func spillBody(r io.Reader, size int64, w io.Writer) (*spilledBody, error) {
+  f, err := os.CreateTemp(TMPDIR, "body-*.tmp")
+  if err != nil {
+    return nil, err
+  }
+  s := &spilledBody{f: f, size: size}
+  if _, err := io.CopyN(io.MultiWriter(f, w), r, size); err != nil {
+    s.remove()
+    return nil, err
+  }
+  return s, nil
+}
+
+// readAll reads the body back from its file and removes the file
+func (s *spilledBody) readAll() ([]byte, error) {
+  defer s.remove()
+  body := make([]byte, s.size)
+  if _, err := s.f.ReadAt(body, 0); err != nil {
+    return nil, err
+  }
+  return body, nil
+}
+
+// remove closes and removes the file of s, if any
+func (s *spilledBody) remove() {
+  if s == nil || s.f == nil {
+    return
+  }
+  s.f.Close()
+  os.Remove(s.f.Name())
+  s.f = nil
+}
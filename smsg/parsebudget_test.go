@@ -0,0 +1,174 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "os"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+// testParseBudget sets the budget of parseMemory to limit bytes for the duration of the
+// test, and checks that all of it has been returned at the end of the test
+func testParseBudget(t *testing.T, limit int) {
+  parseMemory.mu.Lock()
+  prevLimit, prevCond := parseMemory.limit, parseMemory.cond
+  parseMemory.limit = limit
+  parseMemory.cond = sync.NewCond(&parseMemory.mu)
+  parseMemory.spills = 0
+  parseMemory.mu.Unlock()
+  t.Cleanup(func() {
+    parseMemory.mu.Lock()
+    defer parseMemory.mu.Unlock()
+    if parseMemory.used != 0 {
+      t.Errorf("%d bytes of the parse budget weren't returned", parseMemory.used)
+    }
+    parseMemory.limit, parseMemory.cond = prevLimit, prevCond
+  })
+}
+
+// testLargeBodies returns n messages with bodies of size bytes, each different
+func testLargeBodies(n, size int) [][]byte {
+  msgs := make([][]byte, n)
+  for i := range msgs {
+    tm := time.Date(2022, 6, 1, 10+i, 0, 0, 0, time.UTC)
+    line := fmt.Sprintf("Line of message %d.\n", i)
+    body := strings.Repeat(line, size/len(line)+1)[:size]
+    subject := fmt.Sprintf("Message %d", i)
+    msgs[i] = []byte(testMessageText(subject, "alice@example.com", tm, body))
+  }
+  return msgs
+}
+
+// TestParseBudget parses messages with large bodies at once under a budget smaller than
+// their bodies together. Parsers must wait for the budget rather than allocate their
+// bodies, and give the same messages as when parsed one at a time.
+func TestParseBudget(t *testing.T) {
+  const limit = 1 << 20
+  msgs := testLargeBodies(6, 768<<10)
+  msgs = append(msgs, testLargeBodies(1, 2*limit)...) // larger than the whole budget
+  testParseBudget(t, limit)
+
+  expected := make([]*Message, len(msgs))
+  for i, data := range msgs {
+    expected[i] = testParse(t, bytes.NewReader(data), len(data))
+  }
+
+  // while the budget is used up, parsers wait for it
+  held := parseMemory.acquire(limit)
+  type result struct {
+    i   int
+    m   *Message
+    err error
+  }
+  results := make(chan result, len(msgs))
+  for i, data := range msgs {
+    go func(i int, data []byte) {
+      var m Message
+      err := m.ParseReader(bytes.NewReader(data), len(data), "test.msg")
+      results <- result{i, &m, err}
+    }(i, data)
+  }
+  select {
+  case r := <-results:
+    t.Fatalf("message %d parsed while the parse budget was used up (%v)", r.i, r.err)
+  case <-time.After(100 * time.Millisecond):
+  }
+  parseMemory.release(held)
+
+  for range msgs {
+    r := <-results
+    if r.err != nil {
+      t.Fatalf("message %d: %v", r.i, r.err)
+    }
+    e := expected[r.i]
+    if r.m.id != e.id || !bytes.Equal(r.m.body, e.body) {
+      t.Errorf("message %d parsed at once differs from when parsed alone", r.i)
+    }
+  }
+}
+
+// TestParseBudgetSpill parses messages with large bodies while the budget is used up,
+// for longer than parsers wait for it. Their bodies must be spilled to disk, and give the
+// same messages as when parsed in memory.
+func TestParseBudgetSpill(t *testing.T) {
+  testMsgDir(t) // for TMPDIR
+  testParseBudget(t, 1<<20)
+  defer func(wait time.Duration) { parseBudgetWait = wait }(parseBudgetWait)
+  parseBudgetWait = 10 * time.Millisecond
+
+  msgs := testLargeBodies(4, 256<<10)
+  // a file after the body, which is parsed while the body is spilled
+  msgs[0] = append(msgs[0], "\nfile 5 a.txt\nHello"...)
+  expected := make([]*Message, len(msgs))
+  for i, data := range msgs {
+    expected[i] = testParse(t, bytes.NewReader(data), len(data))
+  }
+
+  held := parseMemory.acquire(1 << 20)
+  defer parseMemory.release(held)
+  var wg sync.WaitGroup
+  parsed := make([]Message, len(msgs))
+  errs := make([]error, len(msgs))
+  for i, data := range msgs {
+    wg.Add(1)
+    go func(i int, data []byte) {
+      defer wg.Done()
+      errs[i] = parsed[i].ParseReader(bytes.NewReader(data), len(data), "test.msg")
+    }(i, data)
+  }
+  wg.Wait()
+
+  for i := range parsed {
+    m, e := &parsed[i], expected[i]
+    if errs[i] != nil {
+      t.Fatalf("message %d: %v", i, errs[i])
+    }
+    if m.id != e.id || m.contentHash != e.contentHash || !bytes.Equal(m.body, e.body) ||
+      len(m.files) != len(e.files) {
+      t.Errorf("message %d parsed with its body spilled differs from when parsed alone", i)
+    }
+  }
+  parseMemory.mu.Lock()
+  spills := parseMemory.spills
+  parseMemory.mu.Unlock()
+  if spills != len(msgs) {
+    t.Errorf("%d bodies spilled; expected %d", spills, len(msgs))
+  }
+  if files, err := os.ReadDir(TMPDIR); err != nil || len(files) > 0 {
+    t.Errorf("files left in TMPDIR: %v %v", files, err)
+  }
+}
+
+// TestParseBudgetReleasedOnError checks that parsers return the budget taken for bodies
+// when they fail
+func TestParseBudgetReleasedOnError(t *testing.T) {
+  testParseBudget(t, 1<<20)
+  valid := string(testLargeBodies(1, 4096)[0])
+  tests := []struct {
+    name string
+    data string
+    size int
+  }{
+    {"short body", valid[:len(valid)-100], len(valid)},
+    {"short body of unknown size", valid[:len(valid)-100], 0},
+    {"invalid file after body", valid + "\nfile x a.bin\n", 0},
+    {"short second body", valid + "\nbody 100\nshort", 0},
+  }
+  for _, test := range tests {
+    var m Message
+    err := m.ParseReader(strings.NewReader(test.data), test.size, "test.msg")
+    if err == nil {
+      t.Errorf("%s: parsed", test.name)
+    }
+    parseMemory.mu.Lock()
+    used := parseMemory.used
+    parseMemory.mu.Unlock()
+    if used != 0 {
+      t.Errorf("%s: %d bytes of the parse budget weren't returned", test.name, used)
+    }
+  }
+}
@@ -0,0 +1,682 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bufio"
+  "context"
+  "crypto/sha256"
+  "crypto/tls"
+  "encoding/binary"
+  "encoding/json"
+  "io"
+  "net"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// The peer protocol transfers messages between machines over TCP, without HTTP.
+// serve accepts it on the address of -peer-addr; push uses it as a client.
+//
+// A connection is a sequence of frames. Each frame is a 5 byte header followed by a
+// payload:
+//
+//   type     uint8          one of the peerFrame constants
+//   length   uint32         length of the payload in bytes, big-endian
+//   payload  [length]byte
+//
+// The frames are:
+//
+//   HELLO   1  "key value" lines, like a message's header (see below)
+//   SEND    2  a message file, in the .msg format
+//   ACCEPT  3  "<id>" of the message of a SEND
+//   REJECT  4  "<code> <reason>" where code is a three digit number like in SMTP
+//   PING    5  any data, which is echoed in the PONG
+//   PONG    6
+//
+// The client starts by sending HELLO with the fields:
+//
+//   versions  space-separated protocol versions the client supports, e.g. "1 2"
+//             (or "version" with just one)
+//   address   an address the client sends from (any number of these)
+//   token     an API token (see "serve token"); required unless serve -no-auth
+//
+// The server responds with HELLO with the fields "version", the highest version both
+// support, "address" for each address it accepts messages for and "server", the name
+// and version of the server's software, like "smsg 0.1.0". If the client's
+// HELLO is malformed, has no supported version or has an invalid token, the server
+// responds with REJECT and closes the connection.
+//
+// After that the client sends SEND or PING frames and the server responds to each, in
+// order, with ACCEPT or REJECT and PONG. Sending a message which the server already has
+// is accepted, so SEND can be retried. The server closes the connection after a REJECT
+// of a frame it can't continue after, like a SEND larger than it accepts; codes 500
+// to 505 and 530.
+// Control frames (all but SEND) can be at most peerMaxControlFrame bytes.
+
+// peerProtocolVersions are the versions of the peer protocol this program implements,
+// in ascending order
+var peerProtocolVersions = []int{1}
+
+const (
+  peerFrameHello  = 1
+  peerFrameSend   = 2
+  peerFrameAccept = 3
+  peerFrameReject = 4
+  peerFramePing   = 5
+  peerFramePong   = 6
+)
+
+// peerMaxControlFrame is the max payload size of frames other than SEND
+const peerMaxControlFrame = 4096
+
+const (
+  // peerHandshakeTimeout is how long the server waits for a client's HELLO
+  peerHandshakeTimeout = 10 * time.Second
+  // peerIdleTimeout is how long the server waits for the next frame of a client
+  peerIdleTimeout = 2 * time.Minute
+  // peerIOTimeout is how long reading or writing a frame can go without progress
+  peerIOTimeout = 30 * time.Second
+  // peerReplyTimeout is how long a client waits for the reply to a SEND, which includes
+  // the time the server takes to store the message
+  peerReplyTimeout = time.Minute
+)
+
+// Reply codes of REJECT, in addition to those of receiveError
+const (
+  replyUnknownFrame = 500 // unknown frame type
+  replyBadSyntax    = 501 // malformed frame
+  replyBadSequence  = 503 // frame not allowed at this point, e.g. SEND before HELLO
+  replyBadVersion   = 505 // no protocol version in common
+  replyAuthRequired = 530 // missing or invalid token
+)
+
+// peerConn reads and writes frames on a connection. Reads and writes fail if they make
+// no progress within their deadline.
+type peerConn struct {
+  conn    net.Conn
+  r       *bufio.Reader
+  w       *bufio.Writer
+  timeout time.Duration // deadline of the next read; see deadlineReader
+}
+
+func newPeerConn(conn net.Conn) *peerConn {
+  pc := &peerConn{conn: conn, timeout: peerIOTimeout}
+  pc.r = bufio.NewReader(deadlineReader{pc})
+  pc.w = bufio.NewWriter(deadlineWriter{pc})
+  return pc
+}
+
+// deadlineReader reads from a peerConn's connection, extending the read deadline by
+// pc.timeout each time, so that a slow but steady transfer doesn't time out
+type deadlineReader struct{ pc *peerConn }
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+  r.pc.conn.SetReadDeadline(time.Now().Add(r.pc.timeout))
+  return r.pc.conn.Read(p)
+}
+
+type deadlineWriter struct{ pc *peerConn }
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+  w.pc.conn.SetWriteDeadline(time.Now().Add(peerIOTimeout))
+  return w.pc.conn.Write(p)
+}
+
+// readHeader reads the header of the next frame, waiting up to timeout for it to start
+func (pc *peerConn) readHeader(timeout time.Duration) (typ byte, size uint32, err error) {
+  pc.timeout = timeout
+  var hdr [5]byte
+  if _, err = io.ReadFull(pc.r, hdr[:1]); err != nil {
+    return
+  }
+  pc.timeout = peerIOTimeout
+  if _, err = io.ReadFull(pc.r, hdr[1:]); err != nil {
+    return
+  }
+  return hdr[0], binary.BigEndian.Uint32(hdr[1:]), nil
+}
+
+// readPayload reads the payload of a control frame
+func (pc *peerConn) readPayload(size uint32) ([]byte, error) {
+  if size > peerMaxControlFrame {
+    return nil, errorf("frame too large (%d bytes)", size)
+  }
+  buf := make([]byte, size)
+  _, err := io.ReadFull(pc.r, buf)
+  return buf, err
+}
+
+// writeHeader writes the header of a frame. Its payload is written to pc.w after.
+func (pc *peerConn) writeHeader(typ byte, size int) error {
+  var hdr [5]byte
+  hdr[0] = typ
+  binary.BigEndian.PutUint32(hdr[1:], uint32(size))
+  _, err := pc.w.Write(hdr[:])
+  return err
+}
+
+// writeFrame writes and flushes a frame
+func (pc *peerConn) writeFrame(typ byte, payload []byte) error {
+  if err := pc.writeHeader(typ, len(payload)); err != nil {
+    return err
+  }
+  if _, err := pc.w.Write(payload); err != nil {
+    return err
+  }
+  return pc.w.Flush()
+}
+
+func (pc *peerConn) writeReject(code int, reason string) error {
+  return pc.writeFrame(peerFrameReject, []byte(strconv.Itoa(code)+" "+reason))
+}
+
+// parseReject parses the payload of REJECT into a *receiveError
+func parseReject(payload []byte) error {
+  s := string(payload)
+  fields := strings.SplitN(s, " ", 2)
+  code, err := strconv.Atoi(fields[0])
+  if err != nil || len(fields[0]) != 3 {
+    return &receiveError{replyBadSyntax, errorf("malformed REJECT %q", limitStrLen(s, 80))}
+  }
+  reason := ""
+  if len(fields) > 1 {
+    reason = strings.TrimSpace(fields[1])
+  }
+  if reason == "" {
+    reason = "rejected"
+  }
+  return &receiveError{code, errorf("%s (%d)", reason, code)}
+}
+
+// peerHello is the payload of HELLO
+type peerHello struct {
+  versions  []int
+  addresses []string
+  token     string
+  server    string
+}
+
+func (h *peerHello) encode() []byte {
+  var b strings.Builder
+  if len(h.versions) == 1 {
+    b.WriteString("version ")
+  } else {
+    b.WriteString("versions ")
+  }
+  b.WriteString(formatPeerVersions(h.versions) + "\n")
+  for _, a := range h.addresses {
+    b.WriteString("address " + a + "\n")
+  }
+  if h.token != "" {
+    b.WriteString("token " + h.token + "\n")
+  }
+  if h.server != "" {
+    b.WriteString("server " + h.server + "\n")
+  }
+  return []byte(b.String())
+}
+
+func formatPeerVersions(versions []int) string {
+  s := make([]string, len(versions))
+  for i, v := range versions {
+    s[i] = strconv.Itoa(v)
+  }
+  return strings.Join(s, " ")
+}
+
+// parsePeerHello parses the payload of HELLO. Unknown fields are ignored, so that later
+// versions can add fields.
+func parsePeerHello(payload []byte) (h peerHello, err error) {
+  for _, line := range strings.Split(strings.TrimSuffix(string(payload), "\n"), "\n") {
+    if line == "" {
+      continue
+    }
+    key, value := line, ""
+    if p := strings.IndexByte(line, ' '); p != -1 {
+      key, value = line[:p], strings.TrimSpace(line[p+1:])
+    }
+    switch key {
+    case "version", "versions":
+      for _, s := range strings.Fields(value) {
+        v, err := strconv.Atoi(s)
+        if err != nil || v < 1 {
+          return h, errorf("invalid version %q", s)
+        }
+        h.versions = append(h.versions, v)
+      }
+    case "address":
+      h.addresses = append(h.addresses, value)
+    case "token":
+      h.token = value
+    case "server":
+      h.server = value
+    }
+  }
+  if len(h.versions) == 0 {
+    return h, errorf("missing version")
+  }
+  return h, nil
+}
+
+// negotiatePeerVersion returns the highest version in both versions and
+// peerProtocolVersions, or 0 if there's none
+func negotiatePeerVersion(versions []int) int {
+  for i := len(peerProtocolVersions) - 1; i >= 0; i-- {
+    for _, v := range versions {
+      if v == peerProtocolVersions[i] {
+        return v
+      }
+    }
+  }
+  return 0
+}
+
+// servedAddresses returns the addresses which the server accepts messages for
+func servedAddresses() []string {
+  if len(config.Recipients) > 0 {
+    return config.Recipients
+  }
+  addrs := append([]string(nil), config.Local...)
+  for _, id := range config.Identities {
+    addrs = append(addrs, id.Address)
+  }
+  return addrs
+}
+
+// peerServer accepts connections of the peer protocol
+type peerServer struct {
+  ln      net.Listener
+  auth    bool
+  limiter *rateLimiter
+
+  mu     sync.Mutex
+  conns  map[net.Conn]struct{}
+  closed bool
+  wg     sync.WaitGroup
+}
+
+func newPeerServer(ln net.Listener, auth bool) *peerServer {
+  return &peerServer{
+    ln:      ln,
+    auth:    auth,
+    limiter: newRateLimiter(rateLimit(), rateBurst(), maxUploadsPerClient),
+    conns:   map[net.Conn]struct{}{},
+  }
+}
+
+// Serve accepts connections until Shutdown is called
+func (s *peerServer) Serve() error {
+  for {
+    conn, err := s.ln.Accept()
+    if err != nil {
+      s.mu.Lock()
+      closed := s.closed
+      s.mu.Unlock()
+      if closed {
+        return nil
+      }
+      if ne, ok := err.(net.Error); ok && ne.Temporary() {
+        time.Sleep(100 * time.Millisecond)
+        continue
+      }
+      return err
+    }
+    addr, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+    now := time.Now()
+    if ok, _ := s.limiter.allow(addr, now); !ok || !s.limiter.beginUpload(addr, now) {
+      metricAPIRateLimited.Inc()
+      conn.Close()
+      continue
+    }
+    s.mu.Lock()
+    if s.closed {
+      s.mu.Unlock()
+      conn.Close()
+      return nil
+    }
+    s.conns[conn] = struct{}{}
+    s.wg.Add(1)
+    s.mu.Unlock()
+    go func() {
+      defer s.wg.Done()
+      defer s.limiter.endUpload(addr)
+      s.serveConn(conn)
+      s.mu.Lock()
+      delete(s.conns, conn)
+      s.mu.Unlock()
+    }()
+  }
+}
+
+// Shutdown stops accepting connections and closes open ones. Messages being received are
+// not stored; their senders retry them.
+func (s *peerServer) Shutdown(ctx context.Context) error {
+  s.mu.Lock()
+  s.closed = true
+  s.ln.Close()
+  for conn := range s.conns {
+    conn.Close()
+  }
+  s.mu.Unlock()
+  done := make(chan struct{})
+  go func() {
+    s.wg.Wait()
+    close(done)
+  }()
+  select {
+  case <-done:
+    return nil
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+}
+
+func (s *peerServer) serveConn(conn net.Conn) {
+  defer conn.Close()
+  pc := newPeerConn(conn)
+  if err := s.handshake(pc); err != nil {
+    peerlog.Debugf("%s: %v", conn.RemoteAddr(), err)
+    return
+  }
+  for {
+    typ, size, err := pc.readHeader(peerIdleTimeout)
+    if err != nil {
+      if err != io.EOF {
+        peerlog.Debugf("%s: %v", conn.RemoteAddr(), err)
+      }
+      return
+    }
+    switch typ {
+    case peerFrameSend:
+      err = s.receive(pc, size)
+    case peerFramePing:
+      var payload []byte
+      if payload, err = pc.readPayload(size); err == nil {
+        err = pc.writeFrame(peerFramePong, payload)
+      }
+    case peerFrameHello, peerFrameAccept, peerFrameReject, peerFramePong:
+      pc.writeReject(replyBadSequence, "unexpected frame type "+strconv.Itoa(int(typ)))
+      return
+    default:
+      pc.writeReject(replyUnknownFrame, "unknown frame type "+strconv.Itoa(int(typ)))
+      return
+    }
+    if err != nil {
+      peerlog.Debugf("%s: %v", conn.RemoteAddr(), err)
+      return
+    }
+  }
+}
+
+// handshake receives the client's HELLO and responds to it
+func (s *peerServer) handshake(pc *peerConn) error {
+  typ, size, err := pc.readHeader(peerHandshakeTimeout)
+  if err != nil {
+    return err
+  }
+  if typ != peerFrameHello {
+    pc.writeReject(replyBadSequence, "expected HELLO")
+    return errorf("expected HELLO, got frame type %d", typ)
+  }
+  payload, err := pc.readPayload(size)
+  if err != nil {
+    pc.writeReject(replyBadSyntax, err.Error())
+    return err
+  }
+  hello, err := parsePeerHello(payload)
+  if err != nil {
+    pc.writeReject(replyBadSyntax, "malformed HELLO: "+err.Error())
+    return err
+  }
+  version := negotiatePeerVersion(hello.versions)
+  if version == 0 {
+    pc.writeReject(replyBadVersion, "no supported protocol version; server supports "+
+      formatPeerVersions(peerProtocolVersions))
+    return errorf("no supported protocol version in %v", hello.versions)
+  }
+  if s.auth {
+    ok := false
+    if hello.token != "" {
+      hash := sha256.Sum256([]byte(hello.token))
+      if ok, _, err = db.AuthenticateToken(hash[:]); err != nil {
+        pc.writeReject(replyLocalError, "try again later")
+        return err
+      }
+    }
+    if !ok {
+      pc.writeReject(replyAuthRequired, "missing or invalid API token")
+      return errorf("missing or invalid API token")
+    }
+  }
+  res := peerHello{
+    versions:  []int{version},
+    addresses: servedAddresses(),
+    server:    "smsg " + VERSION,
+  }
+  return pc.writeFrame(peerFrameHello, res.encode())
+}
+
+// receive receives the message of a SEND frame and responds with ACCEPT or REJECT.
+// It returns an error if the connection can't be used after.
+func (s *peerServer) receive(pc *peerConn, size uint32) error {
+  if int64(size) > int64(receiveLimits.total) {
+    // note: the message can't be skipped without reading it, so the connection is closed
+    pc.writeReject(replyTooLarge, "message too large (limit "+
+      strconv.Itoa(receiveLimits.total)+")")
+    return errorf("message too large (%d bytes)", size)
+  }
+  r := &io.LimitedReader{R: pc.r, N: int64(size)}
+  // messages without a time field are timestamped on arrival
+  msg, _, err := receiveMessage(r, int(size), time.Now(), "", s.auth)
+  // skip what the parser didn't read, e.g. after the message was rejected
+  if _, err := io.Copy(io.Discard, r); err != nil {
+    return err
+  }
+  if err != nil {
+    e := err.(*receiveError)
+    return pc.writeReject(e.code, e.Error())
+  }
+  return pc.writeFrame(peerFrameAccept, []byte(msg.IdString()))
+}
+
+// tlsConfig returns the TLS configuration for connections to the peer
+func (p *Peer) tlsConfig() *tls.Config {
+  return clientTLSConfig(p.CertFingerprint, false)
+}
+
+// peerAPIRequest makes a request to the HTTP API of peer at path, like "/v1/messages".
+// If size is not negative, it's the length of body. If timeout is not zero, the request,
+// including reading the response body, fails if it takes longer than that.
+// A response with an error status is returned as an error.
+func peerAPIRequest(
+  ctx context.Context, peer *Peer, method, path string, body io.Reader, size int64,
+  timeout time.Duration,
+) (*http.Response, error) {
+  u, err := url.Parse(peer.URL)
+  if err != nil {
+    return nil, errorf("invalid url: %v", err)
+  }
+  if u.Scheme != "http" && u.Scheme != "https" {
+    return nil, errorf("url %q is not http or https", peer.URL)
+  }
+  req, err := http.NewRequestWithContext(ctx, method,
+    strings.TrimSuffix(u.String(), "/")+path, body)
+  if err != nil {
+    return nil, err
+  }
+  if size >= 0 {
+    req.ContentLength = size
+  }
+  if body != nil {
+    req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+  }
+  if peer.Token != "" {
+    req.Header.Set("Authorization", "Bearer "+peer.Token)
+  }
+  client := &http.Client{
+    Timeout: timeout,
+    Transport: &http.Transport{
+      TLSClientConfig:     peer.tlsConfig(),
+      Proxy:               http.ProxyFromEnvironment,
+      TLSHandshakeTimeout: peerHandshakeTimeout,
+    },
+  }
+  res, err := client.Do(req)
+  if err != nil {
+    return nil, err
+  }
+  if res.StatusCode < 200 || res.StatusCode > 299 {
+    defer res.Body.Close()
+    var e struct {
+      Error string `json:"error"`
+    }
+    json.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(&e)
+    if e.Error == "" {
+      return nil, errorf("%s", res.Status)
+    }
+    return nil, errorf("%s: %s", res.Status, e.Error)
+  }
+  return res, nil
+}
+
+// peerClient is a client of the peer protocol, used by push
+type peerClient struct {
+  pc        *peerConn
+  version   int      // negotiated protocol version
+  addresses []string // addresses the server accepts messages for
+  server    string   // the server's software, like "smsg 0.1.0"
+}
+
+// dialPeer connects to a server of the peer protocol at addr (host:port) and introduces
+// the client with a HELLO. If tlsConfig is not nil, the connection uses TLS.
+func dialPeer(addr string, tlsConfig *tls.Config, token string) (*peerClient, error) {
+  dialer := &net.Dialer{Timeout: peerHandshakeTimeout}
+  var conn net.Conn
+  var err error
+  if tlsConfig != nil {
+    conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+  } else {
+    conn, err = dialer.Dial("tcp", addr)
+  }
+  if err != nil {
+    return nil, err
+  }
+  c := &peerClient{pc: newPeerConn(conn)}
+  if err := c.hello(token); err != nil {
+    conn.Close()
+    return nil, errorf("%s: %v", addr, err)
+  }
+  return c, nil
+}
+
+// dialPeerURL connects to peer with the peer protocol, using TLS if the peer's url is
+// tls://host:port
+func dialPeerURL(peer *Peer) (*peerClient, error) {
+  u, err := url.Parse(peer.URL)
+  if err != nil {
+    return nil, errorf("invalid url: %v", err)
+  }
+  var tlsConfig *tls.Config
+  switch u.Scheme {
+  case "tls":
+    tlsConfig = peer.tlsConfig()
+  case "tcp":
+  default:
+    return nil, errorf("url %q is not tcp or tls", peer.URL)
+  }
+  return dialPeer(u.Host, tlsConfig, peer.Token)
+}
+
+func (c *peerClient) hello(token string) error {
+  hello := peerHello{versions: peerProtocolVersions, token: token}
+  for _, id := range config.Identities {
+    hello.addresses = append(hello.addresses, id.Address)
+  }
+  if err := c.pc.writeFrame(peerFrameHello, hello.encode()); err != nil {
+    return err
+  }
+  typ, payload, err := c.readReply(peerHandshakeTimeout)
+  if err != nil {
+    return err
+  }
+  if typ != peerFrameHello {
+    return errorf("unexpected frame type %d from server", typ)
+  }
+  res, err := parsePeerHello(payload)
+  if err != nil {
+    return errorf("malformed HELLO from server: %v", err)
+  }
+  c.version = negotiatePeerVersion(res.versions)
+  if c.version == 0 || len(res.versions) != 1 {
+    return errorf("server chose unsupported protocol version %v", res.versions)
+  }
+  c.addresses = res.addresses
+  c.server = res.server
+  return nil
+}
+
+// readReply reads a control frame from the server. A REJECT is returned as an error.
+func (c *peerClient) readReply(timeout time.Duration) (byte, []byte, error) {
+  typ, size, err := c.pc.readHeader(timeout)
+  if err != nil {
+    return 0, nil, err
+  }
+  payload, err := c.pc.readPayload(size)
+  if err != nil {
+    return 0, nil, err
+  }
+  if typ == peerFrameReject {
+    return typ, nil, parseReject(payload)
+  }
+  return typ, payload, nil
+}
+
+// Send sends a message file of size bytes, read from r, and returns the id of the message.
+// If the server rejects the message, the error is a *receiveError.
+func (c *peerClient) Send(r io.Reader, size int64) (string, error) {
+  if size > 1<<32-1 {
+    return "", errorf("message too large (%d bytes)", size)
+  }
+  if err := c.pc.writeHeader(peerFrameSend, int(size)); err != nil {
+    return "", err
+  }
+  if _, err := io.CopyN(c.pc.w, r, size); err != nil {
+    return "", err
+  }
+  if err := c.pc.w.Flush(); err != nil {
+    return "", err
+  }
+  typ, payload, err := c.readReply(peerReplyTimeout)
+  if err != nil {
+    return "", err
+  }
+  if typ != peerFrameAccept {
+    return "", errorf("unexpected frame type %d from server", typ)
+  }
+  return string(payload), nil
+}
+
+// Ping sends a PING and returns the time until the PONG
+func (c *peerClient) Ping() (time.Duration, error) {
+  start := time.Now()
+  payload := []byte(strconv.FormatInt(start.UnixNano(), 10))
+  if err := c.pc.writeFrame(peerFramePing, payload); err != nil {
+    return 0, err
+  }
+  typ, pong, err := c.readReply(peerIOTimeout)
+  if err != nil {
+    return 0, err
+  }
+  if typ != peerFramePong || string(pong) != string(payload) {
+    return 0, errorf("unexpected response to PING")
+  }
+  return time.Since(start), nil
+}
+
+func (c *peerClient) Close() error {
+  return c.pc.conn.Close()
+}
@@ -0,0 +1,198 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "encoding/binary"
+  "net"
+  "strings"
+  "testing"
+  "time"
+)
+
+// testPeerConn returns the client end of a connection served by a peer server without
+// authentication, and a channel which is closed when the server has closed it
+func testPeerConn(t *testing.T) (*peerConn, <-chan struct{}) {
+  testMsgDir(t)
+  client, server := net.Pipe()
+  s := newPeerServer(nil, false)
+  done := make(chan struct{})
+  go func() {
+    s.serveConn(server)
+    close(done)
+  }()
+  t.Cleanup(func() {
+    client.Close()
+    <-done
+  })
+  return newPeerConn(client), done
+}
+
+// writeTestFrame writes a frame with a header which says it's size bytes long, whatever
+// the length of payload
+func writeTestFrame(t *testing.T, pc *peerConn, typ byte, size uint32, payload string) {
+  t.Helper()
+  var hdr [5]byte
+  hdr[0] = typ
+  binary.BigEndian.PutUint32(hdr[1:], size)
+  pc.w.Write(hdr[:])
+  pc.w.WriteString(payload)
+  if err := pc.w.Flush(); err != nil {
+    t.Fatal(err)
+  }
+}
+
+// expectTestFrame reads a frame and checks its type, and that its payload starts with
+// prefix
+func expectTestFrame(t *testing.T, pc *peerConn, typ byte, prefix string) string {
+  t.Helper()
+  gottyp, size, err := pc.readHeader(5 * time.Second)
+  if err != nil {
+    t.Fatalf("expected frame %d %q: %v", typ, prefix, err)
+  }
+  payload, err := pc.readPayload(size)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if gottyp != typ || !strings.HasPrefix(string(payload), prefix) {
+    t.Fatalf("got frame %d %q; expected %d %q…", gottyp, payload, typ, prefix)
+  }
+  return string(payload)
+}
+
+// expectTestClosed checks that the server closes the connection
+func expectTestClosed(t *testing.T, pc *peerConn, done <-chan struct{}) {
+  t.Helper()
+  select {
+  case <-done:
+  case <-time.After(5 * time.Second):
+    t.Fatal("server did not close the connection")
+  }
+}
+
+func testPeerHello(t *testing.T, pc *peerConn) {
+  t.Helper()
+  hello := "version 1\n"
+  writeTestFrame(t, pc, peerFrameHello, uint32(len(hello)), hello)
+  expectTestFrame(t, pc, peerFrameHello, "version 1\n")
+}
+
+func TestPeerMalformedHandshake(t *testing.T) {
+  tests := []struct {
+    name    string
+    typ     byte
+    size    uint32
+    payload string
+    reject  string // prefix of REJECT
+  }{
+    {"send before hello", peerFrameSend, 3, "abc", "503 "},
+    {"ping before hello", peerFramePing, 0, "", "503 "},
+    {"hello too large", peerFrameHello, peerMaxControlFrame + 1, "", "501 frame too large"},
+    {"hello without version", peerFrameHello, 14, "address a@b.c\n", "501 malformed HELLO"},
+    {"hello with invalid version", peerFrameHello, 10, "version x\n", "501 malformed HELLO"},
+    {"hello with version 0", peerFrameHello, 10, "version 0\n", "501 malformed HELLO"},
+    {"hello with unsupported version", peerFrameHello, 10, "version 9\n", "505 "},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      pc, done := testPeerConn(t)
+      writeTestFrame(t, pc, test.typ, test.size, test.payload)
+      expectTestFrame(t, pc, peerFrameReject, test.reject)
+      expectTestClosed(t, pc, done)
+    })
+  }
+}
+
+func TestPeerMalformedFrames(t *testing.T) {
+  tests := []struct {
+    name    string
+    typ     byte
+    size    uint32
+    payload string
+    reject  string // prefix of REJECT, or "" if the server closes the connection
+  }{
+    {"unknown frame", 99, 0, "", "500 "},
+    {"second hello", peerFrameHello, 10, "version 1\n", "503 "},
+    {"accept from client", peerFrameAccept, 0, "", "503 "},
+    {"ping too large", peerFramePing, peerMaxControlFrame + 1, "", ""},
+    {"send too large", peerFrameSend, uint32(receiveLimits.total) + 1, "", "552 "},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      pc, done := testPeerConn(t)
+      testPeerHello(t, pc)
+      writeTestFrame(t, pc, test.typ, test.size, test.payload)
+      if test.reject != "" {
+        expectTestFrame(t, pc, peerFrameReject, test.reject)
+      }
+      expectTestClosed(t, pc, done)
+    })
+  }
+}
+
+func TestPeerTruncatedFrames(t *testing.T) {
+  for _, data := range []string{"\x01", "\x01\x00\x00", "\x01\x00\x00\x00\x0Aversion"} {
+    pc, done := testPeerConn(t)
+    pc.w.WriteString(data)
+    pc.w.Flush()
+    pc.conn.Close()
+    expectTestClosed(t, pc, done)
+  }
+}
+
+// A malformed message is rejected, but the connection can still be used
+func TestPeerMalformedMessage(t *testing.T) {
+  pc, done := testPeerConn(t)
+  testPeerHello(t, pc)
+  msg := "subject Hi\nbody 100\nshort"
+  writeTestFrame(t, pc, peerFrameSend, uint32(len(msg)), msg)
+  expectTestFrame(t, pc, peerFrameReject, "554 ")
+  writeTestFrame(t, pc, peerFramePing, 4, "ping")
+  expectTestFrame(t, pc, peerFramePong, "ping")
+  select {
+  case <-done:
+    t.Error("server closed the connection after a rejected message")
+  default:
+  }
+}
+
+func TestParsePeerHello(t *testing.T) {
+  h, err := parsePeerHello([]byte("versions 1 2\naddress a@b.c\naddress d@e.f\n" +
+    "token xyz\nfuture field\n\nserver smsg 1.0\n"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(h.versions) != 2 || h.versions[1] != 2 || len(h.addresses) != 2 ||
+    h.token != "xyz" || h.server != "smsg 1.0" {
+    t.Errorf("got %+v", h)
+  }
+  if h2, err := parsePeerHello(h.encode()); err != nil || h2.token != h.token ||
+    len(h2.versions) != 2 || len(h2.addresses) != 2 {
+    t.Errorf("encoded and parsed again: %+v, %v", h2, err)
+  }
+  for _, payload := range []string{"", "\n", "address a@b.c", "version", "version 1 x"} {
+    if _, err := parsePeerHello([]byte(payload)); err == nil {
+      t.Errorf("%q: no error", payload)
+    }
+  }
+}
+
+func TestParseReject(t *testing.T) {
+  tests := []struct {
+    payload string
+    code    int
+  }{
+    {"552 too large", 552},
+    {"530", 530},
+    {"530   ", 530},
+    {"", replyBadSyntax},
+    {"5x2 bad", replyBadSyntax},
+    {"5520 bad", replyBadSyntax},
+    {"52 bad", replyBadSyntax},
+  }
+  for _, test := range tests {
+    err := parseReject([]byte(test.payload))
+    if e, ok := err.(*receiveError); !ok || e.code != test.code {
+      t.Errorf("%q: %v; expected code %d", test.payload, err, test.code)
+    }
+  }
+}
@@ -0,0 +1,79 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "encoding/json"
+  "strings"
+)
+
+// messagePriority is the priority of a message, from its "priority" section. Messages
+// without one have normal priority. It's stored in the database as an integer which
+// sorts by priority (see MessageFilter.sortBy.)
+type messagePriority int
+
+const (
+  priorityLow    messagePriority = -1
+  priorityNormal messagePriority = 0
+  priorityHigh   messagePriority = 1
+  priorityUrgent messagePriority = 2
+)
+
+func (p messagePriority) String() string {
+  switch p {
+  case priorityLow:
+    return "low"
+  case priorityNormal:
+    return "normal"
+  case priorityHigh:
+    return "high"
+  case priorityUrgent:
+    return "urgent"
+  }
+  return "?"
+}
+
+// parsePriority parses the value of a "priority" section, ignoring case
+func parsePriority(s string) (messagePriority, error) {
+  switch strings.ToLower(s) {
+  case "low":
+    return priorityLow, nil
+  case "normal":
+    return priorityNormal, nil
+  case "high":
+    return priorityHigh, nil
+  case "urgent":
+    return priorityUrgent, nil
+  }
+  return priorityNormal, errorf("invalid priority %q (expected low, normal, high or urgent)",
+    s)
+}
+
+// priorityColor returns the terminal color of rows of messages with priority p, which is
+// color unless the priority is high or urgent
+func priorityColor(p messagePriority, color string) string {
+  switch {
+  case p >= priorityUrgent:
+    return colurgent
+  case p == priorityHigh:
+    return colhigh
+  }
+  return color
+}
+
+func (p messagePriority) MarshalJSON() ([]byte, error) {
+  return json.Marshal(p.String())
+}
+
+func (p *messagePriority) UnmarshalJSON(data []byte) error {
+  var str string
+  if err := json.Unmarshal(data, &str); err != nil {
+    return err
+  }
+  if str == "" {
+    *p = priorityNormal
+    return nil
+  }
+  v, err := parsePriority(str)
+  *p = v
+  return err
+}
@@ -0,0 +1,183 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "math"
+  "net"
+  "net/http"
+  "strconv"
+  "sync"
+  "time"
+)
+
+// defaultRateLimit is the number of requests per minute the server accepts from each
+// client address, unless configured otherwise (Config.RateLimit)
+const defaultRateLimit = 120
+
+// defaultRateBurst is the number of requests a client can make at once, unless
+// configured otherwise (Config.RateBurst)
+const defaultRateBurst = 30
+
+// maxUploadsPerClient is the number of messages a client address can upload at the same
+// time, so that a client can't hold all connections with slow uploads
+const maxUploadsPerClient = 4
+
+// maxRequestSize caps the body of requests. It's one more than the size limit of
+// received messages, so that the parser can tell when that limit is exceeded.
+var maxRequestSize = int64(receiveLimits.total) + 1
+
+func rateLimit() float64 {
+  if config.RateLimit != 0 {
+    return float64(config.RateLimit)
+  }
+  return defaultRateLimit
+}
+
+func rateBurst() float64 {
+  if config.RateBurst > 0 {
+    return float64(config.RateBurst)
+  }
+  return defaultRateBurst
+}
+
+// rateLimiter limits the rate of requests from each client address with a token bucket
+// and the number of uploads in progress
+type rateLimiter struct {
+  rate    float64 // tokens per second; no limit if <= 0
+  burst   float64 // max tokens
+  uploads int     // max uploads in progress per client
+
+  mu        sync.Mutex
+  clients   map[string]*rateLimitClient
+  lastsweep time.Time
+}
+
+type rateLimitClient struct {
+  tokens  float64
+  updated time.Time
+  uploads int // number of uploads in progress
+}
+
+// newRateLimiter returns a limiter which allows perMinute requests per minute with bursts
+// of up to burst requests. A perMinute of zero or less means no rate limit.
+func newRateLimiter(perMinute, burst float64, uploads int) *rateLimiter {
+  return &rateLimiter{
+    rate:      perMinute / 60,
+    burst:     burst,
+    uploads:   uploads,
+    clients:   map[string]*rateLimitClient{},
+    lastsweep: time.Now(),
+  }
+}
+
+// allow takes a token from the bucket of addr. If the bucket is empty, it returns false
+// and how long it takes until there's a token.
+func (l *rateLimiter) allow(addr string, now time.Time) (bool, time.Duration) {
+  if l.rate <= 0 {
+    return true, 0
+  }
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  l.sweep(now)
+  c := l.client(addr, now)
+  c.tokens = math.Min(l.burst, c.tokens+now.Sub(c.updated).Seconds()*l.rate)
+  c.updated = now
+  if c.tokens < 1 {
+    wait := time.Duration((1 - c.tokens) / l.rate * float64(time.Second))
+    return false, wait
+  }
+  c.tokens--
+  return true, 0
+}
+
+// beginUpload returns false if addr has the max number of uploads in progress.
+// Otherwise endUpload must be called when the upload has finished.
+func (l *rateLimiter) beginUpload(addr string, now time.Time) bool {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  c := l.client(addr, now)
+  if c.uploads >= l.uploads {
+    return false
+  }
+  c.uploads++
+  return true
+}
+
+// endUpload ends an upload started with beginUpload. Without a rate limit, clients are
+// only in the map while they upload, since allow doesn't sweep it then.
+func (l *rateLimiter) endUpload(addr string) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  if c := l.clients[addr]; c != nil {
+    c.uploads--
+    if c.uploads == 0 && l.rate <= 0 {
+      delete(l.clients, addr)
+    }
+  }
+}
+
+func (l *rateLimiter) client(addr string, now time.Time) *rateLimitClient {
+  c := l.clients[addr]
+  if c == nil {
+    c = &rateLimitClient{tokens: l.burst, updated: now}
+    l.clients[addr] = c
+  }
+  return c
+}
+
+// sweep forgets clients whose buckets have refilled, about once a minute, so that the
+// map doesn't grow forever. l.mu must be locked.
+func (l *rateLimiter) sweep(now time.Time) {
+  if now.Sub(l.lastsweep) < time.Minute {
+    return
+  }
+  l.lastsweep = now
+  for addr, c := range l.clients {
+    if c.uploads == 0 && c.tokens+now.Sub(c.updated).Seconds()*l.rate >= l.burst {
+      delete(l.clients, addr)
+    }
+  }
+}
+
+// limitRequests wraps h so that requests are rate limited per client address, uploads
+// (POST requests) are limited by l.uploads and request bodies by maxRequestSize.
+// Requests over a limit are rejected with status 429 before their bodies are read.
+func limitRequests(h http.Handler, l *rateLimiter) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    addr, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+      addr = r.RemoteAddr
+    }
+    now := time.Now()
+    if ok, wait := l.allow(addr, now); !ok {
+      metricAPIRateLimited.Inc()
+      retryAfter(w, wait)
+      apiError(w, http.StatusTooManyRequests, "too many requests")
+      return
+    }
+    if r.Method == "POST" {
+      if !l.beginUpload(addr, now) {
+        metricAPITooManyUploads.Inc()
+        retryAfter(w, time.Second)
+        apiError(w, http.StatusTooManyRequests, "too many uploads in progress")
+        return
+      }
+      defer l.endUpload(addr)
+    }
+    metricAPIAccepted.Inc()
+    r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+    h.ServeHTTP(w, r)
+  })
+}
+
+// retryAfter sets the Retry-After header to d, rounded up to whole seconds.
+// It also closes the connection after the response, which otherwise waits for the unread
+// request body to be received.
+func retryAfter(w http.ResponseWriter, d time.Duration) {
+  w.Header().Set("Connection", "close")
+  secs := int((d + time.Second - 1) / time.Second)
+  if secs < 1 {
+    secs = 1
+  }
+  w.Header().Set("Retry-After", strconv.Itoa(secs))
+}
@@ -0,0 +1,65 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "strconv"
+  "testing"
+  "time"
+)
+
+func TestRateLimiterWithoutRateForgetsClients(t *testing.T) {
+  l := newRateLimiter(0, 10, 2)
+  now := time.Now()
+  for i := 0; i < 100; i++ {
+    addr := "10.0.0." + strconv.Itoa(i)
+    if ok, _ := l.allow(addr, now); !ok {
+      t.Fatalf("allow(%s) = false without a rate limit", addr)
+    }
+    if !l.beginUpload(addr, now) {
+      t.Fatalf("beginUpload(%s) = false", addr)
+    }
+    l.endUpload(addr)
+  }
+  if n := len(l.clients); n != 0 {
+    t.Errorf("%d clients left after their uploads ended; expected 0", n)
+  }
+}
+
+func TestRateLimiterUploads(t *testing.T) {
+  l := newRateLimiter(0, 10, 2)
+  now := time.Now()
+  if !l.beginUpload("a", now) || !l.beginUpload("a", now) {
+    t.Fatal("beginUpload = false below the limit")
+  }
+  if l.beginUpload("a", now) {
+    t.Error("beginUpload = true over the limit")
+  }
+  l.endUpload("a")
+  if len(l.clients) != 1 {
+    t.Error("client with an upload in progress was forgotten")
+  }
+  if !l.beginUpload("a", now) {
+    t.Error("beginUpload = false after endUpload")
+  }
+}
+
+func TestRateLimiterRate(t *testing.T) {
+  l := newRateLimiter(60, 2, 1) // 1 per second
+  now := time.Now()
+  for i := 0; i < 2; i++ {
+    if ok, _ := l.allow("a", now); !ok {
+      t.Fatalf("request %d of the burst was rejected", i+1)
+    }
+  }
+  ok, wait := l.allow("a", now)
+  if ok || wait <= 0 || wait > time.Second {
+    t.Errorf("allow after burst = %v, %v; expected false, up to 1s", ok, wait)
+  }
+  if ok, _ := l.allow("a", now.Add(time.Second)); !ok {
+    t.Error("allow after refill = false")
+  }
+  l.sweep(now.Add(time.Hour))
+  if len(l.clients) != 0 {
+    t.Error("sweep kept a client whose bucket has refilled")
+  }
+}
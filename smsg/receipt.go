@@ -0,0 +1,164 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "time"
+)
+
+// receiptStatus is the status of a sent message, as reported by a receipt: a message with
+// an "x-receipt <id> <status>" section which its recipient's server sends back to the
+// sender. A later status implies the earlier ones; a message which was read was delivered.
+type receiptStatus int
+
+const (
+  receiptNone      receiptStatus = iota
+  receiptDelivered               // the message was received and indexed
+  receiptRead                    // the message was read by its recipient
+)
+
+func (s receiptStatus) String() string {
+  switch s {
+  case receiptNone:
+    return "none"
+  case receiptDelivered:
+    return "delivered"
+  case receiptRead:
+    return "read"
+  }
+  return "?"
+}
+
+func parseReceiptStatus(s string) (receiptStatus, error) {
+  switch s {
+  case "delivered":
+    return receiptDelivered, nil
+  case "read":
+    return receiptRead, nil
+  }
+  return receiptNone, errorf("invalid receipt status %q (expected delivered or read)", s)
+}
+
+func (s receiptStatus) MarshalJSON() ([]byte, error) {
+  return json.Marshal(s.String())
+}
+
+func (s *receiptStatus) UnmarshalJSON(data []byte) error {
+  var str string
+  if err := json.Unmarshal(data, &str); err != nil {
+    return err
+  }
+  if str == "none" || str == "" {
+    *s = receiptNone
+    return nil
+  }
+  v, err := parseReceiptStatus(str)
+  *s = v
+  return err
+}
+
+// sendReceipt queues a receipt with status to the sender of msg, a message received into
+// the inbox, if the configuration says so (Config.Receipts). No receipts are sent for
+// receipts.
+func sendReceipt(msg *Message, status receiptStatus) error {
+  if config.Receipts < status || msg.receipt != receiptNone || msg.from.address == "" {
+    return nil
+  }
+  r := &Message{
+    time:      time.Now().UTC().Truncate(time.Second),
+    subject:   "Receipt: " + status.String(),
+    from:      receiptSender(msg),
+    to:        Author{address: msg.from.address},
+    receipt:   status,
+    receiptOf: msg.id,
+    body:      []byte{},
+  }
+  var buf bytes.Buffer
+  if _, err := r.WriteTo(&buf); err != nil {
+    return err
+  }
+  // parse the encoded receipt to get its id, like sent messages
+  r, data, err := parseOutgoingMessage(buf.Bytes(), "receipt")
+  if err != nil {
+    return err
+  }
+  // note: receipts are not added to the database, so that they don't show up among sent
+  // messages, but they are in the outbox until delivered (see outbox)
+  if _, err := writeOutboxFile(r, data); err != nil {
+    return err
+  }
+  receiptlog.Debugf("sending %s receipt for %s to %s", status, msg.IdString(), r.to.address)
+  delivery.Wakeup()
+  return nil
+}
+
+// receiptSender returns the recipient of msg whom a receipt for it is from: the first
+// recipient who is local (Config.Local) or hosted (Config.Recipients)
+func receiptSender(msg *Message) Author {
+  recipients := msg.Recipients()
+  for _, a := range recipients {
+    if config.IsLocalAddress(a.address) || config.IsHostedRecipient(a.address) {
+      return a
+    }
+  }
+  if len(recipients) == 0 {
+    return Author{}
+  }
+  return recipients[0]
+}
+
+// applyReceipt records the status reported by the receipt r on the message it is for.
+// Receipts for messages which were not sent from here to the receipt's sender are dropped.
+func applyReceipt(r *Message) error {
+  idstr := (&Message{id: r.receiptOf}).IdString()
+  msg, err := loadMessage(idstr)
+  if err != nil {
+    receiptlog.Debugf("dropping %s receipt from %s for unknown message %s",
+      r.receipt, r.from.address, idstr)
+    return nil
+  }
+  isRecipient := false
+  for _, a := range msg.Recipients() {
+    if a.address == r.from.address {
+      isRecipient = true
+      break
+    }
+  }
+  if !isRecipient {
+    receiptlog.Debugf("dropping %s receipt for %s from %s, who is not a recipient",
+      r.receipt, idstr, r.from.address)
+    return nil
+  }
+  ok, err := db.SetDeliveryStatus(r.receiptOf[:], r.receipt)
+  if err != nil {
+    return err
+  }
+  if !ok {
+    receiptlog.Debugf("dropping %s receipt for %s, which is not a sent message",
+      r.receipt, idstr)
+    return nil
+  }
+  receiptlog.Debugf("%s was %s by %s", idstr, r.receipt, r.from.address)
+  return nil
+}
+
+// markRead marks a message as read. If it was unread, a read receipt is sent for it when
+// enabled (see sendReceipt.)
+func markRead(id [24]byte) error {
+  unread, err := db.UnreadMessages([][24]byte{id})
+  if err != nil {
+    return err
+  }
+  if err := db.MarkRead(id[:], true); err != nil {
+    return err
+  }
+  if !unread[id] || config.Receipts < receiptRead {
+    return nil
+  }
+  msg, err := loadMessage((&Message{id: id}).IdString())
+  if err != nil || msg.folder != "inbox" {
+    return err
+  }
+  return sendReceipt(msg, receiptRead)
+}
@@ -0,0 +1,713 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "context"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "mime"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// apiMaxLimit is the max number of messages returned by one request for a message list
+const apiMaxLimit = 500
+
+// apiDefaultLimit is the number of messages returned when no limit is given
+const apiDefaultLimit = 50
+
+// receiveLimits limits the size of messages received with POST /v1/messages
+var receiveLimits = MessageLimits{
+  body:  MAX_BODY_SIZE,
+  file:  32 * 1024 * 1024, // 32 MiB
+  total: 64 * 1024 * 1024, // 64 MiB
+}
+
+// newAPIHandler returns the handler of the HTTP API:
+//
+//   GET  /v1/messages                   List messages
+//   POST /v1/messages                   Receive a message (.msg format) into the inbox
+//   GET  /v1/messages/{id}              A message, including its body
+//   GET  /v1/messages/{id}/raw          The message file
+//   GET  /v1/messages/{id}/files/{n}    Data of the message's n:th file (from 0)
+//   GET  /v1/events                     Stream of new messages (server-sent events)
+//   GET  /v1/health                     The server's version and the result of the last
+//                                       scan of the inbox; for checking a token
+//
+// Unless auth is false, requests must have an API token (see requireToken.)
+// Requests are rate limited per client (see limitRequests) and logged (see logRequests.)
+func newAPIHandler(auth bool) http.Handler {
+  mux := http.NewServeMux()
+  mux.HandleFunc("/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+    if r.Method == "POST" {
+      apiPostMessage(w, r)
+    } else {
+      apiListMessages(w, r)
+    }
+  })
+  mux.HandleFunc("/v1/messages/", apiMessage)
+
+  // new messages are streamed to clients of /v1/events. The streams are ended at
+  // shutdown, since the server would otherwise wait for them to finish.
+  events := newEventBroker()
+  msgsync.OnNewMessage(events.publish)
+  RegisterExitHandlerWithPhase(ExitPhaseServers, events.Close, "event streams")
+  mux.Handle("/v1/events", events)
+  mux.HandleFunc("/v1/health", apiHealth)
+
+  limiter := newRateLimiter(rateLimit(), rateBurst(), maxUploadsPerClient)
+  if !auth {
+    return logRequests(limitRequests(mux, limiter))
+  }
+  return logRequests(limitRequests(requireToken(mux), limiter))
+}
+
+// requestLogKey is the key of the logger of a request in the request's context
+type requestLogKey struct{}
+
+// requestLog returns the logger of a request, whose messages have the request's id
+func requestLog(r *http.Request) *Logger {
+  if log, ok := r.Context().Value(requestLogKey{}).(*Logger); ok {
+    return log
+  }
+  return servelog
+}
+
+// logRequests wraps h so that each request gets an id, which is sent to the client in
+// the X-Request-Id header and is in log messages about the request (see requestLog.)
+// Requests are logged once handled, at debug level (-v).
+func logRequests(h http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    var b [6]byte
+    rand.Read(b[:])
+    log := servelog.With("req", hex.EncodeToString(b[:]))
+    w.Header().Set("X-Request-Id", hex.EncodeToString(b[:]))
+    sw := &statusWriter{ResponseWriter: w}
+    start := time.Now()
+    h.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, log)))
+    if sw.status == 0 {
+      sw.status = http.StatusOK
+    }
+    log.Debugf("%s %s %d (%s, %s)", r.Method, r.URL.Path, sw.status, r.RemoteAddr,
+      time.Since(start).Round(time.Microsecond))
+  })
+}
+
+// statusWriter records the status of a response
+type statusWriter struct {
+  http.ResponseWriter
+  status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+  if w.status == 0 {
+    w.status = status
+  }
+  w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+  if w.status == 0 {
+    w.status = http.StatusOK
+  }
+  return w.ResponseWriter.Write(p)
+}
+
+// Flush is for streams of events (see eventBroker)
+func (w *statusWriter) Flush() {
+  if f, ok := w.ResponseWriter.(http.Flusher); ok {
+    f.Flush()
+  }
+}
+
+// ownerKey is the key of the owner of a request's token in the request's context
+type ownerKey struct{}
+
+// authKey is the key of whether a request has a valid API token, in its context
+type authKey struct{}
+
+// requestAuthenticated returns true if a request has a valid API token (see
+// requireToken), false if the API is served without authentication
+func requestAuthenticated(r *http.Request) bool {
+  auth, _ := r.Context().Value(authKey{}).(bool)
+  return auth
+}
+
+// requestOwner returns the address of the user whose messages a request is limited to,
+// or "" if it has access to all messages
+func requestOwner(r *http.Request) string {
+  owner, _ := r.Context().Value(ownerKey{}).(string)
+  return owner
+}
+
+// requireToken wraps h so that requests without a valid API token in an
+// "Authorization: Bearer <token>" header are rejected with status 401.
+// Tokens are managed with "smsg serve token". A token with an owner gives access only to
+// the owner's messages (see requestOwner.)
+func requireToken(h http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    var token string
+    if s := r.Header.Get("Authorization"); len(s) > 7 && strings.EqualFold(s[:7], "bearer ") {
+      token = strings.TrimSpace(s[7:])
+    }
+    if token == "" {
+      w.Header().Set("WWW-Authenticate", `Bearer realm="smsg"`)
+      apiError(w, http.StatusUnauthorized, "missing API token")
+      return
+    }
+    hash := sha256.Sum256([]byte(token))
+    ok, owner, err := db.AuthenticateToken(hash[:])
+    if err != nil {
+      apiError(w, http.StatusInternalServerError, "%v", err)
+      return
+    }
+    if !ok {
+      w.Header().Set("WWW-Authenticate", `Bearer realm="smsg", error="invalid_token"`)
+      apiError(w, http.StatusUnauthorized, "invalid API token")
+      return
+    }
+    ctx := context.WithValue(r.Context(), authKey{}, true)
+    if owner != "" {
+      ctx = context.WithValue(ctx, ownerKey{}, owner)
+    }
+    h.ServeHTTP(w, r.WithContext(ctx))
+  })
+}
+
+// messageListJSON is the JSON encoding of a page of a message list
+type messageListJSON struct {
+  Messages []apiMessageJSON `json:"messages"`
+  Total    int              `json:"total"` // number of messages matching the filter
+  Offset   int              `json:"offset"`
+  Limit    int              `json:"limit"`
+}
+
+type apiMessageJSON struct {
+  messageJSON
+  Unread bool `json:"unread"`
+}
+
+// messageDetailJSON is the JSON encoding of a single message
+type messageDetailJSON struct {
+  apiMessageJSON
+  Cc        []string         `json:"cc,omitempty"`
+  ReplyTo   string           `json:"reply_to,omitempty"`
+  InReplyTo string           `json:"in_reply_to,omitempty"`
+  Body      string           `json:"body"`
+  Files     []attachmentJSON `json:"files"`
+
+  // Encrypted is true for encrypted messages (see crypt.go), whose body is left empty
+  // and whose files have no names
+  Encrypted bool `json:"encrypted,omitempty"`
+}
+
+type attachmentJSON struct {
+  Name string `json:"name"`
+  Size int    `json:"size"`
+  Type string `json:"type"`
+}
+
+func makeMessageDetailJSON(msg *Message) messageDetailJSON {
+  m := messageDetailJSON{
+    apiMessageJSON: apiMessageJSON{messageJSON: makeMessageJSON(msg)},
+    ReplyTo:        msg.replyTo.address,
+    Body:           string(msg.body),
+    Files:          []attachmentJSON{},
+    Encrypted:      msg.enc != nil,
+  }
+  for _, a := range msg.cc {
+    m.Cc = append(m.Cc, a.address)
+  }
+  if msg.inReplyTo != ([24]byte{}) {
+    m.InReplyTo = (&Message{id: msg.inReplyTo}).IdString()
+  }
+  for i := range msg.files {
+    a := &msg.files[i]
+    m.Files = append(m.Files, attachmentJSON{
+      Name: a.name,
+      Size: a.dataLen,
+      Type: attachmentContentType(a.name),
+    })
+  }
+  return m
+}
+
+// attachmentContentType returns the MIME type of a file, based on its name
+func attachmentContentType(name string) string {
+  if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+    return t
+  }
+  return "application/octet-stream"
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+  w.Header().Set("Content-Type", "application/json; charset=utf-8")
+  w.WriteHeader(status)
+  enc := json.NewEncoder(w)
+  enc.SetIndent("", "  ")
+  enc.Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, format string, arg ...interface{}) {
+  writeJSON(w, status, map[string]string{"error": errorf(format, arg...).Error()})
+}
+
+// apiAllowMethods responds with an error and returns false if the request's method is
+// not one of methods
+func apiAllowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+  if indexOfString(methods, r.Method) != -1 {
+    return true
+  }
+  w.Header().Set("Allow", strings.Join(methods, ", "))
+  apiError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+  return false
+}
+
+// parseMessageFilter parses the query parameters folder, from, since, until, unread,
+// after, order, sort, offset and limit of a message list request
+func parseMessageFilter(q url.Values) (f MessageFilter, err error) {
+  f.folder = "inbox"
+  if s := q.Get("folder"); s != "" {
+    f.folder = s
+  }
+  if s := q.Get("from"); s != "" {
+    if f.from, err = normalizeAndValidateAddress(s); err != nil {
+      return f, errorf("from: %v", err)
+    }
+  }
+  parseTime := func(name string) (t time.Time, err error) {
+    s := q.Get(name)
+    if s == "" {
+      return
+    }
+    if t, err = time.Parse(time.RFC3339, s); err == nil {
+      return
+    }
+    if t, err = parseTimeArg(s); err != nil {
+      err = errorf("%s: %v", name, err)
+    }
+    return
+  }
+  if f.since, err = parseTime("since"); err != nil {
+    return
+  }
+  if f.until, err = parseTime("until"); err != nil {
+    return
+  }
+  if s := q.Get("unread"); s != "" {
+    if f.unread, err = strconv.ParseBool(s); err != nil {
+      return f, errorf("unread: invalid value %q", s)
+    }
+  }
+  f.limit = apiDefaultLimit
+  if s := q.Get("limit"); s != "" {
+    if f.limit, err = strconv.Atoi(s); err != nil || f.limit < 1 || f.limit > apiMaxLimit {
+      return f, errorf("limit: must be a number between 1 and %d", apiMaxLimit)
+    }
+  }
+  if s := q.Get("after"); s != "" {
+    id, err := decodeId(s)
+    if err != nil {
+      return f, errorf("after: %v", err)
+    }
+    f.after = id[:]
+  }
+  switch s := q.Get("order"); s {
+  case "", "newest":
+  case "oldest":
+    f.oldest = true
+  default:
+    return f, errorf("order: must be \"newest\" or \"oldest\"")
+  }
+  switch s := q.Get("sort"); s {
+  case "", "id", "priority", "size":
+    f.sortBy = s
+  default:
+    return f, errorf("sort: must be \"id\", \"priority\" or \"size\"")
+  }
+  if s := q.Get("offset"); s != "" {
+    if f.offset, err = strconv.Atoi(s); err != nil || f.offset < 0 {
+      return f, errorf("offset: invalid value %q", s)
+    }
+  }
+  return f, nil
+}
+
+// GET /v1/messages[?q=<search query>]
+func apiListMessages(w http.ResponseWriter, r *http.Request) {
+  if !apiAllowMethods(w, r, "GET", "HEAD", "POST") {
+    return
+  }
+  filter, err := parseMessageFilter(r.URL.Query())
+  if err != nil {
+    apiError(w, http.StatusBadRequest, "%v", err)
+    return
+  }
+  filter.owner = requestOwner(r)
+  res := messageListJSON{
+    Messages: []apiMessageJSON{},
+    Offset:   filter.offset,
+    Limit:    filter.limit,
+  }
+  var ids [][24]byte
+  if query := r.URL.Query().Get("q"); query != "" {
+    // note: all matches are visited to count them
+    page := filter
+    filter.offset, filter.limit = 0, 0
+    err = db.SearchMessages(query, &filter, true, func(msg *Message, snippet string) error {
+      if res.Total >= page.offset && res.Total < page.offset+page.limit {
+        m := apiMessageJSON{messageJSON: makeMessageJSON(msg)}
+        m.Snippet = snippet
+        res.Messages = append(res.Messages, m)
+        ids = append(ids, msg.id)
+      }
+      res.Total++
+      return nil
+    })
+    if err != nil {
+      apiError(w, http.StatusBadRequest, "%v", err)
+      return
+    }
+  } else if res.Total, err = db.CountMessages(&filter); err == nil {
+    err = db.ListMessages(&filter, func(msg *Message) error {
+      res.Messages = append(res.Messages, apiMessageJSON{messageJSON: makeMessageJSON(msg)})
+      ids = append(ids, msg.id)
+      return nil
+    })
+  }
+  var unread map[[24]byte]bool
+  if err == nil {
+    unread, err = db.UnreadMessages(ids)
+  }
+  if err != nil {
+    apiError(w, http.StatusInternalServerError, "%v", err)
+    return
+  }
+  for i := range res.Messages {
+    res.Messages[i].Unread = unread[ids[i]]
+  }
+  writeJSON(w, http.StatusOK, res)
+}
+
+// GET /v1/health
+func apiHealth(w http.ResponseWriter, r *http.Request) {
+  if !apiAllowMethods(w, r, "GET", "HEAD") {
+    return
+  }
+  res := map[string]interface{}{
+    "status":  "ok",
+    "version": VERSION,
+    "build":   BUILDTAG,
+  }
+  if st := msgsync.LastScan(); st != nil {
+    res["last_scan"] = st
+  }
+  writeJSON(w, http.StatusOK, res)
+}
+
+// POST /v1/messages
+//
+// Receiving a message which is already in the database is not an error, which makes it
+// safe for the sender to retry.
+func apiPostMessage(w http.ResponseWriter, r *http.Request) {
+  if r.ContentLength > int64(receiveLimits.total) {
+    apiError(w, http.StatusRequestEntityTooLarge, "message too large (limit %d)",
+      receiveLimits.total)
+    return
+  }
+  size := int(r.ContentLength)
+  if size < 0 { // unknown, e.g. chunked encoding
+    size = receiveLimits.total
+  }
+  // messages without a time field are timestamped on arrival
+  msg, isnew, err := receiveMessage(r.Body, size, time.Now(), "", requestAuthenticated(r))
+  if err != nil {
+    e := err.(*receiveError)
+    switch e.code {
+    case replyNoRecipient:
+      writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+        "error": e.Error(),
+        "code":  e.code,
+      })
+    case replyTooLarge:
+      apiError(w, http.StatusRequestEntityTooLarge, "%v", e)
+    case replyInvalid:
+      apiError(w, http.StatusBadRequest, "%v", e)
+    default:
+      apiError(w, http.StatusInternalServerError, "%v", e)
+    }
+    if e.code != replyLocalError {
+      requestLog(r).Debugf("rejected message: %v", e)
+    }
+    return
+  }
+  res := map[string]string{"id": msg.IdString()}
+  if isnew {
+    writeJSON(w, http.StatusCreated, res)
+  } else {
+    writeJSON(w, http.StatusOK, res)
+  }
+}
+
+// Reply codes of receiveError, like those of SMTP
+const (
+  replyLocalError  = 451 // the server failed; try again later
+  replyNoRecipient = 550 // no recipient is hosted by the server
+  replyTooLarge    = 552 // the message exceeds receiveLimits
+  replyInvalid     = 554 // the message is malformed or invalid
+)
+
+// receiveError is an error of receiveMessage
+type receiveError struct {
+  code int // e.g. replyInvalid
+  err  error
+}
+
+func (e *receiveError) Error() string { return e.err.Error() }
+
+// receiveMessage receives a message of up to size bytes from r into the inbox, for
+// POST /v1/messages and the peer protocol (see peerConn.)
+//
+// The message is parsed while it's received, so that a message exceeding receiveLimits is
+// rejected without reading the rest of it. Meanwhile it's written to a file in TMPDIR,
+// which is linked into INBOXDIR once the message is complete and valid.
+// Messages without a time field get the time deftime. If id is not empty, the message
+// must have that id. authed is false if the sender didn't need an API token, e.g. with
+// serve -no-auth, in which case urgent messages may be rejected (see
+// Config.RejectUnauthenticatedUrgent.)
+// isnew is false if the message was already in the database. Errors are *receiveError.
+func receiveMessage(r io.Reader, size int, deftime time.Time, id string, authed bool) (
+  msg *Message, isnew bool, err error,
+) {
+  msg, isnew, err = storeMessage(r, size, deftime, id, authed)
+  if isnew {
+    if err := sendReceipt(msg, receiptDelivered); err != nil {
+      errlog("failed to send receipt for message %s: %v", msg, err)
+    }
+  }
+  return
+}
+
+// storeMessage is receiveMessage without sending a receipt for the message
+func storeMessage(r io.Reader, size int, deftime time.Time, id string, authed bool) (
+  msg *Message, isnew bool, err error,
+) {
+  f, err := os.CreateTemp(TMPDIR, "receive-*")
+  if err != nil {
+    return nil, false, &receiveError{replyLocalError, err}
+  }
+  defer os.Remove(f.Name())
+  defer f.Close()
+
+  msg = &Message{time: deftime.Truncate(time.Second)}
+  err = msg.ParseReaderLimits(io.TeeReader(r, f), size, "message", receiveLimits)
+  if err == nil {
+    err = msg.Validate()
+  }
+  if err == nil && msg.priority == priorityUrgent && !authed &&
+    config.RejectUnauthenticatedUrgent {
+    err = errorf("urgent messages are only accepted with an API token")
+  }
+  if err == nil && id != "" && msg.IdString() != id {
+    err = errorf("message has id %s, expected %s", msg.IdString(), id)
+  }
+  if err != nil {
+    if errors.Is(err, ErrTooLarge) {
+      return nil, false, &receiveError{replyTooLarge, err}
+    }
+    metricParseFailures.Inc()
+    return nil, false, &receiveError{replyInvalid, err}
+  }
+  var owners []string
+  if len(config.Recipients) > 0 {
+    if owners = hostedRecipients(msg); len(owners) == 0 {
+      err = errorf("no such recipient %s", msg.to.address)
+      return nil, false, &receiveError{replyNoRecipient, err}
+    }
+  }
+
+  // receipts update the status of the message they are for, instead of being received
+  if msg.receipt != receiptNone {
+    if err := applyReceipt(msg); err != nil {
+      return nil, false, &receiveError{replyLocalError, err}
+    }
+    return msg, false, nil
+  }
+
+  if exists, err := db.HasMessage(msg.id); err != nil {
+    return nil, false, &receiveError{replyLocalError, err}
+  } else if exists {
+    return msg, false, nil
+  }
+
+  err = f.Sync()
+  if err2 := f.Close(); err == nil {
+    err = err2
+  }
+  if err == nil {
+    err = receiveMessageFile(msg, f.Name(), owners)
+  }
+  if err != nil {
+    errlog("failed to receive message %s: %v", msg, err)
+    return nil, false, &receiveError{replyLocalError, err}
+  }
+  metricMessagesReceived.Inc()
+  servelog.Debugf("received message %s", msg)
+  return msg, true, nil
+}
+
+// hostedRecipients returns the recipients of msg which are hosted by the server
+// (Config.Recipients)
+func hostedRecipients(msg *Message) []string {
+  var owners []string
+  for _, a := range msg.Recipients() {
+    // note: the address names a directory
+    if !config.IsHostedRecipient(a.address) || strings.ContainsAny(a.address, `/\`) ||
+      a.address[0] == '.' || indexOfString(owners, a.address) != -1 {
+      continue
+    }
+    owners = append(owners, a.address)
+  }
+  return owners
+}
+
+// receiveMessageFile links file into INBOXDIR and adds msg to the database.
+// If owners is not empty, the message is instead linked into the inbox directory of each
+// owner, INBOXDIR/<owner>, and recorded as theirs.
+// Inbox files are named by time, like queued messages.
+func receiveMessageFile(msg *Message, file string, owners []string) error {
+  dirs := []string{INBOXDIR}
+  if len(owners) > 0 {
+    dirs = dirs[:0]
+    for _, owner := range owners {
+      dirs = append(dirs, filepath.Join(INBOXDIR, owner))
+    }
+  }
+  name := msg.time.UTC().Format("20060102-150405")
+  for i, dir := range dirs {
+    dir, err := messageDir(dir, msg.time)
+    if err != nil {
+      return err
+    }
+    dstfile := filepath.Join(dir, name+".msg")
+    for n := 2; ; n++ {
+      err := os.Link(file, dstfile)
+      if err == nil {
+        break
+      }
+      if !os.IsExist(err) {
+        return err
+      }
+      dstfile = filepath.Join(dir, fmt.Sprintf("%s.%d.msg", name, n))
+    }
+    if i == 0 {
+      msg.file = relPath(MSGDIR, dstfile)
+    }
+  }
+  msg.folder = "inbox"
+  added, err := db.PutMessage(msg)
+  if err != nil {
+    return err
+  }
+  for _, owner := range owners {
+    if err := db.AddMessageOwner(msg.id, owner); err != nil {
+      return err
+    }
+  }
+  if added {
+    msgsync.messageAdded(msg)
+  }
+  return nil
+}
+
+// GET /v1/messages/{id}[/raw|/files/{n}]
+func apiMessage(w http.ResponseWriter, r *http.Request) {
+  if !apiAllowMethods(w, r, "GET", "HEAD") {
+    return
+  }
+  path := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/messages/"), "/")
+  msg, err := loadMessage(path[0])
+  if err == nil {
+    if owner := requestOwner(r); owner != "" {
+      var ok bool
+      if ok, err = db.IsMessageOwner(msg.id, owner); err == nil && !ok {
+        err = errorf("message %s %w", path[0], ErrNotFound)
+      }
+    }
+  }
+  if err != nil {
+    apiError(w, httpStatusOf(err), "%v", err)
+    return
+  }
+
+  switch {
+  case len(path) == 1:
+    m := makeMessageDetailJSON(msg)
+    unread, err := db.UnreadMessages([][24]byte{msg.id})
+    if err != nil {
+      apiError(w, http.StatusInternalServerError, "%v", err)
+      return
+    }
+    m.Unread = unread[msg.id]
+    writeJSON(w, http.StatusOK, m)
+
+  case len(path) == 2 && path[1] == "raw":
+    if msg.file == "" {
+      apiError(w, http.StatusNotFound, "the file of message %s is not available", path[0])
+      return
+    }
+    f, err := os.Open(filepath.Join(MSGDIR, msg.file))
+    if err != nil {
+      apiError(w, http.StatusNotFound, "%v", err)
+      return
+    }
+    defer f.Close()
+    st, err := f.Stat()
+    if err != nil {
+      apiError(w, http.StatusInternalServerError, "%v", err)
+      return
+    }
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    http.ServeContent(w, r, filepath.Base(msg.file), st.ModTime(), f)
+
+  case len(path) == 3 && path[1] == "files":
+    n, err := strconv.Atoi(path[2])
+    if err != nil || n < 0 || n >= len(msg.files) {
+      apiError(w, http.StatusNotFound, "message %s has no file %q", path[0], path[2])
+      return
+    }
+    a := &msg.files[n]
+    rd, err := a.Open()
+    if err != nil {
+      apiError(w, http.StatusInternalServerError, "%v", err)
+      return
+    }
+    defer rd.Close()
+    // Files are whatever senders made them, e.g. HTML with scripts, so they're served as
+    // downloads, and in a sandbox without scripts when opened anyway. The web UI reads
+    // them with fetch, which isn't affected.
+    w.Header().Set("Content-Type", attachmentContentType(a.name))
+    w.Header().Set("Content-Length", strconv.Itoa(a.dataLen))
+    w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+      map[string]string{"filename": filepath.Base(a.name)}))
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'")
+    w.WriteHeader(http.StatusOK)
+    if r.Method != "HEAD" {
+      io.Copy(w, rd)
+    }
+
+  default:
+    apiError(w, http.StatusNotFound, "not found")
+  }
+}
@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "encoding/json"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+// testAPIServer serves the API of a MSGDIR with 3 messages, the last of which has a
+// file "hello.html"
+func testAPIServer(t *testing.T, auth bool) *httptest.Server {
+  testMsgDir(t)
+  writeTestMessages(t, 2)
+  tm := time.Date(2022, 6, 2, 10, 0, 0, 0, time.UTC)
+  text := testMessageText("With a file", "bob@example.com", tm, "See file") +
+    "\nfile 25 hello.html\n<script>alert(1)</script>\n"
+  writeTestFile(t, INBOXDIR, "20220602-100000.msg", text)
+  scanTestFolder(t, "inbox")
+  srv := httptest.NewServer(newAPIHandler(auth))
+  t.Cleanup(srv.Close)
+  return srv
+}
+
+// getTest requests path of srv and returns the response with its body
+func getTest(t *testing.T, srv *httptest.Server, path string) (*http.Response, []byte) {
+  t.Helper()
+  res, err := http.Get(srv.URL + path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer res.Body.Close()
+  body, err := io.ReadAll(res.Body)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return res, body
+}
+
+func getTestJSON(t *testing.T, srv *httptest.Server, path string, v interface{}) {
+  t.Helper()
+  res, body := getTest(t, srv, path)
+  if res.StatusCode != http.StatusOK {
+    t.Fatalf("GET %s: %s: %s", path, res.Status, body)
+  }
+  if err := json.Unmarshal(body, v); err != nil {
+    t.Fatalf("GET %s: %v", path, err)
+  }
+}
+
+func TestAPIListMessages(t *testing.T) {
+  srv := testAPIServer(t, false)
+  var list messageListJSON
+  getTestJSON(t, srv, "/v1/messages", &list)
+  if list.Total != 3 || len(list.Messages) != 3 || list.Limit != apiDefaultLimit {
+    t.Fatalf("got %d of %d messages, limit %d; expected 3 of 3, limit %d",
+      len(list.Messages), list.Total, list.Limit, apiDefaultLimit)
+  }
+  if s := list.Messages[0].Subject; s != "With a file" {
+    t.Errorf("first message is %q; expected the newest one", s)
+  }
+
+  // pages
+  var page messageListJSON
+  getTestJSON(t, srv, "/v1/messages?limit=1&offset=1", &page)
+  if page.Total != 3 || len(page.Messages) != 1 || page.Messages[0].Id != list.Messages[1].Id {
+    t.Errorf("page at offset 1 = %+v; expected the second message", page)
+  }
+  getTestJSON(t, srv, "/v1/messages?from=bob@example.com", &page)
+  if page.Total != 1 || page.Messages[0].From != "bob@example.com" {
+    t.Errorf("messages from bob = %+v; expected 1", page)
+  }
+
+  for _, query := range []string{"limit=0", "limit=x", "offset=-1", "order=x", "after=x"} {
+    if res, _ := getTest(t, srv, "/v1/messages?"+query); res.StatusCode != http.StatusBadRequest {
+      t.Errorf("?%s: %s; expected 400", query, res.Status)
+    }
+  }
+}
+
+func TestAPIGetMessage(t *testing.T) {
+  srv := testAPIServer(t, false)
+  var list messageListJSON
+  getTestJSON(t, srv, "/v1/messages", &list)
+  id := list.Messages[0].Id
+
+  var m messageDetailJSON
+  getTestJSON(t, srv, "/v1/messages/"+id, &m)
+  if m.Id != id || m.Body != "See file" || len(m.Files) != 1 || m.Files[0].Name != "hello.html" ||
+    m.Files[0].Size != 25 {
+    t.Errorf("message = %+v", m)
+  }
+
+  res, body := getTest(t, srv, "/v1/messages/"+id+"/raw")
+  data, _ := os.ReadFile(filepath.Join(INBOXDIR, "20220602-100000.msg"))
+  if res.StatusCode != http.StatusOK || string(body) != string(data) {
+    t.Errorf("raw: %s %q; expected the message file", res.Status, body)
+  }
+
+  res, body = getTest(t, srv, "/v1/messages/"+id+"/files/0")
+  if res.StatusCode != http.StatusOK || string(body) != "<script>alert(1)</script>" {
+    t.Fatalf("file 0: %s %q", res.Status, body)
+  }
+  for name, want := range map[string]string{
+    "Content-Type":            "text/html; charset=utf-8",
+    "Content-Length":          "25",
+    "Content-Disposition":     `attachment; filename=hello.html`,
+    "X-Content-Type-Options":  "nosniff",
+    "Content-Security-Policy": "sandbox; default-src 'none'",
+  } {
+    if got := res.Header.Get(name); got != want {
+      t.Errorf("file 0: %s: %q; expected %q", name, got, want)
+    }
+  }
+
+  for _, path := range []string{id + "/files/1", id + "/files/x", id + "/x", "0000"} {
+    if res, _ := getTest(t, srv, "/v1/messages/"+path); res.StatusCode != http.StatusNotFound &&
+      res.StatusCode != http.StatusBadRequest {
+      t.Errorf("%s: %s; expected 404 or 400", path, res.Status)
+    }
+  }
+}
+
+func TestAPIRequiresToken(t *testing.T) {
+  srv := testAPIServer(t, true)
+  for _, path := range []string{"/v1/messages", "/v1/health"} {
+    if res, _ := getTest(t, srv, path); res.StatusCode != http.StatusUnauthorized {
+      t.Errorf("%s without a token: %s; expected 401", path, res.Status)
+    }
+  }
+}
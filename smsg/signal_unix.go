@@ -0,0 +1,24 @@
+// SPDX-License-Identifier: Apache-2.0
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// exitSignals are the signals which shut down the program (see HandleSignal)
+var exitSignals = []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM}
+
+// termResizeSignals are the signals received when the terminal is resized
+var termResizeSignals = []os.Signal{syscall.SIGWINCH}
+
+// handleRescanSignal makes SIGUSR1 request a scan of MSGDIR, e.g. after files have been
+// copied into it while watching it doesn't work (see MessageSyncer.Rescan)
+func handleRescanSignal() {
+	HandleSignal(syscall.SIGUSR1, func() {
+		logger.Infof("SIGUSR1: rescanning %s", MSGDIR)
+		msgsync.Rescan()
+	})
+}
@@ -0,0 +1,20 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// exitSignals are the signals which shut down the program (see HandleSignal).
+// The Go runtime delivers Ctrl-C and Ctrl-Break as os.Interrupt, and the console window
+// being closed, the user logging off and the system shutting down as SIGTERM. Note that
+// Windows ends the process soon after the latter, after 5 seconds for a closed console.
+var exitSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// termResizeSignals are the signals received when the terminal is resized; there are
+// none on Windows, so the terminal UI keeps the size it started with
+var termResizeSignals []os.Signal
+
+// handleRescanSignal does nothing on Windows, which has no SIGUSR1
+func handleRescanSignal() {}
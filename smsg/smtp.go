@@ -0,0 +1,407 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "context"
+  "fmt"
+  "io"
+  "net"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// The SMTP gateway receives email into the inbox, for correspondents who only have email.
+// It speaks a minimal subset of ESMTP (RFC 5321): HELO, EHLO, MAIL, RCPT, DATA, RSET,
+// NOOP, VRFY and QUIT. It only accepts email for local addresses (or the hosted
+// recipients of the config), so it can't be used to relay email elsewhere, and it never
+// sends email itself. Emails are converted to messages by convertEmail.
+
+const (
+  smtpTimeout       = 5 * time.Minute // for each command and line of DATA (RFC 5321 4.5.3.2)
+  smtpMaxLine       = 1000            // max length of a command line, including CRLF
+  smtpMaxRecipients = 100
+  smtpMaxErrors     = 10 // bad commands after which the connection is closed
+)
+
+var errSMTPLineTooLong = errorf("line too long")
+
+// smtpServer accepts SMTP connections
+type smtpServer struct {
+  ln       net.Listener
+  hostname string
+  limiter  *rateLimiter
+
+  mu     sync.Mutex
+  conns  map[net.Conn]struct{}
+  closed bool
+  wg     sync.WaitGroup
+}
+
+func newSMTPServer(ln net.Listener) *smtpServer {
+  hostname, err := os.Hostname()
+  if err != nil || hostname == "" {
+    hostname = "localhost"
+  }
+  return &smtpServer{
+    ln:       ln,
+    hostname: hostname,
+    limiter:  newRateLimiter(rateLimit(), rateBurst(), maxUploadsPerClient),
+    conns:    map[net.Conn]struct{}{},
+  }
+}
+
+// Serve accepts connections until Shutdown is called
+func (s *smtpServer) Serve() error {
+  for {
+    conn, err := s.ln.Accept()
+    if err != nil {
+      s.mu.Lock()
+      closed := s.closed
+      s.mu.Unlock()
+      if closed {
+        return nil
+      }
+      if ne, ok := err.(net.Error); ok && ne.Temporary() {
+        time.Sleep(100 * time.Millisecond)
+        continue
+      }
+      return err
+    }
+    addr, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+    now := time.Now()
+    if ok, _ := s.limiter.allow(addr, now); !ok || !s.limiter.beginUpload(addr, now) {
+      metricAPIRateLimited.Inc()
+      conn.SetWriteDeadline(now.Add(time.Second))
+      io.WriteString(conn, "421 too many connections; try again later\r\n")
+      conn.Close()
+      continue
+    }
+    s.mu.Lock()
+    if s.closed {
+      s.mu.Unlock()
+      conn.Close()
+      return nil
+    }
+    s.conns[conn] = struct{}{}
+    s.wg.Add(1)
+    s.mu.Unlock()
+    go func() {
+      defer s.wg.Done()
+      defer s.limiter.endUpload(addr)
+      s.serveConn(conn)
+      s.mu.Lock()
+      delete(s.conns, conn)
+      s.mu.Unlock()
+    }()
+  }
+}
+
+// Shutdown stops accepting connections and closes open ones. Emails being received are
+// not stored; their senders retry them.
+func (s *smtpServer) Shutdown(ctx context.Context) error {
+  s.mu.Lock()
+  s.closed = true
+  s.ln.Close()
+  for conn := range s.conns {
+    conn.Close()
+  }
+  s.mu.Unlock()
+  done := make(chan struct{})
+  go func() {
+    s.wg.Wait()
+    close(done)
+  }()
+  select {
+  case <-done:
+    return nil
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+}
+
+// smtpSession is the state of an SMTP connection
+type smtpSession struct {
+  server *smtpServer
+  conn   net.Conn
+  r      *bufio.Reader
+  w      *bufio.Writer
+  helo   string // argument of HELO or EHLO
+
+  // mail transaction
+  hasFrom bool
+  from    string   // reverse-path of MAIL; empty for bounces ("<>")
+  rcpts   []string // forward-paths of RCPT
+}
+
+func (s *smtpServer) serveConn(conn net.Conn) {
+  defer conn.Close()
+  sess := &smtpSession{
+    server: s,
+    conn:   conn,
+    r:      bufio.NewReaderSize(conn, smtpMaxLine),
+    w:      bufio.NewWriter(conn),
+  }
+  if err := sess.reply(220, s.hostname+" smsg ESMTP"); err != nil {
+    return
+  }
+  nerrors := 0
+  for {
+    line, err := sess.readLine()
+    if err == errSMTPLineTooLong {
+      err = sess.reply(500, "line too long")
+      nerrors++
+    } else if err == nil {
+      var code int
+      code, err = sess.command(line)
+      if code == 221 {
+        return
+      }
+      if code >= 500 {
+        nerrors++
+      }
+    }
+    if err != nil {
+      if err != io.EOF {
+        smtplog.Debugf("%s: %v", conn.RemoteAddr(), err)
+      }
+      return
+    }
+    if nerrors > smtpMaxErrors {
+      sess.reply(421, "too many errors")
+      return
+    }
+  }
+}
+
+// reply writes a response. Each line of text is written as a line of the response.
+func (sess *smtpSession) reply(code int, text string) error {
+  lines := strings.Split(text, "\n")
+  for i, line := range lines {
+    sep := "-"
+    if i == len(lines)-1 {
+      sep = " "
+    }
+    fmt.Fprintf(sess.w, "%d%s%s\r\n", code, sep, line)
+  }
+  sess.conn.SetWriteDeadline(time.Now().Add(smtpTimeout))
+  return sess.w.Flush()
+}
+
+// readLine reads a command line, without its line ending
+func (sess *smtpSession) readLine() (string, error) {
+  sess.conn.SetReadDeadline(time.Now().Add(smtpTimeout))
+  line, err := sess.r.ReadSlice('\n')
+  if err == bufio.ErrBufferFull {
+    // skip the rest of the line
+    for err == bufio.ErrBufferFull {
+      _, err = sess.r.ReadSlice('\n')
+    }
+    if err == nil {
+      err = errSMTPLineTooLong
+    }
+    return "", err
+  }
+  if err != nil {
+    return "", err
+  }
+  return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// readData reads the content of DATA up to the line with a single ".", undoing
+// dot-stuffing. Content beyond limit is read but not kept, and toolarge is set.
+func (sess *smtpSession) readData(limit int) (data []byte, toolarge bool, err error) {
+  var buf bytes.Buffer
+  linestart := true
+  for {
+    sess.conn.SetReadDeadline(time.Now().Add(smtpTimeout))
+    line, err := sess.r.ReadSlice('\n')
+    if err != nil && err != bufio.ErrBufferFull {
+      return nil, false, err
+    }
+    // note: lines longer than the buffer are read in pieces
+    if linestart && len(line) > 0 && line[0] == '.' {
+      if s := string(line); s == ".\r\n" || s == ".\n" {
+        return buf.Bytes(), toolarge, nil
+      }
+      line = line[1:]
+    }
+    linestart = err == nil
+    if buf.Len()+len(line) > limit {
+      toolarge = true
+    } else if !toolarge {
+      buf.Write(line)
+    }
+  }
+}
+
+func (sess *smtpSession) resetTransaction() {
+  sess.hasFrom = false
+  sess.from = ""
+  sess.rcpts = nil
+}
+
+// command handles a command line and returns the code it replied with
+func (sess *smtpSession) command(line string) (int, error) {
+  verb, arg := line, ""
+  if p := strings.IndexByte(line, ' '); p != -1 {
+    verb, arg = line[:p], strings.TrimSpace(line[p+1:])
+  }
+  reply := func(code int, text string) (int, error) {
+    return code, sess.reply(code, text)
+  }
+  switch strings.ToUpper(verb) {
+
+  case "HELO", "EHLO":
+    if arg == "" {
+      return reply(501, "missing domain")
+    }
+    sess.helo = arg
+    sess.resetTransaction()
+    if strings.ToUpper(verb) == "HELO" {
+      return reply(250, sess.server.hostname)
+    }
+    return reply(250, sess.server.hostname+" greets "+arg+"\n"+
+      "SIZE "+strconv.Itoa(receiveLimits.total)+"\n"+
+      "8BITMIME")
+
+  case "MAIL":
+    if sess.helo == "" {
+      return reply(503, "send HELO or EHLO first")
+    }
+    if sess.hasFrom {
+      return reply(503, "nested MAIL command")
+    }
+    path, params, err := parseSMTPPath(arg, "FROM:")
+    if err != nil {
+      return reply(501, err.Error())
+    }
+    for _, param := range params {
+      if k, v, _ := strings.Cut(param, "="); strings.EqualFold(k, "SIZE") {
+        if size, err := strconv.Atoi(v); err == nil && size > receiveLimits.total {
+          return reply(552, "message too large (limit "+strconv.Itoa(receiveLimits.total)+")")
+        }
+      }
+    }
+    if path != "" {
+      if path, err = normalizeAndValidateAddress(path); err != nil {
+        return reply(553, "invalid address")
+      }
+    }
+    sess.hasFrom = true
+    sess.from = path
+    return reply(250, "OK")
+
+  case "RCPT":
+    if !sess.hasFrom {
+      return reply(503, "send MAIL first")
+    }
+    path, _, err := parseSMTPPath(arg, "TO:")
+    if err != nil {
+      return reply(501, err.Error())
+    }
+    address, err := normalizeAndValidateAddress(path)
+    if err != nil {
+      return reply(553, "invalid address")
+    }
+    if !acceptsEmailFor(address) {
+      // note: this is what keeps the server from being an open relay
+      return reply(550, "no such user here")
+    }
+    if len(sess.rcpts) >= smtpMaxRecipients {
+      return reply(452, "too many recipients")
+    }
+    if indexOfString(sess.rcpts, address) == -1 {
+      sess.rcpts = append(sess.rcpts, address)
+    }
+    return reply(250, "OK")
+
+  case "DATA":
+    if !sess.hasFrom || len(sess.rcpts) == 0 {
+      return reply(503, "send MAIL and RCPT first")
+    }
+    if err := sess.reply(354, "end data with <CR><LF>.<CR><LF>"); err != nil {
+      return 354, err
+    }
+    data, toolarge, err := sess.readData(receiveLimits.total)
+    if err != nil {
+      return 0, err
+    }
+    defer sess.resetTransaction()
+    if toolarge {
+      return reply(552, "message too large (limit "+strconv.Itoa(receiveLimits.total)+")")
+    }
+    return reply(sess.receive(data))
+
+  case "RSET":
+    sess.resetTransaction()
+    return reply(250, "OK")
+
+  case "NOOP":
+    return reply(250, "OK")
+
+  case "VRFY":
+    return reply(252, "cannot VRFY user")
+
+  case "QUIT":
+    return reply(221, "bye")
+
+  case "":
+    return reply(500, "missing command")
+
+  default:
+    return reply(502, "command not implemented")
+  }
+}
+
+// receive converts an email to a message and stores it in the inbox.
+// It returns the reply to the DATA command.
+func (sess *smtpSession) receive(data []byte) (int, string) {
+  encoded, err := convertEmail(data, Author{address: sess.from}, sess.rcpts)
+  if err != nil {
+    metricParseFailures.Inc()
+    smtplog.Debugf("%s: invalid email: %v", sess.conn.RemoteAddr(), err)
+    return replyInvalid, "invalid message: " + oneLine(err.Error())
+  }
+  // note: receipts are not sent for emails; their senders don't use smolmsg
+  msg, _, err := storeMessage(bytes.NewReader(encoded), len(encoded), time.Now(), "", false)
+  if err != nil {
+    e := err.(*receiveError)
+    smtplog.Debugf("%s: %v", sess.conn.RemoteAddr(), e)
+    return e.code, oneLine(e.Error())
+  }
+  smtplog.Debugf("received email from %s as message %s", msg.from.address, msg)
+  return 250, "OK " + msg.IdString()
+}
+
+// acceptsEmailFor returns true if the SMTP gateway receives email for address
+func acceptsEmailFor(address string) bool {
+  if len(config.Recipients) > 0 {
+    return config.IsHostedRecipient(address)
+  }
+  return config.IsLocalAddress(address)
+}
+
+// parseSMTPPath parses the argument of MAIL or RCPT, e.g. "FROM:<a@b> SIZE=123"
+func parseSMTPPath(arg, prefix string) (path string, params []string, err error) {
+  if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+    return "", nil, errorf("expected %s<address>", prefix)
+  }
+  arg = strings.TrimSpace(arg[len(prefix):])
+  end := strings.IndexByte(arg, '>')
+  if !strings.HasPrefix(arg, "<") || end == -1 {
+    return "", nil, errorf("expected %s<address>", prefix)
+  }
+  path = arg[1:end]
+  // source routes, like "<@relay:a@b>", are ignored (RFC 5321 4.1.1.3)
+  if p := strings.IndexByte(path, ':'); p != -1 && strings.HasPrefix(path, "@") {
+    path = path[p+1:]
+  }
+  return path, strings.Fields(arg[end+1:]), nil
+}
+
+
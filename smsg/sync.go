@@ -2,104 +2,1068 @@
 package main
 
 import (
+  "context"
+  "errors"
+  "fmt"
   "io"
   "io/fs"
   "os"
   "path/filepath"
+  "runtime"
   "strings"
   "sync"
   "sync/atomic"
+  "time"
 )
 
 var syncOldMessagesArray []*Message // TODO remove
 
+// inboxPollInterval is how often INBOXDIR is checked for new files when watching
+// without notifications from the operating system (see Config.InboxPoll)
+const inboxPollInterval = 2 * time.Second
+
+// scanWorkers returns the number of message files parsed at once when scanning
+func scanWorkers() int {
+  if config.ScanWorkers > 0 {
+    return config.ScanWorkers
+  }
+  return runtime.GOMAXPROCS(0) * 2
+}
+
+// defaultRescanInterval is how often the inbox is scanned while watching it, unless
+// configured otherwise (Config.RescanInterval)
+const defaultRescanInterval = 15 * time.Minute
+
+func rescanInterval() time.Duration {
+  if config.RescanInterval != nil {
+    return time.Duration(*config.RescanInterval)
+  }
+  return defaultRescanInterval
+}
+
+// newMessageQueueSize is the number of new messages which can wait for OnNewMessage
+// handlers to be called
+const newMessageQueueSize = 256
+
+// errScanBusy is returned by MessageSyncer.scan when a scan is already in progress
+var errScanBusy = errors.New("a scan is already in progress")
+
+// scanFolders are the folders which are scanned, in order (see MessageSyncer.main)
+var scanFolders = []string{"inbox", "outbox", "sent"}
+
+// errInterrupted is returned by MessageSyncer.WaitReady when the syncer is shut down
+// before it's ready
+var errInterrupted = errors.New("interrupted")
+
 type MessageSyncer struct {
-  shutdown   uint32
-  initscanwg sync.WaitGroup
+  shutdown  uint32
+  ctx       context.Context    // cancelled by Shutdown, which stops scans
+  cancel    context.CancelFunc
+  inboxscan chan struct{}      // closed when the initial scan of the inbox has finished
+  allscan   chan struct{}      // closed when the initial scan of all scanFolders has finished
+  maindone  chan struct{}      // closed when main has exited
+  watchdone chan struct{}      // closed when the watch loop has exited
+  rescanwg  sync.WaitGroup     // the goroutines of Watch other than the watch loop
+  rescanreq chan struct{}      // requests made with Rescan; holds at most one
+
+  watching   uint32        // 1 once new messages are reported to handlers
+  newmsgs    chan *Message // messages for OnNewMessage handlers (see messageAdded)
+  scanning   uint32        // 1 while scanning the inbox
+  lastScanMu sync.Mutex
+  lastScan   *scanStatus // of all scanFolders; nil until the first scan has finished
+
+  handlersMu sync.Mutex
+  handlers   []func(msg *Message)
+}
+
+// scanStatus is the result of a scan of the inbox
+type scanStatus struct {
+  Time      time.Time `json:"time"`    // when the scan finished
+  Seconds   float64   `json:"seconds"` // how long it took
+  Indexed   int       `json:"indexed"`
+  Unchanged int       `json:"unchanged"`
+  Failed    int       `json:"failed"`
+  Removed   int       `json:"removed"`
+  Moved     int       `json:"moved"`
+  Error     string    `json:"error,omitempty"`
 }
 
+// changed returns true if the scan found files which had been added, changed or removed
+func (st *scanStatus) changed() bool {
+  return st.Indexed > 0 || st.Removed > 0 || st.Moved > 0
+}
+
+// add adds the result of a scan of another folder to st
+func (st *scanStatus) add(other scanStatus) {
+  if other.Time.After(st.Time) {
+    st.Time = other.Time
+  }
+  st.Seconds += other.Seconds
+  st.Indexed += other.Indexed
+  st.Unchanged += other.Unchanged
+  st.Failed += other.Failed
+  st.Removed += other.Removed
+  st.Moved += other.Moved
+  if other.Error != "" {
+    if st.Error != "" {
+      st.Error += "; "
+    }
+    st.Error += other.Error
+  }
+}
+
+// Start starts scanning folders in the background. It's stopped by Shutdown, which is
+// called at exit.
 func (ms *MessageSyncer) Start() {
-  dlog("[sync] start")
-  RegisterExitHandler(ms.Shutdown)
-  ms.initscanwg.Add(1)
+  synclog.Debugf("start")
+  ms.ctx, ms.cancel = context.WithCancel(context.Background())
+  ms.inboxscan = make(chan struct{})
+  ms.allscan = make(chan struct{})
+  ms.maindone = make(chan struct{})
+  RegisterExitHandler(ms.Shutdown, "sync")
   go ms.main()
 }
 
-func (ms *MessageSyncer) WaitReady() {
-  ms.initscanwg.Wait()
+// OnNewMessage registers fn to be called for every message which is added to the inbox
+// while watching (see Watch), but not for messages which were already in the database.
+// Handlers are called one at a time, in the order of arrival, on a goroutine of their
+// own so that they don't hold up indexing. If they fall behind by more than
+// newMessageQueueSize messages, the messages in excess are not reported.
+//
+// A message found by a scan is reported once the transaction which added it to the
+// database has been committed (see indexWriter), so handlers can read it from there.
+func (ms *MessageSyncer) OnNewMessage(fn func(msg *Message)) {
+  ms.handlersMu.Lock()
+  defer ms.handlersMu.Unlock()
+  ms.handlers = append(ms.handlers, fn)
+}
+
+// Watch makes the syncer keep indexing message files which are added to INBOXDIR after
+// the initial scan, until Shutdown is called.
+func (ms *MessageSyncer) Watch() {
+  if ms.watchdone != nil {
+    return
+  }
+  ms.watchdone = make(chan struct{})
+  ms.newmsgs = make(chan *Message, newMessageQueueSize)
+  ms.rescanreq = make(chan struct{}, 1)
+  ms.rescanwg.Add(2)
+  go ms.dispatchNewMessages()
+  go ms.watch()
+  go ms.rescan(rescanInterval())
+}
+
+func (ms *MessageSyncer) watch() {
+  defer close(ms.watchdone)
+  if ms.WaitReady() != nil {
+    return
+  }
+
+  // note: messages added before here, e.g. by the initial scan, are not reported to
+  // OnNewMessage handlers
+  atomic.StoreUint32(&ms.watching, 1)
+  w := &inboxWatcher{
+    ms:      ms,
+    ignore:  loadIgnoreRules(),
+    known:   map[string]bool{},
+    pending: map[string]*pendingFile{},
+    files:   newFileRecordCache(),
+  }
+  for _, file := range ms.inboxFiles(w.ignore) {
+    w.known[file] = true
+  }
+  if !config.InboxPoll {
+    err := w.watchEvents()
+    if err == nil {
+      return
+    }
+    synclog.Warnf("can't watch %s for changes (%v); checking it every %s instead",
+      relPath(MSGDIR, INBOXDIR), err, inboxPollInterval)
+  }
+  w.watchPoll()
+}
+
+// rescan scans all folders every interval (unless it's 0) until shutdown, to catch
+// changes which the inbox watcher missed, e.g. since notifications were lost or don't
+// work on a network mount, and files added to the other folders by other programs.
+// It also scans them when requested with Rescan.
+func (ms *MessageSyncer) rescan(interval time.Duration) {
+  defer ms.rescanwg.Done()
+  if ms.WaitAllReady() != nil {
+    return
+  }
+  var tick <-chan time.Time
+  if interval > 0 {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    tick = ticker.C
+  }
+  for {
+    select {
+    case <-ms.ctx.Done():
+      return
+    case <-tick:
+      ms.rescanOnce(false)
+    case <-ms.rescanreq:
+      ms.rescanOnce(true)
+    }
+  }
+}
+
+// Rescan requests a scan of all folders, like the periodic one, and returns right away.
+// The scan starts once the initial scan has finished and its result is logged. A request
+// made while a scan is running or already requested is ignored. Watch must have been
+// called.
+func (ms *MessageSyncer) Rescan() {
+  if atomic.LoadUint32(&ms.scanning) == 1 {
+    synclog.Debugf("not rescanning: a scan is running")
+    return
+  }
+  select {
+  case ms.rescanreq <- struct{}{}:
+  default:
+    synclog.Debugf("not rescanning: a rescan is already requested")
+  }
+}
+
+// rescanOnce scans all folders, unless a scan is running, and logs the result if
+// something changed, or always if verbose is true
+func (ms *MessageSyncer) rescanOnce(verbose bool) {
+  st, err := ms.scan(false, scanFolders...)
+  if err == errScanBusy || ms.ctx.Err() != nil {
+    return
+  }
+  ms.recordScan(st)
+  if err != nil {
+    synclog.Errorf("rescan failed: %v", err)
+  } else if verbose || st.changed() {
+    synclog.Infof("rescan: %d %s indexed, %d removed, %d moved",
+      st.Indexed, plural(st.Indexed, "file", "files"), st.Removed, st.Moved)
+  }
+}
+
+// scan scans folders, unless a scan is already in progress, in which case it returns
+// errScanBusy
+func (ms *MessageSyncer) scan(full bool, folders ...string) (st scanStatus, err error) {
+  if !atomic.CompareAndSwapUint32(&ms.scanning, 0, 1) {
+    return st, errScanBusy
+  }
+  defer atomic.StoreUint32(&ms.scanning, 0)
+  var errs scanErrors
+  for _, folder := range folders {
+    if ms.ctx.Err() != nil {
+      break
+    }
+    scanner := &MessageFileScanner{
+      ctx:    ms.ctx,
+      folder: folder,
+      full:   full,
+      follow: config.FollowSymlinks,
+    }
+    err := scanner.scan()
+    if err != nil {
+      err = errorf("%s: %v", folder, err)
+      errs = append(errs, err)
+    }
+    st.add(scanner.status(err))
+  }
+  if len(errs) > 0 {
+    err = errs
+  }
+  return st, err
+}
+
+// recordScan records st as the result of the last scan of all folders, unless the scan
+// was interrupted by shutdown
+func (ms *MessageSyncer) recordScan(st scanStatus) {
+  if ms.ctx.Err() != nil {
+    return
+  }
+  ms.lastScanMu.Lock()
+  ms.lastScan = &st
+  ms.lastScanMu.Unlock()
+}
+
+// LastScan returns the result of the last scan of all folders, or nil if there's been none
+func (ms *MessageSyncer) LastScan() *scanStatus {
+  ms.lastScanMu.Lock()
+  defer ms.lastScanMu.Unlock()
+  return ms.lastScan
+}
+
+// messageAdded reports a message which has been added to the inbox in the database to
+// OnNewMessage handlers, when watching. It never blocks.
+func (ms *MessageSyncer) messageAdded(msg *Message) {
+  if atomic.LoadUint32(&ms.watching) == 0 {
+    return
+  }
+  select {
+  case ms.newmsgs <- msg:
+  default:
+    metricNewMessagesDropped.Inc()
+    synclog.Warnf("too many new messages; not reporting message %s", msg.IdString())
+  }
+}
+
+// dispatchNewMessages calls OnNewMessage handlers for messages added to the inbox until
+// shutdown
+func (ms *MessageSyncer) dispatchNewMessages() {
+  defer ms.rescanwg.Done()
+  for {
+    select {
+    case <-ms.ctx.Done():
+      return
+    case msg := <-ms.newmsgs:
+      ms.handlersMu.Lock()
+      handlers := ms.handlers[:]
+      ms.handlersMu.Unlock()
+      for _, fn := range handlers {
+        fn(msg)
+      }
+    }
+  }
+}
+
+// inboxFiles returns the paths of all message files in INBOXDIR, except those excluded
+// by ignore
+func (ms *MessageSyncer) inboxFiles(ignore ignoreRules) []string {
+  var files []string
+  err := filepath.WalkDir(INBOXDIR, func(path string, d fs.DirEntry, err error) error {
+    if err != nil {
+      return err
+    }
+    if path == INBOXDIR {
+      return nil
+    }
+    // skip dot files and ignored files
+    if d.Name()[0] == '.' || ignore.ignored(relPath(MSGDIR, path), d.IsDir()) {
+      if d.IsDir() {
+        return filepath.SkipDir
+      }
+      return nil
+    }
+    if !d.IsDir() && strings.HasSuffix(path, ".msg") {
+      files = append(files, path)
+    }
+    return nil
+  })
+  if err != nil {
+    synclog.Errorf("failed to read inbox: %v", err)
+  }
+  return files
+}
+
+// WaitReady waits for the initial scan of the inbox to finish.
+// Returns errInterrupted if the syncer is shut down first.
+func (ms *MessageSyncer) WaitReady() error {
+  return ms.wait(context.Background(), ms.inboxscan)
+}
+
+// WaitReadyContext is like WaitReady but gives up when ctx is done, returning ctx.Err()
+func (ms *MessageSyncer) WaitReadyContext(ctx context.Context) error {
+  return ms.wait(ctx, ms.inboxscan)
+}
+
+// WaitAllReady waits for the initial scan of all folders to finish, which is needed for
+// sent messages and those in the outbox which were added by other programs.
+// Returns errInterrupted if the syncer is shut down first.
+func (ms *MessageSyncer) WaitAllReady() error {
+  return ms.wait(context.Background(), ms.allscan)
+}
+
+// waitFolderReady waits for the initial scan of the inbox if folder is "inbox", or else
+// of all folders (folder may also be e.g. "all"), like WaitReadyContext
+func (ms *MessageSyncer) waitFolderReady(ctx context.Context, folder string) error {
+  if folder == "inbox" {
+    return ms.wait(ctx, ms.inboxscan)
+  }
+  return ms.wait(ctx, ms.allscan)
+}
+
+func (ms *MessageSyncer) wait(ctx context.Context, ch chan struct{}) error {
+  if ms.ctx == nil {
+    return nil // not started
+  }
+  select {
+  case <-ch:
+    return nil
+  case <-ms.ctx.Done():
+    return errInterrupted
+  case <-ctx.Done():
+    return ctx.Err()
+  }
 }
 
 func (ms *MessageSyncer) main() {
-  // initial file system scan of MSGDIR
-  scanner := MessageFileScanner{}
-  scanner.scanInbox()
-  ms.initscanwg.Done()
+  defer close(ms.maindone)
+  // purge expired messages from the trash, and messages which have expired, while
+  // scanning. It's bounded in time so that it doesn't delay commands waiting for the scan.
+  var purgewg sync.WaitGroup
+  purgewg.Add(1)
+  go func() {
+    defer purgewg.Done()
+    autoPurgeTrash()
+    autoPurgeExpired()
+  }()
+
+  // initial file system scan of MSGDIR, inbox first so that commands which only need the
+  // inbox don't wait for the others, like a large sent folder
+  st, err := ms.scan(false, scanFolders[0])
+  if err != nil && ms.ctx.Err() == nil {
+    synclog.Errorf("failed to scan: %v", err)
+  }
+  purgewg.Wait()
+  close(ms.inboxscan)
+  st2, err := ms.scan(false, scanFolders[1:]...)
+  if err != nil && ms.ctx.Err() == nil {
+    synclog.Errorf("failed to scan: %v", err)
+  }
+  st.add(st2)
+  ms.recordScan(st)
+  close(ms.allscan)
 }
 
-func (ms *MessageSyncer) Shutdown() error {
+// Shutdown stops scans in progress and watching, and waits for them to stop until ctx
+// is done
+func (ms *MessageSyncer) Shutdown(ctx context.Context) error {
   if !atomic.CompareAndSwapUint32(&ms.shutdown, 0, 1) {
     return nil // race lost or already shut down
   }
-  // TODO
-  return nil
+  ms.cancel()
+  stopped := make(chan struct{})
+  go func() {
+    <-ms.maindone
+    if ms.watchdone != nil {
+      <-ms.watchdone
+    }
+    ms.rescanwg.Wait()
+    close(stopped)
+  }()
+  select {
+  case <-stopped:
+    return nil
+  case <-ctx.Done():
+    return ctx.Err()
+  }
 }
 
+// MessageFileScanner indexes the message files of a folder, e.g. INBOXDIR. Files which
+// have not changed since they were last indexed are skipped, unless full is set.
 type MessageFileScanner struct {
-  wg  sync.WaitGroup
-  err error
+  ctx    context.Context // stops the scan when cancelled
+  folder string          // one of scanFolders; MSGDIR/folder is scanned
+  full   bool            // parse all files, even those which have not changed
+  ignore ignoreRules     // files not to index (see msgIgnoreName)
+  follow bool            // follow symbolic links (see Config.FollowSymlinks)
+  rmdups bool            // remove files which duplicate another file (see found)
+
+  start time.Time
+
+  wg    sync.WaitGroup // files which have not yet been indexed
+  paths chan string    // files to be indexed by workers
+  files map[string]IndexedFile // files indexed before, by path relative to MSGDIR
+  seen  map[string]bool        // files found, by path relative to MSGDIR
+
+  // when following symbolic links: the real path of MSGDIR, and of the directories and
+  // files which have been scanned, so that links don't make the scan go in circles or
+  // index a file more than once
+  realMsgDir string
+  visited    map[string]bool
+
+  mu   sync.Mutex
+  ids  map[[24]byte]string // files found, by message id
+  dups map[string][24]byte // files whose message is also in another file
+  errs scanErrors          // errors other than files which failed to index
+
+  deferred []deferredFile // files which were being written (see retryDeferred)
+  writer   *indexWriter   // adds the messages of files to the database
+
+  // number of files indexed, skipped since unchanged, and which failed to index
+  nindexed, nskipped, nfailed uint32
+
+  // number of messages removed since their file is gone, and whose file has moved
+  nremoved, nmoved int
+
+  // number of duplicate files found, and removed (see rmdups)
+  ndups, ndupsRemoved int
 }
 
-func (s *MessageFileScanner) scanInbox() {
-  s.scanDir(INBOXDIR)
+// scan indexes the files of the folder. It returns the errors which prevented files
+// from being scanned, as scanErrors. Files which failed to index are logged and counted
+// (see nfailed.)
+func (s *MessageFileScanner) scan() error {
+  s.start = time.Now()
+  start := s.start
+  s.seen = map[string]bool{}
+  s.ids = map[[24]byte]string{}
+  s.dups = map[string][24]byte{}
+  s.ignore = loadIgnoreRules()
+  if !s.full {
+    var err error
+    if s.files, err = db.IndexedFiles(s.folder); err != nil {
+      return scanErrors{err}
+    }
+  }
+  // parse files with a fixed number of workers, so that a large folder doesn't open more
+  // files at once than the system allows
+  s.writer = newIndexWriter(s.written)
+  s.paths = make(chan string)
+  for n := scanWorkers(); n > 0; n-- {
+    go s.worker()
+  }
+  dir := filepath.Join(MSGDIR, s.folder)
+  realdir := dir
+  if s.follow {
+    var err error
+    if s.realMsgDir, err = filepath.EvalSymlinks(MSGDIR); err != nil {
+      return scanErrors{err}
+    }
+    if realdir, err = filepath.EvalSymlinks(dir); err != nil {
+      realdir = filepath.Join(s.realMsgDir, s.folder) // reported by scanDir
+    }
+    s.visited = map[string]bool{}
+  }
+  s.scanDir(dir, realdir, 0)
+  close(s.paths)
   s.wg.Wait() // wait for all operations to finish
-  if s.err != nil {
-    errlog("error in scanInbox: %v", s.err)
+  s.retryDeferred()
+  // commit the last batch, so that the scan's messages are in the database once it has
+  // finished, e.g. when WaitReady returns
+  s.writer.close()
+  if err := s.ctx.Err(); err != nil {
+    return err
+  }
+  if s.folder == "inbox" {
+    metricInboxScanSeconds.Set(time.Since(start).Seconds())
+  }
+  if len(s.errs) > 0 {
+    // parts of the folder were not scanned, so files not seen may still be there
+    return s.errs
+  }
+  // forget files which are gone. Their messages are removed by reconcile.
+  var gone []string
+  for path := range s.files {
+    if !s.seen[path] {
+      gone = append(gone, path)
+    }
+  }
+  if err := db.DeleteFiles(gone); err != nil {
+    s.fail(err)
   }
+  if err := s.reconcile(); err != nil {
+    s.fail(err)
+  }
+  if err := s.recordDuplicates(); err != nil {
+    s.fail(err)
+  }
+  synclog.Debugf("scanned %d files in %s in %s: %d indexed, %d unchanged, %d failed; "+
+    "%d removed, %d moved",
+    len(s.seen), s.folder, time.Since(start), s.nindexed, s.nskipped, s.nfailed, s.nremoved, s.nmoved)
+  if len(s.errs) > 0 {
+    return s.errs
+  }
+  return nil
+}
+
+// status returns the result of the scan, which ended with err
+func (s *MessageFileScanner) status(err error) scanStatus {
+  st := scanStatus{
+    Time:      time.Now(),
+    Seconds:   time.Since(s.start).Seconds(),
+    Indexed:   int(atomic.LoadUint32(&s.nindexed)),
+    Unchanged: int(atomic.LoadUint32(&s.nskipped)),
+    Failed:    int(atomic.LoadUint32(&s.nfailed)),
+    Removed:   s.nremoved,
+    Moved:     s.nmoved,
+  }
+  if err != nil {
+    st.Error = err.Error()
+  }
+  return st
 }
 
-func (s *MessageFileScanner) scanDir(dirpath string) {
+// fail records an error which happened while scanning
+func (s *MessageFileScanner) fail(err error) {
+  s.mu.Lock()
+  s.errs = append(s.errs, err)
+  s.mu.Unlock()
+}
+
+// scanErrors are the errors of a scan (see MessageFileScanner.scan)
+type scanErrors []error
+
+func (e scanErrors) Error() string {
+  if len(e) == 1 {
+    return e[0].Error()
+  }
+  var sb strings.Builder
+  fmt.Fprintf(&sb, "%d errors:", len(e))
+  for _, err := range e {
+    sb.WriteString("\n  ")
+    sb.WriteString(err.Error())
+  }
+  return sb.String()
+}
+
+// reconcile updates the messages in the folder whose files were not found by the scan:
+// messages whose file has moved within the folder get its new path, as do those whose
+// file is a duplicate of another file with a smaller path (see found), and in the inbox,
+// those whose file is gone, e.g. since it was deleted by hand, are removed from the
+// database.
+func (s *MessageFileScanner) reconcile() error {
+  files, err := db.MessageFiles(s.folder)
+  if err != nil {
+    return err
+  }
+  var removed [][24]byte
+  for id, file := range files {
+    newfile, ok := s.ids[id]
+    if s.seen[file] && (!ok || newfile == file) {
+      continue
+    }
+    if ok {
+      if err := db.MoveMessage(id[:], s.folder, s.folder, newfile); err != nil {
+        return err
+      }
+      if s.seen[file] {
+        // file is a duplicate of newfile
+        synclog.Debugf("message %x: file %s is now %s", id, file, newfile)
+      } else {
+        synclog.Debugf("message %x moved from %s to %s", id, file, newfile)
+        s.nmoved++
+      }
+      continue
+    }
+    if s.folder != "inbox" {
+      // files are moved from the outbox to sent before the database is updated, so the
+      // file of a message being delivered right now may seem to be gone
+      continue
+    }
+    // note: the file may have been added after its directory was scanned, e.g. by serve
+    if _, err := os.Stat(filepath.Join(MSGDIR, file)); err == nil {
+      continue
+    }
+    synclog.Debugf("removing message %x of deleted file %s", id, file)
+    removed = append(removed, id)
+  }
+  s.nremoved = len(removed)
+  return db.DeleteMessages(removed)
+}
+
+// freshFileAge is how long ago a file must have been modified for scans to index it
+// right away. More recently modified files may still be being written; they are indexed
+// once they stop changing (see retryDeferred.)
+const freshFileAge = 2 * time.Second
+
+// scanRetries is how many times a scan checks whether a file which is being written
+// has stopped changing before giving up on it
+const scanRetries = 4
+
+type deferredFile struct {
+  path string
+  rel  string // path relative to MSGDIR
+  info fs.FileInfo
+}
+
+// retryDeferred indexes the files which were modified less than freshFileAge ago when
+// they were found, once they have stopped changing: when they were last modified
+// freshFileAge ago (or, for files modified "in the future", haven't changed since the
+// previous check.) It checks after half of freshFileAge, then with doubling delays, and
+// gives up after scanRetries checks, about 15 seconds later.
+// Files it gives up on are counted as failed; they are indexed by a later scan.
+func (s *MessageFileScanner) retryDeferred() {
+  delay := freshFileAge / 2
+  for attempt := 0; len(s.deferred) > 0; attempt++ {
+    if attempt == scanRetries {
+      for _, f := range s.deferred {
+        synclog.With("file", f.rel).Warnf("not indexing file: it's still being written")
+        atomic.AddUint32(&s.nfailed, 1)
+      }
+      return
+    }
+    synclog.Debugf("waiting %s for %d %s being written", delay, len(s.deferred),
+      plural(len(s.deferred), "file", "files"))
+    select {
+    case <-s.ctx.Done():
+      return
+    case <-time.After(delay):
+    }
+    var changing []deferredFile
+    for _, f := range s.deferred {
+      info, err := os.Stat(f.path)
+      if err != nil {
+        // e.g. a temporary file which was renamed. Its message, if any, is removed like
+        // that of any other file which is gone.
+        delete(s.seen, f.rel)
+        continue
+      }
+      age := time.Since(info.ModTime())
+      if age < 0 && info.Size() == f.info.Size() && info.ModTime().Equal(f.info.ModTime()) {
+        // modified "in the future", i.e. the clock of whatever wrote it is ahead
+        age = freshFileAge
+      }
+      if age < freshFileAge {
+        f.info = info
+        changing = append(changing, f)
+        continue
+      }
+      s.wg.Add(1)
+      s.loadMessage(f.path)
+    }
+    s.deferred = changing
+    delay *= 2
+  }
+}
+
+// recordDuplicates records the duplicate files found by the scan in the database, for
+// smsg doctor, or removes them if rmdups is set and they are identical to the message's
+// file
+func (s *MessageFileScanner) recordDuplicates() error {
+  s.ndups = len(s.dups)
+  dups := make([]Duplicate, 0, len(s.dups))
+  var removed []string
+  for path, id := range s.dups {
+    d := Duplicate{path: path, id: id, canonical: s.ids[id]}
+    log := synclog.With("file", d.path)
+    log.Debugf("file is a duplicate of %s", d.canonical)
+    if s.rmdups {
+      if err := removeDuplicate(d); err != nil {
+        log.Warnf("not removing duplicate: %v", err)
+      } else {
+        removed = append(removed, d.path)
+        continue
+      }
+    }
+    dups = append(dups, d)
+  }
+  s.ndupsRemoved = len(removed)
+  if err := db.DeleteFiles(removed); err != nil {
+    return err
+  }
+  return db.SetDuplicates(s.folder, dups)
+}
+
+// removeDuplicate removes the file of d if it's identical to the canonical file
+func removeDuplicate(d Duplicate) error {
+  same, err := sameFileContent(filepath.Join(MSGDIR, d.path), filepath.Join(MSGDIR, d.canonical))
+  if err != nil {
+    return err
+  }
+  if !same {
+    // e.g. a different encoding of the same message
+    return errorf("it differs from %s", d.canonical)
+  }
+  synclog.With("file", d.path).Debugf("removing duplicate of %s", d.canonical)
+  return os.Remove(filepath.Join(MSGDIR, d.path))
+}
+
+// maxScanDepth limits how deep directories are scanned when following symbolic links,
+// in case links form a loop which isn't noticed, e.g. through a bind mount
+const maxScanDepth = 64
+
+// scanDir scans the directory at dirpath. realpath is dirpath with symbolic links
+// resolved, when following them.
+func (s *MessageFileScanner) scanDir(dirpath, realpath string, depth int) {
+  if s.follow {
+    if depth > maxScanDepth {
+      synclog.Warnf("not scanning %s: more than %d directories deep",
+        relPath(MSGDIR, dirpath), maxScanDepth)
+      return
+    }
+    if s.visited[realpath] {
+      synclog.Debugf("not scanning %s again (symbolic link loop?)", relPath(MSGDIR, dirpath))
+      return
+    }
+    s.visited[realpath] = true
+  }
   f, err := os.Open(dirpath)
   if err != nil {
-    s.err = err
+    s.fail(err)
     return
   }
   defer f.Close()
-  for {
+  for s.ctx.Err() == nil {
     entries, err := f.ReadDir(64)
     if err != nil {
       if err != io.EOF {
-        s.err = err
+        s.fail(err)
       }
       break
     }
-    s.scanDirEntries(dirpath, entries)
+    s.scanDirEntries(dirpath, realpath, depth, entries)
   }
 }
 
-func (s *MessageFileScanner) scanDirEntries(dirpath string, entries []fs.DirEntry) {
+func (s *MessageFileScanner) scanDirEntries(
+  dirpath, realpath string, depth int, entries []fs.DirEntry,
+) {
   for _, ent := range entries {
     name := ent.Name()
     if name[0] == '.' { // skip dot files
       continue
     }
+    if s.ctx.Err() != nil {
+      return
+    }
     path := filepath.Join(dirpath, name)
-    if ent.IsDir() {
-      s.scanDir(path)
+    rel := relPath(MSGDIR, path)
+    if s.ignore.ignored(rel, ent.IsDir()) {
+      // note: the messages of ignored files which were indexed before are removed
+      // from the index like those of deleted files (see reconcile)
+      continue
+    }
+    entRealpath := filepath.Join(realpath, name)
+    var info fs.FileInfo
+    if ent.Type()&fs.ModeSymlink != 0 {
+      if !s.follow {
+        continue
+      }
+      if info, entRealpath = s.resolveLink(path); info == nil {
+        continue
+      }
+    }
+    if ent.IsDir() || (info != nil && info.IsDir()) {
+      s.scanDir(path, entRealpath, depth+1)
     } else if strings.HasSuffix(name, ".msg") {
+      if s.follow {
+        if s.visited[entRealpath] {
+          continue
+        }
+        s.visited[entRealpath] = true
+      }
+      s.seen[rel] = true
+      if info == nil {
+        info, _ = ent.Info()
+      }
+      if s.unchanged(rel, info) {
+        s.found(s.files[rel].id, rel)
+        atomic.AddUint32(&s.nskipped, 1)
+        continue
+      }
+      if info != nil && time.Since(info.ModTime()) < freshFileAge {
+        // probably still being written, e.g. by a sync tool
+        s.deferred = append(s.deferred, deferredFile{path, rel, info})
+        continue
+      }
       s.wg.Add(1)
-      go s.loadMessage(path)
+      s.paths <- path
+    }
+  }
+}
+
+// resolveLink returns the file info and real path of the file which the symbolic link
+// at path points to. It returns nil if the link is broken or points outside of MSGDIR.
+func (s *MessageFileScanner) resolveLink(path string) (fs.FileInfo, string) {
+  log := synclog.With("file", relPath(MSGDIR, path))
+  realpath, err := filepath.EvalSymlinks(path)
+  if err != nil {
+    log.Warnf("skipping symbolic link: %v", err)
+    return nil, ""
+  }
+  if !strings.HasPrefix(realpath, s.realMsgDir+string(filepath.Separator)) {
+    // its messages would be indexed with paths which don't lead to their files when
+    // the link changes, and removed from the index when it's gone
+    log.Warnf("skipping symbolic link: it points outside of %s", MSGDIR)
+    return nil, ""
+  }
+  info, err := os.Stat(realpath)
+  if err != nil {
+    log.Warnf("skipping symbolic link: %v", err)
+    return nil, ""
+  }
+  return info, realpath
+}
+
+// unchanged returns true if the file at MSGDIR/rel is likely unchanged since it was last
+// indexed (see isLikelyUnchanged), and its message is still in the folder.
+// info is nil if the file couldn't be stat'ed.
+func (s *MessageFileScanner) unchanged(rel string, info fs.FileInfo) bool {
+  f, ok := s.files[rel]
+  if !ok || !f.current || info == nil {
+    return false
+  }
+  if !isLikelyUnchanged(filepath.Join(MSGDIR, rel), info, f) {
+    return false
+  }
+  mtime := info.ModTime()
+  if mtime.UnixNano() != f.mtime ||
+    (f.indexed != 0 && time.Duration(f.indexed-f.mtime) < mtimeResolution) {
+    // its contents were compared. Record its new state so that they aren't next time.
+    if err := db.TouchFile(rel, mtime); err != nil {
+      synclog.With("file", rel).Debugf("failed to record state of file: %v", err)
     }
   }
+  return true
+}
+
+func (s *MessageFileScanner) worker() {
+  for path := range s.paths {
+    s.loadMessage(path)
+  }
+}
+
+// found records that the file at MSGDIR/rel has message id.
+//
+// When several files have the same message, e.g. copies made by a sync tool, the one
+// with the smallest path becomes the message's file, so that scans of copies of MSGDIR
+// agree, and the others are recorded as duplicates (see recordDuplicates.)
+func (s *MessageFileScanner) found(id [24]byte, rel string) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  other, ok := s.ids[id]
+  if !ok || other == rel {
+    s.ids[id] = rel
+    return
+  }
+  if rel < other {
+    s.ids[id] = rel
+    rel = other
+  }
+  s.dups[rel] = id
 }
 
+// readScanFile reads a message file for a scan. Tests replace it to see how many files
+// scans read at once.
+var readScanFile = readIndexedMessage
+
 func (s *MessageFileScanner) loadMessage(file string) {
   defer s.wg.Done()
+  if s.ctx.Err() != nil {
+    return // the remaining files are skipped
+  }
+  if m := readScanFile(file); m != nil {
+    s.writer.put(m) // see written
+  } else {
+    atomic.AddUint32(&s.nfailed, 1)
+  }
+}
+
+// written is called by s.writer when the message of a file has been added to the
+// database, or failed to be, with err
+func (s *MessageFileScanner) written(m *IndexedMessage, err error) {
+  if indexed(m, err) {
+    s.found(m.msg.id, m.msg.file)
+    atomic.AddUint32(&s.nindexed, 1)
+  } else {
+    atomic.AddUint32(&s.nfailed, 1)
+  }
+}
+
+// indexMessageFile parses a message file in one of scanFolders and adds it to the
+// database. Returns nil if that failed, after logging the error.
+func indexMessageFile(file string) *Message {
+  m := readIndexedMessage(file)
+  if m == nil || !indexed(m, db.PutIndexedMessages([]*IndexedMessage{m})) {
+    return nil
+  }
+  return m.msg
+}
+
+// readIndexedMessage parses a message file in one of scanFolders, to be added to the
+// database. Returns nil if that failed, after logging the error, or if the file was a
+// receipt, which has been applied.
+func readIndexedMessage(file string) *IndexedMessage {
+  log := synclog.With("file", relPath(MSGDIR, file))
+  // note: stat before parsing so that a change made while parsing is noticed next scan
+  info, err := os.Stat(file)
+  if err != nil {
+    log.Warnf("failed to read message file: %v", err)
+    return nil
+  }
+  // note: fingerprint before parsing too, for the same reason
+  hash, err := fileFingerprint(file)
+  if err != nil {
+    log.Warnf("failed to read message file: %v", err)
+    return nil
+  }
   msg := &Message{}
   if err := msg.ParseFile(file); err != nil {
-    logger.Printf("failed to read message file %q: %v", file, err)
-    return
+    metricParseFailures.Inc()
+    log.Warnf("failed to read message file: %v", err)
+    return nil
+  }
+  folder := fileFolder(file)
+  if msg.receipt != receiptNone && folder == "inbox" {
+    // a receipt put in the inbox by other means than receiveMessage
+    if err := applyReceipt(msg); err != nil {
+      log.Errorf("failed to apply receipt: %v", err)
+    } else if err := os.Remove(file); err != nil {
+      log.Errorf("%v", err)
+    }
+    return nil
+  }
+  msg.folder = folder
+  msg.file = relPath(MSGDIR, file)
+  m := &IndexedMessage{msg: msg, size: info.Size(), mtime: info.ModTime(), hash: hash}
+  if folder == "inbox" {
+    m.owner = inboxOwner(file)
+  }
+  return m
+}
+
+// indexed finishes indexing a message which has been added to the database with
+// PutIndexedMessages, or failed to be, with err. Returns false if it failed, after
+// logging the error.
+func indexed(m *IndexedMessage, err error) bool {
+  msg := m.msg
+  log := synclog.With("file", msg.file)
+  if err != nil {
+    // note: the database is closed at shutdown, which may happen while scanning, e.g.
+    // with "list -nowait"
+    if atomic.LoadUint32(&msgsync.shutdown) == 0 {
+      log.Errorf("failed to put message %s into database: %v", msg, err)
+    }
+    return false
+  }
+  // a message indexed with its legacy id (see Message.legacyId) is the same message
+  legacy := m.prev != ([24]byte{}) && m.prev == msg.legacyId()
+  if m.prev != ([24]byte{}) && m.prev != msg.id {
+    // the file has been replaced with a different message, or indexed again with its
+    // canonical id
+    if err := db.ReplaceMessage(m.prev, msg.id, msg.file); err != nil {
+      log.Errorf("failed to remove replaced message: %v", err)
+    }
+  }
+  if m.added && msg.folder == "inbox" && !legacy {
+    msgsync.messageAdded(msg)
+  }
+  log.Tracef("indexed message %s", msg.IdString())
+  return true
+}
+
+// fileFolder returns the folder of a file in MSGDIR, i.e. the name of the directory in
+// MSGDIR which it's in, like "inbox" for INBOXDIR/user@host/20220807-101532.msg
+func fileFolder(file string) string {
+  rel := relPath(MSGDIR, file)
+  if p := strings.IndexByte(rel, filepath.Separator); p != -1 {
+    return rel[:p]
+  }
+  return ""
+}
+
+// messageDir returns the directory in dir where a new message file for a message with
+// time t goes: dir/YYYY/MM with Config.DateDirs, else dir itself. The directory is
+// created if needed.
+//
+// note: files are found anywhere in a folder, so messages stored before DateDirs was
+// set, or after it was unset, are read all the same (see cmd_migrate_layout)
+func messageDir(dir string, t time.Time) (string, error) {
+  if config.DateDirs {
+    t = t.UTC()
+    dir = filepath.Join(dir, t.Format("2006"), t.Format("01"))
+  }
+  return dir, os.MkdirAll(dir, 0700)
+}
+
+// inboxOwner returns the address of the user which a file in INBOXDIR belongs to, when
+// serving several users (see Config.Recipients), or "" if it's not in a user's inbox
+func inboxOwner(file string) string {
+  dir := filepath.Dir(relPath(INBOXDIR, file))
+  if p := strings.IndexByte(dir, filepath.Separator); p != -1 {
+    dir = dir[:p]
   }
-  if err := db.PutMessage(msg); err != nil {
-    errlog("failed to put message %s into database: %v", msg, err)
+  if strings.IndexByte(dir, '@') == -1 || !config.IsHostedRecipient(dir) {
+    return ""
   }
+  return dir
 }
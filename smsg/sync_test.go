@@ -0,0 +1,408 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+// testInboxSubjects returns the subjects of the messages in the inbox, oldest first
+func testInboxSubjects(t testing.TB) []string {
+  t.Helper()
+  var subjects []string
+  err := db.ListMessages(&MessageFilter{folder: "inbox", oldest: true}, func(m *Message) error {
+    subjects = append(subjects, m.subject)
+    return nil
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  return subjects
+}
+
+func expectScanCounts(t *testing.T, s *MessageFileScanner, nindexed, nskipped uint32) {
+  t.Helper()
+  if s.nindexed != nindexed || s.nskipped != nskipped || s.nfailed != 0 {
+    t.Errorf("scan: %d indexed, %d unchanged, %d failed; expected %d, %d and 0",
+      s.nindexed, s.nskipped, s.nfailed, nindexed, nskipped)
+  }
+}
+
+func TestScanSkipsUnchangedFiles(t *testing.T) {
+  testMsgDir(t)
+  writeTestMessages(t, 3)
+  expectScanCounts(t, scanTestFolder(t, "inbox"), 0, 3)
+
+  s := &MessageFileScanner{ctx: context.Background(), folder: "inbox", full: true}
+  if err := s.scan(); err != nil {
+    t.Fatal(err)
+  }
+  expectScanCounts(t, s, 3, 0)
+  if subjects := testInboxSubjects(t); len(subjects) != 3 {
+    t.Errorf("%d messages after a full scan; expected 3: %q", len(subjects), subjects)
+  }
+}
+
+func TestScanReindexesChangedFiles(t *testing.T) {
+  testMsgDir(t)
+  writeTestMessages(t, 3)
+  files, err := db.IndexedFiles("inbox")
+  if err != nil {
+    t.Fatal(err)
+  }
+  const name = "20220601-120000.msg" // "Message 2"
+  rel := "inbox/" + name
+  old, ok := files[rel]
+  if !ok {
+    t.Fatalf("no file %s in %v", rel, files)
+  }
+
+  // same path, different message
+  tm := time.Date(2022, 6, 1, 12, 30, 0, 0, time.UTC)
+  path := writeTestFile(t, INBOXDIR, name,
+    testMessageText("Changed", "bob@example.com", tm, "Hello again"))
+  mtime := time.Now().Add(-30 * time.Second)
+  if err := os.Chtimes(path, mtime, mtime); err != nil {
+    t.Fatal(err)
+  }
+  expectScanCounts(t, scanTestFolder(t, "inbox"), 1, 2)
+
+  subjects := testInboxSubjects(t)
+  expect := []string{"Message 1", "Changed", "Message 3"}
+  if strings.Join(subjects, "\n") != strings.Join(expect, "\n") {
+    t.Errorf("subjects %q; expected %q", subjects, expect)
+  }
+  var msg Message
+  if err := db.LoadMessageById(old.id, &msg); err == nil {
+    t.Errorf("the old message of %s is still in the database", rel)
+  }
+  files, err = db.IndexedFiles("inbox")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if f := files[rel]; f.id == old.id || f.mtime != mtime.UnixNano() {
+    t.Errorf("file %s wasn't updated: %+v", rel, f)
+  }
+}
+
+// TestScanIndexesOneOfCopies delivers two files with the same content, but for the
+// time they were sent at, e.g. a message sent again. With duplicates "skip", only one
+// must be indexed, and with "link", the other is indexed as a copy of it.
+func TestScanIndexesOneOfCopies(t *testing.T) {
+  for _, mode := range []duplicatesMode{duplicatesSkip, duplicatesLink} {
+    t.Run(mode.String(), func(t *testing.T) {
+      testMsgDir(t)
+      config.Duplicates = mode
+      for i, name := range []string{"20220601-100000.msg", "20220601-110000.msg"} {
+        tm := time.Date(2022, 6, 1, 10+i, 0, 0, 0, time.UTC)
+        writeTestFile(t, INBOXDIR, name,
+          testMessageText("Hello", "alice@example.com", tm, "Same body"))
+      }
+      scanTestFolder(t, "inbox")
+
+      var ncopies int
+      filter := &MessageFilter{folder: "inbox", copies: true}
+      err := db.ListMessages(filter, func(m *Message) error {
+        ncopies++
+        return nil
+      })
+      if err != nil {
+        t.Fatal(err)
+      }
+      nlisted := len(testInboxSubjects(t))
+      if mode == duplicatesSkip && ncopies != 1 {
+        t.Errorf("%d copies indexed; expected 1", ncopies)
+      }
+      if mode == duplicatesLink && (ncopies != 2 || nlisted != 1) {
+        t.Errorf("%d copies indexed, listed as %d; expected 2 listed as 1", ncopies, nlisted)
+      }
+    })
+  }
+}
+
+// BenchmarkScanInbox measures how long it takes to scan an inbox of 10k messages at
+// startup, when none of them have changed, and with -full
+func BenchmarkScanInbox(b *testing.B) {
+  testMsgDir(b)
+  writeTestMessages(b, 10000)
+  for _, full := range []bool{false, true} {
+    name := "unchanged"
+    if full {
+      name = "full"
+    }
+    b.Run(name, func(b *testing.B) {
+      for i := 0; i < b.N; i++ {
+        s := &MessageFileScanner{ctx: context.Background(), folder: "inbox", full: full}
+        if err := s.scan(); err != nil {
+          b.Fatal(err)
+        }
+      }
+    })
+  }
+}
+
+func TestScanBoundsOpenFiles(t *testing.T) {
+  testMsgDir(t)
+  config.ScanWorkers = 4
+  const nfiles = 1000
+  start := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  for i := 0; i < nfiles; i++ {
+    tm := start.Add(time.Duration(i) * time.Minute)
+    writeTestFile(t, INBOXDIR, tm.Format("20060102-150405")+".msg",
+      testMessageText(fmt.Sprintf("Message %d", i), "alice@example.com", tm, "Hello"))
+  }
+
+  // count the files being read, keeping each open for a while so that they pile up if
+  // they aren't read by a bounded number of workers
+  var open, maxOpen int32
+  readScanFile = func(file string) *IndexedMessage {
+    n := atomic.AddInt32(&open, 1)
+    defer atomic.AddInt32(&open, -1)
+    for {
+      max := atomic.LoadInt32(&maxOpen)
+      if n <= max || atomic.CompareAndSwapInt32(&maxOpen, max, n) {
+        break
+      }
+    }
+    time.Sleep(time.Millisecond)
+    return readIndexedMessage(file)
+  }
+  defer func() { readScanFile = readIndexedMessage }()
+
+  expectScanCounts(t, scanTestFolder(t, "inbox"), nfiles, 0)
+  if maxOpen > int32(config.ScanWorkers) {
+    t.Errorf("%d files were read at once; expected at most %d", maxOpen, config.ScanWorkers)
+  }
+}
+
+// TestScanCountsCorruptFiles scans valid files along with corrupt ones, which are read
+// by several workers at once; run with -race
+func TestScanCountsCorruptFiles(t *testing.T) {
+  testMsgDir(t)
+  config.ScanWorkers = 4
+  corrupt := []string{
+    "not a message\n",
+    "subject Bad sender\nfrom alice\nto me@example.com\ntime 2022-06-01 10:00:00 +0000\n",
+    "subject Bad body\nfrom alice@example.com\nto me@example.com\n" +
+      "time 2022-06-01 10:00:00 +0000\nbody many\nHello",
+    "subject Bad time\nfrom alice@example.com\nto me@example.com\ntime yesterday\n",
+    "subject Truncated\nfrom alice@example.com\nto me@example.com\n" +
+      "time 2022-06-01 10:00:00 +0000\nbody 100\nHello",
+    "subject Truncated file\nfrom alice@example.com\nto me@example.com\n" +
+      "time 2022-06-01 10:00:00 +0000\nfile 100 a.txt\nHello",
+  }
+  start := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  for i, text := range corrupt {
+    tm := start.Add(time.Duration(i) * time.Minute)
+    writeTestFile(t, INBOXDIR, tm.Format("20060102-150405")+".msg", text)
+  }
+  const nvalid = 20
+  for i := 1; i <= nvalid; i++ {
+    tm := start.Add(time.Duration(i) * time.Hour)
+    writeTestFile(t, INBOXDIR, tm.Format("20060102-150405")+".msg",
+      testMessageText(fmt.Sprintf("Message %d", i), "alice@example.com", tm, "Hello"))
+  }
+
+  s := &MessageFileScanner{ctx: context.Background(), folder: "inbox"}
+  if err := s.scan(); err != nil {
+    t.Fatal(err)
+  }
+  if s.nindexed != nvalid || s.nfailed != uint32(len(corrupt)) {
+    t.Errorf("%d indexed and %d failed; expected %d and %d",
+      s.nindexed, s.nfailed, nvalid, len(corrupt))
+  }
+  if st := s.status(nil); st.Failed != len(corrupt) || st.Indexed != nvalid {
+    t.Errorf("status %+v", st)
+  }
+}
+
+func TestScanErrors(t *testing.T) {
+  err := scanErrors{errors.New("a"), errors.New("b")}
+  if s := err.Error(); s != "2 errors:\n  a\n  b" {
+    t.Errorf("%q", s)
+  }
+  if s := (scanErrors{errors.New("a")}).Error(); s != "a" {
+    t.Errorf("%q", s)
+  }
+}
+
+// testStalledScan makes msgsync seem to have started an initial scan which never
+// finishes, until the test ends
+func testStalledScan(t testing.TB) {
+  ctx, cancel := context.WithCancel(context.Background())
+  msgsync.ctx, msgsync.cancel = ctx, cancel
+  msgsync.inboxscan = make(chan struct{})
+  msgsync.allscan = make(chan struct{})
+  t.Cleanup(func() {
+    cancel()
+    msgsync.ctx, msgsync.cancel = nil, nil
+    msgsync.inboxscan, msgsync.allscan = nil, nil
+  })
+}
+
+func TestWaitReadyContext(t *testing.T) {
+  testStalledScan(t)
+  for _, folder := range []string{"inbox", "sent"} {
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    err := msgsync.waitFolderReady(ctx, folder)
+    cancel()
+    if err != context.DeadlineExceeded {
+      t.Errorf("waiting for %s: %v; expected %v", folder, err, context.DeadlineExceeded)
+    }
+  }
+  close(msgsync.inboxscan)
+  if err := msgsync.WaitReadyContext(context.Background()); err != nil {
+    t.Errorf("WaitReadyContext after the scan finished: %v", err)
+  }
+  msgsync.cancel()
+  if err := msgsync.WaitAllReady(); err != errInterrupted {
+    t.Errorf("WaitAllReady after shutdown: %v; expected %v", err, errInterrupted)
+  }
+}
+
+// TestScanDuplicateFiles scans files which have the same message, e.g. copies made by a
+// sync tool: the file with the smallest path must be the message's file, and the others
+// recorded as duplicates, until removed with rmdups if they are identical to it
+func TestScanDuplicateFiles(t *testing.T) {
+  testMsgDir(t)
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  text := testMessageText("Hello", "alice@example.com", tm, "Hello")
+  const name = "20220601-100000.msg"
+  for _, dir := range []string{"b", "a"} {
+    writeTestFile(t, filepath.Join(INBOXDIR, dir), name, text)
+  }
+  // a copy with CRLF line endings has the same message, but different data
+  writeTestFile(t, filepath.Join(INBOXDIR, "c"), name, strings.Replace(text, "\n", "\r\n", 4))
+  scanTestFolder(t, "inbox")
+
+  expectDuplicates := func(expected ...string) {
+    t.Helper()
+    dups, err := db.Duplicates("")
+    if err != nil {
+      t.Fatal(err)
+    }
+    var paths []string
+    for _, d := range dups {
+      if d.canonical != filepath.Join("inbox", "a", name) {
+        t.Errorf("%s is a duplicate of %s; expected inbox/a/%s", d.path, d.canonical, name)
+      }
+      paths = append(paths, filepath.ToSlash(d.path))
+    }
+    if strings.Join(paths, " ") != strings.Join(expected, " ") {
+      t.Errorf("duplicates %q; expected %q", paths, expected)
+    }
+  }
+  files, err := db.IndexedFiles("inbox")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if n := len(testInboxSubjects(t)); n != 1 {
+    t.Errorf("%d messages indexed; expected 1", n)
+  }
+  var msg Message
+  if err := db.LoadMessageById(files[filepath.Join("inbox", "b", name)].id, &msg); err != nil {
+    t.Fatal(err)
+  }
+  if msg.file != filepath.Join("inbox", "a", name) {
+    t.Errorf("message file %s; expected inbox/a/%s", msg.file, name)
+  }
+  expectDuplicates("inbox/b/"+name, "inbox/c/"+name)
+
+  // only the identical copy is removed
+  s := &MessageFileScanner{ctx: context.Background(), folder: "inbox", rmdups: true}
+  if err := s.scan(); err != nil {
+    t.Fatal(err)
+  }
+  expectDuplicates("inbox/c/" + name)
+  for dir, exists := range map[string]bool{"a": true, "b": false, "c": true} {
+    if _, err := os.Stat(filepath.Join(INBOXDIR, dir, name)); (err == nil) != exists {
+      t.Errorf("inbox/%s/%s: %v; expected it to exist: %v", dir, name, err, exists)
+    }
+  }
+}
+
+// TestScanWaitsForSlowWriter scans a message file while it's being written in two
+// chunks, which is indexed once it has stopped changing
+func TestScanWaitsForSlowWriter(t *testing.T) {
+  testMsgDir(t)
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  text := testMessageText("Slow", "alice@example.com", tm, "Hello, this is a message")
+  path := filepath.Join(INBOXDIR, "20220601-100000.msg")
+  half := len(text) - 10
+  if err := os.WriteFile(path, []byte(text[:half]), 0600); err != nil {
+    t.Fatal(err)
+  }
+  // temporary files of sync tools
+  writeTestFile(t, INBOXDIR, ".20220601-100000.msg", text)
+  writeTestFile(t, INBOXDIR, "20220601-100000.msg.tmp", text)
+  writeTestFile(t, INBOXDIR, "20220601-100000.msg.partial", text)
+
+  written := make(chan error, 1)
+  go func() {
+    time.Sleep(500 * time.Millisecond)
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+    if err == nil {
+      _, err = f.WriteString(text[half:])
+      if err2 := f.Close(); err == nil {
+        err = err2
+      }
+    }
+    written <- err
+  }()
+  s := scanTestFolder(t, "inbox")
+  if err := <-written; err != nil {
+    t.Fatal(err)
+  }
+  expectScanCounts(t, s, 1, 0)
+  subjects := testInboxSubjects(t)
+  if len(subjects) != 1 || subjects[0] != "Slow" {
+    t.Errorf("subjects %q; expected [\"Slow\"]", subjects)
+  }
+}
+
+// BenchmarkScanIndex measures how fast the initial scan adds the messages of a folder to
+// an empty database, e.g. with go test -bench ScanIndex
+func BenchmarkScanIndex(b *testing.B) {
+  for _, n := range []int{100, 2000} {
+    b.Run(fmt.Sprint(n), func(b *testing.B) {
+      testMsgDir(b)
+      start := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+      for i := 0; i < n; i++ {
+        tm := start.Add(time.Duration(i) * time.Minute)
+        body := strings.Repeat(fmt.Sprintf("Line %d of message %d\n", i, i), 1+i%50)
+        writeTestFile(b, INBOXDIR, tm.Format("20060102-150405")+".msg",
+          testMessageText(fmt.Sprintf("Message %d", i), "alice@example.com", tm, body))
+      }
+      var elapsed time.Duration
+      b.ResetTimer()
+      for i := 0; i < b.N; i++ {
+        b.StopTimer()
+        db.Close()
+        for _, suffix := range []string{"", "-wal", "-shm"} {
+          os.Remove(DBFILE + suffix)
+        }
+        if err := db.Open(); err != nil {
+          b.Fatal(err)
+        }
+        b.StartTimer()
+        t := time.Now()
+        s := &MessageFileScanner{ctx: context.Background(), folder: "inbox"}
+        if err := s.scan(); err != nil {
+          b.Fatal(err)
+        }
+        elapsed += time.Since(t)
+        if s.nindexed != uint32(n) {
+          b.Fatalf("%d of %d messages indexed", s.nindexed, n)
+        }
+      }
+      b.ReportMetric(float64(n*b.N)/elapsed.Seconds(), "msgs/s")
+    })
+  }
+}
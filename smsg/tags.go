@@ -0,0 +1,45 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "strings"
+  "unicode/utf8"
+)
+
+const (
+  maxTags     = 16 // max number of tags of a message; more are ignored
+  maxLabelLen = 32 // max length of a tag or label, in characters; longer ones are ignored
+)
+
+// Sources of labels. Labels from the "tags" section of a message are added when it is
+// first indexed; a sender label removed locally is kept as removed, so that it's not
+// added again when the message is indexed again (see DB.RemoveLabel.)
+const (
+  labelSourceSender = "sender"
+  labelSourceLocal  = "local"
+)
+
+// normalizeLabel returns s trimmed and lowercased, or "" if it's not a valid label
+func normalizeLabel(s string) string {
+  s = strings.ToLower(strings.TrimSpace(s))
+  if strings.ContainsAny(s, ",\n") || utf8.RuneCountInString(s) > maxLabelLen {
+    return ""
+  }
+  return s
+}
+
+// parseTags parses the comma-separated value of a "tags" section into normalized labels.
+// Empty, too long and repeated tags, and tags beyond the first maxTags, are ignored.
+func parseTags(s string) []string {
+  var tags []string
+  for _, tag := range strings.Split(s, ",") {
+    if tag = normalizeLabel(tag); tag == "" || indexOfString(tags, tag) != -1 {
+      continue
+    }
+    if len(tags) == maxTags {
+      break
+    }
+    tags = append(tags, tag)
+  }
+  return tags
+}
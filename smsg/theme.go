@@ -0,0 +1,215 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+
+  "golang.org/x/term"
+)
+
+// Theme is the styles of text which commands like list, search, watch and ui print, as
+// specs like "bold+blue" (see parseStyle). It's one of themePresets, with some of its
+// styles replaced by those of SMSG_THEME or the "theme" section of the config (see
+// loadTheme).
+type Theme struct {
+  MarkerUnread string // the marker "●" of unread messages
+  RowUnread    string // rows of unread messages
+  Separator    string // lines between rows, e.g. dates
+  Header       string // headers of tables and messages
+  Snippet      string // notes below rows, e.g. snippets of search results
+  Dim          string // other secondary text, e.g. ids and hints
+}
+
+// themePresets are the built-in themes. "light" is for terminals with a light
+// background, which dim text is hard to read on, and "mono" doesn't use colors.
+var themePresets = map[string]Theme{
+  "default": {
+    MarkerUnread: "bold", RowUnread: "bold", Separator: "dim", Header: "dim",
+    Snippet: "dim", Dim: "dim",
+  },
+  "light": {
+    MarkerUnread: "bold+blue", RowUnread: "bold", Separator: "blue", Header: "underline",
+    Snippet: "bright-black", Dim: "bright-black",
+  },
+  "mono": {
+    MarkerUnread: "bold", RowUnread: "bold", Separator: "", Header: "underline",
+    Snippet: "", Dim: "",
+  },
+}
+
+// style returns the style of t with name, as in the config, or nil if there's none
+func (t *Theme) style(name string) *string {
+  switch name {
+  case "marker_unread":
+    return &t.MarkerUnread
+  case "row_unread":
+    return &t.RowUnread
+  case "separator":
+    return &t.Separator
+  case "header":
+    return &t.Header
+  case "snippet":
+    return &t.Snippet
+  case "dim":
+    return &t.Dim
+  }
+  return nil
+}
+
+// styleAttributes and styleColors are the words of style specs (see parseStyle), by the
+// SGR parameters they stand for
+var (
+  styleAttributes = map[string]string{
+    "bold": "1", "dim": "2", "italic": "3", "underline": "4", "reverse": "7",
+  }
+  styleColors = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+)
+
+// parseStyle returns the SGR parameters of a style spec: words separated by "+" or
+// spaces, which are attributes (bold, dim, italic, underline, reverse), colors (black,
+// red, green, yellow, blue, magenta, cyan, white, each also as bright-<color>, and gray)
+// or numbers of 256-color palette colors. An empty spec, or "none", is plain text.
+func parseStyle(spec string) (string, error) {
+  params := []string{"0"} // a style replaces the one before it
+  for _, word := range strings.FieldsFunc(spec, func(r rune) bool {
+    return r == '+' || r == ' '
+  }) {
+    word = strings.ToLower(word)
+    if p, ok := styleAttributes[word]; ok {
+      params = append(params, p)
+      continue
+    }
+    if word == "none" {
+      continue
+    }
+    if word == "gray" || word == "grey" {
+      word = "bright-black"
+    }
+    base := 30
+    if name := strings.TrimPrefix(word, "bright-"); name != word {
+      base, word = 90, name
+    }
+    if i := indexOfString(styleColors, word); i != -1 {
+      params = append(params, strconv.Itoa(base+i))
+      continue
+    }
+    if n, err := strconv.ParseUint(word, 10, 8); err == nil && base == 30 {
+      params = append(params, "38;5;"+strconv.FormatUint(n, 10))
+      continue
+    }
+    return "", errorf("unknown color or attribute %q", word)
+  }
+  return strings.Join(params, ";"), nil
+}
+
+// loadTheme returns the theme configured with SMSG_THEME or else the "theme" section of
+// the config. Unknown presets and styles and invalid specs are warned about and ignored.
+//
+// SMSG_THEME is a comma-separated list of a preset and/or styles, like
+// "light,marker_unread=bold+red"; the config section has the same keys, e.g.
+// {"preset": "light", "marker_unread": "bold+red"}.
+func loadTheme() Theme {
+  settings := config.Theme
+  if env := os.Getenv("SMSG_THEME"); env != "" {
+    settings = map[string]string{}
+    for _, item := range strings.Split(env, ",") {
+      key, value, ok := strings.Cut(item, "=")
+      if !ok {
+        key, value = "preset", item
+      }
+      settings[strings.TrimSpace(key)] = strings.TrimSpace(value)
+    }
+  }
+  preset := settings["preset"]
+  if preset == "" {
+    preset = "default"
+  }
+  theme, ok := themePresets[preset]
+  if !ok {
+    warnlog("theme: unknown preset %q (expected default, light or mono)", preset)
+    theme = themePresets["default"]
+  }
+  names := make([]string, 0, len(settings))
+  for name := range settings {
+    names = append(names, name)
+  }
+  sort.Strings(names) // warnings in the same order every time
+  for _, name := range names {
+    if name == "preset" {
+      continue
+    }
+    style := theme.style(name)
+    if style == nil {
+      warnlog("theme: unknown style %q", name)
+      continue
+    }
+    if _, err := parseStyle(settings[name]); err != nil {
+      warnlog("theme: %s: %v; using %q", name, err, *style)
+      continue
+    }
+    *style = settings[name]
+  }
+  return theme
+}
+
+// setColors sets the terminal colors (see colrow) to those of a theme, or turns them off
+// when color is "never", or when it's "" and NO_COLOR is set, or when it's "auto" and
+// stdout is not a terminal. The -color option, which color is, takes precedence over
+// NO_COLOR, which takes precedence over the theme.
+func setColors(color string) error {
+  on := os.Getenv("NO_COLOR") == ""
+  switch color {
+  case "":
+  case "always":
+    on = true
+  case "never":
+    on = false
+  case "auto":
+    on = on && term.IsTerminal(int(os.Stdout.Fd()))
+  default:
+    return errorf("invalid -color %q (expected always, never or auto)", color)
+  }
+  if !on {
+    for _, col := range []*string{&colmarker, &colrow, &colseparator, &colheader,
+      &colsnippet, &coldim, &colfailed, &colwarn, &colurgent, &colhigh, &colselected,
+      &colreset} {
+      *col = ""
+    }
+    return nil
+  }
+  theme := loadTheme()
+  param := func(spec string) string {
+    params, _ := parseStyle(spec) // checked by loadTheme
+    return params
+  }
+  colors := []struct {
+    col    *string
+    params string
+  }{
+    {&colmarker, param(theme.MarkerUnread)},
+    {&colrow, param(theme.RowUnread)},
+    {&colseparator, param(theme.Separator)},
+    {&colheader, param(theme.Header)},
+    {&colsnippet, param(theme.Snippet)},
+    {&coldim, param(theme.Dim)},
+    {&colfailed, "31"},
+    {&colwarn, "33"},
+    {&colurgent, "91"},
+    {&colhigh, "93"},
+    {&colselected, "7"},
+    {&colreset, "0"},
+  }
+  // all colors have the same length, which keeps the columns of tables aligned (see
+  // colrow), padded with leading zeros
+  width := 0
+  for _, c := range colors {
+    width = imax(width, len(c.params))
+  }
+  for _, c := range colors {
+    *c.col = "\x1B[" + strings.Repeat("0", width-len(c.params)) + c.params + "m"
+  }
+  return nil
+}
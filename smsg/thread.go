@@ -0,0 +1,281 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bufio"
+  "fmt"
+  "os"
+  "strconv"
+  "strings"
+  "text/tabwriter"
+  "time"
+)
+
+// maxThreadDepth is the depth of replies beyond which replies in a thread are indented
+// no further
+const maxThreadDepth = 8
+
+// subjectPrefixes are the prefixes of the subjects of replies and forwards, like
+// "Re: " (see replySubject and forwardSubject), which normalizeSubject removes
+var subjectPrefixes = []string{"re", "fwd", "fw"}
+
+// normalizeSubject returns subject without any leading prefixes of replies and forwards,
+// in any case and like "Re: Fwd: RE[2]: ", as the subject of its thread
+func normalizeSubject(subject string) string {
+  s := strings.TrimSpace(subject)
+  for {
+    n := subjectPrefixLen(s)
+    if n == 0 {
+      return s
+    }
+    s = strings.TrimLeft(s[n:], " \t")
+  }
+}
+
+// subjectPrefixLen returns the length of the reply or forward prefix which s starts with,
+// including its colon, or 0 if it doesn't start with one
+func subjectPrefixLen(s string) int {
+  for _, prefix := range subjectPrefixes {
+    if len(s) <= len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+      continue
+    }
+    i := len(prefix)
+    if s[i] == '[' {
+      // e.g. "Re[2]:", which some mail programs write for the second reply
+      end := strings.IndexByte(s[i:], ']')
+      if end < 2 {
+        continue
+      }
+      if _, err := strconv.ParseUint(s[i+1:i+end], 10, 32); err != nil {
+        continue
+      }
+      i += end + 1
+    }
+    if i < len(s) && s[i] == ':' {
+      return i + 1
+    }
+  }
+  return 0
+}
+
+// summarizeParticipants returns names separated by commas, or the first two of them and
+// the number of others, like "alice, bob +2"
+func summarizeParticipants(names []string) string {
+  const shown = 2
+  if len(names) <= shown {
+    return strings.Join(names, ", ")
+  }
+  return fmt.Sprintf("%s +%d", strings.Join(names[:shown], ", "), len(names)-shown)
+}
+
+// threadParticipantNames returns the names of the participants of t (see
+// Author.ShortString) other than the user, unless the user is the only one
+func threadParticipantNames(t *Thread) []string {
+  var names, own []string
+  for _, a := range t.participants {
+    if config.FindIdentity(a.address) != nil {
+      own = append(own, a.ShortString())
+    } else {
+      names = append(names, a.ShortString())
+    }
+  }
+  if len(names) == 0 {
+    return own // e.g. notes to self
+  }
+  return names
+}
+
+// threadJSON is the JSON encoding of a thread in lists of threads
+type threadJSON struct {
+  Id           string    `json:"id"`
+  Latest       string    `json:"latest"` // id of the latest message
+  Subject      string    `json:"subject"`
+  Participants []string  `json:"participants"` // addresses
+  Count        int       `json:"count"`
+  Unread       int       `json:"unread"`
+  Time         time.Time `json:"time"` // of the latest message
+}
+
+func makeThreadJSON(t *Thread) threadJSON {
+  latest := Message{id: t.latest}
+  latest.SetTimeFromId()
+  m := threadJSON{
+    Id:           (&Message{id: t.id}).IdString(),
+    Latest:       latest.IdString(),
+    Subject:      normalizeSubject(t.subject),
+    Participants: []string{},
+    Count:        t.count,
+    Unread:       t.unread,
+    Time:         latest.time,
+  }
+  for _, a := range t.participants {
+    m.Participants = append(m.Participants, a.address)
+  }
+  return m
+}
+
+// printThreadList prints the threads of the messages matching filter, one per row, and
+// returns the number of threads printed. With ids or asJSON, the ids of the threads are
+// printed, or JSON.
+func printThreadList(filter *MessageFilter, ids, asJSON bool) int {
+  page := *filter
+  if page.limit > 0 {
+    page.limit++ // to tell whether there are more
+  }
+  threads, err := db.ListThreads(&page)
+  must(err)
+  more := filter.limit > 0 && len(threads) > filter.limit
+  if more {
+    threads = threads[:filter.limit]
+  }
+
+  if ids {
+    w := bufio.NewWriter(os.Stdout)
+    for i := range threads {
+      fmt.Fprintln(w, (&Message{id: threads[i].id}).IdString())
+    }
+    must(w.Flush())
+    return len(threads)
+  }
+  if asJSON {
+    list := []threadJSON{}
+    for i := range threads {
+      list = append(list, makeThreadJSON(&threads[i]))
+    }
+    printJSON(list)
+    return len(threads)
+  }
+
+  w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+  numwidth := countDigits(filter.offset + len(threads))
+  now := time.Now()
+  fmt.Fprintf(w, "%s%s  %*s Subject\tParticipants\tMessages\tTime%s\n",
+    colreset, colheader, numwidth, "#", colreset)
+  for i := range threads {
+    t := &threads[i]
+    latest := Message{id: t.latest}
+    latest.SetTimeFromId()
+    marker := " "
+    if t.unread > 0 {
+      marker = "●"
+    }
+    count := strconv.Itoa(t.count)
+    if t.unread > 0 {
+      count += fmt.Sprintf(" (%d unread)", t.unread)
+    }
+    fmt.Fprintf(w, "%s%s%s %*d %s\t%s\t%s\t%s%s\n", colmarker, marker, colrow,
+      numwidth, filter.offset+len(threads)-i,
+      limitStrLen(normalizeSubject(t.subject), 35),
+      limitStrLen(summarizeParticipants(threadParticipantNames(t)), 30),
+      count, formatMessageTime(now, localTime(latest.time)), colreset)
+  }
+  w.Flush()
+
+  if more {
+    n, err := db.CountThreads(filter)
+    must(err)
+    if n -= filter.offset + len(threads); n > 0 {
+      fmt.Fprintf(os.Stderr, "%s…and %d more (use -n 0 to show all)%s\n",
+        coldim, n, colreset)
+    }
+  }
+  return len(threads)
+}
+
+// printThread prints the messages of the thread which the message with id idstr is in,
+// or of the thread with that id, each reply indented below the message it's a reply to,
+// with columns
+func printThread(filter *MessageFilter, idstr string, columns []*listColumn) {
+  msgs, replies := listThread(filter, idstr)
+  var labels map[[24]byte][]string
+  if hasListColumn(columns, "labels") {
+    var err error
+    labels, err = db.MessageLabels()
+    must(err)
+  }
+
+  order, depth := threadOrder(msgs, replies)
+  p := newMessageListPrinter(os.Stdout, len(msgs))
+  p.columns = columns
+  p.labels = labels
+  p.datesep = false // replies are not in order of time
+  p.depth = depth
+  p.countUp(1)
+  for _, i := range order {
+    p.PrintRow(&msgs[i], colrow, "●")
+  }
+  p.Flush()
+}
+
+// listThread returns the messages matching filter of the thread which the message with
+// id idstr is in, or of the thread with that id, in order of id, and the ids of the
+// messages which they reply to (see DB.ThreadReplies)
+func listThread(filter *MessageFilter, idstr string) ([]Message, map[[24]byte][24]byte) {
+  id, err := decodeId(idstr)
+  if err != nil {
+    fatalf("-thread: %v", err)
+  }
+  thread, ok, err := db.MessageThread(id)
+  must(err)
+  if !ok {
+    thread = id // e.g. the first message of the thread, which is not in the database
+  }
+  f := *filter
+  f.thread = thread[:]
+  f.oldest = true
+  f.limit, f.offset = 0, 0
+  var msgs []Message
+  must(listMessages(&f, func(msg *Message) error {
+    msgs = append(msgs, *msg)
+    return nil
+  }))
+  if len(msgs) == 0 {
+    fatalf("no messages in thread %s", idstr)
+  }
+  replies, err := db.ThreadReplies(thread)
+  must(err)
+  return msgs, replies
+}
+
+// threadOrder returns the order in which to list msgs, which are in order of id, with the
+// replies to each message right after it (see ThreadReplies), and the depth of each
+// message, by id
+func threadOrder(msgs []Message, replies map[[24]byte][24]byte) ([]int, map[[24]byte]int) {
+  index := map[[24]byte]int{}
+  for i := range msgs {
+    index[msgs[i].id] = i
+  }
+  children := map[int][]int{}
+  var roots []int
+  for i := range msgs {
+    parent, ok := index[replies[msgs[i].id]]
+    if !ok || parent == i {
+      roots = append(roots, i) // not a reply, or the message it replies to is not listed
+      continue
+    }
+    children[parent] = append(children[parent], i)
+  }
+  order := make([]int, 0, len(msgs))
+  depth := map[[24]byte]int{}
+  visited := make([]bool, len(msgs))
+  var visit func(i, d int)
+  visit = func(i, d int) {
+    if visited[i] {
+      return
+    }
+    visited[i] = true
+    order = append(order, i)
+    depth[msgs[i].id] = imin(d, maxThreadDepth)
+    for _, c := range children[i] {
+      visit(c, d+1)
+    }
+  }
+  for _, i := range roots {
+    visit(i, 0)
+  }
+  // note: messages which reply to each other in a cycle are listed after the others
+  for i := range msgs {
+    visit(i, 0)
+  }
+  return order, depth
+}
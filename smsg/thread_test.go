@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "reflect"
+  "testing"
+)
+
+func TestNormalizeSubject(t *testing.T) {
+  tests := []struct {
+    subject  string
+    expected string
+  }{
+    {"Hello", "Hello"},
+    {"  Hello  ", "Hello"},
+    {"Re: Hello", "Hello"},
+    {"RE: Hello", "Hello"},
+    {"re:Hello", "Hello"},
+    {"Fwd: Hello", "Hello"},
+    {"FW: Hello", "Hello"},
+    {"fw:  Hello", "Hello"},
+    {"Re: Fwd: RE: Hello", "Hello"},
+    {"Re[2]: Hello", "Hello"},
+    {"RE[12]: Re: Hello", "Hello"},
+    {"Re: ", ""},
+    {"Re:", ""},
+
+    // not prefixes
+    {"Re", "Re"},
+    {"Regarding: Hello", "Regarding: Hello"},
+    {"Fwding: Hello", "Fwding: Hello"},
+    {"Re : Hello", "Re : Hello"},
+    {"Re[]: Hello", "Re[]: Hello"},
+    {"Re[x]: Hello", "Re[x]: Hello"},
+    {"Re[2: Hello", "Re[2: Hello"},
+    {"Hello Re: world", "Hello Re: world"},
+    {"Hello, re: world", "Hello, re: world"},
+    {"Réponse: Hello", "Réponse: Hello"},
+  }
+  for _, test := range tests {
+    if s := normalizeSubject(test.subject); s != test.expected {
+      t.Errorf("normalizeSubject(%q) = %q; expected %q", test.subject, s, test.expected)
+    }
+  }
+}
+
+func TestSummarizeParticipants(t *testing.T) {
+  tests := []struct {
+    names    []string
+    expected string
+  }{
+    {nil, ""},
+    {[]string{"alice"}, "alice"},
+    {[]string{"alice", "bob"}, "alice, bob"},
+    {[]string{"alice", "bob", "carol"}, "alice, bob +1"},
+    {[]string{"alice", "bob", "carol", "dave"}, "alice, bob +2"},
+  }
+  for _, test := range tests {
+    if s := summarizeParticipants(test.names); s != test.expected {
+      t.Errorf("summarizeParticipants(%q) = %q; expected %q", test.names, s, test.expected)
+    }
+  }
+}
+
+func TestThreadParticipantNames(t *testing.T) {
+  config = Config{Identities: []*Identity{{Address: "me@example.com"}}}
+  t.Cleanup(func() { config = Config{} })
+  me := Author{address: "Me@Example.com", name: "Me"}
+  alice := Author{address: "alice@example.com", name: "Alice"}
+  bob := Author{address: "bob@example.com"}
+  tests := []struct {
+    participants []Author
+    expected     []string
+  }{
+    {[]Author{alice, bob}, []string{"Alice", "bob@example.com"}},
+    {[]Author{me, alice, bob}, []string{"Alice", "bob@example.com"}},
+    {[]Author{bob, me, alice}, []string{"bob@example.com", "Alice"}},
+    {[]Author{me}, []string{"Me"}}, // notes to self
+  }
+  for _, test := range tests {
+    names := threadParticipantNames(&Thread{participants: test.participants})
+    if !reflect.DeepEqual(names, test.expected) {
+      t.Errorf("participants %v: names %q; expected %q",
+        test.participants, names, test.expected)
+    }
+  }
+}
+
+func TestThreadOrder(t *testing.T) {
+  // messages 0..5 in order of id; 1 and 3 reply to 0, 2 to 1, 4 to a message which isn't
+  // listed, and 5 to 3
+  msgs := make([]Message, 6)
+  for i := range msgs {
+    msgs[i].id[0] = byte(i + 1)
+  }
+  var unlisted [24]byte
+  unlisted[0] = 100
+  replies := map[[24]byte][24]byte{
+    msgs[1].id: msgs[0].id,
+    msgs[2].id: msgs[1].id,
+    msgs[3].id: msgs[0].id,
+    msgs[4].id: unlisted,
+    msgs[5].id: msgs[3].id,
+  }
+  order, depth := threadOrder(msgs, replies)
+  if expected := []int{0, 1, 2, 3, 5, 4}; !reflect.DeepEqual(order, expected) {
+    t.Errorf("order %v; expected %v", order, expected)
+  }
+  for i, d := range []int{0, 1, 2, 1, 0, 2} {
+    if depth[msgs[i].id] != d {
+      t.Errorf("message %d at depth %d; expected %d", i, depth[msgs[i].id], d)
+    }
+  }
+
+  // replies deeper than maxThreadDepth are indented as deep as it, and messages which
+  // reply to each other in a cycle are still listed
+  msgs = make([]Message, maxThreadDepth+4)
+  replies = map[[24]byte][24]byte{}
+  for i := range msgs {
+    msgs[i].id[0] = byte(i + 1)
+    if i > 0 {
+      replies[msgs[i].id] = msgs[i-1].id
+    }
+  }
+  order, depth = threadOrder(msgs, replies)
+  if len(order) != len(msgs) || depth[msgs[len(msgs)-1].id] != maxThreadDepth {
+    t.Errorf("order %v, depth of last %d", order, depth[msgs[len(msgs)-1].id])
+  }
+  replies[msgs[0].id] = msgs[len(msgs)-1].id
+  if order, _ = threadOrder(msgs, replies); len(order) != len(msgs) {
+    t.Errorf("order %v of messages replying in a cycle", order)
+  }
+}
@@ -0,0 +1,160 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/hex"
+  "encoding/pem"
+  "math/big"
+  "net"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+)
+
+// selfSignedCertValidity is how long a self-signed certificate made by serve is valid
+const selfSignedCertValidity = 10 * 365 * 24 * time.Hour
+
+// certLoader provides the server's certificate to TLS handshakes and can reload it from
+// its files, e.g. when they have been replaced, without affecting open connections
+type certLoader struct {
+  certfile, keyfile string
+
+  mu   sync.RWMutex
+  cert *tls.Certificate
+}
+
+func newCertLoader(certfile, keyfile string) (*certLoader, error) {
+  l := &certLoader{certfile: certfile, keyfile: keyfile}
+  return l, l.Reload()
+}
+
+// Reload loads the certificate from its files. The current certificate is kept if that fails.
+func (l *certLoader) Reload() error {
+  cert, err := tls.LoadX509KeyPair(l.certfile, l.keyfile)
+  if err != nil {
+    return err
+  }
+  l.mu.Lock()
+  l.cert = &cert
+  l.mu.Unlock()
+  return nil
+}
+
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+  l.mu.RLock()
+  defer l.mu.RUnlock()
+  return l.cert, nil
+}
+
+// Fingerprint returns the fingerprint of the current certificate (see certFingerprint)
+func (l *certLoader) Fingerprint() string {
+  l.mu.RLock()
+  defer l.mu.RUnlock()
+  return certFingerprint(l.cert.Certificate[0])
+}
+
+// certFingerprint returns the SHA-256 hash of a DER-encoded certificate as hex.
+// This is what clients pin (see clientTLSConfig.)
+func certFingerprint(der []byte) string {
+  sum := sha256.Sum256(der)
+  return hex.EncodeToString(sum[:])
+}
+
+// selfSignedCert returns the files of the server's self-signed certificate, creating it
+// on first use. hosts are added to the certificate's names, in addition to the local
+// host name and loopback addresses.
+func selfSignedCert(hosts ...string) (certfile, keyfile string, err error) {
+  certfile = filepath.Join(SERVEDIR, "selfsigned-cert.pem")
+  keyfile = filepath.Join(SERVEDIR, "selfsigned-key.pem")
+  if _, err = os.Stat(certfile); err == nil {
+    return
+  }
+  if err = os.MkdirAll(SERVEDIR, 0700); err != nil {
+    return
+  }
+  servelog.Debugf("creating self-signed certificate %s", relPath(MSGDIR, certfile))
+
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    return
+  }
+  serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+  if err != nil {
+    return
+  }
+  hostname, _ := os.Hostname()
+  tmpl := &x509.Certificate{
+    SerialNumber:          serial,
+    Subject:               pkix.Name{CommonName: hostname, Organization: []string{"smsg"}},
+    NotBefore:             time.Now().Add(-time.Hour),
+    NotAfter:              time.Now().Add(selfSignedCertValidity),
+    KeyUsage:              x509.KeyUsageDigitalSignature,
+    ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    BasicConstraintsValid: true,
+    IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+    DNSNames:              []string{"localhost"},
+  }
+  if hostname != "" {
+    hosts = append(hosts, hostname)
+  }
+  for _, h := range hosts {
+    if ip := net.ParseIP(h); ip != nil {
+      if !ip.IsUnspecified() {
+        tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+      }
+    } else if h != "" && indexOfString(tmpl.DNSNames, h) == -1 {
+      tmpl.DNSNames = append(tmpl.DNSNames, h)
+    }
+  }
+  der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+  if err != nil {
+    return
+  }
+  keyder, err := x509.MarshalECPrivateKey(key)
+  if err != nil {
+    return
+  }
+
+  // write the key first, since the certificate file is what marks the pair as complete
+  keypem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder})
+  if err = writeFileAtomic(keyfile, keypem, 0600); err != nil {
+    return
+  }
+  certpem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+  err = writeFileAtomic(certfile, certpem, 0644)
+  return
+}
+
+// clientTLSConfig returns the TLS configuration of a client of a server (see serve.)
+// If pin is not empty, the server's certificate must have that fingerprint (see
+// certFingerprint) but is otherwise not verified, which allows self-signed certificates.
+// If insecure is true, the certificate is not verified at all.
+func clientTLSConfig(pin string, insecure bool) *tls.Config {
+  if insecure {
+    warnlog("not verifying the server's TLS certificate; the connection is not secure")
+    return &tls.Config{InsecureSkipVerify: true}
+  }
+  if pin == "" {
+    return &tls.Config{}
+  }
+  pin = strings.ToLower(strings.ReplaceAll(pin, ":", "")) // also accept "AB:CD:..."
+  return &tls.Config{
+    // note: verification is done by VerifyPeerCertificate
+    InsecureSkipVerify: true,
+    VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+      if len(rawCerts) > 0 && certFingerprint(rawCerts[0]) == pin {
+        return nil
+      }
+      return errorf("the server's certificate does not match the pinned fingerprint")
+    },
+  }
+}
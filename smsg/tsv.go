@@ -0,0 +1,29 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "strings"
+  "time"
+)
+
+// Tab-separated output (-tsv) is for pipelines, like "smsg list -tsv | cut -f 3": one
+// line per row, without a header, colors or truncation, with fields separated by tabs.
+// So that fields can't break lines or rows apart, backslashes, tabs, newlines and
+// carriage returns in them are escaped as \\, \t, \n and \r.
+
+// tsvEscaper escapes the values of fields of tab-separated output
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// appendTSVField appends s to b, escaped as a field of tab-separated output
+func appendTSVField(b []byte, s string) []byte {
+  if strings.ContainsAny(s, "\\\t\n\r") {
+    s = tsvEscaper.Replace(s)
+  }
+  return append(b, s...)
+}
+
+// appendTSVTime appends t to b for tab-separated output, in UTC like
+// "2006-01-02T15:04:05Z", so that times sort as text
+func appendTSVTime(b []byte, t time.Time) []byte {
+  return t.UTC().AppendFormat(b, time.RFC3339)
+}
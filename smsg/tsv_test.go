@@ -0,0 +1,65 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestAppendTSVField(t *testing.T) {
+  tests := []struct {
+    s        string
+    expected string
+  }{
+    {"", ""},
+    {"Hello", "Hello"},
+    {"a\tb", `a\tb`},
+    {"a\nb", `a\nb`},
+    {"a\r\nb", `a\r\nb`},
+    {`a\b`, `a\\b`},
+    {`a\tb`, `a\\tb`}, // not a tab
+    {"\t\t\n", `\t\t\n`},
+    {"日本\t語", `日本\t語`},
+  }
+  for _, test := range tests {
+    if s := string(appendTSVField([]byte("x"), test.s)); s != "x"+test.expected {
+      t.Errorf("appendTSVField(%q) = %q; expected %q", test.s, s, "x"+test.expected)
+    }
+  }
+}
+
+func TestAppendTSVRow(t *testing.T) {
+  msg := &Message{
+    subject: "Tab\there,\nnewline there",
+    from:    Author{address: "alice@example.com", name: "Alice"},
+    time:    time.Date(2022, 6, 1, 10, 0, 0, 0, time.FixedZone("+0200", 2*3600)),
+    folder:  "inbox",
+  }
+  columns := selectListColumns("subject,from,time,folder", false, true)
+  row := string(appendTSVRow(nil, msg, columns, []string{"a\tb", "c"}))
+  expected := `Tab\there,\nnewline there` + "\talice@example.com\t2022-06-01T08:00:00Z\tinbox"
+  if row != expected {
+    t.Errorf("row %q; expected %q", row, expected)
+  }
+  columns = selectListColumns("labels", false, true)
+  if row = string(appendTSVRow(nil, msg, columns, []string{"a\tb", "c"})); row != `a\tb,c` {
+    t.Errorf("row %q; expected %q", row, `a\tb,c`)
+  }
+}
+
+func TestListTSV(t *testing.T) {
+  testMsgDir(t)
+  tm := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+  subject := "Tab\there" + strings.Repeat(", and a long subject", 10)
+  writeTestFile(t, INBOXDIR, "20220601-100000.msg",
+    testMessageText(subject, "alice@example.com", tm, "Hello"))
+  scanTestFolder(t, "inbox")
+
+  out := runTestCommand(t, "list", "-tsv", "-columns", "subject,from,time")
+  expected := strings.Replace(subject, "\t", `\t`, 1) +
+    "\talice@example.com\t2022-06-01T10:00:00Z\n"
+  if out != expected {
+    t.Errorf("list -tsv = %q; expected %q", out, expected)
+  }
+}
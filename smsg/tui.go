@@ -0,0 +1,274 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bytes"
+  "errors"
+  "os"
+  "strings"
+  "sync"
+  "time"
+  "unicode/utf8"
+
+  "golang.org/x/term"
+)
+
+// terminal is a minimal full-screen terminal: it reads keys in raw mode and draws
+// frames of whole lines on the alternate screen
+type terminal struct {
+  tty           *os.File
+  fd            int
+  width, height int
+  keys          chan string // keys read from the terminal; see parseKeys for names
+
+  mu       sync.Mutex // protects the following fields
+  oldstate *term.State // nil when not in raw mode
+  closed   bool
+
+  // used to stop readKeys while suspended. canPause is false if the tty doesn't
+  // support read deadlines, in which case keys typed while suspended may be lost.
+  canPause bool
+  paused   chan struct{} // readKeys has stopped
+  resumed  chan struct{} // readKeys may continue
+  done     chan struct{} // closed when readKeys has returned
+}
+
+func openTerminal() (*terminal, error) {
+  tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+  if err != nil {
+    return nil, err
+  }
+  t := &terminal{
+    tty:     tty,
+    keys:    make(chan string, 16),
+    paused:  make(chan struct{}),
+    resumed: make(chan struct{}),
+    done:    make(chan struct{}),
+  }
+  // note: tty.Fd() would put the file in blocking mode, which disables read deadlines
+  if rc, err := tty.SyscallConn(); err == nil {
+    rc.Control(func(fd uintptr) { t.fd = int(fd) })
+  }
+  t.canPause = tty.SetReadDeadline(time.Time{}) == nil
+  if err := t.enter(); err != nil {
+    tty.Close()
+    return nil, err
+  }
+  go t.readKeys()
+  return t, nil
+}
+
+// enter puts the terminal in raw mode and switches to the alternate screen
+func (t *terminal) enter() error {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  state, err := term.MakeRaw(t.fd)
+  if err != nil {
+    return err
+  }
+  t.oldstate = state
+  t.tty.WriteString("\x1b[?1049h\x1b[?25l") // alternate screen, hide cursor
+  return t.updateSize()
+}
+
+// leave restores the terminal to the state it was in before enter
+func (t *terminal) leave() {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  if t.oldstate == nil {
+    return
+  }
+  t.tty.WriteString("\x1b[?25h\x1b[?1049l") // show cursor, main screen
+  term.Restore(t.fd, t.oldstate)
+  t.oldstate = nil
+}
+
+// close restores the terminal. It's safe to call more than once, e.g. from an exit
+// handler when the program is shut down by a signal.
+func (t *terminal) close() {
+  t.leave()
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  if !t.closed {
+    t.closed = true
+    t.tty.Close()
+  }
+}
+
+// suspend restores the terminal and stops reading keys until resume is called,
+// e.g. to run an editor
+func (t *terminal) suspend() {
+  if t.canPause {
+    t.tty.SetReadDeadline(time.Now()) // interrupts readKeys
+    // discard pending keys, which readKeys may be blocked on
+  wait:
+    for {
+      select {
+      case <-t.keys:
+      case <-t.paused:
+        break wait
+      case <-t.done:
+        break wait
+      }
+    }
+  }
+  t.leave()
+}
+
+func (t *terminal) resume() error {
+  err := t.enter()
+  if t.canPause {
+    t.tty.SetReadDeadline(time.Time{})
+    select {
+    case t.resumed <- struct{}{}:
+    case <-t.done:
+    }
+  }
+  return err
+}
+
+// updateSize reads the size of the terminal. Call it when the terminal is resized.
+func (t *terminal) updateSize() error {
+  w, h, err := term.GetSize(t.fd)
+  if err != nil {
+    return err
+  }
+  t.width, t.height = w, h
+  return nil
+}
+
+func (t *terminal) readKeys() {
+  defer close(t.done)
+  defer close(t.keys)
+  buf := make([]byte, 256)
+  for {
+    n, err := t.tty.Read(buf)
+    if err != nil {
+      if errors.Is(err, os.ErrDeadlineExceeded) {
+        t.paused <- struct{}{}
+        <-t.resumed
+        continue
+      }
+      return
+    }
+    for _, key := range parseKeys(buf[:n]) {
+      t.keys <- key
+    }
+  }
+}
+
+// terminalKeys maps escape sequences to key names
+var terminalKeys = map[string]string{
+  "\x1b[A": "up", "\x1b[B": "down", "\x1b[C": "right", "\x1b[D": "left",
+  "\x1bOA": "up", "\x1bOB": "down", "\x1bOC": "right", "\x1bOD": "left",
+  "\x1b[5~": "pgup", "\x1b[6~": "pgdn",
+  "\x1b[H": "home", "\x1b[F": "end", "\x1b[1~": "home", "\x1b[4~": "end",
+  "\x1bOH": "home", "\x1bOF": "end",
+}
+
+// parseKeys splits input read from the terminal into keys. Keys are named "up", "down",
+// "left", "right", "pgup", "pgdn", "home", "end", "esc", "enter", "backspace", "tab" and
+// "ctrl-<letter>". Other keys are the character typed.
+func parseKeys(b []byte) []string {
+  var keys []string
+  for len(b) > 0 {
+    if b[0] == 0x1b && len(b) > 1 {
+      // escape sequence: ESC [ or ESC O, parameters, then a final byte
+      end := 1
+      if b[1] == '[' || b[1] == 'O' {
+        end = 2
+        for end < len(b) && (b[end] < 0x40 || b[end] > 0x7e) {
+          end++
+        }
+        end = imin(end+1, len(b))
+      }
+      if name, ok := terminalKeys[string(b[:end])]; ok {
+        keys = append(keys, name)
+      } else if end == 1 {
+        keys = append(keys, "esc")
+      }
+      b = b[end:]
+      continue
+    }
+    switch c := b[0]; {
+    case c == 0x1b:
+      keys = append(keys, "esc")
+    case c == '\r' || c == '\n':
+      keys = append(keys, "enter")
+    case c == 0x7f || c == 0x08:
+      keys = append(keys, "backspace")
+    case c == '\t':
+      keys = append(keys, "tab")
+    case c < 0x20:
+      keys = append(keys, "ctrl-"+string(rune('a'+c-1)))
+    default:
+      r, size := utf8.DecodeRune(b)
+      keys = append(keys, string(r))
+      b = b[size:]
+      continue
+    }
+    b = b[1:]
+  }
+  return keys
+}
+
+// draw writes a frame of lines to the terminal, replacing what was there.
+// Lines must fit the width of the terminal; see fitWidth.
+func (t *terminal) draw(lines []string) {
+  var buf bytes.Buffer
+  buf.WriteString("\x1b[H")
+  for i, line := range lines {
+    if i >= t.height {
+      break
+    }
+    if i > 0 {
+      buf.WriteString("\r\n")
+    }
+    buf.WriteString(line)
+    buf.WriteString("\x1b[K") // clear rest of line
+  }
+  buf.WriteString("\x1b[J") // clear rest of screen
+  t.tty.Write(buf.Bytes())
+}
+
+// fitWidth truncates or pads s with spaces to width columns (see runeWidth)
+func fitWidth(s string, width int) string {
+  if n := textWidth(s); n <= width {
+    return s + strings.Repeat(" ", width-n)
+  }
+  s = limitStrLen(s, width)
+  return s + strings.Repeat(" ", width-textWidth(s)) // e.g. when a wide rune was cut
+}
+
+// sanitizeText replaces characters which would affect the terminal, like escape
+// sequences, and expands tabs
+func sanitizeText(s string) string {
+  return strings.Map(func(r rune) rune {
+    if r < 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0) {
+      return '?'
+    }
+    return r
+  }, strings.ReplaceAll(s, "\t", "    "))
+}
+
+// wrapText splits text into lines of at most width columns, breaking at spaces if possible
+func wrapText(text string, width int) []string {
+  var lines []string
+  for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+    line = sanitizeText(strings.TrimRight(line, "\r"))
+    for utf8.RuneCountInString(line) > width && width > 0 {
+      runes := []rune(line)
+      i := width
+      for i > width/2 && runes[i] != ' ' {
+        i--
+      }
+      if runes[i] != ' ' {
+        i = width
+      }
+      lines = append(lines, string(runes[:i]))
+      line = strings.TrimLeft(string(runes[i:]), " ")
+    }
+    lines = append(lines, line)
+  }
+  return lines
+}
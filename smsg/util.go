@@ -2,13 +2,21 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"fmt"
 	"hash"
 	"io"
-	"math/bits"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/width"
 )
 
 type HashingCountingReader struct {
@@ -26,27 +34,33 @@ func MakeSHA256HashingCountingReader(r io.Reader) HashingCountingReader {
 
 func (r *HashingCountingReader) Read(p []byte) (n int, err error) {
 	n, err = r.Reader.Read(p)
-	if err == nil {
+	// note: a reader may return data along with an error, like io.EOF
+	if n > 0 {
 		r.nread += n
 		r.hash.Write(p[:n])
 	}
 	return
 }
 
-func ilog2(n uint64) int {
-	if n <= 1 {
-		return 1
-	}
-	return (64 - bits.LeadingZeros64(n)) - 1
-}
-
-// create error
+// create error. Like fmt.Errorf, %w wraps an error, e.g. one of the kinds in errors.go.
 func errorf(format string, arg ...interface{}) error {
 	return fmt.Errorf(format, arg...)
 }
 
-// log error and exit
+// log error and exit, after running the exit handlers like Shutdown does, e.g. to close
+// the database. The exit status depends on the kind of the error in msg or arg, if any
+// (see exitCodeOf.) It never returns, unless exitFunc doesn't exit.
+//
+// When called while shutting down, e.g. by an exit handler, it exits right away rather
+// than waiting for the exit handlers, which may be waiting for it.
 func fatalf(msg interface{}, arg ...interface{}) {
+	code := 1
+	for _, v := range append([]interface{}{msg}, arg...) {
+		if err, ok := v.(error); ok {
+			code = exitCodeOf(err)
+			break
+		}
+	}
 	var format string
 	if s, ok := msg.(string); ok {
 		format = s
@@ -56,7 +70,11 @@ func fatalf(msg interface{}, arg ...interface{}) {
 		format = fmt.Sprintf("%v", msg)
 	}
 	fmt.Fprintf(os.Stderr, format+"\n", arg...)
-	os.Exit(1)
+	if !beginShutdown() {
+		exitFunc(code)
+		return
+	}
+	finishShutdown(nil, code)
 }
 
 // isdir returns nil if path is a directory, or an error describing the issue
@@ -78,6 +96,54 @@ func plural(n int, one, other string) string {
 	return other
 }
 
+// humanBytes formats a size in bytes with binary units and at most one decimal,
+// like "512 B", "1 KiB" or "3.4 MiB"
+func humanBytes(n int64) string {
+	if n < 0 {
+		return "-" + humanBytes(-n)
+	}
+	if n < 1024 {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	return humanUnits(float64(n), 1024, []string{" KiB", " MiB", " GiB", " TiB", " PiB", " EiB"})
+}
+
+// humanCount formats a number with decimal units and at most one decimal, like "999",
+// "1k" or "1.2M"
+func humanCount(n int) string {
+	if n < 0 {
+		return "-" + humanCount(-n)
+	}
+	if n < 1000 {
+		return strconv.Itoa(n)
+	}
+	return humanUnits(float64(n), 1000, []string{"k", "M", "G", "T", "P", "E"})
+}
+
+// humanUnits formats v, which is at least base, in the largest of units in which it's
+// at least 1
+func humanUnits(v, base float64, units []string) string {
+	i := 0
+	v /= base
+	s := strconv.FormatFloat(v, 'f', 1, 64)
+	// note: e.g. 1048575 bytes is 1023.999 KiB, which rounds to 1 MiB, not 1024 KiB
+	for i < len(units)-1 && (v >= base || s == strconv.FormatFloat(base, 'f', 1, 64)) {
+		v /= base
+		i++
+		s = strconv.FormatFloat(v, 'f', 1, 64)
+	}
+	return strings.TrimSuffix(s, ".0") + units[i]
+}
+
+// sizeString formats a size in bytes with humanBytes, or as an exact number of bytes if
+// exact is true, e.g. with the -bytes option of commands, for scripts
+func sizeString(n int64, exact bool) string {
+	if exact {
+		return strconv.FormatInt(n, 10) + " bytes"
+	}
+	return humanBytes(n)
+}
+
 func countByte(data []byte, subject byte) (count uint) {
 	for _, b := range data {
 		if b == subject {
@@ -87,6 +153,20 @@ func countByte(data []byte, subject byte) (count uint) {
 	return
 }
 
+// countDigits returns the number of decimal digits of n, including a minus sign
+func countDigits(n int) int {
+	d := 1
+	if n < 0 {
+		d++
+		n = -n
+	}
+	for n >= 10 {
+		n /= 10
+		d++
+	}
+	return d
+}
+
 func imin(a, b int) int {
 	if a < b {
 		return a
@@ -101,22 +181,435 @@ func imax(a, b int) int {
 	return b
 }
 
+// editDistance returns the number of edits (insertions, deletions, substitutions and
+// transpositions of adjacent bytes) needed to turn a into b
+func editDistance(a, b string) int {
+	// rows of the distance matrix: i-2, i-1 and i
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = imin(imin(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				curr[j] = imin(curr[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, curr = prev, curr, prev2
+	}
+	return prev[len(b)]
+}
+
+// indexOfString returns the index of the first occurrence of s in v, or -1
+func indexOfString(v []string, s string) int {
+	for i, s2 := range v {
+		if s2 == s {
+			return i
+		}
+	}
+	return -1
+}
+
 // relPath returns a relative name of path rooted in dir.
 // If path is outside dir path is returned verbatim.
-// path is assumed to be absolute.
+// path is assumed to be absolute. On Windows either may use "/" as separator, like
+// "C:/Users/sam", and the comparison ignores case, including that of the drive letter.
 func relPath(dir string, path string) string {
-	if len(path) > len(dir) && path[len(dir)] == os.PathSeparator && strings.HasPrefix(path, dir) {
-		return path[len(dir)+1:]
-	} else if path == dir {
+	return relPathOS(dir, path, runtime.GOOS == "windows")
+}
+
+// relPathOS is relPath for Windows-style paths if windows is true, else for Unix-style
+// paths, on any OS
+func relPathOS(dir, path string, windows bool) string {
+	// note: keep a root's separator, e.g. "/" or "C:\"
+	for len(dir) > 1 && isPathSeparatorOS(dir[len(dir)-1], windows) &&
+		!(windows && len(dir) == 3 && dir[1] == ':') {
+		dir = dir[:len(dir)-1]
+	}
+	if dir == "" || !hasPathPrefixOS(path, dir, windows) {
+		return path
+	}
+	rest := path[len(dir):]
+	if !isPathSeparatorOS(dir[len(dir)-1], windows) {
+		if rest == "" {
+			return "."
+		}
+		if !isPathSeparatorOS(rest[0], windows) {
+			return path // e.g. "/a/bc" in "/a/b"
+		}
+		rest = rest[1:]
+	}
+	if rest == "" { // e.g. "/a/b/" in "/a/b"
 		return "."
 	}
-	return path
+	return rest
+}
+
+// hasPathPrefix returns true if path starts with prefix, ignoring case on Windows where
+// file names are case insensitive, e.g. "C:\Users" and "c:\users"
+func hasPathPrefix(path, prefix string) bool {
+	return hasPathPrefixOS(path, prefix, runtime.GOOS == "windows")
+}
+
+// hasPathPrefixOS is hasPathPrefix for Windows if windows is true, where "/" and "\" are
+// the same too, else for Unix
+func hasPathPrefixOS(path, prefix string, windows bool) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	if !windows {
+		return path[:len(prefix)] == prefix
+	}
+	return strings.EqualFold(
+		strings.ReplaceAll(path[:len(prefix)], "/", "\\"), strings.ReplaceAll(prefix, "/", "\\"))
+}
+
+// isPathSeparatorOS is os.IsPathSeparator for Windows if windows is true, else for Unix
+func isPathSeparatorOS(c byte, windows bool) bool {
+	return c == '/' || (windows && c == '\\')
+}
+
+// argPath resolves a filename given as a command-line argument.
+// Since the process changes its working directory to MSGDIR at startup,
+// relative paths are resolved against WORKDIR.
+func argPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(WORKDIR, path)
+}
+
+// runeWidth returns the number of terminal columns r takes up: 2 for East Asian wide
+// characters, like CJK and most emoji, 0 for combining marks and invisible formatting
+// characters, like the zero-width joiners of emoji sequences, and 1 for the rest
+func runeWidth(r rune) int {
+	if unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+	if r >= 0x1F3FB && r <= 0x1F3FF { // emoji skin tone modifiers
+		return 0
+	}
+	switch width.LookupRune(r).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	}
+	return 1
 }
 
+// textWidth returns the number of terminal columns s takes up (see runeWidth). A rune
+// which follows a zero-width joiner is shown as part of the rune before it, like the
+// people of the emoji "👩‍👩‍👧", and takes up no columns of its own.
+func textWidth(s string) int {
+	w, prev := 0, rune(0)
+	for _, r := range s {
+		if prev != '\u200d' {
+			w += runeWidth(r)
+		}
+		prev = r
+	}
+	return w
+}
+
+// limitStrLen truncates s to at most maxlen terminal columns (see runeWidth), replacing
+// what's removed with "…". Runes are kept whole, along with combining marks which follow
+// them.
+func limitStrLen(s string, maxlen int) string {
+	if len(s) <= maxlen { // note: no rune is wider than its encoding
+		return s
+	}
+	if maxlen <= 0 {
+		return ""
+	}
+	w, end, prev := 0, 0, rune(0) // end of the part of s which fits along with "…"
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if prev != '\u200d' { // see textWidth
+			w += runeWidth(r)
+		}
+		if w > maxlen {
+			return s[:end] + "…"
+		}
+		i += size
+		if w < maxlen && r != '\u200d' { // not ending with a joiner
+			end = i
+		}
+		prev = r
+	}
+	return s
+}
+
+// isDotFilename returns true if the last element of filename starts with ".", like
+// "inbox/.hidden.msg", or "inbox\.hidden.msg" on Windows
 func isDotFilename(filename string) bool {
-	i := strings.LastIndexByte(filename, '/') + 1
+	return isDotFilenameOS(filename, runtime.GOOS == "windows")
+}
+
+// isDotFilenameOS is isDotFilename for Windows if windows is true, else for Unix
+func isDotFilenameOS(filename string, windows bool) bool {
+	i := len(filename)
+	for i > 0 && !isPathSeparatorOS(filename[i-1], windows) {
+		i--
+	}
 	if i >= len(filename) {
 		return false
 	}
 	return filename[i] == '.'
 }
+
+// writeFileNoClobber atomically writes data to filename.
+// The data is first written to a temporary file in TMPDIR which is then linked into place,
+// so that readers never see a partially written file.
+// Returns an error satisfying os.IsExist if filename already exists.
+func writeFileNoClobber(filename string, data []byte) error {
+	f, err := os.CreateTemp(TMPDIR, "write-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	return os.Link(f.Name(), filename)
+}
+
+// writeFileAtomic writes data to filename via a temporary file, so that filename is
+// either absent or complete
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmpfile := filename + ".tmp"
+	if err := os.WriteFile(tmpfile, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, filename)
+}
+
+// linkIntoDir hard-links file into dir, keeping its name if possible.
+// If dir already has a file with the same name and identical content, no link is made and
+// the path of the existing file is returned. This makes the operation idempotent.
+func linkIntoDir(file, dir string) (string, error) {
+	name := filepath.Base(file)
+	ext := filepath.Ext(name)
+	stem := name[:len(name)-len(ext)]
+	dstfile := filepath.Join(dir, name)
+	for n := 2; ; n++ {
+		err := os.Link(file, dstfile)
+		if err == nil || !os.IsExist(err) {
+			return dstfile, err
+		}
+		if same, err := sameFileContent(file, dstfile); same || err != nil {
+			return dstfile, err
+		}
+		dstfile = filepath.Join(dir, fmt.Sprintf("%s.%d%s", stem, n, ext))
+	}
+}
+
+// moveIntoDir moves file into dir. See linkIntoDir for details.
+func moveIntoDir(file, dir string) (string, error) {
+	dstfile, err := linkIntoDir(file, dir)
+	if err != nil {
+		return "", err
+	}
+	return dstfile, os.Remove(file)
+}
+
+func sameFileContent(file1, file2 string) (bool, error) {
+	info1, err := os.Stat(file1)
+	if err != nil {
+		return false, err
+	}
+	info2, err := os.Stat(file2)
+	if err != nil {
+		return false, err
+	}
+	if os.SameFile(info1, info2) {
+		return true, nil
+	}
+	if info1.Size() != info2.Size() {
+		return false, nil
+	}
+	data1, err := os.ReadFile(file1)
+	if err != nil {
+		return false, err
+	}
+	data2, err := os.ReadFile(file2)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(data1, data2), nil
+}
+
+// parseDuration is like time.ParseDuration but also accepts a number of days, e.g. "7d"
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		if n, err := strconv.ParseFloat(s[:len(s)-1], 64); err == nil {
+			return time.Duration(n * float64(24*time.Hour)), nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// parseByteSize parses a size in bytes with an optional binary unit, e.g. "512", "10K",
+// "1M", "1.5MiB" or "2G"
+func parseByteSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(s), "B"), "i")
+	mult := int64(1)
+	if n := len(num); n > 0 {
+		if i := strings.IndexByte("KMGT", num[n-1]&^0x20); i != -1 {
+			mult = 1 << (10 * (i + 1))
+			num = num[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return 0, errorf("invalid size %q (expected bytes or e.g. 10K, 1M or 2G)", s)
+	}
+	return int64(v * float64(mult)), nil
+}
+
+// parseTimeArg parses a point in time given on the command line, either as a local
+// date ("2006-01-02"), a local date and time ("2006-01-02 15:04") or as a duration
+// before now ("7d", "3h").
+func parseTimeArg(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	d, err := parseDuration(s)
+	if err != nil {
+		return time.Time{}, errorf("invalid time %q (expected YYYY-MM-DD or duration)", s)
+	}
+	return time.Now().Add(-d), nil
+}
+
+// formatMessageTime formats the time of a message for listing it: relative to now with
+// formatRelativeTime, or with formatTime for -abs-time or abs_time in the config
+func formatMessageTime(now time.Time, t time.Time) string {
+	var buf [32]byte
+	return string(appendMessageTime(buf[:0], now, t))
+}
+
+// appendMessageTime appends t formatted like formatMessageTime to dst
+func appendMessageTime(dst []byte, now time.Time, t time.Time) []byte {
+	if ABSTIME || config.AbsTime {
+		return appendTime(dst, now, t)
+	}
+	return appendRelativeTime(dst, now, t)
+}
+
+// formatRelativeTime formats t relative to now, the first of these which applies:
+//
+//   now               less than a minute ago (or ahead, e.g. when a clock is off)
+//   5m                less than an hour ago, in whole minutes (59m59s is "59m")
+//   3h                earlier the same day, in whole hours
+//   yesterday 14:02   the day before
+//   Mon 14:02         2 to 6 days before
+//   (formatTime)      a week or more before, or in the future
+//
+// Days are calendar days in the time zone of t, so 23:50 is "yesterday 23:50" at 00:40
+// the next day, unless it's less than an hour ago ("50m"). The year makes no difference
+// to days, e.g. Dec 31 is "yesterday" on Jan 1.
+func formatRelativeTime(now time.Time, t time.Time) string {
+	var buf [32]byte
+	return string(appendRelativeTime(buf[:0], now, t))
+}
+
+// appendRelativeTime appends t formatted like formatRelativeTime to dst
+func appendRelativeTime(dst []byte, now time.Time, t time.Time) []byte {
+	if n, unit, ok := recentAge(now, t); ok {
+		if n == 0 {
+			return append(dst, "now"...)
+		}
+		return append(strconv.AppendInt(dst, int64(n), 10), unit)
+	}
+	if !isRelativeTime(now, t) {
+		return appendTime(dst, now, t)
+	}
+	if daysBetween(t, now) == 1 {
+		return t.AppendFormat(append(dst, "yesterday "...), "15:04")
+	}
+	return t.AppendFormat(dst, "Mon 15:04")
+}
+
+// isRelativeTime returns true if formatRelativeTime formats t relative to now, rather
+// than falling back to formatTime
+func isRelativeTime(now time.Time, t time.Time) bool {
+	if _, _, ok := recentAge(now, t); ok {
+		return true
+	}
+	return !now.Before(t) && daysBetween(t, now) < 7
+}
+
+// recentAge returns how long before now t is when that's less than an hour, in minutes
+// (unit 'm'; 0 for less than a minute, or up to a minute ahead), or when t is earlier the
+// same day, in hours (unit 'h'). ok is false for other times.
+func recentAge(now, t time.Time) (n int, unit byte, ok bool) {
+	d := now.Sub(t)
+	switch {
+	case d < -time.Minute:
+		return 0, 0, false
+	case d < time.Minute:
+		return 0, 'm', true
+	case d < time.Hour:
+		return int(d / time.Minute), 'm', true
+	case daysBetween(t, now) == 0:
+		return int(d / time.Hour), 'h', true
+	}
+	return 0, 0, false
+}
+
+// daysBetween returns the number of calendar days from the day of t to that of u, in the
+// time zone of t
+func daysBetween(t, u time.Time) int {
+	y1, m1, d1 := t.Date()
+	y2, m2, d2 := u.In(t.Location()).Date()
+	// note: in UTC, which has no daylight saving time, every day has 24 hours
+	a := time.Date(y1, m1, d1, 0, 0, 0, 0, time.UTC)
+	b := time.Date(y2, m2, d2, 0, 0, 0, 0, time.UTC)
+	return int(b.Sub(a) / (24 * time.Hour))
+}
+
+// formatMessageDate formats the time of a message for its header, followed by the time
+// relative to now like formatRelativeTime when that's recent, unless times are to be
+// absolute
+func formatMessageDate(now, t time.Time) string {
+	s := t.Format("Mon, Jan 2, 2006 at 15:04")
+	if ABSTIME || config.AbsTime || !isRelativeTime(now, t) {
+		return s
+	}
+	return s + " (" + formatRelativeTime(now, t) + ")"
+}
+
+func formatTime(now time.Time, t time.Time) string {
+	var buf [32]byte
+	return string(appendTime(buf[:0], now, t))
+}
+
+// appendTime appends t formatted like formatTime to dst
+func appendTime(dst []byte, now time.Time, t time.Time) []byte {
+	now = now.In(t.Location())
+	if now.Year() != t.Year() {
+		return t.AppendFormat(dst, "2006, Jan 2, 15:04")
+	}
+	if now.Month() != t.Month() {
+		return t.AppendFormat(dst, "Jan 2, 15:04")
+	}
+	if now.Day() != t.Day() {
+		return t.AppendFormat(dst, "Jan 2, 15:04")
+	}
+	return t.AppendFormat(dst, "15:04:05")
+}
@@ -0,0 +1,360 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+	"unicode/utf8"
+)
+
+func TestRelPath(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "msg")
+	sep := string(filepath.Separator)
+	tests := []struct{ dir, path, rel string }{
+		{dir, dir, "."},
+		{dir, filepath.Join(dir, "inbox", "a.msg"), filepath.Join("inbox", "a.msg")},
+		{dir + sep, filepath.Join(dir, "a.msg"), "a.msg"},
+		{dir, dir + "x" + sep + "a.msg", dir + "x" + sep + "a.msg"},
+		{dir, filepath.Dir(dir), filepath.Dir(dir)},
+	}
+	for _, test := range tests {
+		if rel := relPath(test.dir, test.path); rel != test.rel {
+			t.Errorf("relPath(%q, %q) = %q; expected %q", test.dir, test.path, rel, test.rel)
+		}
+	}
+}
+
+func TestIsDotFilename(t *testing.T) {
+	tests := []struct {
+		filename string
+		dot      bool
+	}{
+		{".a.msg", true},
+		{"a.msg", false},
+		{"", false},
+		{filepath.Join("inbox", ".a.msg"), true},
+		{filepath.Join(".inbox", "a.msg"), false},
+		{filepath.Join("inbox", "a.msg") + string(filepath.Separator), false},
+	}
+	for _, test := range tests {
+		if dot := isDotFilename(test.filename); dot != test.dot {
+			t.Errorf("isDotFilename(%q) = %v; expected %v", test.filename, dot, test.dot)
+		}
+	}
+}
+
+func TestHashingCountingReaderFinalRead(t *testing.T) {
+	data := strings.Repeat("hello, world\n", 100)
+	read := func(r io.Reader) HashingCountingReader {
+		cr := MakeSHA256HashingCountingReader(r)
+		if _, err := io.ReadAll(&cr); err != nil {
+			t.Fatal(err)
+		}
+		return cr
+	}
+	want := read(strings.NewReader(data))
+	// returns the last data along with io.EOF
+	got := read(iotest.DataErrReader(strings.NewReader(data)))
+	if got.nread != len(data) || want.nread != len(data) {
+		t.Errorf("nread = %d and %d; expected %d", got.nread, want.nread, len(data))
+	}
+	if !bytes.Equal(got.hash.Sum(nil), want.hash.Sum(nil)) {
+		t.Errorf("hash differs when the final read returns io.EOF")
+	}
+}
+
+func TestLimitStrLen(t *testing.T) {
+	family := "👩‍👩‍👧" // one emoji, 2 columns wide
+	tests := []struct {
+		s      string
+		maxlen int
+		result string
+	}{
+		// ASCII
+		{"hello", 10, "hello"},
+		{"hello", 5, "hello"},
+		{"hello world", 5, "hell…"},
+		{"hello world", 1, "…"},
+		{"hello world", 0, ""},
+		{"", 0, ""},
+
+		// precomposed and combining characters
+		{"caf\u00e9 au lait", 4, "caf…"},
+		{"caf\u00e9 au lait", 5, "caf\u00e9…"},
+		{"caf\u00e9", 4, "caf\u00e9"},
+		{"cafe\u0301 au lait", 5, "cafe\u0301…"},
+		{"cafe\u0301 au lait", 4, "caf…"},
+		{"cafe\u0301", 4, "cafe\u0301"},
+
+		// wide characters
+		{"日本語のテキスト", 16, "日本語のテキスト"},
+		{"日本語のテキスト", 15, "日本語のテキス…"},
+		{"日本語のテキスト", 6, "日本…"},
+		{"日本語のテキスト", 5, "日本…"},
+		{"日本語のテキスト", 2, "…"},
+		{"ａｂｃ", 4, "ａ…"},
+
+		// emoji, with zero-width joiners and skin tones
+		{family, 2, family},
+		{family + " family", 9, family + " family"},
+		{family + " family", 8, family + " fami…"},
+		{family + " family", 3, family + "…"},
+		{family + " family", 2, "…"},
+		{"ab" + family, 4, "ab" + family},
+		{"ab" + family, 3, "ab…"},
+		{"👍🏽👍🏽", 4, "👍🏽👍🏽"},
+		{"👍🏽👍🏽", 3, "👍🏽…"},
+	}
+	for _, test := range tests {
+		result := limitStrLen(test.s, test.maxlen)
+		if result != test.result {
+			t.Errorf("limitStrLen(%q, %d) = %q; expected %q", test.s, test.maxlen, result, test.result)
+		}
+		if !utf8.ValidString(result) || textWidth(result) > test.maxlen {
+			t.Errorf("limitStrLen(%q, %d) = %q, %d columns wide", test.s, test.maxlen, result,
+				textWidth(result))
+		}
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	tests := []struct {
+		n      int64
+		result string
+	}{
+		{0, "0 B"},
+		{1, "1 B"},
+		{1023, "1023 B"},
+		{1024, "1 KiB"},
+		{1025, "1 KiB"},
+		{1536, "1.5 KiB"},
+		{10*1024 - 1, "10 KiB"},
+		{1<<20 - 1, "1 MiB"},
+		{1 << 20, "1 MiB"},
+		{1<<20 + 1, "1 MiB"},
+		{3565158, "3.4 MiB"},
+		{1<<30 - 1, "1 GiB"},
+		{1 << 30, "1 GiB"},
+		{1 << 40, "1 TiB"},
+		{1 << 50, "1 PiB"},
+		{1 << 60, "1 EiB"},
+		{math.MaxInt64, "8 EiB"},
+		{-1, "-1 B"},
+		{-1024, "-1 KiB"},
+	}
+	for _, test := range tests {
+		if s := humanBytes(test.n); s != test.result {
+			t.Errorf("humanBytes(%d) = %q; expected %q", test.n, s, test.result)
+		}
+	}
+}
+
+func TestHumanCount(t *testing.T) {
+	tests := []struct {
+		n      int
+		result string
+	}{
+		{0, "0"},
+		{999, "999"},
+		{1000, "1k"},
+		{1001, "1k"},
+		{1500, "1.5k"},
+		{9999, "10k"},
+		{999999, "1M"},
+		{1000000, "1M"},
+		{1234567, "1.2M"},
+		{999999999, "1G"},
+		{1000000000, "1G"},
+		{-999, "-999"},
+		{-1000, "-1k"},
+	}
+	for _, test := range tests {
+		if s := humanCount(test.n); s != test.result {
+			t.Errorf("humanCount(%d) = %q; expected %q", test.n, s, test.result)
+		}
+	}
+}
+
+func TestRelPathOS(t *testing.T) {
+	tests := []struct {
+		windows        bool
+		dir, path, rel string
+	}{
+		{false, "/a/b", "/a/b/c.msg", "c.msg"},
+		{false, "/a/b", "/a/b/c/d.msg", "c/d.msg"},
+		{false, "/a/b/", "/a/b/c.msg", "c.msg"},
+		{false, "/a/b//", "/a/b/c.msg", "c.msg"},
+		{false, "/a/b", "/a/b", "."},
+		{false, "/a/b", "/a/b/", "."},
+		{false, "/a/b/", "/a/b", "."},
+		{false, "/a/b", "/a/bc", "/a/bc"},
+		{false, "/a/b", "/x/y", "/x/y"},
+		{false, "/", "/a/b", "a/b"},
+		{false, "/a/B", "/a/b/c", "/a/b/c"},
+		{false, `/a/b`, `/a/b\c`, `/a/b\c`},
+		{false, "", "/a", "/a"},
+
+		{true, `C:\a\b`, `C:\a\b\c.msg`, `c.msg`},
+		{true, `C:\a`, `C:\a\b\c.msg`, `b\c.msg`},
+		{true, `C:\a\b\`, `C:\a\b\c.msg`, `c.msg`},
+		{true, `c:\A\B`, `C:\a\b\c.msg`, `c.msg`},
+		{true, `C:/a/b`, `C:\a\b\c.msg`, `c.msg`},
+		{true, `C:\a\b`, `C:/a/b/c.msg`, `c.msg`},
+		{true, `C:\`, `C:\a`, `a`},
+		{true, `C:\a\b`, `C:\a\b`, `.`},
+		{true, `C:\a\b`, `C:\a\b\`, `.`},
+		{true, `C:\a\b`, `C:\a\bc`, `C:\a\bc`},
+		{true, `C:\a\b`, `D:\a\b\c`, `D:\a\b\c`},
+	}
+	for _, test := range tests {
+		if rel := relPathOS(test.dir, test.path, test.windows); rel != test.rel {
+			t.Errorf("relPathOS(%q, %q, windows=%v) = %q; expected %q",
+				test.dir, test.path, test.windows, rel, test.rel)
+		}
+	}
+}
+
+func TestIsDotFilenameOS(t *testing.T) {
+	tests := []struct {
+		windows  bool
+		filename string
+		dot      bool
+	}{
+		{false, ".a.msg", true},
+		{false, "inbox/.a.msg", true},
+		{false, ".inbox/a.msg", false},
+		{false, `inbox\.a.msg`, false},
+		{false, "inbox/", false},
+		{false, "", false},
+
+		{true, `.a.msg`, true},
+		{true, `inbox\.a.msg`, true},
+		{true, `inbox/.a.msg`, true},
+		{true, `C:\msg\inbox\.a.msg`, true},
+		{true, `.inbox\a.msg`, false},
+		{true, `inbox\`, false},
+	}
+	for _, test := range tests {
+		if dot := isDotFilenameOS(test.filename, test.windows); dot != test.dot {
+			t.Errorf("isDotFilenameOS(%q, windows=%v) = %v; expected %v",
+				test.filename, test.windows, dot, test.dot)
+		}
+	}
+}
+
+func TestAppendTime(t *testing.T) {
+	now := time.Date(2022, 6, 15, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		t      time.Time
+		layout string
+	}{
+		{now.Add(-time.Hour), "15:04:05"},
+		{now.Add(-24 * time.Hour), "Jan 2, 15:04"},
+		{now.AddDate(0, -1, 0), "Jan 2, 15:04"},
+		{now.AddDate(-1, 0, 0), "2006, Jan 2, 15:04"},
+	} {
+		want := test.t.Format(test.layout)
+		if s := string(appendTime([]byte("x"), now, test.t)); s != "x"+want {
+			t.Errorf("appendTime(%v) = %q; expected %q", test.t, s, "x"+want)
+		}
+		if s := formatTime(now, test.t); s != want {
+			t.Errorf("formatTime(%v) = %q; expected %q", test.t, s, want)
+		}
+	}
+}
+
+func TestFormatRelativeTime(t *testing.T) {
+	at := func(month time.Month, day, hour, min, sec int) time.Time {
+		return time.Date(2022, month, day, hour, min, sec, 0, time.UTC)
+	}
+	now := at(6, 15, 12, 0, 0) // a Wednesday
+	for _, test := range []struct {
+		now      time.Time
+		t        time.Time
+		expected string
+	}{
+		{now, now, "now"},
+		{now, now.Add(-59 * time.Second), "now"},
+		{now, now.Add(-time.Minute), "1m"},
+		{now, now.Add(-59*time.Minute - 59*time.Second), "59m"},
+		{now, now.Add(-time.Hour), "1h"},
+		{now, now.Add(-11*time.Hour - 59*time.Minute), "11h"},
+		{now, at(6, 15, 0, 0, 0), "12h"},
+		{now, at(6, 14, 23, 59, 59), "yesterday 23:59"},
+		{now, at(6, 14, 0, 0, 0), "yesterday 00:00"},
+		{now, at(6, 13, 14, 2, 0), "Mon 14:02"},
+		{now, at(6, 9, 0, 0, 0), "Thu 00:00"},
+		{now, at(6, 8, 23, 59, 0), formatTime(now, at(6, 8, 23, 59, 0))},
+
+		// ahead of now
+		{now, now.Add(time.Minute), "now"},
+		{now, now.Add(2 * time.Minute), formatTime(now, now.Add(2*time.Minute))},
+
+		// crossing midnight
+		{at(6, 15, 0, 40, 0), at(6, 14, 23, 50, 0), "50m"},
+		{at(6, 15, 0, 40, 0), at(6, 14, 23, 40, 0), "yesterday 23:40"},
+		{at(6, 15, 0, 40, 0), at(6, 14, 12, 0, 0), "yesterday 12:00"},
+
+		// crossing the end of a year
+		{time.Date(2023, 1, 1, 9, 0, 0, 0, time.UTC), at(12, 31, 18, 0, 0), "yesterday 18:00"},
+		{time.Date(2023, 1, 1, 0, 30, 0, 0, time.UTC), at(12, 31, 23, 45, 0), "45m"},
+		{time.Date(2023, 1, 2, 9, 0, 0, 0, time.UTC), at(12, 30, 9, 0, 0), "Fri 09:00"},
+
+		// days are those of the time zone of t
+		{now, at(6, 14, 20, 0, 0).In(time.FixedZone("+0900", 9*3600)), "16h"},
+		{now, at(6, 15, 1, 0, 0).In(time.FixedZone("-0300", -3*3600)), "yesterday 22:00"},
+	} {
+		if s := formatRelativeTime(test.now, test.t); s != test.expected {
+			t.Errorf("formatRelativeTime(%v, %v) = %q; expected %q", test.now, test.t, s,
+				test.expected)
+		}
+	}
+}
+
+func TestFormatMessageTimeAbsolute(t *testing.T) {
+	now := time.Date(2022, 6, 15, 12, 0, 0, 0, time.UTC)
+	tm := now.Add(-5 * time.Minute)
+	if s := formatMessageTime(now, tm); s != "5m" {
+		t.Errorf("formatMessageTime = %q; expected %q", s, "5m")
+	}
+	defer func() { ABSTIME, config.AbsTime = false, false }()
+	for _, abs := range []*bool{&ABSTIME, &config.AbsTime} {
+		ABSTIME, config.AbsTime = false, false
+		*abs = true
+		if s, want := formatMessageTime(now, tm), formatTime(now, tm); s != want {
+			t.Errorf("formatMessageTime with absolute times = %q; expected %q", s, want)
+		}
+	}
+}
+
+func TestFormatMessageDate(t *testing.T) {
+	now := time.Date(2022, 6, 15, 12, 0, 0, 0, time.UTC) // a Wednesday
+	for _, test := range []struct {
+		t        time.Time
+		expected string
+	}{
+		{now, "Wed, Jun 15, 2022 at 12:00 (now)"},
+		{now.Add(-59 * time.Minute), "Wed, Jun 15, 2022 at 11:01 (59m)"},
+		{now.Add(-time.Hour), "Wed, Jun 15, 2022 at 11:00 (1h)"},
+		{now.Add(-24 * time.Hour), "Tue, Jun 14, 2022 at 12:00 (yesterday 12:00)"},
+		{now.AddDate(0, 0, -6), "Thu, Jun 9, 2022 at 12:00 (Thu 12:00)"},
+		{now.AddDate(0, 0, -7), "Wed, Jun 8, 2022 at 12:00"},
+		{now.Add(time.Hour), "Wed, Jun 15, 2022 at 13:00"},
+	} {
+		if s := formatMessageDate(now, test.t); s != test.expected {
+			t.Errorf("formatMessageDate(%v) = %q; expected %q", test.t, s, test.expected)
+		}
+	}
+	defer func() { ABSTIME = false }()
+	ABSTIME = true
+	if s := formatMessageDate(now, now); s != "Wed, Jun 15, 2022 at 12:00" {
+		t.Errorf("formatMessageDate with absolute times = %q", s)
+	}
+}
+
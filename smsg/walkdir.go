@@ -8,25 +8,34 @@ import (
   "sort"
 )
 
-func walkDirRev(dirpath string, callback fs.WalkDirFunc) error {
-  return walkDirRev1(dirpath, nil, callback)
+// walkDirRev is like filepath.WalkDir but visits the entries of each directory in reverse
+// lexical order, e.g. message files newest first, since their names start with their time.
+// As with filepath.WalkDir, fn is called for root too, and fn returning filepath.SkipDir
+// skips the directory, or for a file, the rest of the entries of its directory.
+func walkDirRev(root string, fn fs.WalkDirFunc) error {
+  info, err := os.Lstat(root)
+  if err != nil {
+    err = fn(root, nil, err)
+  } else {
+    err = walkDirRev1(root, fs.FileInfoToDirEntry(info), fn)
+  }
+  if err == filepath.SkipDir {
+    return nil
+  }
+  return err
 }
 
 func walkDirRev1(dirpath string, d fs.DirEntry, callback fs.WalkDirFunc) error {
-  if d != nil {
-    if err := callback(dirpath, d, nil); err != nil || !d.IsDir() {
-      if err == filepath.SkipDir && d.IsDir() {
-        // Successfully skipped directory.
-        err = nil
-      }
-      return err
+  if err := callback(dirpath, d, nil); err != nil || !d.IsDir() {
+    if err == filepath.SkipDir && d.IsDir() {
+      // Successfully skipped directory.
+      err = nil
     }
+    return err
   }
   entries, err := readDirRev(dirpath)
   if err != nil {
-    if d == nil {
-      return err
-    }
+    // second call, to report the error
     err = callback(dirpath, d, err)
     if err != nil {
       if err == filepath.SkipDir && d.IsDir() {
@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "errors"
+  "io/fs"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+// testWalkDirRev walks a tree of a/, b/1.msg, b/2.msg and c.msg, with skip returning
+// the error to return for a path relative to the root, and returns the paths visited
+func testWalkDirRev(t *testing.T, skip func(rel string) error) ([]string, error) {
+  t.Helper()
+  root := t.TempDir()
+  for _, name := range []string{"b/1.msg", "b/2.msg", "c.msg"} {
+    writeTestFile(t, root, name, "")
+  }
+  if err := os.Mkdir(filepath.Join(root, "a"), 0700); err != nil {
+    t.Fatal(err)
+  }
+  var visited []string
+  err := walkDirRev(root, func(path string, d fs.DirEntry, err error) error {
+    if err != nil {
+      return err
+    }
+    rel := filepath.ToSlash(relPath(root, path))
+    visited = append(visited, rel)
+    return skip(rel)
+  })
+  return visited, err
+}
+
+func TestWalkDirRev(t *testing.T) {
+  errTest := errors.New("test")
+  tests := []struct {
+    skip    string // path to return skipErr for
+    skipErr error
+    visited string
+    err     error
+  }{
+    {"", nil, ". c.msg b b/2.msg b/1.msg a", nil},
+    // a directory's files are skipped
+    {"b", filepath.SkipDir, ". c.msg b a", nil},
+    // a file's remaining siblings are skipped, like with filepath.WalkDir
+    {"b/2.msg", filepath.SkipDir, ". c.msg b b/2.msg a", nil},
+    {"c.msg", filepath.SkipDir, ". c.msg", nil},
+    {".", filepath.SkipDir, ".", nil},
+    // other errors stop the walk
+    {"b/2.msg", errTest, ". c.msg b b/2.msg", errTest},
+  }
+  for _, test := range tests {
+    visited, err := testWalkDirRev(t, func(rel string) error {
+      if rel == test.skip {
+        return test.skipErr
+      }
+      return nil
+    })
+    if s := strings.Join(visited, " "); s != test.visited || err != test.err {
+      t.Errorf("%s returning %v: visited %q with error %v; expected %q and %v",
+        test.skip, test.skipErr, s, err, test.visited, test.err)
+    }
+  }
+}
+
+func TestWalkDirRevMissingRoot(t *testing.T) {
+  root := filepath.Join(t.TempDir(), "missing")
+  var errs []error
+  err := walkDirRev(root, func(path string, d fs.DirEntry, err error) error {
+    errs = append(errs, err)
+    return err
+  })
+  if !os.IsNotExist(err) || len(errs) != 1 {
+    t.Errorf("walkDirRev of a missing directory: %v, callback errors %v", err, errs)
+  }
+}
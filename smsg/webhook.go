@@ -0,0 +1,208 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "bytes"
+  "context"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "io"
+  "net/http"
+  "sync"
+  "time"
+)
+
+// webhookTimeout limits each request to a webhook
+const webhookTimeout = 10 * time.Second
+
+// webhookQueueSize is the number of events queued for each webhook. Events for a webhook
+// which falls further behind, e.g. because it's down, are dropped.
+const webhookQueueSize = 100
+
+// webhookRetryDelays are the delays before retrying a failed request to a webhook.
+// An event is dropped after len(webhookRetryDelays)+1 failed attempts.
+var webhookRetryDelays = []time.Duration{time.Second, 5 * time.Second, 30 * time.Second}
+
+// webhookEvent is the JSON body POSTed to a webhook for a new message
+type webhookEvent struct {
+  Event    string          `json:"event"` // "message"
+  Id       string          `json:"id"`
+  From     string          `json:"from"`
+  FromName string          `json:"from_name,omitempty"`
+  Subject  string          `json:"subject"`
+  Time     time.Time       `json:"time"`
+  Priority messagePriority `json:"priority"`
+  NFiles   int             `json:"nfiles"`
+  Test     bool            `json:"test,omitempty"` // sent by "webhook test"
+}
+
+func makeWebhookEvent(msg *Message) webhookEvent {
+  return webhookEvent{
+    Event:    "message",
+    Id:       msg.IdString(),
+    From:     msg.from.address,
+    FromName: msg.from.name,
+    Subject:  msg.subject,
+    Time:     msg.time,
+    Priority: msg.priority,
+    NFiles:   len(msg.files),
+  }
+}
+
+// webhookQueue delivers events to a webhook, one at a time
+type webhookQueue struct {
+  hook *Webhook
+  ch   chan webhookEvent
+
+  mu      sync.Mutex
+  failing bool // an event was dropped; more failures are not logged until one succeeds
+  dropped int  // number of events dropped since failing was set
+}
+
+// startWebhooks makes new messages be POSTed to the webhooks of the config.
+// Requests are made in the background so that a slow webhook doesn't hold up indexing.
+func startWebhooks() {
+  if len(config.Webhooks) == 0 {
+    return
+  }
+  var wg sync.WaitGroup
+  var queues []*webhookQueue
+  for _, hook := range config.Webhooks {
+    q := &webhookQueue{hook: hook, ch: make(chan webhookEvent, webhookQueueSize)}
+    queues = append(queues, q)
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      q.run()
+    }()
+  }
+  msgsync.OnNewMessage(func(msg *Message) {
+    for _, q := range queues {
+      if q.hook.matches(msg) {
+        q.enqueue(makeWebhookEvent(msg))
+      }
+    }
+  })
+  RegisterExitHandler(func(ctx context.Context) error {
+    // note: queued events are sent until ctx is done
+    for _, q := range queues {
+      close(q.ch)
+    }
+    done := make(chan struct{})
+    go func() {
+      wg.Wait()
+      close(done)
+    }()
+    select {
+    case <-done:
+      return nil
+    case <-ctx.Done():
+      return ctx.Err()
+    }
+  }, "webhooks")
+  webhooklog.Debugf("%d %s", len(queues), plural(len(queues), "webhook", "webhooks"))
+}
+
+// matches returns true if the webhook is for messages like msg
+func (hook *Webhook) matches(msg *Message) bool {
+  return len(hook.From) == 0 || matchAddress(hook.From, msg.from.address)
+}
+
+func (q *webhookQueue) enqueue(ev webhookEvent) {
+  select {
+  case q.ch <- ev:
+  default:
+    q.fail(errorf("too many events queued"))
+  }
+}
+
+func (q *webhookQueue) run() {
+  for ev := range q.ch {
+    // while the webhook is failing, events are tried once so that the queue drains quickly
+    q.mu.Lock()
+    retries := len(webhookRetryDelays)
+    if q.failing {
+      retries = 0
+    }
+    q.mu.Unlock()
+    var err error
+    for attempt := 0; ; attempt++ {
+      if err = postWebhook(q.hook, &ev); err == nil || attempt == retries {
+        break
+      }
+      if _, ok := err.(permanentError); ok {
+        break
+      }
+      webhooklog.Debugf("%s: %v (retrying in %s)", q.hook.Name, err, webhookRetryDelays[attempt])
+      time.Sleep(webhookRetryDelays[attempt])
+    }
+    if err != nil {
+      q.fail(err)
+      continue
+    }
+    q.mu.Lock()
+    if q.failing {
+      logger.Infof("webhook %s is working again; %d %s were not sent",
+        q.hook.Name, q.dropped, plural(q.dropped, "event", "events"))
+      q.failing, q.dropped = false, 0
+    }
+    q.mu.Unlock()
+  }
+}
+
+// fail records that an event was dropped. Only the first failure of a burst is logged.
+func (q *webhookQueue) fail(err error) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  q.dropped++
+  if q.failing {
+    webhooklog.Debugf("%s: %v", q.hook.Name, err)
+    return
+  }
+  q.failing = true
+  errlog("webhook %s: %v (not logging more failures until it works again)", q.hook.Name, err)
+}
+
+// permanentError is a webhook failure which is not retried, like a 404 response
+type permanentError struct{ error }
+
+// postWebhook POSTs ev to hook. The body is signed with HMAC-SHA256 when the webhook has
+// a secret, in the header "X-Smsg-Signature: sha256=<hex>".
+func postWebhook(hook *Webhook, ev *webhookEvent) error {
+  body, err := json.Marshal(ev)
+  if err != nil {
+    return err
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+  defer cancel()
+  req, err := http.NewRequestWithContext(ctx, "POST", hook.URL, bytes.NewReader(body))
+  if err != nil {
+    return permanentError{err}
+  }
+  req.Header.Set("Content-Type", "application/json")
+  req.Header.Set("User-Agent", "smsg/"+VERSION)
+  req.Header.Set("X-Smsg-Event", ev.Event)
+  if hook.Secret != "" {
+    mac := hmac.New(sha256.New, []byte(hook.Secret))
+    mac.Write(body)
+    req.Header.Set("X-Smsg-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+  }
+  res, err := http.DefaultClient.Do(req)
+  if err != nil {
+    return err
+  }
+  defer res.Body.Close()
+  io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+  if res.StatusCode < 200 || res.StatusCode > 299 {
+    err = errorf("%s", res.Status)
+    // client errors won't go away by trying again, except for rate limiting
+    if res.StatusCode >= 400 && res.StatusCode < 500 &&
+      res.StatusCode != http.StatusTooManyRequests {
+      return permanentError{err}
+    }
+    return err
+  }
+  return nil
+}
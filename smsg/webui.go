@@ -0,0 +1,35 @@
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+  "embed"
+  "io/fs"
+  "net/http"
+)
+
+// webUIFiles are the files of the web UI, a static page which uses the HTTP API
+//go:embed webui
+var webUIFiles embed.FS
+
+// webUIHandler serves the web UI. It needs no auth since it's just static files; the user
+// pastes an API token into the page, which it uses for requests to the API.
+func webUIHandler() http.Handler {
+  files, err := fs.Sub(webUIFiles, "webui")
+  if err != nil {
+    panic(err)
+  }
+  fileServer := http.FileServer(http.FS(files))
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" && r.Method != "HEAD" {
+      w.Header().Set("Allow", "GET, HEAD")
+      http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+      return
+    }
+    h := w.Header()
+    h.Set("Content-Security-Policy",
+      "default-src 'self'; img-src 'self' blob:; object-src 'none'; frame-ancestors 'none'")
+    h.Set("X-Content-Type-Options", "nosniff")
+    h.Set("Referrer-Policy", "no-referrer")
+    fileServer.ServeHTTP(w, r)
+  })
+}
@@ -0,0 +1,324 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Web UI of "smsg serve". It uses the HTTP API at /v1 with the API token stored in
+// localStorage. Message content is only ever inserted as text, never as HTML.
+//
+// Routes (location.hash):
+//   #/?folder=inbox&q=&offset=0   message list
+//   #/m/{id}                      message
+"use strict"
+
+const PAGE_SIZE = 50
+const TOKEN_KEY = "smsg.token"
+
+const $ = (sel) => document.querySelector(sel)
+
+class AuthError extends Error {}
+
+function getToken() {
+  return localStorage.getItem(TOKEN_KEY) || ""
+}
+
+async function api(path) {
+  const headers = {}
+  const token = getToken()
+  if (token) {
+    headers["Authorization"] = "Bearer " + token
+  }
+  const res = await fetch(path, { headers })
+  if (res.status == 401) {
+    throw new AuthError((await res.json()).error)
+  }
+  if (!res.ok) {
+    let msg = res.statusText
+    try { msg = (await res.json()).error } catch (_) {}
+    throw new Error(msg)
+  }
+  return res
+}
+
+function el(tag, props, ...children) {
+  const e = document.createElement(tag)
+  Object.assign(e, props)
+  for (const c of children) {
+    e.append(c)
+  }
+  return e
+}
+
+function formatTime(s) {
+  const t = new Date(s)
+  const now = new Date()
+  if (t.toDateString() == now.toDateString()) {
+    return t.toLocaleTimeString([], { hour: "2-digit", minute: "2-digit" })
+  }
+  if (t.getFullYear() == now.getFullYear()) {
+    return t.toLocaleDateString([], { month: "short", day: "numeric" })
+  }
+  return t.toLocaleDateString()
+}
+
+function formatSize(n) {
+  if (n < 1024) {
+    return n + " B"
+  }
+  const units = ["kB", "MB", "GB"]
+  let i = -1
+  do {
+    n /= 1024
+    i++
+  } while (n >= 1024 && i < units.length - 1)
+  return n.toFixed(n < 10 ? 1 : 0) + " " + units[i]
+}
+
+function formatAddress(addr, name) {
+  return name ? `${name} <${addr}>` : addr
+}
+
+// appendLinkified appends text to parent, with http(s) URLs as links
+function appendLinkified(parent, text) {
+  const re = /\bhttps?:\/\/[^\s<>"]+[^\s<>".,;:!?)\]'}]/g
+  let start = 0
+  for (const m of text.matchAll(re)) {
+    parent.append(text.slice(start, m.index))
+    parent.append(el("a", {
+      href: m[0],
+      textContent: m[0],
+      target: "_blank",
+      rel: "noopener noreferrer",
+    }))
+    start = m.index + m[0].length
+  }
+  parent.append(text.slice(start))
+}
+
+// show makes one of the main sections visible
+function show(id) {
+  for (const s of ["#auth", "#list", "#message"]) {
+    $(s).hidden = s != id
+  }
+  $("#error").hidden = true
+  $("#signout").hidden = !getToken()
+}
+
+function showError(err) {
+  if (err instanceof AuthError) {
+    show("#auth")
+    if (getToken()) {
+      $("#error").textContent = err.message
+      $("#error").hidden = false
+    }
+    return
+  }
+  $("#error").textContent = err.message
+  $("#error").hidden = false
+}
+
+function listParams() {
+  const q = new URLSearchParams(location.hash.replace(/^#\/?\??/, ""))
+  return {
+    folder: q.get("folder") || "inbox",
+    q: q.get("q") || "",
+    offset: Math.max(0, parseInt(q.get("offset")) || 0),
+  }
+}
+
+function listHash(p) {
+  const q = new URLSearchParams({ folder: p.folder })
+  if (p.q) {
+    q.set("q", p.q)
+  }
+  if (p.offset) {
+    q.set("offset", p.offset)
+  }
+  return "#/?" + q
+}
+
+async function updateUnreadBadge() {
+  const res = await api("/v1/messages?folder=inbox&unread=1&limit=1")
+  const { total } = await res.json()
+  const badge = $("#unread-badge")
+  badge.textContent = total
+  badge.title = `${total} unread in inbox`
+  badge.hidden = total == 0
+}
+
+async function showList(p) {
+  $("#folder").value = p.folder
+  $("#search").q.value = p.q
+  const q = new URLSearchParams({ folder: p.folder, offset: p.offset, limit: PAGE_SIZE })
+  if (p.q) {
+    q.set("q", p.q)
+  }
+  const res = await api("/v1/messages?" + q)
+  const list = await res.json()
+  show("#list")
+
+  const tbody = el("tbody")
+  for (const m of list.messages) {
+    const subject = el("td", { className: "subject" }, m.subject || "(no subject)")
+    if (m.snippet) {
+      subject.append(el("span", { className: "snippet" }, " — " + m.snippet))
+    }
+    const tr = el("tr", { className: m.unread ? "unread" : "" },
+      el("td", { className: "dot", textContent: m.unread ? "●" : "" }),
+      el("td", { className: "from", title: m.from }, m.from_name || m.from),
+      subject,
+      el("td", { className: "time", title: new Date(m.time).toLocaleString() },
+        formatTime(m.time)))
+    tr.onclick = () => { location.hash = "#/m/" + m.id }
+    tbody.append(tr)
+  }
+  if (list.messages.length == 0) {
+    tbody.append(el("tr", {}, el("td", { colSpan: 4 }, "No messages")))
+  }
+  $("#list tbody").replaceWith(tbody)
+
+  const end = list.offset + list.messages.length
+  $("#range").textContent = list.total ? `${list.offset + 1}–${end} of ${list.total}` : ""
+  $("#prev").disabled = list.offset == 0
+  $("#next").disabled = end >= list.total
+  $("#prev").onclick = () => {
+    location.hash = listHash({ ...p, offset: Math.max(0, p.offset - PAGE_SIZE) })
+  }
+  $("#next").onclick = () => { location.hash = listHash({ ...p, offset: end }) }
+}
+
+async function showMessage(id) {
+  const res = await api("/v1/messages/" + encodeURIComponent(id))
+  const m = await res.json()
+  show("#message")
+  const article = $("#message")
+  article.querySelector(".subject").textContent = m.subject || "(no subject)"
+
+  const headers = el("dl", { className: "headers" })
+  const addHeader = (name, value) => {
+    if (value) {
+      headers.append(el("dt", {}, name), el("dd", {}, value))
+    }
+  }
+  addHeader("From", formatAddress(m.from, m.from_name))
+  addHeader("To", formatAddress(m.to, m.to_name))
+  addHeader("Cc", (m.cc || []).join(", "))
+  addHeader("Reply-To", m.reply_to)
+  addHeader("Date", new Date(m.time).toLocaleString())
+  addHeader("Folder", m.folder)
+  article.querySelector(".headers").replaceWith(headers)
+
+  const body = el("div", { className: "body" })
+  appendLinkified(body, m.body)
+  article.querySelector(".body").replaceWith(body)
+
+  const files = el("ul", { className: "files" })
+  m.files.forEach((f, i) => {
+    const a = el("a", { href: "#", textContent: f.name })
+    a.onclick = (ev) => {
+      ev.preventDefault()
+      downloadFile(m.id, i, f.name).catch(showError)
+    }
+    files.append(el("li", {}, a, el("span", { className: "size" }, " " + formatSize(f.size))))
+  })
+  article.querySelector(".files").replaceWith(files)
+}
+
+// downloadFile fetches a file of a message, which needs the Authorization header, and
+// saves it with a temporary link to the data
+async function downloadFile(id, n, name) {
+  const res = await api(`/v1/messages/${encodeURIComponent(id)}/files/${n}`)
+  const url = URL.createObjectURL(await res.blob())
+  const a = el("a", { href: url, download: name.split("/").pop() })
+  document.body.append(a)
+  a.click()
+  a.remove()
+  setTimeout(() => URL.revokeObjectURL(url), 10000)
+}
+
+// watchEvents reads the stream of new messages from /v1/events and refreshes the page
+// when one arrives. EventSource can't send an Authorization header, so fetch is used.
+let watchingEvents = false
+async function watchEvents() {
+  if (watchingEvents) {
+    return
+  }
+  watchingEvents = true
+  let lastId = ""
+  for (;;) {
+    try {
+      const res = await api("/v1/events" + (lastId ? "?since=" + lastId : ""))
+      const reader = res.body.pipeThrough(new TextDecoderStream()).getReader()
+      let buf = ""
+      for (;;) {
+        const { value, done } = await reader.read()
+        if (done) {
+          break
+        }
+        buf += value
+        let end
+        while ((end = buf.indexOf("\n\n")) != -1) {
+          const id = buf.slice(0, end).match(/^id: (.*)$/m)
+          buf = buf.slice(end + 2)
+          if (id) {
+            lastId = id[1]
+            onNewMessage()
+          }
+        }
+      }
+    } catch (err) {
+      if (err instanceof AuthError) {
+        watchingEvents = false
+        return
+      }
+    }
+    await new Promise((resolve) => setTimeout(resolve, 5000))
+  }
+}
+
+function onNewMessage() {
+  const p = listParams()
+  if (!$("#list").hidden && p.offset == 0 && !p.q) {
+    route()
+  } else {
+    updateUnreadBadge().catch(showError)
+  }
+}
+
+async function route() {
+  const m = location.hash.match(/^#\/m\/([^/?]+)/)
+  try {
+    if (m) {
+      await showMessage(decodeURIComponent(m[1]))
+    } else {
+      await showList(listParams())
+    }
+    await updateUnreadBadge()
+    watchEvents()
+  } catch (err) {
+    showError(err)
+  }
+}
+
+$("#folder").onchange = (ev) => {
+  location.hash = listHash({ folder: ev.target.value, q: listParams().q, offset: 0 })
+}
+
+$("#search").onsubmit = (ev) => {
+  ev.preventDefault()
+  const p = listParams()
+  location.hash = listHash({ folder: p.folder, q: ev.target.q.value.trim(), offset: 0 })
+}
+
+$("#auth").onsubmit = (ev) => {
+  ev.preventDefault()
+  localStorage.setItem(TOKEN_KEY, ev.target.token.value.trim())
+  ev.target.reset()
+  route()
+}
+
+$("#signout").onclick = () => {
+  localStorage.removeItem(TOKEN_KEY)
+  $("#unread-badge").hidden = true
+  route()
+}
+
+window.onhashchange = route
+route()